@@ -13,6 +13,7 @@ class IPBlocker:
     """Handles adding/removing IPs from Redis blocklist with auto-expiry."""
     
     BLOCKLIST_PREFIX = "blocklist:ip:"
+    SCORE_PREFIX = "aegis:score:ip:"
     STATS_KEY = "aegis:stats:blocked_ips"
     
     def __init__(self, redis_url: str, default_ttl: int = 300):
@@ -56,7 +57,8 @@ class IPBlocker:
         ip: str,
         reason: str = "anomaly_detected",
         score: float = 0.0,
-        ttl: Optional[int] = None
+        ttl: Optional[int] = None,
+        request_id: str = ""
     ) -> bool:
         """
         Block an IP address.
@@ -66,6 +68,7 @@ class IPBlocker:
             reason: Reason for blocking
             score: Anomaly score that triggered the block
             ttl: Block duration in seconds (uses default if not specified)
+            request_id: Proxy request ID of the latest request scored
         
         Returns:
             True if successfully blocked, False otherwise
@@ -75,7 +78,7 @@ class IPBlocker:
         
         key = f"{self.BLOCKLIST_PREFIX}{ip}"
         timestamp = time.strftime("%Y-%m-%d %H:%M:%S")
-        value = f'{{"reason": "{reason}", "score": {score:.4f}, "blocked_at": "{timestamp}"}}'
+        value = f'{{"reason": "{reason}", "score": {score:.4f}, "blocked_at": "{timestamp}", "request_id": "{request_id}"}}'
         
         try:
             # SETEX: Set with expiration
@@ -95,6 +98,32 @@ class IPBlocker:
             logger.error(f"Failed to block IP {ip}: {e}")
             return False
     
+    def record_score(self, ip: str, risk: float, decision: str, ttl: Optional[int] = None) -> bool:
+        """
+        Cache the latest risk score for an IP so the proxy can annotate requests.
+        
+        Args:
+            ip: IP address that was scored
+            risk: Normalized risk score (0 = benign, 1 = malicious)
+            decision: Suggested action ("allow", "challenge" or "block")
+            ttl: Cache duration in seconds (uses default if not specified)
+        
+        Returns:
+            True if successfully stored, False otherwise
+        """
+        if ttl is None:
+            ttl = self.default_ttl
+        
+        key = f"{self.SCORE_PREFIX}{ip}"
+        value = f'{{"score": {risk:.4f}, "decision": "{decision}"}}'
+        
+        try:
+            self.client.setex(key, ttl, value)
+            return True
+        except redis.RedisError as e:
+            logger.error(f"Failed to record score for IP {ip}: {e}")
+            return False
+    
     def unblock_ip(self, ip: str) -> bool:
         """
         Unblock an IP address.
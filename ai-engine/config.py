@@ -16,10 +16,19 @@ class Config:
     kafka_topic: str
     kafka_group_id: str
     
+    # Feedback labels for retraining (empty topic disables)
+    feedback_topic: str
+    feedback_group_id: str
+    labels_path: str
+    
     # Redis
     redis_url: str
     block_ttl_seconds: int
     
+    # Verdict push (gRPC, one host:port per proxy)
+    verdict_push_targets: List[str]
+    verdict_push_token: str
+    
     # Model
     model_path: str
     
@@ -38,8 +47,13 @@ class Config:
             kafka_brokers=os.getenv("KAFKA_BROKERS", "localhost:9092").split(","),
             kafka_topic=os.getenv("KAFKA_TOPIC", "request-logs"),
             kafka_group_id=os.getenv("KAFKA_GROUP_ID", "ai-engine-group"),
+            feedback_topic=os.getenv("KAFKA_FEEDBACK_TOPIC", "aegis-feedback"),
+            feedback_group_id=os.getenv("FEEDBACK_GROUP_ID", "ai-engine-feedback"),
+            labels_path=os.getenv("LABELS_PATH", "data/labels.jsonl"),
             redis_url=os.getenv("REDIS_URL", "localhost:6379"),
             block_ttl_seconds=int(os.getenv("BLOCK_TTL_SECONDS", "300")),
+            verdict_push_targets=[t for t in os.getenv("VERDICT_PUSH_TARGETS", "").split(",") if t],
+            verdict_push_token=os.getenv("VERDICT_PUSH_TOKEN", ""),
             model_path=os.getenv("MODEL_PATH", "models/xgboost_final.joblib"),
             window_size_seconds=int(os.getenv("WINDOW_SIZE_SECONDS", "5")),
             anomaly_threshold=float(os.getenv("ANOMALY_THRESHOLD", "-0.5")),
@@ -28,6 +28,7 @@ class RequestLog:
     request_size: int
     response_size: int
     features: Optional[dict] = None  # Pre-calculated features from the proxy
+    request_id: str = ""  # Ties the log to the proxy's log lines and traces
 
 
 @dataclass
@@ -35,6 +36,7 @@ class IPFeatures:
     """Maintains feature state for a specific client IP."""
     ip: str
     latest_features: Optional[dict] = None
+    last_request_id: str = ""
     
     def to_vector(self) -> np.ndarray:
         """
@@ -108,6 +110,7 @@ class FeatureEngine:
                 request_size=log_data.get("request_size", 0),
                 response_size=log_data.get("response_size", 0),
                 features=log_data.get("features"),
+                request_id=log_data.get("request_id", ""),
             )
         except Exception as e:
             logger.debug(f"Log parsing failed: {e} | Data: {str(log_data)[:100]}...")
@@ -123,6 +126,8 @@ class FeatureEngine:
         # We just need to persist the latest snapshot for inference.
         if log.features:
             self.ip_features[ip].latest_features = log.features
+        if log.request_id:
+            self.ip_features[ip].last_request_id = log.request_id
     
     def get_features(self) -> Dict[str, np.ndarray]:
         """Returns the current feature vectors for all active IPs."""
@@ -135,6 +140,11 @@ class FeatureEngine:
         """Clears current state (called at the start of a window)."""
         self.ip_features.clear()
     
+    def last_request_id(self, ip: str) -> str:
+        """Returns the ID of the IP's latest request in the window, if known."""
+        features = self.ip_features.get(ip)
+        return features.last_request_id if features else ""
+    
     def get_stats(self) -> Dict[str, int]:
         """Returns metadata about the current window state."""
         return {
@@ -0,0 +1,112 @@
+"""Kafka consumer recording labeled examples from the feedback topic for retraining."""
+
+import json
+import logging
+import os
+import threading
+import time
+from typing import List, Optional
+
+from kafka import KafkaConsumer
+from kafka.errors import KafkaError
+
+logger = logging.getLogger(__name__)
+
+# Labels the proxy publishes: operator feedback and decoy hits
+KNOWN_LABELS = {"false_positive", "false_negative", "honeypot"}
+
+
+class FeedbackRecorder:
+    """Appends every label on the feedback topic to a JSON Lines file.
+
+    Operators label decisions through the proxy's /admin/feedback, and
+    honeypot hits are labeled by default on the same topic. The retraining
+    pipeline reads the file as its labeled set.
+    """
+
+    def __init__(self, brokers: List[str], topic: str, group_id: str, labels_path: str):
+        """
+        Initialize the recorder.
+
+        Args:
+            brokers: List of Kafka broker addresses
+            topic: Feedback topic to consume from
+            group_id: Consumer group ID, separate from the detection loop's
+            labels_path: JSON Lines file the labels are appended to
+        """
+        self.brokers = brokers
+        self.topic = topic
+        self.group_id = group_id
+        self.labels_path = labels_path
+        self.consumer: Optional[KafkaConsumer] = None
+        self.running = False
+        self.thread: Optional[threading.Thread] = None
+
+    def start(self) -> None:
+        """Connect to Kafka and record labels in the background."""
+        logger.info(f"Recording feedback labels from topic {self.topic} to {self.labels_path}")
+        directory = os.path.dirname(self.labels_path)
+        if directory:
+            os.makedirs(directory, exist_ok=True)
+
+        # Labels are rare and each one counts, so start from the earliest
+        # offset the group hasn't committed
+        self.consumer = KafkaConsumer(
+            self.topic,
+            bootstrap_servers=self.brokers,
+            group_id=self.group_id,
+            auto_offset_reset="earliest",
+            enable_auto_commit=False,
+        )
+        self.running = True
+        self.thread = threading.Thread(target=self._run, name="feedback", daemon=True)
+        self.thread.start()
+
+    def _run(self) -> None:
+        while self.running:
+            try:
+                batch = self.consumer.poll(timeout_ms=1000)
+                records = [m.value for messages in batch.values() for m in messages]
+                if not records:
+                    continue
+                recorded = self.record(records)
+                # Commit only once the labels are on disk
+                self.consumer.commit()
+                if recorded:
+                    logger.info(f"Recorded {recorded} feedback labels")
+            except KafkaError as e:
+                logger.error(f"Kafka error: {e}")
+                time.sleep(1)
+            except Exception as e:
+                logger.error(f"Failed to record feedback labels: {e}")
+                time.sleep(1)
+
+    def record(self, records: List[bytes]) -> int:
+        """Append the valid labels among raw messages, returning how many were kept."""
+        lines = []
+        for value in records:
+            try:
+                event = json.loads(value.decode("utf-8"))
+            except (ValueError, UnicodeDecodeError) as e:
+                logger.warning(f"Ignoring malformed feedback message: {e}")
+                continue
+            if not isinstance(event, dict) or event.get("label") not in KNOWN_LABELS or not event.get("client_ip"):
+                logger.warning(f"Ignoring feedback without a known label and client: {event}")
+                continue
+            lines.append(json.dumps(event, separators=(",", ":")))
+
+        if lines:
+            with open(self.labels_path, "a", encoding="utf-8") as f:
+                f.write("\n".join(lines) + "\n")
+                f.flush()
+                os.fsync(f.fileno())
+        return len(lines)
+
+    def stop(self) -> None:
+        """Stop recording."""
+        self.running = False
+        if self.thread:
+            self.thread.join(timeout=5)
+        if self.consumer:
+            self.consumer.close()
+            logger.info("Feedback consumer closed")
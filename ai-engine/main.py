@@ -15,6 +15,8 @@ from consumer import RequestLogConsumer
 from features import FeatureEngine
 from detector import AnomalyDetector
 from blocker import IPBlocker
+from pusher import VerdictPusher
+from labels import FeedbackRecorder
 
 # Configure standard logging
 logging.basicConfig(
@@ -39,6 +41,8 @@ class AegisEngine:
         self.feature_engine: FeatureEngine = None
         self.detector: AnomalyDetector = None
         self.blocker: IPBlocker = None
+        self.pusher: VerdictPusher = None
+        self.feedback: FeedbackRecorder = None
         
     def initialize(self) -> None:
         """Sets up all subsystems (Kafka, Redis, Models)."""
@@ -62,7 +66,25 @@ class AegisEngine:
                 default_ttl=self.config.block_ttl_seconds,
             )
             
-            # 4. Kafka Consumer
+            # 4. Verdict push to the proxies (optional)
+            if self.config.verdict_push_targets:
+                self.pusher = VerdictPusher(
+                    targets=self.config.verdict_push_targets,
+                    token=self.config.verdict_push_token,
+                    default_ttl=self.config.block_ttl_seconds,
+                )
+            
+            # 5. Feedback labels for retraining (optional)
+            if self.config.feedback_topic:
+                self.feedback = FeedbackRecorder(
+                    brokers=self.config.kafka_brokers,
+                    topic=self.config.feedback_topic,
+                    group_id=self.config.feedback_group_id,
+                    labels_path=self.config.labels_path,
+                )
+                self.feedback.start()
+            
+            # 6. Kafka Consumer
             self.consumer = RequestLogConsumer(
                 brokers=self.config.kafka_brokers,
                 topic=self.config.kafka_topic,
@@ -115,15 +137,33 @@ class AegisEngine:
             # DIAGNOSTIC: Log every score to prove AI is used
             logger.info(f"Analyzed IP {ip} -> Score: {score:.4f} (Anomaly: {is_anomaly})")
             
+            # Share the normalized risk with the proxy (lower raw score = riskier)
+            risk = min(max(-score, 0.0), 1.0)
+            self.blocker.record_score(
+                ip=ip,
+                risk=risk,
+                decision="block" if is_anomaly else "allow",
+            )
+            
             if is_anomaly:
-                logger.warning(f"THREAT DETECTED [IP: {ip}] Score: {score:.4f}")
+                request_id = self.feature_engine.last_request_id(ip)
+                logger.warning(f"THREAT DETECTED [IP: {ip}] Score: {score:.4f} (request_id={request_id})")
                 
                 # 4. Mitigate
                 self.blocker.block_ip(
                     ip=ip,
                     reason="ai_anomaly_detection",
                     score=score,
+                    request_id=request_id,
                 )
+                if self.pusher:
+                    self.pusher.push(
+                        ip=ip,
+                        action="block",
+                        score=risk,
+                        reason="ai_anomaly_detection",
+                        request_id=request_id,
+                    )
     
     def run(self) -> None:
         """Starts the main event loop."""
@@ -149,6 +189,10 @@ class AegisEngine:
             self.consumer.stop()
         if self.blocker:
             self.blocker.close()
+        if self.pusher:
+            self.pusher.close()
+        if self.feedback:
+            self.feedback.stop()
             
         logger.info("Shutdown complete.")
 
@@ -0,0 +1,105 @@
+"""Pushes verdicts to each proxy over a gRPC stream (aegis.verdicts.v1)."""
+
+import logging
+import queue
+import struct
+import threading
+import time
+from typing import Iterator, List, Optional
+
+import grpc
+
+logger = logging.getLogger(__name__)
+
+PUSH_METHOD = "/aegis.verdicts.v1.VerdictPush/Push"
+
+
+def _varint(value: int) -> bytes:
+    out = bytearray()
+    value &= (1 << 64) - 1
+    while value >= 0x80:
+        out.append((value & 0x7F) | 0x80)
+        value >>= 7
+    out.append(value)
+    return bytes(out)
+
+
+def _string_field(num: int, value: str) -> bytes:
+    data = value.encode()
+    return _varint(num << 3 | 2) + _varint(len(data)) + data
+
+
+def encode_verdict(ip: str, action: str, score: float, reason: str, ttl: int, request_id: str = "") -> bytes:
+    """Encodes an aegis.verdicts.v1.Verdict (see proxy/verdictpush/verdicts.proto)."""
+    msg = _string_field(1, ip) + _string_field(2, action)
+    msg += _varint(3 << 3 | 1) + struct.pack("<d", score)
+    if reason:
+        msg += _string_field(4, reason)
+    if ttl:
+        msg += _varint(5 << 3) + _varint(ttl)
+    if request_id:
+        msg += _string_field(6, request_id)
+    return msg
+
+
+class _Stream:
+    """One long-lived Push stream to a proxy, reopened when it fails."""
+
+    def __init__(self, target: str, token: str):
+        self.target = target
+        self.metadata = [("authorization", f"Bearer {token}")] if token else []
+        self.queue: "queue.Queue[Optional[bytes]]" = queue.Queue(maxsize=10000)
+        self.thread = threading.Thread(target=self._run, name=f"push-{target}", daemon=True)
+        self.thread.start()
+
+    def _messages(self) -> Iterator[bytes]:
+        while True:
+            msg = self.queue.get()
+            if msg is None:
+                return
+            yield msg
+
+    def _run(self) -> None:
+        delay = 1
+        while True:
+            channel = grpc.insecure_channel(self.target)
+            push = channel.stream_unary(PUSH_METHOD)
+            try:
+                logger.info(f"Pushing verdicts to {self.target}")
+                push(self._messages(), metadata=self.metadata)
+                return  # closed by stop()
+            except grpc.RpcError as e:
+                logger.warning(f"Verdict stream to {self.target} failed: {e.code()}; retrying in {delay}s")
+            finally:
+                channel.close()
+            time.sleep(delay)
+            delay = min(delay * 2, 30)
+
+    def send(self, msg: bytes) -> None:
+        try:
+            self.queue.put_nowait(msg)
+        except queue.Full:
+            logger.warning(f"Verdict queue for {self.target} is full, dropping verdict")
+
+    def stop(self) -> None:
+        self.queue.put(None)
+        self.thread.join(timeout=5)
+
+
+class VerdictPusher:
+    """Streams verdicts to every proxy, so blocks apply without waiting for Redis."""
+
+    def __init__(self, targets: List[str], token: str = "", default_ttl: int = 300):
+        self.default_ttl = default_ttl
+        self.streams = [_Stream(t, token) for t in targets]
+
+    def push(
+        self, ip: str, action: str, score: float = 0.0, reason: str = "", ttl: Optional[int] = None, request_id: str = ""
+    ) -> None:
+        msg = encode_verdict(ip, action, score, reason, ttl or self.default_ttl, request_id)
+        for stream in self.streams:
+            stream.send(msg)
+
+    def close(self) -> None:
+        for stream in self.streams:
+            stream.stop()
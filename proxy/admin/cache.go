@@ -0,0 +1,52 @@
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// purgeRequest is the body of POST /admin/cache/purge.
+type purgeRequest struct {
+	Host   string `json:"host"`   // Host whose responses are purged; empty purges every host
+	Prefix string `json:"prefix"` // Path prefix; empty purges everything
+}
+
+// handleCachePurge serves POST /admin/cache/purge, removing cached responses
+// of a host under a path prefix, e.g. after a deploy changed them.
+func (s *Server) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Cache == nil {
+		writeError(w, http.StatusNotFound, "cache is disabled")
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req purgeRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+	}
+	if req.Prefix != "" && req.Prefix[0] != '/' {
+		writeError(w, http.StatusBadRequest, "prefix must start with /")
+		return
+	}
+	if strings.ContainsAny(req.Host, "/|") {
+		writeError(w, http.StatusBadRequest, "invalid host")
+		return
+	}
+
+	purged, err := s.opts.Cache.Purge(r.Context(), req.Host, req.Prefix)
+	if err != nil {
+		log.Printf("[Admin] Failed to purge cache under %q: %v", req.Host+req.Prefix, err)
+		writeError(w, http.StatusInternalServerError, "failed to purge cache")
+		return
+	}
+	log.Printf("[Admin] Purged %d cached responses under %q", purged, req.Host+req.Prefix)
+	writeJSON(w, http.StatusOK, map[string]int{"purged": purged})
+}
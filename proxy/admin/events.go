@@ -0,0 +1,194 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// streamEvent is an audit event or scoring decision, with the fields
+// subscribers filter on.
+type streamEvent struct {
+	kind     string // "audit" or "decision"
+	clientIP string
+	subject  string
+	tenant   string
+	path     string
+	score    *float64
+	payload  interface{}
+}
+
+// eventFilter selects the events a subscriber receives. Empty fields match
+// everything.
+type eventFilter struct {
+	kind     string
+	clientIP string
+	subject  string
+	tenant   string
+	route    string // Path prefix
+	minScore *float64
+}
+
+func (f *eventFilter) match(ev *streamEvent) bool {
+	switch {
+	case f.kind != "" && ev.kind != f.kind,
+		f.clientIP != "" && ev.clientIP != f.clientIP,
+		f.subject != "" && ev.subject != f.subject,
+		f.tenant != "" && ev.tenant != f.tenant,
+		f.route != "" && !strings.HasPrefix(ev.path, f.route),
+		f.minScore != nil && (ev.score == nil || *ev.score < *f.minScore):
+		return false
+	}
+	return true
+}
+
+// EventStream fans audit events and scoring decisions out to connected admin
+// clients. Slow clients miss events rather than holding up requests.
+type EventStream struct {
+	mu      sync.RWMutex
+	clients map[chan *streamEvent]*eventFilter
+	count   atomic.Int32
+}
+
+// NewEventStream creates an event stream with no clients.
+func NewEventStream() *EventStream {
+	return &EventStream{clients: make(map[chan *streamEvent]*eventFilter)}
+}
+
+// Publish sends an audit event to interested clients without blocking.
+func (es *EventStream) Publish(ev middleware.AuditEvent) {
+	if es.count.Load() == 0 {
+		return
+	}
+	se := &streamEvent{kind: "audit", clientIP: ev.ClientIP, subject: ev.Subject, tenant: ev.Tenant, path: ev.Path, payload: ev}
+	if ev.Decision != nil {
+		se.score = &ev.Decision.Score
+	}
+	es.publish(se)
+}
+
+// PublishScore sends a scoring decision to interested clients without
+// blocking; subscribe it to the scoring stage.
+func (es *EventStream) PublishScore(ev middleware.ScoreEvent) {
+	if es.count.Load() == 0 {
+		return
+	}
+	es.publish(&streamEvent{kind: "decision", clientIP: ev.ClientIP, subject: ev.Subject, tenant: ev.Tenant, path: ev.Path, score: &ev.Score, payload: ev})
+}
+
+func (es *EventStream) publish(ev *streamEvent) {
+	es.mu.RLock()
+	defer es.mu.RUnlock()
+	for ch, filter := range es.clients {
+		if !filter.match(ev) {
+			continue
+		}
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+func (es *EventStream) subscribe(filter *eventFilter) chan *streamEvent {
+	ch := make(chan *streamEvent, 256)
+	es.mu.Lock()
+	es.clients[ch] = filter
+	es.mu.Unlock()
+	es.count.Add(1)
+	return ch
+}
+
+func (es *EventStream) unsubscribe(ch chan *streamEvent) {
+	es.mu.Lock()
+	delete(es.clients, ch)
+	es.mu.Unlock()
+	es.count.Add(-1)
+}
+
+// parseEventFilter reads the filter from ?type=audit|decision, ip, subject,
+// tenant, route (a path prefix) and min_score.
+func parseEventFilter(r *http.Request) (*eventFilter, error) {
+	q := r.URL.Query()
+	filter := &eventFilter{
+		kind:     q.Get("type"),
+		clientIP: q.Get("ip"),
+		subject:  q.Get("subject"),
+		tenant:   q.Get("tenant"),
+		route:    q.Get("route"),
+	}
+	if filter.kind != "" && filter.kind != "audit" && filter.kind != "decision" {
+		return nil, fmt.Errorf("type must be audit or decision")
+	}
+	if value := q.Get("min_score"); value != "" {
+		score, err := strconv.ParseFloat(value, 64)
+		if err != nil || score < 0 || score > 1 {
+			return nil, fmt.Errorf("min_score must be between 0 and 1")
+		}
+		filter.minScore = &score
+	}
+	return filter, nil
+}
+
+// handleEvents serves GET /admin/events: audit events and scoring decisions
+// as they happen, as server-sent events, until the client disconnects.
+// Query parameters narrow the stream; see parseEventFilter.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.opts.Events == nil {
+		writeError(w, http.StatusNotFound, "event streaming is disabled")
+		return
+	}
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	ch := s.opts.Events.subscribe(filter)
+	defer s.opts.Events.unsubscribe(ch)
+	log.Printf("[Admin] Event stream opened by %s (%s)", r.RemoteAddr, r.URL.RawQuery)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comments keep idle connections open through proxies
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-ch:
+			data, err := json.Marshal(ev.payload)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.kind, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,86 @@
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// Feedback labels an operator can attach to a past decision.
+const (
+	LabelFalsePositive = "false_positive"
+	LabelFalseNegative = "false_negative"
+)
+
+// FeedbackEvent is published to the feedback topic for model retraining.
+type FeedbackEvent struct {
+	Timestamp time.Time                  `json:"timestamp"`
+	ClientIP  string                     `json:"client_ip"`
+	Label     string                     `json:"label"`
+	Operator  string                     `json:"operator,omitempty"`
+	Note      string                     `json:"note,omitempty"`
+	Decision  *middleware.DecisionRecord `json:"decision,omitempty"`
+}
+
+// feedbackRequest is the body of POST /admin/feedback.
+type feedbackRequest struct {
+	ClientIP string `json:"client_ip"`
+	Label    string `json:"label"`
+	Operator string `json:"operator"`
+	Note     string `json:"note"`
+}
+
+// handleFeedback serves POST /admin/feedback: it labels the client's latest
+// decision and publishes it, with the decision's explanation, for retraining.
+func (s *Server) handleFeedback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var req feedbackRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body")
+		return
+	}
+	if req.ClientIP == "" {
+		writeError(w, http.StatusBadRequest, "client_ip is required")
+		return
+	}
+	if req.Label != LabelFalsePositive && req.Label != LabelFalseNegative {
+		writeError(w, http.StatusBadRequest, "label must be false_positive or false_negative")
+		return
+	}
+
+	// False negatives usually have no decision on record; that's fine
+	rec, err := s.opts.Decisions.Get(r.Context(), req.ClientIP)
+	if err != nil {
+		log.Printf("[Admin] Failed to load decision for %s: %v", req.ClientIP, err)
+	}
+
+	ev := FeedbackEvent{
+		Timestamp: time.Now().UTC(),
+		ClientIP:  req.ClientIP,
+		Label:     req.Label,
+		Operator:  req.Operator,
+		Note:      req.Note,
+		Decision:  rec,
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "failed to encode feedback")
+		return
+	}
+	if err := s.opts.Sink.Publish(s.opts.FeedbackTopic, ev.ClientIP, data); err != nil {
+		log.Printf("[Admin] Failed to publish feedback for %s: %v", ev.ClientIP, err)
+		writeError(w, http.StatusBadGateway, "failed to publish feedback")
+		return
+	}
+
+	log.Printf("[Admin] Feedback %s for %s by %q", ev.Label, ev.ClientIP, ev.Operator)
+	writeJSON(w, http.StatusAccepted, ev)
+}
@@ -0,0 +1,418 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// maxListed bounds the entries returned by list endpoints.
+const maxListed = 1000
+
+// blockRequest is the body of POST /admin/blocklist. Exactly one of
+// ClientIP and Subject is set.
+type blockRequest struct {
+	ClientIP   string `json:"client_ip"`
+	Subject    string `json:"subject"`
+	Reason     string `json:"reason"`
+	TTLSeconds int    `json:"ttl_seconds"` // 0 blocks permanently
+}
+
+// tenantContext scopes an operation to the tenant named by ?tenant=, if any.
+// It writes the error response and returns false for unknown tenants.
+func (s *Server) tenantContext(w http.ResponseWriter, r *http.Request) (context.Context, bool) {
+	name := r.URL.Query().Get("tenant")
+	if name == "" {
+		return r.Context(), true
+	}
+	if s.opts.Tenants == nil {
+		writeError(w, http.StatusBadRequest, "no tenants are configured")
+		return nil, false
+	}
+	tenant, ok := s.opts.Tenants.Lookup(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown tenant")
+		return nil, false
+	}
+	return middleware.WithTenant(r.Context(), tenant), true
+}
+
+// handleBlocklist serves GET /admin/blocklist, listing blocked clients and
+// subjects, and POST /admin/blocklist, blocking one. With ?tenant=, both
+// apply to that tenant's blocklist instead of the global one.
+func (s *Server) handleBlocklist(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Blocklist == nil {
+		writeError(w, http.StatusNotFound, "blocklist is disabled")
+		return
+	}
+	ctx, ok := s.tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := s.opts.Blocklist.List(ctx, maxListed)
+		if err != nil {
+			log.Printf("[Admin] Failed to list blocklist: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to list blocklist")
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+
+	case http.MethodPost:
+		var req blockRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if (req.ClientIP == "") == (req.Subject == "") {
+			writeError(w, http.StatusBadRequest, "exactly one of client_ip and subject is required")
+			return
+		}
+		if req.ClientIP != "" && net.ParseIP(req.ClientIP) == nil {
+			writeError(w, http.StatusBadRequest, "client_ip must be an IP address")
+			return
+		}
+		if req.TTLSeconds < 0 {
+			writeError(w, http.StatusBadRequest, "ttl_seconds must not be negative")
+			return
+		}
+		if req.Reason == "" {
+			req.Reason = "admin"
+		}
+
+		ttl := time.Duration(req.TTLSeconds) * time.Second
+		target, block := req.ClientIP, s.opts.Blocklist.Block
+		if req.Subject != "" {
+			target, block = "subject "+req.Subject, s.opts.Blocklist.BlockSubject
+		}
+		if err := block(ctx, req.ClientIP+req.Subject, req.Reason, ttl); err != nil {
+			log.Printf("[Admin] Failed to block %s: %v", target, err)
+			writeError(w, http.StatusInternalServerError, "failed to block client")
+			return
+		}
+		log.Printf("[Admin] Blocked %s (%s, ttl %ds)", target, req.Reason, req.TTLSeconds)
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "blocked"})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleBlocklistEntry serves GET and DELETE /admin/blocklist/<ip>.
+func (s *Server) handleBlocklistEntry(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Blocklist == nil {
+		writeError(w, http.StatusNotFound, "blocklist is disabled")
+		return
+	}
+	ip := strings.TrimPrefix(r.URL.Path, "/admin/blocklist/")
+	if ip == "" {
+		writeError(w, http.StatusBadRequest, "client IP is required")
+		return
+	}
+	ctx, ok := s.tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, err := s.opts.Blocklist.Get(ctx, ip)
+		if err != nil {
+			log.Printf("[Admin] Failed to load blocklist entry for %s: %v", ip, err)
+			writeError(w, http.StatusInternalServerError, "failed to load blocklist entry")
+			return
+		}
+		if entry == nil {
+			writeError(w, http.StatusNotFound, "client is not blocked")
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+
+	case http.MethodDelete:
+		removed, err := s.opts.Blocklist.Unblock(ctx, ip)
+		if err != nil {
+			log.Printf("[Admin] Failed to unblock %s: %v", ip, err)
+			writeError(w, http.StatusInternalServerError, "failed to unblock client")
+			return
+		}
+		if !removed {
+			writeError(w, http.StatusNotFound, "client is not blocked")
+			return
+		}
+		log.Printf("[Admin] Unblocked %s", ip)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "unblocked"})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleSubjectEntry serves GET and DELETE /admin/blocklist/subjects/<sub>.
+func (s *Server) handleSubjectEntry(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Blocklist == nil {
+		writeError(w, http.StatusNotFound, "blocklist is disabled")
+		return
+	}
+	subject := strings.TrimPrefix(r.URL.Path, "/admin/blocklist/subjects/")
+	if subject == "" {
+		writeError(w, http.StatusBadRequest, "subject is required")
+		return
+	}
+	ctx, ok := s.tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, err := s.opts.Blocklist.GetSubject(ctx, subject)
+		if err != nil {
+			log.Printf("[Admin] Failed to load blocklist entry for subject %s: %v", subject, err)
+			writeError(w, http.StatusInternalServerError, "failed to load blocklist entry")
+			return
+		}
+		if entry == nil {
+			writeError(w, http.StatusNotFound, "subject is not blocked")
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+
+	case http.MethodDelete:
+		removed, err := s.opts.Blocklist.UnblockSubject(ctx, subject)
+		if err != nil {
+			log.Printf("[Admin] Failed to unblock subject %s: %v", subject, err)
+			writeError(w, http.StatusInternalServerError, "failed to unblock subject")
+			return
+		}
+		if !removed {
+			writeError(w, http.StatusNotFound, "subject is not blocked")
+			return
+		}
+		log.Printf("[Admin] Unblocked subject %s", subject)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "unblocked"})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleFlows serves GET /admin/flows?window=5m: the tracked flows of
+// recently active clients, most recent first, optionally of one ?tenant=.
+func (s *Server) handleFlows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.opts.Flows == nil {
+		writeError(w, http.StatusNotFound, "flow tracking is disabled")
+		return
+	}
+
+	window := 5 * time.Minute
+	if value := r.URL.Query().Get("window"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			writeError(w, http.StatusBadRequest, "window must be a duration such as 5m")
+			return
+		}
+		window = d
+	}
+	limit := 100
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxListed {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 1000")
+			return
+		}
+		limit = n
+	}
+
+	writeJSON(w, http.StatusOK, s.opts.Flows.Recent(r.URL.Query().Get("tenant"), window, limit))
+}
+
+// handleFlow serves GET /admin/flows/<ip>: the tracked flow of one client,
+// within the ?tenant= namespace if given.
+func (s *Server) handleFlow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.opts.Flows == nil {
+		writeError(w, http.StatusNotFound, "flow tracking is disabled")
+		return
+	}
+
+	tenant := r.URL.Query().Get("tenant")
+	flow, ok := s.opts.Flows.Snapshot(middleware.FlowKey(tenant, strings.TrimPrefix(r.URL.Path, "/admin/flows/")))
+	if !ok {
+		writeError(w, http.StatusNotFound, "no flow tracked for client")
+		return
+	}
+	writeJSON(w, http.StatusOK, flow)
+}
+
+// handleEnforcement serves GET /admin/enforcement and PUT /admin/enforcement
+// with {"mode": "enforce"} or {"mode": "monitor"}. The change lasts until
+// the next config reload or restart.
+func (s *Server) handleEnforcement(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Enforcement == nil {
+		writeError(w, http.StatusNotFound, "enforcement control is disabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Mode string `json:"mode"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if req.Mode != "enforce" && req.Mode != "monitor" {
+			writeError(w, http.StatusBadRequest, "mode must be enforce or monitor")
+			return
+		}
+		if req.Mode == "enforce" && s.opts.KillSwitch.Engaged() {
+			writeError(w, http.StatusConflict, "the kill switch is engaged; release it to enforce")
+			return
+		}
+		s.opts.Enforcement.SetEnforcementMode(req.Mode)
+		log.Printf("[Admin] Enforcement mode set to %s by %s", req.Mode, r.RemoteAddr)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"mode": s.opts.Enforcement.EnforcementMode()})
+}
+
+// handleMaintenance serves GET /admin/maintenance and PUT /admin/maintenance
+// with {"enabled": true} or {"enabled": false}. The change lasts until the
+// next config reload or restart.
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Maintenance == nil {
+		writeError(w, http.StatusNotFound, "maintenance control is disabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || req.Enabled == nil {
+			writeError(w, http.StatusBadRequest, "body must be {\"enabled\": true|false}")
+			return
+		}
+		s.opts.Maintenance.SetMaintenance(*req.Enabled)
+		log.Printf("[Admin] Maintenance mode set to %t by %s", *req.Enabled, r.RemoteAddr)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"enabled": s.opts.Maintenance.Maintenance()})
+}
+
+// handleKillSwitch serves GET /admin/killswitch, the kill switch state and
+// its last change, POST /admin/killswitch with {"by": "alice", "reason":
+// "false positives on /login"}, engaging it for the whole fleet, and DELETE
+// /admin/killswitch, releasing it. "by" defaults to the client certificate's
+// common name.
+func (s *Server) handleKillSwitch(w http.ResponseWriter, r *http.Request) {
+	if s.opts.KillSwitch == nil {
+		writeError(w, http.StatusNotFound, "kill switch is disabled")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		state, err := s.opts.KillSwitch.State(r.Context())
+		if err != nil {
+			log.Printf("[Admin] Failed to read kill switch: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to read kill switch")
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+
+	case http.MethodPost, http.MethodDelete:
+		var req struct {
+			By     string `json:"by"`
+			Reason string `json:"reason"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+		}
+		if req.By == "" {
+			req.By = operator(r)
+		}
+		engage := r.Method == http.MethodPost
+		if engage && req.Reason == "" {
+			writeError(w, http.StatusBadRequest, "reason is required")
+			return
+		}
+
+		state, err := s.opts.KillSwitch.Set(r.Context(), engage, req.By, r.RemoteAddr, req.Reason)
+		if err != nil {
+			log.Printf("[Admin] Failed to set kill switch: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to set kill switch")
+			return
+		}
+		writeJSON(w, http.StatusOK, state)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// operator identifies the caller by client certificate, if it presented one.
+func operator(r *http.Request) string {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	return "unknown"
+}
+
+// handleDrain serves POST /admin/drain: health checks start failing so load
+// balancers move traffic away, while in-flight and new requests are served.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.opts.Drain == nil {
+		writeError(w, http.StatusNotFound, "draining is not available")
+		return
+	}
+	log.Printf("[Admin] Drain requested by %s", r.RemoteAddr)
+	s.opts.Drain()
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "draining"})
+}
+
+// handleShutdown serves POST /admin/shutdown: a graceful shutdown, as on SIGTERM.
+func (s *Server) handleShutdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.opts.Shutdown == nil {
+		writeError(w, http.StatusNotFound, "shutdown is not available")
+		return
+	}
+	log.Printf("[Admin] Shutdown requested by %s", r.RemoteAddr)
+	writeJSON(w, http.StatusAccepted, map[string]string{"status": "shutting down"})
+	s.opts.Shutdown()
+}
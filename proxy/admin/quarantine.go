@@ -0,0 +1,121 @@
+package admin
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// quarantineRequest is the body of POST /admin/quarantine.
+type quarantineRequest struct {
+	ClientIP   string `json:"client_ip"`
+	Reason     string `json:"reason"`
+	TTLSeconds int    `json:"ttl_seconds"` // 0 quarantines until released
+}
+
+// handleQuarantine serves GET /admin/quarantine, listing quarantined
+// clients, and POST /admin/quarantine, quarantining one. Like the blocklist,
+// both take ?tenant=.
+func (s *Server) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Blocklist == nil {
+		writeError(w, http.StatusNotFound, "blocklist is disabled")
+		return
+	}
+	ctx, ok := s.tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entries, err := s.opts.Blocklist.ListQuarantine(ctx, maxListed)
+		if err != nil {
+			log.Printf("[Admin] Failed to list quarantine: %v", err)
+			writeError(w, http.StatusInternalServerError, "failed to list quarantine")
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+
+	case http.MethodPost:
+		var req quarantineRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid JSON body")
+			return
+		}
+		if net.ParseIP(req.ClientIP) == nil {
+			writeError(w, http.StatusBadRequest, "client_ip must be an IP address")
+			return
+		}
+		if req.TTLSeconds < 0 {
+			writeError(w, http.StatusBadRequest, "ttl_seconds must not be negative")
+			return
+		}
+		if req.Reason == "" {
+			req.Reason = "admin"
+		}
+
+		ttl := time.Duration(req.TTLSeconds) * time.Second
+		if err := s.opts.Blocklist.Quarantine(ctx, req.ClientIP, req.Reason, ttl); err != nil {
+			log.Printf("[Admin] Failed to quarantine %s: %v", req.ClientIP, err)
+			writeError(w, http.StatusInternalServerError, "failed to quarantine client")
+			return
+		}
+		log.Printf("[Admin] Quarantined %s (%s, ttl %ds)", req.ClientIP, req.Reason, req.TTLSeconds)
+		writeJSON(w, http.StatusCreated, map[string]string{"status": "quarantined"})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleQuarantineEntry serves GET and DELETE /admin/quarantine/<ip>.
+func (s *Server) handleQuarantineEntry(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Blocklist == nil {
+		writeError(w, http.StatusNotFound, "blocklist is disabled")
+		return
+	}
+	ip := strings.TrimPrefix(r.URL.Path, "/admin/quarantine/")
+	if ip == "" {
+		writeError(w, http.StatusBadRequest, "client IP is required")
+		return
+	}
+	ctx, ok := s.tenantContext(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		entry, err := s.opts.Blocklist.GetQuarantine(ctx, ip)
+		if err != nil {
+			log.Printf("[Admin] Failed to load quarantine entry for %s: %v", ip, err)
+			writeError(w, http.StatusInternalServerError, "failed to load quarantine entry")
+			return
+		}
+		if entry == nil {
+			writeError(w, http.StatusNotFound, "client is not quarantined")
+			return
+		}
+		writeJSON(w, http.StatusOK, entry)
+
+	case http.MethodDelete:
+		removed, err := s.opts.Blocklist.Release(ctx, ip)
+		if err != nil {
+			log.Printf("[Admin] Failed to release %s: %v", ip, err)
+			writeError(w, http.StatusInternalServerError, "failed to release client")
+			return
+		}
+		if !removed {
+			writeError(w, http.StatusNotFound, "client is not quarantined")
+			return
+		}
+		log.Printf("[Admin] Released %s from quarantine", ip)
+		writeJSON(w, http.StatusOK, map[string]string{"status": "released"})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,245 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/cluster"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/handler"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// Options holds the dependencies exposed through the admin API.
+type Options struct {
+	// Token is the bearer token required on every admin request.
+	Token string
+	// ClientCNs, if set, also require a verified client certificate with
+	// one of these common names.
+	ClientCNs []string
+
+	Decisions  *middleware.DecisionStore
+	Aggregates *middleware.RiskAggregator
+	Blocklist  *middleware.BlocklistMiddleware
+	Flows      *middleware.FlowTracker
+	Events     *EventStream
+	// Tenants resolves ?tenant= on blocklist operations; nil without tenants.
+	Tenants *middleware.TenantResolver
+
+	// Sink and FeedbackTopic receive operator feedback for retraining.
+	Sink          middleware.EventSink
+	FeedbackTopic string
+
+	// Traffic returns live per-route and per-upstream statistics.
+	Traffic func() handler.TrafficReport
+	// Upstreams lists upstreams and drains them for backend deploys.
+	Upstreams UpstreamControl
+	// Cluster lists the replicas; nil without cluster coordination.
+	Cluster *cluster.Coordinator
+
+	// Config returns the configuration in effect, served redacted.
+	Config func() *config.Config
+
+	Enforcement EnforcementControl
+	Maintenance MaintenanceControl
+	KillSwitch  *middleware.KillSwitch
+	// Cache is purged through the admin API; nil without the cache stage.
+	Cache *middleware.ResponseCache
+	// Drain starts failing health checks; Shutdown stops the proxy gracefully.
+	Drain    func()
+	Shutdown func()
+}
+
+// EnforcementControl reads and switches the enforcement mode at runtime.
+type EnforcementControl interface {
+	EnforcementMode() string
+	SetEnforcementMode(mode string)
+}
+
+// UpstreamControl lists upstreams and routes and drains upstreams at runtime.
+type UpstreamControl interface {
+	Upstreams() []handler.UpstreamStatus
+	Drain(name string, draining bool) error
+	Routes() []handler.Route
+}
+
+// MaintenanceControl reads and switches maintenance mode at runtime.
+type MaintenanceControl interface {
+	Maintenance() bool
+	SetMaintenance(enabled bool)
+}
+
+// Server exposes operational endpoints under /admin/.
+type Server struct {
+	opts Options
+	mux  *http.ServeMux
+}
+
+// NewServer creates the admin API handler.
+func NewServer(opts Options) *Server {
+	s := &Server{opts: opts, mux: http.NewServeMux()}
+	s.mux.HandleFunc("/admin/decisions/", s.handleDecision)
+	s.mux.HandleFunc("/admin/feedback", s.handleFeedback)
+	s.mux.HandleFunc("/admin/heatmap", s.handleHeatmap)
+	s.mux.HandleFunc("/admin/stats", s.handleStats)
+	s.mux.HandleFunc("/admin/upstreams", s.handleUpstreams)
+	s.mux.HandleFunc("/admin/upstreams/", s.handleUpstream)
+	s.mux.HandleFunc("/admin/config", s.handleConfig)
+	s.mux.HandleFunc("/admin/blocklist", s.handleBlocklist)
+	s.mux.HandleFunc("/admin/blocklist/", s.handleBlocklistEntry)
+	s.mux.HandleFunc("/admin/flows", s.handleFlows)
+	s.mux.HandleFunc("/admin/flows/", s.handleFlow)
+	s.mux.HandleFunc("/admin/blocklist/subjects/", s.handleSubjectEntry)
+	s.mux.HandleFunc("/admin/quarantine", s.handleQuarantine)
+	s.mux.HandleFunc("/admin/quarantine/", s.handleQuarantineEntry)
+	s.mux.HandleFunc("/admin/events", s.handleEvents)
+	s.mux.HandleFunc("/admin/enforcement", s.handleEnforcement)
+	s.mux.HandleFunc("/admin/killswitch", s.handleKillSwitch)
+	s.mux.HandleFunc("/admin/maintenance", s.handleMaintenance)
+	s.mux.HandleFunc("/admin/cache/purge", s.handleCachePurge)
+	s.mux.HandleFunc("/admin/routes", s.handleRoutes)
+	s.mux.HandleFunc("/admin/cluster", s.handleCluster)
+	s.mux.HandleFunc("/admin/drain", s.handleDrain)
+	s.mux.HandleFunc("/admin/shutdown", s.handleShutdown)
+	return s
+}
+
+// ServeHTTP authenticates the caller and dispatches to the admin routes.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		log.Printf("[Admin] Unauthorized request from %s to %s", r.RemoteAddr, r.URL.Path)
+		writeError(w, http.StatusUnauthorized, "unauthorized")
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorized checks the bearer token in constant time and, if configured,
+// the client certificate's common name.
+func (s *Server) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || s.opts.Token == "" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(s.opts.Token)) != 1 {
+		return false
+	}
+	if len(s.opts.ClientCNs) == 0 {
+		return true
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	for _, allowed := range s.opts.ClientCNs {
+		if cn == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// handleDecision serves GET /admin/decisions/<ip>: the latest decision record
+// for a client, including the features that contributed most to it, or with
+// ?history its recent records, newest first.
+func (s *Server) handleDecision(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	ip := strings.TrimPrefix(r.URL.Path, "/admin/decisions/")
+	if ip == "" {
+		writeError(w, http.StatusBadRequest, "client IP is required")
+		return
+	}
+
+	if r.URL.Query().Has("history") {
+		records, err := s.opts.Decisions.History(r.Context(), ip)
+		if err != nil {
+			log.Printf("[Admin] Failed to load decisions for %s: %v", ip, err)
+			writeError(w, http.StatusInternalServerError, "failed to load decisions")
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"client_ip": ip, "decisions": records})
+		return
+	}
+
+	rec, err := s.opts.Decisions.Get(r.Context(), ip)
+	if err != nil {
+		log.Printf("[Admin] Failed to load decision for %s: %v", ip, err)
+		writeError(w, http.StatusInternalServerError, "failed to load decision")
+		return
+	}
+	if rec == nil {
+		writeError(w, http.StatusNotFound, "no decision recorded for client")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rec)
+}
+
+// handleHeatmap serves GET /admin/heatmap: rolling aggregates of scores and
+// blocks (top risky IPs and subjects, score distribution, blocks per minute).
+func (s *Server) handleHeatmap(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.opts.Aggregates == nil {
+		writeError(w, http.StatusNotFound, "aggregation is disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.opts.Aggregates.Snapshot())
+}
+
+// handleStats serves GET /admin/stats: request rate, error rate, latency
+// percentiles and in-flight requests per route and upstream over the last
+// minute.
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.opts.Traffic == nil {
+		writeError(w, http.StatusNotFound, "traffic statistics are disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.opts.Traffic())
+}
+
+// handleConfig serves GET /admin/config: the effective configuration, keyed
+// like the config file, with secrets redacted.
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.opts.Config == nil {
+		writeError(w, http.StatusNotFound, "configuration is not available")
+		return
+	}
+
+	redacted, err := s.opts.Config().Redacted()
+	if err != nil {
+		log.Printf("[Admin] Failed to render configuration: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to render configuration")
+		return
+	}
+	writeJSON(w, http.StatusOK, redacted)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[Admin] Failed to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
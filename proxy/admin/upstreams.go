@@ -0,0 +1,102 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/handler"
+)
+
+// handleUpstreams serves GET /admin/upstreams: every upstream, whether it is
+// draining and the requests it is serving.
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.opts.Upstreams == nil {
+		writeError(w, http.StatusNotFound, "upstream control is disabled")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.opts.Upstreams.Upstreams())
+}
+
+// handleRoutes serves GET /admin/routes: the host and path routes, such as
+// those of the ingress controller, in the order they are matched.
+func (s *Server) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.opts.Upstreams == nil {
+		writeError(w, http.StatusNotFound, "upstream control is disabled")
+		return
+	}
+	routes := s.opts.Upstreams.Routes()
+	if routes == nil {
+		routes = []handler.Route{}
+	}
+	writeJSON(w, http.StatusOK, routes)
+}
+
+// handleUpstream serves PUT /admin/upstreams/<host:port> with
+// {"draining": true} to stop sending it new requests, or false to return it
+// to service. The change lasts until the next config reload or restart.
+func (s *Server) handleUpstream(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Upstreams == nil {
+		writeError(w, http.StatusNotFound, "upstream control is disabled")
+		return
+	}
+	if r.Method != http.MethodPut {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/admin/upstreams/")
+	var req struct {
+		Draining *bool `json:"draining"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil || req.Draining == nil {
+		writeError(w, http.StatusBadRequest, "body must be {\"draining\": true|false}")
+		return
+	}
+
+	if err := s.opts.Upstreams.Drain(name, *req.Draining); err != nil {
+		status := http.StatusConflict
+		if errors.Is(err, handler.ErrUnknownUpstream) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, err.Error())
+		return
+	}
+	log.Printf("[Admin] Upstream %s draining set to %t by %s", name, *req.Draining, r.RemoteAddr)
+	for _, upstream := range s.opts.Upstreams.Upstreams() {
+		if upstream.Name == name {
+			writeJSON(w, http.StatusOK, upstream)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"draining": *req.Draining})
+}
+
+// handleCluster serves GET /admin/cluster: the replicas coordinating
+// through Redis, as of their last heartbeat.
+func (s *Server) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if s.opts.Cluster == nil {
+		writeError(w, http.StatusNotFound, "cluster coordination is disabled")
+		return
+	}
+	members, err := s.opts.Cluster.Members(r.Context())
+	if err != nil {
+		log.Printf("[Admin] Failed to list cluster members: %v", err)
+		writeError(w, http.StatusInternalServerError, "failed to list cluster members")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"node": s.opts.Cluster.Node(), "members": members})
+}
@@ -0,0 +1,87 @@
+// Package central pulls dynamic policy (route profiles, thresholds, rate
+// limits) from a store shared by a fleet of proxies, so a config push
+// reaches every replica within seconds.
+package central
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"time"
+)
+
+// Snapshot is the dynamic policy held in the store. Values are keyed like the
+// config file (e.g. "risk_block_threshold") and hold YAML or JSON values.
+type Snapshot struct {
+	Version int64
+	Values  map[string]string
+}
+
+// Source is a central config store.
+type Source interface {
+	// Load reads the current snapshot.
+	Load(ctx context.Context) (*Snapshot, error)
+	// Watch signals on changed when the store may have changed, until ctx
+	// is done or the watch fails.
+	Watch(ctx context.Context, changed chan<- struct{}) error
+	String() string
+}
+
+// watchRetry is the delay before re-establishing a failed watch.
+const watchRetry = 5 * time.Second
+
+// Run applies new snapshots from src, starting after current. Watch
+// notifications trigger a load immediately; polling every poll interval
+// covers missed notifications. Snapshots older than the applied version are
+// ignored, so a lagging replica of the store cannot roll the policy back.
+func Run(ctx context.Context, src Source, current *Snapshot, poll time.Duration, apply func(*Snapshot)) {
+	changed := make(chan struct{}, 1)
+	go func() {
+		for {
+			if err := src.Watch(ctx, changed); err != nil && ctx.Err() == nil {
+				log.Printf("[Central] Watch on %s failed, retrying: %v", src, err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetry):
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+
+		loadCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		next, err := src.Load(loadCtx)
+		cancel()
+		if err != nil {
+			log.Printf("[Central] Failed to read %s: %v", src, err)
+			continue
+		}
+		if current != nil && (next.Version < current.Version ||
+			next.Version == current.Version && reflect.DeepEqual(next.Values, current.Values)) {
+			continue
+		}
+
+		log.Printf("[Central] Version %d received from %s", next.Version, src)
+		apply(next)
+		current = next
+	}
+}
+
+// notify signals a change without blocking; one pending signal is enough.
+func notify(changed chan<- struct{}) {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
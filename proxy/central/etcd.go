@@ -0,0 +1,154 @@
+package central
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// EtcdSource reads the policy from the keys under an etcd prefix, through
+// etcd's v3 JSON gateway: "/aegis/config/risk_block_threshold" holds the
+// risk_block_threshold value. The snapshot version is the etcd revision.
+type EtcdSource struct {
+	endpoints []string
+	prefix    string
+	client    *http.Client // Load requests
+	stream    *http.Client // Long-lived watch requests
+}
+
+// NewEtcdSource creates a source for prefix on the given endpoints
+// (e.g. "http://etcd-0:2379"), tried in order.
+func NewEtcdSource(endpoints []string, prefix string) *EtcdSource {
+	return &EtcdSource{
+		endpoints: endpoints,
+		prefix:    prefix,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		stream:    &http.Client{},
+	}
+}
+
+type etcdRangeResponse struct {
+	Header struct {
+		Revision int64 `json:"revision,string"`
+	} `json:"header"`
+	Kvs []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"kvs"`
+}
+
+func (s *EtcdSource) Load(ctx context.Context) (*Snapshot, error) {
+	var lastErr error
+	for _, endpoint := range s.endpoints {
+		resp, err := s.post(ctx, s.client, endpoint+"/v3/kv/range", s.rangeRequest())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		var body etcdRangeResponse
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("invalid etcd range response: %w", err)
+		}
+
+		snapshot := &Snapshot{Version: body.Header.Revision, Values: make(map[string]string)}
+		for _, kv := range body.Kvs {
+			key, err := base64.StdEncoding.DecodeString(kv.Key)
+			if err != nil {
+				return nil, fmt.Errorf("invalid etcd key: %w", err)
+			}
+			value, err := base64.StdEncoding.DecodeString(kv.Value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid etcd value for %s: %w", key, err)
+			}
+			snapshot.Values[strings.TrimPrefix(string(key), s.prefix)] = string(value)
+		}
+		return snapshot, nil
+	}
+	return nil, lastErr
+}
+
+func (s *EtcdSource) Watch(ctx context.Context, changed chan<- struct{}) error {
+	var lastErr error
+	for _, endpoint := range s.endpoints {
+		resp, err := s.post(ctx, s.stream, endpoint+"/v3/watch", map[string]interface{}{"create_request": s.rangeRequest()})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		defer resp.Body.Close()
+
+		// The gateway streams one JSON object per watch response
+		dec := json.NewDecoder(resp.Body)
+		for {
+			var msg struct {
+				Result struct {
+					Events []json.RawMessage `json:"events"`
+				} `json:"result"`
+			}
+			if err := dec.Decode(&msg); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			if len(msg.Result.Events) > 0 {
+				notify(changed)
+			}
+		}
+	}
+	return lastErr
+}
+
+func (s *EtcdSource) String() string {
+	return "etcd prefix " + s.prefix
+}
+
+// rangeRequest selects every key under the prefix.
+func (s *EtcdSource) rangeRequest() map[string]string {
+	return map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(s.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(prefixEnd(s.prefix)),
+	}
+}
+
+func (s *EtcdSource) post(ctx context.Context, client *http.Client, url string, body interface{}) (*http.Response, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("etcd returned %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+// prefixEnd returns the smallest key greater than every key with the prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0}
+}
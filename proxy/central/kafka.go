@@ -0,0 +1,183 @@
+package central
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+
+	"github.com/IBM/sarama"
+)
+
+// KafkaSource reads the policy from a control topic the AI engine publishes
+// to, so the feedback loop can tune the proxy without a config push. Each
+// message is keyed by a config key and holds its value; an empty value
+// removes the key, and the "version" key carries the snapshot version, as
+// in a Redis hash. The topic is read from the start, so it should be
+// compacted rather than expire keys still in effect.
+type KafkaSource struct {
+	brokers []string
+	topic   string
+	updated chan struct{}
+
+	mu       sync.Mutex
+	started  bool
+	caughtUp chan struct{} // Closed once the topic is read up to startup
+	values   map[string]string
+	version  int64
+}
+
+// NewKafkaSource creates a source for topic on the given brokers.
+func NewKafkaSource(brokers []string, topic string) *KafkaSource {
+	return &KafkaSource{
+		brokers: brokers,
+		topic:   topic,
+		updated: make(chan struct{}, 1),
+		values:  make(map[string]string),
+	}
+}
+
+// Load returns the policy read from the topic, once the messages published
+// before the source started are read.
+func (s *KafkaSource) Load(ctx context.Context) (*Snapshot, error) {
+	caughtUp, err := s.start()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-caughtUp:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("reading topic %s: %w", s.topic, ctx.Err())
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot := &Snapshot{Version: s.version, Values: make(map[string]string, len(s.values))}
+	for key, value := range s.values {
+		snapshot.Values[key] = value
+	}
+	return snapshot, nil
+}
+
+// start connects and consumes every partition from its oldest message, on
+// first use or after a failed attempt.
+func (s *KafkaSource) start() (<-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return s.caughtUp, nil
+	}
+
+	config := sarama.NewConfig()
+	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	client, err := sarama.NewClient(s.brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	partitionIDs, err := consumer.Partitions(s.topic)
+	if err != nil {
+		consumer.Close()
+		client.Close()
+		return nil, err
+	}
+
+	var pending sync.WaitGroup
+	for _, id := range partitionIDs {
+		if err := s.consumePartition(client, consumer, id, &pending); err != nil {
+			consumer.Close()
+			client.Close()
+			return nil, err
+		}
+	}
+
+	s.caughtUp = make(chan struct{})
+	go func(caughtUp chan struct{}) {
+		pending.Wait()
+		close(caughtUp)
+	}(s.caughtUp)
+	s.started = true
+	log.Printf("[Central] Consuming %d partitions of control topic %s", len(partitionIDs), s.topic)
+	return s.caughtUp, nil
+}
+
+// consumePartition starts consuming a partition from its oldest message,
+// adding it to pending until the messages published before now are applied.
+func (s *KafkaSource) consumePartition(client sarama.Client, consumer sarama.Consumer, id int32, pending *sync.WaitGroup) error {
+	oldest, err := client.GetOffset(s.topic, id, sarama.OffsetOldest)
+	if err != nil {
+		return err
+	}
+	end, err := client.GetOffset(s.topic, id, sarama.OffsetNewest)
+	if err != nil {
+		return err
+	}
+	pc, err := consumer.ConsumePartition(s.topic, id, sarama.OffsetOldest)
+	if err != nil {
+		return err
+	}
+	if end <= oldest {
+		go s.consume(pc, 0, nil)
+		return nil
+	}
+	pending.Add(1)
+	go s.consume(pc, end, pending.Done)
+	return nil
+}
+
+// consume applies the messages of one partition, calling caughtUp once the
+// message before offset end is applied.
+func (s *KafkaSource) consume(pc sarama.PartitionConsumer, end int64, caughtUp func()) {
+	for msg := range pc.Messages() {
+		s.apply(string(msg.Key), string(msg.Value))
+		if end > 0 && msg.Offset >= end-1 {
+			caughtUp()
+			end = 0
+		}
+	}
+}
+
+// apply records one message and signals watchers.
+func (s *KafkaSource) apply(key, value string) {
+	if key == "" {
+		log.Printf("[Central] Ignoring control message without a key on %s", s.topic)
+		return
+	}
+	s.mu.Lock()
+	switch {
+	case key == versionField:
+		version, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			s.mu.Unlock()
+			log.Printf("[Central] Ignoring invalid %s %q on %s", versionField, value, s.topic)
+			return
+		}
+		s.version = version
+	case value == "":
+		delete(s.values, key)
+	default:
+		s.values[key] = value
+	}
+	s.mu.Unlock()
+	notify(s.updated)
+}
+
+func (s *KafkaSource) Watch(ctx context.Context, changed chan<- struct{}) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-s.updated:
+			notify(changed)
+		}
+	}
+}
+
+func (s *KafkaSource) String() string {
+	return "kafka topic " + s.topic
+}
@@ -0,0 +1,73 @@
+package central
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// versionField holds the snapshot version in the Redis hash.
+const versionField = "version"
+
+// RedisSource reads the policy from a Redis hash whose fields are config keys,
+// plus a "version" field. Pushers bump the version and publish to a channel
+// named like the hash, e.g.:
+//
+//	HSET aegis:config risk_block_threshold 0.85
+//	HINCRBY aegis:config version 1
+//	PUBLISH aegis:config updated
+type RedisSource struct {
+	client *redis.Client
+	key    string
+}
+
+// NewRedisSource creates a source for the hash at key.
+func NewRedisSource(client *redis.Client, key string) *RedisSource {
+	return &RedisSource{client: client, key: key}
+}
+
+func (s *RedisSource) Load(ctx context.Context) (*Snapshot, error) {
+	fields, err := s.client.HGetAll(ctx, s.key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{Values: make(map[string]string)}
+	for field, value := range fields {
+		if field == versionField {
+			if snapshot.Version, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid %s field %q", versionField, value)
+			}
+			continue
+		}
+		snapshot.Values[field] = value
+	}
+	return snapshot, nil
+}
+
+func (s *RedisSource) Watch(ctx context.Context, changed chan<- struct{}) error {
+	sub := s.client.Subscribe(ctx, s.key)
+	defer sub.Close()
+
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-messages:
+			if !ok {
+				return fmt.Errorf("subscription closed")
+			}
+			notify(changed)
+		}
+	}
+}
+
+func (s *RedisSource) String() string {
+	return "redis hash " + s.key
+}
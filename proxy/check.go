@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/openapi"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/secrets"
+)
+
+// checkTimeout bounds each connectivity check.
+const checkTimeout = 5 * time.Second
+
+// checkReport collects the results of a validation run.
+type checkReport struct {
+	failed bool
+}
+
+func (r *checkReport) ok(name, detail string) {
+	fmt.Printf("  OK    %-18s %s\n", name, detail)
+}
+
+func (r *checkReport) warn(name, detail string) {
+	fmt.Printf("  WARN  %-18s %s\n", name, detail)
+}
+
+func (r *checkReport) fail(name string, err error) {
+	r.failed = true
+	fmt.Printf("  FAIL  %-18s %v\n", name, err)
+}
+
+// runCheck loads and validates the configuration and verifies, without
+// writing anything, that TLS material, Redis and Kafka are usable.
+// It returns the process exit code: 0 if every check passed.
+func runCheck() int {
+	report := &checkReport{}
+	fmt.Println("Aegis Zero configuration check")
+
+	cfg, err := config.Load()
+	if err != nil {
+		report.fail("config", err)
+		fmt.Println("FAILED")
+		return 1
+	}
+	source := "environment"
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		source = path + " + environment"
+	}
+	report.ok("config", source)
+	report.ok("jwt public key", secrets.Redact(cfg.JWTPublicKeyPath))
+
+	if cfg.Discovered() {
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		if discovery, err := newDiscovery(cfg); err != nil {
+			report.fail("upstream discovery", err)
+		} else if urls, err := discovery.Resolve(ctx); err != nil {
+			report.fail("upstream discovery", fmt.Errorf("%s: %w", discovery, err))
+		} else {
+			report.ok("upstream discovery", fmt.Sprintf("%s: %v", discovery, urls))
+		}
+		cancel()
+	} else {
+		for _, upstream := range cfg.Upstreams() {
+			if u, err := url.Parse(upstream); err != nil || u.Scheme == "" || u.Host == "" && u.Scheme != "unix" {
+				report.fail("upstream", fmt.Errorf("invalid upstream URL %q", upstream))
+			} else {
+				report.ok("upstream", upstream)
+			}
+		}
+	}
+
+	if cfg.PagesDir != "" {
+		if _, err := pages.Load(cfg.PagesDir, cfg.SupportContact); err != nil {
+			report.fail("pages", err)
+		} else {
+			report.ok("pages", cfg.PagesDir)
+		}
+	}
+
+	for _, route := range cfg.RoutePolicies {
+		if route.OpenAPI == "" {
+			continue
+		}
+		if _, err := openapi.Load(route.OpenAPI); err != nil {
+			report.fail("openapi "+route.Prefix, err)
+		} else {
+			report.ok("openapi "+route.Prefix, route.OpenAPI)
+		}
+	}
+
+	checkTLS(report, cfg)
+	if cfg.ClockCheck != "" {
+		checkClock(report, cfg)
+	}
+	checkRedis(report, cfg)
+	if cfg.EventBus == "nats" {
+		checkNATS(report, cfg)
+	} else {
+		checkKafka(report, cfg)
+	}
+
+	if report.failed {
+		fmt.Println("FAILED")
+		return 1
+	}
+	fmt.Println("PASSED")
+	return 0
+}
+
+func checkTLS(report *checkReport, cfg *config.Config) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	material, err := loadTLSMaterial(ctx, cfg)
+	if err != nil {
+		report.fail("tls material", err)
+		return
+	}
+
+	checkCertificate(report, "tls certificate", material.cert.Load())
+	for _, v := range material.vhosts {
+		checkCertificate(report, "tls certificate "+v.name, v.cert.Load())
+	}
+	report.ok("ca certificate", secrets.Redact(cfg.CACertPath))
+}
+
+func checkCertificate(report *checkReport, name string, cert *tls.Certificate) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	switch {
+	case err != nil:
+		report.fail(name, err)
+	case time.Now().After(leaf.NotAfter):
+		report.fail(name, fmt.Errorf("expired on %s", leaf.NotAfter.Format(time.RFC3339)))
+	default:
+		report.ok(name, fmt.Sprintf("%s (expires %s)", leaf.Subject.CommonName, leaf.NotAfter.Format("2006-01-02")))
+	}
+}
+
+// checkClock compares the host clock with the clock check's source.
+func checkClock(report *checkReport, cfg *config.Config) {
+	clock := newClockMonitor(cfg.ClockCheck, cfg.JWTLeeway.Std())
+	clock.check(context.Background())
+	detail, err := clock.status(context.Background())
+	if err != nil {
+		report.fail("clock", err)
+		return
+	}
+	report.ok("clock", detail)
+}
+
+func checkRedis(report *checkReport, cfg *config.Config) {
+	client := redis.NewClient(&redis.Options{Addr: cfg.RedisURL})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		report.fail("redis", fmt.Errorf("%s: %w", cfg.RedisURL, err))
+		return
+	}
+	report.ok("redis", cfg.RedisURL)
+}
+
+// checkNATS connects to the servers and verifies that a JetStream stream
+// captures the subject of each configured topic.
+func checkNATS(report *checkReport, cfg *config.Config) {
+	sink, err := middleware.NewNATSSink(middleware.NATSOptions{
+		URLs:          cfg.NATSURLs,
+		SubjectPrefix: cfg.NATSSubjectPrefix,
+		Token:         cfg.NATSToken,
+		User:          cfg.NATSUser,
+		Password:      cfg.NATSPassword,
+		AckTimeout:    checkTimeout,
+	})
+	if err != nil {
+		report.fail("nats", fmt.Errorf("%v: %w", cfg.NATSURLs, err))
+		return
+	}
+	defer sink.Close()
+	report.ok("nats", fmt.Sprintf("%v", cfg.NATSURLs))
+
+	topics := []string{
+		cfg.KafkaTopic, cfg.KafkaFeaturesTopic, cfg.KafkaAuditTopic,
+		cfg.KafkaFeedbackTopic, cfg.KafkaHoneypotTopic, cfg.KafkaDLPTopic, cfg.KafkaDecisionsTopic,
+	}
+	for _, tenant := range cfg.Tenants {
+		topics = append(topics, tenant.AccessLogTopic, tenant.FeatureTopic)
+	}
+	seen := make(map[string]bool)
+	for _, topic := range topics {
+		if topic == "" || seen[topic] {
+			continue
+		}
+		seen[topic] = true
+		// Unlike Kafka topics, subjects without a stream lose their messages
+		if err := sink.Check(topic); err != nil {
+			report.fail("nats subject", err)
+			continue
+		}
+		report.ok("nats subject", cfg.NATSSubjectPrefix+topic)
+	}
+}
+
+// checkKafka connects to the brokers and looks up the configured topics.
+// Missing topics are warnings, since brokers may auto-create them.
+func checkKafka(report *checkReport, cfg *config.Config) {
+	saramaConfig := sarama.NewConfig()
+	saramaConfig.Net.DialTimeout = checkTimeout
+	saramaConfig.Metadata.Retry.Max = 1
+
+	client, err := sarama.NewClient(cfg.KafkaBrokers, saramaConfig)
+	if err != nil {
+		report.fail("kafka", fmt.Errorf("%v: %w", cfg.KafkaBrokers, err))
+		return
+	}
+	defer client.Close()
+	report.ok("kafka", fmt.Sprintf("%v", cfg.KafkaBrokers))
+
+	existing, err := client.Topics()
+	if err != nil {
+		report.fail("kafka topics", err)
+		return
+	}
+	known := make(map[string]bool, len(existing))
+	for _, topic := range existing {
+		known[topic] = true
+	}
+
+	topics := []string{
+		cfg.KafkaTopic, cfg.KafkaFeaturesTopic, cfg.KafkaAuditTopic, cfg.KafkaVerdictTopic,
+		cfg.KafkaFeedbackTopic, cfg.KafkaHoneypotTopic, cfg.KafkaDLPTopic, cfg.KafkaDecisionsTopic,
+	}
+	for _, tenant := range cfg.Tenants {
+		topics = append(topics, tenant.AccessLogTopic, tenant.FeatureTopic)
+	}
+
+	seen := make(map[string]bool)
+	for _, topic := range topics {
+		switch {
+		case topic == "" || seen[topic]:
+		case known[topic]:
+			report.ok("kafka topic", topic)
+		case topic == cfg.KafkaVerdictTopic:
+			// The consumer needs the topic's partitions at startup
+			report.fail("kafka topic", fmt.Errorf("verdicts topic %s does not exist", topic))
+		default:
+			report.warn("kafka topic", topic+" does not exist (requires auto-creation)")
+		}
+		seen[topic] = true
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+// clockCheckTimeout bounds each query of the clock source.
+const clockCheckTimeout = 5 * time.Second
+
+// ntpEpochOffset is the number of seconds from 1900, the NTP epoch, to 1970.
+const ntpEpochOffset = 2208988800
+
+var (
+	clockOffset = metrics.NewGaugeVec("aegis_clock_offset_seconds",
+		"Offset of the host clock from the clock check's source at the last check; positive when the host is behind.")
+	clockDrift = metrics.NewGaugeVec("aegis_clock_drift_exceeded",
+		"1 if the host clock drifted from the clock check's source by more than JWT_LEEWAY.")
+)
+
+// clockMonitor compares the host clock with a reference. Tokens are checked
+// against the host clock, so once it drifts beyond the JWT leeway, valid
+// tokens are refused as not yet valid or expired for every client at once.
+type clockMonitor struct {
+	source string // "ntp:host[:port]" or an http(s) URL whose Date is read
+	leeway time.Duration
+	client *http.Client
+
+	mu      sync.Mutex
+	offset  time.Duration
+	err     error
+	checked bool
+}
+
+func newClockMonitor(source string, leeway time.Duration) *clockMonitor {
+	return &clockMonitor{
+		source: source,
+		leeway: leeway,
+		client: &http.Client{Timeout: clockCheckTimeout},
+	}
+}
+
+// Run checks the clock now and then every interval until ctx is done.
+func (c *clockMonitor) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		c.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check measures the offset, logging when the drift crosses the leeway.
+func (c *clockMonitor) check(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, clockCheckTimeout)
+	defer cancel()
+	offset, err := c.measure(ctx)
+	offset = offset.Round(time.Millisecond)
+
+	c.mu.Lock()
+	wasDrifting := c.checked && c.err == nil && c.drifting(c.offset)
+	c.offset, c.err, c.checked = offset, err, true
+	c.mu.Unlock()
+
+	if err != nil {
+		log.Printf("[Clock] Check against %s failed: %v", c.source, err)
+		return
+	}
+	clockOffset.Set(offset.Seconds())
+	switch drifting := c.drifting(offset); {
+	case drifting:
+		clockDrift.Set(1)
+		log.Printf("[Clock] Host clock is off by %v from %s, beyond the JWT leeway of %v; tokens may be refused", offset, c.source, c.leeway)
+	case wasDrifting:
+		clockDrift.Set(0)
+		log.Printf("[Clock] Host clock back within %v of %s (off by %v)", c.leeway, c.source, offset)
+	default:
+		clockDrift.Set(0)
+	}
+}
+
+func (c *clockMonitor) drifting(offset time.Duration) bool {
+	return offset.Abs() > c.leeway
+}
+
+// status reports the last check, for readiness and aegis-proxy check.
+func (c *clockMonitor) status(context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case !c.checked:
+		return "", errors.New("not checked yet")
+	case c.err != nil:
+		return "", c.err
+	case c.drifting(c.offset):
+		return "", fmt.Errorf("off by %v from %s, beyond the leeway of %v", c.offset, c.source, c.leeway)
+	}
+	return fmt.Sprintf("off by %v from %s", c.offset, c.source), nil
+}
+
+// measure returns the offset of the host clock from the source.
+func (c *clockMonitor) measure(ctx context.Context) (time.Duration, error) {
+	if server, ok := strings.CutPrefix(c.source, "ntp:"); ok {
+		return ntpOffset(ctx, server)
+	}
+	return dateOffset(ctx, c.client, c.source)
+}
+
+// ntpOffset queries an NTP server with SNTP (RFC 4330).
+func ntpOffset(ctx context.Context, server string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := make([]byte, 48)
+	req[0] = 0x23 // Version 4, client mode
+	sent := time.Now()
+	binary.BigEndian.PutUint64(req[40:], toNTP(sent))
+	if _, err := conn.Write(req); err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	received := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case n < 48:
+		return 0, fmt.Errorf("short NTP response (%d bytes)", n)
+	case resp[0]&0x07 != 4:
+		return 0, errors.New("not an NTP server response")
+	case resp[1] == 0:
+		return 0, fmt.Errorf("NTP server refused the query (%s)", strings.TrimRight(string(resp[12:16]), "\x00"))
+	case binary.BigEndian.Uint64(resp[24:]) != binary.BigEndian.Uint64(req[40:]):
+		return 0, errors.New("NTP response doesn't answer the query")
+	}
+	serverReceived := fromNTP(binary.BigEndian.Uint64(resp[32:]))
+	serverSent := fromNTP(binary.BigEndian.Uint64(resp[40:]))
+	return (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2, nil
+}
+
+func toNTP(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / 1e9
+	return secs<<32 | frac
+}
+
+func fromNTP(ts uint64) time.Time {
+	secs := int64(ts>>32) - ntpEpochOffset
+	nanos := int64((ts & 0xffffffff) * 1e9 >> 32)
+	return time.Unix(secs, nanos)
+}
+
+// dateOffset reads the Date header of a HEAD request. Dates have whole
+// seconds, so the offset is only accurate to about half a second.
+func dateOffset(ctx context.Context, client *http.Client, url string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return 0, err
+	}
+	sent := time.Now()
+	resp, err := client.Do(req)
+	received := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, fmt.Errorf("no valid Date header: %w", err)
+	}
+	midpoint := sent.Add(received.Sub(sent) / 2)
+	return date.Add(500 * time.Millisecond).Sub(midpoint), nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// cloudMetadataTimeout bounds each metadata request. The services answer
+// in milliseconds on their cloud; elsewhere the address doesn't exist and
+// the request would hang until the dial timed out.
+const cloudMetadataTimeout = 2 * time.Second
+
+// Metadata service endpoints, reachable from any instance of the cloud.
+var (
+	awsMetadataURL = "http://169.254.169.254/latest"
+	gcpMetadataURL = "http://metadata.google.internal/computeMetadata/v1"
+)
+
+// detectCloud reads where the proxy runs from the metadata service of
+// provider: "aws", "gcp", or "auto" to try both. cluster, if set,
+// overrides the cluster name found.
+func detectCloud(ctx context.Context, provider, cluster string) (*middleware.CloudInfo, error) {
+	client := &http.Client{Timeout: cloudMetadataTimeout}
+	var info *middleware.CloudInfo
+	var err error
+	switch provider {
+	case "aws":
+		info, err = awsMetadata(ctx, client)
+	case "gcp":
+		info, err = gcpMetadata(ctx, client)
+	case "auto":
+		var awsErr error
+		if info, awsErr = awsMetadata(ctx, client); awsErr != nil {
+			info, err = gcpMetadata(ctx, client)
+			if err != nil {
+				err = fmt.Errorf("no metadata service found: aws: %v; gcp: %v", awsErr, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown cloud provider %q", provider)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cluster != "" {
+		info.Cluster = cluster
+	}
+	return info, nil
+}
+
+// awsMetadata reads the instance identity document through IMDSv2, and the
+// EKS cluster from the instance's tags when they are exposed in metadata.
+func awsMetadata(ctx context.Context, client *http.Client) (*middleware.CloudInfo, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, awsMetadataURL+"/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := metadataGet(client, req)
+	if err != nil {
+		return nil, err
+	}
+	get := func(path string) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, awsMetadataURL+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+		return metadataGet(client, req)
+	}
+
+	document, err := get("/dynamic/instance-identity/document")
+	if err != nil {
+		return nil, err
+	}
+	var identity struct {
+		AccountID        string `json:"accountId"`
+		InstanceID       string `json:"instanceId"`
+		InstanceType     string `json:"instanceType"`
+		Region           string `json:"region"`
+		AvailabilityZone string `json:"availabilityZone"`
+	}
+	if err := json.Unmarshal([]byte(document), &identity); err != nil {
+		return nil, fmt.Errorf("invalid instance identity document: %w", err)
+	}
+	info := &middleware.CloudInfo{
+		Provider:     "aws",
+		Account:      identity.AccountID,
+		Region:       identity.Region,
+		Zone:         identity.AvailabilityZone,
+		InstanceID:   identity.InstanceID,
+		InstanceType: identity.InstanceType,
+	}
+	// Tags are only in metadata when the instance allows it
+	info.Cluster, _ = get("/meta-data/tags/instance/eks:cluster-name")
+	return info, nil
+}
+
+// gcpMetadata reads the instance's zone, type and project, and the GKE
+// cluster from the instance attributes GKE sets.
+func gcpMetadata(ctx context.Context, client *http.Client) (*middleware.CloudInfo, error) {
+	get := func(path string) (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataURL+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+		return metadataGet(client, req)
+	}
+
+	zone, err := get("/instance/zone")
+	if err != nil {
+		return nil, err
+	}
+	info := &middleware.CloudInfo{Provider: "gcp"}
+	// Zones and machine types are returned as projects/<n>/zones/<zone>
+	info.Zone = zone[strings.LastIndex(zone, "/")+1:]
+	if i := strings.LastIndex(info.Zone, "-"); i > 0 {
+		info.Region = info.Zone[:i]
+	}
+	info.InstanceID, _ = get("/instance/id")
+	if machineType, err := get("/instance/machine-type"); err == nil {
+		info.InstanceType = machineType[strings.LastIndex(machineType, "/")+1:]
+	}
+	info.Account, _ = get("/project/project-id")
+	info.Cluster, _ = get("/instance/attributes/cluster-name")
+	return info, nil
+}
+
+// metadataGet sends a metadata request and returns its body.
+func metadataGet(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s returned %d", req.URL.Path, resp.StatusCode)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
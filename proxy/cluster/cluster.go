@@ -0,0 +1,302 @@
+// Package cluster coordinates the replicas of a horizontally scaled proxy
+// through the Redis they already share: replicas announce themselves, pass
+// events such as blocks and upstream drains to each other over pub/sub, and
+// count rate-limit consumption together so a client is limited fleet-wide
+// rather than per replica.
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var (
+	eventsTotal = metrics.NewCounterVec("aegis_cluster_events_total",
+		"Coordination events, by kind and direction (sent or received).", "kind", "direction")
+	syncErrors = metrics.NewCounterVec("aegis_cluster_sync_errors_total",
+		"Failed rate-limit synchronizations and heartbeats.", "operation")
+	membersGauge = metrics.NewGaugeVec("aegis_cluster_members",
+		"Replicas that sent a heartbeat recently, this one included.")
+)
+
+const (
+	// heartbeatInterval is how often a replica announces itself; it is
+	// considered gone after three missed heartbeats
+	heartbeatInterval = 5 * time.Second
+	// counterTTL is how long a shared rate-limit counter outlives its last
+	// use
+	counterTTL = time.Minute
+)
+
+// Event is passed between replicas.
+type Event struct {
+	Kind string `json:"kind"`
+	Node string `json:"node"`
+	// Key is what the event is about: a blocklist key or an upstream
+	Key        string `json:"key"`
+	TTLSeconds int64  `json:"ttl_seconds,omitempty"`
+	Draining   bool   `json:"draining,omitempty"`
+}
+
+// Event kinds.
+const (
+	EventBlock   = "block"
+	EventUnblock = "unblock"
+	EventDrain   = "drain"
+)
+
+// Limiter is a rate limiter whose consumption is shared, such as
+// middleware.RateLimiter.
+type Limiter interface {
+	// TakeConsumed returns the tokens taken per key since the last call.
+	TakeConsumed() map[string]float64
+	// Consume takes tokens used by other replicas.
+	Consume(key string, tokens float64)
+}
+
+// Options configures a Coordinator.
+type Options struct {
+	Node   string // Unique per replica; defaults to the hostname and PID
+	Prefix string // Of the Redis keys and channel, e.g. aegis:cluster:
+	// SyncInterval is how often rate-limit consumption is exchanged
+	SyncInterval time.Duration
+}
+
+// Member is a replica that sent a heartbeat recently.
+type Member struct {
+	Node     string    `json:"node"`
+	LastSeen time.Time `json:"last_seen"`
+	Self     bool      `json:"self,omitempty"`
+}
+
+// Coordinator connects a replica to the others.
+type Coordinator struct {
+	client *redis.Client
+	opts   Options
+
+	mu       sync.RWMutex
+	handlers map[string][]func(Event)
+	limiters map[string]*sharedLimiter
+}
+
+// sharedLimiter tracks, per key, what this replica added to the shared
+// counter and what the others had added when it last looked.
+type sharedLimiter struct {
+	limiter Limiter
+	counts  map[string]*sharedCount
+}
+
+type sharedCount struct {
+	own, others float64
+	synced      time.Time
+}
+
+// New creates a coordinator; Run starts it.
+func New(client *redis.Client, opts Options) *Coordinator {
+	if opts.Node == "" {
+		host, _ := os.Hostname()
+		opts.Node = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	return &Coordinator{
+		client:   client,
+		opts:     opts,
+		handlers: make(map[string][]func(Event)),
+		limiters: make(map[string]*sharedLimiter),
+	}
+}
+
+// Node returns the name of this replica.
+func (c *Coordinator) Node() string {
+	return c.opts.Node
+}
+
+// Subscribe calls fn with every event of kind sent by another replica.
+// Subscribe before Run.
+func (c *Coordinator) Subscribe(kind string, fn func(Event)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[kind] = append(c.handlers[kind], fn)
+}
+
+// ShareLimiter counts the consumption of a limiter together with the
+// limiters of the same name on the other replicas. Share before Run.
+func (c *Coordinator) ShareLimiter(name string, limiter Limiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	limiter.TakeConsumed() // Starts counting
+	c.limiters[name] = &sharedLimiter{limiter: limiter, counts: make(map[string]*sharedCount)}
+}
+
+// Publish sends an event to the other replicas. It doesn't wait for Redis.
+func (c *Coordinator) Publish(event Event) {
+	event.Node = c.opts.Node
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), heartbeatInterval)
+		defer cancel()
+		if err := c.client.Publish(ctx, c.opts.Prefix+"events", payload).Err(); err != nil {
+			log.Printf("[Cluster] Failed to publish %s event: %v", event.Kind, err)
+			return
+		}
+		eventsTotal.Inc(event.Kind, "sent")
+	}()
+}
+
+// Run receives events, sends heartbeats and shares rate-limit consumption
+// until ctx is done, then leaves the cluster.
+func (c *Coordinator) Run(ctx context.Context) {
+	pubsub := c.client.Subscribe(ctx, c.opts.Prefix+"events")
+	defer pubsub.Close()
+	go c.receive(pubsub.Channel())
+
+	c.heartbeat(ctx)
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	share := time.NewTicker(c.opts.SyncInterval)
+	defer share.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			leaveCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+			c.client.ZRem(leaveCtx, c.opts.Prefix+"members", c.opts.Node)
+			cancel()
+			return
+		case <-heartbeat.C:
+			c.heartbeat(ctx)
+		case <-share.C:
+			c.syncLimiters(ctx)
+		}
+	}
+}
+
+// receive dispatches the events of other replicas. The channel is closed
+// with the subscription; go-redis resubscribes after reconnecting.
+func (c *Coordinator) receive(messages <-chan *redis.Message) {
+	for msg := range messages {
+		var event Event
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil || event.Node == c.opts.Node {
+			continue
+		}
+		eventsTotal.Inc(event.Kind, "received")
+		c.mu.RLock()
+		handlers := c.handlers[event.Kind]
+		c.mu.RUnlock()
+		for _, fn := range handlers {
+			fn(event)
+		}
+	}
+}
+
+// heartbeat announces this replica and forgets those that stopped.
+func (c *Coordinator) heartbeat(ctx context.Context) {
+	now := time.Now()
+	key := c.opts.Prefix + "members"
+	pipe := c.client.Pipeline()
+	pipe.ZAdd(ctx, key, redis.Z{Score: float64(now.UnixMilli()), Member: c.opts.Node})
+	pipe.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprint(now.Add(-3*heartbeatInterval).UnixMilli()))
+	count := pipe.ZCard(ctx, key)
+	if _, err := pipe.Exec(ctx); err != nil {
+		if ctx.Err() == nil {
+			syncErrors.Inc("heartbeat")
+			log.Printf("[Cluster] Heartbeat failed: %v", err)
+		}
+		return
+	}
+	membersGauge.Set(float64(count.Val()))
+}
+
+// Members lists the replicas that sent a heartbeat recently.
+func (c *Coordinator) Members(ctx context.Context) ([]Member, error) {
+	since := time.Now().Add(-3 * heartbeatInterval).UnixMilli()
+	entries, err := c.client.ZRangeByScoreWithScores(ctx, c.opts.Prefix+"members", &redis.ZRangeBy{
+		Min: fmt.Sprint(since), Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	members := make([]Member, 0, len(entries))
+	for _, entry := range entries {
+		node, _ := entry.Member.(string)
+		members = append(members, Member{
+			Node:     node,
+			LastSeen: time.UnixMilli(int64(entry.Score)).UTC(),
+			Self:     node == c.opts.Node,
+		})
+	}
+	return members, nil
+}
+
+// syncLimiters adds this replica's consumption to the shared counters and
+// takes what the other replicas consumed since the last sync from the local
+// buckets. Only keys this replica saw traffic for are exchanged, which is
+// what matters when a load balancer spreads a client over the replicas.
+func (c *Coordinator) syncLimiters(ctx context.Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, shared := range c.limiters {
+		if err := c.syncLimiter(ctx, name, shared); err != nil && ctx.Err() == nil {
+			syncErrors.Inc("ratelimit")
+			log.Printf("[Cluster] Failed to share %s rate limits: %v", name, err)
+		}
+	}
+}
+
+func (c *Coordinator) syncLimiter(ctx context.Context, name string, shared *sharedLimiter) error {
+	now := time.Now()
+	for key, count := range shared.counts {
+		if now.Sub(count.synced) > counterTTL {
+			delete(shared.counts, key)
+		}
+	}
+	consumed := shared.limiter.TakeConsumed()
+	if len(consumed) == 0 {
+		return nil
+	}
+
+	pipe := c.client.Pipeline()
+	totals := make(map[string]*redis.FloatCmd, len(consumed))
+	for key, tokens := range consumed {
+		counter := c.opts.Prefix + "ratelimit:" + name + ":" + key
+		totals[key] = pipe.IncrByFloat(ctx, counter, tokens)
+		pipe.Expire(ctx, counter, counterTTL)
+	}
+	// Consumption that couldn't be shared is dropped: the other replicas
+	// are only less strict for a moment
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	for key, total := range totals {
+		count, ok := shared.counts[key]
+		if !ok {
+			count = &sharedCount{}
+			shared.counts[key] = count
+		}
+		count.own += consumed[key]
+		count.synced = now
+		others := total.Val() - count.own
+		if others < count.others {
+			// The counter expired and started over
+			count.own, others = consumed[key], total.Val()-consumed[key]
+			count.others = others
+		}
+		if others > count.others && ok {
+			shared.limiter.Consume(key, others-count.others)
+		}
+		count.others = others
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+// Command aegis-loadgen replays recorded traffic against a running Aegis Zero
+// proxy and reports throughput, latency percentiles and, from the proxy's
+// metrics, allocations per request. It can serve a fake upstream for the
+// proxy to forward to, so the proxy is measured rather than the service
+// behind it, and fails when thresholds are exceeded so CI catches
+// regressions.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const usage = `Usage: aegis-loadgen [flags]
+
+Replays the requests in -traffic (the proxy's access logs, one JSON object per
+line with method, url and user_agent) against -target in a loop, from -c
+concurrent clients, for -d or until -n requests. With -upstream, it also
+serves a fake upstream answering every request with -upstream-size bytes;
+point UPSTREAM_URL at it.
+
+Example:
+  aegis-loadgen -upstream :9000 -target https://localhost:8443 -insecure \
+      -cert certs/client.crt -key certs/client.key -token "$JWT" \
+      -traffic access-logs.jsonl -c 64 -d 30s \
+      -metrics https://localhost:8443/metrics -max-p99 20ms -max-allocs 150
+
+Flags:
+`
+
+// request is a recorded request, in the fields of the proxy's access logs.
+type request struct {
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+	UserAgent string `json:"user_agent"`
+}
+
+// result is the outcome of one request.
+type result struct {
+	latency time.Duration
+	status  int // 0 when the request failed
+}
+
+func main() {
+	fs := flag.NewFlagSet("aegis-loadgen", flag.ExitOnError)
+	target := fs.String("target", "https://localhost:8443", "proxy base URL")
+	traffic := fs.String("traffic", "", "recorded requests, as JSON lines; empty sends GET /")
+	concurrency := fs.Int("c", 32, "concurrent clients")
+	duration := fs.Duration("d", 30*time.Second, "how long to send requests")
+	total := fs.Int64("n", 0, "stop after this many requests; 0 runs for -d")
+	rate := fs.Float64("rate", 0, "requests per second across all clients; 0 sends as fast as possible")
+	token := fs.String("token", os.Getenv("AEGIS_TOKEN"), "bearer token sent with every request (AEGIS_TOKEN)")
+	caCert := fs.String("cacert", "", "CA certificate of the proxy")
+	cert := fs.String("cert", "", "client certificate for mTLS")
+	key := fs.String("key", "", "client private key for mTLS")
+	insecure := fs.Bool("insecure", false, "skip verification of the proxy's certificate")
+	upstream := fs.String("upstream", "", "serve a fake upstream on this address, e.g. :9000")
+	upstreamSize := fs.Int("upstream-size", 512, "bytes in each fake upstream response")
+	metricsURL := fs.String("metrics", "", "the proxy's /metrics URL, to report allocations per request")
+	maxP99 := fs.Duration("max-p99", 0, "exit with status 1 if the p99 latency exceeds this")
+	maxAllocs := fs.Float64("max-allocs", 0, "exit with status 1 if allocations per request exceed this")
+	maxErrors := fs.Float64("max-errors", 0.01, "exit with status 1 if the share of failed or 5xx requests exceeds this")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	requests, err := loadTraffic(*traffic)
+	if err != nil {
+		exit(err)
+	}
+	tlsConfig, err := clientTLS(*caCert, *cert, *key, *insecure)
+	if err != nil {
+		exit(err)
+	}
+	client := &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig:     tlsConfig,
+			MaxIdleConnsPerHost: *concurrency,
+		},
+	}
+
+	if *upstream != "" {
+		if err := serveUpstream(*upstream, *upstreamSize); err != nil {
+			exit(fmt.Errorf("fake upstream: %w", err))
+		}
+	}
+
+	var before map[string]float64
+	if *metricsURL != "" {
+		if before, err = scrape(client, *metricsURL); err != nil {
+			exit(err)
+		}
+	}
+
+	results, elapsed := run(client, strings.TrimRight(*target, "/"), *token, requests, *concurrency, *duration, *total, *rate)
+	report := summarize(results, elapsed)
+
+	if *metricsURL != "" {
+		after, err := scrape(client, *metricsURL)
+		if err != nil {
+			exit(err)
+		}
+		if n := float64(len(results)); n > 0 {
+			report.allocs = (after["go_heap_allocs_objects_total"] - before["go_heap_allocs_objects_total"]) / n
+			report.allocBytes = (after["go_heap_allocs_bytes_total"] - before["go_heap_allocs_bytes_total"]) / n
+		}
+	}
+	report.print(os.Stdout)
+
+	var failures []string
+	if *maxP99 > 0 && report.p99 > *maxP99 {
+		failures = append(failures, fmt.Sprintf("p99 %v exceeds %v", report.p99, *maxP99))
+	}
+	if *maxAllocs > 0 && report.allocs > *maxAllocs {
+		failures = append(failures, fmt.Sprintf("%.1f allocations per request exceed %.1f", report.allocs, *maxAllocs))
+	}
+	if report.errorRate > *maxErrors {
+		failures = append(failures, fmt.Sprintf("error rate %.2f%% exceeds %.2f%%", 100*report.errorRate, 100**maxErrors))
+	}
+	if len(failures) > 0 {
+		exit(errors.New(strings.Join(failures, "; ")))
+	}
+	exit(nil)
+}
+
+// loadTraffic reads recorded requests, skipping lines without a URL.
+func loadTraffic(path string) ([]request, error) {
+	if path == "" {
+		return []request{{Method: http.MethodGet, URL: "/"}}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var requests []request
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var req request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil || req.URL == "" {
+			continue
+		}
+		if req.Method == "" {
+			req.Method = http.MethodGet
+		}
+		requests = append(requests, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("no requests found in %s", path)
+	}
+	return requests, nil
+}
+
+// run sends requests until the duration or count is reached and returns
+// every result with the time it took.
+func run(client *http.Client, target, token string, requests []request, concurrency int, duration time.Duration, total int64, rate float64) ([]result, time.Duration) {
+	var ticks <-chan time.Time
+	if rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / rate))
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	deadline := time.Now().Add(duration)
+	var sent atomic.Int64
+	var mu sync.Mutex
+	var results []result
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []result
+			for {
+				n := sent.Add(1)
+				if total > 0 && n > total || total == 0 && time.Now().After(deadline) {
+					break
+				}
+				if ticks != nil {
+					<-ticks
+				}
+				local = append(local, send(client, target, token, requests[int(n-1)%len(requests)]))
+			}
+			mu.Lock()
+			results = append(results, local...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results, time.Since(start)
+}
+
+// send makes one request and drains the response.
+func send(client *http.Client, target, token string, r request) result {
+	req, err := http.NewRequest(r.Method, target+r.URL, nil)
+	if err != nil {
+		return result{}
+	}
+	if r.UserAgent != "" {
+		req.Header.Set("User-Agent", r.UserAgent)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return result{latency: time.Since(start)}
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return result{latency: time.Since(start), status: resp.StatusCode}
+}
+
+// serveUpstream starts answering every request on addr with size bytes.
+func serveUpstream(addr string, size int) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	body := bytes.Repeat([]byte("a"), size)
+	go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(body)
+	}))
+	return nil
+}
+
+// scrape reads the unlabeled samples of a Prometheus text exposition.
+func scrape(client *http.Client, url string) (map[string]float64, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok || strings.HasPrefix(name, "#") || strings.Contains(name, "{") {
+			continue
+		}
+		if v, err := strconv.ParseFloat(value, 64); err == nil {
+			samples[name] = v
+		}
+	}
+	return samples, scanner.Err()
+}
+
+// summary is what a run measured.
+type summary struct {
+	requests           int
+	elapsed            time.Duration
+	statuses           map[string]int
+	errorRate          float64 // Failed and 5xx requests
+	p50, p90, p99, max time.Duration
+	allocs, allocBytes float64 // Per request; 0 without -metrics
+}
+
+func summarize(results []result, elapsed time.Duration) summary {
+	s := summary{requests: len(results), elapsed: elapsed, statuses: make(map[string]int)}
+	if len(results) == 0 {
+		return s
+	}
+
+	latencies := make([]time.Duration, len(results))
+	failed := 0
+	for i, r := range results {
+		latencies[i] = r.latency
+		switch {
+		case r.status == 0:
+			s.statuses["error"]++
+			failed++
+		default:
+			s.statuses[strconv.Itoa(r.status/100)+"xx"]++
+			if r.status >= 500 {
+				failed++
+			}
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	s.p50 = latencies[len(latencies)*50/100]
+	s.p90 = latencies[len(latencies)*90/100]
+	s.p99 = latencies[len(latencies)*99/100]
+	s.max = latencies[len(latencies)-1]
+	s.errorRate = float64(failed) / float64(len(results))
+	return s
+}
+
+func (s summary) print(w io.Writer) {
+	fmt.Fprintf(w, "requests:  %d in %v (%.0f/s)\n", s.requests, s.elapsed.Round(time.Millisecond), float64(s.requests)/s.elapsed.Seconds())
+	classes := make([]string, 0, len(s.statuses))
+	for class := range s.statuses {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Fprintf(w, "  %-6s   %d\n", class, s.statuses[class])
+	}
+	fmt.Fprintf(w, "latency:   p50 %v  p90 %v  p99 %v  max %v\n", s.p50, s.p90, s.p99, s.max)
+	if s.allocs > 0 {
+		fmt.Fprintf(w, "allocs:    %.1f per request, %.0f bytes per request\n", s.allocs, s.allocBytes)
+	}
+}
+
+func clientTLS(caCert, cert, key string, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecure}
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return tlsConfig, nil
+}
+
+// exit terminates with status 1 and the error, or 0 without one.
+func exit(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "aegis-loadgen: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// audit verifies a hash-chained audit log with the proxy's public key.
+func audit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	keyPath := fs.String("key", os.Getenv("AUDIT_CHAIN_PUBLIC_KEY"), "PEM public key of AUDIT_CHAIN_SIGNING_KEY_PATH (AUDIT_CHAIN_PUBLIC_KEY)")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("audit requires the audit chain file")
+	}
+	path := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if fs.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if *keyPath == "" {
+		return errors.New("audit requires -key")
+	}
+
+	keyData, err := os.ReadFile(*keyPath)
+	if err != nil {
+		return err
+	}
+	key, err := config.ParsePublicKey(keyData)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	report, err := middleware.VerifyAuditChain(f, key)
+	if err != nil {
+		return fmt.Errorf("audit chain broken after %d records: %w", report.Records, err)
+	}
+	if report.Records == 0 {
+		fmt.Println("audit chain is empty")
+		return nil
+	}
+	fmt.Printf("audit chain intact: seq %d to %d, %d records, %d checkpoints\n", report.FirstSeq, report.LastSeq, report.Records, report.Checkpoints)
+	if report.Dropped > 0 {
+		fmt.Printf("%d events are missing where gap records say the buffer was full\n", report.Dropped)
+	}
+	if report.Verified < report.LastSeq {
+		fmt.Printf("records after seq %d are linked but not yet covered by a checkpoint\n", report.Verified)
+	}
+	if report.FirstSeq > 1 {
+		fmt.Printf("records before seq %d are not in this file\n", report.FirstSeq)
+	}
+	return nil
+}
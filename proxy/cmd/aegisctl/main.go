@@ -0,0 +1,499 @@
+// Command aegisctl operates a running Aegis Zero proxy through its admin API.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+)
+
+const usage = `Usage: aegisctl [flags] <command> [args]
+
+Commands:
+  block <ip|subject> [-ttl 1h] [-reason text] [-subject]
+                          block a client IP, or a JWT subject with -subject
+  unblock <ip|subject> [-subject]
+                          remove a block
+  blocklist [ip|subject] [-subject]
+                          list blocks, or show one
+  quarantine [ip] [-ttl 1h] [-reason text]
+                          list quarantined clients, or limit one to the quarantine paths
+  release <ip>            lift a quarantine
+  tail [-decisions] [-ip ip] [-subject sub] [-route prefix] [-min-score n]
+                          stream audit events and decisions as they happen
+  inspect <ip>            show a client's tracked flow and feature vector
+  stats                   show live traffic per route and upstream
+  upstreams               list upstreams and whether they are draining
+  routes                  list host and path routes, e.g. from the ingress controller
+  cluster                 list the replicas coordinating through Redis
+  drain <host:port>       stop sending new requests to an upstream
+  undrain <host:port>     return a drained upstream to service
+  mode [enforce|monitor]  show or switch the enforcement mode
+  killswitch [on|off] [-reason text] [-by name]
+                          show, engage or release the fleet-wide kill switch
+  maintenance [on|off]    show or switch maintenance mode
+  purge [-host name] [path-prefix]
+                          remove cached responses under a path, or all of them
+  validate [config-file]  load and validate a configuration locally
+  audit <file> -key <pem> verify a hash-chained audit log and its signed checkpoints
+  record [-in file] [-o file] [-d 10m] [-n count]
+                          record sanitized requests from the access log topic or a file
+  replay -target <url> [-speed n] <recording>
+                          replay a recording against a proxy at its original pace, or faster
+
+Flags:
+`
+
+// client calls the admin API.
+type client struct {
+	base   string
+	token  string
+	tenant string
+	http   *http.Client
+}
+
+func main() {
+	fs := flag.NewFlagSet("aegisctl", flag.ExitOnError)
+	addr := fs.String("addr", envOr("AEGIS_ADMIN_URL", "https://localhost:9091"), "admin API base URL (AEGIS_ADMIN_URL)")
+	token := fs.String("token", os.Getenv("AEGIS_ADMIN_TOKEN"), "admin bearer token (AEGIS_ADMIN_TOKEN)")
+	caCert := fs.String("cacert", os.Getenv("AEGIS_ADMIN_CA"), "CA certificate of the proxy (AEGIS_ADMIN_CA)")
+	cert := fs.String("cert", os.Getenv("AEGIS_ADMIN_CERT"), "client certificate for mTLS (AEGIS_ADMIN_CERT)")
+	key := fs.String("key", os.Getenv("AEGIS_ADMIN_KEY"), "client private key for mTLS (AEGIS_ADMIN_KEY)")
+	insecure := fs.Bool("insecure", false, "skip verification of the proxy's certificate")
+	tenant := fs.String("tenant", os.Getenv("AEGIS_TENANT"), "tenant whose blocklist and flows to operate on (AEGIS_TENANT)")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	command, args := fs.Arg(0), fs.Args()[1:]
+
+	// validate, audit and record need no running proxy
+	switch command {
+	case "validate":
+		exit(validate(args))
+	case "audit":
+		exit(audit(args))
+	case "record":
+		exit(record(args))
+	}
+
+	tlsConfig, err := clientTLS(*caCert, *cert, *key, *insecure)
+	if err != nil {
+		exit(err)
+	}
+	if command == "replay" {
+		exit(replay(args, tlsConfig))
+	}
+	c := &client{
+		base:   strings.TrimRight(*addr, "/"),
+		token:  *token,
+		tenant: *tenant,
+		http:   &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	}
+
+	switch command {
+	case "block":
+		err = c.block(args)
+	case "unblock":
+		err = c.unblock(args)
+	case "blocklist":
+		err = c.blocklist(args)
+	case "quarantine":
+		err = c.quarantine(args)
+	case "release":
+		err = c.release(args)
+	case "tail":
+		err = c.tail(args)
+	case "inspect":
+		err = c.inspect(args)
+	case "stats":
+		err = c.print(http.MethodGet, "/admin/stats", nil)
+	case "upstreams":
+		err = c.print(http.MethodGet, "/admin/upstreams", nil)
+	case "routes":
+		err = c.print(http.MethodGet, "/admin/routes", nil)
+	case "cluster":
+		err = c.print(http.MethodGet, "/admin/cluster", nil)
+	case "drain", "undrain":
+		err = c.drain(args, command == "drain")
+	case "mode":
+		err = c.mode(args)
+	case "killswitch":
+		err = c.killSwitch(args)
+	case "maintenance":
+		err = c.maintenance(args)
+	case "purge":
+		err = c.purge(args)
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+	exit(err)
+}
+
+func (c *client) block(args []string) error {
+	fs := flag.NewFlagSet("block", flag.ExitOnError)
+	ttl := fs.Duration("ttl", 0, "how long the block lasts; 0 blocks permanently")
+	reason := fs.String("reason", "aegisctl", "reason recorded with the block")
+	subject := fs.Bool("subject", false, "block a JWT subject instead of a client IP")
+	target, err := parseTarget(fs, args)
+	if err != nil {
+		return err
+	}
+	seconds, err := ttlSeconds(*ttl)
+	if err != nil {
+		return err
+	}
+
+	req := map[string]interface{}{"reason": *reason, "ttl_seconds": seconds}
+	if *subject {
+		req["subject"] = target
+	} else {
+		req["client_ip"] = target
+	}
+	return c.print(http.MethodPost, "/admin/blocklist", req)
+}
+
+func (c *client) unblock(args []string) error {
+	fs := flag.NewFlagSet("unblock", flag.ExitOnError)
+	subject := fs.Bool("subject", false, "unblock a JWT subject instead of a client IP")
+	target, err := parseTarget(fs, args)
+	if err != nil {
+		return err
+	}
+	return c.print(http.MethodDelete, entryPath(target, *subject), nil)
+}
+
+func (c *client) blocklist(args []string) error {
+	fs := flag.NewFlagSet("blocklist", flag.ExitOnError)
+	subject := fs.Bool("subject", false, "show a JWT subject instead of a client IP")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return c.print(http.MethodGet, "/admin/blocklist", nil)
+	}
+	return c.print(http.MethodGet, entryPath(fs.Arg(0), *subject), nil)
+}
+
+func (c *client) quarantine(args []string) error {
+	if len(args) == 0 {
+		return c.print(http.MethodGet, "/admin/quarantine", nil)
+	}
+	fs := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	ttl := fs.Duration("ttl", 0, "how long the quarantine lasts; 0 lasts until released")
+	reason := fs.String("reason", "aegisctl", "reason recorded with the quarantine")
+	target, err := parseTarget(fs, args)
+	if err != nil {
+		return err
+	}
+	seconds, err := ttlSeconds(*ttl)
+	if err != nil {
+		return err
+	}
+	return c.print(http.MethodPost, "/admin/quarantine", map[string]interface{}{
+		"client_ip": target, "reason": *reason, "ttl_seconds": seconds,
+	})
+}
+
+func (c *client) release(args []string) error {
+	if len(args) != 1 {
+		return errors.New("release takes a client IP")
+	}
+	return c.print(http.MethodDelete, "/admin/quarantine/"+url.PathEscape(args[0]), nil)
+}
+
+func (c *client) drain(args []string, draining bool) error {
+	if len(args) != 1 {
+		return errors.New("drain and undrain take an upstream host:port")
+	}
+	return c.print(http.MethodPut, "/admin/upstreams/"+url.PathEscape(args[0]), map[string]bool{"draining": draining})
+}
+
+func (c *client) inspect(args []string) error {
+	if len(args) != 1 {
+		return errors.New("inspect takes a client IP")
+	}
+	return c.print(http.MethodGet, "/admin/flows/"+url.PathEscape(args[0]), nil)
+}
+
+func (c *client) mode(args []string) error {
+	switch len(args) {
+	case 0:
+		return c.print(http.MethodGet, "/admin/enforcement", nil)
+	case 1:
+		return c.print(http.MethodPut, "/admin/enforcement", map[string]string{"mode": args[0]})
+	default:
+		return errors.New("mode takes at most one argument: enforce or monitor")
+	}
+}
+
+func (c *client) maintenance(args []string) error {
+	if len(args) == 0 {
+		return c.print(http.MethodGet, "/admin/maintenance", nil)
+	}
+	if len(args) > 1 || (args[0] != "on" && args[0] != "off") {
+		return errors.New("maintenance takes on or off")
+	}
+	return c.print(http.MethodPut, "/admin/maintenance", map[string]bool{"enabled": args[0] == "on"})
+}
+
+func (c *client) purge(args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	host := fs.String("host", "", "only responses of this host")
+	fs.Parse(args)
+	args = fs.Args()
+	if len(args) > 1 {
+		return errors.New("purge takes at most one path prefix")
+	}
+	req := map[string]string{}
+	if *host != "" {
+		req["host"] = *host
+	}
+	if len(args) == 1 {
+		req["prefix"] = args[0]
+	}
+	return c.print(http.MethodPost, "/admin/cache/purge", req)
+}
+
+func (c *client) killSwitch(args []string) error {
+	fs := flag.NewFlagSet("killswitch", flag.ExitOnError)
+	reason := fs.String("reason", "", "why the switch is flipped (required to engage)")
+	by := fs.String("by", os.Getenv("USER"), "who flips the switch")
+	if len(args) == 0 {
+		return c.print(http.MethodGet, "/admin/killswitch", nil)
+	}
+	action := args[0]
+	fs.Parse(args[1:])
+
+	body := map[string]string{"by": *by, "reason": *reason}
+	switch action {
+	case "on":
+		return c.print(http.MethodPost, "/admin/killswitch", body)
+	case "off":
+		return c.print(http.MethodDelete, "/admin/killswitch", body)
+	default:
+		return errors.New("killswitch takes on or off")
+	}
+}
+
+// tail prints each matching event on its own line until interrupted.
+func (c *client) tail(args []string) error {
+	fs := flag.NewFlagSet("tail", flag.ExitOnError)
+	decisions := fs.Bool("decisions", false, "only scoring decisions")
+	audit := fs.Bool("audit", false, "only audit events (refused requests)")
+	ip := fs.String("ip", "", "only events of this client IP")
+	subject := fs.String("subject", "", "only events of this JWT subject")
+	route := fs.String("route", "", "only events under this path prefix")
+	minScore := fs.String("min-score", "", "only events scored at least this high")
+	fs.Parse(args)
+
+	q := url.Values{}
+	switch {
+	case *decisions && *audit:
+		return errors.New("-decisions and -audit are exclusive")
+	case *decisions:
+		q.Set("type", "decision")
+	case *audit:
+		q.Set("type", "audit")
+	}
+	for key, value := range map[string]string{"ip": *ip, "subject": *subject, "route": *route, "min_score": *minScore} {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+
+	path := "/admin/events"
+	if len(q) > 0 {
+		path += "?" + q.Encode()
+	}
+	resp, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+			fmt.Println(data)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return errors.New("event stream closed by the proxy")
+}
+
+// print performs a request and pretty-prints the JSON response.
+func (c *client) print(method, path string, body interface{}) error {
+	resp, err := c.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if json.Indent(&out, data, "", "  ") != nil {
+		out.Reset()
+		out.Write(data)
+	}
+	fmt.Println(strings.TrimSpace(out.String()))
+	return nil
+}
+
+// do performs a request and turns error responses into errors.
+func (c *client) do(method, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	if c.tenant != "" {
+		sep := "?"
+		if strings.Contains(path, "?") {
+			sep = "&"
+		}
+		path += sep + "tenant=" + url.QueryEscape(c.tenant)
+	}
+	req, err := http.NewRequest(method, c.base+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&apiErr) == nil && apiErr.Error != "" {
+			return nil, fmt.Errorf("%s: %s", resp.Status, apiErr.Error)
+		}
+		return nil, errors.New(resp.Status)
+	}
+	return resp, nil
+}
+
+// validate loads a configuration the way the proxy does, including the
+// JWT public key, and reports the first problem found.
+func validate(args []string) error {
+	if len(args) > 1 {
+		return errors.New("validate takes at most one config file")
+	}
+	if len(args) == 1 {
+		os.Setenv("CONFIG_FILE", args[0])
+	}
+	cfg, err := config.Load()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("configuration is valid (preset %q, stages %s)\n", cfg.Preset, strings.Join(cfg.Stages, ","))
+	return nil
+}
+
+// parseTarget parses a subcommand's flags, which may follow the target.
+// ttlSeconds converts a -ttl flag to the API's whole seconds, rounding up
+// so a sub-second TTL doesn't become 0, which never expires.
+func ttlSeconds(ttl time.Duration) (int, error) {
+	if ttl < 0 {
+		return 0, fmt.Errorf("-ttl must not be negative, got %s", ttl)
+	}
+	return int((ttl + time.Second - 1) / time.Second), nil
+}
+
+func parseTarget(fs *flag.FlagSet, args []string) (string, error) {
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return "", fmt.Errorf("%s requires a client IP or subject", fs.Name())
+	}
+	target := fs.Arg(0)
+	fs.Parse(fs.Args()[1:])
+	if fs.NArg() != 0 {
+		return "", fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	return target, nil
+}
+
+func entryPath(target string, subject bool) string {
+	if subject {
+		return "/admin/blocklist/subjects/" + url.PathEscape(target)
+	}
+	if net.ParseIP(target) == nil {
+		fmt.Fprintf(os.Stderr, "warning: %q is not an IP address; use -subject for JWT subjects\n", target)
+	}
+	return "/admin/blocklist/" + url.PathEscape(target)
+}
+
+// clientTLS builds the TLS configuration for the admin listener.
+func clientTLS(caCert, cert, key string, insecure bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12, InsecureSkipVerify: insecure}
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+	return tlsConfig, nil
+}
+
+func envOr(key, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// exit terminates with status 1 and the error, or 0 without one.
+func exit(err error) {
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "aegisctl: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLSeconds(t *testing.T) {
+	tests := []struct {
+		ttl     time.Duration
+		want    int
+		wantErr bool
+	}{
+		{ttl: 0, want: 0},
+		{ttl: time.Millisecond, want: 1},
+		{ttl: 500 * time.Millisecond, want: 1},
+		{ttl: time.Second, want: 1},
+		{ttl: 1500 * time.Millisecond, want: 2},
+		{ttl: time.Hour, want: 3600},
+		{ttl: -time.Second, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ttl.String(), func(t *testing.T) {
+			got, err := ttlSeconds(tt.ttl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ttlSeconds(%s) = %d, want %d", tt.ttl, got, tt.want)
+			}
+		})
+	}
+}
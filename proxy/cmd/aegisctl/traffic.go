@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// recorded is a sanitized request: what shapes traffic (method, route,
+// sizes, timing and which requests share a client) without identities or
+// parameter values. Its fields are those of access logs, so aegis-loadgen
+// reads recordings as well.
+type recorded struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Client      string    `json:"client_ip"` // A pseudonym, stable within a recording
+	Method      string    `json:"method"`
+	URL         string    `json:"url"`
+	UserAgent   string    `json:"user_agent,omitempty"`
+	RequestSize int64     `json:"request_size,omitempty"`
+}
+
+// record writes sanitized requests from the access log topic, or from
+// access logs in a file, as JSON lines.
+func record(args []string) error {
+	fs := flag.NewFlagSet("record", flag.ExitOnError)
+	brokers := fs.String("brokers", envOr("KAFKA_BROKERS", "localhost:9092"), "Kafka brokers, comma-separated (KAFKA_BROKERS)")
+	topic := fs.String("topic", envOr("KAFKA_TOPIC", "request-logs"), "access log topic (KAFKA_TOPIC)")
+	in := fs.String("in", "", "read access logs from this file instead of Kafka; - is stdin")
+	out := fs.String("o", "-", "write the recording here; - is stdout")
+	duration := fs.Duration("d", 0, "stop after this long; 0 records until interrupted")
+	limit := fs.Int("n", 0, "stop after this many requests; 0 is unlimited")
+	oldest := fs.Bool("from-beginning", false, "start from the oldest retained access logs instead of new ones")
+	fs.Parse(args)
+
+	w := os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	rec, err := newRecorder(w, *limit)
+	if err != nil {
+		return err
+	}
+	defer rec.flush()
+
+	if *in != "" {
+		r := os.Stdin
+		if *in != "-" {
+			f, err := os.Open(*in)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64<<10), 1<<20)
+		for scanner.Scan() && !rec.full() {
+			rec.add(scanner.Bytes())
+		}
+		fmt.Fprintf(os.Stderr, "recorded %d requests\n", rec.count)
+		return scanner.Err()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	if err := consumeTopic(ctx, strings.Split(*brokers, ","), *topic, *oldest, rec); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "recorded %d requests\n", rec.count)
+	return nil
+}
+
+// consumeTopic feeds every partition of topic to rec until ctx is done or
+// rec is full.
+func consumeTopic(ctx context.Context, brokers []string, topic string, oldest bool, rec *recorder) error {
+	consumer, err := sarama.NewConsumer(brokers, sarama.NewConfig())
+	if err != nil {
+		return fmt.Errorf("connecting to Kafka: %w", err)
+	}
+	defer consumer.Close()
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return fmt.Errorf("reading partitions of %s: %w", topic, err)
+	}
+	offset := sarama.OffsetNewest
+	if oldest {
+		offset = sarama.OffsetOldest
+	}
+
+	messages := make(chan []byte)
+	for _, id := range partitions {
+		pc, err := consumer.ConsumePartition(topic, id, offset)
+		if err != nil {
+			return fmt.Errorf("consuming %s/%d: %w", topic, id, err)
+		}
+		defer pc.Close()
+		go func() {
+			for msg := range pc.Messages() {
+				select {
+				case messages <- msg.Value:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	fmt.Fprintf(os.Stderr, "recording from %s (%d partitions), interrupt to stop\n", topic, len(partitions))
+	for !rec.full() {
+		select {
+		case <-ctx.Done():
+			return nil
+		case value := <-messages:
+			rec.add(value)
+		}
+	}
+	return nil
+}
+
+// recorder sanitizes access logs and writes them out.
+type recorder struct {
+	w       *bufio.Writer
+	enc     *json.Encoder
+	key     []byte // Pseudonymizes clients, and is discarded with the recording
+	limit   int
+	count   int
+	skipped int
+}
+
+func newRecorder(w io.Writer, limit int) (*recorder, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	bw := bufio.NewWriter(w)
+	return &recorder{w: bw, enc: json.NewEncoder(bw), key: key, limit: limit}, nil
+}
+
+func (r *recorder) full() bool { return r.limit > 0 && r.count >= r.limit }
+
+func (r *recorder) flush() {
+	r.w.Flush()
+	if r.skipped > 0 {
+		fmt.Fprintf(os.Stderr, "skipped %d lines that weren't access logs\n", r.skipped)
+	}
+}
+
+// add records one access log.
+func (r *recorder) add(line []byte) {
+	var entry struct {
+		Timestamp   time.Time `json:"timestamp"`
+		ClientIP    string    `json:"client_ip"`
+		Method      string    `json:"method"`
+		URL         string    `json:"url"`
+		UserAgent   string    `json:"user_agent"`
+		RequestSize int64     `json:"request_size"`
+	}
+	if err := json.Unmarshal(line, &entry); err != nil || entry.URL == "" || entry.Timestamp.IsZero() {
+		r.skipped++
+		return
+	}
+	r.enc.Encode(recorded{
+		Timestamp:   entry.Timestamp,
+		Client:      r.pseudonym(entry.ClientIP),
+		Method:      entry.Method,
+		URL:         sanitizeURL(entry.URL),
+		UserAgent:   entry.UserAgent,
+		RequestSize: entry.RequestSize,
+	})
+	r.count++
+}
+
+// pseudonym maps a client IP to an address in 198.18.0.0/15, the range
+// reserved for benchmarking, so a replay keeps per-client flows without
+// revealing clients.
+func (r *recorder) pseudonym(ip string) string {
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(ip))
+	sum := mac.Sum(nil)
+	return net.IPv4(198, 18|sum[0]&1, sum[1], sum[2]).String()
+}
+
+var (
+	numericSegment = regexp.MustCompile(`^\d+$`)
+	opaqueSegment  = regexp.MustCompile(`^[0-9a-fA-F-]{16,}$|^[A-Za-z0-9_-]{24,}$`)
+)
+
+// sanitizeURL keeps the route of a request but not the values in it:
+// numeric, UUID-like and token-like path segments and anything with an @
+// are replaced by placeholders, and query values are dropped, keeping
+// their names.
+func sanitizeURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "/"
+	}
+	segments := strings.Split(u.Path, "/")
+	for i, s := range segments {
+		switch {
+		case numericSegment.MatchString(s):
+			segments[i] = "1"
+		case strings.Contains(s, "@"):
+			segments[i] = "redacted"
+		case opaqueSegment.MatchString(s):
+			segments[i] = "00000000-0000-0000-0000-000000000000"
+		}
+	}
+	out := strings.Join(segments, "/")
+	if out == "" {
+		out = "/"
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		names := make([]string, 0, len(query))
+		for name := range query {
+			names = append(names, url.QueryEscape(name)+"=x")
+		}
+		sort.Strings(names)
+		out += "?" + strings.Join(names, "&")
+	}
+	return out
+}
+
+// replay sends a recording to a proxy, at its original pace or faster.
+func replay(args []string, tlsConfig *tls.Config) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "", "base URL of the proxy to replay against, e.g. a staging proxy")
+	token := fs.String("token", os.Getenv("AEGIS_TOKEN"), "bearer token sent with every request (AEGIS_TOKEN)")
+	speed := fs.Float64("speed", 1, "how much faster than recorded to replay; 0 sends as fast as possible")
+	concurrency := fs.Int("c", 256, "requests in flight at most")
+	clients := fs.Bool("clients", true, "send each request's client pseudonym in X-Forwarded-For, so a proxy listing this host in TRUSTED_PROXIES sees distinct clients")
+	fs.Parse(args)
+	if *target == "" || fs.NArg() != 1 {
+		return errors.New("usage: aegisctl replay -target <url> [-speed n] [-token jwt] <recording>")
+	}
+	if *speed < 0 {
+		return errors.New("-speed must not be negative")
+	}
+
+	requests, err := loadRecording(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, MaxIdleConnsPerHost: *concurrency},
+	}
+	base := strings.TrimRight(*target, "/")
+	fmt.Fprintf(os.Stderr, "replaying %d requests recorded over %v at %gx\n",
+		len(requests), requests[len(requests)-1].Timestamp.Sub(requests[0].Timestamp).Round(time.Second), *speed)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var (
+		mu       sync.Mutex
+		statuses = make(map[string]int)
+		maxLag   time.Duration
+		wg       sync.WaitGroup
+	)
+	slots := make(chan struct{}, *concurrency)
+	start := time.Now()
+	first := requests[0].Timestamp
+	sent := 0
+replay:
+	for _, req := range requests {
+		if *speed > 0 {
+			due := start.Add(time.Duration(float64(req.Timestamp.Sub(first)) / *speed))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-ctx.Done():
+				break replay
+			}
+			if lag := time.Since(due); lag > maxLag {
+				maxLag = lag
+			}
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			break replay
+		}
+		sent++
+		wg.Add(1)
+		go func(req recorded) {
+			defer func() { <-slots; wg.Done() }()
+			class := sendRecorded(client, base, *token, req, *clients)
+			mu.Lock()
+			statuses[class]++
+			mu.Unlock()
+		}(req)
+	}
+	wg.Wait()
+
+	elapsed := time.Since(start)
+	fmt.Printf("sent:  %d of %d requests in %v (%.0f/s)\n", sent, len(requests), elapsed.Round(time.Millisecond), float64(sent)/elapsed.Seconds())
+	classes := make([]string, 0, len(statuses))
+	for class := range statuses {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		fmt.Printf("  %-6s %d\n", class, statuses[class])
+	}
+	if *speed > 0 {
+		// Requests sent late distort the timing the replay is meant to keep
+		fmt.Printf("lag:   at most %v behind schedule\n", maxLag.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// loadRecording reads a recording, ordered by time.
+func loadRecording(path string) ([]recorded, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var requests []recorded
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var req recorded
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil || req.URL == "" || req.Timestamp.IsZero() {
+			continue
+		}
+		if req.Method == "" {
+			req.Method = http.MethodGet
+		}
+		requests = append(requests, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(requests) == 0 {
+		return nil, fmt.Errorf("no requests found in %s", path)
+	}
+	sort.SliceStable(requests, func(i, j int) bool { return requests[i].Timestamp.Before(requests[j].Timestamp) })
+	return requests, nil
+}
+
+// sendRecorded makes one request, with a body of the recorded size, and
+// returns its status class.
+func sendRecorded(client *http.Client, base, token string, r recorded, clients bool) string {
+	var body io.Reader
+	if r.RequestSize > 0 {
+		body = bytes.NewReader(bytes.Repeat([]byte("a"), int(min(r.RequestSize, 10<<20))))
+	}
+	req, err := http.NewRequest(r.Method, base+r.URL, body)
+	if err != nil {
+		return "error"
+	}
+	if r.UserAgent != "" {
+		req.Header.Set("User-Agent", r.UserAgent)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if clients && r.Client != "" {
+		req.Header.Set("X-Forwarded-For", r.Client)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "error"
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return strconv.Itoa(resp.StatusCode/100) + "xx"
+}
@@ -0,0 +1,23 @@
+package config
+
+import "fmt"
+
+// validateBandwidth checks the bandwidth stage's rates and how clients are
+// keyed.
+func validateBandwidth(cfg *Config) error {
+	if cfg.BandwidthLimit <= 0 || cfg.BandwidthBurst <= 0 {
+		return fmt.Errorf("BANDWIDTH_LIMIT and BANDWIDTH_BURST must be positive with the bandwidth stage")
+	}
+	if cfg.BandwidthKey != "ip" && cfg.BandwidthKey != "subject" {
+		return fmt.Errorf("BANDWIDTH_KEY must be ip or subject, got %q", cfg.BandwidthKey)
+	}
+	if len(cfg.BandwidthTiers) > 0 && cfg.BandwidthTierClaim == "" {
+		return fmt.Errorf("bandwidth_tiers need BANDWIDTH_TIER_CLAIM")
+	}
+	for name, rate := range cfg.BandwidthTiers {
+		if rate < 0 {
+			return fmt.Errorf("bandwidth tier %q: rate must not be negative", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// centralKeys are the config keys a central store may set: the dynamic
+// policy that reload applies without a restart.
+var centralKeys = map[string]bool{
+	"route_profiles":            true,
+	"response_policy":           true,
+	"scoring_model":             true,
+	"risk_challenge_threshold":  true,
+	"risk_block_threshold":      true,
+	"response_rate_limit_rps":   true,
+	"response_rate_limit_burst": true,
+	"verdict_rate_limit_rps":    true,
+	"verdict_rate_limit_burst":  true,
+	"rate_limit_rps":            true,
+	"rate_limit_burst":          true,
+	"honeypot_paths":            true,
+	"access_log_sample_rate":    true,
+	"score_ewma_alpha":          true,
+	"score_window_size":         true,
+	"score_window_hits":         true,
+	"score_hysteresis":          true,
+}
+
+// ApplyCentral overlays values from a central store onto cfg. Values are
+// YAML (or JSON) keyed like the config file, and take precedence over the
+// file and environment. Keys that aren't dynamic policy are rejected. If the
+// response policy was derived from the thresholds, it is derived again.
+func ApplyCentral(cfg *Config, values map[string]string) error {
+	doc := make(map[string]interface{}, len(values))
+	for key, raw := range values {
+		if !centralKeys[key] {
+			return fmt.Errorf("central key %q is not a dynamic setting", key)
+		}
+		var value interface{}
+		if err := yaml.Unmarshal([]byte(raw), &value); err != nil {
+			return fmt.Errorf("central key %q: %w", key, err)
+		}
+		doc[key] = value
+	}
+	data, err := yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	derived := reflect.DeepEqual(cfg.ResponsePolicy, thresholdPolicy(cfg))
+	next := *cfg
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&next); err != nil {
+		return fmt.Errorf("invalid central config: %w", err)
+	}
+	if _, ok := values["response_policy"]; !ok && derived {
+		next.ResponsePolicy = thresholdPolicy(&next)
+	}
+
+	if err := validateDynamic(&next); err != nil {
+		return fmt.Errorf("invalid central config: %w", err)
+	}
+	*cfg = next
+	return nil
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestApplyCentral(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string]string
+		wantErr string
+	}{
+		{name: "rate limits", values: map[string]string{"rate_limit_rps": "10", "verdict_rate_limit_burst": "2"}},
+		{name: "zero rate", values: map[string]string{"rate_limit_rps": "0"}, wantErr: "RATE_LIMIT_RPS"},
+		{name: "negative burst", values: map[string]string{"rate_limit_burst": "-1"}, wantErr: "RATE_LIMIT_BURST"},
+		{name: "zero response rate", values: map[string]string{"response_rate_limit_rps": "0"}, wantErr: "RESPONSE_RATE_LIMIT_RPS"},
+		{name: "zero response burst", values: map[string]string{"response_rate_limit_burst": "0"}, wantErr: "RESPONSE_RATE_LIMIT_BURST"},
+		{name: "zero verdict rate", values: map[string]string{"verdict_rate_limit_rps": "0"}, wantErr: "VERDICT_RATE_LIMIT_RPS"},
+		{name: "zero verdict burst", values: map[string]string{"verdict_rate_limit_burst": "0"}, wantErr: "VERDICT_RATE_LIMIT_BURST"},
+		{name: "not dynamic", values: map[string]string{"upstream_url": "http://evil"}, wantErr: "not a dynamic setting"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaults()
+			before := *cfg
+			err := ApplyCentral(cfg, tt.values)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ApplyCentral = %v, want an error about %s", err, tt.wantErr)
+			}
+			if cfg.RateLimitRPS != before.RateLimitRPS || cfg.VerdictRateLimitBurst != before.VerdictRateLimitBurst {
+				t.Error("a rejected snapshot changed the configuration")
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Fault is a failure the chaos stage injects into a share of a route's
+// requests, so teams can see how their clients cope behind the proxy.
+type Fault struct {
+	Prefix  string  `yaml:"prefix"`  // Path prefix; "/" matches every request
+	Percent float64 `yaml:"percent"` // Share of matching requests, from 0 to 100
+	// Latency delays requests by this long, plus up to Jitter more
+	Latency Duration `yaml:"latency"`
+	Jitter  Duration `yaml:"jitter"`
+	// Status, if set, answers with this error instead of proxying
+	Status int `yaml:"status"`
+	// Reset closes the client's connection without a response
+	Reset bool `yaml:"reset"`
+}
+
+// chaosPresets are the presets the chaos stage may run under.
+var chaosPresets = map[string]bool{"dev": true, "staging": true}
+
+// validateChaos checks the faults of the chaos stage, which is refused
+// outside the dev and staging presets so it can't reach production.
+func validateChaos(cfg *Config) error {
+	if !chaosPresets[cfg.Preset] {
+		return fmt.Errorf("the chaos stage needs PRESET dev or staging, got %q", cfg.Preset)
+	}
+	if len(cfg.ChaosFaults) == 0 {
+		return fmt.Errorf("the chaos stage needs chaos_faults in the config file")
+	}
+	for i, f := range cfg.ChaosFaults {
+		name := fmt.Sprintf("chaos_faults[%d]", i)
+		if !strings.HasPrefix(f.Prefix, "/") {
+			return fmt.Errorf("%s: prefix must start with /", name)
+		}
+		if f.Percent <= 0 || f.Percent > 100 {
+			return fmt.Errorf("%s: percent must be above 0 and at most 100", name)
+		}
+		if f.Latency < 0 || f.Jitter < 0 {
+			return fmt.Errorf("%s: latency and jitter must not be negative", name)
+		}
+		if f.Status != 0 && (f.Status < 400 || f.Status > 599) {
+			return fmt.Errorf("%s: status must be between 400 and 599", name)
+		}
+		if f.Status != 0 && f.Reset {
+			return fmt.Errorf("%s: status and reset are exclusive", name)
+		}
+		if f.Latency == 0 && f.Jitter == 0 && f.Status == 0 && !f.Reset {
+			return fmt.Errorf("%s: set latency, status or reset", name)
+		}
+	}
+	return nil
+}
@@ -1,93 +1,2342 @@
 package config
 
 import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/secrets"
 )
 
-// Config holds all configuration for the edge proxy
-type Config struct {
-	// Server
-	Port     int
-	LogLevel string
+// Config holds all configuration for the edge proxy
+type Config struct {
+	// Preset supplies defaults for an environment: "dev", "staging", "prod" or "fips"
+	Preset string `yaml:"preset"`
+
+	// Server
+	Port               int      `yaml:"port"`
+	LogLevel           string   `yaml:"log_level"`
+	ServerReadTimeout  Duration `yaml:"server_read_timeout"`
+	ServerWriteTimeout Duration `yaml:"server_write_timeout"`
+	ServerIdleTimeout  Duration `yaml:"server_idle_timeout"`
+	// ServerReadHeaderTimeout bounds reading request headers, so slow-loris
+	// clients can't hold connections by trickling them
+	ServerReadHeaderTimeout Duration `yaml:"server_read_header_timeout"`
+	// TransferProgressTimeout moves the read and write deadlines of proxied
+	// requests forward whenever body data moves; 0 keeps the fixed timeouts
+	TransferProgressTimeout Duration `yaml:"transfer_progress_timeout"`
+
+	// Listeners; empty serves the proxy with mTLS on Port
+	Listeners []Listener `yaml:"listeners"`
+	// AcceptLoops per proxy listener, sharing its port with SO_REUSEPORT
+	// (Linux only); 0 runs one per GOMAXPROCS
+	AcceptLoops int `yaml:"accept_loops"`
+	// AutoGOMAXPROCS lowers GOMAXPROCS to the container's CPU limit, unless
+	// the GOMAXPROCS environment variable is set
+	AutoGOMAXPROCS bool `yaml:"auto_gomaxprocs"`
+
+	// Connections open on the proxy listeners, in total and per client IP;
+	// 0 is unlimited
+	MaxConnections      int `yaml:"max_connections"`
+	MaxConnectionsPerIP int `yaml:"max_connections_per_ip"`
+	// MinTransferRate is the average bytes per second request bodies must
+	// arrive at once MinTransferRateGrace has passed; 0 disables it
+	MinTransferRate      ByteSize `yaml:"min_transfer_rate"`
+	MinTransferRateGrace Duration `yaml:"min_transfer_rate_grace"`
+
+	// ProxyProtocolTrusted are the CIDRs of load balancers whose PROXY
+	// protocol headers listeners with ProxyProtocol read; they must send one
+	ProxyProtocolTrusted []string `yaml:"proxy_protocol_trusted"`
+	// ProxyProtocolTimeout bounds reading the header
+	ProxyProtocolTimeout Duration `yaml:"proxy_protocol_timeout"`
+
+	// RequestIDTrusted are the CIDRs of peers whose X-Request-ID is kept;
+	// other requests get a new ID
+	RequestIDTrusted []string `yaml:"request_id_trusted"`
+	// TrustedProxies are the CIDRs of peers, such as load balancers, whose
+	// X-Forwarded-For and X-Real-IP carry the client address; everyone
+	// else is keyed by their own
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	// SidecarMode runs the proxy next to its application in a Kubernetes
+	// pod: the upstream defaults to the app's SidecarAppPort on loopback,
+	// access logs carry the pod's Downward API metadata, and shutdown
+	// drains for SidecarDrainDelay first, from SIGTERM or the preStop hook
+	SidecarMode       bool     `yaml:"sidecar_mode"`
+	SidecarAppPort    int      `yaml:"sidecar_app_port"`
+	SidecarDrainDelay Duration `yaml:"sidecar_drain_delay"`
+
+	// CloudMetadata reads the instance's location from the metadata service
+	// at startup for the access logs: "off", "auto", "aws" or "gcp".
+	// CloudCluster overrides the cluster name found there
+	CloudMetadata string `yaml:"cloud_metadata"`
+	CloudCluster  string `yaml:"cloud_cluster"`
+
+	// ReadinessInterval is how often /readyz checks the dependencies;
+	// ReadinessRequired are those ("redis", "kafka", "jwt", "upstream",
+	// "clock") that must pass for the proxy to be ready
+	ReadinessInterval Duration `yaml:"readiness_interval"`
+	ReadinessRequired []string `yaml:"readiness_required"`
+
+	// ClusterSync coordinates the replicas through Redis: they share rate
+	// limits every ClusterSyncInterval, and blocks and upstream drains as
+	// they happen. ClusterNode names this replica, by default the pod or
+	// hostname
+	ClusterSync         bool     `yaml:"cluster_sync"`
+	ClusterNode         string   `yaml:"cluster_node"`
+	ClusterSyncInterval Duration `yaml:"cluster_sync_interval"`
+	ClusterKeyPrefix    string   `yaml:"cluster_key_prefix"`
+
+	// Middleware stages in chain order, outermost first; stages not listed are disabled
+	Stages []string `yaml:"stages"`
+	// Settings of stages compiled in with middleware.RegisterStage, by stage
+	// name; file only
+	StageSettings map[string]map[string]string `yaml:"stage_settings"`
+	// Go plugins registering stages, loaded at startup before the rest of
+	// the configuration
+	Plugins []string `yaml:"plugins"`
+
+	// Requirements per route, enforced by the routes stage; file only
+	RoutePolicies  []RoutePolicy            `yaml:"route_policies"`
+	RateLimitTiers map[string]RateLimitTier `yaml:"rate_limit_tiers"`
+
+	// Default policy of the cors stage; route policies may override it
+	CORS CORSPolicy `yaml:"cors"`
+
+	// Double-submit tokens of the csrf stage, for routes with csrf set
+	CSRFSecret        string `yaml:"csrf_secret" secret:"true"` // At least 32 bytes
+	CSRFCookieName    string `yaml:"csrf_cookie_name"`
+	CSRFHeaderName    string `yaml:"csrf_header_name"`
+	CSRFFieldName     string `yaml:"csrf_field_name"`     // In urlencoded form posts
+	CSRFSessionCookie string `yaml:"csrf_session_cookie"` // The app's, binding tokens without a subject
+
+	// OIDC client of the session stage, which logs browsers in at the edge
+	// and keeps their tokens in Redis behind a session cookie
+	OIDCAuthorizeURL      string   `yaml:"oidc_authorize_url"`
+	OIDCTokenURL          string   `yaml:"oidc_token_url"`
+	OIDCClientID          string   `yaml:"oidc_client_id"`
+	OIDCClientSecret      string   `yaml:"oidc_client_secret" secret:"true"`
+	OIDCRedirectURL       string   `yaml:"oidc_redirect_url"` // Callback, served by the proxy
+	OIDCScopes            []string `yaml:"oidc_scopes"`
+	OIDCTimeout           Duration `yaml:"oidc_timeout"`
+	SessionCookieName     string   `yaml:"session_cookie_name"`
+	SessionTTL            Duration `yaml:"session_ttl"`
+	SessionLogoutPath     string   `yaml:"session_logout_path"`
+	SessionLogoutRedirect string   `yaml:"session_logout_redirect"` // e.g. the IdP's end-session endpoint
+
+	// Nonce and timestamp headers of the replay stage, for routes with
+	// replay_protection set
+	ReplayNonceHeader     string   `yaml:"replay_nonce_header"`
+	ReplayTimestampHeader string   `yaml:"replay_timestamp_header"` // Unix seconds
+	ReplayWindow          Duration `yaml:"replay_window"`           // Allowed clock difference
+
+	// Memory tier of the cache stage, for routes with cache_ttl set;
+	// CacheRedis adds Redis as a second tier shared by the fleet
+	CacheMaxSize  ByteSize `yaml:"cache_max_size"`
+	CacheMaxEntry ByteSize `yaml:"cache_max_entry"` // Larger responses aren't cached
+	CacheRedis    bool     `yaml:"cache_redis"`
+
+	// Adaptive concurrency limit of the shed stage, between ShedMinLimit
+	// and ShedMaxLimit; it shrinks once latency exceeds its baseline by
+	// ShedLatencyTolerance times. Scores under ShedLowRisk are low risk.
+	ShedMinLimit         int      `yaml:"shed_min_limit"`
+	ShedMaxLimit         int      `yaml:"shed_max_limit"`
+	ShedInitialLimit     int      `yaml:"shed_initial_limit"`
+	ShedLatencyTolerance float64  `yaml:"shed_latency_tolerance"`
+	ShedRetryAfter       Duration `yaml:"shed_retry_after"`
+	ShedLowRisk          float64  `yaml:"shed_low_risk"`
+	// Response bandwidth of the bandwidth stage per client, in bytes per
+	// second with bursts of BandwidthBurst. BandwidthKey is "ip" or
+	// "subject", which falls back to the IP without a token. Tokens whose
+	// BandwidthTierClaim names one of BandwidthTiers (file only) get its
+	// rate instead; 0 exempts a tier.
+	BandwidthLimit     ByteSize            `yaml:"bandwidth_limit"`
+	BandwidthBurst     ByteSize            `yaml:"bandwidth_burst"`
+	BandwidthKey       string              `yaml:"bandwidth_key"`
+	BandwidthTierClaim string              `yaml:"bandwidth_tier_claim"`
+	BandwidthTiers     map[string]ByteSize `yaml:"bandwidth_tiers"`
+	// Requests in flight per client with the concurrency stage; up to
+	// ConcurrencyQueue more wait ConcurrencyQueueTimeout for a slot.
+	// ConcurrencyKey is "ip" or "subject", like BandwidthKey.
+	ConcurrencyLimit        int      `yaml:"concurrency_limit"`
+	ConcurrencyQueue        int      `yaml:"concurrency_queue"`
+	ConcurrencyQueueTimeout Duration `yaml:"concurrency_queue_timeout"`
+	ConcurrencyKey          string   `yaml:"concurrency_key"`
+	// GeoLite2 or GeoIP2 block files in CSV: City blocks locate clients,
+	// ASN blocks name their networks
+	GeoIPDatabases []string `yaml:"geoip_databases"`
+	// The travel stage flags subjects moving faster than TravelMaxSpeed
+	// km/h between requests, ignoring moves under TravelMinDistance km,
+	// and carries out TravelAction, a response action, on them
+	TravelMaxSpeed    float64 `yaml:"travel_max_speed"`
+	TravelMinDistance float64 `yaml:"travel_min_distance"`
+	TravelAction      string  `yaml:"travel_action"`
+	// The familiarity stage remembers each subject's certificates, user
+	// agent families and ASNs for FamiliarityHistory after its last request.
+	// FamiliarityAction, a response action, is carried out when a new device
+	// comes from a new ASN, or on any new one with FamiliarityTrigger "any".
+	FamiliarityHistory Duration `yaml:"familiarity_history"`
+	FamiliarityAction  string   `yaml:"familiarity_action"`
+	FamiliarityTrigger string   `yaml:"familiarity_trigger"`
+	// Time windows of the schedule stage; file only
+	Schedules []Schedule `yaml:"schedules"`
+	// Faults the chaos stage injects, under the dev and staging presets only;
+	// read from the config file
+	ChaosFaults []Fault `yaml:"chaos_faults"`
+
+	// Default response headers of the headers stage; route policies may override them
+	SecurityHeaders SecurityHeaders `yaml:"security_headers"`
+
+	// Tenants sharing the proxy, read from the config file only
+	Tenants     []Tenant `yaml:"tenants"`
+	TenantClaim string   `yaml:"tenant_claim"` // JWT claim naming a request's tenant
+
+	// Reload: poll the config file for changes (0 reloads on SIGHUP only)
+	ConfigWatchIntervalSeconds int `yaml:"config_watch_interval_seconds"`
+
+	// Central store of dynamic policy shared by a fleet ("redis" or "etcd")
+	CentralConfigSource        string   `yaml:"central_config_source"`
+	CentralConfigKey           string   `yaml:"central_config_key"` // Redis hash, etcd prefix or Kafka topic
+	CentralConfigEtcdEndpoints []string `yaml:"central_config_etcd_endpoints"`
+	CentralConfigPoll          Duration `yaml:"central_config_poll"`
+
+	// Upstream
+	UpstreamURL         string   `yaml:"upstream_url"`
+	UpstreamURLs        []string `yaml:"upstream_urls"`     // Balanced round-robin; replaces UpstreamURL
+	UpstreamDraining    []string `yaml:"upstream_draining"` // Hosts (host:port) taking no new requests
+	UpstreamTimeout     Duration `yaml:"upstream_timeout"`  // Time to response headers; 0 waits indefinitely
+	UpstreamDialTimeout Duration `yaml:"upstream_dial_timeout"`
+	// UpstreamDNS discovers the upstreams from DNS, http(s)://name[:port]
+	// for A and AAAA records or http(s)://_service._proto.name for SRV;
+	// replaces UpstreamURLs. It is looked up again every UpstreamDNSTTL
+	UpstreamDNS    string   `yaml:"upstream_dns"`
+	UpstreamDNSTTL Duration `yaml:"upstream_dns_ttl"`
+	// UpstreamRegistry discovers the upstreams from the healthy instances
+	// of UpstreamService in "consul" or "eureka" at UpstreamRegistryURL;
+	// replaces UpstreamURLs. Consul is watched with blocking queries held
+	// up to UpstreamRegistryPoll, Eureka polled every UpstreamRegistryPoll
+	UpstreamRegistry       string   `yaml:"upstream_registry"`
+	UpstreamRegistryURL    string   `yaml:"upstream_registry_url"`
+	UpstreamRegistryToken  string   `yaml:"upstream_registry_token" secret:"true"` // Consul ACL token
+	UpstreamRegistryPoll   Duration `yaml:"upstream_registry_poll"`
+	UpstreamRegistryScheme string   `yaml:"upstream_registry_scheme"` // Of Consul instances
+	UpstreamService        string   `yaml:"upstream_service"`
+	UpstreamServiceTag     string   `yaml:"upstream_service_tag"` // Consul only
+	// MockUpstream serves a built-in echo backend on MockUpstreamAddr and
+	// makes it the only upstream, for load tests and demos without a real
+	// backend. It answers MockUpstreamStatus after MockUpstreamLatency
+	MockUpstream        bool     `yaml:"mock_upstream"`
+	MockUpstreamAddr    string   `yaml:"mock_upstream_addr"`
+	MockUpstreamStatus  int      `yaml:"mock_upstream_status"`
+	MockUpstreamLatency Duration `yaml:"mock_upstream_latency"`
+	// IngressController routes by host and path from the cluster's
+	// "ingress" (Ingress) or "gateway" (HTTPRoute) resources; the upstream
+	// settings then only serve requests no route matches
+	IngressController    string   `yaml:"ingress_controller"`
+	IngressClass         string   `yaml:"ingress_class"`   // ingressClassName of the Ingresses served
+	IngressGateway       string   `yaml:"ingress_gateway"` // Gateway HTTPRoutes attach to, name or namespace/name
+	IngressNamespace     string   `yaml:"ingress_namespace"`
+	IngressClusterDomain string   `yaml:"ingress_cluster_domain"`
+	IngressResync        Duration `yaml:"ingress_resync"`
+	// Egress allowlist for upstreams, applied at startup only so a reload or
+	// the central store can't widen it
+	UpstreamAllowedHosts          []string `yaml:"upstream_allowed_hosts"` // Exact or "*.suffix"
+	UpstreamAllowedCIDRs          []string `yaml:"upstream_allowed_cidrs"` // Checked after DNS resolution
+	UpstreamBlockPrivateRedirects bool     `yaml:"upstream_block_private_redirects"`
+	// PEM private key forwarded requests are signed with (RFC 9421), the
+	// signatures expiring after RequestSigningTTL; empty doesn't sign
+	RequestSigningKeyPath string        `yaml:"request_signing_key_path"`
+	RequestSigningKey     crypto.Signer `yaml:"-"`
+	RequestSigningTTL     Duration      `yaml:"request_signing_ttl"`
+
+	// Destinations workloads may reach through "egress" listeners
+	EgressAllowedHosts []string `yaml:"egress_allowed_hosts"` // Exact or "*.suffix"
+	EgressAllowedPorts []int    `yaml:"egress_allowed_ports"`
+	EgressAllowedCIDRs []string `yaml:"egress_allowed_cidrs"` // Checked after DNS resolution
+	// EgressAllowPrivate allows destinations on private addresses; loopback,
+	// link-local and metadata addresses are always refused
+	EgressAllowPrivate bool `yaml:"egress_allow_private"`
+
+	// TLS/mTLS
+	TLSCertPath string `yaml:"tls_cert_path"`
+	TLSKeyPath  string `yaml:"tls_key_path"`
+	CACertPath  string `yaml:"ca_cert_path"`
+	TLSPolicy   string `yaml:"tls_policy"` // "intermediate", "modern" (TLS 1.3 only) or "fips"
+	// FIPSMode refuses to start without a FIPS 140 crypto module and limits
+	// TLS and keys to approved algorithms; set by the fips build tag
+	FIPSMode bool `yaml:"fips_mode"`
+	// Domains with their own certificates and upstreams, selected by SNI;
+	// read from the config file at startup only
+	VirtualHosts []VirtualHost `yaml:"virtual_hosts"`
+
+	// Let requests through when the Redis blocklist can't be checked
+	FailOpen bool `yaml:"fail_open"`
+
+	// JWT
+	JWTPublicKeyPath string         `yaml:"jwt_public_key_path"`
+	JWTPublicKey     *rsa.PublicKey `yaml:"-"`
+	// JWTLeeway is the clock skew tolerated when checking exp, nbf and iat
+	JWTLeeway Duration `yaml:"jwt_leeway"`
+	// JWTExpiryWarning tells clients their token expires within this long
+	// in a response header, so they refresh ahead of a 401 (0 disables)
+	JWTExpiryWarning Duration `yaml:"jwt_expiry_warning"`
+
+	// ClockCheck compares the host clock with "ntp:host[:port]" or the Date
+	// header of an http(s) URL, such as the IdP's, every ClockCheckInterval
+	ClockCheck         string   `yaml:"clock_check"`
+	ClockCheckInterval Duration `yaml:"clock_check_interval"`
+
+	// Secrets: TLS and JWT paths may be secret references (vault:, aws:, gcp:,
+	// env:, file:), re-read every SecretsRefreshSeconds to pick up rotation
+	SecretsRefreshSeconds int            `yaml:"secrets_refresh_seconds"`
+	Secrets               *secrets.Store `yaml:"-"`
+
+	// EventBus carries the events: "kafka", or "nats" for NATS JetStream
+	// where Kafka is too heavy. Topics below become NATS subjects under
+	// NATSSubjectPrefix
+	EventBus          string   `yaml:"event_bus"`
+	NATSURLs          []string `yaml:"nats_urls"`
+	NATSSubjectPrefix string   `yaml:"nats_subject_prefix"`
+	NATSToken         string   `yaml:"nats_token" secret:"true"`
+	NATSUser          string   `yaml:"nats_user"`
+	NATSPassword      string   `yaml:"nats_password" secret:"true"`
+	NATSAckTimeout    Duration `yaml:"nats_ack_timeout"`
+
+	// Kafka
+	KafkaBrokers        []string `yaml:"kafka_brokers"`
+	KafkaTopic          string   `yaml:"kafka_topic"`          // Access logs
+	KafkaFeaturesTopic  string   `yaml:"kafka_features_topic"` // Compact feature vectors (optional)
+	KafkaFlowTopic      string   `yaml:"kafka_flow_topic"`     // Connection flow records of "tcp" listeners
+	AccessLogFeatures   bool     `yaml:"access_log_features"`
+	AccessLogSampleRate float64  `yaml:"access_log_sample_rate"` // Fraction of allowed requests logged
+	// Access logs are shipped by a fixed pool of workers from a bounded
+	// queue; the overflow policy is drop-newest, drop-oldest or block
+	LogShipWorkers   int    `yaml:"log_ship_workers"`
+	LogShipQueueSize int    `yaml:"log_ship_queue_size"`
+	LogShipOverflow  string `yaml:"log_ship_overflow"`
+
+	// Verdicts (optional Kafka-driven enforcement)
+	KafkaVerdictTopic     string  `yaml:"kafka_verdict_topic"`
+	VerdictTTLSeconds     int     `yaml:"verdict_ttl_seconds"`
+	VerdictRateLimitRPS   float64 `yaml:"verdict_rate_limit_rps"`
+	VerdictRateLimitBurst int     `yaml:"verdict_rate_limit_burst"`
+	// VerdictPushToken is required from AI engines pushing verdicts to a
+	// "verdicts" listener, unless it is an mtls listener and
+	// VerdictPushClientNames names the AI engine's certificates
+	VerdictPushToken string `yaml:"verdict_push_token" secret:"true"`
+	// VerdictPushClientNames, if set, limits pushes to client certificates
+	// with one of these common names or DNS names
+	VerdictPushClientNames []string `yaml:"verdict_push_client_names"`
+
+	// Per-client rate limit applied by the "ratelimit" stage
+	RateLimitRPS   float64 `yaml:"rate_limit_rps"`
+	RateLimitBurst int     `yaml:"rate_limit_burst"`
+
+	// Redis
+	RedisURL string `yaml:"redis_url"`
+
+	// Audit and explainability
+	KafkaAuditTopic string `yaml:"kafka_audit_topic"`
+	// Audit events are also appended to AuditChainPath as a hash chain,
+	// with checkpoints signed by the PEM private key at
+	// AuditChainSigningKeyPath every AuditCheckpointInterval
+	AuditChainPath           string        `yaml:"audit_chain_path"`
+	AuditChainSigningKeyPath string        `yaml:"audit_chain_signing_key_path"`
+	AuditChainSigningKey     crypto.Signer `yaml:"-"`
+	AuditCheckpointInterval  Duration      `yaml:"audit_checkpoint_interval"`
+	DecisionTTLSeconds       int           `yaml:"decision_ttl_seconds"`
+	DecisionTopFeatures      int           `yaml:"decision_top_features"`
+	KafkaDecisionsTopic      string        `yaml:"kafka_decisions_topic"` // Per-request decision logs of the decisions stage
+
+	// Admin API, served only on admin listeners; without one, an mtls
+	// admin listener is added on AdminAddress
+	AdminToken         string `yaml:"admin_token" secret:"true"`
+	AdminAddress       string `yaml:"admin_address"`
+	KafkaFeedbackTopic string `yaml:"kafka_feedback_topic"`
+	// Admin listeners trust their own client CA, if set, and may be
+	// restricted to client certificates with these common names
+	AdminCACertPath string   `yaml:"admin_ca_cert_path"`
+	AdminClientCNs  []string `yaml:"admin_client_cns"`
+
+	// Decision webhooks, signed with WebhookSecret
+	WebhookURLs           []string `yaml:"webhook_urls" secret:"true"` // Chat webhook URLs embed tokens
+	WebhookSecret         string   `yaml:"webhook_secret" secret:"true"`
+	WebhookEvents         []string `yaml:"webhook_events"` // "block", "challenge", "score", "guardrail"
+	WebhookScoreThreshold float64  `yaml:"webhook_score_threshold"`
+	WebhookMaxRetries     int      `yaml:"webhook_max_retries"`
+	WebhookTimeout        Duration `yaml:"webhook_timeout"`
+	WebhookCooldown       Duration `yaml:"webhook_cooldown"`
+
+	// Blocklist monitor alerting when blocks in a window reach
+	// BlockSpikeFactor times the baseline; 0 interval disables
+	BlocklistMonitorInterval Duration `yaml:"blocklist_monitor_interval"`
+	BlockSpikeWindow         Duration `yaml:"block_spike_window"`
+	BlockSpikeBaseline       Duration `yaml:"block_spike_baseline"`
+	BlockSpikeFactor         float64  `yaml:"block_spike_factor"`
+	BlockSpikeMinBlocks      int      `yaml:"block_spike_min_blocks"`
+
+	// Caps on automated enforcement: allowlisted ASNs (with GeoIPDatabases)
+	// and JWT subjects are never blocked, new blocks are held while over
+	// GuardrailMaxBlockedPercent of the unique client networks in
+	// GuardrailWindow are blocked (0 disables), and the blocklist monitor's
+	// guardrails in GuardrailRevert engage the kill switch
+	GuardrailMaxBlockedPercent float64  `yaml:"guardrail_max_blocked_percent"`
+	GuardrailWindow            Duration `yaml:"guardrail_window"`
+	GuardrailMinClients        int      `yaml:"guardrail_min_clients"`
+	GuardrailAllowASNs         []uint32 `yaml:"guardrail_allow_asns"`
+	GuardrailAllowSubjects     []string `yaml:"guardrail_allow_subjects"`
+	GuardrailRevert            []string `yaml:"guardrail_revert"` // "block_rate_spike", "blocklist_growth"
+
+	// OPA sidecar deciding requests in the opa stage
+	OPAURL      string   `yaml:"opa_url"` // Data API document, e.g. http://localhost:8181/v1/data/aegis/authz
+	OPATimeout  Duration `yaml:"opa_timeout"`
+	OPAFailOpen bool     `yaml:"opa_fail_open"`
+
+	// IdP token endpoint the exchange stage trades inbound tokens at
+	// (RFC 8693), authenticating as the client TokenExchangeClientID
+	TokenExchangeURL          string   `yaml:"token_exchange_url"`
+	TokenExchangeClientID     string   `yaml:"token_exchange_client_id"`
+	TokenExchangeClientSecret string   `yaml:"token_exchange_client_secret" secret:"true"`
+	TokenExchangeAudience     string   `yaml:"token_exchange_audience"` // Routes may set their own
+	TokenExchangeScope        string   `yaml:"token_exchange_scope"`
+	TokenExchangeTimeout      Duration `yaml:"token_exchange_timeout"`
+
+	// PEM private key the assertion stage signs identity assertions with,
+	// valid for AssertionTTL
+	AssertionSigningKeyPath string        `yaml:"assertion_signing_key_path"`
+	AssertionSigningKey     crypto.Signer `yaml:"-"`
+	AssertionIssuer         string        `yaml:"assertion_issuer"`
+	AssertionAudience       string        `yaml:"assertion_audience"`
+	AssertionTTL            Duration      `yaml:"assertion_ttl"`
+
+	// "block" or "detect" HTTP protocol anomalies in the protocol stage
+	ProtocolMode string `yaml:"protocol_mode"`
+	// Request paths are made canonical before any stage with "normalize",
+	// non-canonical ones refused with "strict", or left alone with "off"
+	PathNormalization string `yaml:"path_normalization"`
+
+	// Request inspection in the waf stage
+	WAFMode             string   `yaml:"waf_mode"`              // "block" or "detect"
+	WAFAnomalyThreshold int      `yaml:"waf_anomaly_threshold"` // Blocks at or above this total rule score
+	WAFMaxBody          ByteSize `yaml:"waf_max_body"`          // Bytes of each body inspected
+	WAFDisabledRules    []string `yaml:"waf_disabled_rules"`    // Rule IDs, e.g. 941180
+
+	// Response scanning in the dlp stage
+	DLPAction   string   `yaml:"dlp_action"`   // "mask", "block" or "alert"
+	DLPPatterns []string `yaml:"dlp_patterns"` // Built-in patterns, e.g. credit_card
+	// Extra patterns by name, and actions overriding DLPAction; file only
+	DLPCustomPatterns map[string]string `yaml:"dlp_custom_patterns"`
+	DLPPatternActions map[string]string `yaml:"dlp_pattern_actions"`
+	DLPMaxBody        ByteSize          `yaml:"dlp_max_body"` // Larger responses aren't scanned
+	KafkaDLPTopic     string            `yaml:"kafka_dlp_topic"`
+
+	// Path prefixes quarantined clients may still reach
+	QuarantinePaths []string `yaml:"quarantine_paths"`
+
+	// Honeypot routes
+	HoneypotPaths           []string `yaml:"honeypot_paths"`
+	HoneypotScore           float64  `yaml:"honeypot_score"`
+	HoneypotScoreTTLSeconds int      `yaml:"honeypot_score_ttl_seconds"`
+	HoneypotAutoBlock       bool     `yaml:"honeypot_auto_block"`
+	HoneypotBlockTTLSeconds int      `yaml:"honeypot_block_ttl_seconds"`
+	KafkaHoneypotTopic      string   `yaml:"kafka_honeypot_topic"`
+
+	// Rolling risk aggregates
+	AggregateWindow Duration `yaml:"aggregate_window"`
+	AggregateTopN   int      `yaml:"aggregate_top_n"`
+
+	// Risk scoring
+	ScoringURL             string   `yaml:"scoring_url"`
+	ScoringModel           string   `yaml:"scoring_model"`
+	ScoringShadowURL       string   `yaml:"scoring_shadow_url"`
+	ScoringShadowModel     string   `yaml:"scoring_shadow_model"`
+	ScoringTimeout         Duration `yaml:"scoring_timeout"`
+	RiskChallengeThreshold float64  `yaml:"risk_challenge_threshold"`
+	RiskBlockThreshold     float64  `yaml:"risk_block_threshold"`
+
+	// Heuristic fallback scorer
+	HeuristicScoring        bool     `yaml:"heuristic_scoring"`
+	HeuristicWindow         Duration `yaml:"heuristic_window"`
+	HeuristicMinRequests    int      `yaml:"heuristic_min_requests"`
+	HeuristicMaxRPS         float64  `yaml:"heuristic_max_rps"`
+	HeuristicMaxErrorRate   float64  `yaml:"heuristic_max_error_rate"`
+	HeuristicMaxPathEntropy float64  `yaml:"heuristic_max_path_entropy"`
+	HeuristicMaxPayload     ByteSize `yaml:"heuristic_max_payload"`
+
+	// Per-route scoring profiles
+	RouteProfiles []RouteProfile `yaml:"route_profiles"`
+
+	// Graduated responses
+	ResponsePolicy         []ResponseBand `yaml:"response_policy"`
+	TarpitDelayMs          int            `yaml:"tarpit_delay_ms"`
+	TempBlockTTLSeconds    int            `yaml:"temp_block_ttl_seconds"`
+	ResponseRateLimitRPS   float64        `yaml:"response_rate_limit_rps"`
+	ResponseRateLimitBurst int            `yaml:"response_rate_limit_burst"`
+	// How long a client that re-authenticated after a reauth action isn't
+	// asked again
+	ReauthClearance Duration `yaml:"reauth_clearance"`
+
+	// Escalating block durations: a client's nth block lasts the nth step of
+	// the ladder (the last step after that), counted in Redis until
+	// BlockEscalationDecay passes after its last block. Ladders are kept per
+	// action type (temp_block, honeypot, ai_engine; file only), defaulting
+	// to BlockEscalation. Empty BlockEscalation keeps the fixed TTLs
+	BlockEscalation        []Duration            `yaml:"block_escalation"`
+	BlockEscalationActions map[string][]Duration `yaml:"block_escalation_actions"`
+	BlockEscalationDecay   Duration              `yaml:"block_escalation_decay"`
+
+	// Challenge action: "deny", "pow" (JavaScript proof of work) or "captcha"
+	ChallengeMode         string   `yaml:"challenge_mode"`
+	ChallengeSecret       string   `yaml:"challenge_secret" secret:"true"` // At least 32 bytes
+	ChallengeDifficulty   int      `yaml:"challenge_difficulty"`           // Leading zero bits
+	ChallengeClearanceTTL Duration `yaml:"challenge_clearance_ttl"`
+	ChallengeCookieName   string   `yaml:"challenge_cookie_name"`
+	ChallengePath         string   `yaml:"challenge_path"`   // Where solutions are posted
+	CaptchaProvider       string   `yaml:"captcha_provider"` // "hcaptcha", "recaptcha" or "turnstile"
+	CaptchaSiteKey        string   `yaml:"captcha_site_key"`
+	CaptchaSecretKey      string   `yaml:"captcha_secret_key" secret:"true"`
+
+	// Enforcement
+	EnforcementMode string `yaml:"enforcement_mode"` // "monitor" or "enforce"
+	// Redis key of the fleet-wide kill switch, which forces monitor mode
+	KillSwitchKey   string   `yaml:"kill_switch_key"`
+	KillSwitchPoll  Duration `yaml:"kill_switch_poll"`
+	ScoreSmoothing  string   `yaml:"score_smoothing"` // "none", "ewma" or "window"
+	ScoreEWMAAlpha  float64  `yaml:"score_ewma_alpha"`
+	ScoreWindowSize int      `yaml:"score_window_size"` // N
+	ScoreWindowHits int      `yaml:"score_window_hits"` // K
+	ScoreHysteresis float64  `yaml:"score_hysteresis"`
+
+	// Response pages
+	PagesDir        string `yaml:"pages_dir"`       // Overrides for the built-in HTML pages
+	SupportContact  string `yaml:"support_contact"` // Shown on pages, e.g. an email address
+	MaintenanceMode bool   `yaml:"maintenance_mode"`
+	// Retry-After sent with maintenance responses
+	MaintenanceRetryAfter Duration `yaml:"maintenance_retry_after"`
+}
+
+// Listener is one address the proxy serves, with its own TLS policy and handler.
+type Listener struct {
+	Name    string `yaml:"name"`
+	Address string `yaml:"address"`
+	TLS     string `yaml:"tls"`     // "mtls", "tls" or "none"
+	Handler string `yaml:"handler"` // "proxy" (full chain), "admin" (admin API and metrics), "extauthz" (Envoy ext_authz) "verdicts" (verdict push), "egress" (forward proxy) or "tcp" (L4 relay)
+	// Upstream is the host:port a "tcp" listener relays connections to
+	Upstream string `yaml:"upstream"`
+	// ProxyProtocol reads the client address from PROXY protocol headers
+	// sent by ProxyProtocolTrusted load balancers
+	ProxyProtocol bool `yaml:"proxy_protocol"`
+}
+
+// ResponseBand maps scores at or above MinScore to an action.
+type ResponseBand struct {
+	MinScore float64 `yaml:"min_score"`
+	Action   string  `yaml:"action"`
+}
+
+// RouteProfile selects the model and, optionally, the response policy for
+// requests under a path prefix.
+type RouteProfile struct {
+	Prefix  string         `yaml:"prefix"`
+	ModelID string         `yaml:"model_id"`
+	Policy  []ResponseBand `yaml:"policy"` // Empty inherits RESPONSE_POLICY
+	// SampleRate is the fraction of the route's allowed requests logged;
+	// unset inherits ACCESS_LOG_SAMPLE_RATE
+	SampleRate *float64 `yaml:"sample_rate"`
+}
+
+// responseActions are the actions a response band may use.
+var responseActions = map[string]bool{
+	"allow": true, "log_only": true, "tarpit": true, "challenge": true, "reauth": true,
+	"rate_limit": true, "block": true, "temp_block": true, "perma_block": true,
+}
+
+// Load reads configuration from the optional YAML file named by CONFIG_FILE,
+// then applies environment variable overrides and validates the result.
+func Load() (*Config, error) {
+	base := defaults()
+	path := os.Getenv("CONFIG_FILE")
+
+	// The preset goes under the file, so the file can still override it
+	preset := os.Getenv("PRESET")
+	if preset == "" && path != "" {
+		var err error
+		if preset, err = filePreset(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := applyPreset(base, preset); err != nil {
+		return nil, err
+	}
+
+	if path != "" {
+		if err := loadFile(path, base); err != nil {
+			return nil, err
+		}
+	}
+
+	// Variables that are set must parse; Load fails rather than use the
+	// default in their place
+	env := &envReader{}
+	cfg := &Config{
+		Port:             env.getInt("PORT", base.Port),
+		LogLevel:         getEnv("LOG_LEVEL", base.LogLevel),
+		UpstreamURL:      getEnv("UPSTREAM_URL", base.UpstreamURL),
+		TLSCertPath:      getEnv("TLS_CERT_PATH", base.TLSCertPath),
+		TLSKeyPath:       getEnv("TLS_KEY_PATH", base.TLSKeyPath),
+		CACertPath:       getEnv("CA_CERT_PATH", base.CACertPath),
+		TLSPolicy:        getEnv("TLS_POLICY", base.TLSPolicy),
+		FailOpen:         env.getBool("FAIL_OPEN", base.FailOpen),
+		FIPSMode:         env.getBool("FIPS_MODE", base.FIPSMode) || FIPSBuild,
+		Preset:           preset,
+		JWTPublicKeyPath: getEnv("JWT_PUBLIC_KEY_PATH", base.JWTPublicKeyPath),
+		JWTLeeway:        env.getDuration("JWT_LEEWAY", base.JWTLeeway),
+		JWTExpiryWarning: env.getDuration("JWT_EXPIRY_WARNING", base.JWTExpiryWarning),
+		KafkaBrokers:     getEnvList("KAFKA_BROKERS", base.KafkaBrokers),
+		KafkaTopic:       getEnv("KAFKA_TOPIC", base.KafkaTopic),
+		RedisURL:         getEnv("REDIS_URL", base.RedisURL),
+
+		ClockCheck:         getEnv("CLOCK_CHECK", base.ClockCheck),
+		ClockCheckInterval: env.getDuration("CLOCK_CHECK_INTERVAL", base.ClockCheckInterval),
+
+		EventBus:          getEnv("EVENT_BUS", base.EventBus),
+		NATSURLs:          getEnvList("NATS_URLS", base.NATSURLs),
+		NATSSubjectPrefix: getEnv("NATS_SUBJECT_PREFIX", base.NATSSubjectPrefix),
+		NATSToken:         getEnv("NATS_TOKEN", base.NATSToken),
+		NATSUser:          getEnv("NATS_USER", base.NATSUser),
+		NATSPassword:      getEnv("NATS_PASSWORD", base.NATSPassword),
+		NATSAckTimeout:    env.getDuration("NATS_ACK_TIMEOUT", base.NATSAckTimeout),
+
+		ServerReadTimeout:   env.getDuration("SERVER_READ_TIMEOUT", base.ServerReadTimeout),
+		ServerWriteTimeout:  env.getDuration("SERVER_WRITE_TIMEOUT", base.ServerWriteTimeout),
+		ServerIdleTimeout:   env.getDuration("SERVER_IDLE_TIMEOUT", base.ServerIdleTimeout),
+		UpstreamTimeout:     env.getDuration("UPSTREAM_TIMEOUT", base.UpstreamTimeout),
+		UpstreamDialTimeout: env.getDuration("UPSTREAM_DIAL_TIMEOUT", base.UpstreamDialTimeout),
+		UpstreamURLs:        getEnvList("UPSTREAM_URLS", base.UpstreamURLs),
+		UpstreamDraining:    getEnvList("UPSTREAM_DRAINING", base.UpstreamDraining),
+
+		UpstreamDNS:    getEnv("UPSTREAM_DNS", base.UpstreamDNS),
+		UpstreamDNSTTL: env.getDuration("UPSTREAM_DNS_TTL", base.UpstreamDNSTTL),
+
+		UpstreamRegistry:       getEnv("UPSTREAM_REGISTRY", base.UpstreamRegistry),
+		UpstreamRegistryURL:    getEnv("UPSTREAM_REGISTRY_URL", base.UpstreamRegistryURL),
+		UpstreamRegistryToken:  getEnv("UPSTREAM_REGISTRY_TOKEN", base.UpstreamRegistryToken),
+		UpstreamRegistryPoll:   env.getDuration("UPSTREAM_REGISTRY_POLL", base.UpstreamRegistryPoll),
+		UpstreamRegistryScheme: getEnv("UPSTREAM_REGISTRY_SCHEME", base.UpstreamRegistryScheme),
+		UpstreamService:        getEnv("UPSTREAM_SERVICE", base.UpstreamService),
+		UpstreamServiceTag:     getEnv("UPSTREAM_SERVICE_TAG", base.UpstreamServiceTag),
+
+		MockUpstream:        env.getBool("MOCK_UPSTREAM", base.MockUpstream),
+		MockUpstreamAddr:    getEnv("MOCK_UPSTREAM_ADDR", base.MockUpstreamAddr),
+		MockUpstreamStatus:  env.getInt("MOCK_UPSTREAM_STATUS", base.MockUpstreamStatus),
+		MockUpstreamLatency: env.getDuration("MOCK_UPSTREAM_LATENCY", base.MockUpstreamLatency),
+
+		IngressController:    getEnv("INGRESS_CONTROLLER", base.IngressController),
+		IngressClass:         getEnv("INGRESS_CLASS", base.IngressClass),
+		IngressGateway:       getEnv("INGRESS_GATEWAY", base.IngressGateway),
+		IngressNamespace:     getEnv("INGRESS_NAMESPACE", base.IngressNamespace),
+		IngressClusterDomain: getEnv("INGRESS_CLUSTER_DOMAIN", base.IngressClusterDomain),
+		IngressResync:        env.getDuration("INGRESS_RESYNC", base.IngressResync),
+
+		TransferProgressTimeout: env.getDuration("TRANSFER_PROGRESS_TIMEOUT", base.TransferProgressTimeout),
+
+		AcceptLoops:    env.getInt("ACCEPT_LOOPS", base.AcceptLoops),
+		AutoGOMAXPROCS: env.getBool("AUTO_GOMAXPROCS", base.AutoGOMAXPROCS),
+
+		ServerReadHeaderTimeout: env.getDuration("SERVER_READ_HEADER_TIMEOUT", base.ServerReadHeaderTimeout),
+		MaxConnections:          env.getInt("MAX_CONNECTIONS", base.MaxConnections),
+		MaxConnectionsPerIP:     env.getInt("MAX_CONNECTIONS_PER_IP", base.MaxConnectionsPerIP),
+		MinTransferRate:         env.getByteSize("MIN_TRANSFER_RATE", base.MinTransferRate),
+		MinTransferRateGrace:    env.getDuration("MIN_TRANSFER_RATE_GRACE", base.MinTransferRateGrace),
+
+		ProxyProtocolTrusted: getEnvList("PROXY_PROTOCOL_TRUSTED", base.ProxyProtocolTrusted),
+		ProxyProtocolTimeout: env.getDuration("PROXY_PROTOCOL_TIMEOUT", base.ProxyProtocolTimeout),
+
+		RequestIDTrusted: getEnvList("REQUEST_ID_TRUSTED", base.RequestIDTrusted),
+		TrustedProxies:   getEnvList("TRUSTED_PROXIES", base.TrustedProxies),
+
+		SidecarMode:       env.getBool("SIDECAR_MODE", base.SidecarMode),
+		SidecarAppPort:    env.getInt("SIDECAR_APP_PORT", base.SidecarAppPort),
+		SidecarDrainDelay: env.getDuration("SIDECAR_DRAIN_DELAY", base.SidecarDrainDelay),
+
+		CloudMetadata: getEnv("CLOUD_METADATA", base.CloudMetadata),
+		CloudCluster:  getEnv("CLOUD_CLUSTER", base.CloudCluster),
+
+		ReadinessInterval: env.getDuration("READINESS_INTERVAL", base.ReadinessInterval),
+		ReadinessRequired: getEnvList("READINESS_REQUIRED", base.ReadinessRequired),
+
+		ClusterSync:         env.getBool("CLUSTER_SYNC", base.ClusterSync),
+		ClusterNode:         getEnv("CLUSTER_NODE", getEnv("POD_NAME", base.ClusterNode)),
+		ClusterSyncInterval: env.getDuration("CLUSTER_SYNC_INTERVAL", base.ClusterSyncInterval),
+		ClusterKeyPrefix:    getEnv("CLUSTER_KEY_PREFIX", base.ClusterKeyPrefix),
+
+		UpstreamAllowedHosts:          getEnvList("UPSTREAM_ALLOWED_HOSTS", base.UpstreamAllowedHosts),
+		UpstreamAllowedCIDRs:          getEnvList("UPSTREAM_ALLOWED_CIDRS", base.UpstreamAllowedCIDRs),
+		UpstreamBlockPrivateRedirects: env.getBool("UPSTREAM_BLOCK_PRIVATE_REDIRECTS", base.UpstreamBlockPrivateRedirects),
+		RequestSigningKeyPath:         getEnv("REQUEST_SIGNING_KEY_PATH", base.RequestSigningKeyPath),
+		RequestSigningTTL:             env.getDuration("REQUEST_SIGNING_TTL", base.RequestSigningTTL),
+
+		EgressAllowedHosts: getEnvList("EGRESS_ALLOWED_HOSTS", base.EgressAllowedHosts),
+		EgressAllowedPorts: base.EgressAllowedPorts,
+		EgressAllowedCIDRs: getEnvList("EGRESS_ALLOWED_CIDRS", base.EgressAllowedCIDRs),
+		EgressAllowPrivate: env.getBool("EGRESS_ALLOW_PRIVATE", base.EgressAllowPrivate),
+
+		KafkaAuditTopic:          getEnv("KAFKA_AUDIT_TOPIC", base.KafkaAuditTopic),
+		AuditChainPath:           getEnv("AUDIT_CHAIN_PATH", base.AuditChainPath),
+		AuditChainSigningKeyPath: getEnv("AUDIT_CHAIN_SIGNING_KEY_PATH", base.AuditChainSigningKeyPath),
+		AuditCheckpointInterval:  env.getDuration("AUDIT_CHECKPOINT_INTERVAL", base.AuditCheckpointInterval),
+		DecisionTTLSeconds:       env.getInt("DECISION_TTL_SECONDS", base.DecisionTTLSeconds),
+		DecisionTopFeatures:      env.getInt("DECISION_TOP_FEATURES", base.DecisionTopFeatures),
+		KafkaDecisionsTopic:      getEnv("KAFKA_DECISIONS_TOPIC", base.KafkaDecisionsTopic),
+		AdminToken:               getEnv("ADMIN_TOKEN", base.AdminToken),
+		AdminAddress:             getEnv("ADMIN_ADDRESS", base.AdminAddress),
+		KafkaFeedbackTopic:       getEnv("KAFKA_FEEDBACK_TOPIC", base.KafkaFeedbackTopic),
+		AdminCACertPath:          getEnv("ADMIN_CA_CERT_PATH", base.AdminCACertPath),
+		AdminClientCNs:           getEnvList("ADMIN_CLIENT_CNS", base.AdminClientCNs),
+
+		WebhookURLs:           getEnvList("WEBHOOK_URLS", base.WebhookURLs),
+		WebhookSecret:         getEnv("WEBHOOK_SECRET", base.WebhookSecret),
+		WebhookEvents:         getEnvList("WEBHOOK_EVENTS", base.WebhookEvents),
+		WebhookScoreThreshold: env.getFloat("WEBHOOK_SCORE_THRESHOLD", base.WebhookScoreThreshold),
+		WebhookMaxRetries:     env.getInt("WEBHOOK_MAX_RETRIES", base.WebhookMaxRetries),
+		WebhookTimeout:        env.getDuration("WEBHOOK_TIMEOUT", base.WebhookTimeout),
+		WebhookCooldown:       env.getDuration("WEBHOOK_COOLDOWN", base.WebhookCooldown),
+
+		BlocklistMonitorInterval: env.getDuration("BLOCKLIST_MONITOR_INTERVAL", base.BlocklistMonitorInterval),
+		BlockSpikeWindow:         env.getDuration("BLOCK_SPIKE_WINDOW", base.BlockSpikeWindow),
+		BlockSpikeBaseline:       env.getDuration("BLOCK_SPIKE_BASELINE", base.BlockSpikeBaseline),
+		BlockSpikeFactor:         env.getFloat("BLOCK_SPIKE_FACTOR", base.BlockSpikeFactor),
+		BlockSpikeMinBlocks:      env.getInt("BLOCK_SPIKE_MIN_BLOCKS", base.BlockSpikeMinBlocks),
+
+		GuardrailMaxBlockedPercent: env.getFloat("GUARDRAIL_MAX_BLOCKED_PERCENT", base.GuardrailMaxBlockedPercent),
+		GuardrailWindow:            env.getDuration("GUARDRAIL_WINDOW", base.GuardrailWindow),
+		GuardrailMinClients:        env.getInt("GUARDRAIL_MIN_CLIENTS", base.GuardrailMinClients),
+		GuardrailAllowASNs:         base.GuardrailAllowASNs,
+		GuardrailAllowSubjects:     getEnvList("GUARDRAIL_ALLOW_SUBJECTS", base.GuardrailAllowSubjects),
+		GuardrailRevert:            getEnvList("GUARDRAIL_REVERT", base.GuardrailRevert),
+
+		OPAURL:      getEnv("OPA_URL", base.OPAURL),
+		OPATimeout:  env.getDuration("OPA_TIMEOUT", base.OPATimeout),
+		OPAFailOpen: env.getBool("OPA_FAIL_OPEN", base.OPAFailOpen),
+
+		TokenExchangeURL:          getEnv("TOKEN_EXCHANGE_URL", base.TokenExchangeURL),
+		TokenExchangeClientID:     getEnv("TOKEN_EXCHANGE_CLIENT_ID", base.TokenExchangeClientID),
+		TokenExchangeClientSecret: getEnv("TOKEN_EXCHANGE_CLIENT_SECRET", base.TokenExchangeClientSecret),
+		TokenExchangeAudience:     getEnv("TOKEN_EXCHANGE_AUDIENCE", base.TokenExchangeAudience),
+		TokenExchangeScope:        getEnv("TOKEN_EXCHANGE_SCOPE", base.TokenExchangeScope),
+		TokenExchangeTimeout:      env.getDuration("TOKEN_EXCHANGE_TIMEOUT", base.TokenExchangeTimeout),
+
+		AssertionSigningKeyPath: getEnv("ASSERTION_SIGNING_KEY_PATH", base.AssertionSigningKeyPath),
+		AssertionIssuer:         getEnv("ASSERTION_ISSUER", base.AssertionIssuer),
+		AssertionAudience:       getEnv("ASSERTION_AUDIENCE", base.AssertionAudience),
+		AssertionTTL:            env.getDuration("ASSERTION_TTL", base.AssertionTTL),
+
+		ProtocolMode:      getEnv("PROTOCOL_MODE", base.ProtocolMode),
+		PathNormalization: getEnv("PATH_NORMALIZATION", base.PathNormalization),
+
+		WAFMode:             getEnv("WAF_MODE", base.WAFMode),
+		WAFAnomalyThreshold: env.getInt("WAF_ANOMALY_THRESHOLD", base.WAFAnomalyThreshold),
+		WAFMaxBody:          env.getByteSize("WAF_MAX_BODY", base.WAFMaxBody),
+		WAFDisabledRules:    getEnvList("WAF_DISABLED_RULES", base.WAFDisabledRules),
+
+		DLPAction:         getEnv("DLP_ACTION", base.DLPAction),
+		DLPPatterns:       getEnvList("DLP_PATTERNS", base.DLPPatterns),
+		DLPCustomPatterns: base.DLPCustomPatterns,
+		DLPPatternActions: base.DLPPatternActions,
+		DLPMaxBody:        env.getByteSize("DLP_MAX_BODY", base.DLPMaxBody),
+		KafkaDLPTopic:     getEnv("KAFKA_DLP_TOPIC", base.KafkaDLPTopic),
+
+		QuarantinePaths: getEnvList("QUARANTINE_PATHS", base.QuarantinePaths),
+
+		HoneypotPaths:           getEnvList("HONEYPOT_PATHS", base.HoneypotPaths),
+		HoneypotScore:           env.getFloat("HONEYPOT_SCORE", base.HoneypotScore),
+		HoneypotScoreTTLSeconds: env.getInt("HONEYPOT_SCORE_TTL_SECONDS", base.HoneypotScoreTTLSeconds),
+		HoneypotAutoBlock:       env.getBool("HONEYPOT_AUTO_BLOCK", base.HoneypotAutoBlock),
+		HoneypotBlockTTLSeconds: env.getInt("HONEYPOT_BLOCK_TTL_SECONDS", base.HoneypotBlockTTLSeconds),
+		KafkaHoneypotTopic:      getEnv("KAFKA_HONEYPOT_TOPIC", base.KafkaHoneypotTopic),
+
+		AggregateWindow: env.getDuration("AGGREGATE_WINDOW", env.getLegacyDuration("AGGREGATE_WINDOW_MINUTES", time.Minute, base.AggregateWindow)),
+		AggregateTopN:   env.getInt("AGGREGATE_TOP_N", base.AggregateTopN),
+
+		KafkaFeaturesTopic: getEnv("KAFKA_FEATURES_TOPIC", base.KafkaFeaturesTopic),
+		KafkaFlowTopic:     getEnv("KAFKA_FLOW_TOPIC", base.KafkaFlowTopic),
+		AccessLogFeatures:  env.getBool("ACCESS_LOG_FEATURES", base.AccessLogFeatures),
+
+		AccessLogSampleRate: env.getFloat("ACCESS_LOG_SAMPLE_RATE", base.AccessLogSampleRate),
+		LogShipWorkers:      env.getInt("LOG_SHIP_WORKERS", base.LogShipWorkers),
+		LogShipQueueSize:    env.getInt("LOG_SHIP_QUEUE_SIZE", base.LogShipQueueSize),
+		LogShipOverflow:     getEnv("LOG_SHIP_OVERFLOW", base.LogShipOverflow),
+
+		KafkaVerdictTopic:      getEnv("KAFKA_VERDICT_TOPIC", base.KafkaVerdictTopic),
+		VerdictTTLSeconds:      env.getInt("VERDICT_TTL_SECONDS", base.VerdictTTLSeconds),
+		VerdictRateLimitRPS:    env.getFloat("VERDICT_RATE_LIMIT_RPS", base.VerdictRateLimitRPS),
+		VerdictRateLimitBurst:  env.getInt("VERDICT_RATE_LIMIT_BURST", base.VerdictRateLimitBurst),
+		VerdictPushToken:       getEnv("VERDICT_PUSH_TOKEN", base.VerdictPushToken),
+		VerdictPushClientNames: getEnvList("VERDICT_PUSH_CLIENT_NAMES", base.VerdictPushClientNames),
+
+		Stages:         getEnvList("STAGES", base.Stages),
+		StageSettings:  base.StageSettings,
+		Plugins:        getEnvList("PLUGINS", base.Plugins),
+		RateLimitRPS:   env.getFloat("RATE_LIMIT_RPS", base.RateLimitRPS),
+		RateLimitBurst: env.getInt("RATE_LIMIT_BURST", base.RateLimitBurst),
+
+		CORS: CORSPolicy{
+			AllowedOrigins:   getEnvList("CORS_ALLOWED_ORIGINS", base.CORS.AllowedOrigins),
+			AllowedMethods:   getEnvList("CORS_ALLOWED_METHODS", base.CORS.AllowedMethods),
+			AllowedHeaders:   getEnvList("CORS_ALLOWED_HEADERS", base.CORS.AllowedHeaders),
+			ExposedHeaders:   getEnvList("CORS_EXPOSED_HEADERS", base.CORS.ExposedHeaders),
+			AllowCredentials: env.getBool("CORS_ALLOW_CREDENTIALS", base.CORS.AllowCredentials),
+			MaxAge:           env.getDuration("CORS_MAX_AGE", base.CORS.MaxAge),
+		},
+
+		CSRFSecret:        getEnv("CSRF_SECRET", base.CSRFSecret),
+		CSRFCookieName:    getEnv("CSRF_COOKIE_NAME", base.CSRFCookieName),
+		CSRFHeaderName:    getEnv("CSRF_HEADER_NAME", base.CSRFHeaderName),
+		CSRFFieldName:     getEnv("CSRF_FIELD_NAME", base.CSRFFieldName),
+		CSRFSessionCookie: getEnv("CSRF_SESSION_COOKIE", base.CSRFSessionCookie),
+
+		OIDCAuthorizeURL:      getEnv("OIDC_AUTHORIZE_URL", base.OIDCAuthorizeURL),
+		OIDCTokenURL:          getEnv("OIDC_TOKEN_URL", base.OIDCTokenURL),
+		OIDCClientID:          getEnv("OIDC_CLIENT_ID", base.OIDCClientID),
+		OIDCClientSecret:      getEnv("OIDC_CLIENT_SECRET", base.OIDCClientSecret),
+		OIDCRedirectURL:       getEnv("OIDC_REDIRECT_URL", base.OIDCRedirectURL),
+		OIDCScopes:            getEnvList("OIDC_SCOPES", base.OIDCScopes),
+		OIDCTimeout:           env.getDuration("OIDC_TIMEOUT", base.OIDCTimeout),
+		SessionCookieName:     getEnv("SESSION_COOKIE_NAME", base.SessionCookieName),
+		SessionTTL:            env.getDuration("SESSION_TTL", base.SessionTTL),
+		SessionLogoutPath:     getEnv("SESSION_LOGOUT_PATH", base.SessionLogoutPath),
+		SessionLogoutRedirect: getEnv("SESSION_LOGOUT_REDIRECT", base.SessionLogoutRedirect),
+
+		ReplayNonceHeader:     getEnv("REPLAY_NONCE_HEADER", base.ReplayNonceHeader),
+		ReplayTimestampHeader: getEnv("REPLAY_TIMESTAMP_HEADER", base.ReplayTimestampHeader),
+		ReplayWindow:          env.getDuration("REPLAY_WINDOW", base.ReplayWindow),
+
+		CacheMaxSize:  env.getByteSize("CACHE_MAX_SIZE", base.CacheMaxSize),
+		CacheMaxEntry: env.getByteSize("CACHE_MAX_ENTRY", base.CacheMaxEntry),
+		CacheRedis:    env.getBool("CACHE_REDIS", base.CacheRedis),
+
+		ShedMinLimit:         env.getInt("SHED_MIN_LIMIT", base.ShedMinLimit),
+		ShedMaxLimit:         env.getInt("SHED_MAX_LIMIT", base.ShedMaxLimit),
+		ShedInitialLimit:     env.getInt("SHED_INITIAL_LIMIT", base.ShedInitialLimit),
+		ShedLatencyTolerance: env.getFloat("SHED_LATENCY_TOLERANCE", base.ShedLatencyTolerance),
+		ShedRetryAfter:       env.getDuration("SHED_RETRY_AFTER", base.ShedRetryAfter),
+		ShedLowRisk:          env.getFloat("SHED_LOW_RISK", base.ShedLowRisk),
+		BandwidthLimit:       env.getByteSize("BANDWIDTH_LIMIT", base.BandwidthLimit),
+		BandwidthBurst:       env.getByteSize("BANDWIDTH_BURST", base.BandwidthBurst),
+		BandwidthKey:         getEnv("BANDWIDTH_KEY", base.BandwidthKey),
+		BandwidthTierClaim:   getEnv("BANDWIDTH_TIER_CLAIM", base.BandwidthTierClaim),
+		BandwidthTiers:       base.BandwidthTiers,
+
+		ConcurrencyLimit:        env.getInt("CONCURRENCY_LIMIT", base.ConcurrencyLimit),
+		ConcurrencyQueue:        env.getInt("CONCURRENCY_QUEUE", base.ConcurrencyQueue),
+		ConcurrencyQueueTimeout: env.getDuration("CONCURRENCY_QUEUE_TIMEOUT", base.ConcurrencyQueueTimeout),
+		ConcurrencyKey:          getEnv("CONCURRENCY_KEY", base.ConcurrencyKey),
+		GeoIPDatabases:          getEnvList("GEOIP_DATABASES", base.GeoIPDatabases),
+		TravelMaxSpeed:          env.getFloat("TRAVEL_MAX_SPEED", base.TravelMaxSpeed),
+		TravelMinDistance:       env.getFloat("TRAVEL_MIN_DISTANCE", base.TravelMinDistance),
+		TravelAction:            getEnv("TRAVEL_ACTION", base.TravelAction),
+		FamiliarityHistory:      env.getDuration("FAMILIARITY_HISTORY", base.FamiliarityHistory),
+		FamiliarityAction:       getEnv("FAMILIARITY_ACTION", base.FamiliarityAction),
+		FamiliarityTrigger:      getEnv("FAMILIARITY_TRIGGER", base.FamiliarityTrigger),
+		Schedules:               base.Schedules,
+		ChaosFaults:             base.ChaosFaults,
+
+		SecurityHeaders: SecurityHeaders{
+			HSTS:           getEnv("SECURITY_HSTS", base.SecurityHeaders.HSTS),
+			FrameOptions:   getEnv("SECURITY_FRAME_OPTIONS", base.SecurityHeaders.FrameOptions),
+			ReferrerPolicy: getEnv("SECURITY_REFERRER_POLICY", base.SecurityHeaders.ReferrerPolicy),
+			CSP:            getEnv("SECURITY_CSP", base.SecurityHeaders.CSP),
+		},
+
+		Tenants:      base.Tenants,
+		VirtualHosts: base.VirtualHosts,
+		TenantClaim:  getEnv("TENANT_CLAIM", base.TenantClaim),
+
+		ScoringURL:             getEnv("SCORING_URL", base.ScoringURL),
+		ScoringModel:           getEnv("SCORING_MODEL", base.ScoringModel),
+		ScoringShadowURL:       getEnv("SCORING_SHADOW_URL", base.ScoringShadowURL),
+		ScoringShadowModel:     getEnv("SCORING_SHADOW_MODEL", base.ScoringShadowModel),
+		ScoringTimeout:         env.getDuration("SCORING_TIMEOUT", env.getLegacyDuration("SCORING_TIMEOUT_MS", time.Millisecond, base.ScoringTimeout)),
+		RiskChallengeThreshold: env.getFloat("RISK_CHALLENGE_THRESHOLD", base.RiskChallengeThreshold),
+		RiskBlockThreshold:     env.getFloat("RISK_BLOCK_THRESHOLD", base.RiskBlockThreshold),
+
+		HeuristicScoring:        env.getBool("HEURISTIC_SCORING", base.HeuristicScoring),
+		HeuristicWindow:         env.getDuration("HEURISTIC_WINDOW", env.getLegacyDuration("HEURISTIC_WINDOW_SECONDS", time.Second, base.HeuristicWindow)),
+		HeuristicMinRequests:    env.getInt("HEURISTIC_MIN_REQUESTS", base.HeuristicMinRequests),
+		HeuristicMaxRPS:         env.getFloat("HEURISTIC_MAX_RPS", base.HeuristicMaxRPS),
+		HeuristicMaxErrorRate:   env.getFloat("HEURISTIC_MAX_ERROR_RATE", base.HeuristicMaxErrorRate),
+		HeuristicMaxPathEntropy: env.getFloat("HEURISTIC_MAX_PATH_ENTROPY", base.HeuristicMaxPathEntropy),
+		HeuristicMaxPayload:     env.getByteSize("HEURISTIC_MAX_PAYLOAD", ByteSize(env.getInt64("HEURISTIC_MAX_PAYLOAD_BYTES", int64(base.HeuristicMaxPayload)))),
+
+		TarpitDelayMs:          env.getInt("TARPIT_DELAY_MS", base.TarpitDelayMs),
+		TempBlockTTLSeconds:    env.getInt("TEMP_BLOCK_TTL_SECONDS", base.TempBlockTTLSeconds),
+		ResponseRateLimitRPS:   env.getFloat("RESPONSE_RATE_LIMIT_RPS", base.ResponseRateLimitRPS),
+		ResponseRateLimitBurst: env.getInt("RESPONSE_RATE_LIMIT_BURST", base.ResponseRateLimitBurst),
+		ReauthClearance:        env.getDuration("REAUTH_CLEARANCE", base.ReauthClearance),
+
+		BlockEscalation:        base.BlockEscalation,
+		BlockEscalationActions: base.BlockEscalationActions,
+		BlockEscalationDecay:   env.getDuration("BLOCK_ESCALATION_DECAY", base.BlockEscalationDecay),
+
+		ChallengeMode:         getEnv("CHALLENGE_MODE", base.ChallengeMode),
+		ChallengeSecret:       getEnv("CHALLENGE_SECRET", base.ChallengeSecret),
+		ChallengeDifficulty:   env.getInt("CHALLENGE_DIFFICULTY", base.ChallengeDifficulty),
+		ChallengeClearanceTTL: env.getDuration("CHALLENGE_CLEARANCE_TTL", base.ChallengeClearanceTTL),
+		ChallengeCookieName:   getEnv("CHALLENGE_COOKIE_NAME", base.ChallengeCookieName),
+		ChallengePath:         getEnv("CHALLENGE_PATH", base.ChallengePath),
+		CaptchaProvider:       getEnv("CAPTCHA_PROVIDER", base.CaptchaProvider),
+		CaptchaSiteKey:        getEnv("CAPTCHA_SITE_KEY", base.CaptchaSiteKey),
+		CaptchaSecretKey:      getEnv("CAPTCHA_SECRET_KEY", base.CaptchaSecretKey),
+
+		EnforcementMode: getEnv("ENFORCEMENT_MODE", base.EnforcementMode),
+		KillSwitchKey:   getEnv("KILL_SWITCH_KEY", base.KillSwitchKey),
+		KillSwitchPoll:  env.getDuration("KILL_SWITCH_POLL", base.KillSwitchPoll),
+		ScoreSmoothing:  getEnv("SCORE_SMOOTHING", base.ScoreSmoothing),
+		ScoreEWMAAlpha:  env.getFloat("SCORE_EWMA_ALPHA", base.ScoreEWMAAlpha),
+		ScoreWindowSize: env.getInt("SCORE_WINDOW_SIZE", base.ScoreWindowSize),
+		ScoreWindowHits: env.getInt("SCORE_WINDOW_HITS", base.ScoreWindowHits),
+		ScoreHysteresis: env.getFloat("SCORE_HYSTERESIS", base.ScoreHysteresis),
+
+		PagesDir:              getEnv("PAGES_DIR", base.PagesDir),
+		SupportContact:        getEnv("SUPPORT_CONTACT", base.SupportContact),
+		MaintenanceMode:       env.getBool("MAINTENANCE_MODE", base.MaintenanceMode),
+		MaintenanceRetryAfter: env.getDuration("MAINTENANCE_RETRY_AFTER", base.MaintenanceRetryAfter),
+
+		SecretsRefreshSeconds: env.getInt("SECRETS_REFRESH_SECONDS", base.SecretsRefreshSeconds),
+
+		ConfigWatchIntervalSeconds: env.getInt("CONFIG_WATCH_INTERVAL_SECONDS", base.ConfigWatchIntervalSeconds),
+
+		CentralConfigSource:        getEnv("CENTRAL_CONFIG_SOURCE", base.CentralConfigSource),
+		CentralConfigKey:           getEnv("CENTRAL_CONFIG_KEY", base.CentralConfigKey),
+		CentralConfigEtcdEndpoints: getEnvList("CENTRAL_CONFIG_ETCD_ENDPOINTS", base.CentralConfigEtcdEndpoints),
+		CentralConfigPoll:          env.getDuration("CENTRAL_CONFIG_POLL", base.CentralConfigPoll),
+
+		Listeners:      base.Listeners,
+		RouteProfiles:  base.RouteProfiles,
+		ResponsePolicy: base.ResponsePolicy,
+		RoutePolicies:  base.RoutePolicies,
+		RateLimitTiers: base.RateLimitTiers,
+	}
+
+	if env.err != nil {
+		return nil, env.err
+	}
+
+	if listeners := getEnv("LISTENERS", ""); listeners != "" {
+		parsed, err := parseListeners(listeners)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LISTENERS: %w", err)
+		}
+		cfg.Listeners = parsed
+	} else if len(cfg.Listeners) == 0 {
+		cfg.Listeners = []Listener{{Name: "main", Address: fmt.Sprintf(":%d", cfg.Port), TLS: "mtls", Handler: "proxy"}}
+	}
+	// The admin API never shares the proxy's listeners
+	if cfg.AdminToken != "" && !cfg.HasListener("admin") {
+		cfg.Listeners = append(cfg.Listeners, Listener{Name: "admin", Address: cfg.AdminAddress, TLS: "mtls", Handler: "admin"})
+	}
+	if err := validateListeners(cfg.Listeners); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateProxyProtocol(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateClock(); err != nil {
+		return nil, err
+	}
+	if cfg.RequestSigningKeyPath != "" && cfg.RequestSigningTTL <= 0 {
+		return nil, fmt.Errorf("REQUEST_SIGNING_TTL must be positive with REQUEST_SIGNING_KEY_PATH")
+	}
+	if cfg.AuditChainPath != "" && (cfg.AuditChainSigningKeyPath == "" || cfg.AuditCheckpointInterval <= 0) {
+		return nil, fmt.Errorf("AUDIT_CHAIN_SIGNING_KEY_PATH must be set and AUDIT_CHECKPOINT_INTERVAL positive with AUDIT_CHAIN_PATH")
+	}
+	if cfg.PathNormalization != "normalize" && cfg.PathNormalization != "strict" && cfg.PathNormalization != "off" {
+		return nil, fmt.Errorf("PATH_NORMALIZATION must be normalize, strict or off, got %q", cfg.PathNormalization)
+	}
+	if ports := getEnvList("EGRESS_ALLOWED_PORTS", nil); ports != nil {
+		cfg.EgressAllowedPorts = nil
+		for _, p := range ports {
+			port, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("EGRESS_ALLOWED_PORTS: invalid port %q", p)
+			}
+			cfg.EgressAllowedPorts = append(cfg.EgressAllowedPorts, port)
+		}
+	}
+	if steps := getEnvList("BLOCK_ESCALATION", nil); steps != nil {
+		cfg.BlockEscalation = nil
+		for _, s := range steps {
+			step, err := ParseDuration(s)
+			if err != nil {
+				return nil, fmt.Errorf("BLOCK_ESCALATION: %w", err)
+			}
+			cfg.BlockEscalation = append(cfg.BlockEscalation, step)
+		}
+	}
+	if asns := getEnvList("GUARDRAIL_ALLOW_ASNS", nil); asns != nil {
+		cfg.GuardrailAllowASNs = nil
+		for _, a := range asns {
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(a), "AS"), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("GUARDRAIL_ALLOW_ASNS: invalid ASN %q", a)
+			}
+			cfg.GuardrailAllowASNs = append(cfg.GuardrailAllowASNs, uint32(asn))
+		}
+	}
+	if err := cfg.validateEgress(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validateVerdictPush(); err != nil {
+		return nil, err
+	}
+
+	switch cfg.LogLevel {
+	case "debug", "info", "warn", "error":
+	default:
+		return nil, fmt.Errorf("LOG_LEVEL must be \"debug\", \"info\", \"warn\" or \"error\", got %q", cfg.LogLevel)
+	}
+	switch cfg.TLSPolicy {
+	case "intermediate", "modern", "fips":
+	default:
+		return nil, fmt.Errorf("TLS_POLICY must be \"intermediate\", \"modern\" or \"fips\", got %q", cfg.TLSPolicy)
+	}
+	if cfg.FIPSMode && cfg.TLSPolicy != "fips" {
+		return nil, fmt.Errorf("TLS_POLICY must be \"fips\" in FIPS mode, got %q", cfg.TLSPolicy)
+	}
+	if cfg.LogShipWorkers < 1 || cfg.LogShipQueueSize < 1 {
+		return nil, fmt.Errorf("LOG_SHIP_WORKERS and LOG_SHIP_QUEUE_SIZE must be positive")
+	}
+	switch cfg.LogShipOverflow {
+	case "drop-newest", "drop-oldest", "block":
+	default:
+		return nil, fmt.Errorf("LOG_SHIP_OVERFLOW must be drop-newest, drop-oldest or block, got %q", cfg.LogShipOverflow)
+	}
+
+	if err := validateStages(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateTenants(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateVirtualHosts(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateRoutePolicies(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateWebhooks(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateBlocklistMonitor(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateGuardrails(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateBlockEscalation(cfg); err != nil {
+		return nil, err
+	}
+	if err := validateChallenge(cfg); err != nil {
+		return nil, err
+	}
+
+	if cfg.KafkaHoneypotTopic == "" {
+		cfg.KafkaHoneypotTopic = cfg.KafkaFeedbackTopic
+	}
+
+	switch cfg.EventBus {
+	case "kafka":
+	case "nats":
+		if len(cfg.NATSURLs) == 0 {
+			return nil, fmt.Errorf("EVENT_BUS=nats requires NATS_URLS")
+		}
+		if cfg.NATSAckTimeout <= 0 {
+			return nil, fmt.Errorf("NATS_ACK_TIMEOUT must be positive")
+		}
+		// Verdicts are only consumed from Kafka
+		if cfg.KafkaVerdictTopic != "" {
+			return nil, fmt.Errorf("KAFKA_VERDICT_TOPIC requires EVENT_BUS=kafka")
+		}
+	default:
+		return nil, fmt.Errorf("EVENT_BUS must be kafka or nats, got %q", cfg.EventBus)
+	}
+
+	if cfg.ReadinessInterval <= 0 {
+		return nil, fmt.Errorf("READINESS_INTERVAL must be positive")
+	}
+	for i, name := range cfg.ReadinessRequired {
+		switch name {
+		case "redis", "kafka", "nats", "jwt", "upstream":
+		case "clock":
+			if cfg.ClockCheck == "" {
+				return nil, fmt.Errorf("READINESS_REQUIRED: clock requires CLOCK_CHECK")
+			}
+		default:
+			return nil, fmt.Errorf("READINESS_REQUIRED: unknown dependency %q (use redis, kafka, nats, jwt, upstream or clock)", name)
+		}
+		// The event bus is checked under its own name; the default list
+		// requires Kafka
+		if name == "kafka" && cfg.EventBus == "nats" {
+			cfg.ReadinessRequired[i] = "nats"
+		}
+	}
+
+	if cfg.ClusterSync && cfg.ClusterSyncInterval <= 0 {
+		return nil, fmt.Errorf("CLUSTER_SYNC_INTERVAL must be positive")
+	}
+
+	switch cfg.CloudMetadata {
+	case "off", "auto", "aws", "gcp":
+	default:
+		return nil, fmt.Errorf("CLOUD_METADATA must be off, auto, aws or gcp, got %q", cfg.CloudMetadata)
+	}
+
+	if cfg.SidecarMode {
+		if cfg.SidecarAppPort < 1 || cfg.SidecarAppPort > 65535 {
+			return nil, fmt.Errorf("SIDECAR_APP_PORT must be a port number")
+		}
+		if cfg.SidecarDrainDelay < 0 {
+			return nil, fmt.Errorf("SIDECAR_DRAIN_DELAY must not be negative")
+		}
+		// The app listens in the same pod
+		if cfg.UpstreamURL == "" && len(cfg.UpstreamURLs) == 0 && !cfg.Discovered() {
+			cfg.UpstreamURL = fmt.Sprintf("http://127.0.0.1:%d", cfg.SidecarAppPort)
+		}
+	}
+
+	// Validate required fields
+	if err := validateUpstreams(cfg); err != nil {
+		return nil, err
+	}
+
+	// Without an explicit policy, the thresholds define challenge and block bands
+	if policy := getEnv("RESPONSE_POLICY", ""); policy != "" {
+		bands, err := parseResponsePolicy(policy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RESPONSE_POLICY: %w", err)
+		}
+		cfg.ResponsePolicy = bands
+	} else if len(cfg.ResponsePolicy) == 0 {
+		cfg.ResponsePolicy = thresholdPolicy(cfg)
+	}
+
+	if profiles := getEnv("ROUTE_PROFILES", ""); profiles != "" {
+		parsed, err := parseRouteProfiles(profiles)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ROUTE_PROFILES: %w", err)
+		}
+		cfg.RouteProfiles = parsed
+	}
+	if err := validateDynamic(cfg); err != nil {
+		return nil, err
+	}
+	if cfg.ReauthClearance <= 0 {
+		return nil, fmt.Errorf("REAUTH_CLEARANCE must be positive")
+	}
+	// A hit is recorded with this TTL, and without one it would never expire
+	if cfg.HoneypotScoreTTLSeconds <= 0 {
+		return nil, fmt.Errorf("HONEYPOT_SCORE_TTL_SECONDS must be positive")
+	}
+
+	switch cfg.CentralConfigSource {
+	case "":
+	case "redis":
+		if cfg.CentralConfigKey == "" {
+			cfg.CentralConfigKey = "aegis:config"
+		}
+	case "etcd":
+		if cfg.CentralConfigKey == "" {
+			cfg.CentralConfigKey = "/aegis/config/"
+		}
+		if len(cfg.CentralConfigEtcdEndpoints) == 0 {
+			return nil, fmt.Errorf("CENTRAL_CONFIG_ETCD_ENDPOINTS is required with the etcd source")
+		}
+	case "kafka":
+		if cfg.CentralConfigKey == "" {
+			cfg.CentralConfigKey = "aegis-control"
+		}
+	default:
+		return nil, fmt.Errorf("CENTRAL_CONFIG_SOURCE must be \"redis\", \"etcd\" or \"kafka\", got %q", cfg.CentralConfigSource)
+	}
+	if cfg.CentralConfigPoll <= 0 {
+		return nil, fmt.Errorf("CENTRAL_CONFIG_POLL must be positive")
+	}
+
+	if cfg.EnforcementMode != "monitor" && cfg.EnforcementMode != "enforce" {
+		return nil, fmt.Errorf("ENFORCEMENT_MODE must be \"monitor\" or \"enforce\", got %q", cfg.EnforcementMode)
+	}
+	if cfg.KillSwitchKey == "" || cfg.KillSwitchPoll <= 0 {
+		return nil, fmt.Errorf("KILL_SWITCH_KEY must be set and KILL_SWITCH_POLL must be positive")
+	}
+	if cfg.MaintenanceRetryAfter < 0 {
+		return nil, fmt.Errorf("MAINTENANCE_RETRY_AFTER must not be negative")
+	}
+	switch cfg.ScoreSmoothing {
+	case "none", "ewma", "window":
+	default:
+		return nil, fmt.Errorf("SCORE_SMOOTHING must be \"none\", \"ewma\" or \"window\", got %q", cfg.ScoreSmoothing)
+	}
+
+	if cfg.AggregateWindow < Duration(time.Minute) {
+		return nil, fmt.Errorf("AGGREGATE_WINDOW must be at least 1m")
+	}
+	if cfg.HeuristicWindow <= 0 || cfg.ScoringTimeout <= 0 {
+		return nil, fmt.Errorf("HEURISTIC_WINDOW and SCORING_TIMEOUT must be positive")
+	}
+	if cfg.TransferProgressTimeout < 0 {
+		return nil, fmt.Errorf("TRANSFER_PROGRESS_TIMEOUT must not be negative")
+	}
+	if cfg.AcceptLoops < 0 {
+		return nil, fmt.Errorf("ACCEPT_LOOPS must not be negative")
+	}
+	if cfg.ServerReadHeaderTimeout < 0 || cfg.MinTransferRateGrace < 0 {
+		return nil, fmt.Errorf("SERVER_READ_HEADER_TIMEOUT and MIN_TRANSFER_RATE_GRACE must not be negative")
+	}
+	if cfg.MaxConnections < 0 || cfg.MaxConnectionsPerIP < 0 || cfg.MinTransferRate < 0 {
+		return nil, fmt.Errorf("MAX_CONNECTIONS, MAX_CONNECTIONS_PER_IP and MIN_TRANSFER_RATE must not be negative")
+	}
+
+	if cfg.SecretsRefreshSeconds <= 0 {
+		return nil, fmt.Errorf("SECRETS_REFRESH_SECONDS must be positive")
+	}
+	cfg.Secrets = secrets.NewStore(time.Duration(cfg.SecretsRefreshSeconds) * time.Second)
+
+	// Load JWT public key
+	if err := cfg.loadJWTPublicKey(); err != nil {
+		return nil, fmt.Errorf("failed to load JWT public key: %w", err)
+	}
+	if cfg.HasStage("assertion") {
+		if err := cfg.loadAssertionSigningKey(); err != nil {
+			return nil, fmt.Errorf("failed to load assertion signing key: %w", err)
+		}
+	}
+	if cfg.RequestSigningKeyPath != "" {
+		key, err := cfg.loadPrivateKey(cfg.RequestSigningKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load request signing key: %w", err)
+		}
+		cfg.RequestSigningKey = key
+	}
+	if cfg.AuditChainPath != "" {
+		key, err := cfg.loadPrivateKey(cfg.AuditChainSigningKeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load audit chain signing key: %w", err)
+		}
+		cfg.AuditChainSigningKey = key
+	}
+	if cfg.FIPSMode {
+		if err := cfg.validateFIPSKeys(); err != nil {
+			return nil, err
+		}
+	}
+
+	return cfg, nil
+}
+
+// defaults returns the built-in configuration, before the file and env are applied.
+func defaults() *Config {
+	return &Config{
+		Port:     8443,
+		LogLevel: "info",
+
+		ServerReadTimeout:   Duration(30 * time.Second),
+		ServerWriteTimeout:  Duration(30 * time.Second),
+		ServerIdleTimeout:   Duration(120 * time.Second),
+		UpstreamDialTimeout: Duration(10 * time.Second),
+		UpstreamDNSTTL:      Duration(30 * time.Second),
+
+		UpstreamRegistryPoll:   Duration(5 * time.Minute),
+		UpstreamRegistryScheme: "http",
+
+		MockUpstreamAddr:   "127.0.0.1:9099",
+		MockUpstreamStatus: 200,
+
+		IngressClass:         "aegis",
+		IngressGateway:       "aegis",
+		IngressClusterDomain: "cluster.local",
+		IngressResync:        Duration(5 * time.Minute),
+
+		UpstreamBlockPrivateRedirects: true,
+		RequestSigningTTL:             Duration(30 * time.Second),
+
+		EgressAllowedPorts: []int{80, 443},
+
+		AcceptLoops:    1,
+		AutoGOMAXPROCS: true,
+
+		ServerReadHeaderTimeout: Duration(10 * time.Second),
+		MinTransferRateGrace:    Duration(5 * time.Second),
+
+		ProxyProtocolTimeout: Duration(5 * time.Second),
+
+		SidecarAppPort:    8080,
+		SidecarDrainDelay: Duration(5 * time.Second),
+
+		CloudMetadata: "off",
+
+		ReadinessInterval: Duration(5 * time.Second),
+		ReadinessRequired: []string{"redis", "kafka", "jwt", "upstream"},
+
+		ClusterSyncInterval: Duration(time.Second),
+		ClusterKeyPrefix:    "aegis:cluster:",
+
+		TLSCertPath:      "/certs/server.crt",
+		TLSKeyPath:       "/certs/server.key",
+		CACertPath:       "/certs/ca.crt",
+		TLSPolicy:        "intermediate",
+		FailOpen:         true,
+		JWTPublicKeyPath: "/certs/jwt_public.pem",
+		JWTLeeway:        Duration(30 * time.Second),
+
+		ClockCheckInterval: Duration(5 * time.Minute),
+
+		SecretsRefreshSeconds: 300,
+		CentralConfigPoll:     Duration(10 * time.Second),
+
+		EventBus:          "kafka",
+		NATSURLs:          []string{"nats://localhost:4222"},
+		NATSSubjectPrefix: "aegis.",
+		NATSAckTimeout:    Duration(5 * time.Second),
+
+		KafkaBrokers:   []string{"localhost:9092"},
+		KafkaTopic:     "request-logs",
+		KafkaFlowTopic: "flow-records",
+		RedisURL:       "localhost:6379",
+
+		DecisionTTLSeconds:      86400,
+		AuditCheckpointInterval: Duration(5 * time.Minute),
+		DecisionTopFeatures:     5,
+		KafkaDecisionsTopic:     "aegis-decisions",
+		AdminAddress:            "127.0.0.1:9091",
+		KafkaFeedbackTopic:      "aegis-feedback",
+
+		WebhookEvents:         []string{"block", "challenge", "score", "guardrail"},
+		WebhookScoreThreshold: 0.9,
+		WebhookMaxRetries:     3,
+		WebhookTimeout:        Duration(5 * time.Second),
+		WebhookCooldown:       Duration(time.Minute),
+
+		BlocklistMonitorInterval: Duration(time.Minute),
+		BlockSpikeWindow:         Duration(5 * time.Minute),
+		BlockSpikeBaseline:       Duration(time.Hour),
+		BlockSpikeFactor:         10,
+		BlockSpikeMinBlocks:      50,
+
+		GuardrailWindow:     Duration(time.Hour),
+		GuardrailMinClients: 100,
+
+		OPATimeout: Duration(250 * time.Millisecond),
+
+		TokenExchangeTimeout: Duration(2 * time.Second),
+
+		AssertionIssuer: "aegis-zero",
+		AssertionTTL:    Duration(30 * time.Second),
+
+		ProtocolMode:      "block",
+		PathNormalization: "normalize",
+
+		WAFMode:             "block",
+		WAFAnomalyThreshold: 5,
+		WAFMaxBody:          16 << 10,
+
+		DLPAction:     "alert",
+		DLPPatterns:   []string{"credit_card", "ssn", "aws_key", "github_token", "slack_token", "private_key"},
+		DLPMaxBody:    1 << 20,
+		KafkaDLPTopic: "aegis-dlp",
+
+		QuarantinePaths: []string{"/logout", "/support"},
+
+		HoneypotScore:           1.0,
+		HoneypotScoreTTLSeconds: 3600,
+		HoneypotBlockTTLSeconds: 3600,
+
+		AggregateWindow: Duration(time.Hour),
+		AggregateTopN:   20,
+
+		AccessLogFeatures:   true,
+		AccessLogSampleRate: 1,
+		LogShipWorkers:      8,
+		LogShipQueueSize:    10000,
+		LogShipOverflow:     "drop-newest",
+
+		VerdictTTLSeconds:     300,
+		VerdictRateLimitRPS:   1,
+		VerdictRateLimitBurst: 5,
+
+		Stages:         []string{"blocklist", "honeypot", "verdicts", "jwt", "logger", "heuristic", "scoring"},
+		RateLimitRPS:   50,
+		RateLimitBurst: 100,
+
+		CORS: CORSPolicy{
+			AllowedMethods: []string{"GET", "HEAD", "POST"},
+			AllowedHeaders: []string{"Authorization", "Content-Type"},
+			MaxAge:         Duration(10 * time.Minute),
+		},
+		CSRFCookieName:          "aegis_csrf",
+		CSRFHeaderName:          "X-CSRF-Token",
+		CSRFFieldName:           "csrf_token",
+		OIDCScopes:              []string{"openid", "profile", "email"},
+		OIDCTimeout:             Duration(5 * time.Second),
+		SessionCookieName:       "aegis_session",
+		SessionTTL:              Duration(8 * time.Hour),
+		SessionLogoutPath:       "/oauth2/logout",
+		SessionLogoutRedirect:   "/",
+		ReplayNonceHeader:       "X-Request-Nonce",
+		ReplayTimestampHeader:   "X-Request-Timestamp",
+		ReplayWindow:            Duration(5 * time.Minute),
+		CacheMaxSize:            64 << 20,
+		CacheMaxEntry:           1 << 20,
+		ShedMinLimit:            20,
+		ShedMaxLimit:            2000,
+		ShedInitialLimit:        200,
+		ShedLatencyTolerance:    1.5,
+		ShedRetryAfter:          Duration(time.Second),
+		ShedLowRisk:             0.5,
+		BandwidthLimit:          10 << 20,
+		BandwidthBurst:          1 << 20,
+		BandwidthKey:            "subject",
+		ConcurrencyLimit:        20,
+		ConcurrencyQueue:        20,
+		ConcurrencyQueueTimeout: Duration(time.Second),
+		ConcurrencyKey:          "subject",
+		TravelMaxSpeed:          1000,
+		TravelMinDistance:       200,
+		TravelAction:            "log_only",
+		FamiliarityHistory:      Duration(90 * 24 * time.Hour),
+		FamiliarityAction:       "log_only",
+		FamiliarityTrigger:      "both",
+		SecurityHeaders: SecurityHeaders{
+			HSTS:           "max-age=31536000; includeSubDomains",
+			FrameOptions:   "DENY",
+			ReferrerPolicy: "strict-origin-when-cross-origin",
+			CSP:            "off",
+		},
+
+		ScoringModel:           "champion",
+		ScoringShadowModel:     "challenger",
+		ScoringTimeout:         Duration(50 * time.Millisecond),
+		RiskChallengeThreshold: 0.5,
+		RiskBlockThreshold:     0.9,
+
+		HeuristicWindow:         Duration(time.Minute),
+		HeuristicMinRequests:    10,
+		HeuristicMaxRPS:         20,
+		HeuristicMaxErrorRate:   0.5,
+		HeuristicMaxPathEntropy: 5,
+		HeuristicMaxPayload:     10 << 20,
+
+		TarpitDelayMs:          2000,
+		TempBlockTTLSeconds:    300,
+		ResponseRateLimitRPS:   1,
+		ResponseRateLimitBurst: 5,
+		ReauthClearance:        Duration(15 * time.Minute),
+
+		BlockEscalationDecay: Duration(24 * time.Hour),
+
+		ChallengeMode:         "deny",
+		ChallengeDifficulty:   16,
+		ChallengeClearanceTTL: Duration(30 * time.Minute),
+		ChallengeCookieName:   "aegis_clearance",
+		ChallengePath:         "/.aegis/challenge",
+
+		EnforcementMode: "monitor",
+		KillSwitchKey:   "aegis:killswitch",
+		KillSwitchPoll:  Duration(2 * time.Second),
+		ScoreSmoothing:  "none",
+		ScoreEWMAAlpha:  0.3,
+		ScoreWindowSize: 10,
+		ScoreWindowHits: 3,
+		ScoreHysteresis: 0.05,
+
+		MaintenanceRetryAfter: Duration(5 * time.Minute),
+	}
+}
+
+// thresholdPolicy is the policy used without an explicit one: challenge and
+// block bands at the risk thresholds.
+func thresholdPolicy(cfg *Config) []ResponseBand {
+	return []ResponseBand{
+		{MinScore: cfg.RiskChallengeThreshold, Action: "challenge"},
+		{MinScore: cfg.RiskBlockThreshold, Action: "block"},
+	}
+}
+
+// validateDynamic checks the settings that reload and the central store may change.
+func validateDynamic(cfg *Config) error {
+	if cfg.RiskChallengeThreshold > cfg.RiskBlockThreshold {
+		return fmt.Errorf("RISK_CHALLENGE_THRESHOLD must not exceed RISK_BLOCK_THRESHOLD")
+	}
+	if cfg.AccessLogSampleRate < 0 || cfg.AccessLogSampleRate > 1 {
+		return fmt.Errorf("ACCESS_LOG_SAMPLE_RATE must be between 0 and 1")
+	}
+	switch cfg.ScoreSmoothing {
+	case "ewma":
+		if cfg.ScoreEWMAAlpha <= 0 || cfg.ScoreEWMAAlpha > 1 {
+			return fmt.Errorf("SCORE_EWMA_ALPHA must be in (0, 1]")
+		}
+	case "window":
+		if cfg.ScoreWindowHits < 1 || cfg.ScoreWindowHits > cfg.ScoreWindowSize {
+			return fmt.Errorf("SCORE_WINDOW_HITS must be between 1 and SCORE_WINDOW_SIZE")
+		}
+	}
+	if cfg.ScoreHysteresis < 0 {
+		return fmt.Errorf("SCORE_HYSTERESIS must not be negative")
+	}
+	// Limiters built with a zero rate or burst refuse every request
+	for _, limit := range []struct {
+		name  string
+		rps   float64
+		burst int
+	}{
+		{"RATE_LIMIT", cfg.RateLimitRPS, cfg.RateLimitBurst},
+		{"RESPONSE_RATE_LIMIT", cfg.ResponseRateLimitRPS, cfg.ResponseRateLimitBurst},
+		{"VERDICT_RATE_LIMIT", cfg.VerdictRateLimitRPS, cfg.VerdictRateLimitBurst},
+	} {
+		if limit.rps <= 0 || limit.burst < 1 {
+			return fmt.Errorf("%s_RPS and %s_BURST must be positive", limit.name, limit.name)
+		}
+	}
+
+	for _, path := range cfg.HoneypotPaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("HONEYPOT_PATHS entry %q must start with /", path)
+		}
+	}
+	for _, path := range cfg.QuarantinePaths {
+		if !strings.HasPrefix(path, "/") {
+			return fmt.Errorf("QUARANTINE_PATHS entry %q must start with /", path)
+		}
+	}
+
+	if err := validatePolicy(cfg.ResponsePolicy); err != nil {
+		return fmt.Errorf("invalid response_policy: %w", err)
+	}
+	for _, profile := range cfg.RouteProfiles {
+		if !strings.HasPrefix(profile.Prefix, "/") {
+			return fmt.Errorf("route profile %q: prefix must start with /", profile.Prefix)
+		}
+		if err := validatePolicy(profile.Policy); err != nil {
+			return fmt.Errorf("route profile %q: %w", profile.Prefix, err)
+		}
+		if profile.SampleRate != nil && (*profile.SampleRate < 0 || *profile.SampleRate > 1) {
+			return fmt.Errorf("route profile %q: sample_rate must be between 0 and 1", profile.Prefix)
+		}
+	}
+	return nil
+}
+
+// loadFile decodes a YAML config file over cfg. Unknown keys are rejected so
+// typos fail loudly instead of being ignored.
+func loadFile(path string, cfg *Config) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// parseResponsePolicy parses "score:action" pairs, e.g. "0.5:tarpit,0.9:temp_block".
+func parseResponsePolicy(value string) ([]ResponseBand, error) {
+	var bands []ResponseBand
+	for _, entry := range strings.Split(value, ",") {
+		score, action, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("band %q must be score:action", entry)
+		}
+
+		minScore, err := strconv.ParseFloat(score, 64)
+		if err != nil {
+			return nil, fmt.Errorf("band %q: invalid score", entry)
+		}
+		bands = append(bands, ResponseBand{MinScore: minScore, Action: action})
+	}
+	return bands, validatePolicy(bands)
+}
+
+// validatePolicy checks score ranges and action names of response bands.
+func validatePolicy(bands []ResponseBand) error {
+	for _, band := range bands {
+		if band.MinScore < 0 || band.MinScore > 1 {
+			return fmt.Errorf("band %g:%s: score must be between 0 and 1", band.MinScore, band.Action)
+		}
+		if !responseActions[band.Action] {
+			return fmt.Errorf("band %g:%s: unknown action %q", band.MinScore, band.Action, band.Action)
+		}
+	}
+	return nil
+}
+
+// parseRouteProfiles parses "prefix|model_id|policy" entries separated by ";",
+// e.g. "/login|login-v2|0.4:challenge,0.7:block;/upload|upload-v1".
+func parseRouteProfiles(value string) ([]RouteProfile, error) {
+	var profiles []RouteProfile
+	for _, entry := range strings.Split(value, ";") {
+		parts := strings.Split(strings.TrimSpace(entry), "|")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("profile %q must be prefix|model_id[|policy]", entry)
+		}
+		if !strings.HasPrefix(parts[0], "/") {
+			return nil, fmt.Errorf("profile %q: prefix must start with /", entry)
+		}
+
+		profile := RouteProfile{Prefix: parts[0], ModelID: parts[1]}
+		if len(parts) == 3 && parts[2] != "" {
+			bands, err := parseResponsePolicy(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("profile %q: %w", entry, err)
+			}
+			profile.Policy = bands
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// parseListeners parses "name|address|tls|handler[|upstream][|proxy-protocol]"
+// entries separated by ";", where only tcp listeners take an upstream, e.g.
+// "external|:8443|tls|proxy|proxy-protocol;mesh|:8080|none|proxy;db|:5432|mtls|tcp|db.internal:5432".
+func parseListeners(value string) ([]Listener, error) {
+	var listeners []Listener
+	for _, entry := range strings.Split(value, ";") {
+		parts := strings.Split(strings.TrimSpace(entry), "|")
+		if len(parts) < 4 {
+			return nil, fmt.Errorf("listener %q must be name|address|tls|handler[|upstream][|proxy-protocol]", entry)
+		}
+		l := Listener{Name: parts[0], Address: parts[1], TLS: parts[2], Handler: parts[3]}
+		for i, part := range parts[4:] {
+			switch {
+			case part == "proxy-protocol" && !l.ProxyProtocol:
+				l.ProxyProtocol = true
+			case i == 0 && l.Handler == "tcp":
+				l.Upstream = part
+			default:
+				return nil, fmt.Errorf("listener %q must be name|address|tls|handler[|upstream][|proxy-protocol]", entry)
+			}
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// Stages are the middleware stages that STAGES may list. Stages registered
+// with middleware.RegisterStage are added before the configuration is
+// loaded.
+var Stages = map[string]bool{
+	"blocklist": true, "honeypot": true, "verdicts": true, "jwt": true,
+	"logger": true, "heuristic": true, "scoring": true, "ratelimit": true, "opa": true, "routes": true,
+	"waf": true, "protocol": true, "dlp": true, "cors": true, "headers": true, "csrf": true,
+	"replay": true, "decisions": true, "cache": true, "shed": true, "chaos": true,
+	"bandwidth": true, "concurrency": true, "schedule": true, "travel": true,
+	"familiarity": true, "exchange": true, "assertion": true, "session": true,
+}
+
+// validateSession checks the OIDC client settings of the session stage.
+func validateSession(cfg *Config) error {
+	for _, setting := range []struct{ name, value string }{
+		{"OIDC_AUTHORIZE_URL", cfg.OIDCAuthorizeURL},
+		{"OIDC_TOKEN_URL", cfg.OIDCTokenURL},
+		{"OIDC_REDIRECT_URL", cfg.OIDCRedirectURL},
+	} {
+		if u, err := url.Parse(setting.value); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("%s must be an http(s) URL with the session stage", setting.name)
+		}
+	}
+	if cfg.OIDCClientID == "" || cfg.OIDCClientSecret == "" {
+		return fmt.Errorf("OIDC_CLIENT_ID and OIDC_CLIENT_SECRET are required with the session stage")
+	}
+	if cfg.SessionCookieName == "" || cfg.SessionTTL <= 0 || cfg.OIDCTimeout <= 0 {
+		return fmt.Errorf("SESSION_COOKIE_NAME must be set and SESSION_TTL and OIDC_TIMEOUT positive with the session stage")
+	}
+	if !strings.HasPrefix(cfg.SessionLogoutPath, "/") {
+		return fmt.Errorf("SESSION_LOGOUT_PATH must start with /")
+	}
+	return nil
+}
+
+// validateWebhooks checks the webhook settings when webhooks are enabled.
+func validateWebhooks(cfg *Config) error {
+	if len(cfg.WebhookURLs) == 0 {
+		return nil
+	}
+	if cfg.WebhookSecret == "" {
+		return fmt.Errorf("WEBHOOK_SECRET is required with WEBHOOK_URLS")
+	}
+	for _, u := range cfg.WebhookURLs {
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+			return fmt.Errorf("WEBHOOK_URLS entry %q must be an http(s) URL", u)
+		}
+	}
+	for _, event := range cfg.WebhookEvents {
+		switch event {
+		case "block", "challenge", "score", "guardrail":
+		default:
+			return fmt.Errorf("WEBHOOK_EVENTS: unknown event %q (use block, challenge, score or guardrail)", event)
+		}
+	}
+	if cfg.WebhookMaxRetries < 0 || cfg.WebhookTimeout <= 0 || cfg.WebhookCooldown < 0 {
+		return fmt.Errorf("WEBHOOK_MAX_RETRIES and WEBHOOK_COOLDOWN must not be negative and WEBHOOK_TIMEOUT must be positive")
+	}
+	return nil
+}
+
+// validateBlocklistMonitor checks the spike settings when the blocklist
+// monitor is enabled.
+func validateBlocklistMonitor(cfg *Config) error {
+	if cfg.BlocklistMonitorInterval < 0 {
+		return fmt.Errorf("BLOCKLIST_MONITOR_INTERVAL must not be negative")
+	}
+	if cfg.BlocklistMonitorInterval == 0 {
+		return nil
+	}
+	if cfg.BlockSpikeWindow < cfg.BlocklistMonitorInterval || cfg.BlockSpikeBaseline < cfg.BlockSpikeWindow {
+		return fmt.Errorf("BLOCK_SPIKE_WINDOW must be at least BLOCKLIST_MONITOR_INTERVAL and BLOCK_SPIKE_BASELINE at least BLOCK_SPIKE_WINDOW")
+	}
+	if cfg.BlockSpikeFactor <= 1 || cfg.BlockSpikeMinBlocks < 1 {
+		return fmt.Errorf("BLOCK_SPIKE_FACTOR must be greater than 1 and BLOCK_SPIKE_MIN_BLOCKS at least 1")
+	}
+	return nil
+}
+
+// validateGuardrails checks the caps on automated enforcement.
+func validateGuardrails(cfg *Config) error {
+	if cfg.GuardrailMaxBlockedPercent < 0 || cfg.GuardrailMaxBlockedPercent >= 100 {
+		return fmt.Errorf("GUARDRAIL_MAX_BLOCKED_PERCENT must be from 0 (off) to below 100, got %g", cfg.GuardrailMaxBlockedPercent)
+	}
+	if cfg.GuardrailMaxBlockedPercent > 0 && (cfg.GuardrailWindow < Duration(time.Minute) || cfg.GuardrailMinClients < 1) {
+		return fmt.Errorf("GUARDRAIL_WINDOW must be at least 1m and GUARDRAIL_MIN_CLIENTS at least 1")
+	}
+	if len(cfg.GuardrailAllowASNs) > 0 && len(cfg.GeoIPDatabases) == 0 {
+		return fmt.Errorf("GUARDRAIL_ALLOW_ASNS needs GEOIP_DATABASES with an ASN blocks file")
+	}
+	for _, name := range cfg.GuardrailRevert {
+		switch name {
+		case "block_rate_spike", "blocklist_growth":
+		case "blocked_clients":
+			// Clients drive its counts, so it must not turn enforcement off
+			return fmt.Errorf("GUARDRAIL_REVERT: blocked_clients holds new blocks instead of engaging the kill switch")
+		default:
+			return fmt.Errorf("GUARDRAIL_REVERT: unknown guardrail %q (use block_rate_spike or blocklist_growth)", name)
+		}
+	}
+	return nil
+}
+
+// validateBlockEscalation checks the escalation ladders.
+func validateBlockEscalation(cfg *Config) error {
+	if cfg.BlockEscalationDecay < 0 {
+		return fmt.Errorf("BLOCK_ESCALATION_DECAY must not be negative")
+	}
+	if len(cfg.BlockEscalationActions) > 0 && len(cfg.BlockEscalation) == 0 {
+		return fmt.Errorf("block_escalation_actions needs BLOCK_ESCALATION as the default ladder")
+	}
+	ladders := map[string][]Duration{"BLOCK_ESCALATION": cfg.BlockEscalation}
+	for action, steps := range cfg.BlockEscalationActions {
+		switch action {
+		case "temp_block", "honeypot", "ai_engine":
+		default:
+			return fmt.Errorf("block_escalation_actions: unknown action type %q (use temp_block, honeypot or ai_engine)", action)
+		}
+		if len(steps) == 0 {
+			return fmt.Errorf("block_escalation_actions: %s needs at least one step", action)
+		}
+		ladders["block_escalation_actions "+action] = steps
+	}
+	for name, steps := range ladders {
+		for _, step := range steps {
+			if step < Duration(time.Second) {
+				return fmt.Errorf("%s: steps must be at least 1s, got %s", name, step)
+			}
+		}
+	}
+	return nil
+}
+
+// validateChallenge checks the settings of interactive challenges.
+func validateChallenge(cfg *Config) error {
+	switch cfg.ChallengeMode {
+	case "deny":
+		return nil
+	case "pow":
+		if cfg.ChallengeDifficulty < 1 || cfg.ChallengeDifficulty > 32 {
+			return fmt.Errorf("CHALLENGE_DIFFICULTY must be between 1 and 32")
+		}
+	case "captcha":
+		switch cfg.CaptchaProvider {
+		case "hcaptcha", "recaptcha", "turnstile":
+		default:
+			return fmt.Errorf("CAPTCHA_PROVIDER must be hcaptcha, recaptcha or turnstile, got %q", cfg.CaptchaProvider)
+		}
+		if cfg.CaptchaSiteKey == "" || cfg.CaptchaSecretKey == "" {
+			return fmt.Errorf("CAPTCHA_SITE_KEY and CAPTCHA_SECRET_KEY are required with CHALLENGE_MODE=captcha")
+		}
+	default:
+		return fmt.Errorf("CHALLENGE_MODE must be deny, pow or captcha, got %q", cfg.ChallengeMode)
+	}
+	if len(cfg.ChallengeSecret) < 32 {
+		return fmt.Errorf("CHALLENGE_SECRET of at least 32 bytes is required with CHALLENGE_MODE=%s", cfg.ChallengeMode)
+	}
+	if cfg.ChallengeClearanceTTL <= 0 || cfg.ChallengeCookieName == "" || !strings.HasPrefix(cfg.ChallengePath, "/") {
+		return fmt.Errorf("CHALLENGE_CLEARANCE_TTL must be positive, CHALLENGE_COOKIE_NAME set and CHALLENGE_PATH a path")
+	}
+	return nil
+}
+
+// validateStages checks stage names and the settings of enabled stages.
+func validateStages(cfg *Config) error {
+	seen := make(map[string]bool)
+	for _, stage := range cfg.Stages {
+		if !Stages[stage] {
+			return fmt.Errorf("STAGES: unknown stage %q", stage)
+		}
+		if seen[stage] {
+			return fmt.Errorf("STAGES: stage %q listed twice", stage)
+		}
+		seen[stage] = true
+	}
+	for stage := range cfg.StageSettings {
+		if !Stages[stage] {
+			return fmt.Errorf("stage_settings: unknown stage %q", stage)
+		}
+	}
+	if seen["opa"] && (!strings.HasPrefix(cfg.OPAURL, "http://") && !strings.HasPrefix(cfg.OPAURL, "https://") || cfg.OPATimeout <= 0) {
+		return fmt.Errorf("OPA_URL must be an http(s) URL and OPA_TIMEOUT positive with the opa stage")
+	}
+	if seen["exchange"] {
+		if !strings.HasPrefix(cfg.TokenExchangeURL, "http://") && !strings.HasPrefix(cfg.TokenExchangeURL, "https://") || cfg.TokenExchangeTimeout <= 0 {
+			return fmt.Errorf("TOKEN_EXCHANGE_URL must be an http(s) URL and TOKEN_EXCHANGE_TIMEOUT positive with the exchange stage")
+		}
+		if cfg.TokenExchangeClientID == "" || cfg.TokenExchangeClientSecret == "" {
+			return fmt.Errorf("TOKEN_EXCHANGE_CLIENT_ID and TOKEN_EXCHANGE_CLIENT_SECRET are required with the exchange stage")
+		}
+	}
+	if seen["assertion"] && (cfg.AssertionSigningKeyPath == "" || cfg.AssertionIssuer == "" || cfg.AssertionTTL <= 0) {
+		return fmt.Errorf("ASSERTION_SIGNING_KEY_PATH and ASSERTION_ISSUER must be set and ASSERTION_TTL positive with the assertion stage")
+	}
+	if seen["protocol"] && cfg.ProtocolMode != "block" && cfg.ProtocolMode != "detect" {
+		return fmt.Errorf("PROTOCOL_MODE must be block or detect with the protocol stage")
+	}
+	if seen["waf"] && (cfg.WAFMode != "block" && cfg.WAFMode != "detect" || cfg.WAFAnomalyThreshold < 1 || cfg.WAFMaxBody < 0) {
+		return fmt.Errorf("WAF_MODE must be block or detect, WAF_ANOMALY_THRESHOLD positive and WAF_MAX_BODY not negative with the waf stage")
+	}
+	if seen["cors"] {
+		if err := validateCORS("CORS", cfg.CORS); err != nil {
+			return err
+		}
+	}
+	if seen["headers"] {
+		if err := validateSecurityHeaders("SECURITY_*", cfg.SecurityHeaders); err != nil {
+			return err
+		}
+	}
+	if seen["csrf"] && (!seen["routes"] || len(cfg.CSRFSecret) < 32 || cfg.CSRFCookieName == "" || cfg.CSRFHeaderName == "") {
+		return fmt.Errorf("the csrf stage needs the routes stage, a CSRF_SECRET of at least 32 bytes, CSRF_COOKIE_NAME and CSRF_HEADER_NAME")
+	}
+	if seen["session"] {
+		if err := validateSession(cfg); err != nil {
+			return err
+		}
+	}
+	if seen["replay"] && (!seen["routes"] || cfg.ReplayNonceHeader == "" || cfg.ReplayTimestampHeader == "" || cfg.ReplayWindow <= 0) {
+		return fmt.Errorf("the replay stage needs the routes stage, REPLAY_NONCE_HEADER, REPLAY_TIMESTAMP_HEADER and a positive REPLAY_WINDOW")
+	}
+	if seen["cache"] && (!seen["routes"] || cfg.CacheMaxSize <= 0 || cfg.CacheMaxEntry <= 0) {
+		return fmt.Errorf("the cache stage needs the routes stage and a positive CACHE_MAX_SIZE and CACHE_MAX_ENTRY")
+	}
+	if seen["shed"] {
+		if cfg.ShedMinLimit < 1 || cfg.ShedMaxLimit < cfg.ShedMinLimit || cfg.ShedInitialLimit < cfg.ShedMinLimit || cfg.ShedInitialLimit > cfg.ShedMaxLimit {
+			return fmt.Errorf("SHED_MIN_LIMIT must be positive and SHED_INITIAL_LIMIT between it and SHED_MAX_LIMIT")
+		}
+		if cfg.ShedLatencyTolerance < 1 || cfg.ShedRetryAfter < Duration(time.Second) || cfg.ShedLowRisk < 0 || cfg.ShedLowRisk > 1 {
+			return fmt.Errorf("SHED_LATENCY_TOLERANCE must be at least 1, SHED_RETRY_AFTER at least 1s and SHED_LOW_RISK between 0 and 1")
+		}
+	}
+	if seen["concurrency"] {
+		if cfg.ConcurrencyLimit < 1 || cfg.ConcurrencyQueue < 0 || cfg.ConcurrencyQueue > 0 && cfg.ConcurrencyQueueTimeout <= 0 {
+			return fmt.Errorf("CONCURRENCY_LIMIT must be positive, CONCURRENCY_QUEUE not negative and CONCURRENCY_QUEUE_TIMEOUT positive with a queue")
+		}
+		if cfg.ConcurrencyKey != "ip" && cfg.ConcurrencyKey != "subject" {
+			return fmt.Errorf("CONCURRENCY_KEY must be ip or subject, got %q", cfg.ConcurrencyKey)
+		}
+	}
+	if seen["travel"] {
+		if len(cfg.GeoIPDatabases) == 0 {
+			return fmt.Errorf("the travel stage needs GEOIP_DATABASES with a City blocks file")
+		}
+		if cfg.TravelMaxSpeed <= 0 || cfg.TravelMinDistance < 0 {
+			return fmt.Errorf("TRAVEL_MAX_SPEED must be positive and TRAVEL_MIN_DISTANCE not negative")
+		}
+		if !responseActions[cfg.TravelAction] || cfg.TravelAction == "allow" {
+			return fmt.Errorf("TRAVEL_ACTION must be a response action other than allow, got %q", cfg.TravelAction)
+		}
+	}
+	if seen["familiarity"] {
+		if cfg.FamiliarityHistory <= 0 {
+			return fmt.Errorf("FAMILIARITY_HISTORY must be positive")
+		}
+		if !responseActions[cfg.FamiliarityAction] || cfg.FamiliarityAction == "allow" {
+			return fmt.Errorf("FAMILIARITY_ACTION must be a response action other than allow, got %q", cfg.FamiliarityAction)
+		}
+		if cfg.FamiliarityTrigger != "any" && cfg.FamiliarityTrigger != "both" {
+			return fmt.Errorf("FAMILIARITY_TRIGGER must be any or both, got %q", cfg.FamiliarityTrigger)
+		}
+	}
+	if seen["schedule"] {
+		if err := validateSchedules(cfg); err != nil {
+			return err
+		}
+	}
+	if seen["bandwidth"] {
+		if err := validateBandwidth(cfg); err != nil {
+			return err
+		}
+	}
+	if seen["chaos"] {
+		if err := validateChaos(cfg); err != nil {
+			return err
+		}
+	}
+	if seen["dlp"] {
+		if err := validateDLP(cfg); err != nil {
+			return err
+		}
+	}
+	if seen["decisions"] && cfg.KafkaDecisionsTopic == "" {
+		return fmt.Errorf("KAFKA_DECISIONS_TOPIC is required with the decisions stage")
+	}
+	return nil
+}
 
-	// Upstream
-	UpstreamURL string
+// Upstreams returns the upstream URLs requests are balanced across.
+func (c *Config) Upstreams() []string {
+	if c.MockUpstream {
+		return []string{"http://" + c.MockUpstreamAddr}
+	}
+	if len(c.UpstreamURLs) > 0 {
+		return c.UpstreamURLs
+	}
+	if c.UpstreamURL == "" {
+		return nil // Only with an ingress controller
+	}
+	return []string{c.UpstreamURL}
+}
 
-	// TLS/mTLS
-	TLSCertPath string
-	TLSKeyPath  string
-	CACertPath  string
+// Discovered reports whether the upstreams are discovered at runtime, from
+// DNS or a service registry.
+func (c *Config) Discovered() bool {
+	return c.UpstreamDNS != "" || c.UpstreamRegistry != ""
+}
 
-	// JWT
-	JWTPublicKeyPath string
-	JWTPublicKey     *rsa.PublicKey
+// validateUpstreams checks that there is an upstream and that draining
+// entries name one of them.
+func validateUpstreams(cfg *Config) error {
+	switch cfg.IngressController {
+	case "", "ingress", "gateway":
+	default:
+		return fmt.Errorf("INGRESS_CONTROLLER must be \"ingress\" or \"gateway\", got %q", cfg.IngressController)
+	}
+	if cfg.IngressController != "" && cfg.IngressResync <= 0 {
+		return fmt.Errorf("INGRESS_RESYNC must be positive")
+	}
+	if cfg.MockUpstream {
+		if cfg.Discovered() || cfg.IngressController != "" {
+			return fmt.Errorf("MOCK_UPSTREAM replaces the upstreams and can't be combined with discovery or INGRESS_CONTROLLER")
+		}
+		if _, port, err := net.SplitHostPort(cfg.MockUpstreamAddr); err != nil || port == "" || port == "0" {
+			return fmt.Errorf("MOCK_UPSTREAM_ADDR must be host:port, got %q", cfg.MockUpstreamAddr)
+		}
+		if cfg.MockUpstreamStatus < 200 || cfg.MockUpstreamStatus > 599 || cfg.MockUpstreamLatency < 0 {
+			return fmt.Errorf("MOCK_UPSTREAM_STATUS must be between 200 and 599 and MOCK_UPSTREAM_LATENCY not negative")
+		}
+	}
+	if cfg.UpstreamURL == "" && len(cfg.UpstreamURLs) == 0 && !cfg.Discovered() && cfg.IngressController == "" && !cfg.VirtualHostsRouted() && !cfg.MockUpstream {
+		return fmt.Errorf("UPSTREAM_URL, UPSTREAM_URLS, UPSTREAM_DNS or UPSTREAM_REGISTRY is required")
+	}
+	for _, cidr := range cfg.UpstreamAllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("UPSTREAM_ALLOWED_CIDRS: invalid CIDR %q", cidr)
+		}
+	}
+	if cfg.UpstreamDNS != "" {
+		// Discovered upstreams are only known at runtime, so draining
+		// entries can't be checked against them
+		u, err := url.Parse(cfg.UpstreamDNS)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			return fmt.Errorf("UPSTREAM_DNS must be http(s)://name[:port], got %q", cfg.UpstreamDNS)
+		}
+		if cfg.UpstreamDNSTTL <= 0 {
+			return fmt.Errorf("UPSTREAM_DNS_TTL must be positive")
+		}
+		if cfg.UpstreamRegistry != "" {
+			return fmt.Errorf("UPSTREAM_DNS and UPSTREAM_REGISTRY are exclusive")
+		}
+		return nil
+	}
+	if cfg.UpstreamRegistry != "" {
+		switch cfg.UpstreamRegistry {
+		case "consul", "eureka":
+		default:
+			return fmt.Errorf("UPSTREAM_REGISTRY must be \"consul\" or \"eureka\", got %q", cfg.UpstreamRegistry)
+		}
+		u, err := url.Parse(cfg.UpstreamRegistryURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("UPSTREAM_REGISTRY_URL must be an http(s) URL, got %q", cfg.UpstreamRegistryURL)
+		}
+		if cfg.UpstreamService == "" {
+			return fmt.Errorf("UPSTREAM_SERVICE is required with UPSTREAM_REGISTRY")
+		}
+		if cfg.UpstreamRegistryScheme != "http" && cfg.UpstreamRegistryScheme != "https" {
+			return fmt.Errorf("UPSTREAM_REGISTRY_SCHEME must be \"http\" or \"https\"")
+		}
+		// Consul's longest blocking wait is 10 minutes
+		if cfg.UpstreamRegistryPoll <= 0 || cfg.UpstreamRegistryPoll > Duration(10*time.Minute) {
+			return fmt.Errorf("UPSTREAM_REGISTRY_POLL must be between 0 and 10m")
+		}
+		return nil
+	}
 
-	// Kafka
-	KafkaBrokers []string
-	KafkaTopic   string
+	hosts := make(map[string]bool)
+	for _, raw := range cfg.Upstreams() {
+		name, err := upstreamName(raw)
+		if err != nil {
+			return err
+		}
+		if hosts[name] {
+			return fmt.Errorf("upstream %s is listed twice", name)
+		}
+		hosts[name] = true
+	}
 
-	// Redis
-	RedisURL string
+	draining := make(map[string]bool)
+	for _, host := range cfg.UpstreamDraining {
+		if !hosts[host] {
+			return fmt.Errorf("UPSTREAM_DRAINING entry %q is not an upstream host or socket", host)
+		}
+		draining[host] = true
+	}
+	if len(hosts) > 0 && len(draining) == len(hosts) {
+		return fmt.Errorf("UPSTREAM_DRAINING must leave at least one upstream serving")
+	}
+	return nil
 }
 
-// Load reads configuration from environment variables
-func Load() (*Config, error) {
-	cfg := &Config{
-		Port:             getEnvInt("PORT", 8443),
-		LogLevel:         getEnv("LOG_LEVEL", "info"),
-		UpstreamURL:      getEnv("UPSTREAM_URL", ""),
-		TLSCertPath:      getEnv("TLS_CERT_PATH", "/certs/server.crt"),
-		TLSKeyPath:       getEnv("TLS_KEY_PATH", "/certs/server.key"),
-		CACertPath:       getEnv("CA_CERT_PATH", "/certs/ca.crt"),
-		JWTPublicKeyPath: getEnv("JWT_PUBLIC_KEY_PATH", "/certs/jwt_public.pem"),
-		KafkaBrokers:     strings.Split(getEnv("KAFKA_BROKERS", "localhost:9092"), ","),
-		KafkaTopic:       getEnv("KAFKA_TOPIC", "request-logs"),
-		RedisURL:         getEnv("REDIS_URL", "localhost:6379"),
+// upstreamName returns the name an upstream is drained by: its host:port,
+// or unix:<socket> for unix:///path and unix:///@abstract sockets.
+func upstreamName(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err == nil && u.Scheme == "unix" {
+		socket := strings.TrimPrefix(u.Path, "/")
+		if u.Host != "" || socket == "" || socket == "@" {
+			return "", fmt.Errorf("unix upstream URL %q must be unix:///path or unix:///@abstract", raw)
+		}
+		if !strings.HasPrefix(socket, "@") {
+			socket = u.Path
+		}
+		return "unix:" + socket, nil
+	}
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return "", fmt.Errorf("upstream URL %q must include a scheme and host", raw)
+	}
+	return u.Host, nil
+}
+
+// HasStage reports whether a middleware stage is enabled.
+func (c *Config) HasStage(stage string) bool {
+	for _, s := range c.Stages {
+		if s == stage {
+			return true
+		}
 	}
+	return false
+}
 
-	// Validate required fields
-	if cfg.UpstreamURL == "" {
-		return nil, fmt.Errorf("UPSTREAM_URL is required")
+// HasListener reports whether a listener serves handler.
+func (c *Config) HasListener(handler string) bool {
+	for _, l := range c.Listeners {
+		if l.Handler == handler {
+			return true
+		}
 	}
+	return false
+}
 
-	// Load JWT public key
-	if err := cfg.loadJWTPublicKey(); err != nil {
-		return nil, fmt.Errorf("failed to load JWT public key: %w", err)
+// validateListeners checks listener settings and rejects duplicate names or addresses.
+func validateListeners(listeners []Listener) error {
+	names := make(map[string]bool)
+	addresses := make(map[string]bool)
+	for _, l := range listeners {
+		if l.Name == "" || l.Address == "" {
+			return fmt.Errorf("listener %q: name and address are required", l.Name)
+		}
+		if names[l.Name] || addresses[l.Address] {
+			return fmt.Errorf("listener %q: duplicate name or address %s", l.Name, l.Address)
+		}
+		names[l.Name], addresses[l.Address] = true, true
+
+		switch l.TLS {
+		case "mtls", "tls", "none":
+		default:
+			return fmt.Errorf("listener %q: tls must be \"mtls\", \"tls\" or \"none\", got %q", l.Name, l.TLS)
+		}
+		switch l.Handler {
+		case "proxy", "admin", "extauthz", "verdicts", "egress", "tcp":
+		default:
+			return fmt.Errorf("listener %q: handler must be \"proxy\", \"admin\", \"extauthz\", \"verdicts\", \"egress\" or \"tcp\", got %q", l.Name, l.Handler)
+		}
+		if (l.Handler == "tcp") != (l.Upstream != "") {
+			return fmt.Errorf("listener %q: tcp listeners, and only they, take an upstream", l.Name)
+		}
+		if _, _, err := net.SplitHostPort(l.Upstream); l.Upstream != "" && err != nil {
+			return fmt.Errorf("listener %q: upstream must be host:port, got %q", l.Name, l.Upstream)
+		}
 	}
+	return nil
+}
 
-	return cfg, nil
+// validateVerdictPush requires verdicts listeners to authenticate the AI
+// engine, by token or client certificate, since verdicts can block anyone.
+// Non-admin listeners trust the general client CA, so a certificate alone
+// must also carry one of the AI engine's names.
+func (c *Config) validateVerdictPush() error {
+	for _, l := range c.Listeners {
+		if l.Handler != "verdicts" || c.VerdictPushToken != "" {
+			continue
+		}
+		if l.TLS != "mtls" || len(c.VerdictPushClientNames) == 0 {
+			return fmt.Errorf("listener %q: verdicts requires VERDICT_PUSH_TOKEN, or tls: mtls with VERDICT_PUSH_CLIENT_NAMES", l.Name)
+		}
+	}
+	return nil
+}
+
+// validateEgress requires a destination allowlist for egress listeners.
+func (c *Config) validateEgress() error {
+	for _, cidr := range c.EgressAllowedCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("EGRESS_ALLOWED_CIDRS: invalid CIDR %q", cidr)
+		}
+	}
+	for _, port := range c.EgressAllowedPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("EGRESS_ALLOWED_PORTS: invalid port %d", port)
+		}
+	}
+	for _, l := range c.Listeners {
+		if l.Handler == "egress" && len(c.EgressAllowedHosts) == 0 {
+			return fmt.Errorf("listener %q: egress requires EGRESS_ALLOWED_HOSTS", l.Name)
+		}
+	}
+	return nil
+}
+
+// validateProxyProtocol requires trusted load balancers for listeners that
+// read PROXY protocol headers, and checks the networks of trusted peers.
+func (c *Config) validateProxyProtocol() error {
+	for _, cidr := range c.ProxyProtocolTrusted {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("PROXY_PROTOCOL_TRUSTED: invalid CIDR %q", cidr)
+		}
+	}
+	if c.ProxyProtocolTimeout <= 0 {
+		return fmt.Errorf("PROXY_PROTOCOL_TIMEOUT must be positive")
+	}
+	for _, l := range c.Listeners {
+		if l.ProxyProtocol && len(c.ProxyProtocolTrusted) == 0 {
+			return fmt.Errorf("listener %q: proxy_protocol requires PROXY_PROTOCOL_TRUSTED", l.Name)
+		}
+	}
+	for _, cidr := range c.RequestIDTrusted {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("REQUEST_ID_TRUSTED: invalid CIDR %q", cidr)
+		}
+	}
+	for _, cidr := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("TRUSTED_PROXIES: invalid CIDR %q", cidr)
+		}
+	}
+	return nil
+}
+
+// validateClock checks the JWT leeway and expiry warning and the clock
+// check's source.
+func (c *Config) validateClock() error {
+	if c.JWTLeeway < 0 {
+		return fmt.Errorf("JWT_LEEWAY must not be negative")
+	}
+	if c.JWTExpiryWarning < 0 {
+		return fmt.Errorf("JWT_EXPIRY_WARNING must not be negative")
+	}
+	if c.ClockCheck == "" {
+		return nil
+	}
+	if c.ClockCheckInterval <= 0 {
+		return fmt.Errorf("CLOCK_CHECK_INTERVAL must be positive")
+	}
+	if host, ok := strings.CutPrefix(c.ClockCheck, "ntp:"); ok {
+		if host == "" {
+			return fmt.Errorf("CLOCK_CHECK: ntp: needs a server")
+		}
+		return nil
+	}
+	u, err := url.Parse(c.ClockCheck)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("CLOCK_CHECK must be ntp:host[:port] or an http(s) URL, got %q", c.ClockCheck)
+	}
+	return nil
 }
 
 // loadJWTPublicKey reads and parses the RSA public key for JWT verification
 func (c *Config) loadJWTPublicKey() error {
-	keyData, err := os.ReadFile(c.JWTPublicKeyPath)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	keyData, err := c.Secrets.Get(ctx, c.JWTPublicKeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to read public key: %w", err)
+	}
+
+	rsaPub, err := ParseRSAPublicKey(keyData)
+	if err != nil {
+		return err
+	}
+
+	c.JWTPublicKey = rsaPub
+	return nil
+}
+
+// validateFIPSKeys checks that the loaded keys use FIPS-approved algorithms
+// and sizes: RSA of at least 2048 bits and ECDSA on P-256 or P-384.
+// Ed25519 isn't available from every FIPS module, so it is refused too.
+func (c *Config) validateFIPSKeys() error {
+	if bits := c.JWTPublicKey.N.BitLen(); bits < 2048 {
+		return fmt.Errorf("JWT public key of %d bits is too small in FIPS mode, need 2048", bits)
+	}
+	for _, signing := range []struct {
+		name string
+		key  crypto.Signer
+	}{
+		{"ASSERTION_SIGNING_KEY_PATH", c.AssertionSigningKey},
+		{"REQUEST_SIGNING_KEY_PATH", c.RequestSigningKey},
+		{"AUDIT_CHAIN_SIGNING_KEY_PATH", c.AuditChainSigningKey},
+	} {
+		switch key := signing.key.(type) {
+		case nil:
+		case *rsa.PrivateKey:
+			if bits := key.N.BitLen(); bits < 2048 {
+				return fmt.Errorf("%s: RSA key of %d bits is too small in FIPS mode, need 2048", signing.name, bits)
+			}
+		case *ecdsa.PrivateKey:
+			if key.Curve != elliptic.P256() && key.Curve != elliptic.P384() {
+				return fmt.Errorf("%s: ECDSA curve %s isn't allowed in FIPS mode, use P-256 or P-384", signing.name, key.Curve.Params().Name)
+			}
+		default:
+			return fmt.Errorf("%s: %T keys aren't allowed in FIPS mode, use RSA or ECDSA", signing.name, signing.key)
+		}
+	}
+	return nil
+}
+
+// loadPrivateKey reads and parses a PEM private key.
+func (c *Config) loadPrivateKey(path string) (crypto.Signer, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	keyData, err := c.Secrets.Get(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	return ParsePrivateKey(keyData)
+}
+
+// loadAssertionSigningKey reads and parses the private key identity
+// assertions are signed with.
+func (c *Config) loadAssertionSigningKey() error {
+	key, err := c.loadPrivateKey(c.AssertionSigningKeyPath)
+	if err != nil {
+		return err
+	}
+
+	c.AssertionSigningKey = key
+	return nil
+}
+
+// ParsePrivateKey parses a PEM-encoded PKCS#8, PKCS#1 RSA or SEC 1 EC
+// private key.
+func ParsePrivateKey(keyData []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block")
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key of type %T can't sign", key)
+	}
+	return signer, nil
+}
+
+// ParsePublicKey parses a PEM-encoded PKIX public key of any type.
+func ParsePublicKey(keyData []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(keyData)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode PEM block")
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		return fmt.Errorf("failed to read public key file: %w", err)
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
 	}
+	return pub, nil
+}
 
+// ParseRSAPublicKey parses a PEM-encoded RSA public key.
+func ParseRSAPublicKey(keyData []byte) (*rsa.PublicKey, error) {
 	block, _ := pem.Decode(keyData)
 	if block == nil {
-		return fmt.Errorf("failed to decode PEM block")
+		return nil, fmt.Errorf("failed to decode PEM block")
 	}
 
 	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
-		return fmt.Errorf("failed to parse public key: %w", err)
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
 	}
 
 	rsaPub, ok := pub.(*rsa.PublicKey)
 	if !ok {
-		return fmt.Errorf("public key is not RSA")
+		return nil, fmt.Errorf("public key is not RSA")
 	}
-
-	c.JWTPublicKey = rsaPub
-	return nil
+	return rsaPub, nil
 }
 
 func getEnv(key, defaultValue string) string {
@@ -97,11 +2346,155 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-func getEnvInt(key string, defaultValue int) int {
+func getEnvInt(key string, defaultValue int) (int, error) {
+	if value := os.Getenv(key); value != "" {
+		intVal, err := strconv.Atoi(value)
+		if err != nil {
+			return defaultValue, fmt.Errorf("%s must be an integer, got %q", key, value)
+		}
+		return intVal, nil
+	}
+	return defaultValue, nil
+}
+
+func getEnvFloat(key string, defaultValue float64) (float64, error) {
+	if value := os.Getenv(key); value != "" {
+		floatVal, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return defaultValue, fmt.Errorf("%s must be a number, got %q", key, value)
+		}
+		return floatVal, nil
+	}
+	return defaultValue, nil
+}
+
+func getEnvBool(key string, defaultValue bool) (bool, error) {
+	if value := os.Getenv(key); value != "" {
+		boolVal, err := strconv.ParseBool(value)
+		if err != nil {
+			return defaultValue, fmt.Errorf("%s must be true or false, got %q", key, value)
+		}
+		return boolVal, nil
+	}
+	return defaultValue, nil
+}
+
+func getEnvInt64(key string, defaultValue int64) (int64, error) {
+	if value := os.Getenv(key); value != "" {
+		intVal, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return defaultValue, fmt.Errorf("%s must be an integer, got %q", key, value)
+		}
+		return intVal, nil
+	}
+	return defaultValue, nil
+}
+
+// getEnvDuration reads a duration with units, e.g. "30s".
+func getEnvDuration(key string, defaultValue Duration) (Duration, error) {
+	if value := os.Getenv(key); value != "" {
+		d, err := ParseDuration(value)
+		if err != nil {
+			return defaultValue, fmt.Errorf("%s: %w", key, err)
+		}
+		return d, nil
+	}
+	return defaultValue, nil
+}
+
+// getEnvLegacyDuration reads an older unitless variable such as
+// SCORING_TIMEOUT_MS, counting in the given unit.
+func getEnvLegacyDuration(key string, unit time.Duration, defaultValue Duration) (Duration, error) {
 	if value := os.Getenv(key); value != "" {
-		if intVal, err := strconv.Atoi(value); err == nil {
-			return intVal
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return defaultValue, fmt.Errorf("%s must be a non-negative integer, got %q", key, value)
 		}
+		return Duration(time.Duration(n) * unit), nil
+	}
+	return defaultValue, nil
+}
+
+// getEnvByteSize reads a size with optional units, e.g. "10MiB".
+func getEnvByteSize(key string, defaultValue ByteSize) (ByteSize, error) {
+	if value := os.Getenv(key); value != "" {
+		size, err := ParseByteSize(value)
+		if err != nil {
+			return defaultValue, fmt.Errorf("%s: %w", key, err)
+		}
+		return size, nil
+	}
+	return defaultValue, nil
+}
+
+// envReader reads typed variables in a struct literal, keeping the first
+// error for Load to return.
+type envReader struct {
+	err error
+}
+
+func (e *envReader) keep(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+func (e *envReader) getInt(key string, defaultValue int) int {
+	v, err := getEnvInt(key, defaultValue)
+	e.keep(err)
+	return v
+}
+
+func (e *envReader) getFloat(key string, defaultValue float64) float64 {
+	v, err := getEnvFloat(key, defaultValue)
+	e.keep(err)
+	return v
+}
+
+func (e *envReader) getBool(key string, defaultValue bool) bool {
+	v, err := getEnvBool(key, defaultValue)
+	e.keep(err)
+	return v
+}
+
+func (e *envReader) getInt64(key string, defaultValue int64) int64 {
+	v, err := getEnvInt64(key, defaultValue)
+	e.keep(err)
+	return v
+}
+
+func (e *envReader) getDuration(key string, defaultValue Duration) Duration {
+	v, err := getEnvDuration(key, defaultValue)
+	e.keep(err)
+	return v
+}
+
+func (e *envReader) getLegacyDuration(key string, unit time.Duration, defaultValue Duration) Duration {
+	v, err := getEnvLegacyDuration(key, unit, defaultValue)
+	e.keep(err)
+	return v
+}
+
+func (e *envReader) getByteSize(key string, defaultValue ByteSize) ByteSize {
+	v, err := getEnvByteSize(key, defaultValue)
+	e.keep(err)
+	return v
+}
+
+func getEnvList(key string, defaultValue []string) []string {
+	if value := os.Getenv(key); value != "" {
+		return splitList(value)
 	}
 	return defaultValue
 }
+
+// splitList splits a comma-separated value, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// CORSPolicy is the cross-origin policy the cors stage applies for a route.
+type CORSPolicy struct {
+	// AllowedOrigins are origins such as https://app.example.com, wildcards
+	// such as https://*.example.com, or "*"
+	AllowedOrigins   []string `yaml:"allowed_origins"`
+	AllowedMethods   []string `yaml:"allowed_methods"`
+	AllowedHeaders   []string `yaml:"allowed_headers"`
+	ExposedHeaders   []string `yaml:"exposed_headers"`
+	AllowCredentials bool     `yaml:"allow_credentials"`
+	MaxAge           Duration `yaml:"max_age"` // How long browsers may cache preflight results
+}
+
+// Inherit fills the lists and max age a route's policy leaves unset from the
+// default policy.
+func (p CORSPolicy) Inherit(defaults CORSPolicy) CORSPolicy {
+	if len(p.AllowedMethods) == 0 {
+		p.AllowedMethods = defaults.AllowedMethods
+	}
+	if len(p.AllowedHeaders) == 0 {
+		p.AllowedHeaders = defaults.AllowedHeaders
+	}
+	if len(p.ExposedHeaders) == 0 {
+		p.ExposedHeaders = defaults.ExposedHeaders
+	}
+	if p.MaxAge == 0 {
+		p.MaxAge = defaults.MaxAge
+	}
+	return p
+}
+
+// headerToken matches HTTP header names.
+var headerToken = regexp.MustCompile(`^[A-Za-z0-9!#$%&'*+.^_|~-]+$`)
+
+// validateCORS checks a CORS policy; name identifies it in errors.
+func validateCORS(name string, p CORSPolicy) error {
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" {
+			if p.AllowCredentials {
+				return fmt.Errorf("%s: origin \"*\" can't be combined with allow_credentials", name)
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://wildcard.", 1))
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("%s: origin %q must be scheme://host[:port], e.g. https://app.example.com", name, origin)
+		}
+	}
+	for _, method := range p.AllowedMethods {
+		if !methodToken.MatchString(method) {
+			return fmt.Errorf("%s: method %q must be uppercase, e.g. GET", name, method)
+		}
+	}
+	for _, header := range append(append([]string{}, p.AllowedHeaders...), p.ExposedHeaders...) {
+		if !headerToken.MatchString(header) {
+			return fmt.Errorf("%s: invalid header name %q", name, header)
+		}
+	}
+	if p.MaxAge < 0 {
+		return fmt.Errorf("%s: max_age must not be negative", name)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// DLPBuiltinPatterns are the pattern names DLP_PATTERNS may list.
+var DLPBuiltinPatterns = map[string]bool{
+	"credit_card": true, "ssn": true, "aws_key": true,
+	"github_token": true, "slack_token": true, "private_key": true,
+}
+
+// validateDLP checks the dlp stage's patterns and actions.
+func validateDLP(cfg *Config) error {
+	if !validDLPAction(cfg.DLPAction) {
+		return fmt.Errorf("DLP_ACTION must be mask, block or alert, got %q", cfg.DLPAction)
+	}
+	if cfg.DLPMaxBody <= 0 {
+		return fmt.Errorf("DLP_MAX_BODY must be positive with the dlp stage")
+	}
+	names := make(map[string]bool)
+	for _, name := range cfg.DLPPatterns {
+		if !DLPBuiltinPatterns[name] {
+			return fmt.Errorf("DLP_PATTERNS: unknown pattern %q", name)
+		}
+		names[name] = true
+	}
+	for name, pattern := range cfg.DLPCustomPatterns {
+		if DLPBuiltinPatterns[name] {
+			return fmt.Errorf("dlp_custom_patterns: %q is a built-in pattern name", name)
+		}
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("dlp_custom_patterns: pattern %q: %w", name, err)
+		}
+		names[name] = true
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("the dlp stage needs DLP_PATTERNS or dlp_custom_patterns")
+	}
+	for name, action := range cfg.DLPPatternActions {
+		if !names[name] {
+			return fmt.Errorf("dlp_pattern_actions: pattern %q is not enabled", name)
+		}
+		if !validDLPAction(action) {
+			return fmt.Errorf("dlp_pattern_actions: pattern %q: action must be mask, block or alert, got %q", name, action)
+		}
+	}
+	return nil
+}
+
+func validDLPAction(action string) bool {
+	return action == "mask" || action == "block" || action == "alert"
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		get     func() (any, error)
+		want    any
+		wantErr bool
+	}{
+		{name: "int", value: "42", get: func() (any, error) { return getEnvInt("AEGIS_TEST", 7) }, want: 42},
+		{name: "int unset", get: func() (any, error) { return getEnvInt("AEGIS_TEST", 7) }, want: 7},
+		{name: "int invalid", value: "42s", get: func() (any, error) { return getEnvInt("AEGIS_TEST", 7) }, want: 7, wantErr: true},
+		{name: "float", value: "0.25", get: func() (any, error) { return getEnvFloat("AEGIS_TEST", 1) }, want: 0.25},
+		{name: "float invalid", value: "1/4", get: func() (any, error) { return getEnvFloat("AEGIS_TEST", 1) }, want: 1.0, wantErr: true},
+		{name: "bool", value: "true", get: func() (any, error) { return getEnvBool("AEGIS_TEST", false) }, want: true},
+		{name: "bool unset", get: func() (any, error) { return getEnvBool("AEGIS_TEST", true) }, want: true},
+		{name: "bool invalid", value: "yes", get: func() (any, error) { return getEnvBool("AEGIS_TEST", false) }, want: false, wantErr: true},
+		{name: "int64", value: "10485760", get: func() (any, error) { return getEnvInt64("AEGIS_TEST", 0) }, want: int64(10485760)},
+		{name: "int64 invalid", value: "10MB", get: func() (any, error) { return getEnvInt64("AEGIS_TEST", 0) }, want: int64(0), wantErr: true},
+		{name: "duration", value: "250ms", get: func() (any, error) { return getEnvDuration("AEGIS_TEST", 0) }, want: Duration(250 * time.Millisecond)},
+		{name: "duration unitless", value: "30", get: func() (any, error) { return getEnvDuration("AEGIS_TEST", 0) }, want: Duration(0), wantErr: true},
+		{name: "duration negative", value: "-1s", get: func() (any, error) { return getEnvDuration("AEGIS_TEST", 0) }, want: Duration(0), wantErr: true},
+		{name: "legacy duration", value: "5", get: func() (any, error) { return getEnvLegacyDuration("AEGIS_TEST", time.Minute, 0) }, want: Duration(5 * time.Minute)},
+		{name: "legacy duration with units", value: "5m", get: func() (any, error) { return getEnvLegacyDuration("AEGIS_TEST", time.Minute, 0) }, want: Duration(0), wantErr: true},
+		{name: "legacy duration negative", value: "-5", get: func() (any, error) { return getEnvLegacyDuration("AEGIS_TEST", time.Minute, 0) }, want: Duration(0), wantErr: true},
+		{name: "byte size", value: "10MiB", get: func() (any, error) { return getEnvByteSize("AEGIS_TEST", 0) }, want: ByteSize(10 << 20)},
+		{name: "byte size invalid", value: "ten", get: func() (any, error) { return getEnvByteSize("AEGIS_TEST", 1) }, want: ByteSize(1), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("AEGIS_TEST", tt.value)
+			got, err := tt.get()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "AEGIS_TEST") {
+				t.Errorf("error %q doesn't name the variable", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRejectsInvalidVariables(t *testing.T) {
+	for _, key := range []string{"PORT", "FAIL_OPEN", "RATE_LIMIT_RPS", "HEURISTIC_MAX_PAYLOAD_BYTES", "UPSTREAM_TIMEOUT", "SCORING_TIMEOUT_MS", "WAF_MAX_BODY"} {
+		t.Run(key, func(t *testing.T) {
+			t.Setenv(key, "not-a-value")
+			_, err := Load()
+			if err == nil || !strings.Contains(err.Error(), key) {
+				t.Fatalf("Load = %v, want an error about %s", err, key)
+			}
+		})
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !fips
+
+package config
+
+// FIPSBuild is set by the fips build tag: the binary always runs in FIPS
+// mode, whatever FIPS_MODE says.
+const FIPSBuild = false
@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SecurityHeaders are the response headers the headers stage adds. "off"
+// leaves a header out.
+type SecurityHeaders struct {
+	HSTS           string `yaml:"hsts"` // Strict-Transport-Security, sent over TLS only
+	FrameOptions   string `yaml:"frame_options"`
+	ReferrerPolicy string `yaml:"referrer_policy"`
+	CSP            string `yaml:"csp"` // Content-Security-Policy
+}
+
+// Inherit fills the headers a route leaves unset from the defaults.
+func (h SecurityHeaders) Inherit(defaults SecurityHeaders) SecurityHeaders {
+	if h.HSTS == "" {
+		h.HSTS = defaults.HSTS
+	}
+	if h.FrameOptions == "" {
+		h.FrameOptions = defaults.FrameOptions
+	}
+	if h.ReferrerPolicy == "" {
+		h.ReferrerPolicy = defaults.ReferrerPolicy
+	}
+	if h.CSP == "" {
+		h.CSP = defaults.CSP
+	}
+	return h
+}
+
+// referrerPolicies are the values Referrer-Policy may take.
+var referrerPolicies = map[string]bool{
+	"no-referrer": true, "no-referrer-when-downgrade": true, "origin": true, "origin-when-cross-origin": true,
+	"same-origin": true, "strict-origin": true, "strict-origin-when-cross-origin": true, "unsafe-url": true,
+}
+
+// validateSecurityHeaders checks header values; name identifies them in errors.
+func validateSecurityHeaders(name string, h SecurityHeaders) error {
+	if h.HSTS != "" && h.HSTS != "off" && !strings.HasPrefix(h.HSTS, "max-age=") {
+		return fmt.Errorf("%s: hsts must start with max-age= or be off, got %q", name, h.HSTS)
+	}
+	switch h.FrameOptions {
+	case "", "off", "DENY", "SAMEORIGIN":
+	default:
+		return fmt.Errorf("%s: frame_options must be DENY, SAMEORIGIN or off, got %q", name, h.FrameOptions)
+	}
+	if h.ReferrerPolicy != "" && h.ReferrerPolicy != "off" && !referrerPolicies[h.ReferrerPolicy] {
+		return fmt.Errorf("%s: unknown referrer_policy %q", name, h.ReferrerPolicy)
+	}
+	for _, value := range []string{h.HSTS, h.CSP} {
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("%s: header values must be a single line", name)
+		}
+	}
+	return nil
+}
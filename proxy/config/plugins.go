@@ -0,0 +1,32 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PluginPaths returns the Go plugins to load, from PLUGINS or the plugins
+// key of CONFIG_FILE. They are needed before Load, since plugins register
+// the stages a configuration may name.
+func PluginPaths() ([]string, error) {
+	if value := os.Getenv("PLUGINS"); value != "" {
+		return splitList(value), nil
+	}
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %w", err)
+	}
+	var doc struct {
+		Plugins []string `yaml:"plugins"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return doc.Plugins, nil
+}
@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"gopkg.in/yaml.v3"
+)
+
+// presets are defaults for an environment, applied over the built-in
+// defaults and under the config file and environment.
+var presets = map[string]func(*Config){
+	// Verbose, permissive and observe-only for local work
+	"dev": func(c *Config) {
+		c.LogLevel = "debug"
+		c.TLSPolicy = "intermediate"
+		c.FailOpen = true
+		c.AccessLogSampleRate = 1
+		c.EnforcementMode = "monitor"
+	},
+	// Production-like policy in monitor mode, with a quarter of allowed
+	// traffic logged to keep pre-production Kafka costs down
+	"staging": func(c *Config) {
+		c.LogLevel = "info"
+		c.TLSPolicy = "modern"
+		c.FailOpen = true
+		c.AccessLogSampleRate = 0.25
+		c.EnforcementMode = "monitor"
+	},
+	// Enforcing, TLS 1.3 only, and failing closed when the blocklist is
+	// unavailable. Every request is logged since detection depends on it.
+	"prod": func(c *Config) {
+		c.LogLevel = "warn"
+		c.TLSPolicy = "modern"
+		c.FailOpen = false
+		c.AccessLogSampleRate = 1
+		c.EnforcementMode = "enforce"
+	},
+	// Like prod, in FIPS mode: a FIPS 140 crypto module is required and TLS
+	// and keys are restricted to approved versions, ciphers and algorithms
+	"fips": func(c *Config) {
+		c.LogLevel = "info"
+		c.TLSPolicy = "fips"
+		c.FIPSMode = true
+		c.FailOpen = false
+		c.AccessLogSampleRate = 1
+		c.EnforcementMode = "enforce"
+	},
+}
+
+// applyPreset applies the named preset to cfg; an empty name applies none.
+func applyPreset(cfg *Config, name string) error {
+	if name == "" {
+		return nil
+	}
+	preset, ok := presets[name]
+	if !ok {
+		return fmt.Errorf("PRESET must be \"dev\", \"staging\", \"prod\" or \"fips\", got %q", name)
+	}
+	preset(cfg)
+	cfg.Preset = name
+	return nil
+}
+
+// filePreset reads just the preset key of a config file.
+func filePreset(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open config file: %w", err)
+	}
+	var doc struct {
+		Preset string `yaml:"preset"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return "", fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return doc.Preset, nil
+}
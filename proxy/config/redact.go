@@ -0,0 +1,74 @@
+package config
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// redactedValue replaces secret values in configuration dumps.
+const redactedValue = "[REDACTED]"
+
+// Redacted returns the effective configuration keyed like the config file,
+// with secrets removed: fields tagged `secret:"true"` and credentials
+// embedded in URLs.
+func (c *Config) Redacted() (map[string]interface{}, error) {
+	clean := *c
+	v := reflect.ValueOf(&clean).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		switch {
+		case field.Tag.Get("secret") == "true":
+			if value.Kind() == reflect.String && value.String() != "" {
+				value.SetString(redactedValue)
+			}
+			if value.Kind() == reflect.Slice && !value.IsNil() {
+				items := make([]string, value.Len())
+				for j := range items {
+					items[j] = redactedValue
+				}
+				value.Set(reflect.ValueOf(items))
+			}
+		case value.Kind() == reflect.String:
+			value.SetString(redactURL(value.String()))
+		case value.Type() == reflect.TypeOf([]string(nil)) && !value.IsNil():
+			items := make([]string, value.Len())
+			for j := range items {
+				items[j] = redactURL(value.Index(j).String())
+			}
+			value.Set(reflect.ValueOf(items))
+		}
+	}
+
+	// Round-trip through YAML for the file's key names and value formats
+	data, err := yaml.Marshal(&clean)
+	if err != nil {
+		return nil, err
+	}
+	var out map[string]interface{}
+	if err := yaml.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// redactURL removes passwords and query strings from URLs, which may carry
+// credentials or tokens. Other values are returned unchanged.
+func redactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return redactedValue
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "REDACTED")
+	}
+	if u.RawQuery != "" {
+		u.RawQuery = "REDACTED"
+	}
+	return u.String()
+}
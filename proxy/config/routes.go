@@ -0,0 +1,201 @@
+package config
+
+import (
+	"fmt"
+	"mime"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RoutePolicy states what requests under a path prefix must satisfy. Unset
+// fields impose nothing.
+type RoutePolicy struct {
+	Prefix  string   `yaml:"prefix"`
+	Methods []string `yaml:"methods"`
+	// ContentTypes are the accepted body media types, e.g. application/json
+	// or text/*
+	ContentTypes   []string `yaml:"content_types"`
+	MaxHeaders     int      `yaml:"max_headers"`
+	MaxHeaderBytes ByteSize `yaml:"max_header_bytes"`
+	// Auth is "jwt" (the default: the jwt stage requires a token) or "none"
+	// (the jwt stage lets requests through without one)
+	Auth   string   `yaml:"auth"`
+	Scopes []string `yaml:"scopes"` // All required, from the "scope" or "scp" claim
+	// MTLS "required" refuses requests without a verified client certificate,
+	// for routes served on listeners where it is optional
+	MTLS          string   `yaml:"mtls"`
+	RateLimitTier string   `yaml:"rate_limit_tier"` // A name from RateLimitTiers
+	MaxBody       ByteSize `yaml:"max_body"`
+	MaxRisk       float64  `yaml:"max_risk"` // Refuse scores at or above it; 0 disables
+	// OpenAPI is a spec file requests must conform to; OpenAPIMode is
+	// "block" (the default) or "detect", which only reports violations
+	OpenAPI     string `yaml:"openapi"`
+	OpenAPIMode string `yaml:"openapi_mode"`
+	// CORS replaces the default policy of the cors stage for the route;
+	// lists it leaves out are inherited
+	CORS *CORSPolicy `yaml:"cors"`
+	// CSRF requires the csrf stage's token on state-changing requests that
+	// carry cookies, for browser routes using session cookies
+	CSRF bool `yaml:"csrf"`
+	// ReplayProtection requires the replay stage's nonce and timestamp, for
+	// machine APIs
+	ReplayProtection bool `yaml:"replay_protection"`
+	// SecurityHeaders override the headers stage's defaults for the route
+	SecurityHeaders *SecurityHeaders `yaml:"security_headers"`
+	// Timeout replaces SERVER_READ_TIMEOUT and SERVER_WRITE_TIMEOUT for the
+	// route, e.g. for large uploads
+	Timeout Duration `yaml:"timeout"`
+	// CacheTTL keeps GET responses in the cache stage for up to this long;
+	// Cache-Control from the upstream can shorten it
+	CacheTTL Duration `yaml:"cache_ttl"`
+	// Response rules upstream responses must satisfy
+	Response *ResponseRules `yaml:"response"`
+	// Mirror is an upstream URL MirrorPercent of the route's requests are
+	// copied to, fire-and-forget, e.g. a new service version; the percentage
+	// defaults to 100
+	Mirror        string  `yaml:"mirror"`
+	MirrorPercent float64 `yaml:"mirror_percent"`
+	// TokenAudience replaces TOKEN_EXCHANGE_AUDIENCE for the route's
+	// exchanged tokens, scoping them to its backend
+	TokenAudience string `yaml:"token_audience"`
+}
+
+// ResponseRules limit what a route's upstream responses may carry. Action
+// is "block" (the default), refusing violating responses, or "truncate",
+// cutting bodies off at MaxSize; other violations are refused either way.
+type ResponseRules struct {
+	MaxSize         ByteSize `yaml:"max_size"`
+	ContentTypes    []string `yaml:"content_types"`
+	RequiredHeaders []string `yaml:"required_headers"`
+	Action          string   `yaml:"action"`
+}
+
+// RateLimitTier is a named per-client rate limit routes can share.
+type RateLimitTier struct {
+	RPS   float64 `yaml:"rps"`
+	Burst int     `yaml:"burst"`
+}
+
+// methodToken matches HTTP method names.
+var methodToken = regexp.MustCompile(`^[A-Z]+$`)
+
+// validateRoutePolicies checks each route policy and that prefixes are unique.
+func validateRoutePolicies(cfg *Config) error {
+	for name, tier := range cfg.RateLimitTiers {
+		if tier.RPS <= 0 || tier.Burst < 1 {
+			return fmt.Errorf("rate limit tier %q: rps and burst must be positive", name)
+		}
+	}
+
+	prefixes := make(map[string]bool)
+	for _, route := range cfg.RoutePolicies {
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return fmt.Errorf("route policy %q: prefix must start with /", route.Prefix)
+		}
+		normalized := strings.TrimSuffix(route.Prefix, "/")
+		if prefixes[normalized] {
+			return fmt.Errorf("route policy %q is defined twice", route.Prefix)
+		}
+		prefixes[normalized] = true
+
+		for _, method := range route.Methods {
+			if !methodToken.MatchString(method) {
+				return fmt.Errorf("route policy %q: method %q must be uppercase, e.g. GET", route.Prefix, method)
+			}
+		}
+		for _, contentType := range route.ContentTypes {
+			if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != contentType {
+				return fmt.Errorf("route policy %q: invalid content type %q", route.Prefix, contentType)
+			}
+		}
+		if route.MaxHeaders < 0 || route.MaxHeaderBytes < 0 {
+			return fmt.Errorf("route policy %q: max_headers and max_header_bytes must not be negative", route.Prefix)
+		}
+		switch route.Auth {
+		case "", "jwt":
+		case "none":
+			if len(route.Scopes) > 0 {
+				return fmt.Errorf("route policy %q: scopes require auth jwt", route.Prefix)
+			}
+		default:
+			return fmt.Errorf("route policy %q: auth must be jwt or none, got %q", route.Prefix, route.Auth)
+		}
+		if route.MTLS != "" && route.MTLS != "required" {
+			return fmt.Errorf("route policy %q: mtls must be required or unset, got %q", route.Prefix, route.MTLS)
+		}
+		if _, ok := cfg.RateLimitTiers[route.RateLimitTier]; route.RateLimitTier != "" && !ok {
+			return fmt.Errorf("route policy %q: unknown rate_limit_tier %q", route.Prefix, route.RateLimitTier)
+		}
+		if route.OpenAPIMode != "" && route.OpenAPIMode != "block" && route.OpenAPIMode != "detect" {
+			return fmt.Errorf("route policy %q: openapi_mode must be block or detect, got %q", route.Prefix, route.OpenAPIMode)
+		}
+		if route.OpenAPIMode != "" && route.OpenAPI == "" {
+			return fmt.Errorf("route policy %q: openapi_mode requires openapi", route.Prefix)
+		}
+		if route.Timeout < 0 || route.CacheTTL < 0 {
+			return fmt.Errorf("route policy %q: timeout and cache_ttl must not be negative", route.Prefix)
+		}
+		if route.CacheTTL > 0 && !cfg.HasStage("cache") {
+			return fmt.Errorf("route policy %q: cache_ttl requires the cache stage", route.Prefix)
+		}
+		if route.MaxRisk < 0 || route.MaxRisk > 1 {
+			return fmt.Errorf("route policy %q: max_risk must be between 0 and 1", route.Prefix)
+		}
+		if route.CORS != nil {
+			if !cfg.HasStage("cors") {
+				return fmt.Errorf("route policy %q: cors requires the cors stage", route.Prefix)
+			}
+			if err := validateCORS("route policy "+strconv.Quote(route.Prefix)+": cors", *route.CORS); err != nil {
+				return err
+			}
+		}
+		if route.CSRF && !cfg.HasStage("csrf") {
+			return fmt.Errorf("route policy %q: csrf requires the csrf stage", route.Prefix)
+		}
+		if route.TokenAudience != "" && !cfg.HasStage("exchange") {
+			return fmt.Errorf("route policy %q: token_audience requires the exchange stage", route.Prefix)
+		}
+		if route.ReplayProtection && !cfg.HasStage("replay") {
+			return fmt.Errorf("route policy %q: replay_protection requires the replay stage", route.Prefix)
+		}
+		if route.SecurityHeaders != nil {
+			if !cfg.HasStage("headers") {
+				return fmt.Errorf("route policy %q: security_headers requires the headers stage", route.Prefix)
+			}
+			if err := validateSecurityHeaders("route policy "+strconv.Quote(route.Prefix)+": security_headers", *route.SecurityHeaders); err != nil {
+				return err
+			}
+		}
+		if rules := route.Response; rules != nil {
+			if rules.MaxSize < 0 {
+				return fmt.Errorf("route policy %q: response max_size must not be negative", route.Prefix)
+			}
+			for _, contentType := range rules.ContentTypes {
+				if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != contentType {
+					return fmt.Errorf("route policy %q: invalid response content type %q", route.Prefix, contentType)
+				}
+			}
+			if rules.Action != "" && rules.Action != "block" && rules.Action != "truncate" {
+				return fmt.Errorf("route policy %q: response action must be block or truncate, got %q", route.Prefix, rules.Action)
+			}
+		}
+		if route.Mirror != "" {
+			if u, err := url.Parse(route.Mirror); err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+				return fmt.Errorf("route policy %q: mirror must be an http or https URL, got %q", route.Prefix, route.Mirror)
+			}
+		}
+		if route.MirrorPercent < 0 || route.MirrorPercent > 100 || route.MirrorPercent > 0 && route.Mirror == "" {
+			return fmt.Errorf("route policy %q: mirror_percent must be between 0 and 100, with a mirror", route.Prefix)
+		}
+		if len(route.Scopes) > 0 && !cfg.HasStage("jwt") {
+			return fmt.Errorf("route policy %q: scopes require the jwt stage", route.Prefix)
+		}
+	}
+
+	if len(cfg.RoutePolicies) > 0 && !cfg.HasStage("routes") {
+		return fmt.Errorf("route_policies require the routes stage")
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule restricts a route, or some identities, to time windows, e.g.
+// admin APIs to business hours. Requests it applies to outside the window
+// are refused, or with action "flag" let through and marked for the model.
+type Schedule struct {
+	Name   string `yaml:"name"`
+	Prefix string `yaml:"prefix"` // Path prefix; empty matches every request
+	// Subjects and Claims narrow the schedule to these JWT subjects and to
+	// tokens carrying all of these claim values; empty applies to everyone
+	Subjects []string          `yaml:"subjects"`
+	Claims   map[string]string `yaml:"claims"`
+	// Days are when the window opens, as days or ranges such as "mon-fri";
+	// empty is every day. Hours is "09:00-18:00"; a window ending before
+	// it starts runs overnight into the next day. Empty is all day.
+	Days     []string `yaml:"days"`
+	Hours    string   `yaml:"hours"`
+	Timezone string   `yaml:"timezone"` // IANA name; UTC if empty
+	Action   string   `yaml:"action"`   // "block" (the default) or "flag"
+}
+
+// ScheduleWindow is a parsed schedule window.
+type ScheduleWindow struct {
+	Days       [7]bool // By time.Weekday
+	Start, End time.Duration
+	Location   *time.Location
+}
+
+// weekdays are the day names schedules accept.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Window parses the schedule's days, hours and timezone.
+func (s Schedule) Window() (ScheduleWindow, error) {
+	w := ScheduleWindow{Location: time.UTC, End: 24 * time.Hour}
+	if s.Timezone != "" {
+		loc, err := time.LoadLocation(s.Timezone)
+		if err != nil {
+			return w, fmt.Errorf("unknown timezone %q", s.Timezone)
+		}
+		w.Location = loc
+	}
+
+	if len(s.Days) == 0 {
+		w.Days = [7]bool{true, true, true, true, true, true, true}
+	}
+	for _, day := range s.Days {
+		first, last, _ := strings.Cut(strings.ToLower(strings.TrimSpace(day)), "-")
+		if last == "" {
+			last = first
+		}
+		from, ok1 := weekdays[first]
+		to, ok2 := weekdays[last]
+		if !ok1 || !ok2 {
+			return w, fmt.Errorf("invalid day %q (use mon, tue, ... or ranges such as mon-fri)", day)
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			w.Days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	if s.Hours != "" {
+		start, end, ok := strings.Cut(s.Hours, "-")
+		var err1, err2 error
+		w.Start, err1 = clockTime(start)
+		w.End, err2 = clockTime(end)
+		if !ok || err1 != nil || err2 != nil || w.Start == w.End {
+			return w, fmt.Errorf("invalid hours %q (e.g. 09:00-18:00)", s.Hours)
+		}
+	}
+	return w, nil
+}
+
+// clockTime parses a time of day such as "09:30" into time since midnight;
+// "24:00" is the end of the day.
+func clockTime(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		if strings.TrimSpace(value) == "24:00" {
+			return 24 * time.Hour, nil
+		}
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// validateSchedules checks the schedule stage's windows.
+func validateSchedules(cfg *Config) error {
+	if len(cfg.Schedules) == 0 {
+		return fmt.Errorf("the schedule stage needs schedules in the config file")
+	}
+	names := make(map[string]bool, len(cfg.Schedules))
+	for i, s := range cfg.Schedules {
+		if s.Name == "" || names[s.Name] {
+			return fmt.Errorf("schedules[%d]: name must be set and unique", i)
+		}
+		names[s.Name] = true
+		if s.Prefix != "" && !strings.HasPrefix(s.Prefix, "/") {
+			return fmt.Errorf("schedule %q: prefix must start with /", s.Name)
+		}
+		if s.Action != "" && s.Action != "block" && s.Action != "flag" {
+			return fmt.Errorf("schedule %q: action must be block or flag, got %q", s.Name, s.Action)
+		}
+		if s.Days == nil && s.Hours == "" {
+			return fmt.Errorf("schedule %q: set days or hours", s.Name)
+		}
+		if _, err := s.Window(); err != nil {
+			return fmt.Errorf("schedule %q: %w", s.Name, err)
+		}
+	}
+	return nil
+}
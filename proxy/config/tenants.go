@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Tenant is a product team served by a shared proxy fleet. A request belongs
+// to the first tenant matching its hostname, then its path, then the value
+// of the TenantClaim JWT claim; other requests belong to no tenant.
+type Tenant struct {
+	Name         string   `yaml:"name"`
+	Hosts        []string `yaml:"hosts"`
+	PathPrefixes []string `yaml:"path_prefixes"`
+	ClaimValues  []string `yaml:"claim_values"`
+
+	// Kafka topics for the tenant's access logs and feature vectors; empty
+	// uses the shared topics
+	AccessLogTopic string `yaml:"access_log_topic"`
+	FeatureTopic   string `yaml:"feature_topic"`
+
+	// Rate limit of the tenant's clients; 0 uses RATE_LIMIT_RPS and RATE_LIMIT_BURST
+	RateLimitRPS   float64 `yaml:"rate_limit_rps"`
+	RateLimitBurst int     `yaml:"rate_limit_burst"`
+}
+
+// tenantName restricts tenant names to what is safe in Redis keys and metric labels.
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// validateTenants checks that tenants are named and that every host, path
+// prefix and claim value selects at most one of them.
+func validateTenants(cfg *Config) error {
+	names := make(map[string]bool)
+	hosts := make(map[string]string)
+	prefixes := make(map[string]string)
+	claims := make(map[string]string)
+
+	for _, tenant := range cfg.Tenants {
+		if !tenantName.MatchString(tenant.Name) {
+			return fmt.Errorf("tenant %q: name must be lowercase letters, digits, - and _", tenant.Name)
+		}
+		if names[tenant.Name] {
+			return fmt.Errorf("tenant %q is defined twice", tenant.Name)
+		}
+		names[tenant.Name] = true
+
+		if len(tenant.Hosts)+len(tenant.PathPrefixes)+len(tenant.ClaimValues) == 0 {
+			return fmt.Errorf("tenant %q: set hosts, path_prefixes or claim_values", tenant.Name)
+		}
+		for _, host := range tenant.Hosts {
+			host = strings.ToLower(host)
+			if other, ok := hosts[host]; ok {
+				return fmt.Errorf("tenant %q: host %q already belongs to tenant %q", tenant.Name, host, other)
+			}
+			hosts[host] = tenant.Name
+		}
+		for _, prefix := range tenant.PathPrefixes {
+			if !strings.HasPrefix(prefix, "/") {
+				return fmt.Errorf("tenant %q: path prefix %q must start with /", tenant.Name, prefix)
+			}
+			if other, ok := prefixes[prefix]; ok {
+				return fmt.Errorf("tenant %q: path prefix %q already belongs to tenant %q", tenant.Name, prefix, other)
+			}
+			prefixes[prefix] = tenant.Name
+		}
+		for _, value := range tenant.ClaimValues {
+			if other, ok := claims[value]; ok {
+				return fmt.Errorf("tenant %q: claim value %q already belongs to tenant %q", tenant.Name, value, other)
+			}
+			claims[value] = tenant.Name
+		}
+
+		if tenant.RateLimitRPS < 0 || tenant.RateLimitBurst < 0 {
+			return fmt.Errorf("tenant %q: rate limits must not be negative", tenant.Name)
+		}
+		if (tenant.RateLimitRPS > 0) != (tenant.RateLimitBurst > 0) {
+			return fmt.Errorf("tenant %q: set both rate_limit_rps and rate_limit_burst", tenant.Name)
+		}
+	}
+
+	// The claim is read before the token is verified; only the jwt stage
+	// makes it trustworthy
+	if len(claims) > 0 {
+		if cfg.TenantClaim == "" {
+			return fmt.Errorf("tenant claim_values require TENANT_CLAIM")
+		}
+		if !cfg.HasStage("jwt") {
+			return fmt.Errorf("tenant claim_values require the jwt stage")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Duration is a config duration written with units, e.g. "250ms", "30s" or "5m".
+type Duration time.Duration
+
+// ParseDuration parses a duration with units. Bare numbers are rejected
+// because their unit would be ambiguous.
+func ParseDuration(value string) (Duration, error) {
+	d, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q (use units, e.g. 30s or 5m)", value)
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("invalid duration %q: must not be negative", value)
+	}
+	return Duration(d), nil
+}
+
+// Std returns the value as a time.Duration.
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// UnmarshalYAML parses durations written as strings with units.
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := ParseDuration(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*d = parsed
+	return nil
+}
+
+// MarshalYAML writes the duration with units.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+// ByteSize is a config size written with units, e.g. "512KiB", "10MiB" or "1GB".
+// Bare numbers are bytes.
+type ByteSize int64
+
+// byteUnits are the accepted suffixes, longest first so "MiB" wins over "B".
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+	{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+	{"B", 1},
+}
+
+// ParseByteSize parses a size such as "10MiB" or "4096".
+func ParseByteSize(value string) (ByteSize, error) {
+	value = strings.TrimSpace(value)
+	number, multiplier := value, int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			number, multiplier = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 4096, 512KiB or 10MiB)", value)
+	}
+	return ByteSize(n * float64(multiplier)), nil
+}
+
+// String uses the largest binary unit that represents the size exactly.
+func (b ByteSize) String() string {
+	for i := 2; i >= 0; i-- {
+		unit := byteUnits[i]
+		if b > 0 && int64(b)%unit.size == 0 {
+			return fmt.Sprintf("%d%s", int64(b)/unit.size, unit.suffix)
+		}
+	}
+	return strconv.FormatInt(int64(b), 10)
+}
+
+// UnmarshalYAML parses sizes written as numbers or strings with units.
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	parsed, err := ParseByteSize(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*b = parsed
+	return nil
+}
+
+// MarshalYAML writes the size with units.
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	return b.String(), nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// VirtualHost is a domain served on the proxy listeners with its own
+// certificate, selected by the server name (SNI) of the TLS handshake, and
+// optionally its own upstreams.
+type VirtualHost struct {
+	Name string `yaml:"name"`
+	// Hosts are the server names: exact, or "*.example.com"
+	Hosts []string `yaml:"hosts"`
+	// Certificate and key, as file paths or secret references like
+	// TLS_CERT_PATH
+	CertPath string `yaml:"cert_path"`
+	KeyPath  string `yaml:"key_path"`
+	// Upstreams of the hosts' requests; empty uses the default upstreams
+	Upstreams []string `yaml:"upstreams"`
+}
+
+// VirtualHostsRouted reports whether every virtual host has upstreams of
+// its own, so no default upstream is needed.
+func (c *Config) VirtualHostsRouted() bool {
+	for _, v := range c.VirtualHosts {
+		if len(v.Upstreams) == 0 {
+			return false
+		}
+	}
+	return len(c.VirtualHosts) > 0
+}
+
+// validateVirtualHosts checks that virtual hosts are named, have a
+// certificate, and that every server name selects at most one of them.
+func validateVirtualHosts(cfg *Config) error {
+	names := make(map[string]bool)
+	hosts := make(map[string]string)
+	for _, v := range cfg.VirtualHosts {
+		if v.Name == "" || names[v.Name] {
+			return fmt.Errorf("virtual host %q: names must be set and unique", v.Name)
+		}
+		names[v.Name] = true
+
+		if len(v.Hosts) == 0 {
+			return fmt.Errorf("virtual host %q: hosts are required", v.Name)
+		}
+		for _, host := range v.Hosts {
+			host = strings.ToLower(host)
+			if host == "" || strings.ContainsAny(host, ":/") || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+				return fmt.Errorf("virtual host %q: host must be a name or *.suffix, got %q", v.Name, host)
+			}
+			if other, ok := hosts[host]; ok {
+				return fmt.Errorf("virtual host %q: host %q already belongs to virtual host %q", v.Name, host, other)
+			}
+			hosts[host] = v.Name
+		}
+		if v.CertPath == "" || v.KeyPath == "" {
+			return fmt.Errorf("virtual host %q: cert_path and key_path are required", v.Name)
+		}
+		for _, upstream := range v.Upstreams {
+			u, err := url.Parse(upstream)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("virtual host %q: upstream must be an http(s) URL, got %q", v.Name, upstream)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var connectionsRejected = metrics.NewCounterVec("aegis_connections_rejected_total",
+	"Connections closed by connection limits, by reason: max_connections, max_per_ip or slow_transfer.", "reason")
+
+// connLimiter caps the connections open across the proxy listeners, in total
+// and per client IP, so a flood of connections is shed at accept time, before
+// any TLS handshake or HTTP parsing is spent on it.
+type connLimiter struct {
+	max, perIP int // 0 is unlimited
+	open       atomic.Int64
+
+	mu   sync.Mutex
+	byIP map[string]int
+}
+
+// newConnLimiter returns nil when neither limit is set.
+func newConnLimiter(max, perIP int) *connLimiter {
+	if max <= 0 && perIP <= 0 {
+		return nil
+	}
+	l := &connLimiter{max: max, perIP: perIP, byIP: make(map[string]int)}
+	metrics.NewGaugeFunc("aegis_open_connections", "Connections open on the proxy listeners.",
+		func() float64 { return float64(l.open.Load()) })
+	return l
+}
+
+// acquire admits a connection from ip, reporting why when it doesn't.
+func (l *connLimiter) acquire(ip string) (string, bool) {
+	if open := l.open.Add(1); l.max > 0 && open > int64(l.max) {
+		l.open.Add(-1)
+		return "max_connections", false
+	}
+	if l.perIP > 0 {
+		l.mu.Lock()
+		if l.byIP[ip] >= l.perIP {
+			l.mu.Unlock()
+			l.open.Add(-1)
+			return "max_per_ip", false
+		}
+		l.byIP[ip]++
+		l.mu.Unlock()
+	}
+	return "", true
+}
+
+// release frees a connection admitted by acquire.
+func (l *connLimiter) release(ip string) {
+	l.open.Add(-1)
+	if l.perIP > 0 {
+		l.mu.Lock()
+		if l.byIP[ip]--; l.byIP[ip] <= 0 {
+			delete(l.byIP, ip)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// wrap applies the limits to the connections ln accepts.
+func (l *connLimiter) wrap(ln net.Listener) net.Listener {
+	if l == nil {
+		return ln
+	}
+	return &limitListener{Listener: ln, limiter: l}
+}
+
+// limitListener closes connections over the limits as soon as they are
+// accepted, rather than leaving them in the kernel's backlog.
+type limitListener struct {
+	net.Listener
+	limiter *connLimiter
+}
+
+func (ln *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if reason, ok := ln.limiter.acquire(ip); !ok {
+			connectionsRejected.Inc(reason)
+			logging.Debugf("[Connections] Refused connection from %s: %s", ip, reason)
+			conn.Close()
+			continue
+		}
+		return &limitConn{Conn: conn, limiter: ln.limiter, ip: ip}, nil
+	}
+}
+
+// limitConn releases its slot once, however often it is closed.
+type limitConn struct {
+	net.Conn
+	limiter *connLimiter
+	ip      string
+	once    sync.Once
+}
+
+func (c *limitConn) Close() error {
+	c.once.Do(func() { c.limiter.release(c.ip) })
+	return c.Conn.Close()
+}
+
+// minTransferRate fails request bodies that arrive slower than rate bytes
+// per second on average once grace has passed, so a client can't hold a
+// connection by trickling a body. Headers are bounded by the server's
+// ReadHeaderTimeout, and a body that stalls entirely by its ReadTimeout.
+func minTransferRate(next http.Handler, rate int64, grace time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = &rateBody{ReadCloser: r.Body, w: w, rate: rate, grace: grace, start: time.Now(), remote: r.RemoteAddr}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var errTransferTooSlow = errors.New("request body below the minimum transfer rate")
+
+// rateBody checks the average rate of a request body as it is read.
+type rateBody struct {
+	io.ReadCloser
+	w      http.ResponseWriter
+	rate   int64
+	grace  time.Duration
+	start  time.Time
+	remote string
+	read   int64
+	slow   bool
+}
+
+func (b *rateBody) Read(p []byte) (int, error) {
+	if b.slow {
+		return 0, errTransferTooSlow
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err == nil {
+		if elapsed := time.Since(b.start); elapsed > b.grace && float64(b.read) < float64(b.rate)*elapsed.Seconds() {
+			b.slow = true
+			connectionsRejected.Inc("slow_transfer")
+			logging.Infof("[Connections] Closing connection from %s: %d bytes of body in %v", b.remote, b.read, elapsed.Round(time.Millisecond))
+			// Fail the connection's reads, so it is closed after this request
+			http.NewResponseController(b.w).SetReadDeadline(time.Now())
+			return n, errTransferTooSlow
+		}
+	}
+	return n, err
+}
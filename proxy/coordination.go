@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/cluster"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/handler"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// newCoordinator connects this replica to the others through Redis: blocks
+// and upstream drains made here are announced to them and theirs applied
+// here, and the given rate limiters count consumption fleet-wide.
+func newCoordinator(cfg *config.Config, client *redis.Client, recent *middleware.RecentBlocks, proxyHandler *handler.ProxyHandler, limiters map[string]*middleware.RateLimiter) *cluster.Coordinator {
+	coord := cluster.New(client, cluster.Options{
+		Node:         cfg.ClusterNode,
+		Prefix:       cfg.ClusterKeyPrefix,
+		SyncInterval: cfg.ClusterSyncInterval.Std(),
+	})
+
+	recent.OnBlock = func(key string, ttl time.Duration) {
+		coord.Publish(cluster.Event{Kind: cluster.EventBlock, Key: key, TTLSeconds: int64(ttl.Seconds())})
+	}
+	recent.OnUnblock = func(key string) {
+		coord.Publish(cluster.Event{Kind: cluster.EventUnblock, Key: key})
+	}
+	coord.Subscribe(cluster.EventBlock, func(e cluster.Event) {
+		recent.Add(e.Key, time.Duration(e.TTLSeconds)*time.Second)
+	})
+	coord.Subscribe(cluster.EventUnblock, func(e cluster.Event) {
+		recent.Remove(e.Key)
+	})
+	coord.Subscribe(cluster.EventDrain, func(e cluster.Event) {
+		if err := proxyHandler.Drain(e.Key, e.Draining); err != nil {
+			log.Printf("[Cluster] Can't apply drain of %s from %s: %v", e.Key, e.Node, err)
+		}
+	})
+
+	for name, limiter := range limiters {
+		if limiter != nil {
+			coord.ShareLimiter(name, limiter)
+		}
+	}
+	return coord
+}
+
+// clusterUpstreams announces upstream drains made through the admin API, so
+// a backend deploy drains the upstream on every replica.
+type clusterUpstreams struct {
+	*handler.ProxyHandler
+	coord *cluster.Coordinator
+}
+
+func (u clusterUpstreams) Drain(name string, draining bool) error {
+	if err := u.ProxyHandler.Drain(name, draining); err != nil {
+		return err
+	}
+	u.coord.Publish(cluster.Event{Kind: cluster.EventDrain, Key: name, Draining: draining})
+	return nil
+}
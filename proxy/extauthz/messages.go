@@ -0,0 +1,178 @@
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+)
+
+// httpRequest rebuilds the request Envoy is checking. The peer certificate
+// is only passed on as verified if it chains to roots.
+func httpRequest(ctx context.Context, check *authv3.CheckRequest, roots *x509.CertPool) (*http.Request, error) {
+	attrs := check.GetAttributes()
+	h := attrs.GetRequest().GetHttp()
+
+	target := h.GetPath()
+	if target == "" {
+		target = "/"
+	}
+	u, err := url.ParseRequestURI(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path %q: %w", target, err)
+	}
+	method := h.GetMethod()
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	req := &http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      h.GetProtocol(),
+		Header:     requestHeaders(h),
+		Host:       h.GetHost(),
+		RequestURI: target,
+		Body:       http.NoBody,
+	}
+	switch h.GetProtocol() {
+	case "HTTP/2":
+		req.ProtoMajor = 2
+	case "HTTP/3":
+		req.ProtoMajor = 3
+	default:
+		var ok bool
+		if req.ProtoMajor, req.ProtoMinor, ok = http.ParseHTTPVersion(h.GetProtocol()); !ok {
+			req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.1", 1, 1
+		}
+	}
+	if addr := attrs.GetSource().GetAddress().GetSocketAddress(); addr.GetAddress() != "" {
+		req.RemoteAddr = net.JoinHostPort(addr.GetAddress(), strconv.FormatUint(uint64(addr.GetPortValue()), 10))
+	}
+	body := h.GetRawBody()
+	if len(body) == 0 {
+		// body (UTF-8) or raw_body, depending on pack_as_bytes
+		body = []byte(h.GetBody())
+	}
+	if len(body) > 0 {
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	if encoded := attrs.GetSource().GetCertificate(); encoded != "" {
+		cert, err := parseCertificate(encoded)
+		if err != nil {
+			return nil, err
+		}
+		req.TLS = &tls.ConnectionState{
+			HandshakeComplete: true,
+			PeerCertificates:  []*x509.Certificate{cert},
+		}
+		// Envoy says it verified the certificate, but only a chain to our
+		// own client CAs makes it count as mTLS for the stages
+		if roots != nil {
+			chains, err := cert.Verify(x509.VerifyOptions{
+				Roots:     roots,
+				KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+			if err == nil {
+				req.TLS.VerifiedChains = chains
+			} else {
+				logging.For(ctx).Debugf("[ExtAuthz] Peer certificate of %s not verified: %v", req.RemoteAddr, err)
+			}
+		}
+	} else if h.GetScheme() == "https" {
+		req.TLS = &tls.ConnectionState{HandshakeComplete: true}
+	}
+	return req.WithContext(ctx), nil
+}
+
+// requestHeaders reads the request's headers, which come either as the
+// headers map or, with encode_raw_headers, as header_map.
+func requestHeaders(h *authv3.AttributeContext_HttpRequest) http.Header {
+	header := make(http.Header)
+	for key, value := range h.GetHeaders() {
+		addHeader(header, key, value)
+	}
+	for _, hv := range h.GetHeaderMap().GetHeaders() {
+		value := hv.GetValue()
+		if raw := hv.GetRawValue(); len(raw) > 0 {
+			value = string(raw)
+		}
+		addHeader(header, hv.GetKey(), value)
+	}
+	return header
+}
+
+// addHeader keeps regular headers; pseudo-headers and Host are carried by
+// their own fields.
+func addHeader(header http.Header, key, value string) {
+	if key == "" || strings.HasPrefix(key, ":") || strings.EqualFold(key, "host") {
+		return
+	}
+	header.Add(key, value)
+}
+
+// headerOptions converts header to HeaderValueOptions. With overwrite, the
+// first value of each header replaces what the request has and the others
+// are appended.
+func headerOptions(header http.Header, overwrite bool) []*corev3.HeaderValueOption {
+	var options []*corev3.HeaderValueOption
+	for key, values := range header {
+		for i, value := range values {
+			option := &corev3.HeaderValueOption{
+				Header: &corev3.HeaderValue{Key: strings.ToLower(key), Value: value},
+			}
+			if overwrite && i == 0 {
+				option.AppendAction = corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD
+			}
+			options = append(options, option)
+		}
+	}
+	return options
+}
+
+// okResponse builds a CheckResponse allowing the request. Envoy sets
+// headers on the request and removes the ones listed before forwarding it,
+// and adds responseHeaders to the upstream's response.
+func okResponse(headers http.Header, remove []string, responseHeaders http.Header) *authv3.CheckResponse {
+	for i, key := range remove {
+		remove[i] = strings.ToLower(key)
+	}
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(codes.OK)},
+		HttpResponse: &authv3.CheckResponse_OkResponse{OkResponse: &authv3.OkHttpResponse{
+			Headers:              headerOptions(headers, true),
+			HeadersToRemove:      remove,
+			ResponseHeadersToAdd: headerOptions(responseHeaders, false),
+		}},
+	}
+}
+
+// deniedResponse builds a CheckResponse refusing the request with the
+// response the decision chain wrote.
+func deniedResponse(code int, headers http.Header, body []byte) *authv3.CheckResponse {
+	return &authv3.CheckResponse{
+		Status: &status.Status{Code: int32(codes.PermissionDenied)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{DeniedResponse: &authv3.DeniedHttpResponse{
+			Status:  &typev3.HttpStatus{Code: typev3.StatusCode(code)},
+			Headers: headerOptions(headers, false),
+			Body:    string(body),
+		}},
+	}
+}
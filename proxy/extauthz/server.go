@@ -0,0 +1,166 @@
+// Package extauthz serves the proxy's decision chain as an Envoy external
+// authorization service (envoy.service.auth.v3.Authorization), so meshes
+// already running Envoy or Istio can use the blocklist, JWT and risk scoring
+// without putting the proxy in the data path.
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+// maxDeniedBody bounds the response body returned with a denial.
+const maxDeniedBody = 64 << 10
+
+var checks = metrics.NewCounterVec("aegis_extauthz_checks_total",
+	"ext_authz checks by result (allowed, denied or error).", "result")
+
+type verdictKey struct{}
+
+// verdict records whether a request reached the end of the chain, and its
+// headers once every stage has run.
+type verdict struct {
+	allowed bool
+	header  http.Header
+}
+
+// Allow ends the decision chain: requests reaching it are allowed.
+var Allow http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if v, ok := r.Context().Value(verdictKey{}).(*verdict); ok {
+		v.allowed = true
+		v.header = r.Header.Clone()
+	}
+})
+
+// Server answers Check calls by running the request they describe through
+// the decision chain, which must end with Allow. Requests reaching Allow
+// are allowed, with the headers the stages set or removed, such as the risk
+// score, applied by Envoy before forwarding them. Requests a stage answers
+// itself are denied with that stage's response.
+type Server struct {
+	authv3.UnimplementedAuthorizationServer
+
+	chain     http.Handler
+	clientCAs func() *x509.CertPool
+	grpc      *grpc.Server
+}
+
+// NewServer creates a server for chain. Peer certificates Envoy sends are
+// verified against the pool clientCAs returns, which may be nil, before the
+// stages see them as verified.
+func NewServer(chain http.Handler, clientCAs func() *x509.CertPool) *Server {
+	s := &Server{chain: chain, clientCAs: clientCAs, grpc: grpc.NewServer()}
+	authv3.RegisterAuthorizationServer(s.grpc, s)
+	return s
+}
+
+// ServeHTTP handles gRPC calls, which arrive as HTTP/2 POST requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.grpc.ServeHTTP(w, r)
+}
+
+// Check implements authv3.AuthorizationServer.
+func (s *Server) Check(ctx context.Context, check *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	var roots *x509.CertPool
+	if s.clientCAs != nil {
+		roots = s.clientCAs()
+	}
+	req, err := httpRequest(ctx, check, roots)
+	if err != nil {
+		checks.Inc("error")
+		return nil, grpcstatus.Error(codes.InvalidArgument, err.Error())
+	}
+	return s.check(req), nil
+}
+
+// check runs req through the chain and builds the resulting CheckResponse.
+func (s *Server) check(req *http.Request) *authv3.CheckResponse {
+	v := &verdict{}
+	before := req.Header.Clone()
+	rec := &recorder{header: make(http.Header)}
+	s.chain.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), verdictKey{}, v)))
+
+	if v.allowed && !rec.wrote {
+		checks.Inc("allowed")
+		set := make(http.Header)
+		for key, values := range v.header {
+			if !slices.Equal(before[key], values) {
+				set[key] = values
+			}
+		}
+		var remove []string
+		for key := range before {
+			if _, ok := v.header[key]; !ok {
+				remove = append(remove, key)
+			}
+		}
+		return okResponse(set, remove, rec.header)
+	}
+
+	checks.Inc("denied")
+	status := rec.status
+	if !rec.wrote {
+		// A stage that neither allowed nor answered the request
+		status = http.StatusForbidden
+	}
+	logging.For(req.Context()).Debugf("[ExtAuthz] Denied %s %s%s from %s: %d", req.Method, req.Host, req.URL.Path, req.RemoteAddr, status)
+	return deniedResponse(status, rec.header, rec.body.Bytes())
+}
+
+// parseCertificate decodes the URL-encoded PEM certificate Envoy sends.
+func parseCertificate(encoded string) (*x509.Certificate, error) {
+	data, err := url.QueryUnescape(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer certificate: %w", err)
+	}
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, fmt.Errorf("invalid peer certificate: no PEM data")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// recorder captures the response a stage writes instead of allowing the
+// request.
+type recorder struct {
+	header http.Header
+	status int
+	wrote  bool
+	body   bytes.Buffer
+}
+
+func (r *recorder) Header() http.Header { return r.header }
+
+func (r *recorder) WriteHeader(status int) {
+	if !r.wrote {
+		r.status, r.wrote = status, true
+	}
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	if room := maxDeniedBody - r.body.Len(); room > 0 {
+		r.body.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+func (r *recorder) Flush() {}
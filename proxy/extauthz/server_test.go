@@ -0,0 +1,221 @@
+package extauthz
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// chain denies requests with X-Deny, and otherwise sets X-Aegis-Risk-Score
+// and removes X-Internal before allowing them.
+var chain = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Deny") != "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("slow down"))
+		return
+	}
+	r.Header.Set("X-Aegis-Risk-Score", "0.10")
+	r.Header.Del("X-Internal")
+	Allow.ServeHTTP(w, r)
+})
+
+// serve runs s on an h2c listener, as an extauthz listener does, and returns
+// a client for it.
+func serve(t *testing.T, s *Server) authv3.AuthorizationClient {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: s, Protocols: new(http.Protocols)}
+	server.Protocols.SetUnencryptedHTTP2(true)
+	go server.Serve(ln)
+	t.Cleanup(func() { server.Close() })
+
+	conn, err := grpc.NewClient(ln.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return authv3.NewAuthorizationClient(conn)
+}
+
+func checkRequest(headers map[string]string) *authv3.CheckRequest {
+	return &authv3.CheckRequest{Attributes: &authv3.AttributeContext{
+		Source: &authv3.AttributeContext_Peer{Address: &corev3.Address{Address: &corev3.Address_SocketAddress{
+			SocketAddress: &corev3.SocketAddress{Address: "10.0.0.7", PortSpecifier: &corev3.SocketAddress_PortValue{PortValue: 5123}},
+		}}},
+		Request: &authv3.AttributeContext_Request{Http: &authv3.AttributeContext_HttpRequest{
+			Method:   "GET",
+			Path:     "/orders?page=2",
+			Host:     "api.example.com",
+			Protocol: "HTTP/1.1",
+			Headers:  headers,
+		}},
+	}}
+}
+
+func TestCheck(t *testing.T) {
+	client := serve(t, NewServer(chain, nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Check(ctx, checkRequest(map[string]string{":path": "/orders", "x-internal": "1", "accept": "*/*"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetStatus().GetCode() != int32(codes.OK) {
+		t.Fatalf("status = %d, want OK", resp.GetStatus().GetCode())
+	}
+	ok := resp.GetOkResponse()
+	if len(ok.GetHeaders()) != 1 {
+		t.Fatalf("headers = %v, want only the risk score", ok.GetHeaders())
+	}
+	set := ok.GetHeaders()[0]
+	if set.GetHeader().GetKey() != "x-aegis-risk-score" || set.GetHeader().GetValue() != "0.10" || set.GetAppendAction() != corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD {
+		t.Errorf("header = %v, want x-aegis-risk-score: 0.10 overwriting", set)
+	}
+	if remove := ok.GetHeadersToRemove(); len(remove) != 1 || remove[0] != "x-internal" {
+		t.Errorf("headers to remove = %v, want [x-internal]", remove)
+	}
+
+	resp, err = client.Check(ctx, checkRequest(map[string]string{"x-deny": "1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetStatus().GetCode() != int32(codes.PermissionDenied) {
+		t.Fatalf("status = %d, want PermissionDenied", resp.GetStatus().GetCode())
+	}
+	denied := resp.GetDeniedResponse()
+	if denied.GetStatus().GetCode() != http.StatusTooManyRequests || denied.GetBody() != "slow down" {
+		t.Errorf("denied = %d %q, want 429 \"slow down\"", denied.GetStatus().GetCode(), denied.GetBody())
+	}
+	if len(denied.GetHeaders()) != 1 || denied.GetHeaders()[0].GetHeader().GetKey() != "content-type" {
+		t.Errorf("denied headers = %v, want content-type", denied.GetHeaders())
+	}
+}
+
+func TestCheckInvalidPath(t *testing.T) {
+	client := serve(t, NewServer(chain, nil))
+	check := checkRequest(nil)
+	check.Attributes.Request.Http.Path = "orders"
+	_, err := client.Check(context.Background(), check)
+	if err == nil {
+		t.Fatal("Check of a relative path succeeded")
+	}
+}
+
+func TestRequestFields(t *testing.T) {
+	check := checkRequest(nil)
+	h := check.Attributes.Request.Http
+	h.Protocol = "HTTP/2"
+	h.RawBody = []byte(`{"id":1}`)
+	h.HeaderMap = &corev3.HeaderMap{Headers: []*corev3.HeaderValue{
+		{Key: "x-raw", RawValue: []byte("raw")},
+		{Key: "host", Value: "other.example.com"},
+		{Key: ":authority", Value: "other.example.com"},
+	}}
+	req, err := httpRequest(context.Background(), check, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.RemoteAddr != "10.0.0.7:5123" || req.Host != "api.example.com" || req.URL.RawQuery != "page=2" || req.ProtoMajor != 2 {
+		t.Errorf("request = %s %s %s HTTP/%d", req.RemoteAddr, req.Host, req.URL, req.ProtoMajor)
+	}
+	if req.ContentLength != 8 {
+		t.Errorf("content length = %d, want 8", req.ContentLength)
+	}
+	if len(req.Header) != 1 || req.Header.Get("X-Raw") != "raw" {
+		t.Errorf("headers = %v, want only X-Raw", req.Header)
+	}
+}
+
+func TestPeerCertificate(t *testing.T) {
+	ca, caKey := newCertificate(t, "aegis CA", nil, nil)
+	client, _ := newCertificate(t, "orders", ca, caKey)
+	stranger, _ := newCertificate(t, "orders", nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tests := []struct {
+		name     string
+		cert     *x509.Certificate
+		roots    *x509.CertPool
+		verified bool
+	}{
+		{"issued by the client CA", client, roots, true},
+		{"issued by another CA", stranger, roots, false},
+		{"no client CA", client, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := checkRequest(nil)
+			pemCert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tt.cert.Raw})
+			check.Attributes.Source.Certificate = url.QueryEscape(string(pemCert))
+			req, err := httpRequest(context.Background(), check, tt.roots)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if req.TLS == nil || len(req.TLS.PeerCertificates) != 1 || !req.TLS.PeerCertificates[0].Equal(tt.cert) {
+				t.Fatal("peer certificate not passed on")
+			}
+			if verified := len(req.TLS.VerifiedChains) > 0; verified != tt.verified {
+				t.Errorf("verified = %v, want %v", verified, tt.verified)
+			}
+		})
+	}
+
+	check := checkRequest(nil)
+	check.Attributes.Source.Certificate = "not a certificate"
+	if _, err := httpRequest(context.Background(), check, roots); err == nil {
+		t.Error("invalid certificate accepted")
+	}
+}
+
+// newCertificate creates a client certificate for cn, signed by parent, or
+// a CA certificate signing itself when parent is nil.
+func newCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"crypto/fips140"
+	"fmt"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var fipsActive = metrics.NewGaugeVec("aegis_fips_enabled",
+	"1 if a FIPS 140 crypto module is active, by module: boringcrypto, go-fips140 or none.", "module")
+
+// fipsStatus is the FIPS compliance of the running binary, reported by
+// /health and logged at startup.
+type fipsStatus struct {
+	Mode    bool   `json:"mode"`    // FIPS_MODE, the fips preset or the fips build tag
+	Build   bool   `json:"build"`   // Built with the fips tag
+	Module  string `json:"module"`  // "boringcrypto", "go-fips140" or "none"
+	Enabled bool   `json:"enabled"` // Whether the module is active
+}
+
+// fips is the status found at startup.
+var fips fipsStatus
+
+// checkFIPS finds the crypto module the binary runs with. In FIPS mode,
+// running without one is an error: BoringCrypto builds
+// (GOEXPERIMENT=boringcrypto) always use theirs, and Go's own module needs
+// GOFIPS140 at build time or GODEBUG=fips140=on.
+func checkFIPS(cfg *config.Config) (fipsStatus, error) {
+	status := fipsStatus{Mode: cfg.FIPSMode, Build: config.FIPSBuild, Module: "none"}
+	switch {
+	case boringEnabled():
+		status.Module, status.Enabled = "boringcrypto", true
+	case fips140.Enabled():
+		status.Module, status.Enabled = "go-fips140", true
+	}
+	fipsActive.Set(1, status.Module)
+	if status.Mode && !status.Enabled {
+		return status, fmt.Errorf("FIPS mode requires a FIPS 140 crypto module: build with GOFIPS140=v1.0.0 or GOEXPERIMENT=boringcrypto, or run with GODEBUG=fips140=on")
+	}
+	return status, nil
+}
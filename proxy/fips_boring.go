@@ -0,0 +1,16 @@
+//go:build boringcrypto
+
+package main
+
+import (
+	"crypto/boring"
+
+	// Restricts every TLS config, clients' included, to FIPS-approved
+	// versions, ciphers and curves
+	_ "crypto/tls/fipsonly"
+)
+
+// boringEnabled reports whether BoringCrypto is handling crypto operations.
+func boringEnabled() bool {
+	return boring.Enabled()
+}
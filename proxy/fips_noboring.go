@@ -0,0 +1,8 @@
+//go:build !boringcrypto
+
+package main
+
+// boringEnabled reports whether BoringCrypto is handling crypto operations.
+func boringEnabled() bool {
+	return false
+}
@@ -0,0 +1,232 @@
+// Package geoip locates client addresses with MaxMind's GeoLite2 (or
+// GeoIP2) databases in their CSV edition: the City blocks for coordinates
+// and the ASN blocks for networks' operators. Files are indexed in memory
+// at startup; lookups are a binary search, so the networks of a file must
+// not overlap, as in MaxMind's.
+package geoip
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// Record is what the databases know about an address. Fields a database
+// doesn't carry are zero.
+type Record struct {
+	Latitude     float64
+	Longitude    float64
+	HasLocation  bool
+	ASN          uint32
+	Organization string
+}
+
+// DB holds the networks of one or more block files.
+type DB struct {
+	tables []*table
+}
+
+// table is one file's networks, sorted by start address.
+type table struct {
+	v4      []rangeV4
+	v6      []rangeV6
+	records []Record
+}
+
+type rangeV4 struct {
+	start, end uint32
+	record     int32
+}
+
+type rangeV6 struct {
+	start, end [16]byte
+	record     int32
+}
+
+// Open indexes the block files at paths. Lookups merge what each of them
+// knows, so a City and an ASN file can be used together.
+func Open(paths ...string) (*DB, error) {
+	db := &DB{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		t, err := readTable(bufio.NewReaderSize(f, 1<<20))
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		db.tables = append(db.tables, t)
+	}
+	return db, nil
+}
+
+// readTable reads a blocks CSV by its header: network, and latitude and
+// longitude or autonomous_system_number and autonomous_system_organization.
+func readTable(r io.Reader) (*table, error) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	cols := map[string]int{}
+	for i, name := range header {
+		cols[name] = i
+	}
+	network, ok := cols["network"]
+	if !ok {
+		return nil, fmt.Errorf("no network column")
+	}
+	lat, hasLat := cols["latitude"]
+	lon, hasLon := cols["longitude"]
+	asn, hasASN := cols["autonomous_system_number"]
+	org, hasOrg := cols["autonomous_system_organization"]
+	if !(hasLat && hasLon) && !hasASN {
+		return nil, fmt.Errorf("neither latitude and longitude nor autonomous_system_number columns")
+	}
+
+	t := &table{}
+	seen := map[Record]int32{}
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		prefix, err := netip.ParsePrefix(row[network])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		var rec Record
+		if hasLat && hasLon && row[lat] != "" && row[lon] != "" {
+			rec.Latitude, _ = strconv.ParseFloat(row[lat], 64)
+			rec.Longitude, _ = strconv.ParseFloat(row[lon], 64)
+			rec.HasLocation = true
+		}
+		if hasASN && row[asn] != "" {
+			n, _ := strconv.ParseUint(row[asn], 10, 32)
+			rec.ASN = uint32(n)
+		}
+		if hasOrg {
+			rec.Organization = row[org]
+		}
+		if !rec.HasLocation && rec.ASN == 0 {
+			continue
+		}
+		index, ok := seen[rec]
+		if !ok {
+			index = int32(len(t.records))
+			t.records = append(t.records, rec)
+			seen[rec] = index
+		}
+
+		prefix = prefix.Masked()
+		first, last := prefix.Addr(), lastAddr(prefix)
+		if first.Is4() {
+			t.v4 = append(t.v4, rangeV4{v4(first), v4(last), index})
+		} else {
+			t.v6 = append(t.v6, rangeV6{first.As16(), last.As16(), index})
+		}
+	}
+	sort.Slice(t.v4, func(i, j int) bool { return t.v4[i].start < t.v4[j].start })
+	sort.Slice(t.v6, func(i, j int) bool { return lessV6(t.v6[i].start, t.v6[j].start) })
+	return t, nil
+}
+
+// Lookup returns what the databases know about ip.
+func (db *DB) Lookup(ip netip.Addr) (Record, bool) {
+	ip = ip.Unmap()
+	var rec Record
+	found := false
+	for _, t := range db.tables {
+		r, ok := t.lookup(ip)
+		if !ok {
+			continue
+		}
+		found = true
+		if r.HasLocation {
+			rec.Latitude, rec.Longitude, rec.HasLocation = r.Latitude, r.Longitude, true
+		}
+		if r.ASN != 0 {
+			rec.ASN, rec.Organization = r.ASN, r.Organization
+		}
+	}
+	return rec, found
+}
+
+// Networks returns the number of networks indexed.
+func (db *DB) Networks() int {
+	n := 0
+	for _, t := range db.tables {
+		n += len(t.v4) + len(t.v6)
+	}
+	return n
+}
+
+func (t *table) lookup(ip netip.Addr) (Record, bool) {
+	if ip.Is4() {
+		addr := v4(ip)
+		i := sort.Search(len(t.v4), func(i int) bool { return t.v4[i].start > addr }) - 1
+		if i >= 0 && addr <= t.v4[i].end {
+			return t.records[t.v4[i].record], true
+		}
+		return Record{}, false
+	}
+	addr := ip.As16()
+	i := sort.Search(len(t.v6), func(i int) bool { return lessV6(addr, t.v6[i].start) }) - 1
+	if i >= 0 && !lessV6(t.v6[i].end, addr) {
+		return t.records[t.v6[i].record], true
+	}
+	return Record{}, false
+}
+
+// DistanceKm is the great-circle distance between two points, in km.
+func DistanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	const earthRadius = 6371.0
+	rad := math.Pi / 180
+	dLat, dLon := (lat2-lat1)*rad, (lon2-lon1)*rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+func v4(ip netip.Addr) uint32 {
+	b := ip.As4()
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// lastAddr returns the last address of prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().As16()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	for i := bits; i < 128; i++ {
+		b[i/8] |= 1 << (7 - i%8)
+	}
+	addr := netip.AddrFrom16(b)
+	if prefix.Addr().Is4() {
+		return addr.Unmap()
+	}
+	return addr
+}
+
+func lessV6(a, b [16]byte) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
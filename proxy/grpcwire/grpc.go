@@ -0,0 +1,93 @@
+package grpcwire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gRPC and google.rpc.Status codes used by the services.
+const (
+	CodeOK                = 0
+	CodeInvalidArgument   = 3
+	CodePermissionDenied  = 7
+	CodeResourceExhausted = 8
+	CodeUnimplemented     = 12
+	CodeUnavailable       = 14
+	CodeUnauthenticated   = 16
+)
+
+// MaxMessage is gRPC's default limit on received messages.
+const MaxMessage = 4 << 20
+
+// IsRequest reports whether r is a gRPC call: an HTTP/2 POST with a gRPC
+// content type.
+func IsRequest(r *http.Request) bool {
+	return r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// ReadMessage reads one length-prefixed gRPC message, returning the status
+// code to fail the call with on error. At the end of a client stream it
+// returns an error wrapping io.EOF.
+func ReadMessage(body io.Reader) ([]byte, int, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, CodeInvalidArgument, fmt.Errorf("reading message: %w", err)
+	}
+	if prefix[0] != 0 {
+		return nil, CodeUnimplemented, fmt.Errorf("compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > MaxMessage {
+		return nil, CodeResourceExhausted, fmt.Errorf("message of %d bytes exceeds %d", size, MaxMessage)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, CodeInvalidArgument, fmt.Errorf("reading message: %w", err)
+	}
+	return msg, CodeOK, nil
+}
+
+// WriteMessage answers a call with msg and an OK status in the trailers.
+func WriteMessage(w http.ResponseWriter, msg []byte) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.WriteHeader(http.StatusOK)
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	w.Write(prefix[:])
+	w.Write(msg)
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+}
+
+// WriteStatus fails a call with a trailers-only response.
+func WriteStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	w.Header().Set("Grpc-Message", url.PathEscape(message))
+	w.WriteHeader(http.StatusOK)
+}
+
+// ParseTimeout reads a grpc-timeout header, e.g. 250m for 250ms.
+func ParseTimeout(value string) (time.Duration, bool) {
+	if len(value) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value[:len(value)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	unit, ok := units[value[len(value)-1]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
@@ -0,0 +1,114 @@
+// Package grpcwire serves gRPC methods over the standard library's HTTP/2
+// server, with a minimal protobuf wire format codec covering the fields
+// the services use, so no generated code or gRPC library is needed.
+package grpcwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Wire types.
+const (
+	WireVarint  = 0
+	WireFixed64 = 1
+	WireBytes   = 2
+	WireFixed32 = 5
+)
+
+// ErrMalformed is returned for messages that can't be decoded.
+var ErrMalformed = errors.New("malformed protobuf message")
+
+// Field is a field read from a message. Length-delimited fields (strings,
+// bytes, messages and map entries) are in Bytes, fixed-size ones in Fixed.
+type Field struct {
+	Num    int
+	Wire   int
+	Varint uint64
+	Fixed  uint64
+	Bytes  []byte
+}
+
+// Double returns a double field's value.
+func (f Field) Double() float64 {
+	return math.Float64frombits(f.Fixed)
+}
+
+// ReadFields calls fn with each field of msg, in order.
+func ReadFields(msg []byte, fn func(f Field) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return ErrMalformed
+		}
+		msg = msg[n:]
+		f := Field{Num: int(key >> 3), Wire: int(key & 7)}
+		switch f.Wire {
+		case WireVarint:
+			f.Varint, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return ErrMalformed
+			}
+			msg = msg[n:]
+		case WireFixed64:
+			if len(msg) < 8 {
+				return ErrMalformed
+			}
+			f.Fixed = binary.LittleEndian.Uint64(msg)
+			msg = msg[8:]
+		case WireBytes:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return ErrMalformed
+			}
+			f.Bytes = msg[n : n+int(size)]
+			msg = msg[n+int(size):]
+		case WireFixed32:
+			if len(msg) < 4 {
+				return ErrMalformed
+			}
+			f.Fixed = uint64(binary.LittleEndian.Uint32(msg))
+			msg = msg[4:]
+		default:
+			// Groups are deprecated and unused by the APIs
+			return ErrMalformed
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadMapEntry returns the key and value of a map<string, string> entry.
+func ReadMapEntry(entry []byte) (key, value string, err error) {
+	err = ReadFields(entry, func(f Field) error {
+		switch {
+		case f.Num == 1 && f.Wire == WireBytes:
+			key = string(f.Bytes)
+		case f.Num == 2 && f.Wire == WireBytes:
+			value = string(f.Bytes)
+		}
+		return nil
+	})
+	return key, value, err
+}
+
+// AppendVarintField appends field num with a varint value.
+func AppendVarintField(b []byte, num int, v uint64) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|WireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// AppendBytesField appends a length-delimited field num.
+func AppendBytesField(b []byte, num int, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(num)<<3|WireBytes)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// AppendStringField appends a string field num.
+func AppendStringField(b []byte, num int, v string) []byte {
+	return AppendBytesField(b, num, []byte(v))
+}
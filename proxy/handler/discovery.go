@@ -0,0 +1,172 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var discoveryErrors = metrics.NewCounterVec("aegis_upstream_discovery_errors_total",
+	"Failed lookups of the upstream service in DNS or a registry; the last discovered upstreams are kept.")
+
+// discoveryTimeout bounds the first lookup, which the proxy waits for.
+const discoveryTimeout = 10 * time.Second
+
+// Discovery looks the upstreams up at runtime instead of configuring them.
+type Discovery interface {
+	// Resolve looks up the upstream URLs, sorted so an unchanged set
+	// compares equal
+	Resolve(ctx context.Context) ([]string, error)
+	// Run keeps the proxy's upstreams in line with the lookups until ctx
+	// is done
+	Run(ctx context.Context, p *ProxyHandler)
+	// Host is sent as Host and TLS server name to every discovered
+	// upstream; empty keeps each upstream's own address
+	Host() string
+	// String names what is looked up, for logs
+	String() string
+}
+
+// DNSDiscovery keeps the upstreams in line with DNS, so scaling a service,
+// such as a Kubernetes headless service, is followed without a restart. A
+// name starting with "_", like _http._tcp.api.default.svc.cluster.local, is
+// looked up as SRV records, taking the targets of the lowest priority; any
+// other name as A and AAAA records on the URL's port. Every address found
+// becomes an upstream, and requests keep the service's name as Host and TLS
+// server name.
+type DNSDiscovery struct {
+	scheme string
+	name   string // The name looked up
+	port   string // For A and AAAA records
+	srv    bool
+	host   string // Host header of discovered upstreams
+	ttl    time.Duration
+
+	resolver *net.Resolver
+}
+
+// NewDNSDiscovery parses the service URL, http(s)://name[:port], and the
+// time discovered upstreams are kept before the name is looked up again.
+func NewDNSDiscovery(service string, ttl time.Duration) (*DNSDiscovery, error) {
+	u, err := url.Parse(service)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, fmt.Errorf("discovery URL %q must be http(s)://name[:port]", service)
+	}
+	d := &DNSDiscovery{
+		scheme:   u.Scheme,
+		name:     u.Hostname(),
+		port:     u.Port(),
+		srv:      strings.HasPrefix(u.Hostname(), "_"),
+		host:     u.Host,
+		ttl:      ttl,
+		resolver: net.DefaultResolver,
+	}
+	if d.port == "" {
+		d.port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+	if d.srv {
+		// _service._proto.name is addressed as name
+		labels := strings.SplitN(d.name, ".", 3)
+		if len(labels) < 3 || !strings.HasPrefix(labels[1], "_") {
+			return nil, fmt.Errorf("SRV name %q must be _service._proto.name", d.name)
+		}
+		d.host = labels[2]
+	}
+	return d, nil
+}
+
+func (d *DNSDiscovery) String() string {
+	return "DNS name " + d.name
+}
+
+// Host returns the service's name.
+func (d *DNSDiscovery) Host() string {
+	return d.host
+}
+
+// Resolve looks up the upstream URLs, sorted so an unchanged set compares
+// equal.
+func (d *DNSDiscovery) Resolve(ctx context.Context) ([]string, error) {
+	var addrs []string
+	if d.srv {
+		_, records, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+		if err != nil {
+			return nil, err
+		}
+		// Records are sorted by priority; lower priorities are backups
+		for _, rec := range records {
+			if rec.Priority == records[0].Priority {
+				addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port))))
+			}
+		}
+	} else {
+		hosts, err := d.resolver.LookupHost(ctx, d.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, host := range hosts {
+			addrs = append(addrs, net.JoinHostPort(host, d.port))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no records for %s", d.name)
+	}
+
+	urls := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		urls = append(urls, d.scheme+"://"+addr)
+	}
+	slices.Sort(urls)
+	return slices.Compact(urls), nil
+}
+
+// Run looks the name up again every TTL and switches the proxy to the
+// upstreams found until ctx is done. Failed lookups keep the current
+// upstreams.
+func (d *DNSDiscovery) Run(ctx context.Context, p *ProxyHandler) {
+	ticker := time.NewTicker(d.ttl)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lookupCtx, cancel := context.WithTimeout(ctx, d.ttl)
+		urls, err := d.Resolve(lookupCtx)
+		cancel()
+		if err != nil {
+			discoveryErrors.Inc()
+			log.Printf("[Discovery] Lookup of %s failed, keeping %d upstreams: %v", d.name, len(p.upstreamURLs()), err)
+			continue
+		}
+		p.setDiscovered(d.name, urls)
+	}
+}
+
+// setDiscovered switches to the upstreams discovered for service if they
+// changed. Idle connections are closed on every change, so keep-alive
+// connections are spread over the new set rather than staying with the
+// upstreams that were there first.
+func (p *ProxyHandler) setDiscovered(service string, urls []string) {
+	current := p.upstreamURLs()
+	if slices.Equal(urls, current) {
+		return
+	}
+	if err := p.SetUpstreams(urls); err != nil {
+		discoveryErrors.Inc()
+		log.Printf("[Discovery] Rejected upstreams of %s, keeping %d: %v", service, len(current), err)
+		return
+	}
+	p.transport.CloseIdleConnections()
+	log.Printf("[Discovery] %s: %d upstreams (was %d)", service, len(urls), len(current))
+}
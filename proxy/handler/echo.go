@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxEchoLatency bounds the latency a request may ask the echo upstream for.
+const maxEchoLatency = 30 * time.Second
+
+// EchoOptions configures the echo upstream's answers.
+type EchoOptions struct {
+	Status  int // 0 answers 200
+	Latency time.Duration
+}
+
+// echoResponse describes the request the echo upstream received, after
+// the proxy's stages rewrote it.
+type echoResponse struct {
+	Method   string              `json:"method"`
+	URL      string              `json:"url"`
+	Host     string              `json:"host"`
+	Proto    string              `json:"proto"`
+	Headers  map[string][]string `json:"headers"`
+	BodySize int64               `json:"body_size"`
+	Remote   string              `json:"remote_addr"`
+	Status   int                 `json:"status"`
+	Latency  string              `json:"latency"`
+}
+
+// echoHeaders copies headers without credentials, which clients would
+// otherwise see echoed in demos and recordings.
+func echoHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range []string{"Authorization", "Cookie", "Proxy-Authorization"} {
+		if _, ok := out[name]; ok {
+			out[name] = []string{"[redacted]"}
+		}
+	}
+	return out
+}
+
+// NewEchoUpstream returns a backend answering every request with a JSON
+// description of it, so the proxy can be demonstrated and load tested
+// without a real one. A request may choose its own answer with the
+// X-Mock-Status and X-Mock-Latency headers, e.g. "503" and "250ms".
+func NewEchoUpstream(opts EchoOptions) http.Handler {
+	if opts.Status == 0 {
+		opts.Status = http.StatusOK
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status, latency := opts.Status, opts.Latency
+		if s, err := strconv.Atoi(r.Header.Get("X-Mock-Status")); err == nil && s >= 200 && s <= 599 {
+			status = s
+		}
+		if d, err := time.ParseDuration(r.Header.Get("X-Mock-Latency")); err == nil && d >= 0 {
+			latency = min(d, maxEchoLatency)
+		}
+
+		size, _ := io.Copy(io.Discard, r.Body)
+		if latency > 0 {
+			select {
+			case <-time.After(latency):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(echoResponse{
+			Method:   r.Method,
+			URL:      r.URL.RequestURI(),
+			Host:     r.Host,
+			Proto:    r.Proto,
+			Headers:  echoHeaders(r.Header),
+			BodySize: size,
+			Remote:   r.RemoteAddr,
+			Status:   status,
+			Latency:  latency.String(),
+		})
+	})
+}
@@ -0,0 +1,146 @@
+package handler
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var egressBlocked = metrics.NewCounterVec("aegis_egress_blocked_total",
+	"Upstream connections and redirects blocked by the egress policy, by reason: host, address, redirect or sni.", "reason")
+
+// EgressPolicy limits where the proxy may connect, so a changed upstream
+// list or a rebinding DNS name can't turn it into an SSRF gadget. Empty
+// lists allow anything.
+type EgressPolicy struct {
+	hosts []string // Exact names, or "*.suffix"
+	nets  []*net.IPNet
+}
+
+// NewEgressPolicy parses allowed hosts and CIDRs.
+func NewEgressPolicy(hosts, cidrs []string) (*EgressPolicy, error) {
+	e := &EgressPolicy{}
+	for _, host := range hosts {
+		e.hosts = append(e.hosts, strings.ToLower(host))
+	}
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		e.nets = append(e.nets, network)
+	}
+	return e, nil
+}
+
+// AllowsHost reports whether an upstream host name (without port) may be used.
+func (e *EgressPolicy) AllowsHost(host string) bool {
+	if len(e.hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range e.hosts {
+		if allowed == host || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsIP reports whether the proxy may connect to an address.
+func (e *EgressPolicy) AllowsIP(ip net.IP) bool {
+	if len(e.nets) == 0 {
+		return true
+	}
+	for _, network := range e.nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListsIP reports whether the CIDR allowlist names an address. Unlike
+// AllowsIP, an empty list names none.
+func (e *EgressPolicy) ListsIP(ip net.IP) bool {
+	return len(e.nets) > 0 && e.AllowsIP(ip)
+}
+
+// checkUpstream validates an upstream URL's host against the policy.
+func (e *EgressPolicy) checkUpstream(target *url.URL) error {
+	if !e.AllowsHost(target.Hostname()) {
+		egressBlocked.Inc("host")
+		return fmt.Errorf("upstream host %s is not in UPSTREAM_ALLOWED_HOSTS", target.Hostname())
+	}
+	if ip := net.ParseIP(target.Hostname()); ip != nil && !e.AllowsIP(ip) {
+		egressBlocked.Inc("address")
+		return fmt.Errorf("upstream address %s is not in UPSTREAM_ALLOWED_CIDRS", ip)
+	}
+	return nil
+}
+
+// checkSocket validates a unix socket upstream, named unix:<socket>. With
+// UPSTREAM_ALLOWED_HOSTS set, sockets must be listed by that name, so a
+// reload can't point the proxy at another local service's socket.
+func (e *EgressPolicy) checkSocket(name string) error {
+	if !e.AllowsHost(name) {
+		egressBlocked.Inc("host")
+		return fmt.Errorf("upstream socket %s is not in UPSTREAM_ALLOWED_HOSTS", name)
+	}
+	return nil
+}
+
+// control checks the resolved address of every upstream connection, after
+// DNS, so names can't be rebound to addresses outside the allowlist.
+func (e *EgressPolicy) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !e.AllowsIP(ip) {
+		egressBlocked.Inc("address")
+		log.Printf("[Proxy] Blocked connection to %s: not in UPSTREAM_ALLOWED_CIDRS", address)
+		return fmt.Errorf("connection to %s blocked by egress policy", address)
+	}
+	return nil
+}
+
+// privateRedirect reports whether an upstream response redirects the client
+// to a private, loopback or link-local destination other than the request's
+// own host. Such redirects would let a compromised or confused upstream
+// point browsers at internal services and metadata endpoints.
+func privateRedirect(resp *http.Response) (string, bool) {
+	if resp.StatusCode < 300 || resp.StatusCode > 399 {
+		return "", false
+	}
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || location.Host == "" {
+		// Relative redirects stay on the proxy's host
+		return "", false
+	}
+	host := strings.ToLower(location.Hostname())
+	if clientHost, _ := resp.Request.Context().Value(clientHostKey{}).(string); strings.EqualFold(host, hostOnly(clientHost)) {
+		return "", false
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return host, ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+	}
+	return host, host == "localhost" || strings.HasSuffix(host, ".localhost") ||
+		strings.HasSuffix(host, ".internal") || strings.HasSuffix(host, ".local")
+}
+
+// clientHostKey carries the Host the client addressed to the response hooks.
+type clientHostKey struct{}
+
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
@@ -0,0 +1,362 @@
+package handler
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var (
+	egressRequests = metrics.NewCounterVec("aegis_egress_requests_total",
+		"Outbound requests through egress listeners, by method (connect or http) and result (allowed, denied or failed).", "method", "result")
+	egressBytes = metrics.NewCounterVec("aegis_egress_tunnel_bytes_total",
+		"Bytes relayed through CONNECT tunnels, by direction (sent or received).", "direction")
+)
+
+// helloTimeout bounds the wait for a tunneled TLS client's ClientHello.
+const helloTimeout = 10 * time.Second
+
+// metadataNets are cloud metadata and platform endpoints outside the
+// link-local range, which egress never reaches: AWS's IPv6 instance
+// metadata, Alibaba Cloud's metadata and Azure's wire server.
+var metadataNets = []*net.IPNet{
+	{IP: net.ParseIP("fd00:ec2::254"), Mask: net.CIDRMask(128, 128)},
+	{IP: net.IPv4(100, 100, 100, 200).To4(), Mask: net.CIDRMask(32, 32)},
+	{IP: net.IPv4(168, 63, 129, 16).To4(), Mask: net.CIDRMask(32, 32)},
+}
+
+// ForwardOptions configures the egress proxy.
+type ForwardOptions struct {
+	// Hosts are the destinations workloads may reach: exact names or
+	// "*.suffix"
+	Hosts []string
+	// Ports are the destination ports allowed; empty allows 80 and 443
+	Ports []int
+	// CIDRs, if set, limit the addresses destinations may resolve to, and
+	// are the only literal addresses that may be requested
+	CIDRs []string
+	// AllowPrivate allows destinations resolving to private addresses,
+	// which are refused otherwise. Loopback, link-local and metadata
+	// addresses are always refused
+	AllowPrivate bool
+	DialTimeout  time.Duration
+}
+
+// ForwardProxy is the egress proxy: it forwards workloads' outbound
+// requests, tunneling CONNECT requests and relaying absolute-form HTTP
+// requests, to the destinations the allowlist names. It runs behind the
+// same stages as the reverse proxy, so outbound traffic is authenticated,
+// scored and logged like inbound traffic.
+type ForwardProxy struct {
+	policy       *EgressPolicy
+	ports        map[int]bool
+	allowPrivate bool
+	dialer       *net.Dialer
+	proxy        *httputil.ReverseProxy
+	buffers      *bufferPool
+}
+
+// NewForwardProxy creates an egress proxy allowing the destinations of opts.
+func NewForwardProxy(opts ForwardOptions) (*ForwardProxy, error) {
+	if len(opts.Hosts) == 0 {
+		return nil, errors.New("no destinations are allowed")
+	}
+	policy, err := NewEgressPolicy(opts.Hosts, opts.CIDRs)
+	if err != nil {
+		return nil, err
+	}
+	f := &ForwardProxy{
+		policy:       policy,
+		ports:        map[int]bool{80: true, 443: true},
+		allowPrivate: opts.AllowPrivate,
+		buffers:      newBufferPool(),
+	}
+	if len(opts.Ports) > 0 {
+		f.ports = make(map[int]bool)
+		for _, port := range opts.Ports {
+			f.ports[port] = true
+		}
+	}
+	f.dialer = &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second, Control: f.control}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = f.dialer.DialContext
+	f.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.Host = pr.In.Host
+			if proxyAuthorized(pr.In.Context()) {
+				// The token was meant for the proxy, not the destination
+				pr.Out.Header.Del("Authorization")
+			}
+		},
+		Transport:  transport,
+		BufferPool: f.buffers,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			egressRequests.Inc("http", "failed")
+			log.Printf("[Egress] Request to %s failed: %v", r.URL.Host, err)
+			pages.WriteError(w, r, pages.ErrUpstreamFailed)
+		},
+	}
+	return f, nil
+}
+
+// ServeHTTP forwards a proxy request: CONNECT, or a request for an absolute
+// http URL. HTTPS destinations are reached through CONNECT.
+func (f *ForwardProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodConnect:
+		f.tunnel(w, r)
+	case r.URL.IsAbs() && r.URL.Scheme == "http":
+		f.forward(w, r)
+	default:
+		pages.Write(w, r, http.StatusBadRequest, pages.CodeEgressDenied, "Bad Request - Proxy requests only")
+	}
+}
+
+// allowed checks a destination against the allowlists.
+func (f *ForwardProxy) allowed(host, port string) error {
+	if n, err := strconv.Atoi(port); err != nil || !f.ports[n] {
+		return fmt.Errorf("port %s is not allowed", port)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		// Literal addresses bypass the host allowlist, so only those the
+		// CIDR allowlist names may be requested; they're checked again
+		// when dialing
+		if !f.policy.ListsIP(ip) {
+			return fmt.Errorf("address %s is not in EGRESS_ALLOWED_CIDRS", host)
+		}
+		return nil
+	}
+	if !f.policy.AllowsHost(host) {
+		return fmt.Errorf("host %s is not allowed", host)
+	}
+	return nil
+}
+
+// forward relays a plain HTTP request to its destination.
+func (f *ForwardProxy) forward(w http.ResponseWriter, r *http.Request) {
+	port := r.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+	if err := f.allowed(r.URL.Hostname(), port); err != nil {
+		f.deny(w, r, "http", err)
+		return
+	}
+	egressRequests.Inc("http", "allowed")
+	f.proxy.ServeHTTP(w, r)
+}
+
+// tunnel connects the client to the destination of a CONNECT request and
+// relays bytes both ways until either side closes. When the client speaks
+// TLS, the server name of its ClientHello must be the host it connected to,
+// or an allowed host when it connected to an address, so an allowed tunnel
+// can't be used to reach another name on a shared frontend.
+func (f *ForwardProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		pages.Write(w, r, http.StatusBadRequest, pages.CodeEgressDenied, "Bad Request - CONNECT needs host:port")
+		return
+	}
+	if err := f.allowed(host, port); err != nil {
+		f.deny(w, r, "connect", err)
+		return
+	}
+
+	upstream, err := f.dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		egressRequests.Inc("connect", "failed")
+		log.Printf("[Egress] CONNECT to %s failed: %v", r.Host, err)
+		pages.WriteError(w, r, pages.ErrUpstreamFailed)
+		return
+	}
+	defer upstream.Close()
+
+	// Stages record the 200 they default to; the response is written on
+	// the connection, since net/http would frame it as a body
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		egressRequests.Inc("connect", "failed")
+		log.Printf("[Egress] CONNECT to %s: %v", r.Host, err)
+		pages.Write(w, r, http.StatusInternalServerError, pages.CodeUpstreamFailed, "Tunneling not supported")
+		return
+	}
+	defer client.Close()
+	client.SetDeadline(time.Time{})
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		egressRequests.Inc("connect", "failed")
+		return
+	}
+
+	name, reader, err := clientHelloServerName(client, buffered.Reader)
+	if err != nil {
+		egressRequests.Inc("connect", "failed")
+		log.Printf("[Egress] Closing tunnel to %s from %s: %v", r.Host, r.RemoteAddr, err)
+		return
+	}
+	if name != "" && !strings.EqualFold(name, host) && (net.ParseIP(host) == nil || !f.policy.AllowsHost(name)) {
+		egressRequests.Inc("connect", "denied")
+		egressBlocked.Inc("sni")
+		log.Printf("[Egress] Closing tunnel to %s from %s: TLS server name %s doesn't match", r.Host, r.RemoteAddr, name)
+		return
+	}
+	egressRequests.Inc("connect", "allowed")
+
+	done := make(chan struct{})
+	go func() {
+		egressBytes.Add(f.relay(client, upstream), "received")
+		close(done)
+	}()
+	egressBytes.Add(f.relay(upstream, reader), "sent")
+	<-done
+}
+
+// relay copies src to dst, then closes dst for writing so the other side
+// sees the end of the stream.
+func (f *ForwardProxy) relay(dst net.Conn, src io.Reader) float64 {
+	buf := f.buffers.Get()
+	defer f.buffers.Put(buf)
+	n, _ := io.CopyBuffer(dst, src, buf)
+	if tcp, ok := dst.(interface{ CloseWrite() error }); ok {
+		tcp.CloseWrite()
+	} else {
+		dst.Close()
+	}
+	return float64(n)
+}
+
+func (f *ForwardProxy) deny(w http.ResponseWriter, r *http.Request, method string, err error) {
+	egressRequests.Inc(method, "denied")
+	egressBlocked.Inc("host")
+	log.Printf("[Egress] Denied %s %s from %s: %v", r.Method, r.Host, r.RemoteAddr, err)
+	pages.WriteError(w, r, pages.ErrEgressDenied)
+}
+
+// control checks every resolved destination address before connecting.
+// Whatever the allowlists say, the proxy's own host, link-local addresses
+// and cloud metadata endpoints are never reached.
+func (f *ForwardProxy) control(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || internalIP(ip) || !f.policy.AllowsIP(ip) || !f.allowPrivate && ip.IsPrivate() {
+		egressBlocked.Inc("address")
+		return fmt.Errorf("connection to %s blocked by egress policy", address)
+	}
+	return nil
+}
+
+// internalIP reports whether an address is one egress must never reach:
+// loopback, link-local, unspecified, multicast or a metadata endpoint.
+func internalIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+	for _, network := range metadataNets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientHelloServerName reads the server name from the ClientHello a
+// tunneled TLS client sends first, leaving it buffered in r. It returns ""
+// for clients that don't speak TLS or send no server name. The returned
+// reader replaces r, which may be too small to hold the record.
+func clientHelloServerName(conn net.Conn, r *bufio.Reader) (string, *bufio.Reader, error) {
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	header, err := r.Peek(5)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return "", r, nil
+		}
+		return "", r, err
+	}
+	if header[0] != 0x16 { // Not a TLS handshake record
+		return "", r, nil
+	}
+	size := 5 + (int(header[3])<<8 | int(header[4]))
+	if size > r.Size() {
+		r = bufio.NewReaderSize(r, size)
+	}
+	record, err := r.Peek(size)
+	if err != nil {
+		return "", r, err
+	}
+
+	var name string
+	errHello := errors.New("hello read")
+	server := tls.Server(&helloConn{r: record}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errHello
+		},
+	})
+	if err := server.HandshakeContext(context.Background()); !errors.Is(err, errHello) {
+		return "", r, fmt.Errorf("invalid ClientHello: %v", err)
+	}
+	return name, r, nil
+}
+
+// helloConn feeds a peeked ClientHello to crypto/tls, which parses it and
+// stops at GetConfigForClient without writing anything.
+type helloConn struct {
+	net.Conn
+	r []byte
+}
+
+func (c *helloConn) Read(b []byte) (int, error) {
+	if len(c.r) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, c.r)
+	c.r = c.r[n:]
+	return n, nil
+}
+
+func (c *helloConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// proxyAuthKey marks requests whose Authorization came from
+// Proxy-Authorization.
+type proxyAuthKey struct{}
+
+func proxyAuthorized(ctx context.Context) bool {
+	moved, _ := ctx.Value(proxyAuthKey{}).(bool)
+	return moved
+}
+
+// ProxyAuthorization lets workloads authenticate to the egress proxy the way
+// proxy clients do: a Proxy-Authorization bearer token is checked as if it
+// were the Authorization header, and isn't forwarded to the destination.
+func ProxyAuthorization(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Proxy-Authorization"); auth != "" {
+			r.Header.Del("Proxy-Authorization")
+			if r.Header.Get("Authorization") == "" {
+				r.Header.Set("Authorization", auth)
+				r = r.WithContext(context.WithValue(r.Context(), proxyAuthKey{}, true))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,163 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEgressPolicy(t *testing.T) {
+	policy, err := NewEgressPolicy([]string{"api.example.com", "*.amazonaws.com"}, []string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	open, err := NewEgressPolicy(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := []struct {
+		host string
+		want bool
+	}{
+		{"api.example.com", true},
+		{"API.Example.com", true},
+		{"other.example.com", false},
+		{"s3.amazonaws.com", true},
+		{"a.b.amazonaws.com", true},
+		{"amazonaws.com", false},
+		{"evilamazonaws.com", false},
+	}
+	for _, tt := range hosts {
+		if got := policy.AllowsHost(tt.host); got != tt.want {
+			t.Errorf("AllowsHost(%q) = %t, want %t", tt.host, got, tt.want)
+		}
+		if !open.AllowsHost(tt.host) {
+			t.Errorf("empty policy: AllowsHost(%q) = false", tt.host)
+		}
+	}
+	ips := []struct {
+		ip         string
+		allows     bool
+		lists      bool
+		openAllows bool
+	}{
+		{"203.0.113.9", true, true, true},
+		{"198.51.100.1", false, false, true},
+		{"::ffff:203.0.113.9", true, true, true},
+	}
+	for _, tt := range ips {
+		ip := net.ParseIP(tt.ip)
+		if got := policy.AllowsIP(ip); got != tt.allows {
+			t.Errorf("AllowsIP(%s) = %t, want %t", tt.ip, got, tt.allows)
+		}
+		if got := policy.ListsIP(ip); got != tt.lists {
+			t.Errorf("ListsIP(%s) = %t, want %t", tt.ip, got, tt.lists)
+		}
+		if got := open.AllowsIP(ip); got != tt.openAllows {
+			t.Errorf("empty policy: AllowsIP(%s) = %t, want %t", tt.ip, got, tt.openAllows)
+		}
+		if open.ListsIP(ip) {
+			t.Errorf("empty policy: ListsIP(%s) = true", tt.ip)
+		}
+	}
+	if _, err := NewEgressPolicy(nil, []string{"10.0.0.0/33"}); err == nil {
+		t.Error("invalid CIDR accepted")
+	}
+}
+
+func TestForwardProxyAllowed(t *testing.T) {
+	withCIDRs, err := NewForwardProxy(ForwardOptions{Hosts: []string{"api.example.com"}, CIDRs: []string{"203.0.113.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostsOnly, err := NewForwardProxy(ForwardOptions{Hosts: []string{"api.example.com"}, Ports: []int{443, 8443}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		proxy *ForwardProxy
+		host  string
+		port  string
+		want  bool
+	}{
+		{"allowed host", withCIDRs, "api.example.com", "443", true},
+		{"other host", withCIDRs, "other.example.com", "443", false},
+		{"port not allowed", withCIDRs, "api.example.com", "22", false},
+		{"extra port", hostsOnly, "api.example.com", "8443", true},
+		{"default port dropped", hostsOnly, "api.example.com", "80", false},
+		{"listed address", withCIDRs, "203.0.113.9", "443", true},
+		{"unlisted address", withCIDRs, "198.51.100.1", "443", false},
+		{"address without CIDRs", hostsOnly, "198.51.100.1", "443", false},
+		{"metadata address without CIDRs", hostsOnly, "169.254.169.254", "443", false},
+		{"loopback without CIDRs", hostsOnly, "127.0.0.1", "443", false},
+		{"IPv6 address without CIDRs", hostsOnly, "2001:db8::1", "443", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.proxy.allowed(tt.host, tt.port)
+			if got := err == nil; got != tt.want {
+				t.Errorf("allowed(%s, %s) = %v, want allowed %t", tt.host, tt.port, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardProxyControl(t *testing.T) {
+	everything, err := NewForwardProxy(ForwardOptions{Hosts: []string{"*.example.com"}, CIDRs: []string{"0.0.0.0/0", "::/0"}, AllowPrivate: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := NewForwardProxy(ForwardOptions{Hosts: []string{"*.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		proxy   *ForwardProxy
+		address string
+		want    bool
+	}{
+		{"public address", public, "203.0.113.9:443", true},
+		{"public IPv6 address", public, "[2606:4700::1]:443", true},
+		{"private address", public, "10.1.2.3:443", false},
+		{"private address allowed", everything, "10.1.2.3:443", true},
+		{"loopback", everything, "127.0.0.1:80", false},
+		{"IPv6 loopback", everything, "[::1]:80", false},
+		{"mapped loopback", everything, "[::ffff:127.0.0.1]:80", false},
+		{"metadata", everything, "169.254.169.254:80", false},
+		{"link-local", everything, "169.254.10.1:80", false},
+		{"IPv6 link-local", everything, "[fe80::1]:80", false},
+		{"AWS IPv6 metadata", everything, "[fd00:ec2::254]:80", false},
+		{"Alibaba metadata", everything, "100.100.100.200:80", false},
+		{"Azure wire server", everything, "168.63.129.16:80", false},
+		{"unspecified", everything, "0.0.0.0:80", false},
+		{"multicast", everything, "224.0.0.1:80", false},
+		{"not an address", everything, "example.com:80", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.proxy.control("tcp", tt.address, nil)
+			if got := err == nil; got != tt.want {
+				t.Errorf("control(%s) = %v, want allowed %t", tt.address, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestForwardProxyConnectToAddress(t *testing.T) {
+	proxy, err := NewForwardProxy(ForwardOptions{Hosts: []string{"api.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{"169.254.169.254:80", "10.0.0.1:443", "[::1]:443"} {
+		r := httptest.NewRequest(http.MethodConnect, "http://"+target, nil)
+		r.Host = target
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("CONNECT %s: status %d, want 403", target, w.Code)
+		}
+	}
+}
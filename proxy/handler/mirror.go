@@ -0,0 +1,165 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+const (
+	// mirrorMaxBody bounds the request bodies buffered for a mirror; larger
+	// and chunked ones aren't mirrored.
+	mirrorMaxBody = 1 << 20
+	// mirrorConcurrency bounds the mirrored requests in flight; requests
+	// over it aren't mirrored rather than queued.
+	mirrorConcurrency = 64
+	// mirrorTimeout bounds a mirrored request, response included.
+	mirrorTimeout = 10 * time.Second
+)
+
+// MirrorHeader marks requests that are copies, for the upstream receiving
+// them.
+const MirrorHeader = "X-Aegis-Mirror"
+
+var mirroredRequests = metrics.NewCounterVec("aegis_mirrored_requests_total",
+	"Requests copied to mirror upstreams, by result: sent, failed, dropped at the concurrency limit or skipped for their body.", "result")
+
+// mirrorTarget is the proxy to a mirror upstream, or why there is none.
+type mirrorTarget struct {
+	proxy *httputil.ReverseProxy
+	err   error
+}
+
+// SetRouteMirrors sets the lookup of per-route mirrors: the URL of the
+// upstream a route's requests are copied to and the percentage copied. It
+// returns an empty URL for routes without one.
+func (p *ProxyHandler) SetRouteMirrors(mirror func(path string) (upstreamURL string, percent float64)) {
+	p.routeMirror.Store(&mirror)
+}
+
+// mirror copies a share of requests to their route's mirror upstream,
+// fire-and-forget: the copy's response is discarded, and a slow or failing
+// mirror only loses copies. Bodies are read ahead for the copy, so the
+// primary request gets a replay of them.
+func (p *ProxyHandler) mirror(r *http.Request) {
+	lookup := p.routeMirror.Load()
+	if lookup == nil {
+		return
+	}
+	upstreamURL, percent := (*lookup)(r.URL.Path)
+	if upstreamURL == "" || rand.Float64()*100 >= percent {
+		return
+	}
+	target := p.mirrorTarget(upstreamURL)
+	if target.err != nil {
+		return
+	}
+
+	var body io.ReadCloser = http.NoBody
+	if r.Body != nil && r.Body != http.NoBody {
+		if r.ContentLength < 0 || r.ContentLength > mirrorMaxBody {
+			mirroredRequests.Inc("skipped")
+			return
+		}
+		data, err := io.ReadAll(io.LimitReader(r.Body, r.ContentLength))
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(data), r.Body), r.Body}
+		if err != nil {
+			mirroredRequests.Inc("skipped")
+			return
+		}
+		body = io.NopCloser(bytes.NewReader(data))
+	}
+
+	select {
+	case p.mirrorSlots <- struct{}{}:
+	default:
+		mirroredRequests.Inc("dropped")
+		return
+	}
+	// The copy outlives the request, keeping its values for logging
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), mirrorTimeout)
+	copied := r.Clone(ctx)
+	copied.Body = body
+	copied.Header.Set(MirrorHeader, "true")
+	go func() {
+		defer func() {
+			// The proxy aborts with a panic when copying the response fails
+			if recover() != nil {
+				mirroredRequests.Inc("failed")
+			}
+			cancel()
+			<-p.mirrorSlots
+		}()
+		w := &mirrorWriter{header: make(http.Header)}
+		target.proxy.ServeHTTP(w, copied)
+		if w.err != nil {
+			mirroredRequests.Inc("failed")
+		} else {
+			mirroredRequests.Inc("sent")
+		}
+	}()
+}
+
+// mirrorTarget returns the proxy to a mirror upstream, creating it on first
+// use. Mirrors are addressed to their own host and allowed by the egress
+// policy like any upstream.
+func (p *ProxyHandler) mirrorTarget(upstreamURL string) *mirrorTarget {
+	if target, ok := p.mirrors.Load(upstreamURL); ok {
+		return target.(*mirrorTarget)
+	}
+
+	target := &mirrorTarget{}
+	u, err := url.Parse(upstreamURL)
+	switch {
+	case err != nil:
+		target.err = err
+	case u.Scheme != "http" && u.Scheme != "https" || u.Host == "":
+		target.err = fmt.Errorf("mirror URL %q must be http or https with a host", upstreamURL)
+	default:
+		target.err = p.egress.checkUpstream(u)
+	}
+	if target.err != nil {
+		log.Printf("[Proxy] Not mirroring to %s: %v", upstreamURL, target.err)
+	} else {
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		proxy.Transport = p.transport
+		director := proxy.Director
+		proxy.Director = func(req *http.Request) {
+			director(req)
+			req.Host = u.Host
+			req.Header.Set("X-Forwarded-By", "aegis-zero")
+			p.signRequest(req)
+		}
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			w.(*mirrorWriter).err = err
+		}
+		target.proxy = proxy
+	}
+	actual, _ := p.mirrors.LoadOrStore(upstreamURL, target)
+	return actual.(*mirrorTarget)
+}
+
+// mirrorWriter discards the response to a mirrored request.
+type mirrorWriter struct {
+	header http.Header
+	err    error // Why forwarding failed
+}
+
+func (w *mirrorWriter) Header() http.Header         { return w.header }
+func (w *mirrorWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *mirrorWriter) WriteHeader(int)             {}
+
+// readCloser reads from one reader and closes another.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,48 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// ProbeUpstreams opens a connection to each default upstream, draining or
+// not, and returns the number probed and the errors of those that couldn't
+// be reached, by name.
+func (p *ProxyHandler) ProbeUpstreams(ctx context.Context) (int, map[string]error) {
+	pool := *p.pool.Load()
+	dialer := &net.Dialer{Timeout: p.dialTimeout}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed := make(map[string]error)
+	for _, up := range pool {
+		wg.Add(1)
+		go func(up *upstream) {
+			defer wg.Done()
+			network, address := "unix", strings.TrimPrefix(up.name, "unix:")
+			if !strings.HasPrefix(up.name, "unix:") {
+				network, address = "tcp", up.name
+				if u, err := url.Parse(up.url); err == nil && u.Port() == "" {
+					port := "80"
+					if u.Scheme == "https" {
+						port = "443"
+					}
+					address = net.JoinHostPort(u.Hostname(), port)
+				}
+			}
+			conn, err := dialer.DialContext(ctx, network, address)
+			if err != nil {
+				mu.Lock()
+				failed[up.name] = err
+				mu.Unlock()
+				return
+			}
+			conn.Close()
+		}(up)
+	}
+	wg.Wait()
+	return len(pool), failed
+}
@@ -1,61 +1,419 @@
 package handler
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
 )
 
-// ProxyHandler handles reverse proxying to the upstream service
+// ProxyOptions configures the connection to the upstreams.
+type ProxyOptions struct {
+	Timeout     time.Duration // Time to wait for response headers; 0 waits indefinitely
+	DialTimeout time.Duration
+	// Route names the route a path is counted under in the traffic stats
+	Route func(path string) string
+	// Egress limits the upstream hosts and addresses; nil allows any
+	Egress *EgressPolicy
+	// BlockPrivateRedirects answers 502 to upstream redirects to private,
+	// loopback and link-local destinations
+	BlockPrivateRedirects bool
+	// TransferProgress moves read and write deadlines forward by this much
+	// whenever body data is transferred; 0 keeps the server's timeouts
+	TransferProgress time.Duration
+	// Discovery, if set, replaces the upstream URLs with those it looks up
+	Discovery Discovery
+	// Routed allows starting without default upstreams, for routes set with
+	// SetRoutes; requests no route matches get 404
+	Routed bool
+	// Signer, if set, signs forwarded and mirrored requests (RFC 9421)
+	Signer *RequestSigner
+}
+
+// ProxyHandler handles reverse proxying to the upstream services, balancing
+// requests round-robin across those that are not draining
 type ProxyHandler struct {
-	proxy *httputil.ReverseProxy
+	transport      *http.Transport
+	dialTimeout    time.Duration
+	route          func(path string) string
+	stats          *TrafficStats
+	egress         *EgressPolicy
+	blockRedirects bool
+	buffers        *bufferPool
+	progress       time.Duration
+	host           string // Host of every upstream, with discovery
+	routed         bool
+	routes         atomic.Pointer[routeTable]
+	routeTimeout   atomic.Pointer[func(path string) time.Duration]
+	routeMirror    atomic.Pointer[func(path string) (string, float64)]
+	responseCheck  atomic.Pointer[func(*http.Response) error]
+	mirrors        sync.Map // Mirror upstream URL to *mirrorTarget
+	mirrorSlots    chan struct{}
+	signer         *RequestSigner
+
+	mu    sync.Mutex // Serializes changes to the pool
+	pool  atomic.Pointer[[]*upstream]
+	drain map[string]bool // Names drained by SetDraining, applied to new upstreams
+	next  atomic.Uint64
+}
+
+// ErrUnknownUpstream is returned when draining an upstream that isn't configured.
+var ErrUnknownUpstream = errors.New("unknown upstream")
+
+// upstream is a service requests are forwarded to.
+type upstream struct {
+	name     string // host:port, or unix:<socket>, as reported in stats
+	url      string
+	proxy    *httputil.ReverseProxy
+	draining atomic.Bool
+	active   atomic.Int64
+}
+
+// UpstreamStatus describes an upstream and the requests it is serving.
+type UpstreamStatus struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Draining bool   `json:"draining"`
+	Active   int64  `json:"active"`
 }
 
 // NewProxyHandler creates a new reverse proxy handler
-func NewProxyHandler(upstreamURL string) (*ProxyHandler, error) {
+func NewProxyHandler(upstreamURLs []string, opts ProxyOptions) (*ProxyHandler, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second}
+	if opts.Egress == nil {
+		opts.Egress = &EgressPolicy{}
+	}
+	if len(opts.Egress.nets) > 0 {
+		dialer.Control = opts.Egress.control
+	}
+	transport.DialContext = dialer.DialContext
+	transport.ResponseHeaderTimeout = opts.Timeout
+
+	p := &ProxyHandler{
+		transport:      transport,
+		dialTimeout:    opts.DialTimeout,
+		route:          opts.Route,
+		stats:          NewTrafficStats(),
+		egress:         opts.Egress,
+		blockRedirects: opts.BlockPrivateRedirects,
+		buffers:        newBufferPool(),
+		progress:       opts.TransferProgress,
+		routed:         opts.Routed,
+		mirrorSlots:    make(chan struct{}, mirrorConcurrency),
+		signer:         opts.Signer,
+	}
+	if p.route == nil {
+		p.route = func(string) string { return "/" }
+	}
+	if d := opts.Discovery; d != nil {
+		if p.host = d.Host(); p.host != "" {
+			transport.TLSClientConfig = &tls.Config{ServerName: hostOnly(p.host)}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), discoveryTimeout)
+		defer cancel()
+		urls, err := d.Resolve(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("discovering upstreams: %w", err)
+		}
+		upstreamURLs = urls
+	}
+	if err := p.SetUpstreams(upstreamURLs); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetRouteTimeouts sets the lookup of per-route timeouts, which replace the
+// server's read and write timeouts; it returns 0 for routes without one.
+func (p *ProxyHandler) SetRouteTimeouts(timeout func(path string) time.Duration) {
+	p.routeTimeout.Store(&timeout)
+}
+
+// SetResponseCheck sets a check of upstream responses before they are sent
+// on, which may replace their body. Responses it returns an error for are
+// answered with the error, if it is a *pages.Error, or else 502.
+func (p *ProxyHandler) SetResponseCheck(check func(*http.Response) error) {
+	p.responseCheck.Store(&check)
+}
+
+// SetUpstreams switches to a new set of upstreams. Upstreams that remain
+// keep their draining state, and new ones are drained if SetDraining named
+// them; in-flight requests complete against the previous ones.
+func (p *ProxyHandler) SetUpstreams(upstreamURLs []string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := make(map[string]*upstream)
+	if pool := p.pool.Load(); pool != nil {
+		for _, up := range *pool {
+			current[up.url] = up
+		}
+	}
+
+	pool := make([]*upstream, 0, len(upstreamURLs))
+	for _, upstreamURL := range upstreamURLs {
+		if up, ok := current[upstreamURL]; ok {
+			pool = append(pool, up)
+			continue
+		}
+		proxy, name, err := p.newReverseProxy(upstreamURL, false)
+		if err != nil {
+			return err
+		}
+		up := &upstream{name: name, url: upstreamURL, proxy: proxy}
+		up.draining.Store(p.drain[name])
+		pool = append(pool, up)
+		log.Printf("[Proxy] Configured upstream: %s", upstreamURL)
+	}
+	if len(pool) == 0 && !p.routed {
+		return fmt.Errorf("no upstreams configured")
+	}
+	p.pool.Store(&pool)
+	return nil
+}
+
+// upstreamURLs returns the URLs of the default upstreams.
+func (p *ProxyHandler) upstreamURLs() []string {
+	pool := *p.pool.Load()
+	urls := make([]string, 0, len(pool))
+	for _, up := range pool {
+		urls = append(urls, up.url)
+	}
+	return urls
+}
+
+// SetDraining drains exactly the named upstreams (host:port, or
+// unix:<socket>) and returns the others to service.
+func (p *ProxyHandler) SetDraining(names []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	drain := make(map[string]bool)
+	for _, name := range names {
+		drain[name] = true
+	}
+	p.drain = drain
+	for _, up := range *p.pool.Load() {
+		if up.draining.Swap(drain[up.name]) != drain[up.name] {
+			logDrain(up)
+		}
+	}
+}
+
+// Drain stops sending new requests to an upstream, or returns it to service.
+// Requests already in flight complete. At least one upstream must keep serving.
+func (p *ProxyHandler) Drain(name string, draining bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var target *upstream
+	serving := 0
+	for _, up := range *p.pool.Load() {
+		if up.name == name {
+			target = up
+		} else if !up.draining.Load() {
+			serving++
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("%w %q", ErrUnknownUpstream, name)
+	}
+	if draining && serving == 0 {
+		return fmt.Errorf("cannot drain %s, the last upstream serving requests", name)
+	}
+	if target.draining.Swap(draining) != draining {
+		logDrain(target)
+	}
+	return nil
+}
+
+func logDrain(up *upstream) {
+	if up.draining.Load() {
+		log.Printf("[Proxy] Draining upstream %s (%d requests in flight)", up.name, up.active.Load())
+	} else {
+		log.Printf("[Proxy] Upstream %s back in service", up.name)
+	}
+}
+
+// Upstreams returns the state of every upstream.
+func (p *ProxyHandler) Upstreams() []UpstreamStatus {
+	pool := *p.pool.Load()
+	statuses := make([]UpstreamStatus, 0, len(pool))
+	for _, up := range pool {
+		statuses = append(statuses, UpstreamStatus{Name: up.name, URL: up.url, Draining: up.draining.Load(), Active: up.active.Load()})
+	}
+	return statuses
+}
+
+// pick returns the upstream of the route matching r, or else the next
+// default upstream that isn't draining, round-robin. If every upstream is
+// draining, requests are still served rather than refused. It returns nil
+// if no route matches and there are no default upstreams.
+func (p *ProxyHandler) pick(r *http.Request) *upstream {
+	if table := p.routes.Load(); table != nil {
+		if route := table.match(hostOnly(r.Host), r.URL.Path); route != nil {
+			return route.pick()
+		}
+	}
+	pool := *p.pool.Load()
+	if len(pool) == 0 {
+		return nil
+	}
+	n := p.next.Add(1)
+	for i := range pool {
+		if up := pool[(n+uint64(i))%uint64(len(pool))]; !up.draining.Load() {
+			return up
+		}
+	}
+	return pool[n%uint64(len(pool))]
+}
+
+// ServeHTTP implements http.Handler
+func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	up := p.pick(r)
+	if up == nil {
+		pages.WriteError(w, r, pages.ErrNoRoute)
+		return
+	}
+	up.active.Add(1)
+	route := p.stats.begin(p.route(r.URL.Path), up.name)
+	start := time.Now()
+	var timeout time.Duration
+	if lookup := p.routeTimeout.Load(); lookup != nil {
+		timeout = (*lookup)(r.URL.Path)
+	}
+	p.mirror(r)
+	rec := &statusRecorder{ResponseWriter: w, deadlines: newTransferDeadlines(w, timeout, p.progress)}
+	if rec.deadlines != nil && r.Body != nil && r.Body != http.NoBody {
+		r.Body = &progressBody{ReadCloser: r.Body, deadlines: rec.deadlines}
+	}
+	defer func() {
+		p.stats.end(route, up.name, rec.status, time.Since(start))
+		up.active.Add(-1)
+	}()
+	if p.blockRedirects {
+		r = r.WithContext(context.WithValue(r.Context(), clientHostKey{}, r.Host))
+	}
+	up.proxy.ServeHTTP(rec, r)
+}
+
+// Stats returns the live traffic statistics of proxied requests.
+func (p *ProxyHandler) Stats() TrafficReport {
+	return p.stats.Report()
+}
+
+// newReverseProxy creates the proxy to an upstream and returns it with the
+// upstream's name. Requests are addressed to the upstream's host unless
+// preserveHost keeps the client's, as routes do. unix:// upstreams are
+// reached over their socket, with requests addressed to localhost.
+func (p *ProxyHandler) newReverseProxy(upstreamURL string, preserveHost bool) (*httputil.ReverseProxy, string, error) {
 	target, err := url.Parse(upstreamURL)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	transport, name := p.transport, target.Host
+	if target.Scheme == "unix" {
+		socket := unixSocket(target)
+		if socket == "" || socket == "@" || target.Host != "" {
+			return nil, "", fmt.Errorf("unix upstream URL %q must be unix:///path or unix:///@abstract", upstreamURL)
+		}
+		name = "unix:" + socket
+		if err := p.egress.checkSocket(name); err != nil {
+			return nil, "", err
+		}
+		target = &url.URL{Scheme: "http", Host: "localhost"}
+		transport = p.unixTransport(socket)
+	} else {
+		if target.Scheme == "" || target.Host == "" {
+			return nil, "", fmt.Errorf("upstream URL %q must include a scheme and host", upstreamURL)
+		}
+		if err := p.egress.checkUpstream(target); err != nil {
+			return nil, "", err
+		}
 	}
 
 	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = transport
+	proxy.BufferPool = p.buffers
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if p.blockRedirects {
+			if host, private := privateRedirect(resp); private {
+				egressBlocked.Inc("redirect")
+				return fmt.Errorf("redirect to private destination %s blocked", host)
+			}
+		}
+		if check := p.responseCheck.Load(); check != nil {
+			return (*check)(resp)
+		}
+		return nil
+	}
 
 	// Customize the director to modify requests before forwarding
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
 		originalDirector(req)
-		req.Host = target.Host
+		if !preserveHost {
+			req.Host = target.Host
+			if p.host != "" {
+				req.Host = p.host
+			}
+		}
 
 		// Add custom headers
 		req.Header.Set("X-Forwarded-By", "aegis-zero")
 
-		// Forward client certificate info if available
+		// Forward client certificate info if available. Clients on
+		// listeners without mTLS could otherwise claim any identity
+		req.Header.Del("X-Client-Cert-CN")
+		req.Header.Del("X-Client-Cert-Fingerprint")
 		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
 			cert := req.TLS.PeerCertificates[0]
 			req.Header.Set("X-Client-Cert-CN", cert.Subject.CommonName)
 			req.Header.Set("X-Client-Cert-Fingerprint", certFingerprint(cert))
 		}
+		p.signRequest(req)
 	}
 
 	// Custom error handler
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 		log.Printf("[Proxy] Error forwarding request to %s: %v", upstreamURL, err)
-		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		pages.WriteError(w, r, upstreamError(err))
 	}
 
-	log.Printf("[Proxy] Configured upstream: %s", upstreamURL)
-	return &ProxyHandler{proxy: proxy}, nil
+	return proxy, name, nil
 }
 
-// ServeHTTP implements http.Handler
-func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p.proxy.ServeHTTP(w, r)
+// certFingerprint returns the hex SHA-256 of the certificate's DER encoding.
+func certFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
 }
 
-// certFingerprint generates a simple fingerprint of the certificate
-func certFingerprint(cert interface{}) string {
-	// In production, use crypto/sha256 to hash the certificate
-	// For now, return a placeholder
-	return "fingerprint"
+// upstreamError classifies a forwarding failure: upstreams that ran out
+// of time answer 504, refused responses their refusal and everything else
+// 502.
+func upstreamError(err error) *pages.Error {
+	var e *pages.Error
+	if errors.As(err, &e) {
+		return e
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return pages.ErrUpstreamTimeout.Wrap(err)
+	}
+	return pages.ErrUpstreamFailed.Wrap(err)
 }
@@ -0,0 +1,246 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RegistryOptions configures RegistryDiscovery.
+type RegistryOptions struct {
+	Kind    string // "consul" or "eureka"
+	URL     string // Of the registry's API, e.g. http://consul:8500 or http://eureka:8761/eureka
+	Service string // Consul service or Eureka app
+	Tag     string // Consul only: instances must carry the tag
+	Token   string // Consul ACL token
+	Scheme  string // Consul only: of the instances, "http" or "https"
+	// Poll is the longest a Consul blocking query waits, and the interval
+	// Eureka, which has none, is polled at
+	Poll time.Duration
+}
+
+// RegistryDiscovery takes the upstreams from the healthy instances of a
+// service in Consul or Eureka, so instances can come and go without a
+// configuration change. Consul is watched with blocking queries, which
+// answer as soon as the service changes; Eureka is polled.
+type RegistryDiscovery struct {
+	opts     RegistryOptions
+	endpoint string
+	client   *http.Client
+}
+
+// registryRetry is the delay after a failed lookup.
+const registryRetry = 5 * time.Second
+
+// NewRegistryDiscovery checks the options.
+func NewRegistryDiscovery(opts RegistryOptions) (*RegistryDiscovery, error) {
+	base, err := url.Parse(opts.URL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return nil, fmt.Errorf("registry URL %q must be http(s)://host[:port][/path]", opts.URL)
+	}
+	if opts.Service == "" {
+		return nil, fmt.Errorf("no service to look up")
+	}
+	d := &RegistryDiscovery{opts: opts}
+	switch opts.Kind {
+	case "consul":
+		query := url.Values{"passing": {"1"}}
+		if opts.Tag != "" {
+			query.Set("tag", opts.Tag)
+		}
+		d.endpoint = strings.TrimSuffix(opts.URL, "/") + "/v1/health/service/" + url.PathEscape(opts.Service) + "?" + query.Encode()
+	case "eureka":
+		d.endpoint = strings.TrimSuffix(opts.URL, "/") + "/apps/" + url.PathEscape(opts.Service)
+	default:
+		return nil, fmt.Errorf("unknown registry %q", opts.Kind)
+	}
+	if d.opts.Scheme == "" {
+		d.opts.Scheme = "http"
+	}
+	// Blocking queries are held for up to Poll, plus Consul's jitter of
+	// up to 1/16 of it
+	d.client = &http.Client{Timeout: opts.Poll + opts.Poll/16 + discoveryTimeout}
+	return d, nil
+}
+
+func (d *RegistryDiscovery) String() string {
+	return d.opts.Kind + " service " + d.opts.Service
+}
+
+// Host is empty: instances are addressed directly.
+func (d *RegistryDiscovery) Host() string {
+	return ""
+}
+
+// Resolve looks up the healthy instances of the service.
+func (d *RegistryDiscovery) Resolve(ctx context.Context) ([]string, error) {
+	urls, _, err := d.lookup(ctx, 0)
+	return urls, err
+}
+
+// Run follows the service until ctx is done. A failed lookup keeps the
+// current upstreams and is retried after a few seconds.
+func (d *RegistryDiscovery) Run(ctx context.Context, p *ProxyHandler) {
+	var index uint64
+	for {
+		if d.opts.Kind == "eureka" {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(d.opts.Poll):
+			}
+		}
+
+		urls, next, err := d.lookup(ctx, index)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			discoveryErrors.Inc()
+			log.Printf("[Discovery] Lookup of %s failed, keeping %d upstreams: %v", d, len(p.upstreamURLs()), err)
+			index = 0
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(registryRetry):
+			}
+			continue
+		}
+		// Consul's index only grows; if it goes back, the state was
+		// reset and blocking starts over
+		if next < index {
+			next = 0
+		}
+		index = next
+		p.setDiscovered(d.String(), urls)
+	}
+}
+
+// lookup returns the instances and, for Consul, the index to block on
+// next. A non-zero index makes Consul hold the query until the service
+// changes or Poll has passed.
+func (d *RegistryDiscovery) lookup(ctx context.Context, index uint64) ([]string, uint64, error) {
+	endpoint := d.endpoint
+	if index > 0 {
+		endpoint += fmt.Sprintf("&index=%d&wait=%ds", index, int(d.opts.Poll.Seconds()))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if d.opts.Token != "" {
+		req.Header.Set("X-Consul-Token", d.opts.Token)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, 0, fmt.Errorf("registry returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var addrs []string
+	var next uint64
+	if d.opts.Kind == "consul" {
+		next, _ = strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+		addrs, err = d.consulInstances(resp.Body)
+	} else {
+		addrs, err = eurekaInstances(resp.Body)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(addrs) == 0 {
+		return nil, 0, fmt.Errorf("no healthy instances of %s", d.opts.Service)
+	}
+	slices.Sort(addrs)
+	return slices.Compact(addrs), next, nil
+}
+
+// consulInstances reads a /v1/health/service response. Consul has already
+// left out instances with a check that isn't passing.
+func (d *RegistryDiscovery) consulInstances(body io.Reader) ([]string, error) {
+	var entries []struct {
+		Node struct {
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := json.NewDecoder(body).Decode(&entries); err != nil {
+		return nil, fmt.Errorf("invalid Consul response: %w", err)
+	}
+	var urls []string
+	for _, entry := range entries {
+		// Services registered without an address use their node's
+		host := entry.Service.Address
+		if host == "" {
+			host = entry.Node.Address
+		}
+		urls = append(urls, d.opts.Scheme+"://"+net.JoinHostPort(host, strconv.Itoa(entry.Service.Port)))
+	}
+	return urls, nil
+}
+
+// eurekaPort is a port of an instance, as {"$": 8080, "@enabled": "true"}.
+type eurekaPort struct {
+	Port    json.Number `json:"$"`
+	Enabled string      `json:"@enabled"`
+}
+
+// eurekaInstances reads an /apps/<app> response, keeping the instances
+// that are UP and preferring their secure port.
+func eurekaInstances(body io.Reader) ([]string, error) {
+	var app struct {
+		Application struct {
+			Instance json.RawMessage `json:"instance"`
+		} `json:"application"`
+	}
+	if err := json.NewDecoder(body).Decode(&app); err != nil {
+		return nil, fmt.Errorf("invalid Eureka response: %w", err)
+	}
+	type instance struct {
+		IPAddr     string     `json:"ipAddr"`
+		Status     string     `json:"status"`
+		Port       eurekaPort `json:"port"`
+		SecurePort eurekaPort `json:"securePort"`
+	}
+	var instances []instance
+	raw := app.Application.Instance
+	if len(raw) > 0 && raw[0] == '{' {
+		// Some Eureka versions send a lone instance as an object
+		raw = append(append([]byte{'['}, raw...), ']')
+	}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &instances); err != nil {
+			return nil, fmt.Errorf("invalid Eureka response: %w", err)
+		}
+	}
+	var urls []string
+	for _, instance := range instances {
+		if instance.Status != "UP" {
+			continue
+		}
+		switch {
+		case instance.SecurePort.Enabled == "true":
+			urls = append(urls, "https://"+net.JoinHostPort(instance.IPAddr, instance.SecurePort.Port.String()))
+		case instance.Port.Enabled != "false":
+			urls = append(urls, "http://"+net.JoinHostPort(instance.IPAddr, instance.Port.Port.String()))
+		}
+	}
+	return urls, nil
+}
@@ -0,0 +1,148 @@
+package handler
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Route sends requests for a host and path to its own upstreams, balanced
+// round-robin, instead of the default ones. Requests keep the client's Host.
+type Route struct {
+	Host      string   `json:"host,omitempty"` // Exact, "*.example.com", or empty for any host
+	Path      string   `json:"path"`           // A prefix matched on whole segments, or the exact path
+	Exact     bool     `json:"exact,omitempty"`
+	Upstreams []string `json:"upstreams"`
+	Source    string   `json:"source,omitempty"` // Where the route is defined, e.g. ingress namespace/name
+}
+
+// boundRoute is a route with its upstreams.
+type boundRoute struct {
+	Route
+	pool []*upstream
+	next atomic.Uint64
+}
+
+// routeTable holds routes in the order they are matched: exact hosts before
+// wildcards before any host, then exact paths, then longer prefixes first.
+type routeTable struct {
+	routes []*boundRoute
+}
+
+// SetRoutes replaces the route table. Upstreams shared with the previous
+// table keep their connections and counters. Routes whose upstreams are
+// invalid or not allowed by the egress policy are left out and logged, so
+// one broken route doesn't hold back the others.
+func (p *ProxyHandler) SetRoutes(routes []Route) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current := make(map[string]*upstream)
+	if table := p.routes.Load(); table != nil {
+		for _, route := range table.routes {
+			for _, up := range route.pool {
+				current[up.url] = up
+			}
+		}
+	}
+
+	table := &routeTable{}
+	for _, route := range routes {
+		bound := &boundRoute{Route: route}
+		for _, upstreamURL := range route.Upstreams {
+			up, ok := current[upstreamURL]
+			if !ok {
+				proxy, name, err := p.newReverseProxy(upstreamURL, true)
+				if err != nil {
+					log.Printf("[Proxy] Ignoring route %s%s from %s: %v", route.Host, route.Path, route.Source, err)
+					bound.pool = nil
+					break
+				}
+				up = &upstream{name: name, url: upstreamURL, proxy: proxy}
+				current[upstreamURL] = up
+			}
+			bound.pool = append(bound.pool, up)
+		}
+		if len(bound.pool) > 0 {
+			table.routes = append(table.routes, bound)
+		}
+	}
+	sort.SliceStable(table.routes, func(i, j int) bool {
+		a, b := table.routes[i], table.routes[j]
+		if hostRank(a.Host) != hostRank(b.Host) {
+			return hostRank(a.Host) < hostRank(b.Host)
+		}
+		if len(a.Host) != len(b.Host) {
+			return len(a.Host) > len(b.Host)
+		}
+		if a.Exact != b.Exact {
+			return a.Exact
+		}
+		return len(a.Path) > len(b.Path)
+	})
+	p.routes.Store(table)
+}
+
+// Routes returns the routes in effect, in the order they are matched.
+func (p *ProxyHandler) Routes() []Route {
+	table := p.routes.Load()
+	if table == nil {
+		return nil
+	}
+	routes := make([]Route, 0, len(table.routes))
+	for _, route := range table.routes {
+		routes = append(routes, route.Route)
+	}
+	return routes
+}
+
+func hostRank(host string) int {
+	switch {
+	case host == "":
+		return 2
+	case strings.HasPrefix(host, "*."):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// match returns the first route for host (without port) and path, or nil.
+func (t *routeTable) match(host, path string) *boundRoute {
+	host = strings.ToLower(host)
+	for _, route := range t.routes {
+		if route.matchesHost(host) && route.matchesPath(path) {
+			return route
+		}
+	}
+	return nil
+}
+
+// matchesHost reports whether host is the route's. As in Ingress and
+// HTTPRoute hostnames, a wildcard stands for exactly one DNS label:
+// "*.example.com" matches "shop.example.com" but neither "example.com" nor
+// "a.shop.example.com".
+func (r *boundRoute) matchesHost(host string) bool {
+	switch {
+	case r.Host == "":
+		return true
+	case strings.HasPrefix(r.Host, "*."):
+		label, ok := strings.CutSuffix(host, r.Host[1:])
+		return ok && label != "" && !strings.Contains(label, ".")
+	default:
+		return host == r.Host
+	}
+}
+
+func (r *boundRoute) matchesPath(path string) bool {
+	if r.Exact {
+		return path == r.Path
+	}
+	prefix := strings.TrimSuffix(r.Path, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+func (r *boundRoute) pick() *upstream {
+	return r.pool[r.next.Add(1)%uint64(len(r.pool))]
+}
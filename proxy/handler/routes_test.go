@@ -0,0 +1,53 @@
+package handler
+
+import "testing"
+
+func TestRouteMatchesHost(t *testing.T) {
+	tests := []struct {
+		route string
+		host  string
+		want  bool
+	}{
+		{"", "anything.example.com", true},
+		{"shop.example.com", "shop.example.com", true},
+		{"shop.example.com", "a.shop.example.com", false},
+		{"*.example.com", "shop.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", ".example.com", false},
+		{"*.example.com", "a.shop.example.com", false},
+		{"*.example.com", "evilexample.com", false},
+		{"*.shop.example.com", "eu.shop.example.com", true},
+		{"*.shop.example.com", "shop.example.com", false},
+	}
+	for _, tt := range tests {
+		route := &boundRoute{Route: Route{Host: tt.route}}
+		if got := route.matchesHost(tt.host); got != tt.want {
+			t.Errorf("route %q: matchesHost(%q) = %t, want %t", tt.route, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestRouteTableMatch(t *testing.T) {
+	routes := []*boundRoute{
+		{Route: Route{Host: "shop.example.com", Path: "/"}},
+		{Route: Route{Host: "*.shop.example.com", Path: "/"}},
+		{Route: Route{Host: "*.example.com", Path: "/api"}},
+		{Route: Route{Path: "/"}},
+	}
+	table := &routeTable{routes: routes}
+	tests := []struct {
+		host, path string
+		want       int // Index in routes
+	}{
+		{"Shop.Example.com", "/cart", 0},
+		{"eu.shop.example.com", "/cart", 1},
+		{"api.example.com", "/api/orders", 2},
+		{"api.example.com", "/apiary", 3},
+		{"a.b.example.com", "/api/orders", 3},
+	}
+	for _, tt := range tests {
+		if got := table.match(tt.host, tt.path); got != routes[tt.want] {
+			t.Errorf("match(%q, %q) = %v, want route %d", tt.host, tt.path, got, tt.want)
+		}
+	}
+}
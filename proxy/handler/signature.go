@@ -0,0 +1,156 @@
+package handler
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/httpsig"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var requestSignatures = metrics.NewCounterVec("aegis_request_signatures_total",
+	"Forwarded requests signed for upstreams, by result: signed or failed.", "result")
+
+// signatureLabel names the proxy's signature in the Signature and
+// Signature-Input dictionaries.
+const signatureLabel = "aegis"
+
+// signedHeaders are covered by the signature when the request has them,
+// after the derived components. Hop-by-hop headers and X-Forwarded-For,
+// which the reverse proxy sets after signing, can't be covered.
+var signedHeaders = []string{
+	"content-type",
+	"content-digest",
+	"authorization",
+	"x-aegis-assertion",
+	"x-client-cert-fingerprint",
+	"x-forwarded-by",
+	"x-request-id",
+}
+
+// RequestSigner signs forwarded requests with HTTP Message Signatures
+// (RFC 9421), so upstreams can verify with the proxy's public key that a
+// request came through the proxy and wasn't sent from inside the network.
+// The signature covers the method, authority, path and query and the
+// identity headers set by the stages.
+type RequestSigner struct {
+	key   crypto.Signer
+	alg   string
+	keyID string
+	ttl   time.Duration
+}
+
+// NewRequestSigner creates a signer whose signatures expire after ttl.
+// The algorithm follows the key: rsa-pss-sha512 for RSA, ecdsa-p256-sha256
+// or ecdsa-p384-sha384 for ECDSA and ed25519 for Ed25519. The key ID is the
+// base64url SHA-256 of the public key's DER encoding.
+func NewRequestSigner(key crypto.Signer, ttl time.Duration) (*RequestSigner, error) {
+	alg, err := httpsig.Algorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	s := &RequestSigner{key: key, alg: alg, ttl: ttl}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(der)
+	s.keyID = base64.RawURLEncoding.EncodeToString(sum[:])
+	return s, nil
+}
+
+// KeyID returns the keyid parameter of signatures.
+func (s *RequestSigner) KeyID() string {
+	return s.keyID
+}
+
+// Algorithm returns the alg parameter of signatures.
+func (s *RequestSigner) Algorithm() string {
+	return s.alg
+}
+
+// Sign sets the Signature-Input and Signature headers of an outgoing
+// request, replacing any the client sent. It must run after every other
+// change to the covered components.
+func (s *RequestSigner) Sign(req *http.Request) error {
+	components := []string{"@method", "@authority", "@path", "@query"}
+	for _, name := range signedHeaders {
+		if len(req.Header.Values(name)) > 0 {
+			components = append(components, name)
+		}
+	}
+
+	created := time.Now().Unix()
+	params := httpsig.Params(components, fmt.Sprintf(";created=%d;expires=%d;keyid=%q;alg=%q;tag=%q",
+		created, created+int64(s.ttl/time.Second), s.keyID, s.alg, "aegis-zero"))
+	base, err := httpsig.Base(req, components, params)
+	if err != nil {
+		return err
+	}
+	signature, err := s.sign(base)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature-Input", signatureLabel+"="+params)
+	req.Header.Set("Signature", signatureLabel+"=:"+base64.StdEncoding.EncodeToString(signature)+":")
+	return nil
+}
+
+// sign signs the signature base with the key's algorithm. ECDSA signatures
+// are the fixed-size concatenation of r and s, as RFC 9421 requires.
+func (s *RequestSigner) sign(base []byte) ([]byte, error) {
+	switch key := s.key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha512.Sum512(base)
+		return rsa.SignPSS(rand.Reader, key, crypto.SHA512, digest[:], &rsa.PSSOptions{SaltLength: 64})
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		if key.Curve == elliptic.P256() {
+			sum := sha256.Sum256(base)
+			digest = sum[:]
+		} else {
+			sum := sha512.Sum384(base)
+			digest = sum[:]
+		}
+		r, sv, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return nil, err
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		sv.FillBytes(signature[size:])
+		return signature, nil
+	case ed25519.PrivateKey:
+		return ed25519.Sign(key, base), nil
+	}
+	return nil, fmt.Errorf("unsupported signing key %T", s.key)
+}
+
+// signRequest signs an outgoing request if a signer is set. Requests that
+// can't be signed are forwarded unsigned; upstreams requiring signatures
+// refuse them.
+func (p *ProxyHandler) signRequest(req *http.Request) {
+	if p.signer == nil {
+		return
+	}
+	if err := p.signer.Sign(req); err != nil {
+		requestSignatures.Inc("failed")
+		log.Printf("[Proxy] Failed to sign request %s %s: %v", req.Method, req.URL.Path, err)
+		return
+	}
+	requestSignatures.Inc("signed")
+}
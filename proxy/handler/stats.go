@@ -0,0 +1,236 @@
+package handler
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+const (
+	// statsWindow is the span RPS and error rates are computed over, in seconds.
+	statsWindow = 60
+	// latencySamples is the number of recent latencies percentiles are taken from.
+	latencySamples = 1024
+	// maxRoutes bounds the routes tracked; further ones are counted as "other".
+	maxRoutes = 256
+)
+
+var (
+	upstreamRequests = metrics.NewCounterVec("aegis_upstream_requests_total",
+		"Proxied requests by route, upstream and status class.", "route", "upstream", "class")
+	upstreamDuration = metrics.NewHistogramVec("aegis_upstream_request_duration_seconds",
+		"Time to proxy a request, by route and upstream.",
+		[]float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "route", "upstream")
+	upstreamActive = metrics.NewGaugeVec("aegis_upstream_active_requests",
+		"Requests currently being proxied, by upstream.", "upstream")
+)
+
+// TrafficSnapshot is the live traffic of one route or upstream.
+type TrafficSnapshot struct {
+	Name      string  `json:"name"`
+	Requests  int64   `json:"requests"` // Within the window
+	RPS       float64 `json:"rps"`
+	ErrorRate float64 `json:"error_rate"` // 5xx and failed forwards
+	P50Ms     float64 `json:"p50_ms"`
+	P95Ms     float64 `json:"p95_ms"`
+	P99Ms     float64 `json:"p99_ms"`
+	Active    int64   `json:"active"` // In flight
+}
+
+// TrafficReport is the live traffic of every route and upstream.
+type TrafficReport struct {
+	WindowSeconds int               `json:"window_seconds"`
+	Routes        []TrafficSnapshot `json:"routes"`
+	Upstreams     []TrafficSnapshot `json:"upstreams"`
+}
+
+// TrafficStats keeps live counters of proxied requests per route and per
+// upstream, for quick diagnostics alongside the Prometheus metrics.
+type TrafficStats struct {
+	mu        sync.Mutex
+	routes    map[string]*trafficWindow
+	upstreams map[string]*trafficWindow
+}
+
+// trafficWindow counts requests per second over the last statsWindow
+// seconds and keeps the most recent latencies.
+type trafficWindow struct {
+	active    int64
+	buckets   [statsWindow]trafficBucket
+	latencies [latencySamples]time.Duration
+	samples   int // Latencies recorded, for the ring position
+}
+
+type trafficBucket struct {
+	second   int64
+	requests int64
+	errors   int64
+}
+
+// NewTrafficStats creates empty statistics.
+func NewTrafficStats() *TrafficStats {
+	return &TrafficStats{
+		routes:    make(map[string]*trafficWindow),
+		upstreams: make(map[string]*trafficWindow),
+	}
+}
+
+// begin records the start of a request and returns the route it is counted under.
+func (s *TrafficStats) begin(route, upstream string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.routes[route]; !ok && len(s.routes) >= maxRoutes {
+		route = "other"
+	}
+	s.window(s.routes, route).active++
+	s.window(s.upstreams, upstream).active++
+	upstreamActive.Add(1, upstream)
+	return route
+}
+
+// end records the outcome of a request started with begin.
+func (s *TrafficStats) end(route, upstream string, status int, elapsed time.Duration) {
+	now := time.Now().Unix()
+	if status == 0 {
+		// The response was aborted before a status was written
+		status = http.StatusBadGateway
+	}
+	failed := status >= 500
+
+	s.mu.Lock()
+	for _, w := range []*trafficWindow{s.window(s.routes, route), s.window(s.upstreams, upstream)} {
+		w.active--
+		w.record(now, failed, elapsed)
+	}
+	s.mu.Unlock()
+
+	upstreamActive.Add(-1, upstream)
+	upstreamRequests.Inc(route, upstream, statusClass(status))
+	upstreamDuration.Observe(elapsed.Seconds(), route, upstream)
+}
+
+func (s *TrafficStats) window(windows map[string]*trafficWindow, name string) *trafficWindow {
+	w, ok := windows[name]
+	if !ok {
+		w = &trafficWindow{}
+		windows[name] = w
+	}
+	return w
+}
+
+func (w *trafficWindow) record(now int64, failed bool, elapsed time.Duration) {
+	b := &w.buckets[now%statsWindow]
+	if b.second != now {
+		*b = trafficBucket{second: now}
+	}
+	b.requests++
+	if failed {
+		b.errors++
+	}
+	w.latencies[w.samples%latencySamples] = elapsed
+	w.samples++
+}
+
+// Report returns the current statistics, busiest first.
+func (s *TrafficStats) Report() TrafficReport {
+	now := time.Now().Unix()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return TrafficReport{
+		WindowSeconds: statsWindow,
+		Routes:        snapshots(s.routes, now),
+		Upstreams:     snapshots(s.upstreams, now),
+	}
+}
+
+func snapshots(windows map[string]*trafficWindow, now int64) []TrafficSnapshot {
+	result := make([]TrafficSnapshot, 0, len(windows))
+	for name, w := range windows {
+		result = append(result, w.snapshot(name, now))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Requests != result[j].Requests {
+			return result[i].Requests > result[j].Requests
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func (w *trafficWindow) snapshot(name string, now int64) TrafficSnapshot {
+	snap := TrafficSnapshot{Name: name, Active: w.active}
+	var errors int64
+	for _, b := range w.buckets {
+		if now-b.second < statsWindow {
+			snap.Requests += b.requests
+			errors += b.errors
+		}
+	}
+	snap.RPS = float64(snap.Requests) / statsWindow
+	if snap.Requests > 0 {
+		snap.ErrorRate = float64(errors) / float64(snap.Requests)
+	}
+
+	n := w.samples
+	if n > latencySamples {
+		n = latencySamples
+	}
+	if n > 0 {
+		sorted := make([]time.Duration, n)
+		copy(sorted, w.latencies[:n])
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		snap.P50Ms = percentileMs(sorted, 0.50)
+		snap.P95Ms = percentileMs(sorted, 0.95)
+		snap.P99Ms = percentileMs(sorted, 0.99)
+	}
+	return snap
+}
+
+// percentileMs returns the q-th quantile of sorted latencies in milliseconds.
+func percentileMs(sorted []time.Duration, q float64) float64 {
+	i := int(q * float64(len(sorted)-1))
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// statusRecorder captures the status written by the reverse proxy and
+// notes the progress of the response for its transfer deadlines.
+type statusRecorder struct {
+	http.ResponseWriter
+	status    int
+	deadlines *transferDeadlines // nil with the server's timeouts
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	// Informational responses precede the final status
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	if w.deadlines != nil {
+		w.deadlines.write()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.deadlines != nil {
+		w.deadlines.write()
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController flush streamed responses.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// copyBufferSize is the size of the buffers bodies are streamed through.
+const copyBufferSize = 32 << 10
+
+// bufferPool recycles the reverse proxy's copy buffers, so streaming a body
+// doesn't allocate a new buffer per request.
+type bufferPool struct {
+	pool sync.Pool
+}
+
+func newBufferPool() *bufferPool {
+	return &bufferPool{pool: sync.Pool{New: func() interface{} {
+		b := make([]byte, copyBufferSize)
+		return &b
+	}}}
+}
+
+func (p *bufferPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+func (p *bufferPool) Put(b []byte) {
+	if cap(b) == copyBufferSize {
+		b = b[:copyBufferSize]
+		p.pool.Put(&b)
+	}
+}
+
+// transferDeadlines replace the server's fixed read and write timeouts for
+// one request: a route's own timeout, and with progress set, deadlines that
+// move forward whenever body data is transferred, so large uploads and
+// downloads run as long as they don't stall.
+type transferDeadlines struct {
+	rc       *http.ResponseController
+	progress time.Duration
+	limit    time.Time // Never extended past; zero without a route timeout
+
+	// Deadlines are moved at most every progress/4, not on every chunk
+	lastRead, lastWrite time.Time
+}
+
+// newTransferDeadlines applies a route timeout and progress deadlines to the
+// request w answers, returning nil when neither is set.
+func newTransferDeadlines(w http.ResponseWriter, timeout, progress time.Duration) *transferDeadlines {
+	if timeout <= 0 && progress <= 0 {
+		return nil
+	}
+	d := &transferDeadlines{rc: http.NewResponseController(w), progress: progress}
+	if timeout > 0 {
+		d.limit = time.Now().Add(timeout)
+		d.rc.SetReadDeadline(d.limit)
+		d.rc.SetWriteDeadline(d.limit)
+	}
+	d.read()
+	return d
+}
+
+// next returns the deadline after progress at now, and whether it moved.
+func (d *transferDeadlines) next(now, last time.Time) (time.Time, bool) {
+	if d.progress <= 0 || now.Sub(last) < d.progress/4 {
+		return time.Time{}, false
+	}
+	deadline := now.Add(d.progress)
+	if !d.limit.IsZero() && deadline.After(d.limit) {
+		deadline = d.limit
+	}
+	return deadline, true
+}
+
+// read notes progress reading the request body.
+func (d *transferDeadlines) read() {
+	now := time.Now()
+	if deadline, ok := d.next(now, d.lastRead); ok {
+		d.lastRead = now
+		d.rc.SetReadDeadline(deadline)
+	}
+}
+
+// write notes progress writing the response.
+func (d *transferDeadlines) write() {
+	now := time.Now()
+	if deadline, ok := d.next(now, d.lastWrite); ok {
+		d.lastWrite = now
+		d.rc.SetWriteDeadline(deadline)
+	}
+}
+
+// progressBody moves the read deadline as the request body is streamed
+// upstream.
+type progressBody struct {
+	io.ReadCloser
+	deadlines *transferDeadlines
+}
+
+func (b *progressBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.deadlines.read()
+	}
+	return n, err
+}
@@ -0,0 +1,34 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// unixSocket returns the socket of a unix:// upstream URL: the file for
+// "unix:///run/app.sock", or the abstract socket "@app" for "unix:///@app"
+// (Linux only). Other URLs have none.
+func unixSocket(target *url.URL) string {
+	if target.Scheme != "unix" {
+		return ""
+	}
+	if strings.HasPrefix(target.Path, "/@") {
+		return target.Path[1:]
+	}
+	return target.Path
+}
+
+// unixTransport returns a transport that connects to socket whatever the
+// request's host, with the settings of the shared transport. Each socket
+// gets its own, so idle connections are pooled per socket.
+func (p *ProxyHandler) unixTransport(socket string) *http.Transport {
+	transport := p.transport.Clone()
+	dialer := &net.Dialer{Timeout: p.dialTimeout}
+	transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, "unix", socket)
+	}
+	return transport
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var dependencyUp = metrics.NewGaugeVec("aegis_dependency_up",
+	"1 if the last readiness check of the dependency passed.", "dependency")
+
+// dependency is something the proxy needs to serve requests properly. check
+// returns a short description of its state, or why it is failing.
+type dependency struct {
+	name    string
+	check   func(ctx context.Context) (string, error)
+	running atomic.Bool // A check that outlives its timeout isn't started twice
+}
+
+// dependencyStatus is the result of the last check of a dependency.
+type dependencyStatus struct {
+	Status   string    `json:"status"` // "ok" or "failing"
+	Detail   string    `json:"detail,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Required bool      `json:"required"` // Whether it holds back readiness
+	Since    time.Time `json:"since"`    // Of the current status
+}
+
+// readiness checks the dependencies in the background, so probes answer
+// from the last results and a busy orchestrator doesn't add load to Redis
+// or Kafka. The proxy is ready once every required dependency passed its
+// last check and it isn't draining.
+type readiness struct {
+	deps     []*dependency
+	required map[string]bool
+	interval time.Duration
+	onChange func(ready bool, status string)
+
+	mu      sync.RWMutex
+	results map[string]dependencyStatus
+	checked time.Time
+	ready   bool
+}
+
+func newReadiness(interval time.Duration, required []string, onChange func(ready bool, status string)) *readiness {
+	rd := &readiness{
+		required: make(map[string]bool),
+		interval: interval,
+		onChange: onChange,
+		results:  make(map[string]dependencyStatus),
+	}
+	for _, name := range required {
+		rd.required[name] = true
+	}
+	return rd
+}
+
+// add registers a dependency to check.
+func (rd *readiness) add(name string, check func(ctx context.Context) (string, error)) {
+	rd.deps = append(rd.deps, &dependency{name: name, check: check})
+}
+
+// Run checks the dependencies now and every interval until ctx is done.
+func (rd *readiness) Run(ctx context.Context) {
+	ticker := time.NewTicker(rd.interval)
+	defer ticker.Stop()
+	for {
+		rd.checkAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkAll runs every check in parallel, each bounded by the interval.
+func (rd *readiness) checkAll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, rd.interval)
+	defer cancel()
+
+	type result struct {
+		detail string
+		err    error
+	}
+	results := make([]result, len(rd.deps))
+	var wg sync.WaitGroup
+	for i, dep := range rd.deps {
+		if !dep.running.CompareAndSwap(false, true) {
+			results[i].err = fmt.Errorf("previous check still running")
+			continue
+		}
+		wg.Add(1)
+		done := make(chan result, 1)
+		go func() {
+			defer dep.running.Store(false)
+			detail, err := dep.check(ctx)
+			done <- result{detail, err}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			select {
+			case results[i] = <-done:
+			case <-ctx.Done():
+				results[i].err = fmt.Errorf("timed out")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	rd.mu.Lock()
+	ready := true
+	var failing []string
+	for i, dep := range rd.deps {
+		status := dependencyStatus{Status: "ok", Detail: results[i].detail, Required: rd.required[dep.name], Since: now}
+		if err := results[i].err; err != nil {
+			status.Status, status.Error = "failing", err.Error()
+			failing = append(failing, dep.name)
+			if status.Required {
+				ready = false
+			}
+		}
+		if previous, ok := rd.results[dep.name]; ok && previous.Status == status.Status {
+			status.Since = previous.Since
+		} else if status.Status != "ok" {
+			log.Printf("[Health] %s failing: %s", dep.name, status.Error)
+		} else if ok {
+			log.Printf("[Health] %s recovered", dep.name)
+		}
+		rd.results[dep.name] = status
+		up := 0.0
+		if status.Status == "ok" {
+			up = 1
+		}
+		dependencyUp.Set(up, dep.name)
+	}
+	changed := rd.checked.IsZero() || ready != rd.ready
+	rd.checked, rd.ready = now, ready
+	rd.mu.Unlock()
+
+	if changed && rd.onChange != nil {
+		status := "Ready"
+		if !ready {
+			status = "Not ready"
+		}
+		if len(failing) > 0 {
+			status += "; failing: " + strings.Join(failing, ", ")
+		}
+		rd.onChange(ready, status)
+	}
+}
+
+// alive reports whether the checks are still running, for systemd's
+// watchdog: a proxy whose checks have stalled is stuck.
+func (rd *readiness) alive() bool {
+	rd.mu.RLock()
+	defer rd.mu.RUnlock()
+	return time.Since(rd.checked) < 3*rd.interval
+}
+
+// handleLivez answers as long as the process serves requests; a failing
+// dependency is no reason to restart the proxy.
+func handleLivez(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status": "alive", "service": "aegis-zero-proxy"}`))
+}
+
+// handleReadyz reports whether the proxy should get traffic, with the state
+// of each dependency: 200 when ready, otherwise 503.
+func (rd *readiness) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	rd.mu.RLock()
+	body := struct {
+		Status       string                      `json:"status"` // "ready", "not_ready", "draining" or "starting"
+		Service      string                      `json:"service"`
+		CheckedAt    *time.Time                  `json:"checked_at,omitempty"`
+		Dependencies map[string]dependencyStatus `json:"dependencies"`
+	}{Status: "ready", Service: "aegis-zero-proxy", Dependencies: make(map[string]dependencyStatus)}
+	for name, status := range rd.results {
+		body.Dependencies[name] = status
+	}
+	switch {
+	case rd.checked.IsZero():
+		body.Status = "starting"
+	case draining.Load():
+		body.Status = "draining"
+	case !rd.ready:
+		body.Status = "not_ready"
+	}
+	if !rd.checked.IsZero() {
+		checked := rd.checked
+		body.CheckedAt = &checked
+	}
+	rd.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if body.Status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+// dependencyNames lists the dependencies checked, for logs.
+func (rd *readiness) dependencyNames() string {
+	var names []string
+	for _, dep := range rd.deps {
+		name := dep.name
+		if rd.required[name] {
+			name += " (required)"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,256 @@
+// Package httpsig builds and checks the signature bases of HTTP Message
+// Signatures (RFC 9421), for the proxy's own signatures on forwarded
+// requests and for client signatures over replay protection headers. It
+// covers the derived components @method, @authority, @path and @query and
+// plain header fields, with the rsa-pss-sha512, ecdsa-p256-sha256,
+// ecdsa-p384-sha384 and ed25519 algorithms.
+package httpsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Signature is one signature of a request, as labelled in its Signature and
+// Signature-Input headers.
+type Signature struct {
+	Label      string
+	Components []string // Covered components, lowercase and unquoted
+	Params     string   // The serialized inner list, for @signature-params
+	Created    int64
+	Expires    int64 // 0 when unset
+	KeyID      string
+	Alg        string
+	Value      []byte
+}
+
+// Covers reports whether the signature covers a component.
+func (s *Signature) Covers(component string) bool {
+	for _, c := range s.Components {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+// Algorithm returns the algorithm for a key.
+func Algorithm(key crypto.PublicKey) (string, error) {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return "rsa-pss-sha512", nil
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return "ecdsa-p256-sha256", nil
+		case elliptic.P384():
+			return "ecdsa-p384-sha384", nil
+		}
+		return "", fmt.Errorf("unsupported ECDSA curve %s", k.Curve.Params().Name)
+	case ed25519.PublicKey:
+		return "ed25519", nil
+	}
+	return "", fmt.Errorf("unsupported key %T", key)
+}
+
+// Base builds the signature base of req for the covered components and the
+// serialized signature parameters. A header component the request doesn't
+// have is an error, as the signer can't have covered it.
+func Base(req *http.Request, components []string, params string) ([]byte, error) {
+	var b strings.Builder
+	for _, name := range components {
+		value, err := componentValue(req, name)
+		if err != nil {
+			return nil, err
+		}
+		b.WriteString(strconv.Quote(name) + ": " + value + "\n")
+	}
+	b.WriteString(`"@signature-params": ` + params)
+	return []byte(b.String()), nil
+}
+
+// Params serializes covered components and parameters as the inner list of
+// Signature-Input and @signature-params.
+func Params(components []string, params string) string {
+	quoted := make([]string, len(components))
+	for i, c := range components {
+		quoted[i] = strconv.Quote(c)
+	}
+	return "(" + strings.Join(quoted, " ") + ")" + params
+}
+
+func componentValue(req *http.Request, name string) (string, error) {
+	switch name {
+	case "@method":
+		return req.Method, nil
+	case "@authority":
+		return Authority(req), nil
+	case "@path":
+		return req.URL.EscapedPath(), nil
+	case "@query":
+		return "?" + req.URL.RawQuery, nil
+	}
+	if strings.HasPrefix(name, "@") {
+		return "", fmt.Errorf("unsupported component %s", name)
+	}
+	values := req.Header.Values(name)
+	if len(values) == 0 {
+		return "", fmt.Errorf("covered header %s missing", name)
+	}
+	trimmed := make([]string, len(values))
+	for i, v := range values {
+		trimmed[i] = strings.TrimSpace(v)
+	}
+	return strings.Join(trimmed, ", "), nil
+}
+
+// Authority is the @authority component: the lowercased host, without the
+// scheme's default port.
+func Authority(req *http.Request) string {
+	host := strings.ToLower(req.Host)
+	if host == "" {
+		host = strings.ToLower(req.URL.Host)
+	}
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		scheme := req.URL.Scheme
+		if scheme == "" && req.TLS != nil {
+			scheme = "https"
+		}
+		if port == "80" && scheme == "http" || port == "443" && scheme == "https" {
+			return h
+		}
+	}
+	return host
+}
+
+// Parse reads the first signature in a request's Signature-Input and its
+// value in Signature.
+func Parse(req *http.Request) (*Signature, error) {
+	input := strings.TrimSpace(strings.Join(req.Header.Values("Signature-Input"), ", "))
+	if input == "" {
+		return nil, errors.New("no Signature-Input")
+	}
+	label, rest, ok := strings.Cut(input, "=")
+	if !ok || !strings.HasPrefix(rest, "(") {
+		return nil, errors.New("malformed Signature-Input")
+	}
+	end := strings.IndexByte(rest, ')')
+	if end < 0 {
+		return nil, errors.New("malformed Signature-Input")
+	}
+	sig := &Signature{Label: strings.TrimSpace(label)}
+	for _, item := range strings.Fields(rest[1:end]) {
+		component, err := strconv.Unquote(item)
+		if err != nil || component == "" || component != strings.ToLower(component) {
+			return nil, fmt.Errorf("malformed component %s", item)
+		}
+		sig.Components = append(sig.Components, component)
+	}
+	params, err := sig.parseParams(rest[end+1:])
+	if err != nil {
+		return nil, err
+	}
+	sig.Params = rest[:end+1] + params
+
+	for _, member := range strings.Split(strings.Join(req.Header.Values("Signature"), ","), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(member), "=")
+		if name != sig.Label {
+			continue
+		}
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return nil, errors.New("malformed Signature")
+		}
+		if sig.Value, err = base64.StdEncoding.DecodeString(value[1 : len(value)-1]); err != nil {
+			return nil, fmt.Errorf("malformed Signature: %w", err)
+		}
+		return sig, nil
+	}
+	return nil, fmt.Errorf("no Signature labelled %s", sig.Label)
+}
+
+// parseParams reads the parameters after the inner list, up to the next
+// dictionary member, and returns them as serialized.
+func (sig *Signature) parseParams(s string) (string, error) {
+	var b strings.Builder
+	for strings.HasPrefix(s, ";") {
+		name, rest, _ := strings.Cut(s[1:], "=")
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", errors.New("malformed Signature-Input parameter")
+			}
+			value, s = rest[:end+2], rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, ";,")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, s = rest[:end], rest[end:]
+		}
+		b.WriteString(";" + name + "=" + value)
+
+		var err error
+		switch name {
+		case "created":
+			sig.Created, err = strconv.ParseInt(value, 10, 64)
+		case "expires":
+			sig.Expires, err = strconv.ParseInt(value, 10, 64)
+		case "keyid":
+			sig.KeyID, err = strconv.Unquote(value)
+		case "alg":
+			sig.Alg, err = strconv.Unquote(value)
+		}
+		if err != nil {
+			return "", fmt.Errorf("malformed Signature-Input parameter %s", name)
+		}
+	}
+	return b.String(), nil
+}
+
+// Verify checks a signature over base made with key. ECDSA signatures are
+// the fixed-size concatenation of r and s, as RFC 9421 requires.
+func Verify(key crypto.PublicKey, base, signature []byte) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		digest := sha512.Sum512(base)
+		return rsa.VerifyPSS(k, crypto.SHA512, digest[:], signature, &rsa.PSSOptions{SaltLength: 64})
+	case *ecdsa.PublicKey:
+		var digest []byte
+		if k.Curve == elliptic.P256() {
+			sum := sha256.Sum256(base)
+			digest = sum[:]
+		} else {
+			sum := sha512.Sum384(base)
+			digest = sum[:]
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, base, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported key %T", key)
+}
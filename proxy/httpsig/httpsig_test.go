@@ -0,0 +1,146 @@
+package httpsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestBase(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "http://API.example.com:80/orders/7?expand=items", nil)
+	req.Header.Add("X-Request-Nonce", " 9f0c6a1e ")
+	req.Header.Add("Accept", "text/html")
+	req.Header.Add("Accept", "application/json")
+	components := []string{"@method", "@authority", "@path", "@query", "x-request-nonce", "accept"}
+	params := Params(components, `;created=1767225600;alg="ed25519"`)
+
+	base, err := Base(req, components, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `"@method": POST
+"@authority": api.example.com
+"@path": /orders/7
+"@query": ?expand=items
+"x-request-nonce": 9f0c6a1e
+"accept": text/html, application/json
+"@signature-params": ("@method" "@authority" "@path" "@query" "x-request-nonce" "accept");created=1767225600;alg="ed25519"`
+	if string(base) != want {
+		t.Errorf("base =\n%s\nwant\n%s", base, want)
+	}
+
+	if _, err := Base(req, []string{"x-missing"}, params); err == nil {
+		t.Error("base with a missing header succeeded")
+	}
+	if _, err := Base(req, []string{"@target-uri"}, params); err == nil {
+		t.Error("base with an unsupported component succeeded")
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		signature  string
+		components []string
+		keyID      string
+		wantErr    bool
+	}{
+		{
+			name:       "single signature",
+			input:      `client=("@method" "x-request-nonce");created=1767225600;keyid="k1";alg="ed25519"`,
+			signature:  `client=:AQID:`,
+			components: []string{"@method", "x-request-nonce"},
+			keyID:      "k1",
+		},
+		{
+			name:       "first of several",
+			input:      `client=("@path");created=1, other=("@method");created=2`,
+			signature:  `other=:BAU=:, client=:AQID:`,
+			components: []string{"@path"},
+		},
+		{name: "no input", signature: `client=:AQID:`, wantErr: true},
+		{name: "no matching signature", input: `client=("@path")`, signature: `other=:AQID:`, wantErr: true},
+		{name: "uppercase component", input: `client=("X-Nonce")`, signature: `client=:AQID:`, wantErr: true},
+		{name: "bad base64", input: `client=("@path")`, signature: `client=:!!:`, wantErr: true},
+		{name: "bad created", input: `client=("@path");created=soon`, signature: `client=:AQID:`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.input != "" {
+				req.Header.Set("Signature-Input", tt.input)
+			}
+			req.Header.Set("Signature", tt.signature)
+			sig, err := Parse(req)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Parse succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(sig.Components, tt.components) || sig.KeyID != tt.keyID || !slices.Equal(sig.Value, []byte{1, 2, 3}) {
+				t.Errorf("signature = %+v", sig)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	base := []byte(`"@method": GET` + "\n" + `"@signature-params": ("@method")`)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	p256, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	ecdsaSign := func(key *ecdsa.PrivateKey, digest []byte) []byte {
+		r, s, _ := ecdsa.Sign(rand.Reader, key, digest)
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sig := make([]byte, 2*size)
+		r.FillBytes(sig[:size])
+		s.FillBytes(sig[size:])
+		return sig
+	}
+	sum512 := sha512.Sum512(base)
+	rsaSig, _ := rsa.SignPSS(rand.Reader, rsaKey, crypto.SHA512, sum512[:], &rsa.PSSOptions{SaltLength: 64})
+	sum256 := sha256.Sum256(base)
+	sum384 := sha512.Sum384(base)
+
+	tests := []struct {
+		alg string
+		key crypto.PublicKey
+		sig []byte
+	}{
+		{"rsa-pss-sha512", &rsaKey.PublicKey, rsaSig},
+		{"ecdsa-p256-sha256", &p256.PublicKey, ecdsaSign(p256, sum256[:])},
+		{"ecdsa-p384-sha384", &p384.PublicKey, ecdsaSign(p384, sum384[:])},
+		{"ed25519", edKey.Public(), ed25519.Sign(edKey, base)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.alg, func(t *testing.T) {
+			if alg, err := Algorithm(tt.key); err != nil || alg != tt.alg {
+				t.Errorf("Algorithm = %q, %v, want %q", alg, err, tt.alg)
+			}
+			if err := Verify(tt.key, base, tt.sig); err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+			tampered := append([]byte(nil), base...)
+			tampered[1] = 'M'
+			if err := Verify(tt.key, tampered, tt.sig); err == nil {
+				t.Error("Verify accepted a tampered base")
+			}
+		})
+	}
+}
@@ -0,0 +1,373 @@
+// Package ingress lets the proxy act as a Kubernetes ingress controller: it
+// watches Ingress or Gateway API HTTPRoute resources and turns them into the
+// proxy's route table, so routes don't have to be written by hand.
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/handler"
+)
+
+// Options configures the controller.
+type Options struct {
+	Kind string // "ingress" for Ingress, "gateway" for HTTPRoute
+	// Class is the ingressClassName of the Ingresses served
+	Class string
+	// Gateway is the Gateway HTTPRoutes must attach to, as name or
+	// namespace/name
+	Gateway string
+	// Namespace limits the resources watched; empty watches all
+	Namespace string
+	// ClusterDomain completes service names, e.g. cluster.local
+	ClusterDomain string
+}
+
+// Controller keeps routes in line with the cluster's resources.
+type Controller struct {
+	opts Options
+	kube *kubeClient
+	path string // Of the resources in the API
+
+	mu      sync.Mutex
+	version string // resourceVersion of the last list, where watches start
+}
+
+// watchRetry is the delay before re-establishing a failed watch.
+const watchRetry = 5 * time.Second
+
+// NewController connects to the API server of the cluster the proxy runs in.
+func NewController(opts Options) (*Controller, error) {
+	kube, err := newKubeClient()
+	if err != nil {
+		return nil, err
+	}
+	c := &Controller{opts: opts, kube: kube}
+	namespace := ""
+	if opts.Namespace != "" {
+		namespace = "/namespaces/" + opts.Namespace
+	}
+	switch opts.Kind {
+	case "ingress":
+		c.path = "/apis/networking.k8s.io/v1" + namespace + "/ingresses"
+	case "gateway":
+		c.path = "/apis/gateway.networking.k8s.io/v1" + namespace + "/httproutes"
+	default:
+		return nil, fmt.Errorf("unknown controller kind %q", opts.Kind)
+	}
+	return c, nil
+}
+
+func (c *Controller) String() string {
+	if c.opts.Kind == "gateway" {
+		return "HTTPRoutes of gateway " + c.opts.Gateway
+	}
+	return "Ingresses of class " + c.opts.Class
+}
+
+// Load lists the resources and returns their routes.
+func (c *Controller) Load(ctx context.Context) ([]handler.Route, error) {
+	var routes []handler.Route
+	var version string
+	if c.opts.Kind == "gateway" {
+		var list httpRouteList
+		if err := c.kube.list(ctx, c.path, &list); err != nil {
+			return nil, err
+		}
+		sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Metadata.key() < list.Items[j].Metadata.key() })
+		for _, item := range list.Items {
+			routes = append(routes, c.httpRouteRoutes(item)...)
+		}
+		version = list.Metadata.ResourceVersion
+	} else {
+		var list ingressList
+		if err := c.kube.list(ctx, c.path, &list); err != nil {
+			return nil, err
+		}
+		sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Metadata.key() < list.Items[j].Metadata.key() })
+		for _, item := range list.Items {
+			routes = append(routes, c.ingressRoutes(item)...)
+		}
+		version = list.Metadata.ResourceVersion
+	}
+
+	c.mu.Lock()
+	c.version = version
+	c.mu.Unlock()
+	return routes, nil
+}
+
+// Run applies the routes of the resources until ctx is done: at once, on
+// every change the watch reports, and every resync in case one is missed.
+// A failed list keeps the routes in effect.
+func (c *Controller) Run(ctx context.Context, resync time.Duration, apply func([]handler.Route)) {
+	changed := make(chan struct{}, 1)
+	notify(changed)
+	go func() {
+		for {
+			c.mu.Lock()
+			version := c.version
+			c.mu.Unlock()
+			if version != "" {
+				if err := c.kube.watch(ctx, c.path, version, changed); err != nil && ctx.Err() == nil {
+					log.Printf("[Ingress] Watch of %s failed, retrying: %v", c, err)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(watchRetry):
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(resync)
+	defer ticker.Stop()
+
+	var current []handler.Route
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-changed:
+		case <-ticker.C:
+		}
+
+		loadCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		routes, err := c.Load(loadCtx)
+		cancel()
+		if err != nil {
+			log.Printf("[Ingress] Failed to list %s, keeping %d routes: %v", c, len(current), err)
+			continue
+		}
+		if current != nil && reflect.DeepEqual(routes, current) {
+			continue
+		}
+		log.Printf("[Ingress] %d routes from %s", len(routes), c)
+		apply(routes)
+		current = routes
+	}
+}
+
+// serviceURL is the address of a service port in the cluster.
+func (c *Controller) serviceURL(namespace, name string, port int) string {
+	return fmt.Sprintf("http://%s.%s.svc.%s:%d", name, namespace, c.opts.ClusterDomain, port)
+}
+
+type objectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+func (m objectMeta) key() string {
+	return m.Namespace + "/" + m.Name
+}
+
+type listMeta struct {
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type ingressList struct {
+	Metadata listMeta        `json:"metadata"`
+	Items    []ingressObject `json:"items"`
+}
+
+type ingressObject struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		IngressClassName string          `json:"ingressClassName"`
+		DefaultBackend   *ingressBackend `json:"defaultBackend"`
+		Rules            []struct {
+			Host string `json:"host"`
+			HTTP *struct {
+				Paths []struct {
+					Path     string         `json:"path"`
+					PathType string         `json:"pathType"`
+					Backend  ingressBackend `json:"backend"`
+				} `json:"paths"`
+			} `json:"http"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+type ingressBackend struct {
+	Service *struct {
+		Name string `json:"name"`
+		Port struct {
+			Number int    `json:"number"`
+			Name   string `json:"name"`
+		} `json:"port"`
+	} `json:"service"`
+}
+
+// ingressRoutes returns the routes of an Ingress of the controller's class.
+// Backends other than services, and service ports given by name, aren't
+// supported and are skipped.
+func (c *Controller) ingressRoutes(ing ingressObject) []handler.Route {
+	class := ing.Spec.IngressClassName
+	if class == "" {
+		class = ing.Metadata.Annotations["kubernetes.io/ingress.class"]
+	}
+	if class != c.opts.Class {
+		return nil
+	}
+
+	source := "ingress " + ing.Metadata.key()
+	backend := func(b ingressBackend) (string, bool) {
+		if b.Service == nil || b.Service.Port.Number == 0 {
+			log.Printf("[Ingress] Skipping a backend of %s: only services with numeric ports are supported", source)
+			return "", false
+		}
+		return c.serviceURL(ing.Metadata.Namespace, b.Service.Name, b.Service.Port.Number), true
+	}
+
+	var routes []handler.Route
+	for _, rule := range ing.Spec.Rules {
+		if rule.HTTP == nil {
+			continue
+		}
+		for _, path := range rule.HTTP.Paths {
+			upstream, ok := backend(path.Backend)
+			if !ok {
+				continue
+			}
+			if path.Path == "" {
+				path.Path = "/"
+			}
+			routes = append(routes, handler.Route{
+				Host:      strings.ToLower(rule.Host),
+				Path:      path.Path,
+				Exact:     path.PathType == "Exact",
+				Upstreams: []string{upstream},
+				Source:    source,
+			})
+		}
+	}
+	if ing.Spec.DefaultBackend != nil {
+		if upstream, ok := backend(*ing.Spec.DefaultBackend); ok {
+			routes = append(routes, handler.Route{Path: "/", Upstreams: []string{upstream}, Source: source})
+		}
+	}
+	return routes
+}
+
+type httpRouteList struct {
+	Metadata listMeta          `json:"metadata"`
+	Items    []httpRouteObject `json:"items"`
+}
+
+type httpRouteObject struct {
+	Metadata objectMeta `json:"metadata"`
+	Spec     struct {
+		ParentRefs []struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"parentRefs"`
+		Hostnames []string `json:"hostnames"`
+		Rules     []struct {
+			Matches []struct {
+				Path *struct {
+					Type  string `json:"type"`
+					Value string `json:"value"`
+				} `json:"path"`
+			} `json:"matches"`
+			BackendRefs []struct {
+				Kind      string `json:"kind"`
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+				Port      int    `json:"port"`
+				Weight    *int   `json:"weight"`
+			} `json:"backendRefs"`
+		} `json:"rules"`
+	} `json:"spec"`
+}
+
+// httpRouteRoutes returns the routes of an HTTPRoute attached to the
+// controller's Gateway. Each rule's backends share its requests round-robin;
+// weights only exclude backends weighted 0. Backends in other namespaces
+// would need a ReferenceGrant check and are skipped, as are path matches
+// other than PathPrefix and Exact.
+func (c *Controller) httpRouteRoutes(hr httpRouteObject) []handler.Route {
+	gatewayNamespace, gatewayName, qualified := strings.Cut(c.opts.Gateway, "/")
+	if !qualified {
+		gatewayNamespace, gatewayName = "", c.opts.Gateway
+	}
+	attached := false
+	for _, ref := range hr.Spec.ParentRefs {
+		namespace := ref.Namespace
+		if namespace == "" {
+			namespace = hr.Metadata.Namespace
+		}
+		if ref.Name == gatewayName && (gatewayNamespace == "" || namespace == gatewayNamespace) {
+			attached = true
+		}
+	}
+	if !attached {
+		return nil
+	}
+
+	source := "httproute " + hr.Metadata.key()
+	hosts := hr.Spec.Hostnames
+	if len(hosts) == 0 {
+		hosts = []string{""}
+	}
+	var routes []handler.Route
+	for _, rule := range hr.Spec.Rules {
+		var upstreams []string
+		for _, ref := range rule.BackendRefs {
+			switch {
+			case ref.Kind != "" && ref.Kind != "Service", ref.Port == 0:
+				log.Printf("[Ingress] Skipping backend %s of %s: only services with a port are supported", ref.Name, source)
+			case ref.Namespace != "" && ref.Namespace != hr.Metadata.Namespace:
+				log.Printf("[Ingress] Skipping backend %s/%s of %s: backends in other namespaces are not supported", ref.Namespace, ref.Name, source)
+			case ref.Weight != nil && *ref.Weight == 0:
+			default:
+				upstreams = append(upstreams, c.serviceURL(hr.Metadata.Namespace, ref.Name, ref.Port))
+			}
+		}
+		if len(upstreams) == 0 {
+			continue
+		}
+
+		type match struct {
+			path  string
+			exact bool
+		}
+		matches := []match{{path: "/"}}
+		if len(rule.Matches) > 0 {
+			matches = matches[:0]
+		}
+		for _, m := range rule.Matches {
+			switch {
+			case m.Path == nil:
+				matches = append(matches, match{path: "/"})
+			case m.Path.Type == "" || m.Path.Type == "PathPrefix":
+				matches = append(matches, match{path: m.Path.Value})
+			case m.Path.Type == "Exact":
+				matches = append(matches, match{path: m.Path.Value, exact: true})
+			default:
+				log.Printf("[Ingress] Skipping a %s match of %s: only PathPrefix and Exact are supported", m.Path.Type, source)
+			}
+		}
+		for _, host := range hosts {
+			for _, m := range matches {
+				routes = append(routes, handler.Route{
+					Host:      strings.ToLower(host),
+					Path:      m.path,
+					Exact:     m.exact,
+					Upstreams: upstreams,
+					Source:    source,
+				})
+			}
+		}
+	}
+	return routes
+}
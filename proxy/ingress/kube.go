@@ -0,0 +1,129 @@
+package ingress
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into every pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeClient reads resources from the Kubernetes API server with the pod's
+// service account.
+type kubeClient struct {
+	server string
+	client *http.Client // List requests
+	stream *http.Client // Long-lived watch requests
+}
+
+func newKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes pod: KUBERNETES_SERVICE_HOST is unset")
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("reading the cluster CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}}
+	return &kubeClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		client: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		stream: &http.Client{Transport: transport},
+	}, nil
+}
+
+// list decodes the resources at path into list.
+func (c *kubeClient) list(ctx context.Context, path string, list interface{}) error {
+	resp, err := c.get(ctx, c.client, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(list); err != nil {
+		return fmt.Errorf("invalid response from %s: %w", path, err)
+	}
+	return nil
+}
+
+// watch streams changes to the resources at path after resourceVersion,
+// signalling on changed for each, until ctx is done or the watch ends.
+func (c *kubeClient) watch(ctx context.Context, path, resourceVersion string, changed chan<- struct{}) error {
+	resp, err := c.get(ctx, c.stream, path+"?watch=1&allowWatchBookmarks=true&resourceVersion="+resourceVersion)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// The API server streams one JSON object per event
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event struct {
+			Type   string `json:"type"`
+			Object struct {
+				Message string `json:"message"` // Of ERROR events
+			} `json:"object"`
+		}
+		if err := dec.Decode(&event); err != nil {
+			if ctx.Err() != nil || err == io.EOF {
+				// The server ends watches after a timeout
+				return nil
+			}
+			return err
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			notify(changed)
+		case "ERROR":
+			// Typically 410 Gone: the version is too old, so list again
+			notify(changed)
+			return fmt.Errorf("watch error: %s", event.Object.Message)
+		}
+	}
+}
+
+func (c *kubeClient) get(ctx context.Context, client *http.Client, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Projected service account tokens are rotated, so read it every time
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("reading the service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		resp.Body.Close()
+		return nil, fmt.Errorf("API server returned %d for %s: %s", resp.StatusCode, path, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// notify signals changed without blocking; one pending signal is enough.
+func notify(changed chan<- struct{}) {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,8 @@
+// Package integration holds end-to-end tests of the composed proxy: the
+// aegis-proxy binary runs against Redis and Kafka in Docker containers and
+// a stub upstream, and requests go through the full chain (mTLS, JWT,
+// blocklist, access logs, proxying). They need Docker and are built only
+// with the integration tag:
+//
+//	go test -tags integration -v ./integration
+package integration
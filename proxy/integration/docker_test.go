@@ -0,0 +1,75 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// container is a Docker container started for the tests.
+type container struct {
+	id   string
+	name string
+}
+
+// runContainer starts image detached with the given port mappings
+// ("host:container") and environment, removing any leftover container of
+// the same name first.
+func runContainer(name, image string, ports []string, env ...string) (*container, error) {
+	exec.Command("docker", "rm", "-f", name).Run()
+	args := []string{"run", "-d", "--rm", "--name", name}
+	for _, p := range ports {
+		args = append(args, "-p", "127.0.0.1:"+p)
+	}
+	for _, e := range env {
+		args = append(args, "-e", e)
+	}
+	out, err := exec.Command("docker", append(args, image)...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("docker run %s: %v: %s", image, err, out)
+	}
+	return &container{id: strings.TrimSpace(string(out)), name: name}, nil
+}
+
+// Close removes the container.
+func (c *container) Close() {
+	exec.Command("docker", "rm", "-f", c.id).Run()
+}
+
+// Logs returns the container's output, for failed startups.
+func (c *container) Logs() string {
+	out, _ := exec.Command("docker", "logs", "--tail", "50", c.id).CombinedOutput()
+	return string(out)
+}
+
+// freePort returns a local TCP port nothing listens on.
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("finding a free port: %w", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+// waitFor calls ready until it succeeds or timeout passes.
+func waitFor(ctx context.Context, what string, timeout time.Duration, ready func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		err := ready(ctx)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s not ready after %v: %v", what, timeout, err)
+		case <-time.After(500 * time.Millisecond):
+		}
+	}
+}
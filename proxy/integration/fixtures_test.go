@@ -0,0 +1,155 @@
+//go:build integration
+
+package integration
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// pki is a throwaway CA with the certificates and JWT key the proxy and
+// its clients use, written to dir in the files the proxy reads.
+type pki struct {
+	dir        string
+	ca         *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	caPool     *x509.CertPool
+	client     tls.Certificate // Issued by the CA
+	jwtKey     *rsa.PrivateKey
+	serverCert string
+	serverKey  string
+	caCert     string
+	jwtPublic  string
+}
+
+func newPKI(dir string) (*pki, error) {
+	p := &pki{dir: dir}
+	var err error
+	if p.caKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "aegis integration CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &p.caKey.PublicKey, p.caKey)
+	if err != nil {
+		return nil, err
+	}
+	if p.ca, err = x509.ParseCertificate(der); err != nil {
+		return nil, err
+	}
+	p.caPool = x509.NewCertPool()
+	p.caPool.AddCert(p.ca)
+	if p.caCert, err = p.write("ca.crt", "CERTIFICATE", der); err != nil {
+		return nil, err
+	}
+
+	serverDER, serverKey, err := p.issue(2, "localhost", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		return nil, err
+	}
+	if p.serverCert, err = p.write("server.crt", "CERTIFICATE", serverDER); err != nil {
+		return nil, err
+	}
+	if p.serverKey, err = p.write("server.key", "PRIVATE KEY", serverKey); err != nil {
+		return nil, err
+	}
+
+	clientDER, clientKey, err := p.issue(3, "integration-client", x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return nil, err
+	}
+	clientPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientDER})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: clientKey})
+	if p.client, err = tls.X509KeyPair(clientPEM, keyPEM); err != nil {
+		return nil, err
+	}
+
+	if p.jwtKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		return nil, err
+	}
+	public, err := x509.MarshalPKIXPublicKey(&p.jwtKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	if p.jwtPublic, err = p.write("jwt_public.pem", "PUBLIC KEY", public); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// issue returns a certificate for name signed by the CA, and its PKCS #8 key.
+func (p *pki) issue(serial int64, name string, usage x509.ExtKeyUsage) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return der, keyDER, nil
+}
+
+func (p *pki) write(name, blockType string, der []byte) (string, error) {
+	path := filepath.Join(p.dir, name)
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	return path, os.WriteFile(path, data, 0o600)
+}
+
+// token returns an RS256 token for subject, valid for an hour.
+func (p *pki) token(subject string) string {
+	claims := jwt.MapClaims{
+		"sub": subject,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	signed, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(p.jwtKey)
+	if err != nil {
+		panic(err)
+	}
+	return signed
+}
+
+// clientTLS is the TLS config of a client, presenting the client
+// certificate when withCert is set.
+func (p *pki) clientTLS(withCert bool) *tls.Config {
+	cfg := &tls.Config{RootCAs: p.caPool, ServerName: "localhost"}
+	if withCert {
+		cfg.Certificates = []tls.Certificate{p.client}
+	}
+	return cfg
+}
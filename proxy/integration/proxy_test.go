@@ -0,0 +1,363 @@
+//go:build integration
+
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/redis/go-redis/v9"
+)
+
+const accessLogTopic = "request-logs"
+
+// stack is the proxy under test and its dependencies, shared by the tests.
+type stack struct {
+	pki      *pki
+	proxyURL string
+	brokers  []string
+	redis    *redis.Client
+
+	mu       sync.Mutex
+	upstream []*http.Request // Requests the stub upstream received
+}
+
+var env *stack
+
+func TestMain(m *testing.M) {
+	code, err := run(m)
+	if err != nil {
+		log.Printf("integration: %v", err)
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// run starts Redis, Kafka, a stub upstream and the proxy, runs the tests
+// and tears everything down.
+func run(m *testing.M) (int, error) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return 0, fmt.Errorf("docker is required: %w", err)
+	}
+	ctx := context.Background()
+	dir, err := os.MkdirTemp("", "aegis-integration")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(dir)
+
+	env = &stack{}
+	if env.pki, err = newPKI(dir); err != nil {
+		return 0, fmt.Errorf("generating certificates: %w", err)
+	}
+
+	redisPort, err := freePort()
+	if err != nil {
+		return 0, err
+	}
+	redisC, err := runContainer("aegis-it-redis", "redis:7-alpine", []string{fmt.Sprintf("%d:6379", redisPort)})
+	if err != nil {
+		return 0, err
+	}
+	defer redisC.Close()
+	env.redis = redis.NewClient(&redis.Options{Addr: fmt.Sprintf("127.0.0.1:%d", redisPort)})
+	defer env.redis.Close()
+	if err := waitFor(ctx, "redis", 30*time.Second, func(ctx context.Context) error {
+		return env.redis.Ping(ctx).Err()
+	}); err != nil {
+		return 0, fmt.Errorf("%w\n%s", err, redisC.Logs())
+	}
+
+	// Kafka advertises the address clients reach it on, so the host port
+	// is also the container's
+	kafkaPort, err := freePort()
+	if err != nil {
+		return 0, err
+	}
+	kafkaC, err := runContainer("aegis-it-kafka", "apache/kafka:3.7.0", []string{fmt.Sprintf("%d:%d", kafkaPort, kafkaPort)},
+		"KAFKA_NODE_ID=1",
+		"KAFKA_PROCESS_ROLES=broker,controller",
+		fmt.Sprintf("KAFKA_LISTENERS=PLAINTEXT://:%d,CONTROLLER://:9093", kafkaPort),
+		fmt.Sprintf("KAFKA_ADVERTISED_LISTENERS=PLAINTEXT://127.0.0.1:%d", kafkaPort),
+		"KAFKA_CONTROLLER_LISTENER_NAMES=CONTROLLER",
+		"KAFKA_LISTENER_SECURITY_PROTOCOL_MAP=CONTROLLER:PLAINTEXT,PLAINTEXT:PLAINTEXT",
+		"KAFKA_CONTROLLER_QUORUM_VOTERS=1@localhost:9093",
+		"KAFKA_OFFSETS_TOPIC_REPLICATION_FACTOR=1",
+		"KAFKA_AUTO_CREATE_TOPICS_ENABLE=true",
+	)
+	if err != nil {
+		return 0, err
+	}
+	defer kafkaC.Close()
+	env.brokers = []string{fmt.Sprintf("127.0.0.1:%d", kafkaPort)}
+	if err := waitFor(ctx, "kafka", 90*time.Second, func(context.Context) error {
+		admin, err := sarama.NewClusterAdmin(env.brokers, sarama.NewConfig())
+		if err != nil {
+			return err
+		}
+		defer admin.Close()
+		err = admin.CreateTopic(accessLogTopic, &sarama.TopicDetail{NumPartitions: 1, ReplicationFactor: 1}, false)
+		if errors.Is(err, sarama.ErrTopicAlreadyExists) {
+			return nil
+		}
+		return err
+	}); err != nil {
+		return 0, fmt.Errorf("%w\n%s", err, kafkaC.Logs())
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env.mu.Lock()
+		env.upstream = append(env.upstream, r.Clone(context.Background()))
+		env.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"path": %q}`, r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	stop, err := startProxy(ctx, dir, upstream.URL, redisPort)
+	if err != nil {
+		return 0, err
+	}
+	defer stop()
+
+	return m.Run(), nil
+}
+
+// startProxy builds aegis-proxy and runs it until stop is called.
+func startProxy(ctx context.Context, dir, upstreamURL string, redisPort int) (stop func(), err error) {
+	binary := filepath.Join(dir, "aegis-proxy")
+	if out, err := exec.Command("go", "build", "-o", binary, "..").CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("building the proxy: %v: %s", err, out)
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	env.proxyURL = fmt.Sprintf("https://localhost:%d", port)
+	cmd := exec.Command(binary)
+	cmd.Env = append(os.Environ(),
+		"PORT="+strconv.Itoa(port),
+		"TLS_CERT_PATH="+env.pki.serverCert,
+		"TLS_KEY_PATH="+env.pki.serverKey,
+		"CA_CERT_PATH="+env.pki.caCert,
+		"JWT_PUBLIC_KEY_PATH="+env.pki.jwtPublic,
+		"UPSTREAM_URL="+upstreamURL,
+		fmt.Sprintf("REDIS_URL=127.0.0.1:%d", redisPort),
+		"KAFKA_BROKERS="+env.brokers[0],
+		"KAFKA_TOPIC="+accessLogTopic,
+		"TRUSTED_PROXIES=127.0.0.0/8,::1/128",
+		"FAIL_OPEN=false",
+		"LOG_LEVEL=debug",
+		"AUTO_GOMAXPROCS=false",
+	)
+	output, err := os.Create(filepath.Join(dir, "proxy.log"))
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = output, output
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	stop = func() {
+		cmd.Process.Signal(os.Interrupt)
+		cmd.Wait()
+		output.Close()
+	}
+
+	client := env.client(true)
+	err = waitFor(ctx, "aegis-proxy", 60*time.Second, func(ctx context.Context) error {
+		if cmd.ProcessState != nil {
+			return fmt.Errorf("exited: %s", cmd.ProcessState)
+		}
+		resp, err := client.Get(env.proxyURL + "/readyz")
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("/readyz: %s", resp.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		stop()
+		logs, _ := os.ReadFile(output.Name())
+		return nil, fmt.Errorf("%w\n%s", err, logs)
+	}
+	return stop, nil
+}
+
+// client returns an HTTP client of the proxy, presenting the client
+// certificate when withCert is set.
+func (s *stack) client(withCert bool) *http.Client {
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: s.pki.clientTLS(withCert)},
+	}
+}
+
+// get sends a GET for path with the token and extra headers.
+func (s *stack) get(t *testing.T, path, token string, headers ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.proxyURL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := s.client(true).Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// upstreamRequest returns the request the stub upstream received with the
+// request ID, or nil.
+func (s *stack) upstreamRequest(id string) *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, r := range s.upstream {
+		if r.Header.Get("X-Request-Id") == id {
+			return r
+		}
+	}
+	return nil
+}
+
+// accessLog waits for the access log of the request ID on Kafka.
+func (s *stack) accessLog(t *testing.T, id string) map[string]interface{} {
+	t.Helper()
+	consumer, err := sarama.NewConsumer(s.brokers, sarama.NewConfig())
+	if err != nil {
+		t.Fatalf("kafka consumer: %v", err)
+	}
+	defer consumer.Close()
+	partition, err := consumer.ConsumePartition(accessLogTopic, 0, sarama.OffsetOldest)
+	if err != nil {
+		t.Fatalf("consuming %s: %v", accessLogTopic, err)
+	}
+	defer partition.Close()
+
+	timeout := time.After(30 * time.Second)
+	for {
+		select {
+		case msg := <-partition.Messages():
+			var entry map[string]interface{}
+			if json.Unmarshal(msg.Value, &entry) == nil && entry["request_id"] == id {
+				return entry
+			}
+		case <-timeout:
+			t.Fatalf("no access log with request_id %s on %s", id, accessLogTopic)
+			return nil
+		}
+	}
+}
+
+func TestAllowedRequestIsProxiedAndLogged(t *testing.T) {
+	resp := env.get(t, "/api/orders", env.pki.token("alice"))
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %s, want 200: %s", resp.Status, body)
+	}
+	if want := `{"path": "/api/orders"}`; string(body) != want {
+		t.Errorf("body %s, want the upstream's %s", body, want)
+	}
+
+	id := resp.Header.Get("X-Request-Id")
+	if id == "" {
+		t.Fatal("response has no X-Request-Id")
+	}
+	upstream := env.upstreamRequest(id)
+	if upstream == nil {
+		t.Fatalf("upstream didn't receive request %s", id)
+	}
+	if got := upstream.Header.Get("X-Forwarded-By"); got != "aegis-zero" {
+		t.Errorf("upstream X-Forwarded-By %q, want aegis-zero", got)
+	}
+
+	entry := env.accessLog(t, id)
+	if entry["method"] != http.MethodGet || entry["status"] != float64(http.StatusOK) {
+		t.Errorf("access log %v, want GET with status 200", entry)
+	}
+	if entry["features"] == nil {
+		t.Errorf("access log has no features: %v", entry)
+	}
+}
+
+func TestClientCertificateRequired(t *testing.T) {
+	_, err := env.client(false).Get(env.proxyURL + "/api/orders")
+	if err == nil {
+		t.Fatal("request without a client certificate succeeded")
+	}
+}
+
+func TestTokenRequired(t *testing.T) {
+	for name, token := range map[string]string{
+		"missing": "",
+		"garbage": "not.a.jwt",
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp := env.get(t, "/api/orders", token)
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("status %s, want 401", resp.Status)
+			}
+		})
+	}
+}
+
+func TestBlockedClientIsRefused(t *testing.T) {
+	ctx := context.Background()
+	const ip = "203.0.113.77"
+	if err := env.redis.Set(ctx, "blocklist:ip:"+ip, `{"reason": "integration"}`, time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { env.redis.Del(ctx, "blocklist:ip:"+ip) })
+
+	resp := env.get(t, "/api/orders", env.pki.token("bob"), "X-Forwarded-For", ip)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("status %s, want 403", resp.Status)
+	}
+	if env.upstreamRequest(resp.Header.Get("X-Request-Id")) != nil {
+		t.Error("blocked request reached the upstream")
+	}
+
+	// Other clients are unaffected
+	resp = env.get(t, "/api/orders", env.pki.token("bob"), "X-Forwarded-For", "203.0.113.78")
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("unblocked client: status %s, want 200", resp.Status)
+	}
+}
+
+func TestBlockedSubjectIsRefused(t *testing.T) {
+	ctx := context.Background()
+	if err := env.redis.Set(ctx, "blocklist:subject:mallory", `{"reason": "integration"}`, time.Minute).Err(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { env.redis.Del(ctx, "blocklist:subject:mallory") })
+
+	resp := env.get(t, "/api/orders", env.pki.token("mallory"))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("status %s, want 403", resp.Status)
+	}
+}
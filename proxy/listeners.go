@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/tcpproxy"
+)
+
+// newListenerServer creates the HTTP server for one configured listener.
+func newListenerServer(cfg *config.Config, l config.Listener, handler http.Handler, material *tlsMaterial) *http.Server {
+	server := &http.Server{
+		Addr:         l.Address,
+		Handler:      handler,
+		ReadTimeout:  cfg.ServerReadTimeout.Std(),
+		WriteTimeout: cfg.ServerWriteTimeout.Std(),
+		IdleTimeout:  cfg.ServerIdleTimeout.Std(),
+
+		ReadHeaderTimeout: cfg.ServerReadHeaderTimeout.Std(),
+	}
+	if l.Handler == "proxy" && cfg.MinTransferRate > 0 {
+		server.Handler = minTransferRate(handler, int64(cfg.MinTransferRate), cfg.MinTransferRateGrace.Std())
+	}
+
+	switch l.TLS {
+	case "mtls":
+		server.TLSConfig = material.serverConfig(tls.RequireAndVerifyClientCert, l.Handler == "admin")
+	case "tls":
+		server.TLSConfig = material.serverConfig(tls.NoClientCert, false)
+	}
+
+	// CONNECT tunnels take over the connection, which HTTP/2 doesn't allow
+	if l.Handler == "egress" {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+	}
+
+	// Verdict push streams stay open as long as the AI engine runs
+	if l.Handler == "verdicts" {
+		server.ReadTimeout, server.WriteTimeout = 0, 0
+	}
+
+	// gRPC runs over HTTP/2, which Envoy and gRPC clients speak in
+	// cleartext unless configured with TLS
+	if l.Handler == "extauthz" || l.Handler == "verdicts" {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP2(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+		if server.TLSConfig != nil {
+			getConfig := server.TLSConfig.GetConfigForClient
+			server.TLSConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				c, err := getConfig(hello)
+				if c != nil {
+					c.NextProtos = []string{"h2"}
+				}
+				return c, err
+			}
+		}
+	}
+	return server
+}
+
+// newTCPServer creates the relay for a "tcp" listener, which checks the
+// blocklist for each connection and ships a flow record when it closes.
+func newTCPServer(cfg *config.Config, l config.Listener, material *tlsMaterial, opts tcpproxy.Options) *tcpproxy.Server {
+	opts.Name, opts.Upstream = l.Name, l.Upstream
+	opts.HandshakeTimeout = cfg.ServerReadHeaderTimeout.Std()
+	opts.DialTimeout = cfg.UpstreamDialTimeout.Std()
+	opts.Topic = cfg.KafkaFlowTopic
+	switch l.TLS {
+	case "mtls":
+		opts.TLS = material.serverConfig(tls.RequireAndVerifyClientCert, false)
+	case "tls":
+		opts.TLS = material.serverConfig(tls.NoClientCert, false)
+	}
+	return tcpproxy.NewServer(opts)
+}
+
+// acceptOptions decide how a listener accepts connections.
+type acceptOptions struct {
+	loops   int
+	limiter *connLimiter // nil without connection limits
+	// proxyTrusted, if set, are the load balancers whose PROXY protocol
+	// headers are read
+	proxyTrusted []*net.IPNet
+	proxyTimeout time.Duration
+	// bound, if set, is marked done once the listener's sockets are open
+	bound *sync.WaitGroup
+}
+
+// serveListener runs the server until it is shut down. With more than one
+// accept loop, each accepts on its own socket bound to the address with
+// SO_REUSEPORT, and the kernel spreads connections across them, so a single
+// accept loop doesn't limit the connection rate on many-core nodes. Client
+// addresses are recovered from PROXY protocol headers before connection
+// limits are applied, so they count clients rather than load balancers.
+func serveListener(l config.Listener, server *http.Server, opts acceptOptions) {
+	log.Printf("Starting %s listener on %s (tls: %s, handler: %s, accept loops: %d, proxy protocol: %t)",
+		l.Name, l.Address, l.TLS, l.Handler, opts.loops, opts.proxyTrusted != nil)
+
+	acceptAll(l, opts, http.ErrServerClosed, func(ln net.Listener) error {
+		if server.TLSConfig != nil {
+			return server.ServeTLS(ln, "", "")
+		}
+		return server.Serve(ln)
+	})
+}
+
+// serveTCPListener relays the connections of a "tcp" listener until it is
+// shut down, accepting them as serveListener does.
+func serveTCPListener(l config.Listener, server *tcpproxy.Server, opts acceptOptions) {
+	log.Printf("Starting %s listener on %s (tls: %s, handler: tcp, upstream: %s, accept loops: %d, proxy protocol: %t)",
+		l.Name, l.Address, l.TLS, l.Upstream, opts.loops, opts.proxyTrusted != nil)
+	acceptAll(l, opts, tcpproxy.ErrServerClosed, server.Serve)
+}
+
+// acceptAll opens the listener's sockets and serves each with serve, until
+// every one returns closed.
+func acceptAll(l config.Listener, opts acceptOptions, closed error, serve func(net.Listener) error) {
+	listeners, err := listen(l.Address, opts.loops)
+	if err != nil {
+		log.Fatalf("Server error on %s listener: %v", l.Name, err)
+	}
+	if opts.bound != nil {
+		opts.bound.Done()
+	}
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		if opts.proxyTrusted != nil {
+			ln = newProxyProtoListener(ln, opts.proxyTrusted, opts.proxyTimeout)
+		}
+		ln = opts.limiter.wrap(ln)
+		go func(ln net.Listener) {
+			errs <- serve(ln)
+		}(ln)
+	}
+	for range listeners {
+		if err := <-errs; err != closed {
+			log.Fatalf("Server error on %s listener: %v", l.Name, err)
+		}
+	}
+}
+
+// listen opens loops TCP sockets on address, sharing it with SO_REUSEPORT
+// when there is more than one.
+func listen(address string, loops int) ([]net.Listener, error) {
+	if loops <= 1 {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Listener{ln}, nil
+	}
+
+	lc := net.ListenConfig{Control: reusePort}
+	listeners := make([]net.Listener, 0, loops)
+	for i := 0; i < loops; i++ {
+		ln, err := lc.Listen(context.Background(), "tcp", address)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// shutdownServers gracefully stops every server in parallel, letting
+// in-flight requests and relayed connections finish until ctx expires.
+func shutdownServers(ctx context.Context, servers []*http.Server, relays map[string]*tcpproxy.Server) {
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("Shutdown error on %s: %v", server.Addr, err)
+			}
+		}(server)
+	}
+	for name, relay := range relays {
+		wg.Add(1)
+		go func(name string, relay *tcpproxy.Server) {
+			defer wg.Done()
+			if err := relay.Shutdown(ctx); err != nil {
+				log.Printf("Shutdown error on %s: %v", name, err)
+			}
+		}(name, relay)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,119 @@
+// Package logging adds a verbosity level to the standard logger for
+// per-request messages. Startup and configuration messages are always logged.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// Level is a log verbosity.
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = map[string]Level{"debug": Debug, "info": Info, "warn": Warn, "error": Error}
+
+var current atomic.Int32
+
+func init() {
+	current.Store(int32(Info))
+}
+
+// ParseLevel parses "debug", "info", "warn" or "error".
+func ParseLevel(name string) (Level, error) {
+	level, ok := levelNames[name]
+	if !ok {
+		return Info, fmt.Errorf("unknown log level %q (use debug, info, warn or error)", name)
+	}
+	return level, nil
+}
+
+// SetLevel changes the verbosity; messages below it are dropped.
+func SetLevel(level Level) {
+	current.Store(int32(level))
+}
+
+// Enabled reports whether messages at level are logged.
+func Enabled(level Level) bool {
+	return level >= Level(current.Load())
+}
+
+// Debugf logs per-request detail, such as authenticated users.
+func Debugf(format string, args ...interface{}) {
+	logf(Debug, format, args...)
+}
+
+// Infof logs per-request enforcement, such as blocked clients.
+func Infof(format string, args ...interface{}) {
+	logf(Info, format, args...)
+}
+
+// Warnf logs degraded operation, such as failing dependencies.
+func Warnf(format string, args ...interface{}) {
+	logf(Warn, format, args...)
+}
+
+func logf(level Level, format string, args ...interface{}) {
+	if Enabled(level) {
+		log.Output(3, fmt.Sprintf(format, args...))
+	}
+}
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying a request's ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the ID of the request ctx belongs to, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Logger logs the messages of one request, each ending with its ID so they
+// can be found alongside the request's access log, verdicts and upstream
+// traces.
+type Logger struct {
+	id string
+}
+
+// For returns the logger of the request ctx belongs to.
+func For(ctx context.Context) Logger {
+	return Logger{id: RequestID(ctx)}
+}
+
+// Debugf logs per-request detail, such as authenticated users.
+func (l Logger) Debugf(format string, args ...interface{}) {
+	l.logf(Debug, format, args...)
+}
+
+// Infof logs per-request enforcement, such as blocked clients.
+func (l Logger) Infof(format string, args ...interface{}) {
+	l.logf(Info, format, args...)
+}
+
+// Warnf logs degraded operation, such as failing dependencies.
+func (l Logger) Warnf(format string, args ...interface{}) {
+	l.logf(Warn, format, args...)
+}
+
+func (l Logger) logf(level Level, format string, args ...interface{}) {
+	if !Enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if l.id != "" {
+		msg += " request_id=" + l.id
+	}
+	log.Output(3, msg)
+}
@@ -2,22 +2,56 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/admin"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/central"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/cluster"
 	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/extauthz"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/geoip"
 	"github.com/rajeev-chaurasia/aegis-zero/proxy/handler"
-	"github.com/rajeev-chaurasia/aegis-zero/proxy/middleware"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/ingress"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/notify"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/openapi"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/tcpproxy"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/verdictpush"
 )
 
 func main() {
+	validate := flag.Bool("validate", false, "validate configuration and connectivity, then exit")
+	flag.Parse()
+	if err := loadPlugins(); err != nil {
+		log.Fatalf("Failed to load plugins: %v", err)
+	}
+	allowRegisteredStages()
+	if *validate || flag.Arg(0) == "check" {
+		os.Exit(runCheck())
+	}
+
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	log.Println("============================================")
 	log.Println("  Aegis Zero - AI-Powered Zero Trust Proxy")
@@ -29,103 +63,1509 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	logEffectiveConfig(cfg)
+
+	if cfg.AutoGOMAXPROCS {
+		tuneGOMAXPROCS()
+	}
+
+	level, _ := logging.ParseLevel(cfg.LogLevel)
+	logging.SetLevel(level)
+	if cfg.Preset != "" {
+		log.Printf("Preset: %s (log level %s, TLS %s, fail open %t)", cfg.Preset, cfg.LogLevel, cfg.TLSPolicy, cfg.FailOpen)
+	}
+	if fips, err = checkFIPS(cfg); err != nil {
+		log.Fatalf("FIPS: %v", err)
+	}
+	log.Printf("FIPS: mode %t, build tag %t, crypto module %s (active %t)", fips.Mode, fips.Build, fips.Module, fips.Enabled)
+
+	// Pages for responses the proxy writes itself
+	pageSet, err := pages.Load(cfg.PagesDir, cfg.SupportContact)
+	if err != nil {
+		log.Fatalf("Failed to load pages: %v", err)
+	}
+	pages.Use(pageSet)
+
 	// Initialize middleware components
-	blocklistMiddleware, err := middleware.NewBlocklistMiddleware(cfg.RedisURL)
+	redisClient, err := middleware.NewRedisClient(cfg.RedisURL)
 	if err != nil {
-		log.Fatalf("Failed to initialize blocklist middleware: %v", err)
+		log.Fatalf("Failed to connect to Redis: %v", err)
 	}
-	defer blocklistMiddleware.Close()
+	defer redisClient.Close()
 
-	jwtMiddleware := middleware.NewJWTMiddleware(cfg.JWTPublicKey)
+	// Dynamic policy pushed to the fleet overrides the local file and env
+	centralSource, centralSnapshot := loadCentralConfig(cfg, redisClient)
 
-	loggerMiddleware, err := middleware.NewLoggerMiddleware(cfg.KafkaBrokers, cfg.KafkaTopic)
+	eventSink, err := newEventBus(cfg)
 	if err != nil {
-		log.Fatalf("Failed to initialize logger middleware: %v", err)
+		log.Fatalf("Failed to initialize %s producer: %v", cfg.EventBus, err)
+	}
+	defer eventSink.Close()
+
+	auditor := middleware.NewAuditor(eventSink, cfg.KafkaAuditTopic)
+	// Tamper-evident copy of the audit trail, checked with aegisctl audit
+	if cfg.AuditChainPath != "" {
+		auditChain, err := middleware.NewAuditChain(middleware.AuditChainOptions{
+			Path:               cfg.AuditChainPath,
+			Key:                cfg.AuditChainSigningKey,
+			CheckpointInterval: cfg.AuditCheckpointInterval.Std(),
+			Node:               cfg.ClusterNode,
+		})
+		if err != nil {
+			log.Fatalf("Failed to open audit chain: %v", err)
+		}
+		defer auditChain.Close()
+		auditor.Subscribe(auditChain.Observe)
+		log.Printf("Audit chain: %s, checkpoints every %s, key ID %s", cfg.AuditChainPath, cfg.AuditCheckpointInterval, auditChain.KeyID())
+	}
+	decisionStore := middleware.NewDecisionStore(redisClient, time.Duration(cfg.DecisionTTLSeconds)*time.Second)
+	defer decisionStore.Close()
+
+	// Rolling aggregates for dashboards, fed by scores and refused requests
+	aggregates := middleware.NewRiskAggregator(middleware.AggregatorConfig{
+		Window: cfg.AggregateWindow.Std(),
+		TopN:   cfg.AggregateTopN,
+	})
+	auditor.Subscribe(aggregates.ObserveAudit)
+
+	// Audit events and decisions streamed to admin clients, e.g. aegisctl tail
+	adminEvents := admin.NewEventStream()
+	auditor.Subscribe(adminEvents.Publish)
+
+	blocklistMiddleware := middleware.NewBlocklistMiddleware(redisClient, auditor, decisionStore, cfg.FailOpen)
+	blocklistMiddleware.SetQuarantinePaths(cfg.QuarantinePaths)
+	// Blocks made by this replica, or announced by the others, are enforced
+	// before Redis answers
+	recentBlocks := middleware.NewRecentBlocks()
+	blocklistMiddleware.SetRecentBlocks(recentBlocks)
+
+	// Repeat offenders are blocked for longer, whoever writes the block
+	var escalation *middleware.BlockEscalation
+	if len(cfg.BlockEscalation) > 0 {
+		escalation = middleware.NewBlockEscalation(redisClient, newBlockEscalation(cfg))
+		blocklistMiddleware.SetEscalation(escalation)
+		log.Printf("Block escalation: %v, offenses forgotten %s after a block ends", cfg.BlockEscalation, cfg.BlockEscalationDecay)
+	}
+
+	// Fleet-wide kill switch; a proxy started while it is engaged stays in monitor mode
+	killSwitch := middleware.NewKillSwitch(redisClient, cfg.KillSwitchKey, auditor)
+	if err := killSwitch.Load(context.Background()); err != nil {
+		log.Printf("[KillSwitch] Failed to read state, starting released: %v", err)
+	}
+
+	// GeoIP locations and networks, loaded once for travel, familiarity and
+	// the ASN allowlist
+	var geo *geoip.DB
+	if len(cfg.GeoIPDatabases) > 0 && (cfg.HasStage("travel") || cfg.HasStage("familiarity") || len(cfg.GuardrailAllowASNs) > 0) {
+		var err error
+		if geo, err = geoip.Open(cfg.GeoIPDatabases...); err != nil {
+			log.Fatalf("Failed to load GeoIP databases: %v", err)
+		}
+		log.Printf("GeoIP: %d networks", geo.Networks())
+	}
+
+	// Alerts when automated enforcement looks like it's running away; the
+	// blocklist monitor's guardrails in GUARDRAIL_REVERT engage the kill
+	// switch
+	guardrails := middleware.NewGuardrailAlerts(redisClient, cfg.ClusterNode)
+	guardrails.RevertWith(killSwitch, cfg.GuardrailRevert...)
+
+	// Caps on automated enforcement, consulted by every stage that blocks
+	enforcementGuard := middleware.NewEnforcementGuard(redisClient, guardrails, middleware.EnforcementGuardOptions{
+		MaxBlockedPercent: cfg.GuardrailMaxBlockedPercent,
+		Window:            cfg.GuardrailWindow.Std(),
+		MinClients:        cfg.GuardrailMinClients,
+		AllowASNs:         cfg.GuardrailAllowASNs,
+		AllowSubjects:     cfg.GuardrailAllowSubjects,
+		GeoIP:             geo,
+	})
+	blocklistMiddleware.SetGuard(enforcementGuard)
+	blocklistMiddleware.SetKillSwitch(killSwitch)
+
+	// Decoy paths that are never proxied; hits mark the client as malicious
+	var honeypotMiddleware *middleware.HoneypotMiddleware
+	if len(cfg.HoneypotPaths) > 0 {
+		honeypotMiddleware = middleware.NewHoneypotMiddleware(redisClient, eventSink, auditor, middleware.HoneypotOptions{
+			Paths:      cfg.HoneypotPaths,
+			Score:      cfg.HoneypotScore,
+			ScoreTTL:   time.Duration(cfg.HoneypotScoreTTLSeconds) * time.Second,
+			AutoBlock:  cfg.HoneypotAutoBlock,
+			BlockTTL:   time.Duration(cfg.HoneypotBlockTTLSeconds) * time.Second,
+			Recent:     recentBlocks,
+			Escalation: escalation,
+			Guard:      enforcementGuard,
+			KillSwitch: killSwitch,
+			LabelTopic: cfg.KafkaHoneypotTopic,
+		})
+		log.Printf("Honeypot paths: %v", cfg.HoneypotPaths)
+	}
+
+	jwtMiddleware := middleware.NewJWTMiddleware(cfg.JWTPublicKey)
+	jwtMiddleware.SetLeeway(cfg.JWTLeeway.Std())
+	jwtMiddleware.SetExpiryWarning(cfg.JWTExpiryWarning.Std())
+	jwtMiddleware.SetSubjectBlocklist(blocklistMiddleware)
+
+	// Route profiles pick the model and response policy per endpoint
+	routeProfiles := middleware.NewRouteProfiles(newRouteProfiles(cfg))
+
+	// In sidecar mode, access logs name the pod
+	var side *sidecar
+	var pod *middleware.PodInfo
+	if cfg.SidecarMode {
+		side = newSidecar(cfg.SidecarDrainDelay.Std())
+		pod = side.pod
+		log.Printf("Sidecar mode: pod %s/%s on %s, drain delay %s", pod.Namespace, pod.Name, pod.Node, cfg.SidecarDrainDelay)
+	}
+
+	// In the cloud, access logs locate the instance; without the metadata
+	// they are sent as before
+	var cloud *middleware.CloudInfo
+	if cfg.CloudMetadata != "off" {
+		cloud, err = detectCloud(context.Background(), cfg.CloudMetadata, cfg.CloudCluster)
+		if err != nil {
+			log.Printf("[Cloud] Failed to read instance metadata, access logs won't carry it: %v", err)
+		} else {
+			log.Printf("Cloud: %s %s in %s (zone %s, cluster %q)", cloud.Provider, cloud.InstanceID, cloud.Region, cloud.Zone, cloud.Cluster)
+		}
+	}
+
+	loggerMiddleware := middleware.NewLoggerMiddleware(eventSink, middleware.LoggerOptions{
+		AccessLogTopic:    cfg.KafkaTopic,
+		FeatureTopic:      cfg.KafkaFeaturesTopic,
+		AccessLogFeatures: cfg.AccessLogFeatures,
+		Profiles:          routeProfiles,
+		SampleRate:        cfg.AccessLogSampleRate,
+		ShipWorkers:       cfg.LogShipWorkers,
+		ShipQueueSize:     cfg.LogShipQueueSize,
+		ShipOverflow:      cfg.LogShipOverflow,
+		Pod:               pod,
+		Cloud:             cloud,
+	})
+
+	// Optional verdict-driven enforcement, decoupled from the Redis schema:
+	// verdicts come from Kafka, or are pushed by the AI engine over gRPC
+	var verdictMiddleware *middleware.VerdictMiddleware
+	var verdictStore *middleware.VerdictStore
+	var verdictLimiter *middleware.RateLimiter
+	if cfg.KafkaVerdictTopic != "" || cfg.HasListener("verdicts") {
+		verdictStore = middleware.NewVerdictStore(time.Duration(cfg.VerdictTTLSeconds) * time.Second)
+		if cfg.KafkaVerdictTopic != "" {
+			verdictConsumer, err := middleware.NewVerdictConsumer(cfg.KafkaBrokers, cfg.KafkaVerdictTopic, verdictStore)
+			if err != nil {
+				log.Fatalf("Failed to initialize verdict consumer: %v", err)
+			}
+			defer verdictConsumer.Close()
+		}
+
+		verdictLimiter = middleware.NewRateLimiter(cfg.VerdictRateLimitRPS, cfg.VerdictRateLimitBurst)
+		verdictMiddleware = middleware.NewVerdictMiddleware(verdictStore, verdictLimiter, auditor)
+		verdictMiddleware.SetGuard(enforcementGuard)
+		verdictMiddleware.SetKillSwitch(killSwitch)
+	}
+
+	// Scorers in priority order: honeypot hits, inline service, local verdicts,
+	// then the Redis cache. The heuristic stage's score is the fallback.
+	var scorers []middleware.Scorer
+	scoringTimeout := cfg.ScoringTimeout.Std()
+	if honeypotMiddleware != nil {
+		scorers = append(scorers, honeypotMiddleware)
+	}
+	if cfg.ScoringURL != "" {
+		scorers = append(scorers, middleware.NewHTTPScorer(cfg.ScoringURL, "", scoringTimeout))
+	}
+	if verdictStore != nil {
+		scorers = append(scorers, verdictStore)
+	}
+	scorers = append(scorers, middleware.NewRedisScoreCache(redisClient))
+
+	responseLimiter := middleware.NewRateLimiter(cfg.ResponseRateLimitRPS, cfg.ResponseRateLimitBurst)
+	responderOpts := middleware.ResponderOptions{
+		TarpitDelay:  time.Duration(cfg.TarpitDelayMs) * time.Millisecond,
+		TempBlockTTL: time.Duration(cfg.TempBlockTTLSeconds) * time.Second,
+		Limiter:      responseLimiter,
+		Recent:       recentBlocks,
+		Guard:        enforcementGuard,
+		Escalation:   escalation,
+
+		ReauthClearance: cfg.ReauthClearance.Std(),
+	}
+
+	// Interactive challenges; without them challenged clients are refused
+	var botChallenger *middleware.BotChallenger
+	if cfg.ChallengeMode != "deny" {
+		botChallenger = middleware.NewBotChallenger(middleware.BotChallengeOptions{
+			Kind:         cfg.ChallengeMode,
+			Secret:       []byte(cfg.ChallengeSecret),
+			Difficulty:   cfg.ChallengeDifficulty,
+			ClearanceTTL: cfg.ChallengeClearanceTTL.Std(),
+			CookieName:   cfg.ChallengeCookieName,
+			Path:         cfg.ChallengePath,
+			Captcha:      middleware.CaptchaProviders[cfg.CaptchaProvider],
+			SiteKey:      cfg.CaptchaSiteKey,
+			SecretKey:    cfg.CaptchaSecretKey,
+			Limiter:      middleware.NewRateLimiter(1, 5),
+		})
+		responderOpts.Challenger = botChallenger
+		if verdictMiddleware != nil {
+			verdictMiddleware.SetChallenger(botChallenger)
+		}
+		log.Printf("Challenges: %s, solutions posted to %s", cfg.ChallengeMode, cfg.ChallengePath)
+	}
+
+	responder := middleware.NewResponder(redisClient, responderOpts)
+	scoringOpts := middleware.ScoringOptions{
+		Profiles:    routeProfiles,
+		Enforce:     cfg.EnforcementMode == "enforce" && !killSwitch.Engaged(),
+		Responder:   responder,
+		Decisions:   decisionStore,
+		TopFeatures: cfg.DecisionTopFeatures,
+		Auditor:     auditor,
+		Aggregates:  aggregates,
+	}
+	if cfg.ScoreSmoothing != "none" {
+		scoringOpts.Smoother = middleware.NewScoreSmoother(newSmoothingConfig(cfg))
+	}
+	if cfg.ScoringShadowURL != "" {
+		scoringOpts.Shadow = middleware.NewHTTPScorer(cfg.ScoringShadowURL, cfg.ScoringShadowModel, scoringTimeout)
+		log.Printf("Shadow scoring: %s (%s)", cfg.ScoringShadowModel, cfg.ScoringShadowURL)
+	}
+	scoringMiddleware := middleware.NewScoringMiddleware(scoringOpts, scorers...)
+	scoringMiddleware.Subscribe(adminEvents.PublishScore)
+
+	// Signed webhooks to incident tooling on blocks, challenges, high scores
+	// and guardrail trips
+	if len(cfg.WebhookURLs) > 0 {
+		webhooks := notify.NewWebhooks(notify.Options{
+			URLs:           cfg.WebhookURLs,
+			Secret:         cfg.WebhookSecret,
+			Events:         cfg.WebhookEvents,
+			ScoreThreshold: cfg.WebhookScoreThreshold,
+			MaxRetries:     cfg.WebhookMaxRetries,
+			Timeout:        cfg.WebhookTimeout.Std(),
+			Cooldown:       cfg.WebhookCooldown.Std(),
+		})
+		auditor.Subscribe(webhooks.ObserveAudit)
+		scoringMiddleware.Subscribe(webhooks.ObserveScore)
+		guardrails.Subscribe(webhooks.ObserveGuardrail)
+		log.Printf("Webhooks: %d endpoints for %v", len(cfg.WebhookURLs), cfg.WebhookEvents)
+	}
+
+	// Built-in echo backend standing in for the upstreams
+	if cfg.MockUpstream {
+		if err := startMockUpstream(cfg); err != nil {
+			log.Fatalf("Failed to start mock upstream: %v", err)
+		}
 	}
-	defer loggerMiddleware.Close()
 
 	// Initialize proxy handler
-	proxyHandler, err := handler.NewProxyHandler(cfg.UpstreamURL)
+	egress, err := handler.NewEgressPolicy(cfg.UpstreamAllowedHosts, cfg.UpstreamAllowedCIDRs)
+	if err != nil {
+		log.Fatalf("Invalid upstream egress policy: %v", err)
+	}
+	discovery, err := newDiscovery(cfg)
+	if err != nil {
+		log.Fatalf("Invalid upstream discovery: %v", err)
+	}
+	// Forwarded requests signed so upstreams can tell they came through here
+	var signer *handler.RequestSigner
+	if cfg.RequestSigningKey != nil {
+		signer, err = handler.NewRequestSigner(cfg.RequestSigningKey, cfg.RequestSigningTTL.Std())
+		if err != nil {
+			log.Fatalf("Invalid request signing key: %v", err)
+		}
+		log.Printf("Request signing: %s, key ID %s, valid %s", signer.Algorithm(), signer.KeyID(), cfg.RequestSigningTTL)
+	}
+	proxyHandler, err := handler.NewProxyHandler(cfg.Upstreams(), handler.ProxyOptions{
+		Timeout:               cfg.UpstreamTimeout.Std(),
+		DialTimeout:           cfg.UpstreamDialTimeout.Std(),
+		Route:                 statsRoute(routeProfiles),
+		Egress:                egress,
+		BlockPrivateRedirects: cfg.UpstreamBlockPrivateRedirects,
+		TransferProgress:      cfg.TransferProgressTimeout.Std(),
+		Discovery:             discovery,
+		Routed:                cfg.IngressController != "" || cfg.VirtualHostsRouted(),
+		Signer:                signer,
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize proxy handler: %v", err)
 	}
+	proxyHandler.SetDraining(cfg.UpstreamDraining)
+
+	// Virtual hosts with their own upstreams are routed by host
+	vhostRoutes := virtualHostRoutes(cfg)
+	if len(vhostRoutes) > 0 {
+		proxyHandler.SetRoutes(vhostRoutes)
+	}
 
-	// Build middleware chain
-	// Order: Blocklist -> JWT -> Logger -> Proxy
-	var finalHandler http.Handler = proxyHandler
-	finalHandler = loggerMiddleware.Handler(finalHandler)
-	finalHandler = jwtMiddleware.Handler(finalHandler)
-	finalHandler = blocklistMiddleware.Handler(finalHandler)
+	// As an ingress controller, routes come from the cluster
+	var ingressController *ingress.Controller
+	if cfg.IngressController != "" {
+		ingressController, err = ingress.NewController(ingress.Options{
+			Kind:          cfg.IngressController,
+			Class:         cfg.IngressClass,
+			Gateway:       cfg.IngressGateway,
+			Namespace:     cfg.IngressNamespace,
+			ClusterDomain: cfg.IngressClusterDomain,
+		})
+		if err != nil {
+			log.Fatalf("Failed to start the ingress controller: %v", err)
+		}
+		log.Printf("Ingress controller: %s", ingressController)
+	}
 
-	// Add health check endpoint
-	mux := http.NewServeMux()
-	mux.HandleFunc("/health", healthCheckHandler)
-	mux.Handle("/", finalHandler)
+	// Optional per-client rate limit for all traffic
+	var stageLimiter *middleware.RateLimiter
+	stages := make(map[string]middleware.Stage)
+	add := func(name string, handler func(http.Handler) http.Handler) {
+		stages[name] = middleware.NewStage(name, handler)
+	}
+	add("blocklist", blocklistMiddleware.Handler)
+	add("jwt", jwtMiddleware.Handler)
+	add("logger", loggerMiddleware.Handler)
+	add("scoring", scoringMiddleware.Handler)
+	if honeypotMiddleware != nil {
+		add("honeypot", honeypotMiddleware.Handler)
+	}
+	if verdictMiddleware != nil {
+		add("verdicts", verdictMiddleware.Handler)
+	}
+
+	// Rule-based scores for when no model score is available
+	if cfg.HeuristicScoring {
+		add("heuristic", middleware.NewHeuristicScorer(middleware.HeuristicConfig{
+			Window:         cfg.HeuristicWindow.Std(),
+			MinRequests:    cfg.HeuristicMinRequests,
+			MaxRequestRate: cfg.HeuristicMaxRPS,
+			MaxErrorRate:   cfg.HeuristicMaxErrorRate,
+			MaxPathEntropy: cfg.HeuristicMaxPathEntropy,
+			MaxPayloadSize: int64(cfg.HeuristicMaxPayload),
+		}).Handler)
+	}
+	if cfg.HasStage("opa") {
+		add("opa", middleware.NewPolicyMiddleware(middleware.PolicyOptions{
+			URL:      cfg.OPAURL,
+			Timeout:  cfg.OPATimeout.Std(),
+			FailOpen: cfg.OPAFailOpen,
+			Auditor:  auditor,
+		}).Handler)
+		log.Printf("OPA policy: %s (fail open: %t)", cfg.OPAURL, cfg.OPAFailOpen)
+	}
+
+	// Strict HTTP parsing checks against smuggling and header confusion
+	if cfg.HasStage("protocol") {
+		add("protocol", middleware.NewProtocolMiddleware(cfg.ProtocolMode == "block", auditor).Handler)
+	}
+
+	// Attack signature inspection, scored per rule
+	if cfg.HasStage("waf") {
+		waf := middleware.NewWAFMiddleware(middleware.WAFOptions{
+			Block:     cfg.WAFMode == "block",
+			Threshold: cfg.WAFAnomalyThreshold,
+			MaxBody:   int64(cfg.WAFMaxBody),
+			Disabled:  cfg.WAFDisabledRules,
+			Auditor:   auditor,
+		})
+		add("waf", waf.Handler)
+		log.Printf("WAF: %d rules, %s mode, threshold %d", len(waf.Rules()), cfg.WAFMode, cfg.WAFAnomalyThreshold)
+	}
+
+	// Sensitive data scanning of responses
+	if cfg.HasStage("dlp") {
+		patterns := newDLPPatterns(cfg)
+		add("dlp", middleware.NewDLPMiddleware(eventSink, middleware.DLPOptions{
+			Patterns: patterns,
+			MaxBody:  int64(cfg.DLPMaxBody),
+			Topic:    cfg.KafkaDLPTopic,
+			Auditor:  auditor,
+		}).Handler)
+		log.Printf("DLP: %d patterns, default action %s, events to %s", len(patterns), cfg.DLPAction, cfg.KafkaDLPTopic)
+	}
+
+	// Declarative per-route requirements; auth none routes also skip the jwt stage
+	var routePolicies *middleware.RoutePolicies
+	if cfg.HasStage("routes") {
+		routePolicies = middleware.NewRoutePolicies(auditor, scoringMiddleware.Enforcing)
+		policies, tiers, err := newRoutePolicies(cfg)
+		if err != nil {
+			log.Fatalf("Failed to load route policies: %v", err)
+		}
+		routePolicies.Update(policies, tiers)
+		jwtMiddleware.SetRoutes(routePolicies)
+		proxyHandler.SetRouteTimeouts(routePolicies.Timeout)
+		proxyHandler.SetRouteMirrors(routePolicies.Mirror)
+		proxyHandler.SetResponseCheck(routePolicies.CheckResponse)
+		add("routes", routePolicies.Handler)
+		log.Printf("Route policies: %d, rate limit tiers: %d", len(cfg.RoutePolicies), len(cfg.RateLimitTiers))
+	}
+
+	// Inbound tokens traded for audience-scoped internal ones at the IdP
+	if cfg.HasStage("exchange") {
+		add("exchange", middleware.NewTokenExchangeMiddleware(middleware.TokenExchangeOptions{
+			URL:          cfg.TokenExchangeURL,
+			ClientID:     cfg.TokenExchangeClientID,
+			ClientSecret: cfg.TokenExchangeClientSecret,
+			Audience:     cfg.TokenExchangeAudience,
+			Scope:        cfg.TokenExchangeScope,
+			Timeout:      cfg.TokenExchangeTimeout.Std(),
+			Routes:       routePolicies,
+			Auditor:      auditor,
+		}).Handler)
+		log.Printf("Token exchange: %s (audience %q)", cfg.TokenExchangeURL, cfg.TokenExchangeAudience)
+	}
+
+	// Signed statement of the verified identity for upstreams
+	if cfg.HasStage("assertion") {
+		assertions, err := middleware.NewAssertionMiddleware(middleware.AssertionOptions{
+			Key:      cfg.AssertionSigningKey,
+			Issuer:   cfg.AssertionIssuer,
+			Audience: cfg.AssertionAudience,
+			TTL:      cfg.AssertionTTL.Std(),
+		})
+		if err != nil {
+			log.Fatalf("Invalid assertion signing key: %v", err)
+		}
+		add("assertion", assertions.Handler)
+		log.Printf("Identity assertions: issuer %s, key ID %s, valid %s", cfg.AssertionIssuer, assertions.KeyID(), cfg.AssertionTTL)
+	}
+
+	// GET responses of routes with a cache TTL, in memory and optionally Redis
+	var responseCache *middleware.ResponseCache
+	if cfg.HasStage("cache") {
+		cacheOpts := middleware.CacheOptions{MaxSize: int64(cfg.CacheMaxSize), MaxEntry: int64(cfg.CacheMaxEntry)}
+		if cfg.CacheRedis {
+			cacheOpts.Redis = redisClient
+		}
+		responseCache = middleware.NewResponseCache(routePolicies, cacheOpts)
+		add("cache", responseCache.Handler)
+		log.Printf("Response cache: %s in memory (Redis tier: %t)", cfg.CacheMaxSize, cfg.CacheRedis)
+	}
+
+	// Cross-origin policy, answered at the edge; routes may carry their own
+	var corsMiddleware *middleware.CORSMiddleware
+	if cfg.HasStage("cors") {
+		corsMiddleware = middleware.NewCORSMiddleware(newCORSPolicy(cfg.CORS), routePolicies, auditor)
+		add("cors", corsMiddleware.Handler)
+		log.Printf("CORS: allowed origins %v", cfg.CORS.AllowedOrigins)
+	}
+
+	// Double-submit CSRF tokens for cookie-authenticated browser routes
+	if cfg.HasStage("csrf") {
+		add("csrf", middleware.NewCSRFMiddleware(routePolicies, middleware.CSRFOptions{
+			Secret:     []byte(cfg.CSRFSecret),
+			CookieName: cfg.CSRFCookieName,
+			HeaderName: cfg.CSRFHeaderName,
+			FieldName:  cfg.CSRFFieldName,
+			Session:    cfg.CSRFSessionCookie,
+			Auditor:    auditor,
+		}).Handler)
+	}
+
+	// OIDC logins at the edge for browser apps, tokens kept in Redis
+	if cfg.HasStage("session") {
+		sessions, err := middleware.NewSessionMiddleware(redisClient, middleware.SessionOptions{
+			AuthorizeURL:   cfg.OIDCAuthorizeURL,
+			TokenURL:       cfg.OIDCTokenURL,
+			ClientID:       cfg.OIDCClientID,
+			ClientSecret:   cfg.OIDCClientSecret,
+			RedirectURL:    cfg.OIDCRedirectURL,
+			Scopes:         cfg.OIDCScopes,
+			CookieName:     cfg.SessionCookieName,
+			TTL:            cfg.SessionTTL.Std(),
+			LogoutPath:     cfg.SessionLogoutPath,
+			LogoutRedirect: cfg.SessionLogoutRedirect,
+			Timeout:        cfg.OIDCTimeout.Std(),
+			Auditor:        auditor,
+		})
+		if err != nil {
+			log.Fatalf("Invalid OIDC_REDIRECT_URL: %v", err)
+		}
+		add("session", sessions.Handler)
+		log.Printf("Browser sessions: OIDC client %s, callback %s", cfg.OIDCClientID, cfg.OIDCRedirectURL)
+	}
+
+	// Nonce and timestamp checks against replayed machine API requests
+	if cfg.HasStage("replay") {
+		add("replay", middleware.NewReplayMiddleware(redisClient, routePolicies, middleware.ReplayOptions{
+			NonceHeader:     cfg.ReplayNonceHeader,
+			TimestampHeader: cfg.ReplayTimestampHeader,
+			Window:          cfg.ReplayWindow.Std(),
+			FailOpen:        cfg.FailOpen,
+			Auditor:         auditor,
+		}).Handler)
+	}
+
+	// Security headers on every response, with per-route overrides
+	var headersMiddleware *middleware.SecurityHeadersMiddleware
+	if cfg.HasStage("headers") {
+		headersMiddleware = middleware.NewSecurityHeadersMiddleware(newSecurityHeaders(cfg.SecurityHeaders), routePolicies)
+		add("headers", headersMiddleware.Handler)
+	}
+
+	if cfg.HasStage("ratelimit") {
+		stageLimiter = middleware.NewRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst)
+		add("ratelimit", middleware.NewRateLimitMiddleware(stageLimiter, auditor).Handler)
+	}
+
+	// Adaptive concurrency limit, shedding anonymous and risky traffic first
+	if cfg.HasStage("shed") {
+		add("shed", middleware.NewLoadShedder(middleware.LoadShedOptions{
+			MinLimit:     cfg.ShedMinLimit,
+			MaxLimit:     cfg.ShedMaxLimit,
+			InitialLimit: cfg.ShedInitialLimit,
+			Tolerance:    cfg.ShedLatencyTolerance,
+			RetryAfter:   cfg.ShedRetryAfter.Std(),
+			LowRisk:      cfg.ShedLowRisk,
+		}).Handler)
+		log.Printf("Load shedding: concurrency limit %d (%d-%d)", cfg.ShedInitialLimit, cfg.ShedMinLimit, cfg.ShedMaxLimit)
+	}
+
+	// Time windows for routes and identities, refusing or flagging the rest
+	if cfg.HasStage("schedule") {
+		schedules := make([]middleware.Schedule, len(cfg.Schedules))
+		for i, s := range cfg.Schedules {
+			window, _ := s.Window() // Checked by config validation
+			schedules[i] = middleware.Schedule{
+				Name:     s.Name,
+				Prefix:   s.Prefix,
+				Claims:   s.Claims,
+				Days:     window.Days,
+				Start:    window.Start,
+				End:      window.End,
+				Location: window.Location,
+				Flag:     s.Action == "flag",
+			}
+			if len(s.Subjects) > 0 {
+				schedules[i].Subjects = make(map[string]bool, len(s.Subjects))
+				for _, subject := range s.Subjects {
+					schedules[i].Subjects[subject] = true
+				}
+			}
+		}
+		add("schedule", middleware.NewScheduleMiddleware(schedules, auditor).Handler)
+		log.Printf("Schedules: %d", len(schedules))
+	}
+
+	// Per-client requests in flight, queueing briefly before refusing
+	if cfg.HasStage("concurrency") {
+		add("concurrency", middleware.NewConcurrencyMiddleware(middleware.ConcurrencyOptions{
+			Limit:        cfg.ConcurrencyLimit,
+			Queue:        cfg.ConcurrencyQueue,
+			QueueTimeout: cfg.ConcurrencyQueueTimeout.Std(),
+			BySubject:    cfg.ConcurrencyKey == "subject",
+		}, auditor).Handler)
+		log.Printf("Concurrency: %d in flight per %s, %d queued for %s", cfg.ConcurrencyLimit, cfg.ConcurrencyKey, cfg.ConcurrencyQueue, cfg.ConcurrencyQueueTimeout)
+	}
+
+	// Impossible travel between a subject's requests, by GeoIP location
+	if cfg.HasStage("travel") {
+		add("travel", middleware.NewTravelMiddleware(redisClient, middleware.TravelOptions{
+			GeoIP:       geo,
+			MaxSpeed:    cfg.TravelMaxSpeed,
+			MinDistance: cfg.TravelMinDistance,
+			Action:      middleware.Action(cfg.TravelAction),
+			Responder:   responder,
+			KillSwitch:  killSwitch,
+		}, auditor).Handler)
+		log.Printf("Travel: over %.0f km/h is impossible (%s)", cfg.TravelMaxSpeed, cfg.TravelAction)
+	}
+
+	// Devices and networks new to a subject, remembered in Redis
+	if cfg.HasStage("familiarity") {
+		add("familiarity", middleware.NewFamiliarityMiddleware(redisClient, middleware.FamiliarityOptions{
+			GeoIP:       geo,
+			History:     cfg.FamiliarityHistory.Std(),
+			Action:      middleware.Action(cfg.FamiliarityAction),
+			StepUpOnAny: cfg.FamiliarityTrigger == "any",
+			Responder:   responder,
+			KillSwitch:  killSwitch,
+		}, auditor).Handler)
+		log.Printf("Familiarity: %s of history, %s on unfamiliar access (%s)", cfg.FamiliarityHistory, cfg.FamiliarityAction, cfg.FamiliarityTrigger)
+	}
+
+	// Per-client response bandwidth, with faster or exempt tiers
+	if cfg.HasStage("bandwidth") {
+		tiers := make(map[string]int64, len(cfg.BandwidthTiers))
+		for name, rate := range cfg.BandwidthTiers {
+			tiers[name] = int64(rate)
+		}
+		add("bandwidth", middleware.NewBandwidthMiddleware(middleware.BandwidthOptions{
+			Rate:      int64(cfg.BandwidthLimit),
+			Burst:     int64(cfg.BandwidthBurst),
+			BySubject: cfg.BandwidthKey == "subject",
+			TierClaim: cfg.BandwidthTierClaim,
+			Tiers:     tiers,
+		}).Handler)
+		log.Printf("Bandwidth: %s/s per %s (%d tiers)", cfg.BandwidthLimit, cfg.BandwidthKey, len(tiers))
+	}
 
-	// Load CA certificate for mTLS
-	caCert, err := os.ReadFile(cfg.CACertPath)
+	// Injected latency, errors and resets for resilience testing, never in prod
+	if cfg.HasStage("chaos") {
+		faults := make([]middleware.ChaosFault, len(cfg.ChaosFaults))
+		for i, f := range cfg.ChaosFaults {
+			faults[i] = middleware.ChaosFault{
+				Prefix:  f.Prefix,
+				Percent: f.Percent,
+				Latency: f.Latency.Std(),
+				Jitter:  f.Jitter.Std(),
+				Status:  f.Status,
+				Reset:   f.Reset,
+			}
+		}
+		add("chaos", middleware.NewChaosMiddleware(faults).Handler)
+		log.Printf("Warning: chaos stage injecting faults into %d routes (preset %s)", len(faults), cfg.Preset)
+	}
+
+	// Stages compiled in with middleware.RegisterStage
+	err = addRegisteredStages(cfg, stages, middleware.StageOptions{Sink: eventSink, Auditor: auditor, Redis: redisClient})
 	if err != nil {
-		log.Fatalf("Failed to read CA certificate: %v", err)
+		log.Fatalf("Failed to create registered stages: %v", err)
+	}
+	order := stageOrder(cfg.Stages, stages)
+
+	// One decision log per request, which every other stage reports into
+	var decisionLog *middleware.DecisionLogMiddleware
+	if cfg.HasStage("decisions") {
+		version := policyVersion(cfg)
+		decisionLog = middleware.NewDecisionLogMiddleware(eventSink, cfg.KafkaDecisionsTopic, version)
+		for name, stage := range stages {
+			stages[name] = middleware.WithHandler(stage, decisionLog.Stage(name, stage.Handler))
+		}
+		add("decisions", decisionLog.Handler)
+		log.Printf("Decision logs: to %s, policy version %s", cfg.KafkaDecisionsTopic, version)
+	}
+
+	// Build middleware chain in the configured order, outermost first
+	// (default: Blocklist -> Honeypot -> Verdicts -> JWT -> Logger -> Scoring -> Proxy).
+	// Honeypot and verdicts are skipped when they aren't configured.
+	finalHandler, chain := buildChain(proxyHandler, order, stages)
+	log.Printf("Middleware chain: %s", strings.Join(chain, " -> "))
+
+	// Every client counts towards the share of blocked clients, whichever
+	// stage refuses it
+	finalHandler = enforcementGuard.Handler(finalHandler)
+
+	// Tenants are resolved ahead of every stage so each can isolate its state
+	var tenants *middleware.TenantResolver
+	if len(cfg.Tenants) > 0 {
+		tenants = newTenantResolver(cfg)
+		finalHandler = tenants.Handler(finalHandler)
+		log.Printf("Tenants: %d (claim %q)", len(cfg.Tenants), cfg.TenantClaim)
+	}
+
+	// Replicas share rate limits, blocks and upstream drains
+	var coordinator *cluster.Coordinator
+	var upstreamControl admin.UpstreamControl = proxyHandler
+	if cfg.ClusterSync {
+		limiters := map[string]*middleware.RateLimiter{
+			"ratelimit": stageLimiter,
+			"response":  responseLimiter,
+			"verdict":   verdictLimiter,
+		}
+		for _, t := range cfg.Tenants {
+			if tenant, ok := tenants.Lookup(t.Name); ok && tenant.Limiter != nil {
+				limiters["tenant:"+t.Name] = tenant.Limiter
+			}
+		}
+		coordinator = newCoordinator(cfg, redisClient, recentBlocks, proxyHandler, limiters)
+		upstreamControl = clusterUpstreams{proxyHandler, coordinator}
 	}
 
-	caCertPool := x509.NewCertPool()
-	if !caCertPool.AppendCertsFromPEM(caCert) {
-		log.Fatalf("Failed to parse CA certificate")
+	// Maintenance mode answers before any stage, tenant or not
+	maintenance := middleware.NewMaintenanceMiddleware(cfg.MaintenanceMode, cfg.MaintenanceRetryAfter.Std())
+	finalHandler = maintenance.Handler(finalHandler)
+
+	// Canonical paths before routes and policies see them
+	paths := middleware.NewPathMiddleware(cfg.PathNormalization, auditor)
+	finalHandler = paths.Handler(finalHandler)
+
+	// Every request gets its client address and an ID before anything logs
+	// or answers it, and loses the scoring headers it claims whether or not
+	// scoring runs
+	clientIPs := middleware.NewClientIPMiddleware(cfg.TrustedProxies)
+	requestIDs := middleware.NewRequestIDMiddleware(cfg.RequestIDTrusted)
+	finalHandler = clientIPs.Handler(requestIDs.Handler(middleware.StripScoreHeaders(finalHandler)))
+
+	// Envoy ext_authz listeners run the same stages without proxying
+	var authzHandler http.Handler
+	if cfg.HasListener("extauthz") {
+		authz, authzStages := authzChain(order, stages)
+		authz = enforcementGuard.Handler(authz)
+		if tenants != nil {
+			authz = tenants.Handler(authz)
+		}
+		authzHandler = clientIPs.Handler(requestIDs.Handler(middleware.StripScoreHeaders(paths.Handler(maintenance.Handler(authz)))))
+		log.Printf("Envoy ext_authz chain: %s", strings.Join(append(authzStages, "allow"), " -> "))
 	}
 
-	// Configure TLS with mTLS required
-	tlsConfig := &tls.Config{
-		ClientCAs:  caCertPool,
-		ClientAuth: tls.RequireAndVerifyClientCert,
-		MinVersion: tls.VersionTLS12,
-		CipherSuites: []uint16{
-			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-		},
+	// Egress listeners run the same stages in front of the forward proxy
+	var egressHandler http.Handler
+	if cfg.HasListener("egress") {
+		forward, err := handler.NewForwardProxy(handler.ForwardOptions{
+			Hosts:        cfg.EgressAllowedHosts,
+			Ports:        cfg.EgressAllowedPorts,
+			CIDRs:        cfg.EgressAllowedCIDRs,
+			AllowPrivate: cfg.EgressAllowPrivate,
+			DialTimeout:  cfg.UpstreamDialTimeout.Std(),
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize egress proxy: %v", err)
+		}
+		egress, egressStages := egressChain(forward, order, stages)
+		egress = enforcementGuard.Handler(egress)
+		if tenants != nil {
+			egress = tenants.Handler(egress)
+		}
+		egressHandler = handler.ProxyAuthorization(clientIPs.Handler(requestIDs.Handler(middleware.StripScoreHeaders(maintenance.Handler(egress)))))
+		log.Printf("Egress chain: %s (destinations: %v)", strings.Join(append(egressStages, "forward"), " -> "), cfg.EgressAllowedHosts)
 	}
 
-	// Create HTTPS server
-	server := &http.Server{
-		Addr:         fmt.Sprintf(":%d", cfg.Port),
-		Handler:      mux,
-		TLSConfig:    tlsConfig,
-		ReadTimeout:  30 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  120 * time.Second,
+	// Tracks the running configuration and applies changes to it
+	reloader := &configReloader{
+		current:         cfg,
+		profiles:        routeProfiles,
+		proxy:           proxyHandler,
+		responseLimiter: responseLimiter,
+		verdictLimiter:  verdictLimiter,
+		stageLimiter:    stageLimiter,
+		routePolicies:   routePolicies,
+		cors:            corsMiddleware,
+		headers:         headersMiddleware,
+		decisions:       decisionLog,
+		honeypot:        honeypotMiddleware,
+		blocklist:       blocklistMiddleware,
+		scoring:         scoringMiddleware,
+		smoother:        scoringOpts.Smoother,
+		killSwitch:      killSwitch,
+		maintenance:     maintenance,
 	}
+	killSwitch.Subscribe(reloader.applyKillSwitch)
 
-	// Graceful shutdown handling
+	// Graceful shutdown on SIGTERM or through the admin API
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, os.Interrupt, syscall.SIGTERM)
+	var servers []*http.Server
+	// Fail health checks and close idle connections so clients reconnect
+	// to other replicas
+	drainServers := func() {
+		draining.Store(true)
+		for _, server := range servers {
+			server.SetKeepAlivesEnabled(false)
+		}
+	}
+
+	// Add health check and Prometheus endpoints
+	// Readiness reflects the dependencies, liveness only the process
+	ready := newReadiness(cfg.ReadinessInterval.Std(), cfg.ReadinessRequired, func(ok bool, status string) {
+		sdNotify("STATUS=" + status)
+	})
+	ready.add("redis", func(ctx context.Context) (string, error) {
+		return cfg.RedisURL, redisClient.Ping(ctx).Err()
+	})
+	ready.add(cfg.EventBus, func(ctx context.Context) (string, error) {
+		return eventBusServers(cfg), eventSink.Check(cfg.KafkaTopic)
+	})
+	ready.add("jwt", func(ctx context.Context) (string, error) {
+		key := jwtMiddleware.PublicKey()
+		if key == nil {
+			return "", fmt.Errorf("no public key loaded")
+		}
+		return fmt.Sprintf("RSA %d-bit public key", key.N.BitLen()), nil
+	})
+	ready.add("upstream", func(ctx context.Context) (string, error) {
+		return upstreamReadiness(proxyHandler.ProbeUpstreams(ctx))
+	})
+	// Host clock drift beyond the JWT leeway refuses valid tokens
+	var clock *clockMonitor
+	if cfg.ClockCheck != "" {
+		clock = newClockMonitor(cfg.ClockCheck, cfg.JWTLeeway.Std())
+		ready.add("clock", clock.status)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", healthCheckHandler)
+	mux.HandleFunc("/livez", handleLivez)
+	mux.HandleFunc("/readyz", ready.handleReadyz)
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/", finalHandler)
+	if botChallenger != nil {
+		mux.Handle(cfg.ChallengePath, botChallenger.Handler())
+	}
+	if side != nil {
+		side.drain = drainServers
+		mux.HandleFunc("/prestop", side.handlePreStop)
+	}
 
-	go func() {
-		log.Printf("Starting HTTPS server on :%d", cfg.Port)
-		log.Printf("Upstream: %s", cfg.UpstreamURL)
-		log.Printf("mTLS: REQUIRED")
+	// Admin API (bearer token, plus mTLS from the listener), only ever on
+	// admin listeners; config adds one on ADMIN_ADDRESS if none is listed
+	adminMux := http.NewServeMux()
+	adminMux.HandleFunc("/health", healthCheckHandler)
+	adminMux.HandleFunc("/livez", handleLivez)
+	adminMux.HandleFunc("/readyz", ready.handleReadyz)
+	adminMux.Handle("/metrics", metrics.Handler())
+	if side != nil {
+		adminMux.HandleFunc("/prestop", side.handlePreStop)
+	}
+	if cfg.AdminToken != "" {
+		adminServer := admin.NewServer(admin.Options{
+			Token:         cfg.AdminToken,
+			Decisions:     decisionStore,
+			Aggregates:    aggregates,
+			Sink:          eventSink,
+			FeedbackTopic: cfg.KafkaFeedbackTopic,
+			Config:        reloader.effective,
+			Traffic:       proxyHandler.Stats,
+			Upstreams:     upstreamControl,
+			Cluster:       coordinator,
+			ClientCNs:     cfg.AdminClientCNs,
+			Blocklist:     blocklistMiddleware,
+			Flows:         loggerMiddleware.Flows(),
+			Events:        adminEvents,
+			Tenants:       tenants,
+			KillSwitch:    killSwitch,
+			Cache:         responseCache,
+			Enforcement:   reloader,
+			Maintenance:   reloader,
+			Drain:         drainServers,
+			Shutdown: func() {
+				select {
+				case shutdown <- syscall.SIGTERM:
+				default:
+				}
+			},
+		})
+		adminMux.Handle("/admin/", adminServer)
+		log.Printf("Admin API: enabled at /admin/")
+	}
+	handlers := map[string]http.Handler{"proxy": mux, "admin": adminMux, "egress": egressHandler}
+	if verdictStore != nil {
+		handlers["verdicts"] = verdictpush.NewServer(verdictStore, cfg.VerdictPushToken, cfg.VerdictPushClientNames)
+	}
 
-		if err := server.ListenAndServeTLS(cfg.TLSCertPath, cfg.TLSKeyPath); err != http.ErrServerClosed {
-			log.Fatalf("Server error: %v", err)
+	// Load TLS material for mTLS; it may come from files or secret managers
+	secretsCtx, stopSecrets := context.WithCancel(context.Background())
+	defer stopSecrets()
+
+	tlsMaterial, err := loadTLSMaterial(secretsCtx, cfg)
+	if err != nil {
+		log.Fatalf("Failed to load TLS material: %v", err)
+	}
+	if authzHandler != nil {
+		// Envoy's peer certificates only count as verified against our CAs
+		handlers["extauthz"] = extauthz.NewServer(authzHandler, tlsMaterial.clientCAPool)
+	}
+	if len(tlsMaterial.vhosts) > 0 {
+		handlers["proxy"] = misdirected(tlsMaterial, handlers["proxy"])
+		log.Printf("Virtual hosts: %d, selected by SNI", len(tlsMaterial.vhosts))
+	}
+
+	// Pick up rotated secrets without a restart
+	refresh := time.Duration(cfg.SecretsRefreshSeconds) * time.Second
+	tlsMaterial.watch(secretsCtx, refresh)
+	go cfg.Secrets.Watch(secretsCtx, cfg.JWTPublicKeyPath, refresh, func(data []byte) {
+		key, err := config.ParseRSAPublicKey(data)
+		if err != nil {
+			log.Printf("[JWT] Keeping current public key: %v", err)
+			return
+		}
+		jwtMiddleware.SetPublicKey(key)
+		log.Printf("[JWT] Public key reloaded")
+	})
+
+	// One server per listener, each with its own TLS policy and handler.
+	// All are created before any serves, since the admin API reads servers.
+	listenerServers := make(map[string]*http.Server)
+	relays := make(map[string]*tcpproxy.Server)
+	for _, l := range cfg.Listeners {
+		if l.Handler == "tcp" {
+			relays[l.Name] = newTCPServer(cfg, l, tlsMaterial, tcpproxy.Options{
+				Blocklist: blocklistMiddleware,
+				Sink:      eventSink,
+				Pod:       pod,
+				Cloud:     cloud,
+			})
+			continue
+		}
+		listenerServers[l.Name] = newListenerServer(cfg, l, handlers[l.Handler], tlsMaterial)
+		servers = append(servers, listenerServers[l.Name])
+	}
+	acceptLoops := cfg.AcceptLoops
+	if acceptLoops == 0 {
+		acceptLoops = runtime.GOMAXPROCS(0)
+	}
+	// Connection limits apply to the proxy and tcp listeners only, so
+	// operators can still reach an admin listener while the proxy sheds a
+	// flood
+	connLimits := newConnLimiter(cfg.MaxConnections, cfg.MaxConnectionsPerIP)
+	proxyTrusted, err := parseCIDRs(cfg.ProxyProtocolTrusted)
+	if err != nil {
+		log.Fatalf("Invalid PROXY_PROTOCOL_TRUSTED: %v", err)
+	}
+	var bound sync.WaitGroup
+	bound.Add(len(cfg.Listeners))
+	for _, l := range cfg.Listeners {
+		opts := acceptOptions{loops: 1, bound: &bound}
+		if l.Handler == "proxy" || l.Handler == "tcp" {
+			opts.loops, opts.limiter = acceptLoops, connLimits
+		}
+		if l.ProxyProtocol {
+			opts.proxyTrusted, opts.proxyTimeout = proxyTrusted, cfg.ProxyProtocolTimeout.Std()
+		}
+		if relay, ok := relays[l.Name]; ok {
+			go serveTCPListener(l, relay, opts)
+		} else {
+			go serveListener(l, listenerServers[l.Name], opts)
+		}
+	}
+	go ready.Run(secretsCtx)
+	if clock != nil {
+		go clock.Run(secretsCtx, cfg.ClockCheckInterval.Std())
+	}
+	if coordinator != nil {
+		go coordinator.Run(secretsCtx)
+		log.Printf("Cluster: coordinating as %s every %s", coordinator.Node(), cfg.ClusterSyncInterval)
+	}
+	if cfg.BlocklistMonitorInterval > 0 {
+		monitorOpts := middleware.BlocklistMonitorOptions{
+			Interval:  cfg.BlocklistMonitorInterval.Std(),
+			Window:    cfg.BlockSpikeWindow.Std(),
+			Baseline:  cfg.BlockSpikeBaseline.Std(),
+			Factor:    cfg.BlockSpikeFactor,
+			MinBlocks: cfg.BlockSpikeMinBlocks,
+		}
+		if verdictStore != nil {
+			monitorOpts.LocalBlocks = verdictStore.Blocks
 		}
-	}()
+		go middleware.NewBlocklistMonitor(redisClient, guardrails, monitorOpts).Run(secretsCtx)
+		log.Printf("Blocklist monitor: alerting at %.0fx the block rate over %s", cfg.BlockSpikeFactor, cfg.BlockSpikeWindow)
+	}
+	if cfg.GuardrailMaxBlockedPercent > 0 {
+		go enforcementGuard.Run(secretsCtx)
+		log.Printf("Guardrails: at most %g%% of client networks blocked per %s", cfg.GuardrailMaxBlockedPercent, cfg.GuardrailWindow)
+	}
+	if len(cfg.GuardrailAllowASNs) > 0 || len(cfg.GuardrailAllowSubjects) > 0 {
+		log.Printf("Guardrails: never blocking ASNs %v or subjects %v", cfg.GuardrailAllowASNs, cfg.GuardrailAllowSubjects)
+	}
+
+	// Reload routes, policies, rate limits and the upstream on SIGHUP or
+	// when the config file changes
+	go reloader.run(os.Getenv("CONFIG_FILE"), time.Duration(cfg.ConfigWatchIntervalSeconds)*time.Second)
+	go killSwitch.Run(secretsCtx, cfg.KillSwitchPoll.Std())
+	if discovery != nil {
+		go discovery.Run(secretsCtx, proxyHandler)
+	}
+	if ingressController != nil {
+		go ingressController.Run(secretsCtx, cfg.IngressResync.Std(), withRoutes(proxyHandler.SetRoutes, vhostRoutes))
+	}
+	if centralSource != nil {
+		reloader.central = centralSnapshot
+		go central.Run(secretsCtx, centralSource, centralSnapshot, cfg.CentralConfigPoll.Std(), reloader.applyCentral)
+	}
+
+	if discovery != nil {
+		log.Printf("Upstreams: discovered from %s (draining: %v)", discovery, cfg.UpstreamDraining)
+	} else {
+		log.Printf("Upstreams: %v (draining: %v)", cfg.Upstreams(), cfg.UpstreamDraining)
+	}
+	log.Printf("Enforcement: %s (smoothing: %s, kill switch engaged: %t)", cfg.EnforcementMode, cfg.ScoreSmoothing, killSwitch.Engaged())
+
+	// Tell systemd the proxy is up once every listener accepts connections;
+	// its watchdog is pinged while the readiness checks keep running
+	bound.Wait()
+	sdNotify("READY=1")
+	go sdWatchdog(secretsCtx.Done(), ready.alive)
 
 	// Wait for shutdown signal
 	<-shutdown
+	sdNotify("STOPPING=1")
+	if side != nil {
+		// Endpoints still route to the pod until they see it terminating
+		side.drainAndWait("SIGTERM")
+	}
 	log.Println("Shutting down gracefully...")
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Shutdown error: %v", err)
-	}
+	shutdownServers(ctx, servers, relays)
+	closeStages(stages)
+	loggerMiddleware.Close()
 
 	log.Println("Server stopped")
 }
 
+// loadCentralConfig connects to the central config store, if one is
+// configured, and applies its current snapshot to cfg. An unreachable store
+// or invalid snapshot leaves the local configuration in effect; the watcher
+// applies the store's policy once it becomes valid.
+func loadCentralConfig(cfg *config.Config, redisClient *redis.Client) (central.Source, *central.Snapshot) {
+	var source central.Source
+	switch cfg.CentralConfigSource {
+	case "redis":
+		source = central.NewRedisSource(redisClient, cfg.CentralConfigKey)
+	case "etcd":
+		source = central.NewEtcdSource(cfg.CentralConfigEtcdEndpoints, cfg.CentralConfigKey)
+	case "kafka":
+		source = central.NewKafkaSource(cfg.KafkaBrokers, cfg.CentralConfigKey)
+	default:
+		return nil, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	snapshot, err := source.Load(ctx)
+	if err != nil {
+		log.Printf("[Config] Central config unavailable, starting with local configuration: %v", err)
+		return source, nil
+	}
+	if err := config.ApplyCentral(cfg, snapshot.Values); err != nil {
+		log.Printf("[Config] Central config version %d rejected, starting with local configuration: %v", snapshot.Version, err)
+		return source, nil
+	}
+
+	centralVersion.Set(float64(snapshot.Version))
+	log.Printf("[Config] Central config version %d applied from %s", snapshot.Version, source)
+	return source, snapshot
+}
+
+// buildChain wraps handler with the listed stages, the first outermost, and
+// returns the names of the stages in use. Stages without a middleware are
+// skipped.
+func buildChain(handler http.Handler, order []string, stages map[string]middleware.Stage) (http.Handler, []string) {
+	handler, chain := wrapStages(handler, order, stages)
+	if indexOf(chain, "scoring") >= 0 && indexOf(chain, "scoring") < indexOf(chain, "logger") {
+		log.Printf("Warning: scoring runs before logger, so access logs won't carry risk scores")
+	}
+	if heuristic := indexOf(chain, "heuristic"); heuristic >= 0 && heuristic > indexOf(chain, "scoring") {
+		log.Printf("Warning: heuristic runs after scoring, so scoring can't fall back on its score")
+	}
+	if opa := indexOf(chain, "opa"); opa >= 0 && opa < indexOf(chain, "scoring") {
+		log.Printf("Warning: opa runs before scoring, so policies won't see risk scores")
+	}
+	if waf := indexOf(chain, "waf"); waf >= 0 && waf < indexOf(chain, "logger") {
+		log.Printf("Warning: waf runs before logger, so WAF matches won't reach Kafka")
+	}
+	if protocol := indexOf(chain, "protocol"); protocol >= 0 && protocol < indexOf(chain, "logger") {
+		log.Printf("Warning: protocol runs before logger, so protocol anomalies won't reach Kafka")
+	}
+	if jwt := indexOf(chain, "jwt"); jwt >= 0 && indexOf(chain, "cors") > jwt {
+		log.Printf("Warning: cors runs after jwt, so preflight requests, which carry no token, are refused")
+	}
+	if replay := indexOf(chain, "replay"); replay >= 0 && replay < indexOf(chain, "jwt") {
+		log.Printf("Warning: replay runs before jwt, so nonces are tracked per address rather than per subject")
+	}
+	if shed := indexOf(chain, "shed"); shed >= 0 && (shed < indexOf(chain, "jwt") || shed < indexOf(chain, "scoring")) {
+		log.Printf("Warning: shed runs before jwt or scoring, so it can't tell trusted traffic from the rest")
+	}
+	if schedule := indexOf(chain, "schedule"); schedule >= 0 && schedule < indexOf(chain, "jwt") {
+		log.Printf("Warning: schedule runs before jwt, so schedules for subjects and claims never apply")
+	} else if scoring := indexOf(chain, "scoring"); schedule >= 0 && scoring >= 0 && scoring < schedule {
+		log.Printf("Warning: schedule runs after scoring, so off-schedule requests aren't scored as such")
+	}
+	if familiarity := indexOf(chain, "familiarity"); familiarity >= 0 && familiarity < indexOf(chain, "jwt") {
+		log.Printf("Warning: familiarity runs before jwt, so it never knows the subject")
+	} else if scoring := indexOf(chain, "scoring"); familiarity >= 0 && scoring >= 0 && scoring < familiarity {
+		log.Printf("Warning: familiarity runs after scoring, so unfamiliar access isn't scored as such")
+	}
+	if assertion := indexOf(chain, "assertion"); assertion >= 0 && (assertion < indexOf(chain, "jwt") || assertion < indexOf(chain, "scoring")) {
+		log.Printf("Warning: assertion runs before jwt or scoring, so assertions miss the subject or risk score")
+	}
+	if jwt := indexOf(chain, "jwt"); jwt >= 0 && indexOf(chain, "session") > jwt {
+		log.Printf("Warning: session runs after jwt, so browsers with a session are refused for lacking a token")
+	}
+	if exchange := indexOf(chain, "exchange"); exchange >= 0 && exchange < indexOf(chain, "jwt") {
+		log.Printf("Warning: exchange runs before jwt, so unverified tokens are sent to the IdP and jwt sees internal ones")
+	}
+	if cache := indexOf(chain, "cache"); cache >= 0 && cache < len(chain)-1 {
+		log.Printf("Warning: cache doesn't run last, so cache hits skip the stages after it")
+	}
+	if indexOf(chain, "decisions") > 0 {
+		log.Printf("Warning: decisions doesn't run first, so the stages before it are missing from decision logs")
+	}
+	if routes := indexOf(chain, "routes"); routes >= 0 && routes < indexOf(chain, "jwt") {
+		log.Printf("Warning: routes runs before jwt, so scopes can't be checked")
+	} else if routes >= 0 && routes < indexOf(chain, "scoring") {
+		log.Printf("Warning: routes runs before scoring, so max_risk is not applied")
+	}
+	return handler, append(chain, "proxy")
+}
+
+// wrapStages wraps handler in the stages of order that are enabled,
+// outermost first, and returns their names.
+func wrapStages(handler http.Handler, order []string, stages map[string]middleware.Stage) (http.Handler, []string) {
+	var chain []string
+	for i := len(order) - 1; i >= 0; i-- {
+		if stage, ok := stages[order[i]]; ok {
+			handler = stage.Handler(middleware.MarkStage(order[i], handler))
+			chain = append([]string{order[i]}, chain...)
+		}
+	}
+	return handler, chain
+}
+
+// authzChain is the decision chain served to Envoy over ext_authz: the
+// stages in the configured order, without those working on responses or on
+// the connection to the upstream, which stay with Envoy, and chaos, whose
+// faults Envoy injects itself.
+func authzChain(order []string, stages map[string]middleware.Stage) (http.Handler, []string) {
+	var decisions []string
+	for _, stage := range order {
+		switch stage {
+		case "dlp", "cache", "headers", "cors", "shed", "chaos", "bandwidth", "concurrency":
+		default:
+			decisions = append(decisions, stage)
+		}
+	}
+	return wrapStages(extauthz.Allow, decisions, stages)
+}
+
+// egressChain is the chain in front of the forward proxy: the stages in the
+// configured order, without those shaping responses for browsers, which
+// don't apply to workloads' outbound calls.
+func egressChain(forward http.Handler, order []string, stages map[string]middleware.Stage) (http.Handler, []string) {
+	var outbound []string
+	for _, stage := range order {
+		switch stage {
+		case "cache", "headers", "cors":
+		default:
+			outbound = append(outbound, stage)
+		}
+	}
+	return wrapStages(forward, outbound, stages)
+}
+
+func indexOf(items []string, item string) int {
+	for i, v := range items {
+		if v == item {
+			return i
+		}
+	}
+	return -1
+}
+
+// logEffectiveConfig logs the loaded configuration with secrets redacted, so
+// support can verify what a running proxy actually uses.
+func logEffectiveConfig(cfg *config.Config) {
+	redacted, err := cfg.Redacted()
+	if err == nil {
+		var data []byte
+		if data, err = yaml.Marshal(redacted); err == nil {
+			log.Printf("[Config] Effective configuration:\n%s", data)
+			return
+		}
+	}
+	log.Printf("[Config] Failed to render effective configuration: %v", err)
+}
+
+// policyVersion fingerprints the configuration, so decision logs can be tied
+// to the policy that produced them.
+func policyVersion(cfg *config.Config) string {
+	redacted, err := cfg.Redacted()
+	if err != nil {
+		return ""
+	}
+	data, err := yaml.Marshal(redacted)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// newDiscovery returns the lookup of discovered upstreams, or nil when they
+// are configured.
+func newDiscovery(cfg *config.Config) (handler.Discovery, error) {
+	switch {
+	case cfg.UpstreamDNS != "":
+		return handler.NewDNSDiscovery(cfg.UpstreamDNS, cfg.UpstreamDNSTTL.Std())
+	case cfg.UpstreamRegistry != "":
+		return handler.NewRegistryDiscovery(handler.RegistryOptions{
+			Kind:    cfg.UpstreamRegistry,
+			URL:     cfg.UpstreamRegistryURL,
+			Service: cfg.UpstreamService,
+			Tag:     cfg.UpstreamServiceTag,
+			Token:   cfg.UpstreamRegistryToken,
+			Scheme:  cfg.UpstreamRegistryScheme,
+			Poll:    cfg.UpstreamRegistryPoll.Std(),
+		})
+	}
+	return nil, nil
+}
+
+// statsRoute names the route of a path in the traffic stats: the prefix of
+// its route profile, else its first path segment.
+func statsRoute(profiles *middleware.RouteProfiles) func(path string) string {
+	return func(path string) string {
+		if prefix := profiles.Match(path).Prefix; prefix != "" {
+			return prefix
+		}
+		segment, _, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+		return "/" + segment
+	}
+}
+
+// newRouteProfiles converts the configured profiles; the fallback uses the
+// default model and policy.
+func newRouteProfiles(cfg *config.Config) (middleware.RouteProfile, []middleware.RouteProfile) {
+	var profiles []middleware.RouteProfile
+	for _, p := range cfg.RouteProfiles {
+		profile := middleware.RouteProfile{Prefix: p.Prefix, ModelID: p.ModelID, SampleRate: p.SampleRate}
+		if len(p.Policy) > 0 {
+			profile.Policy = newResponsePolicy(p.Policy)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	sampleRate := cfg.AccessLogSampleRate
+	fallback := middleware.RouteProfile{
+		ModelID:    cfg.ScoringModel,
+		Policy:     newResponsePolicy(cfg.ResponsePolicy),
+		SampleRate: &sampleRate,
+	}
+	return fallback, profiles
+}
+
+// newSmoothingConfig returns the score smoothing settings of cfg.
+func newSmoothingConfig(cfg *config.Config) middleware.SmoothingConfig {
+	return middleware.SmoothingConfig{
+		Mode:       cfg.ScoreSmoothing,
+		Alpha:      cfg.ScoreEWMAAlpha,
+		K:          cfg.ScoreWindowHits,
+		N:          cfg.ScoreWindowSize,
+		Hysteresis: cfg.ScoreHysteresis,
+	}
+}
+
+// newBlockEscalation returns the escalation ladders of cfg.
+func newBlockEscalation(cfg *config.Config) middleware.BlockEscalationOptions {
+	ladder := func(steps []config.Duration) []time.Duration {
+		durations := make([]time.Duration, len(steps))
+		for i, step := range steps {
+			durations[i] = step.Std()
+		}
+		return durations
+	}
+	opts := middleware.BlockEscalationOptions{
+		Steps:   ladder(cfg.BlockEscalation),
+		Actions: make(map[string][]time.Duration),
+		Decay:   cfg.BlockEscalationDecay.Std(),
+	}
+	for action, steps := range cfg.BlockEscalationActions {
+		opts.Actions[action] = ladder(steps)
+	}
+	return opts
+}
+
+// newDLPPatterns selects the enabled built-in patterns and compiles the custom
+// ones, in name order, with their actions.
+func newDLPPatterns(cfg *config.Config) []middleware.DLPPattern {
+	var patterns []middleware.DLPPattern
+	for _, name := range cfg.DLPPatterns {
+		pattern := middleware.BuiltinDLPPatterns[name]
+		pattern.Name = name
+		patterns = append(patterns, pattern)
+	}
+	custom := make([]string, 0, len(cfg.DLPCustomPatterns))
+	for name := range cfg.DLPCustomPatterns {
+		custom = append(custom, name)
+	}
+	sort.Strings(custom)
+	for _, name := range custom {
+		// Validated when the configuration was loaded
+		patterns = append(patterns, middleware.DLPPattern{Name: name, Pattern: regexp.MustCompile(cfg.DLPCustomPatterns[name])})
+	}
+	for i := range patterns {
+		patterns[i].Action = cfg.DLPAction
+		if action, ok := cfg.DLPPatternActions[patterns[i].Name]; ok {
+			patterns[i].Action = action
+		}
+	}
+	return patterns
+}
+
+// newCORSPolicy compiles a CORS policy; one without origins is nil, leaving
+// cross-origin requests to the upstream.
+func newCORSPolicy(p config.CORSPolicy) *middleware.CORSPolicy {
+	if len(p.AllowedOrigins) == 0 {
+		return nil
+	}
+	return middleware.NewCORSPolicy(p.AllowedOrigins, p.AllowedMethods, p.AllowedHeaders, p.ExposedHeaders, p.AllowCredentials, p.MaxAge.Std())
+}
+
+// newSecurityHeaders converts configured security headers, dropping those
+// turned off.
+func newSecurityHeaders(h config.SecurityHeaders) middleware.SecurityHeaders {
+	off := func(value string) string {
+		if value == "off" {
+			return ""
+		}
+		return value
+	}
+	return middleware.SecurityHeaders{
+		HSTS:           off(h.HSTS),
+		FrameOptions:   off(h.FrameOptions),
+		ReferrerPolicy: off(h.ReferrerPolicy),
+		CSP:            off(h.CSP),
+	}
+}
+
+// newRoutePolicies compiles the configured route policies and their tiers,
+// loading their OpenAPI specs.
+func newRoutePolicies(cfg *config.Config) ([]middleware.RoutePolicy, map[string]middleware.RateTier, error) {
+	tiers := make(map[string]middleware.RateTier, len(cfg.RateLimitTiers))
+	for name, tier := range cfg.RateLimitTiers {
+		tiers[name] = middleware.RateTier{RPS: tier.RPS, Burst: tier.Burst}
+	}
+
+	var policies []middleware.RoutePolicy
+	for _, route := range cfg.RoutePolicies {
+		policy := middleware.RoutePolicy{
+			Prefix:           route.Prefix,
+			ContentTypes:     route.ContentTypes,
+			MaxHeaders:       route.MaxHeaders,
+			MaxHeaderBytes:   int64(route.MaxHeaderBytes),
+			AuthNone:         route.Auth == "none",
+			Scopes:           route.Scopes,
+			RequireMTLS:      route.MTLS == "required",
+			Tier:             route.RateLimitTier,
+			MaxBody:          int64(route.MaxBody),
+			MaxRisk:          route.MaxRisk,
+			SchemaBlock:      route.OpenAPIMode != "detect",
+			CSRF:             route.CSRF,
+			ReplayProtection: route.ReplayProtection,
+			Timeout:          route.Timeout.Std(),
+			CacheTTL:         route.CacheTTL.Std(),
+			Mirror:           route.Mirror,
+			MirrorPercent:    route.MirrorPercent,
+			TokenAudience:    route.TokenAudience,
+		}
+		if rules := route.Response; rules != nil {
+			policy.Response = &middleware.ResponseRules{
+				MaxSize:         int64(rules.MaxSize),
+				ContentTypes:    rules.ContentTypes,
+				RequiredHeaders: rules.RequiredHeaders,
+				Truncate:        rules.Action == "truncate",
+			}
+		}
+		if policy.Mirror != "" && policy.MirrorPercent == 0 {
+			policy.MirrorPercent = 100
+		}
+		if route.OpenAPI != "" {
+			spec, err := openapi.Load(route.OpenAPI)
+			if err != nil {
+				return nil, nil, fmt.Errorf("route policy %q: %w", route.Prefix, err)
+			}
+			policy.Schema = spec
+		}
+		if route.CORS != nil {
+			policy.CORS = newCORSPolicy(route.CORS.Inherit(cfg.CORS))
+		}
+		if route.SecurityHeaders != nil {
+			headers := newSecurityHeaders(route.SecurityHeaders.Inherit(cfg.SecurityHeaders))
+			policy.SecurityHeaders = &headers
+		}
+		if len(route.Methods) > 0 {
+			policy.Methods = make(map[string]bool, len(route.Methods))
+			for _, method := range route.Methods {
+				policy.Methods[method] = true
+			}
+		}
+		policies = append(policies, policy)
+	}
+	return policies, tiers, nil
+}
+
+// newTenantResolver converts configured tenants, giving those with their own
+// rate limit a limiter of their own.
+func newTenantResolver(cfg *config.Config) *middleware.TenantResolver {
+	tenants := make([]middleware.Tenant, 0, len(cfg.Tenants))
+	for _, t := range cfg.Tenants {
+		tenant := middleware.Tenant{
+			Name:           t.Name,
+			Hosts:          t.Hosts,
+			PathPrefixes:   t.PathPrefixes,
+			ClaimValues:    t.ClaimValues,
+			AccessLogTopic: t.AccessLogTopic,
+			FeatureTopic:   t.FeatureTopic,
+		}
+		if t.RateLimitRPS > 0 {
+			tenant.Limiter = middleware.NewRateLimiter(t.RateLimitRPS, t.RateLimitBurst)
+		}
+		tenants = append(tenants, tenant)
+	}
+	return middleware.NewTenantResolver(cfg.TenantClaim, tenants)
+}
+
+// newResponsePolicy converts configured bands into a response policy.
+func newResponsePolicy(bands []config.ResponseBand) *middleware.ResponsePolicy {
+	converted := make([]middleware.ResponseBand, 0, len(bands))
+	for _, band := range bands {
+		converted = append(converted, middleware.ResponseBand{MinScore: band.MinScore, Action: middleware.Action(band.Action)})
+	}
+	return middleware.NewResponsePolicy(converted)
+}
+
+// eventBus is the sink events are published to; Check verifies the
+// connection for readiness.
+type eventBus interface {
+	middleware.EventSink
+	Check(topic string) error
+}
+
+// newEventBus connects to Kafka or NATS JetStream, as configured.
+func newEventBus(cfg *config.Config) (eventBus, error) {
+	if cfg.EventBus == "nats" {
+		return middleware.NewNATSSink(middleware.NATSOptions{
+			URLs:          cfg.NATSURLs,
+			SubjectPrefix: cfg.NATSSubjectPrefix,
+			Token:         cfg.NATSToken,
+			User:          cfg.NATSUser,
+			Password:      cfg.NATSPassword,
+			AckTimeout:    cfg.NATSAckTimeout.Std(),
+		})
+	}
+	return middleware.NewKafkaSink(cfg.KafkaBrokers)
+}
+
+// eventBusServers lists the servers of the event bus, for logs and checks.
+func eventBusServers(cfg *config.Config) string {
+	if cfg.EventBus == "nats" {
+		return strings.Join(cfg.NATSURLs, ",")
+	}
+	return strings.Join(cfg.KafkaBrokers, ",")
+}
+
+// upstreamReadiness describes the result of probing the default upstreams:
+// failing if none can be reached.
+func upstreamReadiness(total int, failed map[string]error) (string, error) {
+	if total == 0 {
+		return "no default upstreams", nil
+	}
+	var unreachable []string
+	for name, err := range failed {
+		unreachable = append(unreachable, fmt.Sprintf("%s: %v", name, err))
+	}
+	sort.Strings(unreachable)
+	if len(failed) == total {
+		return "", fmt.Errorf("no upstream reachable (%s)", strings.Join(unreachable, "; "))
+	}
+	detail := fmt.Sprintf("%d of %d reachable", total-len(failed), total)
+	if len(unreachable) > 0 {
+		detail += " (" + strings.Join(unreachable, "; ") + ")"
+	}
+	return detail, nil
+}
+
+// draining is set through the admin API to take the proxy out of rotation.
+var draining atomic.Bool
+
 func healthCheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	if draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"status": "draining", "service": "aegis-zero-proxy"}`))
+		return
+	}
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(`{"status": "healthy", "service": "aegis-zero-proxy"}`))
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "healthy", "service": "aegis-zero-proxy", "fips": fips})
 }
@@ -0,0 +1,291 @@
+// Package metrics is a minimal Prometheus-compatible metrics registry.
+// It supports labeled counters, gauges and histograms and renders them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// collector is a metric family that can render itself.
+type collector interface {
+	name() string
+	write(w io.Writer)
+}
+
+// Registry holds metric families for exposition.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Default is the registry used by the package-level constructors.
+var Default = NewRegistry()
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// register adds a collector, panicking on duplicate names like Prometheus does.
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.collectors {
+		if existing.name() == c.name() {
+			panic("metrics: duplicate metric " + c.name())
+		}
+	}
+	r.collectors = append(r.collectors, c)
+}
+
+// Write renders every metric in the text exposition format.
+func (r *Registry) Write(w io.Writer) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	sort.Slice(collectors, func(i, j int) bool { return collectors[i].name() < collectors[j].name() })
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// Handler serves the default registry for Prometheus scraping.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.Write(w)
+	})
+}
+
+// vec is the shared label bookkeeping of every metric type.
+type vec struct {
+	metricName string
+	help       string
+	labels     []string
+}
+
+func (v *vec) name() string { return v.metricName }
+
+// key joins label values into a map key, checking the label count.
+func (v *vec) key(values []string) string {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", v.metricName, len(v.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelString renders {a="x",b="y"} for a key, plus any extra pair.
+func (v *vec) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(v.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", v.labels[i], value))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", extra[i], extra[i+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (v *vec) header(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.metricName, v.help, v.metricName, kind)
+}
+
+// valueVec stores one float per label combination (counters and gauges).
+type valueVec struct {
+	vec
+	kind   string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newValueVec(kind, name, help string, labels []string) *valueVec {
+	v := &valueVec{vec: vec{metricName: name, help: help, labels: labels}, kind: kind, values: make(map[string]float64)}
+	Default.register(v)
+	return v
+}
+
+func (v *valueVec) add(delta float64, labelValues []string) {
+	key := v.key(labelValues)
+	v.mu.Lock()
+	v.values[key] += delta
+	v.mu.Unlock()
+}
+
+func (v *valueVec) set(value float64, labelValues []string) {
+	key := v.key(labelValues)
+	v.mu.Lock()
+	v.values[key] = value
+	v.mu.Unlock()
+}
+
+func (v *valueVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.header(w, v.kind)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.metricName, v.labelString(key), formatFloat(v.values[key]))
+	}
+}
+
+// CounterVec is a monotonically increasing value per label combination.
+type CounterVec struct{ v *valueVec }
+
+// NewCounterVec registers a counter with the given label names.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{v: newValueVec("counter", name, help, labels)}
+}
+
+// Inc adds one to the counter for the label values.
+func (c *CounterVec) Inc(labelValues ...string) { c.v.add(1, labelValues) }
+
+// Add adds a non-negative delta to the counter for the label values.
+func (c *CounterVec) Add(delta float64, labelValues ...string) { c.v.add(delta, labelValues) }
+
+// GaugeVec is a value that can go up and down per label combination.
+type GaugeVec struct{ v *valueVec }
+
+// NewGaugeVec registers a gauge with the given label names.
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{v: newValueVec("gauge", name, help, labels)}
+}
+
+// Set sets the gauge for the label values.
+func (g *GaugeVec) Set(value float64, labelValues ...string) { g.v.set(value, labelValues) }
+
+// Add adds delta (which may be negative) to the gauge for the label values.
+func (g *GaugeVec) Add(delta float64, labelValues ...string) { g.v.add(delta, labelValues) }
+
+// HistogramVec counts observations into cumulative buckets per label combination.
+type HistogramVec struct {
+	vec
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket, non-cumulative
+	sum    float64
+	count  uint64
+}
+
+// NewHistogramVec registers a histogram with ascending bucket upper bounds.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		vec:     vec{metricName: name, help: help, labels: labels},
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+	Default.register(h)
+	return h
+}
+
+// Observe records a value for the label values.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(key, "le", formatFloat(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, h.labelString(key, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, h.labelString(key), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, h.labelString(key), s.count)
+	}
+}
+
+// gaugeFunc reports a value computed at scrape time.
+type gaugeFunc struct {
+	vec
+	fn func() float64
+}
+
+// NewGaugeFunc registers an unlabeled gauge whose value is computed on scrape.
+func NewGaugeFunc(name, help string, fn func() float64) {
+	Default.register(&gaugeFunc{vec: vec{metricName: name, help: help}, fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	g.header(w, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.metricName, formatFloat(g.fn()))
+}
+
+// counterFunc reports a cumulative value computed at scrape time.
+type counterFunc struct {
+	vec
+	fn func() float64
+}
+
+// NewCounterFunc registers an unlabeled counter whose value is computed on
+// scrape.
+func NewCounterFunc(name, help string, fn func() float64) {
+	Default.register(&counterFunc{vec: vec{metricName: name, help: help}, fn: fn})
+}
+
+func (c *counterFunc) write(w io.Writer) {
+	c.header(w, "counter")
+	fmt.Fprintf(w, "%s %s\n", c.metricName, formatFloat(c.fn()))
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
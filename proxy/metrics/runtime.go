@@ -0,0 +1,33 @@
+package metrics
+
+import (
+	"runtime"
+	runtimemetrics "runtime/metrics"
+)
+
+// Go runtime metrics, so allocation rates can be compared across releases
+// and load tests can report allocations per request.
+func init() {
+	NewCounterFunc("go_heap_allocs_objects_total", "Heap objects allocated since the process started.",
+		runtimeCounter("/gc/heap/allocs:objects"))
+	NewCounterFunc("go_heap_allocs_bytes_total", "Heap bytes allocated since the process started.",
+		runtimeCounter("/gc/heap/allocs:bytes"))
+	NewCounterFunc("go_gc_cycles_total", "Completed garbage collection cycles.",
+		runtimeCounter("/gc/cycles/total:gc-cycles"))
+	NewGaugeFunc("go_goroutines", "Goroutines that currently exist.",
+		func() float64 { return float64(runtime.NumGoroutine()) })
+	NewGaugeFunc("go_gomaxprocs", "Threads that can run Go code simultaneously.",
+		func() float64 { return float64(runtime.GOMAXPROCS(0)) })
+}
+
+// runtimeCounter reads a cumulative runtime/metrics value.
+func runtimeCounter(name string) func() float64 {
+	return func() float64 {
+		sample := []runtimemetrics.Sample{{Name: name}}
+		runtimemetrics.Read(sample)
+		if sample[0].Value.Kind() != runtimemetrics.KindUint64 {
+			return 0
+		}
+		return float64(sample[0].Value.Uint64())
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/handler"
+)
+
+// startMockUpstream serves the echo upstream on MOCK_UPSTREAM_ADDR, which
+// the configuration then names as the only upstream. It runs until the
+// process exits, so requests it holds for their latency end with it.
+func startMockUpstream(cfg *config.Config) error {
+	ln, err := net.Listen("tcp", cfg.MockUpstreamAddr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler: handler.NewEchoUpstream(handler.EchoOptions{
+			Status:  cfg.MockUpstreamStatus,
+			Latency: cfg.MockUpstreamLatency.Std(),
+		}),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go server.Serve(ln)
+	log.Printf("Warning: proxying to the mock upstream on %s (status %d, latency %s) instead of a backend",
+		ln.Addr(), cfg.MockUpstreamStatus, cfg.MockUpstreamLatency)
+	return nil
+}
@@ -0,0 +1,291 @@
+// Package notify sends signed webhooks about enforcement decisions to chat,
+// paging and SOAR tools, so responders hear about incidents without
+// watching Kafka.
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// Event types, as configured in WEBHOOK_EVENTS.
+const (
+	EventBlock     = "block"     // A request was refused with 403
+	EventChallenge = "challenge" // A client was challenged or asked to re-authenticate
+	EventScore     = "score"     // A score reached the threshold, enforced or not
+	EventGuardrail = "guardrail" // A guardrail on automated enforcement tripped
+)
+
+// Headers carried by every delivery.
+const (
+	HeaderSignature = "X-Aegis-Signature" // "sha256=" + hex HMAC of timestamp + "." + body
+	HeaderTimestamp = "X-Aegis-Timestamp" // Unix seconds, to reject replays
+	HeaderEventID   = "X-Aegis-Event-Id"  // Identical across retries, for deduplication
+)
+
+// queueSize bounds deliveries waiting to be sent to each URL; more are
+// dropped.
+const queueSize = 1000
+
+var deliveriesTotal = metrics.NewCounterVec("aegis_webhook_deliveries_total",
+	"Webhook deliveries by result: sent, failed (after retries) or dropped (queue full).", "result")
+
+// Options configures the webhook sender.
+type Options struct {
+	URLs   []string
+	Secret string
+	// Events are the event types sent.
+	Events []string
+	// ScoreThreshold is the minimum score of "score" events.
+	ScoreThreshold float64
+	// MaxRetries bounds retries of a failed delivery, with exponential backoff.
+	MaxRetries int
+	Timeout    time.Duration
+	// Cooldown suppresses repeats of the same event type for the same client.
+	Cooldown time.Duration
+}
+
+// Payload is the JSON body of a webhook.
+type Payload struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	ClientIP  string      `json:"client_ip"`
+	Subject   string      `json:"subject,omitempty"`
+	Tenant    string      `json:"tenant,omitempty"`
+	Summary   string      `json:"summary"`
+	Event     interface{} `json:"event"`
+}
+
+// Webhooks delivers payloads to every configured URL from a background
+// goroutine per URL, so requests are never delayed by slow receivers, and
+// one receiver that is down and retried doesn't hold up the others.
+type Webhooks struct {
+	opts   Options
+	events map[string]bool
+	client *http.Client
+	queues map[string]chan delivery // By URL
+
+	// Last send per type and client, for Cooldown, in two generations:
+	// sends since rotated and those in the Cooldown before. A send older
+	// than both has cooled down, so the older generation is dropped
+	// wholesale on rotation instead of sweeping the map.
+	mu       sync.Mutex
+	sent     map[string]time.Time
+	previous map[string]time.Time
+	rotated  time.Time
+}
+
+type delivery struct {
+	url  string
+	id   string
+	body []byte
+}
+
+// NewWebhooks creates the sender and starts a delivery goroutine per URL.
+func NewWebhooks(opts Options) *Webhooks {
+	wh := &Webhooks{
+		opts:    opts,
+		events:  make(map[string]bool),
+		client:  &http.Client{Timeout: opts.Timeout},
+		queues:  make(map[string]chan delivery),
+		sent:    make(map[string]time.Time),
+		rotated: time.Now(),
+	}
+	for _, event := range opts.Events {
+		wh.events[event] = true
+	}
+	for _, url := range opts.URLs {
+		if _, ok := wh.queues[url]; ok {
+			continue
+		}
+		queue := make(chan delivery, queueSize)
+		wh.queues[url] = queue
+		go wh.run(queue)
+	}
+	return wh
+}
+
+// ObserveAudit sends block and challenge events; subscribe it to the Auditor.
+func (wh *Webhooks) ObserveAudit(ev middleware.AuditEvent) {
+	var eventType string
+	switch {
+	case ev.Stage == "scoring" && (ev.Reason == string(middleware.ActionChallenge) || ev.Reason == string(middleware.ActionReauth)):
+		eventType = EventChallenge
+	case ev.Status == http.StatusForbidden:
+		eventType = EventBlock
+	default:
+		return
+	}
+	summary := fmt.Sprintf("%s %s %s: %d by %s", ev.ClientIP, ev.Method, ev.Path, ev.Status, ev.Stage)
+	if ev.Reason != "" {
+		summary += " (" + ev.Reason + ")"
+	}
+	wh.send(eventType, ev.Timestamp, ev.ClientIP, ev.Subject, ev.Tenant, summary, ev)
+}
+
+// ObserveScore sends score events at or above the threshold; subscribe it
+// to the scoring stage.
+func (wh *Webhooks) ObserveScore(ev middleware.ScoreEvent) {
+	if ev.Score < wh.opts.ScoreThreshold {
+		return
+	}
+	summary := fmt.Sprintf("%s %s %s scored %.2f (%s)", ev.ClientIP, ev.Method, ev.Path, ev.Score, ev.Decision)
+	wh.send(EventScore, ev.Timestamp, ev.ClientIP, ev.Subject, ev.Tenant, summary, ev)
+}
+
+// ObserveGuardrail sends guardrail events; subscribe it to the guardrail
+// alerts. They aren't about a client, and the alerts already keep replicas
+// from repeating each other, so the cooldown doesn't apply.
+func (wh *Webhooks) ObserveGuardrail(ev middleware.GuardrailEvent) {
+	if wh.events[EventGuardrail] {
+		wh.enqueue(EventGuardrail, ev.Timestamp, "", "", "", ev.Summary, ev)
+	}
+}
+
+// send queues a payload for every URL unless the event type is disabled or
+// cooling down for the client.
+func (wh *Webhooks) send(eventType string, ts time.Time, clientIP, subject, tenant, summary string, event interface{}) {
+	if !wh.events[eventType] || !wh.due(eventType+"|"+tenant+"|"+clientIP, ts) {
+		return
+	}
+	wh.enqueue(eventType, ts, clientIP, subject, tenant, summary, event)
+}
+
+// enqueue queues a payload for every URL.
+func (wh *Webhooks) enqueue(eventType string, ts time.Time, clientIP, subject, tenant, summary string, event interface{}) {
+	payload := Payload{
+		ID:        newID(),
+		Type:      eventType,
+		Timestamp: ts,
+		ClientIP:  clientIP,
+		Subject:   subject,
+		Tenant:    tenant,
+		Summary:   summary,
+		Event:     event,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("[Webhook] Error marshalling payload: %v", err)
+		return
+	}
+
+	for url, queue := range wh.queues {
+		select {
+		case queue <- delivery{url: url, id: payload.ID, body: body}:
+		default:
+			deliveriesTotal.Inc("dropped")
+			log.Printf("[Webhook] Queue of %s full, dropping %s event for %s", url, eventType, clientIP)
+		}
+	}
+}
+
+// due reports whether an event for key may be sent, recording it if so.
+func (wh *Webhooks) due(key string, now time.Time) bool {
+	if wh.opts.Cooldown <= 0 {
+		return true
+	}
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+
+	if since := now.Sub(wh.rotated); since >= wh.opts.Cooldown {
+		// Every send in previous is over a Cooldown old, and after a
+		// quiet spell of two, so is every send in sent
+		wh.previous, wh.sent = wh.sent, make(map[string]time.Time)
+		if since >= 2*wh.opts.Cooldown {
+			wh.previous = nil
+		}
+		wh.rotated = now
+	}
+	last, ok := wh.sent[key]
+	if !ok {
+		last, ok = wh.previous[key]
+	}
+	if ok && now.Sub(last) < wh.opts.Cooldown {
+		return false
+	}
+	wh.sent[key] = now
+	return true
+}
+
+// run delivers the payloads queued for a URL one at a time, retrying
+// failures with exponential backoff.
+func (wh *Webhooks) run(queue chan delivery) {
+	for d := range queue {
+		backoff := time.Second
+		for attempt := 0; ; attempt++ {
+			err := wh.post(d)
+			if err == nil {
+				deliveriesTotal.Inc("sent")
+				break
+			}
+			if attempt >= wh.opts.MaxRetries {
+				deliveriesTotal.Inc("failed")
+				log.Printf("[Webhook] Giving up on %s after %d attempts: %v", d.url, attempt+1, err)
+				break
+			}
+			log.Printf("[Webhook] Delivery to %s failed, retrying in %v: %v", d.url, backoff, err)
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// post delivers one payload. Client errors other than 429 are not retried.
+func (wh *Webhooks) post(d delivery) error {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderTimestamp, ts)
+	req.Header.Set(HeaderEventID, d.id)
+	req.Header.Set(HeaderSignature, "sha256="+Sign(wh.opts.Secret, ts, d.body))
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("status %s", resp.Status)
+	default:
+		log.Printf("[Webhook] %s rejected delivery: %s", d.url, resp.Status)
+		return nil
+	}
+}
+
+// Sign returns the hex HMAC-SHA256 of timestamp + "." + body, which
+// receivers recompute to verify a delivery.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newID returns a random event ID.
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhooksURLsDeliverIndependently(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+	received := make(chan string, 4)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(HeaderEventID)
+	}))
+	defer up.Close()
+
+	wh := NewWebhooks(Options{
+		URLs:       []string{down.URL, up.URL},
+		Events:     []string{EventGuardrail},
+		MaxRetries: 5,
+		Timeout:    time.Second,
+	})
+	// The down URL backs off for seconds after each event
+	for i := 0; i < 3; i++ {
+		wh.enqueue(EventGuardrail, time.Now(), "", "", "", "test", nil)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatalf("delivery %d to the working URL held up by the failing one", i+1)
+		}
+	}
+}
+
+func TestWebhooksDue(t *testing.T) {
+	wh := NewWebhooks(Options{Cooldown: time.Minute})
+	start := wh.rotated
+	tests := []struct {
+		key   string
+		after time.Duration
+		want  bool
+	}{
+		{"a", 0, true},
+		{"a", 30 * time.Second, false},
+		{"b", 30 * time.Second, true},
+		{"a", 61 * time.Second, true}, // Rotates; a is in the older generation
+		{"b", 80 * time.Second, false},
+		{"b", 91 * time.Second, true},
+		{"a", 100 * time.Second, false},
+		{"a", 200 * time.Second, true}, // Rotates twice over
+		{"c", 200 * time.Second, true},
+		{"c", 259 * time.Second, false},
+	}
+	for _, tt := range tests {
+		if got := wh.due(tt.key, start.Add(tt.after)); got != tt.want {
+			t.Errorf("due(%s) after %s = %t, want %t", tt.key, tt.after, got, tt.want)
+		}
+	}
+	if len(wh.sent)+len(wh.previous) > 3 {
+		t.Errorf("%d sends remembered, want cooled-down ones forgotten", len(wh.sent)+len(wh.previous))
+	}
+
+	off := NewWebhooks(Options{})
+	if !off.due("a", start) || !off.due("a", start) {
+		t.Error("events suppressed without a cooldown")
+	}
+}
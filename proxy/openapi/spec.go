@@ -0,0 +1,267 @@
+// Package openapi validates requests against an OpenAPI 3 document: the
+// path, method, parameters and JSON body of each request must be described
+// by it. It supports the subset of the specification machine-to-machine APIs
+// usually need; unsupported keywords are ignored.
+package openapi
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Spec is a loaded OpenAPI document, ready to validate requests.
+type Spec struct {
+	basePath string
+	paths    []*pathItem // Literal segments before templated ones
+}
+
+type document struct {
+	Servers []struct {
+		URL string `yaml:"url"`
+	} `yaml:"servers"`
+	Paths      map[string]*pathItem `yaml:"paths"`
+	Components struct {
+		Schemas       map[string]*Schema      `yaml:"schemas"`
+		Parameters    map[string]*Parameter   `yaml:"parameters"`
+		RequestBodies map[string]*RequestBody `yaml:"requestBodies"`
+	} `yaml:"components"`
+}
+
+type pathItem struct {
+	Parameters []*Parameter `yaml:"parameters"`
+	Get        *Operation   `yaml:"get"`
+	Put        *Operation   `yaml:"put"`
+	Post       *Operation   `yaml:"post"`
+	Delete     *Operation   `yaml:"delete"`
+	Options    *Operation   `yaml:"options"`
+	Head       *Operation   `yaml:"head"`
+	Patch      *Operation   `yaml:"patch"`
+	Trace      *Operation   `yaml:"trace"`
+
+	template   string
+	segments   []string // "" for a {parameter}
+	paramNames []string // Parameter name of each templated segment
+}
+
+// Operation is one method of a path.
+type Operation struct {
+	Parameters  []*Parameter `yaml:"parameters"`
+	RequestBody *RequestBody `yaml:"requestBody"`
+}
+
+// Parameter is a path, query or header parameter.
+type Parameter struct {
+	Ref      string  `yaml:"$ref"`
+	Name     string  `yaml:"name"`
+	In       string  `yaml:"in"`
+	Required bool    `yaml:"required"`
+	Schema   *Schema `yaml:"schema"`
+}
+
+// RequestBody describes the accepted bodies by media type.
+type RequestBody struct {
+	Ref      string `yaml:"$ref"`
+	Required bool   `yaml:"required"`
+	Content  map[string]struct {
+		Schema *Schema `yaml:"schema"`
+	} `yaml:"content"`
+}
+
+// Schema is a JSON Schema as used by OpenAPI 3.
+type Schema struct {
+	Ref                  string             `yaml:"$ref"`
+	Type                 string             `yaml:"type"`
+	Format               string             `yaml:"format"`
+	Nullable             bool               `yaml:"nullable"`
+	Enum                 []interface{}      `yaml:"enum"`
+	Pattern              string             `yaml:"pattern"`
+	MinLength            *int               `yaml:"minLength"`
+	MaxLength            *int               `yaml:"maxLength"`
+	Minimum              *float64           `yaml:"minimum"`
+	Maximum              *float64           `yaml:"maximum"`
+	Properties           map[string]*Schema `yaml:"properties"`
+	Required             []string           `yaml:"required"`
+	AdditionalProperties *Additional        `yaml:"additionalProperties"`
+	Items                *Schema            `yaml:"items"`
+	MinItems             *int               `yaml:"minItems"`
+	MaxItems             *int               `yaml:"maxItems"`
+	AllOf                []*Schema          `yaml:"allOf"`
+	AnyOf                []*Schema          `yaml:"anyOf"`
+	OneOf                []*Schema          `yaml:"oneOf"`
+
+	target  *Schema // Resolved $ref
+	pattern *regexp.Regexp
+}
+
+// Additional is additionalProperties: false, true or a schema.
+type Additional struct {
+	Allowed bool
+	Schema  *Schema
+}
+
+func (a *Additional) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&a.Allowed)
+	}
+	a.Allowed = true
+	return node.Decode(&a.Schema)
+}
+
+// Load reads an OpenAPI 3 document in YAML or JSON and resolves its local
+// references.
+func Load(path string) (*Spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var doc document
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid OpenAPI document %s: %w", path, err)
+	}
+	if len(doc.Paths) == 0 {
+		return nil, fmt.Errorf("OpenAPI document %s has no paths", path)
+	}
+
+	r := &resolver{doc: &doc, seen: make(map[*Schema]bool)}
+	spec := &Spec{}
+	if len(doc.Servers) > 0 {
+		if u, err := url.Parse(doc.Servers[0].URL); err == nil {
+			spec.basePath = strings.TrimSuffix(u.Path, "/")
+		}
+	}
+	for template, item := range doc.Paths {
+		if item == nil || !strings.HasPrefix(template, "/") {
+			return nil, fmt.Errorf("OpenAPI document %s: invalid path %q", path, template)
+		}
+		item.template = template
+		for _, segment := range strings.Split(strings.TrimPrefix(template, "/"), "/") {
+			if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+				item.segments = append(item.segments, "")
+				item.paramNames = append(item.paramNames, segment[1:len(segment)-1])
+			} else {
+				item.segments = append(item.segments, segment)
+			}
+		}
+		if err := r.pathItem(item); err != nil {
+			return nil, fmt.Errorf("OpenAPI document %s: %s: %w", path, template, err)
+		}
+		spec.paths = append(spec.paths, item)
+	}
+	sort.Slice(spec.paths, func(i, j int) bool {
+		if a, b := len(spec.paths[i].paramNames), len(spec.paths[j].paramNames); a != b {
+			return a < b
+		}
+		return spec.paths[i].template < spec.paths[j].template
+	})
+	return spec, nil
+}
+
+// resolver replaces local references and compiles patterns.
+type resolver struct {
+	doc  *document
+	seen map[*Schema]bool
+}
+
+func (r *resolver) pathItem(item *pathItem) error {
+	if err := r.parameters(item.Parameters); err != nil {
+		return err
+	}
+	for _, op := range item.operations() {
+		if op == nil {
+			continue
+		}
+		if err := r.parameters(op.Parameters); err != nil {
+			return err
+		}
+		if op.RequestBody != nil && op.RequestBody.Ref != "" {
+			name := strings.TrimPrefix(op.RequestBody.Ref, "#/components/requestBodies/")
+			body, ok := r.doc.Components.RequestBodies[name]
+			if !ok {
+				return fmt.Errorf("unresolved reference %q", op.RequestBody.Ref)
+			}
+			op.RequestBody = body
+		}
+		if op.RequestBody != nil {
+			for _, content := range op.RequestBody.Content {
+				if err := r.schema(content.Schema); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (r *resolver) parameters(params []*Parameter) error {
+	for i, p := range params {
+		if p.Ref != "" {
+			name := strings.TrimPrefix(p.Ref, "#/components/parameters/")
+			target, ok := r.doc.Components.Parameters[name]
+			if !ok {
+				return fmt.Errorf("unresolved reference %q", p.Ref)
+			}
+			params[i], p = target, target
+		}
+		if p.In != "path" && p.In != "query" && p.In != "header" && p.In != "cookie" {
+			return fmt.Errorf("parameter %q: invalid location %q", p.Name, p.In)
+		}
+		if err := r.schema(p.Schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *resolver) schema(s *Schema) error {
+	if s == nil || r.seen[s] {
+		return nil
+	}
+	r.seen[s] = true
+
+	if s.Ref != "" {
+		name := strings.TrimPrefix(s.Ref, "#/components/schemas/")
+		target, ok := r.doc.Components.Schemas[name]
+		if !ok {
+			return fmt.Errorf("unresolved reference %q", s.Ref)
+		}
+		s.target = target
+		return r.schema(target)
+	}
+	if s.Pattern != "" {
+		re, err := regexp.Compile(s.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", s.Pattern, err)
+		}
+		s.pattern = re
+	}
+
+	children := []*Schema{s.Items}
+	for _, p := range s.Properties {
+		children = append(children, p)
+	}
+	if s.AdditionalProperties != nil {
+		children = append(children, s.AdditionalProperties.Schema)
+	}
+	children = append(children, s.AllOf...)
+	children = append(children, s.AnyOf...)
+	children = append(children, s.OneOf...)
+	for _, child := range children {
+		if err := r.schema(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (item *pathItem) operations() map[string]*Operation {
+	return map[string]*Operation{
+		"GET": item.Get, "PUT": item.Put, "POST": item.Post, "DELETE": item.Delete,
+		"OPTIONS": item.Options, "HEAD": item.Head, "PATCH": item.Patch, "TRACE": item.Trace,
+	}
+}
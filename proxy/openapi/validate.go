@@ -0,0 +1,345 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// maxViolations bounds the violations reported for one request.
+const maxViolations = 10
+
+// Validate checks the request against the document and returns its
+// violations, e.g. "query.limit: must be an integer". body is the request
+// body read so far; truncated reports whether it was cut short, in which
+// case the body isn't checked against its schema.
+func (s *Spec) Validate(r *http.Request, body []byte, truncated bool) []string {
+	v := &validation{}
+
+	path := r.URL.Path
+	if s.basePath != "" {
+		if path != s.basePath && !strings.HasPrefix(path, s.basePath+"/") {
+			return []string{"path: not described by the API"}
+		}
+		path = strings.TrimPrefix(path, s.basePath)
+	}
+	item, pathParams := s.match(path)
+	if item == nil {
+		return []string{"path: not described by the API"}
+	}
+	op := item.operations()[r.Method]
+	if op == nil {
+		return []string{"method: " + r.Method + " not allowed for " + item.template}
+	}
+
+	for _, p := range mergeParameters(item.Parameters, op.Parameters) {
+		var values []string
+		switch p.In {
+		case "path":
+			values = []string{pathParams[p.Name]}
+		case "query":
+			values = r.URL.Query()[p.Name]
+		case "header":
+			values = r.Header.Values(p.Name)
+		case "cookie":
+			if c, err := r.Cookie(p.Name); err == nil {
+				values = []string{c.Value}
+			}
+		}
+		name := p.In + "." + p.Name
+		if len(values) == 0 {
+			if p.Required {
+				v.add(name, "is required")
+			}
+			continue
+		}
+		v.param(p.Schema, values, name)
+	}
+
+	if op.RequestBody != nil {
+		v.body(op.RequestBody, r.Header.Get("Content-Type"), body, truncated)
+	}
+	return v.violations
+}
+
+// match finds the path item of a request path and its path parameters.
+func (s *Spec) match(path string) (*pathItem, map[string]string) {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for _, item := range s.paths {
+		if len(item.segments) != len(segments) {
+			continue
+		}
+		var values []string
+		matched := true
+		for i, segment := range item.segments {
+			if segment == "" {
+				if segments[i] == "" {
+					matched = false
+					break
+				}
+				values = append(values, segments[i])
+			} else if segment != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		params := make(map[string]string, len(values))
+		for i, name := range item.paramNames {
+			params[name] = values[i]
+		}
+		return item, params
+	}
+	return nil, nil
+}
+
+// mergeParameters applies an operation's parameters over its path's.
+func mergeParameters(pathParams, opParams []*Parameter) []*Parameter {
+	merged := append([]*Parameter(nil), opParams...)
+	for _, p := range pathParams {
+		overridden := false
+		for _, o := range opParams {
+			if o.Name == p.Name && o.In == p.In {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
+type validation struct {
+	violations []string
+}
+
+func (v *validation) add(location, message string) {
+	if len(v.violations) < maxViolations {
+		v.violations = append(v.violations, location+": "+message)
+	}
+}
+
+// param converts the raw values of a parameter to its schema's type and
+// validates them.
+func (v *validation) param(schema *Schema, values []string, name string) {
+	schema = schema.resolve()
+	if schema == nil {
+		return
+	}
+	if schema.Type == "array" {
+		var items []interface{}
+		for _, value := range values {
+			for _, item := range strings.Split(value, ",") {
+				items = append(items, convert(schema.Items.resolve(), item))
+			}
+		}
+		v.value(schema, items, name)
+		return
+	}
+	v.value(schema, convert(schema, values[0]), name)
+}
+
+// convert parses a parameter value as its schema's type, leaving it a string
+// when it doesn't parse so the type check reports it.
+func convert(schema *Schema, raw string) interface{} {
+	if schema == nil {
+		return raw
+	}
+	switch schema.Type {
+	case "integer", "number":
+		if n, err := strconv.ParseFloat(raw, 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(raw); err == nil {
+			return b
+		}
+	}
+	return raw
+}
+
+// body checks the media type and, for JSON, the body's schema.
+func (v *validation) body(rb *RequestBody, contentType string, body []byte, truncated bool) {
+	if len(body) == 0 {
+		if rb.Required {
+			v.add("body", "is required")
+		}
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	content, ok := rb.Content[mediaType]
+	if !ok {
+		content, ok = rb.Content[strings.SplitN(mediaType, "/", 2)[0]+"/*"]
+	}
+	if !ok {
+		content, ok = rb.Content["*/*"]
+	}
+	if !ok {
+		v.add("body", fmt.Sprintf("content type %q is not accepted", mediaType))
+		return
+	}
+	if content.Schema == nil || truncated || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		v.add("body", "is not valid JSON")
+		return
+	}
+	v.value(content.Schema, value, "body")
+}
+
+// value validates a decoded JSON value against the schema.
+func (v *validation) value(schema *Schema, value interface{}, location string) {
+	schema = schema.resolve()
+	if schema == nil {
+		return
+	}
+
+	if value == nil {
+		if !schema.Nullable && schema.Type != "" {
+			v.add(location, "must not be null")
+		}
+		return
+	}
+	if !typeMatches(schema.Type, value) {
+		v.add(location, "must be "+article(schema.Type))
+		return
+	}
+	if len(schema.Enum) > 0 && !inEnum(schema.Enum, value) {
+		v.add(location, "is not one of the allowed values")
+	}
+
+	switch value := value.(type) {
+	case string:
+		length := len([]rune(value))
+		if schema.MinLength != nil && length < *schema.MinLength {
+			v.add(location, fmt.Sprintf("must be at least %d characters", *schema.MinLength))
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			v.add(location, fmt.Sprintf("must be at most %d characters", *schema.MaxLength))
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(value) {
+			v.add(location, "does not match the pattern")
+		}
+	case float64:
+		if schema.Minimum != nil && value < *schema.Minimum {
+			v.add(location, fmt.Sprintf("must be at least %g", *schema.Minimum))
+		}
+		if schema.Maximum != nil && value > *schema.Maximum {
+			v.add(location, fmt.Sprintf("must be at most %g", *schema.Maximum))
+		}
+	case []interface{}:
+		if schema.MinItems != nil && len(value) < *schema.MinItems {
+			v.add(location, fmt.Sprintf("must have at least %d items", *schema.MinItems))
+		}
+		if schema.MaxItems != nil && len(value) > *schema.MaxItems {
+			v.add(location, fmt.Sprintf("must have at most %d items", *schema.MaxItems))
+		}
+		for i, item := range value {
+			v.value(schema.Items, item, fmt.Sprintf("%s[%d]", location, i))
+		}
+	case map[string]interface{}:
+		for _, name := range schema.Required {
+			if _, ok := value[name]; !ok {
+				v.add(location+"."+name, "is required")
+			}
+		}
+		for name, field := range value {
+			if prop, ok := schema.Properties[name]; ok {
+				v.value(prop, field, location+"."+name)
+			} else if ap := schema.AdditionalProperties; ap != nil && !ap.Allowed {
+				v.add(location+"."+name, "is not allowed")
+			} else if ap != nil {
+				v.value(ap.Schema, field, location+"."+name)
+			}
+		}
+	}
+
+	for _, sub := range schema.AllOf {
+		v.value(sub, value, location)
+	}
+	if len(schema.AnyOf) > 0 && matching(schema.AnyOf, value) == 0 {
+		v.add(location, "matches none of the allowed schemas")
+	}
+	if len(schema.OneOf) > 0 && matching(schema.OneOf, value) != 1 {
+		v.add(location, "must match exactly one of the allowed schemas")
+	}
+}
+
+// matching counts the schemas the value is valid against.
+func matching(schemas []*Schema, value interface{}) int {
+	n := 0
+	for _, s := range schemas {
+		sub := &validation{}
+		sub.value(s, value, "")
+		if len(sub.violations) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Schema) resolve() *Schema {
+	for s != nil && s.target != nil {
+		s = s.target
+	}
+	return s
+}
+
+func typeMatches(typ string, value interface{}) bool {
+	switch typ {
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	}
+	return true
+}
+
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		// YAML decodes numbers as int; JSON as float64
+		if n, ok := allowed.(int); ok {
+			allowed = float64(n)
+		}
+		if reflect.DeepEqual(allowed, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func article(typ string) string {
+	switch typ {
+	case "integer", "object", "array":
+		return "an " + typ
+	}
+	return "a " + typ
+}
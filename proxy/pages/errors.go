@@ -0,0 +1,91 @@
+package pages
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var responses = metrics.NewCounterVec("aegis_error_responses_total",
+	"Responses the proxy wrote itself instead of the upstream's, by status and reason code.", "status", "code")
+
+// Error is a refusal the proxy answers itself: its status, the reason
+// code reported to clients and selecting the page, and the message plain
+// text clients get. Stages return or write these instead of composing
+// responses, so the same refusal reads the same everywhere.
+type Error struct {
+	Status  int
+	Code    string
+	Message string
+	Err     error // The cause, for logs; never sent to clients
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Code + ": " + e.Err.Error()
+	}
+	return e.Code
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Is matches errors with the same status and code, so a wrapped refusal
+// is still errors.Is its sentinel.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Status == e.Status && t.Code == e.Code
+}
+
+// Wrap returns a copy of e caused by err.
+func (e *Error) Wrap(err error) *Error {
+	wrapped := *e
+	wrapped.Err = err
+	return &wrapped
+}
+
+// Refusals shared by the stages and handlers.
+var (
+	ErrBlocked         = &Error{http.StatusForbidden, CodeBlocked, "Forbidden - IP Blocked", nil}
+	ErrSubjectBlocked  = &Error{http.StatusForbidden, CodeBlocked, "Forbidden - Subject Blocked", nil}
+	ErrQuarantined     = &Error{http.StatusForbidden, CodeQuarantined, "Forbidden - Quarantined", nil}
+	ErrRiskTooHigh     = &Error{http.StatusForbidden, CodeRiskTooHigh, "Forbidden - Risk Too High", nil}
+	ErrChallenge       = &Error{http.StatusForbidden, CodeChallenge, "Forbidden - Challenge Required", nil}
+	ErrReauth          = &Error{http.StatusUnauthorized, CodeReauth, "Unauthorized - Re-authentication Required", nil}
+	ErrRateLimited     = &Error{http.StatusTooManyRequests, CodeRateLimited, "Too Many Requests", nil}
+	ErrConcurrency     = &Error{http.StatusTooManyRequests, CodeConcurrencyLimited, "Too Many Requests - Concurrency Limit", nil}
+	ErrTokenMissing    = &Error{http.StatusUnauthorized, CodeUnauthorized, "Unauthorized - Missing token", nil}
+	ErrTokenMalformed  = &Error{http.StatusUnauthorized, CodeUnauthorized, "Unauthorized - Invalid token format", nil}
+	ErrTokenInvalid    = &Error{http.StatusUnauthorized, CodeUnauthorized, "Unauthorized - Invalid token", nil}
+	ErrTokenExpired    = &Error{http.StatusUnauthorized, CodeTokenExpired, "Unauthorized - Token expired", nil}
+	ErrUnavailable     = &Error{http.StatusServiceUnavailable, CodeUnavailable, "Service Unavailable", nil}
+	ErrOverloaded      = &Error{http.StatusServiceUnavailable, CodeOverloaded, "Service Unavailable - Overloaded", nil}
+	ErrMaintenance     = &Error{http.StatusServiceUnavailable, CodeMaintenance, "Service Unavailable - Maintenance", nil}
+	ErrUpstreamFailed  = &Error{http.StatusBadGateway, CodeUpstreamFailed, "Bad Gateway", nil}
+	ErrUpstreamTimeout = &Error{http.StatusGatewayTimeout, CodeUpstreamTimeout, "Gateway Timeout", nil}
+	ErrNoRoute         = &Error{http.StatusNotFound, CodeNoRoute, "Not Found", nil}
+	ErrMisdirected     = &Error{http.StatusMisdirectedRequest, CodeMisdirected, "Misdirected Request", nil}
+	ErrEgressDenied    = &Error{http.StatusForbidden, CodeEgressDenied, "Forbidden - Destination not allowed", nil}
+	ErrWAFBlocked      = &Error{http.StatusForbidden, CodeWAFBlocked, "Forbidden - Request Blocked", nil}
+	ErrProtocolAnomaly = &Error{http.StatusBadRequest, CodeProtocolAnomaly, "Bad Request - Malformed Request", nil}
+	ErrDLPBlocked      = &Error{http.StatusBadGateway, CodeDLPBlocked, "Bad Gateway - Response Blocked", nil}
+	ErrResponseBlocked = &Error{http.StatusBadGateway, CodeResponseBlocked, "Bad Gateway - Response Not Allowed", nil}
+	ErrOffSchedule     = &Error{http.StatusForbidden, CodeOffSchedule, "Forbidden - Outside Allowed Hours", nil}
+	ErrCSRF            = &Error{http.StatusForbidden, CodeForbidden, "Forbidden - Invalid CSRF Token", nil}
+	ErrCrossOrigin     = &Error{http.StatusForbidden, CodeForbidden, "Forbidden - Cross-Origin Request Not Allowed", nil}
+	ErrInternal        = &Error{http.StatusInternalServerError, CodeInternal, "Internal Server Error", nil}
+)
+
+// WriteError writes the refusal err is, or wraps. Any other error is
+// logged and answered as an internal error, without its details.
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *Error
+	if !errors.As(err, &e) {
+		logging.For(r.Context()).Warnf("[Pages] Unexpected error answering %s %s: %v", r.Method, r.URL.Path, err)
+		e = ErrInternal
+	} else if e.Err != nil {
+		logging.For(r.Context()).Debugf("[Pages] %s %s refused with %s: %v", r.Method, r.URL.Path, e.Code, e.Err)
+	}
+	Write(w, r, e.Status, e.Code, e.Message)
+}
@@ -0,0 +1,206 @@
+// Package pages renders the responses the proxy writes itself (blocks,
+// challenges, maintenance) as HTML or JSON pages for browsers and API
+// clients. Other clients get the plain-text message, as before.
+package pages
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+)
+
+// Reason codes, reported to clients and selecting the page.
+const (
+	CodeBlocked        = "blocked"
+	CodeQuarantined    = "quarantined"
+	CodePolicyDenied   = "policy_denied"
+	CodeRiskTooHigh    = "risk_too_high"
+	CodeChallenge      = "challenge_required"
+	CodeReauth         = "reauth_required"
+	CodeRateLimited    = "rate_limited"
+	CodeUnauthorized   = "unauthorized"
+	CodeUnavailable    = "unavailable"
+	CodeMaintenance    = "maintenance"
+	CodeUpstreamFailed = "upstream_failed"
+
+	CodeForbidden        = "forbidden"
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeBodyTooLarge     = "body_too_large"
+	CodeWAFBlocked       = "waf_blocked"
+	CodeSchemaViolation  = "schema_violation"
+
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeHeadersTooLarge      = "headers_too_large"
+	CodeProtocolAnomaly      = "protocol_anomaly"
+	CodeDLPBlocked           = "dlp_blocked"
+	CodeReplayRejected       = "replay_rejected"
+	CodeOverloaded           = "overloaded"
+	CodeNoRoute              = "no_route"
+	CodeEgressDenied         = "egress_denied"
+	CodeMisdirected          = "misdirected_request"
+	CodeInjectedFault        = "injected_fault"
+	CodeTokenExpired         = "token_expired"
+	CodeUpstreamTimeout      = "upstream_timeout"
+	CodeInternal             = "internal_error"
+	CodeConcurrencyLimited   = "concurrency_limited"
+	CodeOffSchedule          = "outside_schedule"
+	CodeResponseBlocked      = "response_blocked"
+)
+
+// pageNames maps reason codes to the page templates that render them.
+var pageNames = map[string]string{
+	CodeBlocked:            "blocked",
+	CodeQuarantined:        "blocked",
+	CodePolicyDenied:       "blocked",
+	CodeRiskTooHigh:        "blocked",
+	CodeChallenge:          "challenge",
+	CodeReauth:             "unauthorized",
+	CodeUnauthorized:       "unauthorized",
+	CodeRateLimited:        "rate_limited",
+	CodeUnavailable:        "unavailable",
+	CodeMaintenance:        "maintenance",
+	CodeUpstreamFailed:     "unavailable",
+	CodeForbidden:          "blocked",
+	CodeWAFBlocked:         "blocked",
+	CodeEgressDenied:       "blocked",
+	CodeDLPBlocked:         "unavailable",
+	CodeOverloaded:         "unavailable",
+	CodeInjectedFault:      "unavailable",
+	CodeTokenExpired:       "unauthorized",
+	CodeUpstreamTimeout:    "unavailable",
+	CodeInternal:           "unavailable",
+	CodeConcurrencyLimited: "rate_limited",
+	CodeOffSchedule:        "blocked",
+	CodeResponseBlocked:    "unavailable",
+}
+
+// Data are the template variables of a page.
+type Data struct {
+	Status  int    `json:"status"`
+	Code    string `json:"error"`
+	Message string `json:"message"`
+	TraceID string `json:"trace_id"`
+	Support string `json:"support,omitempty"`
+}
+
+// defaultPage renders every code unless a directory overrides it.
+const defaultPage = `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>{{.Status}} {{.Message}}</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto">
+<h1>{{.Message}}</h1>
+<p>Your request could not be completed ({{.Code}}).</p>
+{{if .Support}}<p>If you believe this is a mistake, contact {{.Support}} and quote reference <code>{{.TraceID}}</code>.</p>
+{{else}}<p>Reference: <code>{{.TraceID}}</code></p>{{end}}
+</body>
+</html>
+`
+
+// Set is a loaded set of page templates.
+type Set struct {
+	pages   map[string]*template.Template
+	support string
+}
+
+var current atomic.Pointer[Set]
+
+// Load reads <page>.html templates (blocked, challenge, unauthorized,
+// rate_limited, unavailable, maintenance, and default for the rest) from
+// dir. An empty dir uses the built-in page for everything.
+func Load(dir, support string) (*Set, error) {
+	fallback := template.Must(template.New("default").Parse(defaultPage))
+	set := &Set{pages: map[string]*template.Template{"default": fallback}, support: support}
+	if dir == "" {
+		return set, nil
+	}
+
+	names := []string{"default"}
+	for _, name := range pageNames {
+		names = append(names, name)
+	}
+	for _, name := range names {
+		path := filepath.Join(dir, name+".html")
+		data, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tmpl, err := template.New(name).Parse(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid page %s: %w", path, err)
+		}
+		set.pages[name] = tmpl
+	}
+	return set, nil
+}
+
+// Use makes set the pages rendered by Write.
+func Use(set *Set) {
+	current.Store(set)
+}
+
+// Write writes a refusal: JSON for clients accepting application/json, HTML
+// for clients accepting text/html, and message as plain text otherwise.
+func Write(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	responses.Inc(strconv.Itoa(status), code)
+	logging.For(r.Context()).Debugf("[Pages] Answering %s %s with %d code=%s", r.Method, r.URL.Path, status, code)
+
+	set := current.Load()
+	accept := r.Header.Get("Accept")
+	if set == nil || (!strings.Contains(accept, "application/json") && !strings.Contains(accept, "text/html")) {
+		http.Error(w, message, status)
+		return
+	}
+
+	data := Data{Status: status, Code: code, Message: message, TraceID: TraceID(r), Support: set.support}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if strings.Contains(accept, "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+
+	tmpl, ok := set.pages[pageNames[code]]
+	if !ok {
+		tmpl = set.pages["default"]
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// TraceID returns the request's ID, or without one its trace ID from a W3C
+// traceparent or X-Request-Id header, or a new random one.
+func TraceID(r *http.Request) string {
+	if id := logging.RequestID(r.Context()); id != "" {
+		return id
+	}
+	if parts := strings.Split(r.Header.Get("traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 {
+		return parts[1]
+	}
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 {
+		return id
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
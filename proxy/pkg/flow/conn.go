@@ -0,0 +1,96 @@
+package flow
+
+import (
+	"sync"
+	"time"
+)
+
+// ConnMeter measures the traffic of one relayed connection in both
+// directions, keeping the same sliding windows as the request flows. Each
+// read counts as a packet.
+type ConnMeter struct {
+	mu    sync.Mutex
+	start time.Time
+	last  time.Time // Last read from the client
+
+	fwdLengths []float64
+	bwdLengths []float64
+	fwdIATs    []float64
+
+	bytesIn, bytesOut     int64
+	packetsIn, packetsOut int
+}
+
+// Measurement is the traffic of a connection measured so far.
+type Measurement struct {
+	Start      time.Time // When measuring started
+	Duration   time.Duration
+	BytesIn    int64 // From the client
+	BytesOut   int64 // To the client
+	PacketsIn  int
+	PacketsOut int
+	Features   *Features
+}
+
+// NewConnMeter starts measuring a connection.
+func NewConnMeter() *ConnMeter {
+	return &ConnMeter{start: time.Now()}
+}
+
+// Forward records n bytes read from the client.
+func (m *ConnMeter) Forward(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if !m.last.IsZero() {
+		m.fwdIATs = appendWindow(m.fwdIATs, float64(now.Sub(m.last).Microseconds()))
+	}
+	m.last = now
+	m.fwdLengths = appendWindow(m.fwdLengths, float64(n))
+	m.bytesIn += int64(n)
+	m.packetsIn++
+}
+
+// Backward records n bytes read from the upstream.
+func (m *ConnMeter) Backward(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bwdLengths = appendWindow(m.bwdLengths, float64(n))
+	m.bytesOut += int64(n)
+	m.packetsOut++
+}
+
+// Measure returns the traffic measured so far, with its features.
+func (m *ConnMeter) Measure() Measurement {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elapsed := time.Since(m.start)
+
+	bwdMean := calculateMean(m.bwdLengths)
+	features := &Features{
+		BwdPacketLengthStd:  calculateStdDev(m.bwdLengths, bwdMean),
+		BwdPacketLengthMean: bwdMean,
+		FwdIATMean:          calculateMean(m.fwdIATs),
+		FwdIATMax:           calculateMax(m.fwdIATs),
+		FwdIATMin:           calculateMin(m.fwdIATs),
+		FwdIATTotal:         calculateSum(m.fwdIATs),
+		TotalFwdPackets:     m.packetsIn,
+		SubflowFwdPackets:   m.packetsIn,
+	}
+	if packets := m.packetsIn + m.packetsOut; packets > 0 {
+		features.AvgPacketSize = float64(m.bytesIn+m.bytesOut) / float64(packets)
+		if seconds := elapsed.Seconds(); seconds > 0 {
+			features.FlowBytesSec = float64(m.bytesIn+m.bytesOut) / seconds
+			features.FlowPacketsSec = float64(packets) / seconds
+		}
+	}
+	return Measurement{
+		Start:      m.start,
+		Duration:   elapsed,
+		BytesIn:    m.bytesIn,
+		BytesOut:   m.bytesOut,
+		PacketsIn:  m.packetsIn,
+		PacketsOut: m.packetsOut,
+		Features:   features,
+	}
+}
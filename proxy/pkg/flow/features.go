@@ -0,0 +1,126 @@
+// Package flow extracts the traffic features Aegis Zero's models score: per
+// client flows of requests and responses, or relayed connections, reduced
+// to the statistics of the CIC-IDS feature set the XGBoost model was
+// trained on.
+//
+// The package is part of the proxy's public API, for Go services embedding
+// the same feature extraction in-process so their features match what the
+// proxy ships. Its exported names and the JSON encoding of Features change
+// only in backward-compatible ways.
+package flow
+
+import "math"
+
+// Features are the traffic characteristics extracted for the AI model.
+// These align with the features expected by the XGBoost model.
+type Features struct {
+	BwdPacketLengthStd  float64 `json:"bwd_packet_length_std"`
+	BwdPacketLengthMean float64 `json:"bwd_packet_length_mean"`
+	AvgPacketSize       float64 `json:"avg_packet_size"`
+	FlowBytesSec        float64 `json:"flow_bytes_s"`
+	FlowPacketsSec      float64 `json:"flow_packets_s"`
+	FwdIATMean          float64 `json:"fwd_iat_mean"`
+	FwdIATMax           float64 `json:"fwd_iat_max"`
+	FwdIATMin           float64 `json:"fwd_iat_min"`
+	FwdIATTotal         float64 `json:"fwd_iat_total"`
+	TotalFwdPackets     int     `json:"total_fwd_packets"`
+	SubflowFwdPackets   int     `json:"subflow_fwd_packets"`
+
+	// Response statuses over the window, before this request's: enumeration
+	// and brute force show far more clearly in them than in packet sizes.
+	// Connection flows have no statuses and leave them zero.
+	ClientErrorRatio   float64 `json:"client_error_ratio"`  // 4xx share
+	ServerErrorRatio   float64 `json:"server_error_ratio"`  // 5xx share
+	UnauthorizedStreak int     `json:"unauthorized_streak"` // 401s in a row, up to the latest
+	StatusEntropy      float64 `json:"status_entropy"`      // Shannon entropy of the codes, in bits
+}
+
+// Window is the number of samples kept per flow.
+const Window = 100
+
+// appendWindow appends v, dropping the oldest sample once the window is
+// full. Samples shift within the window's own array, so a busy flow
+// doesn't keep reallocating it the way reslicing past the front does.
+func appendWindow(window []float64, v float64) []float64 {
+	if len(window) == Window {
+		copy(window, window[1:])
+		window = window[:Window-1]
+	}
+	return append(window, v)
+}
+
+// --- Statistical Helpers ---
+
+func calculateMean(data []float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range data {
+		sum += v
+	}
+	return sum / float64(len(data))
+}
+
+func calculateStdDev(data []float64, mean float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	var sumSq float64
+	for _, v := range data {
+		diff := v - mean
+		sumSq += diff * diff
+	}
+	return math.Sqrt(sumSq / float64(len(data)))
+}
+
+func calculateMax(data []float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	max := data[0]
+	for _, v := range data {
+		if v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+func calculateMin(data []float64) float64 {
+	if len(data) == 0 {
+		return 0
+	}
+	min := data[0]
+	for _, v := range data {
+		if v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// statusEntropy is the Shannon entropy, in bits, of the status codes.
+func statusEntropy(statuses []int) float64 {
+	if len(statuses) == 0 {
+		return 0
+	}
+	counts := make(map[int]int)
+	for _, status := range statuses {
+		counts[status]++
+	}
+	var entropy float64
+	for _, n := range counts {
+		p := float64(n) / float64(len(statuses))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+func calculateSum(data []float64) float64 {
+	var sum float64
+	for _, v := range data {
+		sum += v
+	}
+	return sum
+}
@@ -0,0 +1,255 @@
+package flow
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key identifies a client's flow, namespaced by tenant so tenants' clients
+// behind the same address are tracked apart. An empty tenant is the
+// client's address alone.
+func Key(tenant, clientIP string) string {
+	if tenant == "" {
+		return clientIP
+	}
+	return tenant + "/" + clientIP
+}
+
+// SplitKey reverses Key.
+func SplitKey(key string) (tenant, clientIP string) {
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return "", key
+}
+
+// Stats maintains the state of a single client's traffic flow.
+type Stats struct {
+	mu sync.Mutex // Protects concurrent access to stats
+
+	LastRequestTime time.Time
+	FlowStartTime   time.Time
+
+	// Sliding window data
+	FwdPacketLengths []float64
+	BwdPacketLengths []float64
+	FwdIATs          []float64
+	Statuses         []int // Response status codes
+
+	UnauthorizedStreak int // 401 responses since the last other status
+
+	TotalFwdPkts int
+	TotalBwdPkts int
+}
+
+// Tracker manages traffic statistics for all active clients.
+type Tracker struct {
+	flows sync.Map // Map[string]*Stats
+}
+
+// NewTracker initializes a new flow tracking system.
+func NewTracker() *Tracker {
+	return &Tracker{}
+}
+
+// getOrCreateFlow retrieves an existing flow or initializes a new one.
+func (ft *Tracker) getOrCreateFlow(clientIP string) *Stats {
+	// Fast path: try load
+	if v, ok := ft.flows.Load(clientIP); ok {
+		return v.(*Stats)
+	}
+
+	// Slow path: initialize
+	newFlow := &Stats{
+		LastRequestTime:  time.Time{},
+		FlowStartTime:    time.Now(),
+		FwdPacketLengths: make([]float64, 0, Window), // Pre-allocate capacity
+		BwdPacketLengths: make([]float64, 0, Window),
+		FwdIATs:          make([]float64, 0, Window),
+		Statuses:         make([]int, 0, Window),
+	}
+
+	v, _ := ft.flows.LoadOrStore(clientIP, newFlow)
+	return v.(*Stats)
+}
+
+// TrackRequest captures metadata from an incoming request of the flow
+// key, usually made with Key. It returns the current feature set for the
+// AI model.
+func (ft *Tracker) TrackRequest(clientIP string, reqSize int64) *Features {
+	stats := ft.getOrCreateFlow(clientIP)
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	now := time.Now()
+
+	// Calculate Inter-Arrival Time (IAT)
+	var fwdIAT float64
+	if !stats.LastRequestTime.IsZero() {
+		fwdIAT = float64(now.Sub(stats.LastRequestTime).Microseconds())
+	}
+
+	// Update statistics, keeping a sliding window of the last 100 samples
+	stats.TotalFwdPkts++
+	stats.FwdPacketLengths = appendWindow(stats.FwdPacketLengths, float64(reqSize))
+	if fwdIAT > 0 {
+		stats.FwdIATs = appendWindow(stats.FwdIATs, fwdIAT)
+	}
+	stats.LastRequestTime = now
+
+	// Compile features
+	features := &Features{}
+	stats.fwdFeatures(features)
+	return features
+}
+
+// UpdateResponseStats captures metadata from the outgoing response.
+//
+// Deprecated: Use TrackResponse, which also records the response status.
+func (ft *Tracker) UpdateResponseStats(clientIP string, respSize int64, features *Features) {
+	ft.TrackResponse(clientIP, respSize, 0, features)
+}
+
+// TrackResponse captures metadata from the outgoing response: its size and
+// status code, which is left out of the status features when 0.
+func (ft *Tracker) TrackResponse(clientIP string, respSize int64, status int, features *Features) {
+	stats := ft.getOrCreateFlow(clientIP)
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	stats.TotalBwdPkts++
+	stats.BwdPacketLengths = appendWindow(stats.BwdPacketLengths, float64(respSize))
+	if status != 0 {
+		if len(stats.Statuses) == Window {
+			copy(stats.Statuses, stats.Statuses[1:])
+			stats.Statuses = stats.Statuses[:Window-1]
+		}
+		stats.Statuses = append(stats.Statuses, status)
+		if status == 401 {
+			stats.UnauthorizedStreak++
+		} else {
+			stats.UnauthorizedStreak = 0
+		}
+	}
+
+	stats.bwdFeatures(features)
+}
+
+// fwdFeatures fills in the request-side features. The caller holds stats.mu.
+func (stats *Stats) fwdFeatures(features *Features) {
+	features.TotalFwdPackets = stats.TotalFwdPkts
+	features.SubflowFwdPackets = stats.TotalFwdPkts // Simplified: subflow = flow
+	features.FwdIATMean = calculateMean(stats.FwdIATs)
+	features.FwdIATMax = calculateMax(stats.FwdIATs)
+	features.FwdIATMin = calculateMin(stats.FwdIATs)
+	features.FwdIATTotal = calculateSum(stats.FwdIATs)
+	stats.statusFeatures(features)
+}
+
+// statusFeatures fills in the response status features, from the responses
+// before the current request. The caller holds stats.mu.
+func (stats *Stats) statusFeatures(features *Features) {
+	features.ClientErrorRatio, features.ServerErrorRatio = 0, 0
+	if n := len(stats.Statuses); n > 0 {
+		var clientErrors, serverErrors int
+		for _, status := range stats.Statuses {
+			switch {
+			case status >= 500:
+				serverErrors++
+			case status >= 400:
+				clientErrors++
+			}
+		}
+		features.ClientErrorRatio = float64(clientErrors) / float64(n)
+		features.ServerErrorRatio = float64(serverErrors) / float64(n)
+	}
+	features.UnauthorizedStreak = stats.UnauthorizedStreak
+	features.StatusEntropy = statusEntropy(stats.Statuses)
+}
+
+// bwdFeatures fills in the bidirectional features. The caller holds stats.mu.
+func (stats *Stats) bwdFeatures(features *Features) {
+	bwdMean := calculateMean(stats.BwdPacketLengths)
+	features.BwdPacketLengthMean = bwdMean
+	features.BwdPacketLengthStd = calculateStdDev(stats.BwdPacketLengths, bwdMean)
+
+	// Combine Fwd + Bwd for average size
+	// Note: In high production, we might optimize avoiding the append here
+	totalPackets := float64(stats.TotalFwdPkts + stats.TotalBwdPkts)
+	totalSize := calculateSum(stats.FwdPacketLengths) + calculateSum(stats.BwdPacketLengths)
+	if totalPackets > 0 {
+		features.AvgPacketSize = totalSize / totalPackets
+	}
+}
+
+// Snapshot summarizes a client's tracked flow for inspection.
+type Snapshot struct {
+	ClientIP         string    `json:"client_ip"`
+	Tenant           string    `json:"tenant,omitempty"`
+	FlowStart        time.Time `json:"flow_start"`
+	LastRequest      time.Time `json:"last_request"`
+	Requests         int       `json:"requests"`
+	Responses        int       `json:"responses"`
+	MeanRequestSize  float64   `json:"mean_request_size"`
+	MeanResponseSize float64   `json:"mean_response_size"`
+	MeanIATMicros    float64   `json:"mean_iat_us"`
+	MinIATMicros     float64   `json:"min_iat_us"`
+
+	// Features is the vector the scoring engine would see for the next request
+	Features Features `json:"features"`
+}
+
+// Snapshot returns the flow state of a client, if it is tracked. Flows are
+// keyed by Key.
+func (ft *Tracker) Snapshot(key string) (*Snapshot, bool) {
+	v, ok := ft.flows.Load(key)
+	if !ok {
+		return nil, false
+	}
+	stats := v.(*Stats)
+
+	stats.mu.Lock()
+	defer stats.mu.Unlock()
+
+	tenant, clientIP := SplitKey(key)
+	snapshot := &Snapshot{
+		Tenant:           tenant,
+		ClientIP:         clientIP,
+		FlowStart:        stats.FlowStartTime,
+		LastRequest:      stats.LastRequestTime,
+		Requests:         stats.TotalFwdPkts,
+		Responses:        stats.TotalBwdPkts,
+		MeanRequestSize:  calculateMean(stats.FwdPacketLengths),
+		MeanResponseSize: calculateMean(stats.BwdPacketLengths),
+		MeanIATMicros:    calculateMean(stats.FwdIATs),
+		MinIATMicros:     calculateMin(stats.FwdIATs),
+	}
+	stats.fwdFeatures(&snapshot.Features)
+	stats.bwdFeatures(&snapshot.Features)
+	return snapshot, true
+}
+
+// Recent returns snapshots of the clients seen in the last window, most
+// recently active first, up to limit. A non-empty tenant selects its flows only.
+func (ft *Tracker) Recent(tenant string, window time.Duration, limit int) []*Snapshot {
+	cutoff := time.Now().Add(-window)
+
+	var flows []*Snapshot
+	ft.flows.Range(func(key, _ interface{}) bool {
+		snapshot, ok := ft.Snapshot(key.(string))
+		if ok && snapshot.LastRequest.After(cutoff) && (tenant == "" || snapshot.Tenant == tenant) {
+			flows = append(flows, snapshot)
+		}
+		return true
+	})
+
+	sort.Slice(flows, func(i, j int) bool { return flows[i].LastRequest.After(flows[j].LastRequest) })
+	if len(flows) > limit {
+		flows = flows[:limit]
+	}
+	return flows
+}
@@ -0,0 +1,270 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+// scoreBuckets are the upper bounds of the score distribution.
+var scoreBuckets = []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1}
+
+var (
+	riskScoreHistogram = metrics.NewHistogramVec("aegis_risk_score",
+		"Risk scores assigned to requests.", scoreBuckets, "model", "tenant")
+	decisionsTotal = metrics.NewCounterVec("aegis_decisions_total",
+		"Scoring decisions by action.", "action", "tenant")
+	blocksTotal = metrics.NewCounterVec("aegis_blocks_total",
+		"Requests refused with 403, by the stage that refused them.", "stage", "tenant")
+
+	// trackedClients reports the latest aggregator's clients; it is
+	// registered once however many aggregators are created
+	latestAggregator atomic.Pointer[RiskAggregator]
+	trackedClients   = sync.OnceFunc(func() {
+		metrics.NewGaugeFunc("aegis_tracked_clients",
+			"Client IPs seen within the aggregation window.", func() float64 {
+				a := latestAggregator.Load()
+				if a == nil {
+					return 0
+				}
+				a.mu.Lock()
+				defer a.mu.Unlock()
+				return float64(len(a.ips))
+			})
+	})
+)
+
+// AggregatorConfig controls the rolling window and report size.
+type AggregatorConfig struct {
+	Window time.Duration // Rounded down to whole minutes
+	TopN   int
+}
+
+// RiskAggregator keeps rolling aggregates of scores and blocks so dashboards
+// don't need to re-aggregate the raw Kafka stream.
+type RiskAggregator struct {
+	mu        sync.Mutex
+	cfg       AggregatorConfig
+	minutes   []minuteBucket // Ring buffer indexed by minute
+	ips       map[string]*RiskEntry
+	subjects  map[string]*RiskEntry
+	lastSweep time.Time
+}
+
+type minuteBucket struct {
+	start     time.Time
+	scores    []int // Per scoreBuckets entry, non-cumulative
+	blocks    int
+	decisions map[Action]int
+}
+
+// RiskEntry aggregates one client IP or subject over the window.
+type RiskEntry struct {
+	Key       string    `json:"key"`
+	MaxScore  float64   `json:"max_score"`
+	LastScore float64   `json:"last_score"`
+	Requests  int       `json:"requests"`
+	Blocks    int       `json:"blocks"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// ScoreBucket is one bar of the score distribution.
+type ScoreBucket struct {
+	UpperBound float64 `json:"le"`
+	Count      int     `json:"count"`
+}
+
+// MinuteStats summarizes one minute of the window.
+type MinuteStats struct {
+	Minute    time.Time      `json:"minute"`
+	Blocks    int            `json:"blocks"`
+	Decisions map[Action]int `json:"decisions,omitempty"`
+}
+
+// AggregateSnapshot is the heatmap served by the admin API.
+type AggregateSnapshot struct {
+	WindowMinutes     int           `json:"window_minutes"`
+	TopIPs            []RiskEntry   `json:"top_ips"`
+	TopSubjects       []RiskEntry   `json:"top_subjects"`
+	ScoreDistribution []ScoreBucket `json:"score_distribution"`
+	PerMinute         []MinuteStats `json:"per_minute"`
+}
+
+// NewRiskAggregator creates an aggregator, which aegis_tracked_clients
+// then reports on.
+func NewRiskAggregator(cfg AggregatorConfig) *RiskAggregator {
+	minutes := int(cfg.Window / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	a := &RiskAggregator{
+		cfg:       cfg,
+		minutes:   make([]minuteBucket, minutes),
+		ips:       make(map[string]*RiskEntry),
+		subjects:  make(map[string]*RiskEntry),
+		lastSweep: time.Now(),
+	}
+
+	latestAggregator.Store(a)
+	trackedClients()
+	return a
+}
+
+// ObserveScore records a scored request of a tenant ("" for none).
+func (a *RiskAggregator) ObserveScore(tenant, clientIP, subject string, score *RiskScore) {
+	riskScoreHistogram.Observe(score.Value, score.Model, tenant)
+	decisionsTotal.Inc(string(score.Decision), tenant)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.sweep(now)
+
+	bucket := a.bucket(now)
+	for i, bound := range scoreBuckets {
+		if score.Value <= bound || i == len(scoreBuckets)-1 {
+			bucket.scores[i]++
+			break
+		}
+	}
+	bucket.decisions[score.Decision]++
+
+	a.entry(a.ips, clientIP, now).observe(score.Value)
+	if subject != "" {
+		a.entry(a.subjects, subject, now).observe(score.Value)
+	}
+}
+
+// ObserveAudit counts refused requests; subscribe it to the Auditor.
+func (a *RiskAggregator) ObserveAudit(ev AuditEvent) {
+	if ev.Status != http.StatusForbidden {
+		return
+	}
+	blocksTotal.Inc(ev.Stage, ev.Tenant)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.sweep(now)
+
+	a.bucket(now).blocks++
+	a.entry(a.ips, ev.ClientIP, now).Blocks++
+	if ev.Subject != "" {
+		a.entry(a.subjects, ev.Subject, now).Blocks++
+	}
+}
+
+// Snapshot returns the current aggregates over the window.
+func (a *RiskAggregator) Snapshot() AggregateSnapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.sweep(now)
+
+	snap := AggregateSnapshot{
+		WindowMinutes: len(a.minutes),
+		TopIPs:        topEntries(a.ips, a.cfg.TopN),
+		TopSubjects:   topEntries(a.subjects, a.cfg.TopN),
+	}
+
+	distribution := make([]int, len(scoreBuckets))
+	for _, b := range a.minutes {
+		if !a.live(b, now) {
+			continue
+		}
+		for i, n := range b.scores {
+			distribution[i] += n
+		}
+		snap.PerMinute = append(snap.PerMinute, MinuteStats{Minute: b.start, Blocks: b.blocks, Decisions: copyDecisions(b.decisions)})
+	}
+	for i, bound := range scoreBuckets {
+		snap.ScoreDistribution = append(snap.ScoreDistribution, ScoreBucket{UpperBound: bound, Count: distribution[i]})
+	}
+	sort.Slice(snap.PerMinute, func(i, j int) bool { return snap.PerMinute[i].Minute.Before(snap.PerMinute[j].Minute) })
+	return snap
+}
+
+func (e *RiskEntry) observe(score float64) {
+	e.Requests++
+	e.LastScore = score
+	if score > e.MaxScore {
+		e.MaxScore = score
+	}
+}
+
+// bucket returns the bucket for the current minute, resetting a stale one.
+// Callers must hold the lock.
+func (a *RiskAggregator) bucket(now time.Time) *minuteBucket {
+	start := now.Truncate(time.Minute)
+	b := &a.minutes[int(start.Unix()/60)%len(a.minutes)]
+	if !b.start.Equal(start) {
+		*b = minuteBucket{start: start, scores: make([]int, len(scoreBuckets)), decisions: make(map[Action]int)}
+	}
+	return b
+}
+
+// live reports whether a bucket falls within the window.
+func (a *RiskAggregator) live(b minuteBucket, now time.Time) bool {
+	return !b.start.IsZero() && now.Sub(b.start) < time.Duration(len(a.minutes))*time.Minute
+}
+
+// entry returns the entry for key, creating it if needed. Callers must hold the lock.
+func (a *RiskAggregator) entry(entries map[string]*RiskEntry, key string, now time.Time) *RiskEntry {
+	e, ok := entries[key]
+	if !ok {
+		e = &RiskEntry{Key: key}
+		entries[key] = e
+	}
+	e.LastSeen = now
+	return e
+}
+
+// sweep drops entries not seen within the window. Callers must hold the lock.
+func (a *RiskAggregator) sweep(now time.Time) {
+	if now.Sub(a.lastSweep) < time.Minute {
+		return
+	}
+	a.lastSweep = now
+
+	window := time.Duration(len(a.minutes)) * time.Minute
+	for _, entries := range []map[string]*RiskEntry{a.ips, a.subjects} {
+		for key, e := range entries {
+			if now.Sub(e.LastSeen) > window {
+				delete(entries, key)
+			}
+		}
+	}
+}
+
+// topEntries returns the n entries with the highest max score, then most blocks.
+func topEntries(entries map[string]*RiskEntry, n int) []RiskEntry {
+	top := make([]RiskEntry, 0, len(entries))
+	for _, e := range entries {
+		top = append(top, *e)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].MaxScore != top[j].MaxScore {
+			return top[i].MaxScore > top[j].MaxScore
+		}
+		return top[i].Blocks > top[j].Blocks
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+func copyDecisions(decisions map[Action]int) map[Action]int {
+	copied := make(map[Action]int, len(decisions))
+	for action, n := range decisions {
+		copied[action] = n
+	}
+	return copied
+}
@@ -0,0 +1,35 @@
+package middleware
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+func TestRiskAggregator(t *testing.T) {
+	// A second aggregator must not register aegis_tracked_clients twice
+	NewRiskAggregator(AggregatorConfig{Window: time.Minute, TopN: 2})
+	a := NewRiskAggregator(AggregatorConfig{Window: 5 * time.Minute, TopN: 2})
+
+	for i, ip := range []string{"203.0.113.7", "203.0.113.7", "198.51.100.1", "192.0.2.9"} {
+		a.ObserveScore("", ip, "", &RiskScore{Value: float64(i+1) / 5, Model: "test", Decision: ActionAllow})
+	}
+	a.ObserveAudit(AuditEvent{ClientIP: "203.0.113.7", Status: 403, Stage: "blocklist"})
+
+	snap := a.Snapshot()
+	if snap.WindowMinutes != 5 {
+		t.Errorf("window = %d minutes, want 5", snap.WindowMinutes)
+	}
+	if len(snap.TopIPs) != 2 || snap.TopIPs[0].Key != "192.0.2.9" {
+		t.Errorf("top IPs = %+v, want 192.0.2.9 first and two entries", snap.TopIPs)
+	}
+
+	var out bytes.Buffer
+	metrics.Default.Write(&out)
+	if !strings.Contains(out.String(), "aegis_tracked_clients 3\n") {
+		t.Errorf("metrics don't report the latest aggregator's 3 clients:\n%s", out.String())
+	}
+}
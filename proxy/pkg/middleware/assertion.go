@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+// HeaderAssertion carries the signed identity assertion to the upstream.
+// Client-supplied values are always stripped so they cannot be spoofed.
+const HeaderAssertion = "X-Aegis-Assertion"
+
+var assertionsSigned = metrics.NewCounterVec("aegis_identity_assertions_total",
+	"Identity assertions attached to upstream requests, by result: signed or failed.", "result")
+
+// AssertionOptions configures the assertion stage.
+type AssertionOptions struct {
+	// Key signs assertions: RSA (RS256), ECDSA P-256 or P-384 (ES256,
+	// ES384) or Ed25519 (EdDSA)
+	Key      crypto.Signer
+	Issuer   string
+	Audience string // Optional aud claim
+	TTL      time.Duration
+}
+
+// AssertionMiddleware attaches a short-lived JWT, signed with the proxy's
+// key, stating what the edge verified about the request: the subject and
+// tenant, the client certificate, the client address and the risk score.
+// Upstreams verify it with the proxy's public key instead of trusting plain
+// identity headers that anything on the network path could set. The
+// assertion is bound to the request's method and path and to its request
+// ID, so it can't be reused for another request.
+type AssertionMiddleware struct {
+	opts   AssertionOptions
+	method jwt.SigningMethod
+	keyID  string
+}
+
+// Assertion is the claims of an identity assertion.
+type Assertion struct {
+	jwt.RegisteredClaims
+	Tenant   string         `json:"tenant,omitempty"`
+	ClientIP string         `json:"client_ip"`
+	Method   string         `json:"htm"` // As in DPoP proofs (RFC 9449)
+	Path     string         `json:"htu"`
+	Scope    interface{}    `json:"scope,omitempty"` // From the client's token
+	Cnf      *AssertionCnf  `json:"cnf,omitempty"`
+	Risk     *AssertionRisk `json:"risk,omitempty"` // Set when scoring ran first
+}
+
+// AssertionCnf binds an assertion to the client certificate, as in
+// certificate-bound tokens (RFC 8705).
+type AssertionCnf struct {
+	X5tS256 string `json:"x5t#S256"` // Base64url SHA-256 of the DER certificate
+}
+
+// AssertionRisk is the request's risk score, without its attributions.
+type AssertionRisk struct {
+	Score    float64 `json:"score"`
+	Decision Action  `json:"decision,omitempty"`
+	Model    string  `json:"model,omitempty"`
+}
+
+// NewAssertionMiddleware creates the assertion stage. The key ID of
+// assertions is the base64url SHA-256 of the public key's DER encoding.
+func NewAssertionMiddleware(opts AssertionOptions) (*AssertionMiddleware, error) {
+	method, keyID, err := signingKey(opts.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &AssertionMiddleware{opts: opts, method: method, keyID: keyID}, nil
+}
+
+// signingKey returns the JWT signing method of a private key and its key
+// ID, the base64url SHA-256 of the public key's DER encoding.
+func signingKey(key crypto.Signer) (jwt.SigningMethod, string, error) {
+	var method jwt.SigningMethod
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		method = jwt.SigningMethodRS256
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			method = jwt.SigningMethodES256
+		case elliptic.P384():
+			method = jwt.SigningMethodES384
+		default:
+			return nil, "", fmt.Errorf("unsupported ECDSA curve %s", k.Curve.Params().Name)
+		}
+	case ed25519.PrivateKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, "", fmt.Errorf("unsupported signing key %T", key)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(der)
+	return method, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// KeyID returns the kid header of assertions.
+func (m *AssertionMiddleware) KeyID() string {
+	return m.keyID
+}
+
+// Handler returns the middleware handler
+func (m *AssertionMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(HeaderAssertion)
+		assertion, err := m.sign(r)
+		if err != nil {
+			// Upstreams requiring assertions refuse the request themselves
+			assertionsSigned.Inc("failed")
+			logging.For(r.Context()).Warnf("[Assertion] Failed to sign assertion for %s %s: %v", r.Method, r.URL.Path, err)
+		} else {
+			assertionsSigned.Inc("signed")
+			r.Header.Set(HeaderAssertion, assertion)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sign mints the assertion of a request.
+func (m *AssertionMiddleware) sign(r *http.Request) (string, error) {
+	now := time.Now()
+	claims := Assertion{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.opts.Issuer,
+			Subject:   subjectFromContext(r.Context()),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(m.opts.TTL)),
+			ID:        logging.RequestID(r.Context()),
+		},
+		Tenant:   tenantName(r.Context()),
+		ClientIP: clientIP(r),
+		Method:   r.Method,
+		Path:     r.URL.Path,
+	}
+	if score := scoreFromContext(r.Context()); score != nil {
+		claims.Risk = &AssertionRisk{Score: score.Value, Decision: score.Decision, Model: score.Model}
+	}
+	if m.opts.Audience != "" {
+		claims.Audience = jwt.ClaimStrings{m.opts.Audience}
+	}
+	if verified := claimsFromContext(r.Context()); verified != nil {
+		claims.Scope = verified["scope"]
+		if claims.Scope == nil {
+			claims.Scope = verified["scp"]
+		}
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		claims.Cnf = &AssertionCnf{X5tS256: base64.RawURLEncoding.EncodeToString(sum[:])}
+	}
+
+	token := jwt.NewWithClaims(m.method, claims)
+	token.Header["kid"] = m.keyID
+	return token.SignedString(m.opts.Key)
+}
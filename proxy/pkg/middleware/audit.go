@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+)
+
+// AuditEvent records a request the proxy rejected and why.
+type AuditEvent struct {
+	Timestamp time.Time       `json:"timestamp"`
+	ClientIP  string          `json:"client_ip"`
+	Subject   string          `json:"subject,omitempty"`
+	Tenant    string          `json:"tenant,omitempty"`
+	RequestID string          `json:"request_id,omitempty"`
+	Method    string          `json:"method"`
+	Path      string          `json:"path"`
+	Status    int             `json:"status"`
+	Stage     string          `json:"stage"`
+	Reason    string          `json:"reason,omitempty"`
+	Decision  *DecisionRecord `json:"decision,omitempty"`
+}
+
+// Auditor writes audit events to the log and, optionally, to a Kafka topic.
+type Auditor struct {
+	sink      EventSink
+	topic     string
+	listeners []func(AuditEvent)
+}
+
+// NewAuditor creates an auditor. With an empty topic, events are only logged.
+func NewAuditor(sink EventSink, topic string) *Auditor {
+	return &Auditor{sink: sink, topic: topic}
+}
+
+// Subscribe registers a function called synchronously with every event.
+// It must be called before the proxy starts serving and must not block.
+func (a *Auditor) Subscribe(fn func(AuditEvent)) {
+	a.listeners = append(a.listeners, fn)
+}
+
+// Record emits the event without blocking the request.
+func (a *Auditor) Record(ev AuditEvent) {
+	if a == nil {
+		return
+	}
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now().UTC()
+	}
+
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("[Audit] Error marshalling event: %v", err)
+		return
+	}
+	logging.Infof("[Audit] %s", data)
+
+	for _, fn := range a.listeners {
+		fn(ev)
+	}
+
+	if a.topic != "" {
+		go func() {
+			if err := a.sink.Publish(a.topic, ev.ClientIP, data); err != nil {
+				log.Printf("[Audit] Failed to publish event: %v", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,393 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var auditChainRecords = metrics.NewCounterVec("aegis_audit_chain_records_total",
+	"Records of the hash-chained audit log, by result: written, checkpoint, dropped (buffer full), gap (a record of dropped events) or failed.", "result")
+
+const (
+	// auditChainBuffer bounds the events waiting to be written; events are
+	// dropped rather than block requests once it is full, and a gap record
+	// says how many.
+	auditChainBuffer = 4096
+	// auditChainGenesis is the prev of the first record of a new log.
+	auditChainGenesis = "0000000000000000000000000000000000000000000000000000000000000000"
+)
+
+// AuditChainRecord is a line of the hash-chained audit log: an audit event,
+// a signed checkpoint or a gap, linked to the record before it. Hash is the
+// hex SHA-256 of the sequence number, prev and the event, checkpoint or
+// gap, so changing, removing or reordering a record breaks every link
+// after it.
+type AuditChainRecord struct {
+	Seq        uint64          `json:"seq"`
+	Prev       string          `json:"prev"`
+	Event      json.RawMessage `json:"event,omitempty"`
+	Checkpoint string          `json:"checkpoint,omitempty"` // JWT of AuditCheckpoint claims
+	Dropped    uint64          `json:"dropped,omitempty"`    // Events missing here, with the buffer full
+	Hash       string          `json:"hash"`
+}
+
+// AuditCheckpoint is the claims of a checkpoint: the sequence number and
+// hash of the record before it, signed so a rewritten chain can't be
+// passed off as the original.
+type AuditCheckpoint struct {
+	jwt.RegisteredClaims
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+// payload is what a record's hash covers besides its position.
+func (r *AuditChainRecord) payload() []byte {
+	switch {
+	case r.Event != nil:
+		return r.Event
+	case r.Dropped > 0:
+		return []byte("dropped " + strconv.FormatUint(r.Dropped, 10))
+	}
+	return []byte(r.Checkpoint)
+}
+
+// chainHash links a record to its predecessor.
+func chainHash(seq uint64, prev string, payload []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n%s\n", seq, prev)
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AuditChainOptions configures the hash-chained audit log.
+type AuditChainOptions struct {
+	Path string
+	// Key signs checkpoints: RSA (RS256), ECDSA P-256 or P-384 (ES256,
+	// ES384) or Ed25519 (EdDSA)
+	Key crypto.Signer
+	// CheckpointInterval is how often a checkpoint is written, if records
+	// were added since the last one
+	CheckpointInterval time.Duration
+	Node               string // sub of checkpoints, telling replicas apart
+}
+
+// AuditChain appends the auditor's events to a local file as a hash chain,
+// with periodic signed checkpoints, so tampering with the audit trail after
+// an incident is detectable with the proxy's public key. Events are written
+// in the background; Observe never blocks a request. Events dropped while
+// the buffer is full leave a gap record in their place, so the chain shows
+// that and how many events are missing.
+type AuditChain struct {
+	opts   AuditChainOptions
+	method jwt.SigningMethod
+	keyID  string
+	file   *os.File
+
+	events  chan AuditEvent
+	dropped atomic.Uint64 // Events dropped since the last gap record
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	// Owned by the writer goroutine
+	seq     uint64
+	head    string
+	pending int // Records since the last checkpoint
+}
+
+// NewAuditChain opens the log at opts.Path, continuing the chain already in
+// it, and starts writing.
+func NewAuditChain(opts AuditChainOptions) (*AuditChain, error) {
+	method, keyID, err := signingKey(opts.Key)
+	if err != nil {
+		return nil, err
+	}
+	c := &AuditChain{
+		opts:    opts,
+		method:  method,
+		keyID:   keyID,
+		head:    auditChainGenesis,
+		events:  make(chan AuditEvent, auditChainBuffer),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	torn, err := c.resume()
+	if err != nil {
+		return nil, err
+	}
+	if c.file, err = os.OpenFile(opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600); err != nil {
+		return nil, err
+	}
+	if torn {
+		// Start on a new line after a write cut short by a crash
+		if _, err := c.file.Write([]byte("\n")); err != nil {
+			c.file.Close()
+			return nil, err
+		}
+	}
+	if c.seq > 0 {
+		log.Printf("[Audit] Continuing audit chain %s after seq %d", opts.Path, c.seq)
+	}
+	go c.run()
+	return c, nil
+}
+
+// KeyID returns the kid header of checkpoints.
+func (c *AuditChain) KeyID() string {
+	return c.keyID
+}
+
+// resume finds the last record of an existing log, reporting whether the
+// file ends mid-line.
+func (c *AuditChain) resume() (torn bool, err error) {
+	f, err := os.Open(c.opts.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		var rec AuditChainRecord
+		if len(bytes.TrimSpace(line)) > 0 && json.Unmarshal(line, &rec) == nil && rec.Hash != "" {
+			c.seq, c.head = rec.Seq, rec.Hash
+		}
+		if err == io.EOF {
+			return len(line) > 0, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
+
+// Observe queues an audit event; subscribe it to the auditor.
+func (c *AuditChain) Observe(ev AuditEvent) {
+	select {
+	case <-c.done:
+		auditChainRecords.Inc("dropped")
+	case c.events <- ev:
+	default:
+		c.dropped.Add(1)
+		auditChainRecords.Inc("dropped")
+	}
+}
+
+// Close writes the queued events and a final checkpoint and closes the log.
+func (c *AuditChain) Close() error {
+	c.once.Do(func() { close(c.done) })
+	<-c.stopped
+	return nil
+}
+
+func (c *AuditChain) run() {
+	defer close(c.stopped)
+	ticker := time.NewTicker(c.opts.CheckpointInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev := <-c.events:
+			c.writeEvent(ev)
+		case <-ticker.C:
+			c.writeGap()
+			c.checkpoint()
+		case <-c.done:
+		drain:
+			for {
+				select {
+				case ev := <-c.events:
+					c.writeEvent(ev)
+				default:
+					break drain
+				}
+			}
+			c.writeGap()
+			c.checkpoint()
+			if err := c.file.Close(); err != nil {
+				log.Printf("[Audit] Failed to close audit chain %s: %v", c.opts.Path, err)
+			}
+			return
+		}
+	}
+}
+
+func (c *AuditChain) writeEvent(ev AuditEvent) {
+	c.writeGap()
+	data, err := json.Marshal(ev)
+	if err != nil {
+		auditChainRecords.Inc("failed")
+		log.Printf("[Audit] Error marshalling event for the audit chain: %v", err)
+		return
+	}
+	if c.append(AuditChainRecord{Event: data}) {
+		auditChainRecords.Inc("written")
+		c.pending++
+	}
+}
+
+// writeGap records the events dropped since the last gap, if any. They were
+// dropped while the queue was full, so the gap lands among the events
+// queued around them rather than at their exact place. A failed write
+// leaves them for the next gap.
+func (c *AuditChain) writeGap() {
+	n := c.dropped.Swap(0)
+	if n == 0 {
+		return
+	}
+	if !c.append(AuditChainRecord{Dropped: n}) {
+		c.dropped.Add(n)
+		return
+	}
+	auditChainRecords.Inc("gap")
+	c.pending++
+	logging.Warnf("[Audit] Audit chain %s buffer full: %d events dropped before seq %d", c.opts.Path, n, c.seq)
+}
+
+// checkpoint signs the head of the chain, if records were added since the
+// last checkpoint. Checkpoints are also logged, so a copy of them lives
+// outside the file.
+func (c *AuditChain) checkpoint() {
+	if c.pending == 0 {
+		return
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(c.method, AuditCheckpoint{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:   "aegis-zero",
+			Subject:  c.opts.Node,
+			IssuedAt: jwt.NewNumericDate(now),
+		},
+		Seq:  c.seq,
+		Hash: c.head,
+	})
+	token.Header["kid"] = c.keyID
+	signed, err := token.SignedString(c.opts.Key)
+	if err != nil {
+		auditChainRecords.Inc("failed")
+		log.Printf("[Audit] Failed to sign audit chain checkpoint: %v", err)
+		return
+	}
+	seq, head := c.seq, c.head
+	if !c.append(AuditChainRecord{Checkpoint: signed}) {
+		return
+	}
+	if err := c.file.Sync(); err != nil {
+		log.Printf("[Audit] Failed to sync audit chain %s: %v", c.opts.Path, err)
+	}
+	auditChainRecords.Inc("checkpoint")
+	c.pending = 0
+	logging.Infof("[Audit] Checkpoint of audit chain %s at seq %d: %s", c.opts.Path, seq, head)
+}
+
+// append links rec to the chain and writes it, reporting whether it was.
+// A failed write leaves the chain where it was.
+func (c *AuditChain) append(rec AuditChainRecord) bool {
+	rec.Seq, rec.Prev = c.seq+1, c.head
+	rec.Hash = chainHash(rec.Seq, rec.Prev, rec.payload())
+	line, err := json.Marshal(rec)
+	if err == nil {
+		_, err = c.file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		auditChainRecords.Inc("failed")
+		log.Printf("[Audit] Failed to write audit chain %s: %v", c.opts.Path, err)
+		return false
+	}
+	c.seq, c.head = rec.Seq, rec.Hash
+	return true
+}
+
+// AuditChainReport is the result of verifying a hash-chained audit log.
+type AuditChainReport struct {
+	FirstSeq    uint64 // Greater than 1 if older records were rotated out
+	LastSeq     uint64
+	Records     int
+	Checkpoints int
+	Dropped     uint64 // Events gap records say are missing
+	// Verified is the last sequence number covered by a checkpoint; records
+	// after it are linked but not yet signed
+	Verified uint64
+}
+
+// VerifyAuditChain checks every link of a hash-chained audit log and the
+// signature of every checkpoint with the proxy's public key. It returns
+// the first broken record as an error.
+func VerifyAuditChain(r io.Reader, key crypto.PublicKey) (*AuditChainReport, error) {
+	report := &AuditChainReport{}
+	parser := jwt.NewParser(jwt.WithValidMethods([]string{"RS256", "ES256", "ES384", "EdDSA"}))
+	head := ""
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var rec AuditChainRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return report, fmt.Errorf("line %d: %w", line, err)
+		}
+		if report.Records == 0 {
+			report.FirstSeq = rec.Seq
+			if rec.Seq == 1 && rec.Prev != auditChainGenesis {
+				return report, fmt.Errorf("seq 1: chain doesn't start at the genesis hash")
+			}
+		} else if rec.Seq != report.LastSeq+1 || rec.Prev != head {
+			return report, fmt.Errorf("seq %d: not linked to seq %d", rec.Seq, report.LastSeq)
+		}
+		kinds := 0
+		for _, set := range []bool{rec.Event != nil, rec.Checkpoint != "", rec.Dropped > 0} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds != 1 {
+			return report, fmt.Errorf("seq %d: must hold one of an event, a checkpoint or a gap", rec.Seq)
+		}
+		if chainHash(rec.Seq, rec.Prev, rec.payload()) != rec.Hash {
+			return report, fmt.Errorf("seq %d: hash mismatch, record was modified", rec.Seq)
+		}
+
+		if rec.Checkpoint != "" {
+			var claims AuditCheckpoint
+			if _, err := parser.ParseWithClaims(rec.Checkpoint, &claims, func(*jwt.Token) (interface{}, error) {
+				return key, nil
+			}); err != nil {
+				return report, fmt.Errorf("seq %d: invalid checkpoint: %w", rec.Seq, err)
+			}
+			if claims.Seq != rec.Seq-1 || claims.Hash != rec.Prev {
+				return report, fmt.Errorf("seq %d: checkpoint signs seq %d, not the record before it", rec.Seq, claims.Seq)
+			}
+			report.Checkpoints++
+			report.Verified = rec.Seq
+		}
+		report.Dropped += rec.Dropped
+		report.Records++
+		report.LastSeq, head = rec.Seq, rec.Hash
+	}
+	return report, scanner.Err()
+}
@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// writeTestChain writes events to a new chain at path, with dropped events
+// before the last, and closes it.
+func writeTestChain(t *testing.T, path string, key ed25519.PrivateKey, events int, dropped uint64) {
+	t.Helper()
+	c, err := NewAuditChain(AuditChainOptions{Path: path, Key: key, CheckpointInterval: time.Hour, Node: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < events; i++ {
+		if i == events-1 {
+			// Wait for the writer, so the gap comes after the first event
+			for len(c.events) > 0 {
+				time.Sleep(time.Millisecond)
+			}
+			c.dropped.Add(dropped)
+		}
+		c.Observe(AuditEvent{ClientIP: "198.51.100.1", Stage: "blocklist", Reason: "blocked", Status: 403})
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAuditChain(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeTestChain(t, path, key, 3, 2)
+	// A restarted proxy continues the chain
+	writeTestChain(t, path, key, 2, 0)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := VerifyAuditChain(bytes.NewReader(data), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 3 events, a gap and a checkpoint, then 2 events and a checkpoint
+	want := AuditChainReport{FirstSeq: 1, LastSeq: 8, Records: 8, Checkpoints: 2, Dropped: 2, Verified: 8}
+	if *report != want {
+		t.Errorf("report %+v, want %+v", *report, want)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	gap, checkpoint := -1, -1
+	for i, line := range lines {
+		var rec AuditChainRecord
+		json.Unmarshal([]byte(line), &rec)
+		if rec.Dropped == 2 && gap < 0 {
+			gap = i
+		}
+		if rec.Checkpoint != "" && checkpoint < 0 {
+			checkpoint = i
+		}
+	}
+	if gap < 0 || gap > 3 || checkpoint != 4 {
+		t.Fatalf("gap at record %d and checkpoint at %d, want the gap among the first events and then the checkpoint", gap+1, checkpoint+1)
+	}
+
+	otherPub, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	resign := func(rec map[string]interface{}) {
+		seq, prev := uint64(rec["seq"].(float64)), rec["prev"].(string)
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodEdDSA, AuditCheckpoint{Seq: seq - 1, Hash: prev}).SignedString(otherKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec["checkpoint"] = signed
+		rec["hash"] = chainHash(seq, prev, []byte(signed))
+	}
+	edit := func(i int, change func(rec map[string]interface{})) string {
+		out := append([]string(nil), lines...)
+		var rec map[string]interface{}
+		json.Unmarshal([]byte(out[i]), &rec)
+		change(rec)
+		b, _ := json.Marshal(rec)
+		out[i] = string(b)
+		return strings.Join(out, "\n")
+	}
+	tests := []struct {
+		name  string
+		chain string
+		want  string
+	}{
+		{"event changed", edit(0, func(rec map[string]interface{}) {
+			rec["event"].(map[string]interface{})["client_ip"] = "203.0.113.1"
+		}), "hash mismatch"},
+		{"gap shrunk", edit(gap, func(rec map[string]interface{}) { rec["dropped"] = 1 }), "hash mismatch"},
+		{"gap rehashed", edit(gap, func(rec map[string]interface{}) {
+			rec["dropped"] = 1
+			rec["hash"] = chainHash(uint64(rec["seq"].(float64)), rec["prev"].(string), []byte("dropped 1"))
+		}), "not linked"},
+		{"gap and event", edit(gap, func(rec map[string]interface{}) { rec["event"] = map[string]interface{}{} }), "must hold one of"},
+		{"record removed", strings.Join(append(append([]string(nil), lines[:1]...), lines[2:]...), "\n"), "not linked"},
+		{"records swapped", strings.Join([]string{lines[1], lines[0]}, "\n"), "not linked"},
+		{"first record replaced", edit(0, func(rec map[string]interface{}) { rec["prev"] = rec["hash"] }), "genesis"},
+		{"checkpoint by another key", edit(checkpoint, resign), "invalid checkpoint"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := VerifyAuditChain(strings.NewReader(tt.chain), pub)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("VerifyAuditChain = %v, want an error about %q", err, tt.want)
+			}
+		})
+	}
+	if _, err := VerifyAuditChain(bytes.NewReader(data), otherPub); err == nil {
+		t.Error("chain verified with another key")
+	}
+}
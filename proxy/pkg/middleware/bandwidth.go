@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var bandwidthDelay = metrics.NewCounterVec("aegis_bandwidth_throttled_seconds_total",
+	"Time responses were held back by the bandwidth stage, by tier.", "tier")
+
+// bandwidthChunk is the most written at once, so a burst isn't spent on one
+// write and throttled clients get a steady stream.
+const bandwidthChunk = 16 << 10
+
+// BandwidthOptions configures per-client response bandwidth.
+type BandwidthOptions struct {
+	Rate  int64 // Bytes per second per client
+	Burst int64 // Bytes a client may receive at once after idling
+	// BySubject keys clients by JWT subject, falling back to their IP
+	// without one; otherwise they're keyed by IP
+	BySubject bool
+	// Tiers replace Rate for tokens whose TierClaim names one; 0 exempts
+	TierClaim string
+	Tiers     map[string]int64
+}
+
+// BandwidthMiddleware caps the rate each client receives response bodies
+// at, so one client pulling large exports can't saturate the link for
+// everyone else. A client's concurrent responses share one token bucket;
+// writes beyond it wait until it refills, which TCP passes on to the
+// upstream as backpressure.
+type BandwidthMiddleware struct {
+	opts BandwidthOptions
+
+	mu        sync.Mutex
+	buckets   map[string]*byteBucket
+	lastSweep time.Time
+}
+
+type byteBucket struct {
+	tokens float64 // Negative while writes are waiting for it to refill
+	last   time.Time
+	rate   float64
+}
+
+// NewBandwidthMiddleware creates the bandwidth stage.
+func NewBandwidthMiddleware(opts BandwidthOptions) *BandwidthMiddleware {
+	return &BandwidthMiddleware{opts: opts, buckets: make(map[string]*byteBucket), lastSweep: time.Now()}
+}
+
+// Handler returns the middleware handler
+func (m *BandwidthMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tier, rate := m.rate(r)
+		if rate <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := identityKey(r, m.opts.BySubject)
+		next.ServeHTTP(&bandwidthWriter{ResponseWriter: w, r: r, m: m, key: key, tier: tier, rate: rate}, r)
+	})
+}
+
+// rate returns the request's tier and bytes per second.
+func (m *BandwidthMiddleware) rate(r *http.Request) (string, int64) {
+	if m.opts.TierClaim != "" {
+		if value, ok := claimsFromContext(r.Context())[m.opts.TierClaim]; ok {
+			if rate, ok := m.opts.Tiers[fmt.Sprint(value)]; ok {
+				return fmt.Sprint(value), rate
+			}
+		}
+	}
+	return "default", m.opts.Rate
+}
+
+// reserve takes n bytes from key's bucket and returns how long to wait
+// before sending them.
+func (m *BandwidthMiddleware) reserve(key string, rate int64, n int) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.sweep(now)
+
+	b, ok := m.buckets[key]
+	if !ok {
+		b = &byteBucket{tokens: float64(m.opts.Burst), last: now}
+		m.buckets[key] = b
+	}
+	b.rate = float64(rate)
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > float64(m.opts.Burst) {
+		b.tokens = float64(m.opts.Burst)
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// sweep drops buckets that have refilled completely, bounding memory use.
+func (m *BandwidthMiddleware) sweep(now time.Time) {
+	if now.Sub(m.lastSweep) < time.Minute {
+		return
+	}
+	m.lastSweep = now
+
+	for key, b := range m.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= float64(m.opts.Burst) {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// bandwidthWriter holds writes back to the client's rate.
+type bandwidthWriter struct {
+	http.ResponseWriter
+	r    *http.Request
+	m    *BandwidthMiddleware
+	key  string
+	tier string
+	rate int64
+}
+
+func (w *bandwidthWriter) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > bandwidthChunk {
+			chunk = chunk[:bandwidthChunk]
+		}
+		if delay := w.m.reserve(w.key, w.rate, len(chunk)); delay > 0 {
+			bandwidthDelay.Add(delay.Seconds(), w.tier)
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-w.r.Context().Done():
+				timer.Stop()
+				return written, w.r.Context().Err()
+			}
+		}
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// streamed responses are flushed and transfer deadlines can be moved.
+func (w *bandwidthWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
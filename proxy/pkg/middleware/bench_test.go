@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Benchmarks of the hot stages and of a typical chain, run per change with
+//
+//	go test -run '^$' -bench . -benchmem ./middleware
+//
+// and compared with benchstat to catch latency and allocation regressions.
+
+// discardSink drops every event, so benchmarks measure the proxy, not Kafka.
+type discardSink struct{}
+
+func (discardSink) Publish(topic, key string, value []byte) error { return nil }
+func (discardSink) Close() error                                  { return nil }
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+// serve runs requests built by newRequest through h b.N times.
+func serve(b *testing.B, h http.Handler, newRequest func() *http.Request) {
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), newRequest())
+	}
+}
+
+func benchRequest(target, token string) func() *http.Request {
+	return func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.RemoteAddr = "203.0.113.7:51234"
+		r.Header.Set("User-Agent", "Mozilla/5.0 (X11; Linux x86_64) aegis-bench")
+		r.Header.Set("Accept", "application/json")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		return r
+	}
+}
+
+// benchLogger is shared by the benchmarks, so they don't each start
+// shipping workers.
+var benchLogger = sync.OnceValue(func() *LoggerMiddleware {
+	return NewLoggerMiddleware(discardSink{}, LoggerOptions{
+		AccessLogTopic: "aegis-access-logs",
+		FeatureTopic:   "aegis-features",
+		Profiles:       NewRouteProfiles(RouteProfile{}, nil),
+		SampleRate:     1,
+		ShipWorkers:    4,
+		ShipQueueSize:  1024,
+		ShipOverflow:   OverflowDropNewest,
+	})
+})
+
+func benchRoutes() *RoutePolicies {
+	rp := NewRoutePolicies(nil, func() bool { return true })
+	rp.Update([]RoutePolicy{
+		{Prefix: "/api/v1/orders", Methods: map[string]bool{http.MethodGet: true, http.MethodPost: true}},
+		{Prefix: "/api/v1/users", Scopes: []string{"users:read"}},
+		{Prefix: "/api/v1/reports", MaxBody: 1 << 20},
+		{Prefix: "/public", AuthNone: true},
+	}, nil)
+	return rp
+}
+
+// benchToken returns a key pair's public half and an RS256 token it verifies.
+func benchToken(b *testing.B) (*rsa.PublicKey, string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		b.Fatal(err)
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub":   "bench-user",
+		"scope": "users:read",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	}).SignedString(key)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return &key.PublicKey, token
+}
+
+func BenchmarkLogger(b *testing.B) {
+	serve(b, benchLogger().Handler(okHandler), benchRequest("/api/v1/orders?page=2", ""))
+}
+
+func BenchmarkWAFClean(b *testing.B) {
+	waf := NewWAFMiddleware(WAFOptions{Block: true, Threshold: 5})
+	serve(b, waf.Handler(okHandler), benchRequest("/api/v1/orders?page=2&sort=created", ""))
+}
+
+func BenchmarkWAFAttack(b *testing.B) {
+	waf := NewWAFMiddleware(WAFOptions{Block: true, Threshold: 5})
+	serve(b, waf.Handler(okHandler), benchRequest("/api/v1/orders?id=1%27%20OR%201=1--", ""))
+}
+
+func BenchmarkRoutes(b *testing.B) {
+	serve(b, benchRoutes().Handler(okHandler), benchRequest("/api/v1/orders/1234/items", ""))
+}
+
+func BenchmarkJWT(b *testing.B) {
+	publicKey, token := benchToken(b)
+	serve(b, NewJWTMiddleware(publicKey).Handler(okHandler), benchRequest("/api/v1/orders", token))
+}
+
+// BenchmarkChain runs a request through the stages of a typical deployment
+// that don't need Redis or Kafka, in their default order.
+func BenchmarkChain(b *testing.B) {
+	publicKey, token := benchToken(b)
+	routes := benchRoutes()
+	jwtm := NewJWTMiddleware(publicKey)
+	jwtm.SetRoutes(routes)
+	headers := NewSecurityHeadersMiddleware(SecurityHeaders{
+		FrameOptions:   "DENY",
+		ReferrerPolicy: "no-referrer",
+	}, routes)
+	waf := NewWAFMiddleware(WAFOptions{Block: true, Threshold: 5})
+
+	var h http.Handler = okHandler
+	for _, stage := range []func(http.Handler) http.Handler{
+		headers.Handler,
+		routes.Handler,
+		waf.Handler,
+		jwtm.Handler,
+		benchLogger().Handler,
+	} {
+		h = stage(h)
+	}
+	serve(b, h, benchRequest("/api/v1/users/42", token))
+}
@@ -0,0 +1,357 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+// Redis key prefixes of blocklisted client IPs and JWT subjects.
+const (
+	blocklistPrefix        = "blocklist:ip:"
+	subjectBlocklistPrefix = "blocklist:subject:"
+)
+
+// BlocklistMiddleware checks if the client IP is in the Redis blocklist, or
+// quarantined and limited to a few safe paths
+type BlocklistMiddleware struct {
+	client          *redis.Client
+	auditor         *Auditor
+	decisions       *DecisionStore
+	failOpen        bool
+	quarantinePaths atomic.Pointer[[]string]
+	recent          *RecentBlocks
+	guard           *EnforcementGuard
+	escalation      *BlockEscalation
+	killSwitch      *KillSwitch
+}
+
+// NewRedisClient connects to Redis and verifies the connection.
+// The client is shared by every component that reads enforcement state.
+func NewRedisClient(redisURL string) (*redis.Client, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr: redisURL,
+	})
+
+	// Test connection
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	log.Printf("[Redis] Connected to Redis at %s", redisURL)
+	return client, nil
+}
+
+// NewBlocklistMiddleware creates a new blocklist checker. Blocks are audited
+// together with the stored decision record, when one exists. With failOpen,
+// requests pass when Redis can't be reached; otherwise they are refused.
+func NewBlocklistMiddleware(client *redis.Client, auditor *Auditor, decisions *DecisionStore, failOpen bool) *BlocklistMiddleware {
+	return &BlocklistMiddleware{client: client, auditor: auditor, decisions: decisions, failOpen: failOpen}
+}
+
+// SetRecentBlocks makes the blocklist refuse recently blocked clients
+// without waiting for Redis, and note the blocks it makes. Call it before
+// serving.
+func (b *BlocklistMiddleware) SetRecentBlocks(recent *RecentBlocks) {
+	b.recent = recent
+}
+
+// SetGuard makes the blocklist let allowlisted clients and subjects through
+// and count the clients it blocks. Call it before serving.
+func (b *BlocklistMiddleware) SetGuard(guard *EnforcementGuard) {
+	b.guard = guard
+}
+
+// SetEscalation makes blocks the proxy didn't write, such as the AI
+// engine's, last as long as the client's offenses warrant, and keeps the
+// duration of blocks made through Block. Call it before serving.
+func (b *BlocklistMiddleware) SetEscalation(escalation *BlockEscalation) {
+	b.escalation = escalation
+}
+
+// SetKillSwitch makes the blocklist let blocked clients through, auditing
+// what it would have refused, while the kill switch is engaged. Call it
+// before serving.
+func (b *BlocklistMiddleware) SetKillSwitch(killSwitch *KillSwitch) {
+	b.killSwitch = killSwitch
+}
+
+// Handler returns the middleware handler
+func (b *BlocklistMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := clientIP(r)
+
+		// Check blocklist: GET blocklist:ip:<IP>, and the tenant's own entry
+		ctx := r.Context()
+		keys := []string{blocklistPrefix + clientIP}
+		if prefix := tenantKeyPrefix(ctx); prefix != "" {
+			keys = append(keys, prefix+blocklistPrefix+clientIP)
+		}
+		recent := b.recent != nil && b.recent.Blocked(keys...)
+		if recent && b.enforces(r, clientIP) {
+			logging.For(r.Context()).Infof("[Blocklist] BLOCKED IP: %s (recent block)", clientIP)
+			b.audit(r, clientIP)
+			pages.WriteError(w, r, pages.ErrBlocked)
+			return
+		}
+
+		// Quarantined clients are refused outside the allowed paths; it is
+		// checked in the same round trip
+		var quarantined *redis.IntCmd
+		pipe := b.client.Pipeline()
+		blocked := pipe.Exists(ctx, keys...)
+		if !b.quarantineAllows(r.URL.Path) {
+			quarantined = pipe.Exists(ctx, quarantineKeys(ctx, clientIP)...)
+		}
+		_, err := pipe.Exec(ctx)
+		exists := blocked.Val()
+		if err != nil {
+			logging.For(r.Context()).Warnf("[Blocklist] Redis error for IP %s: %v", clientIP, err)
+			if !b.failOpen {
+				pages.WriteError(w, r, pages.ErrUnavailable)
+				return
+			}
+			// Fail open - don't block on Redis errors
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A recent block that got this far was spared
+		if exists > 0 && !recent && b.enforces(r, clientIP) {
+			logging.For(r.Context()).Infof("[Blocklist] BLOCKED IP: %s", clientIP)
+			b.escalate(ctx, clientIP)
+			b.audit(r, clientIP)
+			pages.WriteError(w, r, pages.ErrBlocked)
+			return
+		}
+		if quarantined != nil && quarantined.Val() > 0 {
+			b.refuseQuarantined(w, r, clientIP)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BlockEntry describes a blocklisted client IP or subject.
+type BlockEntry struct {
+	ClientIP   string   `json:"client_ip,omitempty"`
+	Subject    string   `json:"subject,omitempty"`
+	Tenant     string   `json:"tenant,omitempty"`
+	Reason     string   `json:"reason,omitempty"`
+	Score      *float64 `json:"score,omitempty"`
+	BlockedAt  string   `json:"blocked_at,omitempty"`
+	RequestID  string   `json:"request_id,omitempty"` // Latest request the AI engine scored
+	TTLSeconds int64    `json:"ttl_seconds"`          // -1 for permanent blocks
+}
+
+// List returns the blocklisted clients and subjects, scanning up to limit
+// entries. A tenant in ctx lists that tenant's entries instead of global ones.
+// The same applies to the other blocklist methods.
+func (b *BlocklistMiddleware) List(ctx context.Context, limit int) ([]BlockEntry, error) {
+	var entries []BlockEntry
+	prefix := tenantKeyPrefix(ctx)
+	iter := b.client.Scan(ctx, 0, prefix+"blocklist:*", 100).Iterator()
+	for iter.Next(ctx) && len(entries) < limit {
+		var entry *BlockEntry
+		var err error
+		switch key := strings.TrimPrefix(iter.Val(), prefix); {
+		case strings.HasPrefix(key, blocklistPrefix):
+			entry, err = b.Get(ctx, strings.TrimPrefix(key, blocklistPrefix))
+		case strings.HasPrefix(key, subjectBlocklistPrefix):
+			entry, err = b.GetSubject(ctx, strings.TrimPrefix(key, subjectBlocklistPrefix))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, iter.Err()
+}
+
+// Get returns the blocklist entry of a client, or nil if it isn't blocked.
+func (b *BlocklistMiddleware) Get(ctx context.Context, clientIP string) (*BlockEntry, error) {
+	return b.entry(ctx, tenantKeyPrefix(ctx)+blocklistPrefix+clientIP, BlockEntry{ClientIP: clientIP})
+}
+
+// GetSubject returns the blocklist entry of a subject, or nil if it isn't blocked.
+func (b *BlocklistMiddleware) GetSubject(ctx context.Context, subject string) (*BlockEntry, error) {
+	return b.entry(ctx, tenantKeyPrefix(ctx)+subjectBlocklistPrefix+subject, BlockEntry{Subject: subject})
+}
+
+func (b *BlocklistMiddleware) entry(ctx context.Context, key string, entry BlockEntry) (*BlockEntry, error) {
+	value, err := b.client.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	ttl, err := b.client.TTL(ctx, key).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entry.Tenant = tenantName(ctx)
+	entry.TTLSeconds = -1
+	if ttl > 0 {
+		entry.TTLSeconds = int64(ttl.Seconds())
+	}
+	// Values written by the proxy and the AI engine are JSON; others are kept as the reason
+	if err := json.Unmarshal([]byte(value), &entry); err != nil {
+		entry.Reason = value
+	}
+	return &entry, nil
+}
+
+// Block adds a client to the blocklist; a zero ttl blocks permanently.
+// The duration is kept as given, without escalation.
+func (b *BlocklistMiddleware) Block(ctx context.Context, clientIP, reason string, ttl time.Duration) error {
+	if err := addToBlocklist(ctx, b.client, b.recent, clientIP, reason, ttl); err != nil {
+		return err
+	}
+	return b.escalation.hold(ctx, clientIP, ttl)
+}
+
+// BlockSubject blocks a JWT subject wherever it connects from; a zero ttl
+// blocks permanently.
+func (b *BlocklistMiddleware) BlockSubject(ctx context.Context, subject, reason string, ttl time.Duration) error {
+	return b.client.Set(ctx, tenantKeyPrefix(ctx)+subjectBlocklistPrefix+subject, blockValue(reason), ttl).Err()
+}
+
+// Unblock removes a client from the blocklist, reporting whether it was blocked.
+func (b *BlocklistMiddleware) Unblock(ctx context.Context, clientIP string) (bool, error) {
+	key := tenantKeyPrefix(ctx) + blocklistPrefix + clientIP
+	b.recent.unblocked(key)
+	n, err := b.client.Del(ctx, key).Result()
+	if err == nil {
+		err = b.escalation.release(ctx, clientIP)
+	}
+	return n > 0, err
+}
+
+// UnblockSubject removes a subject from the blocklist, reporting whether it was blocked.
+func (b *BlocklistMiddleware) UnblockSubject(ctx context.Context, subject string) (bool, error) {
+	n, err := b.client.Del(ctx, tenantKeyPrefix(ctx)+subjectBlocklistPrefix+subject).Result()
+	return n > 0, err
+}
+
+// SubjectBlocked reports whether a subject is blocklisted globally or for
+// the tenant in ctx.
+func (b *BlocklistMiddleware) SubjectBlocked(ctx context.Context, subject string) (bool, error) {
+	keys := []string{subjectBlocklistPrefix + subject}
+	if prefix := tenantKeyPrefix(ctx); prefix != "" {
+		keys = append(keys, prefix+subjectBlocklistPrefix+subject)
+	}
+	n, err := b.client.Exists(ctx, keys...).Result()
+	return n > 0, err
+}
+
+// RefusesConn reports whether connections from a client are refused: it is
+// blocked, or quarantined, since a TCP listener has no paths to allow.
+// While the kill switch is engaged only quarantines refuse them.
+func (b *BlocklistMiddleware) RefusesConn(ctx context.Context, clientIP string) (bool, error) {
+	key := blocklistPrefix + clientIP
+	if !b.killSwitch.enforcing() {
+		n, err := b.client.Exists(ctx, quarantinePrefix+clientIP).Result()
+		return n > 0 && !b.guard.spares(ctx, clientIP, "tcp"), err
+	}
+	if b.recent != nil && b.recent.Blocked(key) {
+		return !b.guard.spares(ctx, clientIP, "tcp"), nil
+	}
+	n, err := b.client.Exists(ctx, key, quarantinePrefix+clientIP).Result()
+	return n > 0 && !b.guard.spares(ctx, clientIP, "tcp"), err
+}
+
+// FailOpen reports whether requests pass when the blocklist can't be read.
+func (b *BlocklistMiddleware) FailOpen() bool {
+	return b.failOpen
+}
+
+// enforces reports whether a blocklisted client is refused: not while the
+// kill switch is engaged, which only audits the block, nor when the guard
+// spares it.
+func (b *BlocklistMiddleware) enforces(r *http.Request, clientIP string) bool {
+	if !b.killSwitch.enforcing() {
+		wouldBlock(r, b.auditor, "blocklist", "IP in blocklist")
+		return false
+	}
+	return !b.guard.spares(r.Context(), clientIP, "blocklist")
+}
+
+// escalate gives the client's blocks written outside the proxy, globally or
+// for the tenant, the duration of its offense's step, and remembers them
+// so the next requests are refused without Redis.
+func (b *BlocklistMiddleware) escalate(ctx context.Context, clientIP string) {
+	if b.escalation == nil {
+		return
+	}
+	prefixes := []string{""}
+	if prefix := tenantKeyPrefix(ctx); prefix != "" {
+		prefixes = append(prefixes, prefix)
+	}
+	for _, prefix := range prefixes {
+		ttl, err := b.escalation.adopt(ctx, prefix, clientIP)
+		if err != nil {
+			logging.For(ctx).Warnf("[Blocklist] Failed to escalate the block of %s: %v", clientIP, err)
+			continue
+		}
+		if ttl > 0 {
+			b.recent.blocked(prefix+blocklistPrefix+clientIP, ttl)
+		}
+	}
+}
+
+// audit records the block along with the explanation for it, if any.
+func (b *BlocklistMiddleware) audit(r *http.Request, clientIP string) {
+	ev := AuditEvent{
+		ClientIP:  clientIP,
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    http.StatusForbidden,
+		Stage:     "blocklist",
+		Reason:    "IP in blocklist",
+	}
+
+	if b.decisions != nil {
+		rec, err := b.decisions.Get(r.Context(), clientIP)
+		if err != nil {
+			log.Printf("[Blocklist] Failed to load decision for %s: %v", clientIP, err)
+		}
+		ev.Decision = rec
+	}
+
+	noteDecision(r.Context(), "blocklist", OutcomeDeny, ev.Reason)
+	b.auditor.Record(ev)
+}
+
+// auditSubject records the block of a blocklisted subject.
+func (b *BlocklistMiddleware) auditSubject(r *http.Request, subject string) {
+	noteDecision(r.Context(), "jwt", OutcomeDeny, "subject in blocklist")
+	b.auditor.Record(AuditEvent{
+		ClientIP:  clientIP(r),
+		Subject:   subject,
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    http.StatusForbidden,
+		Stage:     "blocklist",
+		Reason:    "subject in blocklist",
+	})
+}
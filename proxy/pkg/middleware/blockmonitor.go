@@ -0,0 +1,160 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var (
+	blocklistSize = metrics.NewGaugeVec("aegis_blocklist_size",
+		"Blocklisted clients and subjects, tenants' included, at the last sample.")
+	blocklistWindowBlocks = metrics.NewGaugeVec("aegis_blocklist_window_blocks",
+		"Blocks made by the AI engine, and block verdicts, in the last spike window.")
+	blocklistRateRatio = metrics.NewGaugeVec("aegis_blocklist_block_rate_ratio",
+		"Blocks in the last spike window over the baseline average per window.")
+)
+
+// blockStatsKey is the AI engine's running count of the IPs it blocked.
+const blockStatsKey = "aegis:stats:blocked_ips"
+
+// Guardrails of the blocklist monitor.
+const (
+	GuardrailBlockRate = "block_rate_spike" // Blocks per window far above the baseline
+	GuardrailGrowth    = "blocklist_growth" // Blocklist far larger than a window ago
+)
+
+// BlocklistMonitorOptions configures the blocklist monitor.
+type BlocklistMonitorOptions struct {
+	Interval time.Duration // Between samples
+	Window   time.Duration // Compared with the baseline, e.g. 5m
+	Baseline time.Duration // Before the window, averaged per window
+	// Factor is the growth over the baseline that is a spike, e.g. 10
+	Factor float64
+	// MinBlocks ignores spikes of fewer blocks, so a quiet blocklist going
+	// from one block to ten isn't one
+	MinBlocks int
+	// LocalBlocks counts blocks applied on this replica that never reach
+	// the AI engine's counter, e.g. block verdicts; nil counts none
+	LocalBlocks func() int64
+}
+
+// BlocklistMonitor samples the size of the blocklist and the AI engine's
+// count of blocks, and alerts when either spikes: a guardrail against a
+// misbehaving model mass-blocking customers. Every replica samples, and
+// alerts are coordinated through GuardrailAlerts.
+type BlocklistMonitor struct {
+	client  *redis.Client
+	opts    BlocklistMonitorOptions
+	alerts  *GuardrailAlerts
+	samples []blockSample
+}
+
+type blockSample struct {
+	at      time.Time
+	size    int64
+	blocked int64 // Running count of blocks
+}
+
+// NewBlocklistMonitor creates a monitor; start it with Run.
+func NewBlocklistMonitor(client *redis.Client, alerts *GuardrailAlerts, opts BlocklistMonitorOptions) *BlocklistMonitor {
+	return &BlocklistMonitor{client: client, opts: opts, alerts: alerts}
+}
+
+// Run samples now and every interval until ctx is done.
+func (m *BlocklistMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.opts.Interval)
+	defer ticker.Stop()
+	for {
+		if s, err := m.sample(ctx); err != nil {
+			log.Printf("[Blocklist] Failed to sample blocklist: %v", err)
+		} else {
+			m.observe(ctx, s)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sample counts the blocklist keys and reads the block count.
+func (m *BlocklistMonitor) sample(ctx context.Context) (blockSample, error) {
+	s := blockSample{at: time.Now()}
+	iter := m.client.Scan(ctx, 0, "*blocklist:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		s.size++
+	}
+	if err := iter.Err(); err != nil {
+		return s, err
+	}
+	blocked, err := m.client.Get(ctx, blockStatsKey).Int64()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return s, err
+	}
+	s.blocked = blocked
+	if m.opts.LocalBlocks != nil {
+		s.blocked += m.opts.LocalBlocks()
+	}
+	return s, nil
+}
+
+// observe adds a sample and checks the window ending with it against the
+// window's start and the baseline before it.
+func (m *BlocklistMonitor) observe(ctx context.Context, s blockSample) {
+	blocklistSize.Set(float64(s.size))
+	if n := len(m.samples); n > 0 && s.blocked < m.samples[n-1].blocked {
+		// The AI engine's counter was reset; start over
+		m.samples = m.samples[:0]
+	}
+	m.samples = append(m.samples, s)
+	keep := s.at.Add(-m.opts.Baseline - m.opts.Window - m.opts.Interval)
+	for len(m.samples) > 1 && m.samples[0].at.Before(keep) {
+		m.samples = m.samples[1:]
+	}
+
+	// The window starts at the last sample at least a window old
+	start := -1
+	for i, earlier := range m.samples {
+		if !earlier.at.After(s.at.Add(-m.opts.Window)) {
+			start = i
+		}
+	}
+	if start < 0 {
+		return
+	}
+	from := m.samples[start]
+	blocks := s.blocked - from.blocked
+	blocklistWindowBlocks.Set(float64(blocks))
+
+	// Without a full window of history before it, there's no baseline yet
+	oldest := m.samples[0]
+	if windows := float64(from.at.Sub(oldest.at)) / float64(m.opts.Window); windows >= 1 {
+		baseline := float64(from.blocked-oldest.blocked) / windows
+		blocklistRateRatio.Set(float64(blocks) / max(baseline, 1))
+		limit := m.opts.Factor * max(baseline, 1)
+		m.alerts.Check(ctx, GuardrailBlockRate, blocks >= int64(m.opts.MinBlocks) && float64(blocks) >= limit, GuardrailEvent{
+			Guardrail: GuardrailBlockRate,
+			Summary:   fmt.Sprintf("%d blocks in the last %s, %.1fx the baseline of %.1f", blocks, m.opts.Window, float64(blocks)/max(baseline, 1), baseline),
+			Observed:  float64(blocks),
+			Limit:     limit,
+			Window:    m.opts.Window.String(),
+		}, m.opts.Window)
+	}
+
+	limit := m.opts.Factor * max(float64(from.size), 1)
+	m.alerts.Check(ctx, GuardrailGrowth, s.size-from.size >= int64(m.opts.MinBlocks) && float64(s.size) >= limit, GuardrailEvent{
+		Guardrail: GuardrailGrowth,
+		Summary:   fmt.Sprintf("Blocklist grew from %d to %d entries in %s", from.size, s.size, m.opts.Window),
+		Observed:  float64(s.size),
+		Limit:     limit,
+		Window:    m.opts.Window.String(),
+	}, m.opts.Window)
+}
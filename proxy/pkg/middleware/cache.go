@@ -0,0 +1,458 @@
+package middleware
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var cacheRequests = metrics.NewCounterVec("aegis_cache_requests_total",
+	"GET requests to cacheable routes, by result: hit, miss or bypass.", "result")
+
+// cacheKeyPrefix namespaces cached responses in Redis.
+const cacheKeyPrefix = "aegis:cache:"
+
+// CacheOptions configures the response cache.
+type CacheOptions struct {
+	MaxSize  int64 // Bytes held in memory
+	MaxEntry int64 // Larger responses aren't cached
+	// Redis, if set, is a second tier shared by the fleet, consulted on
+	// memory misses
+	Redis *redis.Client
+}
+
+// cachedResponse is a stored upstream response.
+type cachedResponse struct {
+	Key     string      `json:"key"`
+	Status  int         `json:"status"`
+	Header  http.Header `json:"header"`
+	Body    []byte      `json:"body"`
+	Stored  time.Time   `json:"stored"`
+	Expires time.Time   `json:"expires"`
+	// Vary holds the request header values the response varies by
+	Vary map[string]string `json:"vary,omitempty"`
+}
+
+func (e *cachedResponse) size() int64 {
+	size := int64(len(e.Key) + len(e.Body))
+	for name, values := range e.Header {
+		size += int64(len(name))
+		for _, v := range values {
+			size += int64(len(v))
+		}
+	}
+	return size
+}
+
+// matches reports whether the request has the header values the response
+// varies by.
+func (e *cachedResponse) matches(r *http.Request) bool {
+	for name, value := range e.Vary {
+		if r.Header.Get(name) != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ResponseCache serves GET responses of routes with a cache TTL from memory,
+// or from Redis when a second tier is configured, so read-heavy APIs aren't
+// asked for the same response over and over. It follows Cache-Control:
+// requests may bypass it, responses marked no-store or private aren't kept
+// and max-age or s-maxage shorten the route's TTL. Responses to requests
+// with credentials, an Authorization header or cookies, are cached per
+// subject, unless they are marked public or carry s-maxage. It should run
+// last, so cached responses still go through every other stage.
+type ResponseCache struct {
+	routes *RoutePolicies
+	opts   CacheOptions
+
+	mu      sync.Mutex
+	lru     *list.List // Of *cachedResponse, most recently used first
+	entries map[string]*list.Element
+	size    int64
+}
+
+// NewResponseCache creates the cache stage; TTLs come from the route policies.
+func NewResponseCache(routes *RoutePolicies, opts CacheOptions) *ResponseCache {
+	c := &ResponseCache{
+		routes:  routes,
+		opts:    opts,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+	metrics.NewGaugeFunc("aegis_cache_bytes", "Bytes of responses held in the memory cache.", func() float64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return float64(c.size)
+	})
+	return c
+}
+
+// Handler returns the middleware handler
+func (c *ResponseCache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := c.routes.Match(r.URL.Path)
+		if r.Method != http.MethodGet || p == nil || p.CacheTTL <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		directives := parseCacheControl(r.Header.Get("Cache-Control"))
+		if _, ok := directives["no-store"]; ok {
+			cacheRequests.Inc("bypass")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		shared := cacheKey(r, "")
+		subject := subjectFromContext(r.Context())
+		if !requestRevalidates(directives) {
+			keys := []string{shared}
+			if subject != "" {
+				keys = append(keys, cacheKey(r, subject))
+			}
+			// A shared entry varying on a header the request doesn't match
+			// can sit next to one of the subject's, so try both
+			for _, key := range keys {
+				if entry := c.get(r.Context(), key); entry != nil && entry.matches(r) {
+					cacheRequests.Inc("hit")
+					noteDecision(r.Context(), "cache", OutcomeResponse, "cache hit")
+					serveCached(w, r, entry)
+					return
+				}
+			}
+		}
+
+		cacheRequests.Inc("miss")
+		w.Header().Set("X-Cache", "MISS")
+		cw := &cacheWriter{ResponseWriter: w, max: c.opts.MaxEntry}
+		next.ServeHTTP(cw, r)
+		c.store(r, cw, p.CacheTTL, shared, subject)
+	})
+}
+
+// cacheKey identifies the response to r, for one subject or, with an empty
+// subject, for everyone. Virtual hosts and ingress routes send hosts to
+// different upstreams, so the host is part of it; host and path come first,
+// so it can be purged by prefix.
+func cacheKey(r *http.Request, subject string) string {
+	return strings.ToLower(r.Host) + r.URL.RequestURI() + "|" + tenantName(r.Context()) + "|" + subject
+}
+
+// keyPurged reports whether the key of a cached response falls under a
+// purge of host and path prefix; an empty host stands for every host.
+func keyPurged(key, host, prefix string) bool {
+	if host != "" {
+		return strings.HasPrefix(key, host+prefix)
+	}
+	// Hosts can't contain a slash, so the first one starts the path
+	i := strings.IndexByte(key, '/')
+	return i >= 0 && strings.HasPrefix(key[i:], prefix)
+}
+
+// requestRevalidates reports whether the client asked for a fresh response.
+func requestRevalidates(directives map[string]string) bool {
+	if _, ok := directives["no-cache"]; ok {
+		return true
+	}
+	return directives["max-age"] == "0"
+}
+
+// serveCached writes a stored response, answering 304 when the client
+// already has it.
+func serveCached(w http.ResponseWriter, r *http.Request, entry *cachedResponse) {
+	header := w.Header()
+	for name, values := range entry.Header {
+		header[name] = append([]string(nil), values...)
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.Stored).Seconds())))
+	header.Set("X-Cache", "HIT")
+	if etag := entry.Header.Get("ETag"); etag != "" && r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.WriteHeader(entry.Status)
+	w.Write(entry.Body)
+}
+
+// store keeps the response cw captured, if it may be cached.
+func (c *ResponseCache) store(r *http.Request, cw *cacheWriter, ttl time.Duration, shared, subject string) {
+	if !cw.complete() || !cacheableStatus(cw.status) {
+		return
+	}
+	header := cw.Header()
+	if header.Get("Set-Cookie") != "" {
+		return
+	}
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	for _, d := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := directives[d]; ok {
+			return
+		}
+	}
+	if age, ok := directives["s-maxage"]; ok {
+		ttl = minTTL(ttl, age)
+	} else if age, ok := directives["max-age"]; ok {
+		ttl = minTTL(ttl, age)
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	entry := &cachedResponse{Key: shared, Status: cw.status, Header: header.Clone(), Body: cw.buf.Bytes(), Stored: time.Now()}
+	entry.Expires = entry.Stored.Add(ttl)
+	entry.Header.Del("X-Cache")
+	for _, field := range header.Values("Vary") {
+		for _, name := range strings.Split(field, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return
+			}
+			if name != "" {
+				if entry.Vary == nil {
+					entry.Vary = make(map[string]string)
+				}
+				entry.Vary[http.CanonicalHeaderKey(name)] = r.Header.Get(name)
+			}
+		}
+	}
+	// A shared cache may only reuse responses to requests with credentials
+	// that say so; others are kept for their subject alone. Cookies count,
+	// as session apps authenticate with them
+	_, public := directives["public"]
+	_, sMaxAge := directives["s-maxage"]
+	if hasCredentials(r) && !public && !sMaxAge {
+		if subject == "" {
+			return
+		}
+		entry.Key = cacheKey(r, subject)
+	}
+	c.put(r.Context(), entry, ttl)
+}
+
+// hasCredentials reports whether a request may be authenticated, so its
+// response may be for its sender alone.
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("Authorization") != "" || r.Header.Get("Cookie") != ""
+}
+
+// cacheableStatus reports whether responses with status are cached.
+func cacheableStatus(status int) bool {
+	switch status {
+	case http.StatusOK, http.StatusNonAuthoritativeInfo, http.StatusMovedPermanently,
+		http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// minTTL returns ttl, shortened to the seconds of a max-age directive.
+func minTTL(ttl time.Duration, seconds string) time.Duration {
+	n, err := strconv.Atoi(seconds)
+	if err != nil {
+		return 0
+	}
+	if age := time.Duration(n) * time.Second; age < ttl {
+		return age
+	}
+	return ttl
+}
+
+// parseCacheControl splits a Cache-Control header into lowercase directives
+// and their unquoted arguments.
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name != "" {
+			directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+		}
+	}
+	return directives
+}
+
+// get returns the unexpired entry stored under key, from memory or Redis.
+func (c *ResponseCache) get(ctx context.Context, key string) *cachedResponse {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*cachedResponse)
+		if time.Now().Before(entry.Expires) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return entry
+		}
+		c.remove(el)
+	}
+	c.mu.Unlock()
+
+	if c.opts.Redis == nil {
+		return nil
+	}
+	data, err := c.opts.Redis.Get(ctx, cacheKeyPrefix+key).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			logging.For(ctx).Warnf("[Cache] Redis error reading %s: %v", key, err)
+		}
+		return nil
+	}
+	var entry cachedResponse
+	if err := json.Unmarshal(data, &entry); err != nil || !time.Now().Before(entry.Expires) {
+		return nil
+	}
+	c.putMemory(&entry)
+	return &entry
+}
+
+// put stores entry in memory and, with a second tier, in Redis.
+func (c *ResponseCache) put(ctx context.Context, entry *cachedResponse, ttl time.Duration) {
+	c.putMemory(entry)
+	if c.opts.Redis == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := c.opts.Redis.Set(ctx, cacheKeyPrefix+entry.Key, data, ttl).Err(); err != nil {
+		logging.For(ctx).Warnf("[Cache] Redis error storing %s: %v", entry.Key, err)
+	}
+}
+
+// putMemory adds entry to the LRU, evicting the least recently used entries
+// to stay within MaxSize.
+func (c *ResponseCache) putMemory(entry *cachedResponse) {
+	size := entry.size()
+	if size > c.opts.MaxSize {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[entry.Key]; ok {
+		c.remove(el)
+	}
+	c.entries[entry.Key] = c.lru.PushFront(entry)
+	c.size += size
+	for c.size > c.opts.MaxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove drops an entry from memory; c.mu must be held.
+func (c *ResponseCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cachedResponse)
+	delete(c.entries, entry.Key)
+	c.size -= entry.size()
+}
+
+// Purge removes cached responses of host whose path starts with prefix,
+// from memory and Redis. An empty host purges the path on every host, and
+// an empty prefix every path. It returns how many were removed.
+func (c *ResponseCache) Purge(ctx context.Context, host, prefix string) (int, error) {
+	host = strings.ToLower(host)
+	purged := 0
+	c.mu.Lock()
+	for key, el := range c.entries {
+		if keyPurged(key, host, prefix) {
+			c.remove(el)
+			purged++
+		}
+	}
+	c.mu.Unlock()
+
+	if c.opts.Redis == nil {
+		return purged, nil
+	}
+	pattern := cacheKeyPrefix + escapeGlob(host+prefix) + "*"
+	if host == "" {
+		pattern = cacheKeyPrefix + "*" + escapeGlob(prefix) + "*"
+	}
+	iter := c.opts.Redis.Scan(ctx, 0, pattern, 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		// The pattern can't anchor the path after any host
+		if keyPurged(strings.TrimPrefix(iter.Val(), cacheKeyPrefix), host, prefix) {
+			keys = append(keys, iter.Val())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return purged, err
+	}
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+		n, err := c.opts.Redis.Del(ctx, keys[start:end]...).Result()
+		if err != nil {
+			return purged, err
+		}
+		purged += int(n)
+	}
+	return purged, nil
+}
+
+// escapeGlob escapes the characters Redis SCAN patterns treat specially.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// cacheWriter passes a response through while keeping a copy of it, up to
+// max bytes, for the cache.
+type cacheWriter struct {
+	http.ResponseWriter
+	max      int64
+	status   int
+	buf      bytes.Buffer
+	overflow bool
+}
+
+func (w *cacheWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !w.overflow {
+		if int64(w.buf.Len()+len(b)) > w.max {
+			w.overflow = true
+			w.buf = bytes.Buffer{}
+		} else {
+			w.buf.Write(b)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// complete reports whether the whole response was kept.
+func (w *cacheWriter) complete() bool {
+	return w.status != 0 && !w.overflow
+}
+
+// Unwrap lets http.ResponseController reach the connection.
+func (w *cacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,135 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCache returns a cache of every path and its handler, whose
+// upstream answers with the host and who asked, marked public under /public
+// and varying on Accept-Language under /lang.
+// The cache registers a gauge, so a test binary can only create one.
+var newTestCache = sync.OnceValues(func() (*ResponseCache, http.Handler) {
+	routes := NewRoutePolicies(nil, func() bool { return true })
+	routes.Update([]RoutePolicy{{Prefix: "/", CacheTTL: time.Minute}}, nil)
+	cache := NewResponseCache(routes, CacheOptions{MaxSize: 1 << 20, MaxEntry: 1 << 16})
+	return cache, cache.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/public" {
+			w.Header().Set("Cache-Control", "public")
+		}
+		if r.URL.Path == "/lang" {
+			w.Header().Set("Vary", "Accept-Language")
+		}
+		who := r.Header.Get("Cookie") + r.Header.Get("Authorization") + subjectFromContext(r.Context())
+		w.Write([]byte(r.Host + " " + who))
+	}))
+})
+
+func TestResponseCacheCredentials(t *testing.T) {
+	_, h := newTestCache()
+
+	type request struct {
+		cookie, authorization, subject string
+	}
+	tests := []struct {
+		name          string
+		path          string
+		first, second request
+		shared        bool // Whether the second gets the first's response
+	}{
+		{"different cookies", "/account", request{cookie: "session=alice"}, request{cookie: "session=bob"}, false},
+		{"same cookie without a subject", "/settings", request{cookie: "session=alice"}, request{cookie: "session=alice"}, false},
+		{"cookies of one subject", "/profile", request{cookie: "session=a", subject: "alice"}, request{cookie: "session=b", subject: "alice"}, true},
+		{"cookies of different subjects", "/orders", request{cookie: "session=a", subject: "alice"}, request{cookie: "session=b", subject: "bob"}, false},
+		{"different tokens", "/inbox", request{authorization: "Bearer a"}, request{authorization: "Bearer b"}, false},
+		{"public response", "/public", request{cookie: "session=alice"}, request{cookie: "session=bob"}, true},
+		{"no credentials", "/catalog", request{}, request{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send := func(req request) *httptest.ResponseRecorder {
+				r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+				if req.cookie != "" {
+					r.Header.Set("Cookie", req.cookie)
+				}
+				if req.authorization != "" {
+					r.Header.Set("Authorization", req.authorization)
+				}
+				if req.subject != "" {
+					r = r.WithContext(withSubject(r.Context(), req.subject))
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, r)
+				return rec
+			}
+			first := send(tt.first)
+			second := send(tt.second)
+			hit := second.Header().Get("X-Cache") == "HIT"
+			if hit != tt.shared {
+				t.Fatalf("second request X-Cache = %s, want shared = %t", second.Header().Get("X-Cache"), tt.shared)
+			}
+			if !hit && second.Body.String() == first.Body.String() && tt.first != tt.second {
+				t.Errorf("second request got the first's response %q", first.Body.String())
+			}
+		})
+	}
+}
+
+func TestResponseCacheHosts(t *testing.T) {
+	cache, h := newTestCache()
+	send := func(host string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/hosts", nil)
+		r.Host = host
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	send("a.example.com")
+	if rec := send("b.example.com"); rec.Header().Get("X-Cache") == "HIT" || rec.Body.String() != "b.example.com " {
+		t.Fatalf("b.example.com got X-Cache = %s, body %q, want its own response", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := send("A.example.com"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "a.example.com " {
+		t.Errorf("A.example.com got X-Cache = %s, body %q, want a.example.com's response", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+
+	ctx := context.Background()
+	if n, err := cache.Purge(ctx, "a.example.com", "/hosts"); err != nil || n != 1 {
+		t.Fatalf("Purge = %d, %v, want 1 entry", n, err)
+	}
+	if rec := send("b.example.com"); rec.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("b.example.com X-Cache = %s, want HIT after purging a.example.com", rec.Header().Get("X-Cache"))
+	}
+	if n, err := cache.Purge(ctx, "", "/hosts"); err != nil || n != 1 {
+		t.Errorf("Purge of every host = %d, %v, want 1 entry", n, err)
+	}
+}
+
+func TestResponseCacheVarySubject(t *testing.T) {
+	_, h := newTestCache()
+	send := func(language, subject string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/lang", nil)
+		r.Header.Set("Accept-Language", language)
+		if subject != "" {
+			r.Header.Set("Cookie", "session="+subject)
+			r = r.WithContext(withSubject(r.Context(), subject))
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	// A shared response in English, and alice's own in French
+	send("en", "")
+	send("fr", "alice")
+	if rec := send("fr", "alice"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "example.com session=alicealice" {
+		t.Errorf("alice got X-Cache = %s, body %q, want her cached response", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := send("en", "bob"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "example.com " {
+		t.Errorf("bob got X-Cache = %s, body %q, want the shared response", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
@@ -0,0 +1,326 @@
+package middleware
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math/bits"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var challengeOutcomes = metrics.NewCounterVec("aegis_challenges_total",
+	"Bot challenges by kind and outcome: served, passed or failed.", "kind", "outcome")
+
+// challengeTTL is how long a served challenge may be solved.
+const challengeTTL = 5 * time.Minute
+
+// Challenge kinds.
+const (
+	ChallengePoW     = "pow"     // A JavaScript proof of work
+	ChallengeCaptcha = "captcha" // A CAPTCHA widget
+)
+
+// CaptchaProvider describes a CAPTCHA service with a siteverify API.
+type CaptchaProvider struct {
+	Script    string // Widget script URL
+	Class     string // Class of the element the widget renders into
+	Field     string // Form field carrying the widget's response
+	VerifyURL string
+}
+
+// CaptchaProviders are the supported CAPTCHA services by name.
+var CaptchaProviders = map[string]CaptchaProvider{
+	"hcaptcha": {
+		Script: "https://js.hcaptcha.com/1/api.js", Class: "h-captcha",
+		Field: "h-captcha-response", VerifyURL: "https://api.hcaptcha.com/siteverify",
+	},
+	"recaptcha": {
+		Script: "https://www.google.com/recaptcha/api.js", Class: "g-recaptcha",
+		Field: "g-recaptcha-response", VerifyURL: "https://www.google.com/recaptcha/api/siteverify",
+	},
+	"turnstile": {
+		Script: "https://challenges.cloudflare.com/turnstile/v0/api.js", Class: "cf-turnstile",
+		Field: "cf-turnstile-response", VerifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	},
+}
+
+// BotChallengeOptions configures interactive challenges.
+type BotChallengeOptions struct {
+	Kind         string
+	Secret       []byte        // Signs challenges and clearance cookies
+	Difficulty   int           // Leading zero bits of a proof of work
+	ClearanceTTL time.Duration // How long a passed challenge lets a client through
+	CookieName   string
+	Path         string // Where solutions are posted
+	Captcha      CaptchaProvider
+	SiteKey      string
+	SecretKey    string
+	Limiter      *RateLimiter // Bounds solution attempts per client
+}
+
+// BotChallenger serves challenges to clients whose risk calls for one, a
+// middle ground between allowing and blocking them. Browsers get a page that
+// solves a proof of work or shows a CAPTCHA and posts the solution to the
+// challenge path; a correct one earns a signed clearance cookie, bound to the
+// client's address, that passes later challenges until it expires.
+// Challenges are signed rather than stored, so any proxy can check them.
+type BotChallenger struct {
+	opts   BotChallengeOptions
+	client *http.Client
+}
+
+// NewBotChallenger creates a challenger for the graduated responder.
+func NewBotChallenger(opts BotChallengeOptions) *BotChallenger {
+	return &BotChallenger{opts: opts, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+// Verify reports whether the request carries a valid clearance cookie.
+func (c *BotChallenger) Verify(r *http.Request) bool {
+	cookie, err := r.Cookie(c.opts.CookieName)
+	if err != nil {
+		return false
+	}
+	expiry, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(c.sign("clearance", clientIP(r), expiry))) {
+		return false
+	}
+	unix, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && time.Now().Unix() < unix
+}
+
+// Serve answers browsers with the challenge page and other clients with a
+// challenge_required refusal.
+func (c *BotChallenger) Serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet || !strings.Contains(r.Header.Get("Accept"), "text/html") {
+		pages.WriteError(w, r, pages.ErrChallenge)
+		return
+	}
+	challengeOutcomes.Inc(c.opts.Kind, "served")
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusForbidden)
+	challengePage.Execute(w, challengePageData{
+		Path:       c.opts.Path,
+		Return:     r.URL.RequestURI(),
+		Challenge:  c.newChallenge(clientIP(r)),
+		Difficulty: c.opts.Difficulty,
+		Captcha:    c.opts.Kind == ChallengeCaptcha,
+		Provider:   c.opts.Captcha,
+		SiteKey:    c.opts.SiteKey,
+	})
+}
+
+// Handler accepts posted solutions, sets the clearance cookie for correct
+// ones and sends the client back to the page it asked for. It is served
+// outside the middleware chain so challenged clients can reach it.
+func (c *BotChallenger) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			pages.Write(w, r, http.StatusMethodNotAllowed, pages.CodeMethodNotAllowed, "Method Not Allowed")
+			return
+		}
+		clientIP := clientIP(r)
+		if !c.opts.Limiter.Allow(clientIP) {
+			w.Header().Set("Retry-After", "1")
+			pages.WriteError(w, r, pages.ErrRateLimited)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+		if err := r.ParseForm(); err != nil {
+			pages.Write(w, r, http.StatusBadRequest, pages.CodeChallenge, "Bad Request")
+			return
+		}
+
+		if err := c.check(r.Context(), clientIP, r.PostForm); err != nil {
+			challengeOutcomes.Inc(c.opts.Kind, "failed")
+			logging.For(r.Context()).Infof("[Challenge] %s failed the %s challenge: %v", clientIP, c.opts.Kind, err)
+		} else {
+			challengeOutcomes.Inc(c.opts.Kind, "passed")
+			logging.For(r.Context()).Infof("[Challenge] %s passed the %s challenge", clientIP, c.opts.Kind)
+			expiry := strconv.FormatInt(time.Now().Add(c.opts.ClearanceTTL).Unix(), 10)
+			http.SetCookie(w, &http.Cookie{
+				Name:     c.opts.CookieName,
+				Value:    expiry + "." + c.sign("clearance", clientIP, expiry),
+				Path:     "/",
+				MaxAge:   int(c.opts.ClearanceTTL.Seconds()),
+				Secure:   r.TLS != nil,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+		}
+		// A failed attempt lands on a fresh challenge
+		http.Redirect(w, r, localPath(r.PostForm.Get("return")), http.StatusSeeOther)
+	})
+}
+
+// check verifies a posted solution.
+func (c *BotChallenger) check(ctx context.Context, clientIP string, form url.Values) error {
+	challenge := form.Get("challenge")
+	parts := strings.Split(challenge, ".")
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(c.sign("challenge", clientIP, parts[0]+"."+parts[1]))) {
+		return fmt.Errorf("invalid challenge")
+	}
+	issued, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || time.Since(time.Unix(issued, 0)) > challengeTTL {
+		return fmt.Errorf("expired challenge")
+	}
+
+	if c.opts.Kind == ChallengeCaptcha {
+		return c.verifyCaptcha(ctx, clientIP, form.Get(c.opts.Captcha.Field))
+	}
+	nonce := form.Get("nonce")
+	if _, err := strconv.ParseUint(nonce, 10, 64); err != nil {
+		return fmt.Errorf("invalid nonce")
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) < c.opts.Difficulty {
+		return fmt.Errorf("insufficient work")
+	}
+	return nil
+}
+
+// verifyCaptcha asks the provider whether a widget response is valid.
+func (c *BotChallenger) verifyCaptcha(ctx context.Context, clientIP, response string) error {
+	if response == "" {
+		return fmt.Errorf("no CAPTCHA response")
+	}
+	form := url.Values{"secret": {c.opts.SecretKey}, "response": {response}, "remoteip": {clientIP}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.opts.Captcha.VerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("CAPTCHA verification: %w", err)
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("CAPTCHA verification: %w", err)
+	}
+	if !result.Success {
+		return fmt.Errorf("CAPTCHA response rejected")
+	}
+	return nil
+}
+
+// newChallenge returns a signed challenge for a client: issue time, a random
+// value and the signature.
+func (c *BotChallenger) newChallenge(clientIP string) string {
+	random := make([]byte, 16)
+	rand.Read(random)
+	payload := strconv.FormatInt(time.Now().Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString(random)
+	return payload + "." + c.sign("challenge", clientIP, payload)
+}
+
+// sign binds a value of a purpose to a client address.
+func (c *BotChallenger) sign(purpose, clientIP, value string) string {
+	mac := hmac.New(sha256.New, c.opts.Secret)
+	mac.Write([]byte(purpose + "|" + clientIP + "|" + value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	n := 0
+	for _, b := range hash {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
+
+// localPath returns target if it is a path on this host, else "/", so the
+// return address can't redirect elsewhere. Browsers drop tabs and newlines
+// from URLs and read backslashes as slashes, so "/\t/evil.example" would
+// become "//evil.example": control characters are refused outright.
+func localPath(target string) string {
+	if strings.IndexFunc(target, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+		return "/"
+	}
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/"
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "" || u.Host != "" || u.User != nil {
+		return "/"
+	}
+	return target
+}
+
+type challengePageData struct {
+	Path       string
+	Return     string
+	Challenge  string
+	Difficulty int
+	Captcha    bool
+	Provider   CaptchaProvider
+	SiteKey    string
+}
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Checking your browser</title>
+{{if .Captcha}}<script src="{{.Provider.Script}}" async defer></script>{{end}}
+</head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 4em auto">
+<h1>Checking your browser</h1>
+<form id="challenge" method="POST" action="{{.Path}}">
+<input type="hidden" name="return" value="{{.Return}}">
+<input type="hidden" name="challenge" value="{{.Challenge}}">
+{{if .Captcha}}
+<p>Please confirm you are not a robot to continue.</p>
+<div class="{{.Provider.Class}}" data-sitekey="{{.SiteKey}}"></div>
+<p><button type="submit">Continue</button></p>
+{{else}}
+<input type="hidden" name="nonce">
+<p>This takes a few seconds and happens once.</p>
+<noscript><p>Please enable JavaScript to continue.</p></noscript>
+<script>
+(async function () {
+  var form = document.getElementById("challenge");
+  var challenge = form.elements.challenge.value, difficulty = {{.Difficulty}};
+  var encoder = new TextEncoder();
+  function zeroBits(hash) {
+    var n = 0;
+    for (var i = 0; i < hash.length; i++) {
+      if (hash[i] !== 0) { return n + Math.clz32(hash[i]) - 24; }
+      n += 8;
+    }
+    return n;
+  }
+  for (var nonce = 0; ; nonce++) {
+    var hash = new Uint8Array(await crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + nonce)));
+    if (zeroBits(hash) >= difficulty) {
+      form.elements.nonce.value = nonce;
+      form.submit();
+      return;
+    }
+  }
+})();
+</script>
+{{end}}
+</form>
+</body>
+</html>
+`))
@@ -0,0 +1,29 @@
+package middleware
+
+import "testing"
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		target string
+		want   string
+	}{
+		{"/account?tab=2", "/account?tab=2"},
+		{"/", "/"},
+		{"", "/"},
+		{"account", "/"},
+		{"https://evil.example/", "/"},
+		{"//evil.example", "/"},
+		{"/\\evil.example", "/"},
+		{"/\t/evil.example", "/"},
+		{"/\n/evil.example", "/"},
+		{"/\r/evil.example", "/"},
+		{"/path\x00", "/"},
+		{"/path\x7f", "/"},
+		{"/%zz", "/"},
+	}
+	for _, tt := range tests {
+		if got := localPath(tt.target); got != tt.want {
+			t.Errorf("localPath(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var faultsInjected = metrics.NewCounterVec("aegis_chaos_faults_total",
+	"Faults injected by the chaos stage, by route prefix and kind (latency, status or reset).", "prefix", "kind")
+
+// ChaosFault is a failure injected into a share of the requests under a
+// path prefix.
+type ChaosFault struct {
+	Prefix  string
+	Percent float64 // 0 to 100
+	Latency time.Duration
+	Jitter  time.Duration
+	Status  int  // Answered instead of proxying, if set
+	Reset   bool // Close the connection without answering
+}
+
+// ChaosMiddleware injects latency, errors and connection resets, for
+// testing how clients behave when the proxy or upstream misbehaves. The
+// longest matching prefix picks a request's fault.
+type ChaosMiddleware struct {
+	faults []ChaosFault
+}
+
+// NewChaosMiddleware creates the middleware for faults.
+func NewChaosMiddleware(faults []ChaosFault) *ChaosMiddleware {
+	return &ChaosMiddleware{faults: faults}
+}
+
+// match returns the fault of the longest prefix of path.
+func (c *ChaosMiddleware) match(path string) *ChaosFault {
+	var best *ChaosFault
+	for i := range c.faults {
+		f := &c.faults[i]
+		if strings.HasPrefix(path, f.Prefix) && (best == nil || len(f.Prefix) > len(best.Prefix)) {
+			best = f
+		}
+	}
+	return best
+}
+
+// Handler wraps the next stage.
+func (c *ChaosMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := c.match(r.URL.Path)
+		if f == nil || rand.Float64()*100 >= f.Percent {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("X-Aegis-Chaos", f.Prefix)
+
+		if delay := f.Latency + jitter(f.Jitter); delay > 0 {
+			faultsInjected.Inc(f.Prefix, "latency")
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		switch {
+		case f.Reset:
+			faultsInjected.Inc(f.Prefix, "reset")
+			logging.For(r.Context()).Debugf("[Chaos] Resetting connection of %s %s", r.Method, r.URL.Path)
+			// ErrAbortHandler makes net/http close the connection silently
+			panic(http.ErrAbortHandler)
+		case f.Status != 0:
+			faultsInjected.Inc(f.Prefix, "status")
+			logging.For(r.Context()).Debugf("[Chaos] Answering %s %s with %d", r.Method, r.URL.Path, f.Status)
+			if f.Status == http.StatusTooManyRequests || f.Status == http.StatusServiceUnavailable {
+				w.Header().Set("Retry-After", "1")
+			}
+			pages.Write(w, r, f.Status, pages.CodeInjectedFault, http.StatusText(f.Status)+" - Injected fault")
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return rand.N(max)
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ClientIPMiddleware resolves the client address every per-client key uses:
+// rate limits, the blocklist, scoring and the rest. It is the connection's
+// peer, after PROXY protocol. Only peers in the trusted CIDRs, such as a load
+// balancer or CDN in front of the proxy, may pass the client's address in
+// X-Forwarded-For or X-Real-IP; from anyone else those headers are ignored,
+// so clients can't pick the address they are keyed by.
+type ClientIPMiddleware struct {
+	trusted []*net.IPNet
+}
+
+// NewClientIPMiddleware creates the middleware, believing the forwarding
+// headers of peers in the trusted CIDRs.
+func NewClientIPMiddleware(trusted []string) *ClientIPMiddleware {
+	m := &ClientIPMiddleware{}
+	for _, cidr := range trusted {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			m.trusted = append(m.trusted, network)
+		}
+	}
+	return m
+}
+
+// Handler attaches a RequestContext with the resolved client address before
+// calling next. It replaces RequestContextHandler outside every stage.
+func (m *ClientIPMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, rc := attachRequestContext(r)
+		rc.ClientIP = m.clientIP(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP walks X-Forwarded-For from the right, past the trusted proxies
+// that appended to it, and returns the first address they didn't vouch for.
+// Without X-Forwarded-For it takes X-Real-IP. Malformed hops end the walk,
+// at the last address a trusted proxy added.
+func (m *ClientIPMiddleware) clientIP(r *http.Request) string {
+	client := extractClientIP(r)
+	if !peerIn(r, m.trusted) {
+		return client
+	}
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			ip := parseHop(hops[i])
+			if ip == nil {
+				break
+			}
+			client = ip.String()
+			if !ipIn(ip, m.trusted) {
+				break
+			}
+		}
+		return client
+	}
+	if ip := parseHop(r.Header.Get("X-Real-IP")); ip != nil {
+		return ip.String()
+	}
+	return client
+}
+
+// parseHop parses an address of X-Forwarded-For or X-Real-IP, which some
+// load balancers send with a port.
+func parseHop(hop string) net.IP {
+	hop = strings.TrimSpace(hop)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(hop)
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	m := NewClientIPMiddleware([]string{"10.0.0.0/8", "fd00::/8"})
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{name: "untrusted peer", remote: "203.0.113.7:4000", want: "203.0.113.7"},
+		{name: "untrusted peer ignores XFF", remote: "203.0.113.7:4000", xff: []string{"198.51.100.1"}, want: "203.0.113.7"},
+		{name: "untrusted peer ignores X-Real-IP", remote: "203.0.113.7:4000", realIP: "198.51.100.1", want: "203.0.113.7"},
+		{name: "trusted peer without headers", remote: "10.0.0.5:4000", want: "10.0.0.5"},
+		{name: "trusted peer XFF", remote: "10.0.0.5:4000", xff: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "spoofed leftmost hop", remote: "10.0.0.5:4000", xff: []string{"1.2.3.4, 198.51.100.1"}, want: "198.51.100.1"},
+		{name: "chain of trusted proxies", remote: "10.0.0.5:4000", xff: []string{"1.2.3.4, 198.51.100.1, 10.1.1.1"}, want: "198.51.100.1"},
+		{name: "repeated XFF headers", remote: "10.0.0.5:4000", xff: []string{"1.2.3.4", "198.51.100.1"}, want: "198.51.100.1"},
+		{name: "only trusted hops", remote: "10.0.0.5:4000", xff: []string{"10.2.2.2, 10.1.1.1"}, want: "10.2.2.2"},
+		{name: "malformed hop ends the walk", remote: "10.0.0.5:4000", xff: []string{"junk, 10.1.1.1"}, want: "10.1.1.1"},
+		{name: "malformed last hop", remote: "10.0.0.5:4000", xff: []string{"junk"}, want: "10.0.0.5"},
+		{name: "hop with port", remote: "10.0.0.5:4000", xff: []string{"198.51.100.1:5555"}, want: "198.51.100.1"},
+		{name: "IPv6 hop with port", remote: "[fd00::1]:4000", xff: []string{"[2001:db8::1]:5555"}, want: "2001:db8::1"},
+		{name: "trusted peer X-Real-IP", remote: "10.0.0.5:4000", realIP: "198.51.100.1", want: "198.51.100.1"},
+		{name: "XFF over X-Real-IP", remote: "10.0.0.5:4000", xff: []string{"198.51.100.1"}, realIP: "198.51.100.2", want: "198.51.100.1"},
+		{name: "malformed X-Real-IP", remote: "10.0.0.5:4000", realIP: "junk", want: "10.0.0.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			var got string
+			m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIP(r)
+			})).ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("client IP %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientIPWithoutMiddleware(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "203.0.113.7:4000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	r.Header.Set("X-Real-IP", "198.51.100.2")
+	if got := clientIP(r); got != "203.0.113.7" {
+		t.Errorf("client IP %q, want the peer's", got)
+	}
+}
@@ -0,0 +1,141 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var concurrencyRejections = metrics.NewCounterVec("aegis_concurrency_rejected_total",
+	"Requests refused for exceeding their client's concurrency limit, by reason.", "reason")
+
+// ConcurrencyOptions configures per-client concurrency limits.
+type ConcurrencyOptions struct {
+	Limit        int           // Requests in flight per client
+	Queue        int           // Requests per client waiting for a slot
+	QueueTimeout time.Duration // How long a request waits for one
+	// BySubject keys clients by JWT subject, falling back to their IP
+	// without one; otherwise they're keyed by IP
+	BySubject bool
+}
+
+// ConcurrencyMiddleware limits the requests each client has in flight, so a
+// runaway client can't tie up the upstream's workers however slowly it is
+// answered. Requests over the limit wait in a short queue for a slot and
+// are refused with 429 once the queue is full or they time out.
+type ConcurrencyMiddleware struct {
+	opts    ConcurrencyOptions
+	auditor *Auditor
+
+	mu      sync.Mutex
+	clients map[string]*clientSlots
+}
+
+// clientSlots are a client's slots; users counts the requests holding or
+// waiting for one, so the entry is dropped once it is idle.
+type clientSlots struct {
+	sem     chan struct{}
+	waiting int
+	users   int
+}
+
+// NewConcurrencyMiddleware creates the concurrency stage.
+func NewConcurrencyMiddleware(opts ConcurrencyOptions, auditor *Auditor) *ConcurrencyMiddleware {
+	return &ConcurrencyMiddleware{opts: opts, auditor: auditor, clients: make(map[string]*clientSlots)}
+}
+
+// Handler returns the middleware handler
+func (m *ConcurrencyMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := identityKey(r, m.opts.BySubject)
+		slots, reason := m.acquire(r, key)
+		if slots == nil {
+			concurrencyRejections.Inc(reason)
+			logging.For(r.Context()).Infof("[Concurrency] Refused %s %s from %s: %s", r.Method, r.URL.Path, clientIP(r), reason)
+			noteDecision(r.Context(), "concurrency", OutcomeDeny, "concurrency limit, "+reason)
+			m.auditor.Record(AuditEvent{
+				ClientIP:  clientIP(r),
+				Subject:   subjectFromContext(r.Context()),
+				Tenant:    tenantName(r.Context()),
+				RequestID: logging.RequestID(r.Context()),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Status:    http.StatusTooManyRequests,
+				Stage:     "concurrency",
+				Reason:    "concurrency limit of " + strconv.Itoa(m.opts.Limit) + ", " + reason,
+			})
+			w.Header().Set("Retry-After", "1")
+			pages.WriteError(w, r, pages.ErrConcurrency)
+			return
+		}
+		defer m.release(key, slots)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire takes one of key's slots, waiting in its queue if they're all
+// taken. It returns nil and why if the request gets none.
+func (m *ConcurrencyMiddleware) acquire(r *http.Request, key string) (*clientSlots, string) {
+	m.mu.Lock()
+	slots, ok := m.clients[key]
+	if !ok {
+		slots = &clientSlots{sem: make(chan struct{}, m.opts.Limit)}
+		m.clients[key] = slots
+	}
+	select {
+	case slots.sem <- struct{}{}:
+		slots.users++
+		m.mu.Unlock()
+		return slots, ""
+	default:
+	}
+	if slots.waiting >= m.opts.Queue {
+		m.mu.Unlock()
+		return nil, "queue_full"
+	}
+	slots.waiting++
+	slots.users++
+	m.mu.Unlock()
+
+	timer := time.NewTimer(m.opts.QueueTimeout)
+	defer timer.Stop()
+	reason := ""
+	select {
+	case slots.sem <- struct{}{}:
+	case <-timer.C:
+		reason = "timeout"
+	case <-r.Context().Done():
+		reason = "canceled"
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	slots.waiting--
+	if reason != "" {
+		m.drop(key, slots)
+		return nil, reason
+	}
+	return slots, ""
+}
+
+// release frees a slot of key.
+func (m *ConcurrencyMiddleware) release(key string, slots *clientSlots) {
+	<-slots.sem
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.drop(key, slots)
+}
+
+// drop ends a request's use of key's slots, forgetting them once unused.
+// The caller holds m.mu.
+func (m *ConcurrencyMiddleware) drop(key string, slots *clientSlots) {
+	slots.users--
+	if slots.users == 0 {
+		delete(m.clients, key)
+	}
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/flow"
+)
+
+// FlowRecord is the record shipped for each connection of a TCP listener,
+// where there are no requests to log. Its features are computed over the
+// connection's reads, each counted as a packet.
+type FlowRecord struct {
+	Timestamp time.Time `json:"timestamp"` // When the connection was accepted
+	ClientIP  string    `json:"client_ip"`
+	// Identity is the common name of the client certificate on mTLS
+	// listeners
+	Identity string `json:"identity,omitempty"`
+	Listener string `json:"listener"`
+	Upstream string `json:"upstream"`
+	Protocol string `json:"protocol"` // "tcp", or "tls" when terminated
+	Duration int64  `json:"duration_ms"`
+
+	BytesIn    int64 `json:"bytes_in"`  // From the client
+	BytesOut   int64 `json:"bytes_out"` // To the client
+	PacketsIn  int   `json:"packets_in"`
+	PacketsOut int   `json:"packets_out"`
+
+	Blocked  bool             `json:"blocked,omitempty"`
+	Error    string           `json:"error,omitempty"` // Why the upstream couldn't be reached
+	Features *TrafficFeatures `json:"features"`
+	Pod      *PodInfo         `json:"pod,omitempty"`
+	Cloud    *CloudInfo       `json:"cloud,omitempty"`
+}
+
+// Measured fills in the traffic a connection meter measured.
+func (r *FlowRecord) Measured(m flow.Measurement) {
+	r.Timestamp = m.Start.UTC()
+	r.Duration = m.Duration.Milliseconds()
+	r.BytesIn, r.BytesOut = m.BytesIn, m.BytesOut
+	r.PacketsIn, r.PacketsOut = m.PacketsIn, m.PacketsOut
+	r.Features = m.Features
+}
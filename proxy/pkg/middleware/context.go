@@ -0,0 +1,305 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type contextKey int
+
+const (
+	requestContextKey contextKey = iota
+	decisionKey
+)
+
+// RequestContext is what the chain has learned about a request, filled in
+// as it goes: the client's address when it arrives, the tenant, the
+// subject and claims once jwt verified them, the traffic features from
+// the logger, the route, the risk score, and what the WAF and validators
+// found. Stages read what the stages before them set, and the logger and
+// decisions stages read what the stages after them set once the request
+// has been handled.
+//
+// A request is handled by one goroutine at a time, so RequestContext is
+// not locked; don't hand it to goroutines that outlive the stage.
+type RequestContext struct {
+	ClientIP string    // The peer address, or what trusted proxies forwarded
+	Start    time.Time // When the request entered the chain
+
+	Tenant   *Tenant                // Nil without tenants
+	Subject  string                 // The JWT "sub" claim
+	Claims   map[string]interface{} // Verified JWT claims
+	Route    string                 // Prefix of the matched route policy
+	Features *TrafficFeatures       // Computed by the logger
+	Score    *RiskScore             // Set by scoring
+
+	// Heuristic is the heuristic stage's score, scoring's fallback
+	Heuristic *RiskScore
+
+	WAF               *WAFResult   // What the WAF found
+	SchemaViolations  []string     // How the request broke its route's OpenAPI spec
+	ProtocolAnomalies []string     // HTTP-level oddities such as duplicate headers
+	OffSchedule       []string     // Flagging schedules the request is outside of
+	Travel            *Travel      // The subject's move since its last request
+	Familiarity       *Familiarity // What the subject hasn't been seen with
+
+	// Timings are when each stage handed the request on, since Start
+	Timings []StageTiming
+
+	shadow <-chan *RiskScore // Pending challenger score, for the logger
+}
+
+// StageTiming is how long after the request's start a stage passed it on.
+type StageTiming struct {
+	Stage   string        `json:"stage"`
+	Elapsed time.Duration `json:"elapsed_ns"`
+}
+
+// Mark records that stage handed the request on now.
+func (rc *RequestContext) Mark(stage string) {
+	rc.Timings = append(rc.Timings, StageTiming{Stage: stage, Elapsed: time.Since(rc.Start)})
+}
+
+// RequestContextFrom returns the request's context, or nil if none was
+// attached.
+func RequestContextFrom(ctx context.Context) *RequestContext {
+	rc, _ := ctx.Value(requestContextKey).(*RequestContext)
+	return rc
+}
+
+// RequestContextHandler attaches a RequestContext to every request before
+// calling next. It runs outside every stage; stages that need one attach
+// it themselves when embedded without it.
+func RequestContextHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, _ = attachRequestContext(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MarkStage wraps the handler a stage calls to pass the request on, so the
+// request's timings record when it did.
+func MarkStage(stage string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rc := RequestContextFrom(r.Context()); rc != nil {
+			rc.Mark(stage)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// attachRequestContext returns the request with a RequestContext, and
+// the context, reusing the one it has.
+func attachRequestContext(r *http.Request) (*http.Request, *RequestContext) {
+	if rc := RequestContextFrom(r.Context()); rc != nil {
+		if rc.ClientIP == "" {
+			rc.ClientIP = extractClientIP(r)
+		}
+		return r, rc
+	}
+	rc := &RequestContext{ClientIP: extractClientIP(r), Start: time.Now()}
+	return r.WithContext(context.WithValue(r.Context(), requestContextKey, rc)), rc
+}
+
+// ensureRequestContext is attachRequestContext for code without the request.
+func ensureRequestContext(ctx context.Context) (context.Context, *RequestContext) {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		return ctx, rc
+	}
+	rc := &RequestContext{Start: time.Now()}
+	return context.WithValue(ctx, requestContextKey, rc), rc
+}
+
+// clientIP returns the request's client address, extracted once per request.
+func clientIP(r *http.Request) string {
+	if rc := RequestContextFrom(r.Context()); rc != nil && rc.ClientIP != "" {
+		return rc.ClientIP
+	}
+	return extractClientIP(r)
+}
+
+// identityKey keys per-client state by JWT subject when bySubject is set
+// and the request has one, and by IP otherwise, per tenant either way.
+func identityKey(r *http.Request, bySubject bool) string {
+	if subject := subjectFromContext(r.Context()); bySubject && subject != "" {
+		return FlowKey(tenantName(r.Context()), "sub:"+subject)
+	}
+	return FlowKey(tenantName(r.Context()), clientIP(r))
+}
+
+// extractClientIP gets the client IP from RemoteAddr: the peer's address,
+// or the client's a listener read from a PROXY protocol header. Headers are
+// only believed from trusted proxies, by ClientIPMiddleware.
+func extractClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return strings.Trim(r.RemoteAddr, "[]")
+	}
+	return host
+}
+
+// peerIn reports whether the request's peer, after PROXY protocol, is in
+// one of the networks.
+func peerIn(r *http.Request, networks []*net.IPNet) bool {
+	ip := net.ParseIP(extractClientIP(r))
+	if ip == nil {
+		return false
+	}
+	return ipIn(ip, networks)
+}
+
+func ipIn(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// featuresFromContext returns the features computed by the logger, if any.
+func featuresFromContext(ctx context.Context) *TrafficFeatures {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		return rc.Features
+	}
+	return nil
+}
+
+// setShadowScore hands the pending challenger result to the logger.
+func setShadowScore(ctx context.Context, shadow <-chan *RiskScore) {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		rc.shadow = shadow
+	}
+}
+
+// setWAFResult hands what the WAF found to the logger.
+func setWAFResult(ctx context.Context, result *WAFResult) {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		rc.WAF = result
+	}
+}
+
+// setSchemaViolations hands the request's OpenAPI violations to the logger.
+func setSchemaViolations(ctx context.Context, violations []string) {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		rc.SchemaViolations = violations
+	}
+}
+
+// addProtocolAnomalies hands protocol anomalies of the request, found by
+// the protocol stage or path normalization, to the logger.
+func addProtocolAnomalies(ctx context.Context, anomalies ...string) {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		rc.ProtocolAnomalies = append(rc.ProtocolAnomalies, anomalies...)
+	}
+}
+
+// setOffSchedule records the flagging schedules a request is outside of.
+func setOffSchedule(ctx context.Context, schedules []string) {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		rc.OffSchedule = schedules
+	}
+}
+
+// offScheduleFromContext returns the flagging schedules a request is outside of.
+func offScheduleFromContext(ctx context.Context) []string {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		return rc.OffSchedule
+	}
+	return nil
+}
+
+// setTravel records the subject's travel since its last request.
+func setTravel(ctx context.Context, travel *Travel) {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		rc.Travel = travel
+	}
+}
+
+// travelFromContext returns the subject's travel, if the travel stage ran.
+func travelFromContext(ctx context.Context) *Travel {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		return rc.Travel
+	}
+	return nil
+}
+
+// heuristicScoreFromContext returns the heuristic stage's score, if it ran.
+func heuristicScoreFromContext(ctx context.Context) *RiskScore {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		return rc.Heuristic
+	}
+	return nil
+}
+
+// setRoute records the prefix of the request's route policy.
+func setRoute(ctx context.Context, route string) {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		rc.Route = route
+	}
+}
+
+// withSubject records the authenticated subject (the JWT "sub" claim).
+func withSubject(ctx context.Context, subject string) context.Context {
+	ctx, rc := ensureRequestContext(ctx)
+	rc.Subject = subject
+	return ctx
+}
+
+// subjectFromContext returns the authenticated subject, if any.
+func subjectFromContext(ctx context.Context) string {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		return rc.Subject
+	}
+	return ""
+}
+
+// withClaims records the verified JWT claims.
+func withClaims(ctx context.Context, claims map[string]interface{}) context.Context {
+	ctx, rc := ensureRequestContext(ctx)
+	rc.Claims = claims
+	return ctx
+}
+
+// claimsFromContext returns the verified JWT claims, if any.
+func claimsFromContext(ctx context.Context) map[string]interface{} {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		return rc.Claims
+	}
+	return nil
+}
+
+// withScore records the request's risk score for the stages after scoring
+// and for the logger.
+func withScore(ctx context.Context, score *RiskScore) context.Context {
+	ctx, rc := ensureRequestContext(ctx)
+	rc.Score = score
+	return ctx
+}
+
+// scoreFromContext returns the risk score, if the scoring stage ran.
+func scoreFromContext(ctx context.Context) *RiskScore {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		return rc.Score
+	}
+	return nil
+}
+
+// setFamiliarity records what was new about the request.
+func setFamiliarity(ctx context.Context, f *Familiarity) {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		rc.Familiarity = f
+	}
+}
+
+// familiarityFromContext returns what was new about the request, if the
+// familiarity stage ran.
+func familiarityFromContext(ctx context.Context) *Familiarity {
+	if rc := RequestContextFrom(ctx); rc != nil {
+		return rc.Familiarity
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var corsRejected = metrics.NewCounterVec("aegis_cors_rejected_total",
+	"Cross-origin requests refused by the cors stage, by reason: origin, method or header.", "reason")
+
+// corsSafelisted are request headers browsers may send cross-origin without
+// them being allowed.
+var corsSafelisted = map[string]bool{"accept": true, "accept-language": true, "content-language": true}
+
+// CORSPolicy is a compiled cross-origin policy.
+type CORSPolicy struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	wildcards   [][2]string // Scheme and host suffix, e.g. "https://" and ".example.com"
+	methods     map[string]bool
+	headers     map[string]bool // Lowercase
+	credentials bool
+
+	allowMethods, allowHeaders, expose, maxAge string // Response header values
+}
+
+// NewCORSPolicy compiles a policy. Origins are exact, "*", or wildcards such
+// as https://*.example.com matching any subdomain.
+func NewCORSPolicy(origins, methods, headers, exposed []string, credentials bool, maxAge time.Duration) *CORSPolicy {
+	p := &CORSPolicy{
+		origins:      make(map[string]bool),
+		methods:      make(map[string]bool),
+		headers:      make(map[string]bool),
+		credentials:  credentials,
+		allowMethods: strings.Join(methods, ", "),
+		allowHeaders: strings.Join(headers, ", "),
+		expose:       strings.Join(exposed, ", "),
+	}
+	for _, origin := range origins {
+		switch {
+		case origin == "*":
+			p.anyOrigin = true
+		case strings.Contains(origin, "://*."):
+			scheme, suffix, _ := strings.Cut(origin, "://*")
+			p.wildcards = append(p.wildcards, [2]string{scheme + "://", strings.ToLower(suffix)})
+		default:
+			p.origins[strings.ToLower(origin)] = true
+		}
+	}
+	for _, method := range methods {
+		p.methods[method] = true
+	}
+	for _, header := range headers {
+		p.headers[strings.ToLower(header)] = true
+	}
+	if maxAge > 0 {
+		p.maxAge = strconv.Itoa(int(maxAge.Seconds()))
+	}
+	return p
+}
+
+// allowsOrigin matches an Origin header against the policy.
+func (p *CORSPolicy) allowsOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if strings.HasPrefix(origin, w[0]) && strings.HasSuffix(origin, w[1]) && len(origin) > len(w[0])+len(w[1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// CORSMiddleware answers preflight requests and adds CORS headers to
+// cross-origin responses, so upstreams don't have to, and refuses requests
+// from origins their route doesn't allow.
+type CORSMiddleware struct {
+	defaults atomic.Pointer[CORSPolicy] // nil leaves routes without a policy to the upstream
+	routes   *RoutePolicies             // Per-route policies; nil without the routes stage
+	auditor  *Auditor
+}
+
+// NewCORSMiddleware creates the cors stage.
+func NewCORSMiddleware(defaults *CORSPolicy, routes *RoutePolicies, auditor *Auditor) *CORSMiddleware {
+	m := &CORSMiddleware{routes: routes, auditor: auditor}
+	m.defaults.Store(defaults)
+	return m
+}
+
+// SetDefault replaces the policy of routes without their own.
+func (m *CORSMiddleware) SetDefault(p *CORSPolicy) {
+	m.defaults.Store(p)
+}
+
+// Handler returns the middleware handler
+func (m *CORSMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		p := m.policy(r.URL.Path)
+		if origin == "" || p == nil || sameOrigin(r, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Add("Vary", "Origin")
+		if !p.allowsOrigin(origin) {
+			m.reject(w, r, "origin", "origin "+strconv.Quote(origin)+" not allowed")
+			return
+		}
+
+		method := r.Header.Get("Access-Control-Request-Method")
+		if r.Method != http.MethodOptions || method == "" {
+			next.ServeHTTP(&corsWriter{ResponseWriter: w, policy: p, origin: origin}, r)
+			return
+		}
+
+		// Preflight
+		if !p.methods[method] {
+			m.reject(w, r, "method", "method "+strconv.Quote(method)+" not allowed")
+			return
+		}
+		for _, header := range strings.Split(r.Header.Get("Access-Control-Request-Headers"), ",") {
+			header = strings.ToLower(strings.TrimSpace(header))
+			if header != "" && !p.headers[header] && !corsSafelisted[header] {
+				m.reject(w, r, "header", "header "+strconv.Quote(header)+" not allowed")
+				return
+			}
+		}
+		h := w.Header()
+		h.Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+		h.Set("Access-Control-Allow-Origin", p.allowOrigin(origin))
+		h.Set("Access-Control-Allow-Methods", p.allowMethods)
+		if p.allowHeaders != "" {
+			h.Set("Access-Control-Allow-Headers", p.allowHeaders)
+		}
+		if p.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if p.maxAge != "" {
+			h.Set("Access-Control-Max-Age", p.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// policy returns the policy of the route of path, or the default one.
+func (m *CORSMiddleware) policy(path string) *CORSPolicy {
+	if m.routes != nil {
+		if route := m.routes.Match(path); route != nil && route.CORS != nil {
+			return route.CORS
+		}
+	}
+	return m.defaults.Load()
+}
+
+// allowOrigin is the Access-Control-Allow-Origin value for an allowed origin.
+// Credentialed responses must name the origin rather than "*".
+func (p *CORSPolicy) allowOrigin(origin string) string {
+	if p.anyOrigin && !p.credentials {
+		return "*"
+	}
+	return origin
+}
+
+// reject logs, audits and refuses a cross-origin request the policy doesn't allow.
+func (m *CORSMiddleware) reject(w http.ResponseWriter, r *http.Request, reason, detail string) {
+	corsRejected.Inc(reason)
+	clientIP := clientIP(r)
+	logging.For(r.Context()).Infof("[CORS] REJECTED %s %s from %s: %s", r.Method, r.URL.Path, clientIP, detail)
+	noteDecision(r.Context(), "cors", OutcomeDeny, detail)
+	m.auditor.Record(AuditEvent{
+		ClientIP:  clientIP,
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    http.StatusForbidden,
+		Stage:     "cors",
+		Reason:    detail,
+	})
+	pages.WriteError(w, r, pages.ErrCrossOrigin)
+}
+
+// sameOrigin reports whether origin is the proxy's own, which browsers also
+// send on same-origin requests that aren't GET or HEAD.
+func sameOrigin(r *http.Request, origin string) bool {
+	scheme := "http://"
+	if r.TLS != nil {
+		scheme = "https://"
+	}
+	return strings.EqualFold(origin, scheme+r.Host)
+}
+
+// corsWriter replaces the CORS headers of upstream responses with the
+// policy's.
+type corsWriter struct {
+	http.ResponseWriter
+	policy      *CORSPolicy
+	origin      string
+	wroteHeader bool
+}
+
+func (w *corsWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.wroteHeader = true
+		h := w.Header()
+		for _, name := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Credentials", "Access-Control-Expose-Headers"} {
+			h.Del(name)
+		}
+		h.Set("Access-Control-Allow-Origin", w.policy.allowOrigin(w.origin))
+		if w.policy.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if w.policy.expose != "" {
+			h.Set("Access-Control-Expose-Headers", w.policy.expose)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var csrfRejected = metrics.NewCounterVec("aegis_csrf_rejected_total",
+	"State-changing requests refused by the csrf stage, by reason.", "reason")
+
+// csrfFormLimit bounds the form body read for the token field.
+const csrfFormLimit = 64 << 10
+
+// CSRFOptions configures the csrf stage.
+type CSRFOptions struct {
+	Secret     []byte // Signs tokens together with the session they belong to
+	CookieName string
+	HeaderName string
+	FieldName  string // Form field carrying the token in urlencoded posts
+	Session    string // The app's session cookie, binding tokens without a subject
+	Auditor    *Auditor
+}
+
+// CSRFMiddleware protects cookie-authenticated browser routes from cross-site
+// request forgery with signed double-submit tokens. Safe requests are issued
+// a token cookie; state-changing requests must echo it in a header or form
+// field. Tokens are signed for the session they were issued in, so a token
+// another session got can't be planted from a sibling subdomain. Requests
+// without cookies carry no ambient credentials and pass, as do requests the
+// browser attests are same-origin with Sec-Fetch-Site.
+type CSRFMiddleware struct {
+	routes *RoutePolicies // Routes with csrf set are protected
+	opts   CSRFOptions
+}
+
+// NewCSRFMiddleware creates the csrf stage.
+func NewCSRFMiddleware(routes *RoutePolicies, opts CSRFOptions) *CSRFMiddleware {
+	return &CSRFMiddleware{routes: routes, opts: opts}
+}
+
+// Handler returns the middleware handler
+func (m *CSRFMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := m.routes.Match(r.URL.Path); route == nil || !route.CSRF {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(m.opts.CookieName)
+		hasToken := err == nil && m.valid(r, cookie.Value)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			if !hasToken {
+				m.issue(w, r)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(r.Cookies()) == 0 || r.Header.Get("Sec-Fetch-Site") == "same-origin" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !hasToken {
+			m.reject(w, r, "missing_cookie")
+			return
+		}
+		token := r.Header.Get(m.opts.HeaderName)
+		if token == "" {
+			token = m.formToken(r)
+		}
+		if token == "" {
+			m.reject(w, r, "missing_token")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cookie.Value)) != 1 {
+			m.reject(w, r, "mismatch")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// issue sets a new token cookie. Scripts must read it to echo it, so it
+// isn't HttpOnly; SameSite=Lax keeps it off cross-site subresource requests.
+func (m *CSRFMiddleware) issue(w http.ResponseWriter, r *http.Request) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return
+	}
+	value := base64.RawURLEncoding.EncodeToString(nonce)
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.opts.CookieName,
+		Value:    value + "." + m.sign(m.session(r), value),
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// valid checks that a token was signed for the request's session.
+func (m *CSRFMiddleware) valid(r *http.Request, token string) bool {
+	value, sig, ok := strings.Cut(token, ".")
+	return ok && hmac.Equal([]byte(sig), []byte(m.sign(m.session(r), value)))
+}
+
+// session identifies who a token is for: the authenticated subject, else
+// the app's session cookie, else no one. A token issued before login stops
+// validating after it, and a new one is issued on the next safe request.
+func (m *CSRFMiddleware) session(r *http.Request) string {
+	if subject := subjectFromContext(r.Context()); subject != "" {
+		return "sub:" + subject
+	}
+	if m.opts.Session != "" {
+		if cookie, err := r.Cookie(m.opts.Session); err == nil && cookie.Value != "" {
+			return "cookie:" + cookie.Value
+		}
+	}
+	return ""
+}
+
+func (m *CSRFMiddleware) sign(session, value string) string {
+	mac := hmac.New(sha256.New, m.opts.Secret)
+	mac.Write([]byte(session))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// formToken reads the token field of urlencoded form posts, leaving the body
+// intact for the upstream.
+func (m *CSRFMiddleware) formToken(r *http.Request) string {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" || r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+	body, _ := io.ReadAll(io.LimitReader(r.Body, csrfFormLimit))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	form, _ := url.ParseQuery(string(body))
+	return form.Get(m.opts.FieldName)
+}
+
+// reject logs, audits and refuses a request failing the CSRF check.
+func (m *CSRFMiddleware) reject(w http.ResponseWriter, r *http.Request, reason string) {
+	csrfRejected.Inc(reason)
+	clientIP := clientIP(r)
+	logging.For(r.Context()).Infof("[CSRF] REJECTED %s %s from %s: %s (origin %q)", r.Method, r.URL.Path, clientIP, reason, r.Header.Get("Origin"))
+	noteDecision(r.Context(), "csrf", OutcomeDeny, reason)
+	m.opts.Auditor.Record(AuditEvent{
+		ClientIP:  clientIP,
+		Subject:   subjectFromContext(r.Context()),
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    http.StatusForbidden,
+		Stage:     "csrf",
+		Reason:    reason,
+	})
+	pages.WriteError(w, r, pages.ErrCSRF)
+}
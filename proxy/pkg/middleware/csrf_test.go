@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	routes := NewRoutePolicies(nil, func() bool { return true })
+	routes.Update([]RoutePolicy{{Prefix: "/account", CSRF: true}}, nil)
+	m := NewCSRFMiddleware(routes, CSRFOptions{
+		Secret:     []byte(strings.Repeat("k", 32)),
+		CookieName: "aegis_csrf",
+		HeaderName: "X-CSRF-Token",
+		FieldName:  "csrf_token",
+		Session:    "app_session",
+	})
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	// tokenFor is the token a GET in the given session is issued
+	tokenFor := func(session, subject string) string {
+		req := httptest.NewRequest(http.MethodGet, "/account", nil)
+		if session != "" {
+			req.AddCookie(&http.Cookie{Name: "app_session", Value: session})
+		}
+		if subject != "" {
+			req = req.WithContext(withSubject(req.Context(), subject))
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		for _, cookie := range rec.Result().Cookies() {
+			if cookie.Name == "aegis_csrf" {
+				return cookie.Value
+			}
+		}
+		t.Fatalf("no token issued for session %q, subject %q", session, subject)
+		return ""
+	}
+	victim, attacker := tokenFor("victim", ""), tokenFor("attacker", "")
+	anonymous, alice := tokenFor("", ""), tokenFor("", "alice")
+
+	tests := []struct {
+		name    string
+		session string // app_session cookie
+		subject string
+		cookie  string // aegis_csrf cookie
+		header  string
+		form    string
+		site    string // Sec-Fetch-Site
+		want    int
+	}{
+		{"token of the session", "victim", "", victim, victim, "", "", http.StatusOK},
+		{"token in the form", "victim", "", victim, "", victim, "", http.StatusOK},
+		{"token planted from another session", "victim", "", attacker, attacker, "", "", http.StatusForbidden},
+		{"token from before login", "victim", "", anonymous, anonymous, "", "", http.StatusForbidden},
+		{"token of the subject", "", "alice", alice, alice, "", "", http.StatusOK},
+		{"token of the session for a subject", "victim", "alice", victim, victim, "", "", http.StatusForbidden},
+		{"header differs from the cookie", "victim", "", victim, tokenFor("victim", ""), "", "", http.StatusForbidden},
+		{"no token", "victim", "", victim, "", "", "", http.StatusForbidden},
+		{"no token cookie", "victim", "", "", victim, "", "", http.StatusForbidden},
+		{"tampered token", "victim", "", victim + "x", victim + "x", "", "", http.StatusForbidden},
+		{"same-origin request", "victim", "", "", "", "", "same-origin", http.StatusOK},
+		{"cross-site request", "victim", "", "", "", "", "cross-site", http.StatusForbidden},
+		{"no cookies", "", "", "", "", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body *strings.Reader
+			if tt.form != "" {
+				body = strings.NewReader(url.Values{"csrf_token": {tt.form}}.Encode())
+			} else {
+				body = strings.NewReader("")
+			}
+			req := httptest.NewRequest(http.MethodPost, "/account/email", body)
+			if tt.form != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tt.session != "" {
+				req.AddCookie(&http.Cookie{Name: "app_session", Value: tt.session})
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "aegis_csrf", Value: tt.cookie})
+			}
+			if tt.header != "" {
+				req.Header.Set("X-CSRF-Token", tt.header)
+			}
+			if tt.site != "" {
+				req.Header.Set("Sec-Fetch-Site", tt.site)
+			}
+			if tt.subject != "" {
+				req = req.WithContext(withSubject(req.Context(), tt.subject))
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
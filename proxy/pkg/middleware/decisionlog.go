@@ -0,0 +1,183 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+// Stage outcomes in a decision log.
+const (
+	OutcomePass     = "pass"     // Handed the request on
+	OutcomeDeny     = "deny"     // Refused the request or its response
+	OutcomeResponse = "response" // Answered the request itself, e.g. a CORS preflight
+)
+
+// StageDecision is what one stage did with a request.
+type StageDecision struct {
+	Stage   string   `json:"stage"`
+	Outcome string   `json:"outcome"`
+	Reason  string   `json:"reason,omitempty"`
+	Rules   []string `json:"rules,omitempty"` // e.g. matched WAF rules
+}
+
+// DecisionLog is the single record of how the chain handled a request: the
+// stages it went through, what each of them did and why, and the final
+// action, under the policy version that was in effect.
+type DecisionLog struct {
+	Timestamp     time.Time       `json:"timestamp"`
+	TraceID       string          `json:"trace_id"`
+	ClientIP      string          `json:"client_ip"`
+	Subject       string          `json:"subject,omitempty"`
+	Tenant        string          `json:"tenant,omitempty"`
+	Method        string          `json:"method"`
+	Path          string          `json:"path"`
+	Status        int             `json:"status"`
+	Action        string          `json:"action"`               // allow, deny or response
+	DecidedBy     string          `json:"decided_by,omitempty"` // Stage that denied or answered
+	RiskScore     *float64        `json:"risk_score,omitempty"`
+	RiskDecision  Action          `json:"risk_decision,omitempty"`
+	Stages        []StageDecision `json:"stages"`
+	PolicyVersion string          `json:"policy_version,omitempty"`
+	Duration      int64           `json:"duration_ms"`
+	// Timings are when each stage passed the request on
+	Timings []StageTiming `json:"timings,omitempty"`
+}
+
+// decisionTrace collects the stage decisions of one request as it goes
+// through the chain.
+type decisionTrace struct {
+	stages []StageDecision
+}
+
+// stage returns the named stage's entry, adding it if it hasn't run yet.
+func (t *decisionTrace) stage(name string) *StageDecision {
+	for i := len(t.stages) - 1; i >= 0; i-- {
+		if t.stages[i].Stage == name {
+			return &t.stages[i]
+		}
+	}
+	t.stages = append(t.stages, StageDecision{Stage: name})
+	return &t.stages[len(t.stages)-1]
+}
+
+// noteDecision records why a stage acted on a request in its decision log,
+// if one is being kept. An empty outcome leaves it to the request's flow.
+func noteDecision(ctx context.Context, stage, outcome, reason string, rules ...string) {
+	trace, ok := ctx.Value(decisionKey).(*decisionTrace)
+	if !ok {
+		return
+	}
+	s := trace.stage(stage)
+	if outcome != "" {
+		s.Outcome = outcome
+	}
+	if reason != "" {
+		s.Reason = reason
+	}
+	s.Rules = append(s.Rules, rules...)
+}
+
+// DecisionLogMiddleware publishes a decision log for every request, so the
+// enforcement rationale can be audited in one place rather than pieced
+// together from the log lines and audit events of each stage. It must run
+// first; the stages after it are wrapped with Stage to be recorded.
+type DecisionLogMiddleware struct {
+	sink    EventSink
+	topic   string
+	version atomic.Value // string
+}
+
+// NewDecisionLogMiddleware creates the decisions stage publishing to topic.
+func NewDecisionLogMiddleware(sink EventSink, topic, policyVersion string) *DecisionLogMiddleware {
+	m := &DecisionLogMiddleware{sink: sink, topic: topic}
+	m.version.Store(policyVersion)
+	return m
+}
+
+// SetPolicyVersion sets the policy version stamped on decision logs.
+func (m *DecisionLogMiddleware) SetPolicyVersion(version string) {
+	m.version.Store(version)
+}
+
+// Stage wraps a stage so its outcome is recorded: it passed the request if
+// it called the next handler, and otherwise refused or answered it.
+func (m *DecisionLogMiddleware) Stage(name string, stage func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		inner := stage(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if trace, ok := r.Context().Value(decisionKey).(*decisionTrace); ok {
+				if s := trace.stage(name); s.Outcome == "" {
+					s.Outcome = OutcomePass
+				}
+			}
+			next.ServeHTTP(w, r)
+		}))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if trace, ok := r.Context().Value(decisionKey).(*decisionTrace); ok {
+				trace.stage(name)
+			}
+			inner.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Handler returns the middleware handler
+func (m *DecisionLogMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r, rc := attachRequestContext(r)
+		trace := &decisionTrace{}
+		ww := &responseWriterWrapper{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), decisionKey, trace)))
+
+		entry := DecisionLog{
+			Timestamp:     start.UTC(),
+			TraceID:       pages.TraceID(r),
+			ClientIP:      rc.ClientIP,
+			Subject:       rc.Subject,
+			Tenant:        tenantName(r.Context()),
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			Status:        ww.statusCode,
+			Action:        "allow",
+			Stages:        trace.stages,
+			PolicyVersion: m.version.Load().(string),
+			Duration:      time.Since(start).Milliseconds(),
+			Timings:       rc.Timings,
+		}
+		if rc.Score != nil {
+			entry.RiskScore = &rc.Score.Value
+			entry.RiskDecision = rc.Score.Decision
+		}
+		// A stage that neither passed nor explained itself decided by its status
+		for i := range entry.Stages {
+			if s := &entry.Stages[i]; s.Outcome == "" {
+				s.Outcome = OutcomeDeny
+				if ww.statusCode < 400 {
+					s.Outcome = OutcomeResponse
+				}
+			}
+		}
+		for _, s := range entry.Stages {
+			switch {
+			case s.Outcome == OutcomeDeny:
+				entry.Action, entry.DecidedBy = OutcomeDeny, s.Stage
+			case s.Outcome == OutcomeResponse && entry.Action != OutcomeDeny:
+				entry.Action, entry.DecidedBy = OutcomeResponse, s.Stage
+			}
+		}
+
+		go m.publish(&entry)
+	})
+}
+
+// publish sends the decision log keyed by client IP for partition locality.
+func (m *DecisionLogMiddleware) publish(entry *DecisionLog) {
+	if err := publishJSON(m.sink, m.topic, entry.ClientIP, entry); err != nil {
+		log.Printf("[Decisions] Failed to publish decision log: %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+// FeatureAttribution is a single feature's contribution to a score (e.g. a SHAP value).
+type FeatureAttribution struct {
+	Feature string  `json:"feature"`
+	Value   float64 `json:"value"`
+}
+
+// DecisionRecord explains why a client received a non-allow decision.
+type DecisionRecord struct {
+	ClientIP    string               `json:"client_ip"`
+	Score       float64              `json:"score"`
+	Decision    Action               `json:"decision"`
+	Model       string               `json:"model,omitempty"`
+	Source      string               `json:"source,omitempty"`
+	TopFeatures []FeatureAttribution `json:"top_features,omitempty"`
+	DecidedAt   time.Time            `json:"decided_at"`
+}
+
+const (
+	decisionPrefix = "aegis:decisions:ip:"
+	// decisionHistory is how many records are kept per client, newest first
+	decisionHistory = 20
+	// decisionBuffer bounds the records waiting to be written; more are
+	// dropped rather than hold up requests while Redis is slow
+	decisionBuffer       = 1024
+	decisionWriteTimeout = 2 * time.Second
+	// decisionCloseTimeout bounds how long Close waits for queued records
+	decisionCloseTimeout = 5 * time.Second
+)
+
+var decisionWrites = metrics.NewCounterVec("aegis_decision_records_total",
+	"Decision records by outcome (stored, dropped or error).", "result")
+
+// DecisionStore keeps each client's latest decision records in Redis. Saves
+// are written in the background, so scoring never waits on Redis.
+type DecisionStore struct {
+	client  *redis.Client
+	ttl     time.Duration
+	records chan *DecisionRecord
+	done    chan struct{}
+	close   sync.Once
+}
+
+// NewDecisionStore creates a store whose records expire after ttl.
+func NewDecisionStore(client *redis.Client, ttl time.Duration) *DecisionStore {
+	d := &DecisionStore{
+		client:  client,
+		ttl:     ttl,
+		records: make(chan *DecisionRecord, decisionBuffer),
+		done:    make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// Save queues the record for aegis:decisions:ip:<IP>, dropping it if the
+// buffer is full.
+func (d *DecisionStore) Save(rec *DecisionRecord) {
+	select {
+	case d.records <- rec:
+	default:
+		decisionWrites.Inc("dropped")
+	}
+}
+
+// Close stops the writer once the queued records are written, waiting at
+// most decisionCloseTimeout for them.
+func (d *DecisionStore) Close() {
+	d.close.Do(func() { close(d.records) })
+	select {
+	case <-d.done:
+	case <-time.After(decisionCloseTimeout):
+		log.Printf("[Decisions] Gave up writing %d queued decisions", len(d.records))
+	}
+}
+
+func (d *DecisionStore) run() {
+	defer close(d.done)
+	for rec := range d.records {
+		ctx, cancel := context.WithTimeout(context.Background(), decisionWriteTimeout)
+		if err := d.write(ctx, rec); err != nil {
+			decisionWrites.Inc("error")
+			log.Printf("[Decisions] Failed to store decision for %s: %v", rec.ClientIP, err)
+		} else {
+			decisionWrites.Inc("stored")
+		}
+		cancel()
+	}
+}
+
+// write pushes the record onto the client's list, trimmed to the last
+// decisionHistory records.
+func (d *DecisionStore) write(ctx context.Context, rec *DecisionRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	key := decisionPrefix + rec.ClientIP
+	pipe := d.client.TxPipeline()
+	pipe.LPush(ctx, key, data)
+	pipe.LTrim(ctx, key, 0, decisionHistory-1)
+	pipe.Expire(ctx, key, d.ttl)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Get returns the latest record for a client, or nil if there is none.
+func (d *DecisionStore) Get(ctx context.Context, clientIP string) (*DecisionRecord, error) {
+	records, err := d.history(ctx, clientIP, 0)
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	return records[0], nil
+}
+
+// History returns a client's records, newest first.
+func (d *DecisionStore) History(ctx context.Context, clientIP string) ([]*DecisionRecord, error) {
+	return d.history(ctx, clientIP, decisionHistory-1)
+}
+
+func (d *DecisionStore) history(ctx context.Context, clientIP string, last int64) ([]*DecisionRecord, error) {
+	items, err := d.client.LRange(ctx, decisionPrefix+clientIP, 0, last).Result()
+	if err != nil {
+		return nil, err
+	}
+	records := make([]*DecisionRecord, 0, len(items))
+	for _, item := range items {
+		var rec DecisionRecord
+		if err := json.Unmarshal([]byte(item), &rec); err != nil {
+			return nil, err
+		}
+		records = append(records, &rec)
+	}
+	return records, nil
+}
+
+// topAttributions returns the n features with the largest absolute contribution.
+func topAttributions(attributions map[string]float64, n int) []FeatureAttribution {
+	if len(attributions) == 0 {
+		return nil
+	}
+
+	top := make([]FeatureAttribution, 0, len(attributions))
+	for feature, value := range attributions {
+		top = append(top, FeatureAttribution{Feature: feature, Value: value})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		return math.Abs(top[i].Value) > math.Abs(top[j].Value)
+	})
+
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
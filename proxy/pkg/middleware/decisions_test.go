@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestDecisionStore(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	store := NewDecisionStore(client, time.Hour)
+
+	for i := range decisionHistory + 5 {
+		store.Save(&DecisionRecord{ClientIP: "203.0.113.7", Score: float64(i), Decision: ActionChallenge})
+	}
+	store.Save(&DecisionRecord{ClientIP: "198.51.100.1", Score: 1, Decision: ActionTempBlock})
+	store.Close()
+
+	ctx := context.Background()
+	history, err := store.History(ctx, "203.0.113.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != decisionHistory {
+		t.Fatalf("history has %d records, want %d", len(history), decisionHistory)
+	}
+	if history[0].Score != decisionHistory+4 || history[decisionHistory-1].Score != 5 {
+		t.Errorf("history runs from %v to %v, want the newest first", history[0].Score, history[decisionHistory-1].Score)
+	}
+	latest, err := store.Get(ctx, "203.0.113.7")
+	if err != nil || latest == nil || latest.Score != decisionHistory+4 {
+		t.Errorf("Get = %v, %v, want the latest record", latest, err)
+	}
+	if ttl := mr.TTL(decisionPrefix + "203.0.113.7"); ttl != time.Hour {
+		t.Errorf("TTL = %s, want 1h", ttl)
+	}
+
+	other, err := store.Get(ctx, "198.51.100.1")
+	if err != nil || other == nil || other.Decision != ActionTempBlock {
+		t.Errorf("Get = %v, %v, want the other client's record", other, err)
+	}
+	none, err := store.Get(ctx, "192.0.2.1")
+	if err != nil || none != nil {
+		t.Errorf("Get = %v, %v, want nothing for an unknown client", none, err)
+	}
+}
+
+func TestDecisionStoreDoesNotBlock(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	store := NewDecisionStore(client, time.Hour)
+
+	// With Redis gone the writer falls behind; saves are dropped instead
+	mr.Close()
+	done := make(chan struct{})
+	go func() {
+		for range 2 * decisionBuffer {
+			store.Save(&DecisionRecord{ClientIP: "203.0.113.7"})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Save blocked with Redis down")
+	}
+}
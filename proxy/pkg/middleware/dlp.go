@@ -0,0 +1,305 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var dlpMatches = metrics.NewCounterVec("aegis_dlp_matches_total",
+	"Sensitive data found in responses, by pattern and action.", "pattern", "action")
+
+// DLP actions.
+const (
+	DLPMask  = "mask"  // Redact matches and deliver the response
+	DLPBlock = "block" // Replace the response with a 502
+	DLPAlert = "alert" // Deliver the response unchanged and report it
+)
+
+// DLPPattern is a kind of sensitive data to look for in responses.
+type DLPPattern struct {
+	Name    string
+	Pattern *regexp.Regexp
+	Valid   func(match []byte) bool // Optional check cutting false positives
+	Action  string
+}
+
+// BuiltinDLPPatterns are the patterns that can be enabled by name.
+var BuiltinDLPPatterns = map[string]DLPPattern{
+	"credit_card":  {Pattern: regexp.MustCompile(`\b(?:\d[ -]?){12,18}\d\b`), Valid: luhnValid},
+	"ssn":          {Pattern: regexp.MustCompile(`\b(?:00[1-9]|0[1-9]\d|[1-578]\d\d|6[0-57-9]\d|66[0-57-9])-(?:0[1-9]|[1-9]\d)-(?:000[1-9]|00[1-9]\d|0[1-9]\d\d|[1-9]\d{3})\b`)},
+	"aws_key":      {Pattern: regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	"github_token": {Pattern: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`)},
+	"slack_token":  {Pattern: regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}\b`)},
+	"private_key":  {Pattern: regexp.MustCompile(`-----BEGIN (?:RSA |EC |DSA |OPENSSH |ENCRYPTED )?PRIVATE KEY-----`)},
+}
+
+// DLPEvent is published to the DLP topic for every response with matches.
+// It carries counts, never the matched data.
+type DLPEvent struct {
+	Timestamp time.Time      `json:"timestamp"`
+	ClientIP  string         `json:"client_ip"`
+	Tenant    string         `json:"tenant,omitempty"`
+	RequestID string         `json:"request_id,omitempty"`
+	Subject   string         `json:"subject,omitempty"`
+	Method    string         `json:"method"`
+	Path      string         `json:"path"`
+	Status    int            `json:"status"`
+	Matches   map[string]int `json:"matches"` // By pattern
+	Action    string         `json:"action"`  // The strictest action taken
+}
+
+// DLPOptions configures the dlp stage.
+type DLPOptions struct {
+	Patterns []DLPPattern
+	MaxBody  int64  // Larger responses are delivered unscanned
+	Topic    string // Receives DLPEvents; empty disables
+	Auditor  *Auditor
+}
+
+// DLPMiddleware scans textual responses for sensitive data such as card
+// numbers and credentials, and masks, blocks or reports them.
+type DLPMiddleware struct {
+	sink EventSink
+	opts DLPOptions
+}
+
+// NewDLPMiddleware creates the dlp stage.
+func NewDLPMiddleware(sink EventSink, opts DLPOptions) *DLPMiddleware {
+	return &DLPMiddleware{sink: sink, opts: opts}
+}
+
+// Handler returns the middleware handler
+func (m *DLPMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Compressed responses can't be scanned
+		r.Header.Del("Accept-Encoding")
+
+		dw := &dlpWriter{ResponseWriter: w, max: m.opts.MaxBody}
+		next.ServeHTTP(dw, r)
+		if !dw.buffering {
+			return
+		}
+
+		body, matches, action := m.scan(dw.buf.Bytes())
+		if len(matches) > 0 {
+			m.report(r, dw.status, matches, action)
+		}
+		if action == DLPBlock {
+			for name := range w.Header() {
+				delete(w.Header(), name)
+			}
+			pages.WriteError(w, r, pages.ErrDLPBlocked)
+			return
+		}
+		if dw.Header().Get("Content-Length") != "" {
+			dw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		}
+		w.WriteHeader(dw.status)
+		w.Write(body)
+	})
+}
+
+// scan finds the patterns in body, masking those whose action is mask, and
+// returns the counts and the strictest action.
+func (m *DLPMiddleware) scan(body []byte) ([]byte, map[string]int, string) {
+	matches := make(map[string]int)
+	action := ""
+	for _, p := range m.opts.Patterns {
+		found := 0
+		body = p.Pattern.ReplaceAllFunc(body, func(match []byte) []byte {
+			if p.Valid != nil && !p.Valid(match) {
+				return match
+			}
+			found++
+			if p.Action == DLPMask {
+				return maskMatch(match)
+			}
+			return match
+		})
+		if found == 0 {
+			continue
+		}
+		matches[p.Name] = found
+		dlpMatches.Add(float64(found), p.Name, p.Action)
+		if action == "" || p.Action == DLPBlock || p.Action == DLPMask && action == DLPAlert {
+			action = p.Action
+		}
+	}
+	return body, matches, action
+}
+
+// maskMatch keeps the last four characters of longer matches, e.g. for
+// matching a card number with a customer, and hides the rest.
+func maskMatch(match []byte) []byte {
+	masked := bytes.Repeat([]byte("*"), len(match))
+	if len(match) >= 12 {
+		copy(masked[len(match)-4:], match[len(match)-4:])
+	}
+	return masked
+}
+
+// report logs, audits and publishes a response with matches.
+func (m *DLPMiddleware) report(r *http.Request, status int, matches map[string]int, action string) {
+	clientIP := clientIP(r)
+	names := make([]string, 0, len(matches))
+	for name := range matches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	logging.For(r.Context()).Warnf("[DLP] %s %s to %s: %s in response (%s)", r.Method, r.URL.Path, clientIP, strings.Join(names, ","), action)
+
+	if action == DLPBlock {
+		noteDecision(r.Context(), "dlp", OutcomeDeny, "", names...)
+		m.opts.Auditor.Record(AuditEvent{
+			ClientIP:  clientIP,
+			Subject:   subjectFromContext(r.Context()),
+			Tenant:    tenantName(r.Context()),
+			RequestID: logging.RequestID(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    http.StatusBadGateway,
+			Stage:     "dlp",
+			Reason:    strings.Join(names, ","),
+		})
+	}
+
+	if m.opts.Topic == "" {
+		return
+	}
+	data, err := json.Marshal(DLPEvent{
+		Timestamp: time.Now().UTC(),
+		ClientIP:  clientIP,
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Subject:   subjectFromContext(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    status,
+		Matches:   matches,
+		Action:    action,
+	})
+	if err != nil {
+		log.Printf("[DLP] Failed to marshal event: %v", err)
+		return
+	}
+	go func() {
+		if err := m.sink.Publish(m.opts.Topic, clientIP, data); err != nil {
+			log.Printf("[DLP] Failed to publish event: %v", err)
+		}
+	}()
+}
+
+// dlpWriter buffers scannable responses up to max bytes. Other responses,
+// and those that outgrow the buffer, pass through unscanned.
+type dlpWriter struct {
+	http.ResponseWriter
+	max       int64
+	status    int
+	buffering bool
+	buf       bytes.Buffer
+}
+
+func (w *dlpWriter) WriteHeader(code int) {
+	if w.status != 0 || code < 200 {
+		if code < 200 {
+			w.ResponseWriter.WriteHeader(code)
+		}
+		return
+	}
+	w.status = code
+	w.buffering = w.scannable(code)
+	if !w.buffering {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *dlpWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.buffering {
+		return w.ResponseWriter.Write(b)
+	}
+	if int64(w.buf.Len()+len(b)) > w.max {
+		// Too large to hold; deliver what we have and stream the rest
+		dlpMatches.Inc("unscanned", "oversized")
+		w.buffering = false
+		w.ResponseWriter.WriteHeader(w.status)
+		if _, err := w.ResponseWriter.Write(w.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		w.buf.Reset()
+		return w.ResponseWriter.Write(b)
+	}
+	return w.buf.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection; flushing a
+// buffered response has no effect until it is scanned.
+func (w *dlpWriter) Unwrap() http.ResponseWriter {
+	if w.buffering {
+		return nil
+	}
+	return w.ResponseWriter
+}
+
+// scannable reports whether a response is text small enough to buffer.
+func (w *dlpWriter) scannable(status int) bool {
+	if status == http.StatusNoContent || status == http.StatusNotModified || w.max <= 0 {
+		return false
+	}
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil && length > w.max {
+		return false
+	}
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	switch {
+	case mediaType == "text/event-stream":
+		return false
+	case strings.HasPrefix(mediaType, "text/"), strings.HasSuffix(mediaType, "json"),
+		strings.HasSuffix(mediaType, "xml"), mediaType == "application/javascript",
+		mediaType == "application/x-www-form-urlencoded":
+		return true
+	}
+	return false
+}
+
+// luhnValid checks the Luhn checksum of a candidate card number.
+func luhnValid(match []byte) bool {
+	sum, digits := 0, 0
+	for i := len(match) - 1; i >= 0; i-- {
+		c := match[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if digits%2 == 1 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		digits++
+	}
+	return digits >= 13 && digits <= 19 && sum%10 == 0
+}
@@ -0,0 +1,10 @@
+// Package middleware holds the proxy's enforcement stages: JWT
+// verification, blocklists, risk scoring and the other stages STAGES
+// enables, each an http.Handler wrapper, with the Stage interface and
+// registry for adding stages of one's own.
+//
+// Like package flow, it is part of the proxy's public API, so Go services
+// can run the same enforcement in-process, in front of their own handlers.
+// Exported names change only in backward-compatible ways; behavior follows
+// the proxy's documented configuration.
+package middleware
@@ -0,0 +1,275 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/geoip"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var (
+	guardrailSpared = metrics.NewCounterVec("aegis_guardrail_spared_total",
+		"Blocks not carried out because the client's network or subject is allowlisted, by stage.", "stage")
+	guardrailCapped = metrics.NewCounterVec("aegis_guardrail_capped_total",
+		"New blocks not carried out because the blocked clients cap is reached, by stage.", "stage")
+	guardrailBlockedPercent = metrics.NewGaugeVec("aegis_guardrail_blocked_clients_percent",
+		"Share of the fleet's unique client networks blocked in the guardrail window, in percent.")
+)
+
+// GuardrailBlockedClients trips when too many of the unique client networks
+// seen in the window were blocked.
+const GuardrailBlockedClients = "blocked_clients"
+
+// Redis key prefixes of the HyperLogLogs counting unique client networks and
+// blocked ones, by the start of their bucket.
+const (
+	guardClientsPrefix = "aegis:guardrail:clients:"
+	guardBlockedPrefix = "aegis:guardrail:blocked:"
+)
+
+// guardBuckets divides the window, so it slides a bucket at a time.
+const guardBuckets = 60
+
+// EnforcementGuardOptions configures the caps on automated enforcement.
+type EnforcementGuardOptions struct {
+	// MaxBlockedPercent trips the blocked_clients guardrail when more of the
+	// unique client networks in Window were blocked; 0 disables it
+	MaxBlockedPercent float64
+	Window            time.Duration
+	// MinClients is the fewest unique client networks the percentage is
+	// checked at, so a handful of scanners can't trip it on a quiet night
+	MinClients int
+
+	AllowASNs     []uint32
+	AllowSubjects []string
+	GeoIP         *geoip.DB // With ASN blocks; required by AllowASNs
+}
+
+// EnforcementGuard caps automated enforcement: clients from allowlisted
+// networks and allowlisted subjects are never blocked, whatever the model,
+// the verdicts or the blocklist say, and the fleet's share of blocked
+// clients is watched through HyperLogLogs in Redis. Clients are counted by
+// network, a /24 or /48, so an attacker needs real networks, not addresses,
+// to move the share. Once it's over the cap, new blocks are held until it
+// falls back; blocks already made are still enforced. The stages that block
+// consult it; a nil guard spares no one.
+type EnforcementGuard struct {
+	client   *redis.Client
+	alerts   *GuardrailAlerts
+	opts     EnforcementGuardOptions
+	asns     map[uint32]bool
+	subjects map[string]bool
+
+	// Client networks seen and blocked since the last flush
+	mu      sync.Mutex
+	seen    map[string]struct{}
+	blocked map[string]struct{}
+
+	capped atomic.Bool // The blocked_clients guardrail is tripped
+}
+
+// NewEnforcementGuard creates the guard; start it with Run when
+// MaxBlockedPercent is set.
+func NewEnforcementGuard(client *redis.Client, alerts *GuardrailAlerts, opts EnforcementGuardOptions) *EnforcementGuard {
+	g := &EnforcementGuard{
+		client:   client,
+		alerts:   alerts,
+		opts:     opts,
+		asns:     make(map[uint32]bool),
+		subjects: make(map[string]bool),
+		seen:     make(map[string]struct{}),
+		blocked:  make(map[string]struct{}),
+	}
+	for _, asn := range opts.AllowASNs {
+		g.asns[asn] = true
+	}
+	for _, subject := range opts.AllowSubjects {
+		g.subjects[subject] = true
+	}
+	return g
+}
+
+// Handler counts every client's network towards the unique clients of the
+// window. It wraps the whole chain, so clients refused by any stage are
+// counted.
+func (g *EnforcementGuard) Handler(next http.Handler) http.Handler {
+	if g.opts.MaxBlockedPercent <= 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		network := clientNetwork(clientIP(r))
+		g.mu.Lock()
+		g.seen[network] = struct{}{}
+		g.mu.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// spares reports whether a block of the client by stage must not be carried
+// out. Blocks that go ahead are counted towards the blocked clients.
+func (g *EnforcementGuard) spares(ctx context.Context, clientIP, stage string) bool {
+	if g == nil {
+		return false
+	}
+	if reason := g.allowlisted(ctx, clientIP); reason != "" {
+		guardrailSpared.Inc(stage)
+		logging.For(ctx).Infof("[Guardrail] Not blocking %s in %s: %s is allowlisted", clientIP, stage, reason)
+		return true
+	}
+	g.noteBlocked(clientIP)
+	return false
+}
+
+// holds reports whether a new block of the client by stage, such as an
+// action or a honeypot hit writing to the blocklist, must not be made
+// because the blocked clients cap is reached. Blocks that go ahead are
+// counted towards the blocked clients.
+func (g *EnforcementGuard) holds(ctx context.Context, clientIP, stage string) bool {
+	if g == nil {
+		return false
+	}
+	if g.capped.Load() {
+		guardrailCapped.Inc(stage)
+		logging.For(ctx).Infof("[Guardrail] Not blocking %s in %s: the blocked clients cap is reached", clientIP, stage)
+		return true
+	}
+	g.noteBlocked(clientIP)
+	return false
+}
+
+func (g *EnforcementGuard) noteBlocked(clientIP string) {
+	if g.opts.MaxBlockedPercent <= 0 {
+		return
+	}
+	network := clientNetwork(clientIP)
+	g.mu.Lock()
+	g.blocked[network] = struct{}{}
+	g.mu.Unlock()
+}
+
+// clientNetwork returns the /24 or /48 of a client address, the unit the
+// guard counts, so one network rotating addresses counts once.
+func clientNetwork(clientIP string) string {
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return clientIP
+	}
+	addr = addr.Unmap()
+	bits := 48
+	if addr.Is4() {
+		bits = 24
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+// allowlisted names what allowlists the request's subject or the client's
+// network, if anything does.
+func (g *EnforcementGuard) allowlisted(ctx context.Context, clientIP string) string {
+	if subject := subjectFromContext(ctx); subject != "" && g.subjects[subject] {
+		return "subject " + subject
+	}
+	if len(g.asns) == 0 || g.opts.GeoIP == nil {
+		return ""
+	}
+	addr, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return ""
+	}
+	if rec, ok := g.opts.GeoIP.Lookup(addr); ok && g.asns[rec.ASN] {
+		return "AS" + strconv.FormatUint(uint64(rec.ASN), 10)
+	}
+	return ""
+}
+
+// Run adds the networks seen and blocked to the fleet's counts and checks
+// the blocked share every bucket, or every 10s if sooner, until ctx is done.
+func (g *EnforcementGuard) Run(ctx context.Context) {
+	interval := min(g.bucket(), 10*time.Second)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := g.check(ctx, time.Now()); err != nil {
+			log.Printf("[Guardrail] Failed to count blocked clients: %v", err)
+		}
+	}
+}
+
+func (g *EnforcementGuard) bucket() time.Duration {
+	return max(g.opts.Window/guardBuckets, time.Second)
+}
+
+// check flushes the local counts into the current bucket, then counts the
+// unique and blocked networks across the window's buckets, capping new
+// blocks while the share is over the cap.
+func (g *EnforcementGuard) check(ctx context.Context, now time.Time) error {
+	g.mu.Lock()
+	seen, blocked := g.seen, g.blocked
+	g.seen, g.blocked = make(map[string]struct{}), make(map[string]struct{})
+	g.mu.Unlock()
+
+	bucket := g.bucket()
+	start := now.Truncate(bucket)
+	pipe := g.client.Pipeline()
+	for prefix, clients := range map[string]map[string]struct{}{guardClientsPrefix: seen, guardBlockedPrefix: blocked} {
+		if len(clients) == 0 {
+			continue
+		}
+		members := make([]interface{}, 0, len(clients))
+		for ip := range clients {
+			members = append(members, ip)
+		}
+		key := prefix + strconv.FormatInt(start.Unix(), 10)
+		pipe.PFAdd(ctx, key, members...)
+		pipe.Expire(ctx, key, g.opts.Window+bucket)
+	}
+	clientKeys := make([]string, 0, guardBuckets)
+	blockedKeys := make([]string, 0, guardBuckets)
+	for t := start; t.After(now.Add(-g.opts.Window)); t = t.Add(-bucket) {
+		suffix := strconv.FormatInt(t.Unix(), 10)
+		clientKeys = append(clientKeys, guardClientsPrefix+suffix)
+		blockedKeys = append(blockedKeys, guardBlockedPrefix+suffix)
+	}
+	clients := pipe.PFCount(ctx, clientKeys...)
+	blockedCount := pipe.PFCount(ctx, blockedKeys...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	total, refused := clients.Val(), blockedCount.Val()
+	if total == 0 {
+		guardrailBlockedPercent.Set(0)
+		g.capped.Store(false)
+		return nil
+	}
+	percent := 100 * float64(min(refused, total)) / float64(total)
+	guardrailBlockedPercent.Set(percent)
+	tripped := total >= int64(g.opts.MinClients) && percent > g.opts.MaxBlockedPercent
+	if g.capped.Swap(tripped) != tripped {
+		log.Printf("[Guardrail] New blocks held: %t", tripped)
+	}
+	g.alerts.Check(ctx, GuardrailBlockedClients, tripped, GuardrailEvent{
+		Guardrail: GuardrailBlockedClients,
+		Summary:   fmt.Sprintf("%d of %d client networks (%.1f%%) blocked in the last %s, over the cap of %g%%; new blocks are held", refused, total, percent, g.opts.Window, g.opts.MaxBlockedPercent),
+		Observed:  percent,
+		Limit:     g.opts.MaxBlockedPercent,
+		Window:    g.opts.Window.String(),
+	}, g.opts.Window)
+	return nil
+}
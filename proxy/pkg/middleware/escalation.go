@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var blockEscalations = metrics.NewCounterVec("aegis_block_escalations_total",
+	"Blocks given an escalating duration, by action and step of its ladder.", "action", "step")
+
+// Action types with their own escalation ladder. Blocks written to the
+// blocklist by the AI engine, or anything else outside the proxy, are
+// ActionTypeAIEngine.
+const (
+	ActionTypeTempBlock = "temp_block"
+	ActionTypeHoneypot  = "honeypot"
+	ActionTypeAIEngine  = "ai_engine"
+)
+
+// Redis key prefixes of a client's offense count and of the deadline of its
+// current escalated block, under the tenant's prefix.
+const (
+	offensesPrefix  = "aegis:offenses:"
+	escalatedPrefix = "aegis:escalated:"
+)
+
+// escalateScript counts an offense and gives the block the duration of the
+// ladder's step for it. KEYS are the block, its deadline and the offense
+// count; ARGV the decay in ms, the value to block with and the ladder in ms.
+// Without a value it adopts an existing block: permanent blocks are left
+// alone, and a block already escalated, then rewritten with a shorter TTL
+// (the AI engine re-blocking), is held until its deadline. It returns the
+// TTL in ms and step of a counted offense, or else the block's PTTL.
+var escalateScript = redis.NewScript(`
+if ARGV[2] == '' then
+	local pttl = redis.call('PTTL', KEYS[1])
+	if pttl < 0 then
+		return pttl
+	end
+	local deadline = redis.call('PTTL', KEYS[2])
+	if deadline > 0 then
+		if pttl < deadline then
+			redis.call('PEXPIRE', KEYS[1], deadline)
+			return deadline
+		end
+		return pttl
+	end
+end
+local n = redis.call('INCR', KEYS[3])
+local steps = #ARGV - 2
+local ttl = tonumber(ARGV[math.min(n, steps) + 2])
+if ARGV[2] == '' then
+	redis.call('PEXPIRE', KEYS[1], ttl)
+else
+	redis.call('SET', KEYS[1], ARGV[2], 'PX', ttl)
+end
+redis.call('SET', KEYS[2], n, 'PX', ttl)
+local decay = ttl + tonumber(ARGV[1])
+if redis.call('PTTL', KEYS[3]) < decay then
+	redis.call('PEXPIRE', KEYS[3], decay)
+end
+return {ttl, math.min(n, steps)}
+`)
+
+// BlockEscalationOptions configures escalating block durations.
+type BlockEscalationOptions struct {
+	// Steps is the default ladder: a client's first offense is blocked for
+	// the first step, the second for the second, and so on, the last step
+	// repeating, e.g. 5m, 1h, 24h
+	Steps []time.Duration
+	// Actions overrides the ladder by action type
+	Actions map[string][]time.Duration
+	// Decay forgets a client's offenses once this long has passed since
+	// its last block ended
+	Decay time.Duration
+}
+
+// BlockEscalation lengthens the blocks of repeat offenders. Offenses are
+// counted per client in Redis, so every replica and the AI engine's blocks
+// share the count. A nil escalation leaves block durations as they are.
+type BlockEscalation struct {
+	client *redis.Client
+	opts   BlockEscalationOptions
+	decay  string
+}
+
+// NewBlockEscalation creates the escalation of block durations.
+func NewBlockEscalation(client *redis.Client, opts BlockEscalationOptions) *BlockEscalation {
+	return &BlockEscalation{client: client, opts: opts, decay: strconv.FormatInt(opts.Decay.Milliseconds(), 10)}
+}
+
+// ladder returns the steps of an action type.
+func (e *BlockEscalation) ladder(action string) []time.Duration {
+	if steps, ok := e.opts.Actions[action]; ok {
+		return steps
+	}
+	return e.opts.Steps
+}
+
+// block blocklists the client like addToBlocklist, for the step of the
+// action's ladder its offenses have reached. A nil escalation blocks for
+// ttl; permanent blocks aren't escalated.
+func (e *BlockEscalation) block(ctx context.Context, client *redis.Client, recent *RecentBlocks, clientIP, action, reason string, ttl time.Duration) error {
+	if e == nil || ttl == 0 {
+		return addToBlocklist(ctx, client, recent, clientIP, reason, ttl)
+	}
+	prefix := tenantKeyPrefix(ctx)
+	key := prefix + blocklistPrefix + clientIP
+	escalated, err := e.escalate(ctx, prefix, clientIP, action, blockValue(reason))
+	if err != nil {
+		recent.blocked(key, ttl)
+		return err
+	}
+	recent.blocked(key, escalated)
+	return nil
+}
+
+// adopt escalates a block under the key prefix (a tenant's or none) that
+// the proxy found in the blocklist but didn't write, returning its TTL; a
+// block escalated before keeps its deadline. It returns 0 for permanent
+// blocks and blocks that expired meanwhile.
+func (e *BlockEscalation) adopt(ctx context.Context, prefix, clientIP string) (time.Duration, error) {
+	if e == nil {
+		return 0, nil
+	}
+	return e.escalate(ctx, prefix, clientIP, ActionTypeAIEngine, "")
+}
+
+// hold marks a block made by an operator as escalated already, so its
+// duration is kept.
+func (e *BlockEscalation) hold(ctx context.Context, clientIP string, ttl time.Duration) error {
+	if e == nil || ttl == 0 {
+		return nil
+	}
+	return e.client.Set(ctx, tenantKeyPrefix(ctx)+escalatedPrefix+clientIP, "manual", ttl).Err()
+}
+
+// release forgets the deadline of an unblocked client's block, so a new
+// block is counted as a new offense. The count itself still decays.
+func (e *BlockEscalation) release(ctx context.Context, clientIP string) error {
+	if e == nil {
+		return nil
+	}
+	return e.client.Del(ctx, tenantKeyPrefix(ctx)+escalatedPrefix+clientIP).Err()
+}
+
+func (e *BlockEscalation) escalate(ctx context.Context, prefix, clientIP, action, value string) (time.Duration, error) {
+	steps := e.ladder(action)
+	args := make([]interface{}, 0, len(steps)+2)
+	args = append(args, e.decay, value)
+	for _, step := range steps {
+		args = append(args, step.Milliseconds())
+	}
+	result, err := escalateScript.Run(ctx, e.client, []string{prefix + blocklistPrefix + clientIP, prefix + escalatedPrefix + clientIP, prefix + offensesPrefix + clientIP}, args...).Result()
+	if err != nil {
+		return 0, err
+	}
+	switch v := result.(type) {
+	case int64:
+		// Permanent, expired or escalated before
+		return time.Duration(max(v, 0)) * time.Millisecond, nil
+	case []interface{}:
+		ttl, _ := v[0].(int64)
+		step, _ := v[1].(int64)
+		blockEscalations.Inc(action, strconv.FormatInt(step, 10))
+		return time.Duration(ttl) * time.Millisecond, nil
+	}
+	return 0, nil
+}
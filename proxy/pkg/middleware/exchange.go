@@ -0,0 +1,218 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var tokenExchanges = metrics.NewCounterVec("aegis_token_exchanges_total",
+	"Inbound tokens exchanged for internal ones, by result: exchanged, cached, rejected by the IdP or failed.", "result")
+
+// OAuth 2.0 Token Exchange (RFC 8693) parameters.
+const (
+	grantTokenExchange   = "urn:ietf:params:oauth:grant-type:token-exchange"
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// errNotBearer refuses Authorization headers that aren't a single bearer
+// token, which can't be exchanged.
+var errNotBearer = errors.New("authorization header is not a single bearer token")
+
+const (
+	// exchangeCacheSize bounds the exchanged tokens kept; expired ones are
+	// dropped when it is reached, and the cache is emptied if none were.
+	exchangeCacheSize = 10000
+	// exchangeExpiryMargin is how long before expiry an exchanged token
+	// stops being reused, so it doesn't expire on its way upstream.
+	exchangeExpiryMargin = 30 * time.Second
+)
+
+// TokenExchangeOptions configures the exchange stage.
+type TokenExchangeOptions struct {
+	// URL is the IdP's token endpoint, which the proxy authenticates to
+	// with ClientID and ClientSecret
+	URL          string
+	ClientID     string
+	ClientSecret string
+	// Audience and Scope narrow the internal token; a route's
+	// token_audience replaces Audience
+	Audience string
+	Scope    string
+	Timeout  time.Duration
+	Routes   *RoutePolicies // nil without the routes stage
+	Auditor  *Auditor
+}
+
+// TokenExchangeMiddleware swaps the client's bearer token for a narrower,
+// audience-scoped one from the IdP before the request is forwarded, so
+// upstreams never see the client's original token. Exchanged tokens are
+// cached until shortly before they expire. A token that can't be exchanged
+// is never forwarded as is: requests are refused instead.
+type TokenExchangeMiddleware struct {
+	opts   TokenExchangeOptions
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]exchangedToken // By inbound token hash and audience
+}
+
+type exchangedToken struct {
+	token   string
+	expires time.Time
+}
+
+// NewTokenExchangeMiddleware creates the exchange stage.
+func NewTokenExchangeMiddleware(opts TokenExchangeOptions) *TokenExchangeMiddleware {
+	return &TokenExchangeMiddleware{
+		opts:   opts,
+		client: &http.Client{Timeout: opts.Timeout},
+		cache:  make(map[string]exchangedToken),
+	}
+}
+
+// Handler returns the middleware handler
+func (m *TokenExchangeMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Routes without auth carry no token; the jwt stage refuses
+		// missing tokens elsewhere
+		values := r.Header.Values("Authorization")
+		if len(values) == 0 || len(values) == 1 && values[0] == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// The scheme is case-insensitive, as in the jwt stage; anything
+		// else would be forwarded as is
+		scheme, token, _ := strings.Cut(values[0], " ")
+		if len(values) > 1 || !strings.EqualFold(scheme, "bearer") || token == "" {
+			m.refuse(w, r, errNotBearer)
+			return
+		}
+		audience := m.opts.Audience
+		if m.opts.Routes != nil {
+			if p := m.opts.Routes.Match(r.URL.Path); p != nil && p.TokenAudience != "" {
+				audience = p.TokenAudience
+			}
+		}
+
+		internal, err := m.token(r.Context(), token, audience)
+		if err != nil {
+			logging.For(r.Context()).Warnf("[Exchange] Token exchange for %s %s from %s failed: %v", r.Method, r.URL.Path, clientIP(r), err)
+			m.refuse(w, r, err)
+			return
+		}
+		r.Header.Set("Authorization", "Bearer "+internal)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refuse answers a request whose token wasn't exchanged: 401 when the token
+// is unusable, 503 when the IdP couldn't be asked.
+func (m *TokenExchangeMiddleware) refuse(w http.ResponseWriter, r *http.Request, err error) {
+	status, page := http.StatusServiceUnavailable, pages.ErrUnavailable
+	switch {
+	case errors.Is(err, errNotBearer):
+		status, page = http.StatusUnauthorized, pages.ErrTokenMalformed
+		bearerChallenge(w, bearerInvalidRequest, "The Authorization header is not a bearer token")
+	case errors.Is(err, errTokenRejected):
+		status, page = http.StatusUnauthorized, pages.ErrTokenInvalid
+		bearerChallenge(w, bearerInvalidToken, "The access token was refused")
+	}
+	noteDecision(r.Context(), "exchange", OutcomeDeny, err.Error())
+	m.opts.Auditor.Record(AuditEvent{
+		ClientIP:  clientIP(r),
+		Subject:   subjectFromContext(r.Context()),
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    status,
+		Stage:     "exchange",
+		Reason:    err.Error(),
+	})
+	pages.WriteError(w, r, page.Wrap(err))
+}
+
+// token returns the internal token for an inbound one and an audience,
+// from the cache or the IdP.
+func (m *TokenExchangeMiddleware) token(ctx context.Context, inbound, audience string) (string, error) {
+	sum := sha256.Sum256([]byte(inbound))
+	key := hex.EncodeToString(sum[:]) + " " + audience
+	now := time.Now()
+
+	m.mu.Lock()
+	cached, ok := m.cache[key]
+	m.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		tokenExchanges.Inc("cached")
+		return cached.token, nil
+	}
+
+	resp, err := m.exchange(ctx, inbound, audience)
+	if err != nil {
+		if errors.Is(err, errTokenRejected) {
+			tokenExchanges.Inc("rejected")
+		} else {
+			tokenExchanges.Inc("failed")
+		}
+		return "", err
+	}
+	tokenExchanges.Inc("exchanged")
+
+	// Tokens without a lifetime are exchanged again on every request
+	expires := now.Add(time.Duration(resp.ExpiresIn) * time.Second)
+	if exp, ok := claimsFromContext(ctx)["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(expires) {
+		// Never outlive the token it was exchanged for
+		expires = time.Unix(int64(exp), 0)
+	}
+	expires = expires.Add(-exchangeExpiryMargin)
+	if expires.After(now) {
+		m.mu.Lock()
+		if len(m.cache) >= exchangeCacheSize {
+			m.sweep(now)
+		}
+		m.cache[key] = exchangedToken{token: resp.AccessToken, expires: expires}
+		m.mu.Unlock()
+	}
+	return resp.AccessToken, nil
+}
+
+// exchange asks the IdP for a token for audience in place of inbound.
+func (m *TokenExchangeMiddleware) exchange(ctx context.Context, inbound, audience string) (*tokenResponse, error) {
+	form := url.Values{
+		"grant_type":           {grantTokenExchange},
+		"subject_token":        {inbound},
+		"subject_token_type":   {tokenTypeAccessToken},
+		"requested_token_type": {tokenTypeAccessToken},
+	}
+	if audience != "" {
+		form.Set("audience", audience)
+	}
+	if m.opts.Scope != "" {
+		form.Set("scope", m.opts.Scope)
+	}
+	return requestToken(ctx, m.client, m.opts.URL, m.opts.ClientID, m.opts.ClientSecret, form)
+}
+
+// sweep drops expired tokens, or all of them if none were. Callers must
+// hold the lock.
+func (m *TokenExchangeMiddleware) sweep(now time.Time) {
+	for key, cached := range m.cache {
+		if !now.Before(cached.expires) {
+			delete(m.cache, key)
+		}
+	}
+	if len(m.cache) >= exchangeCacheSize {
+		clear(m.cache)
+	}
+}
@@ -0,0 +1,54 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenExchangeSchemes(t *testing.T) {
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "internal-" + r.FormValue("subject_token"), ExpiresIn: 300})
+	}))
+	defer idp.Close()
+	exchange := NewTokenExchangeMiddleware(TokenExchangeOptions{URL: idp.URL, ClientID: "proxy", Timeout: time.Second})
+
+	var forwarded []string
+	h := exchange.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Values("Authorization")
+	}))
+
+	tests := []struct {
+		name          string
+		authorization []string
+		status        int
+		forwarded     []string
+	}{
+		{"no header", nil, http.StatusOK, nil},
+		{"bearer", []string{"Bearer broad"}, http.StatusOK, []string{"Bearer internal-broad"}},
+		{"lowercase scheme", []string{"bearer broad"}, http.StatusOK, []string{"Bearer internal-broad"}},
+		{"uppercase scheme", []string{"BEARER broad"}, http.StatusOK, []string{"Bearer internal-broad"}},
+		{"other scheme", []string{"Basic cHJveHk6c2VjcmV0"}, http.StatusUnauthorized, nil},
+		{"no token", []string{"Bearer"}, http.StatusUnauthorized, nil},
+		{"two headers", []string{"Bearer broad", "Bearer other"}, http.StatusUnauthorized, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forwarded = nil
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, value := range tt.authorization {
+				r.Header.Add("Authorization", value)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if len(forwarded) != len(tt.forwarded) || len(forwarded) > 0 && forwarded[0] != tt.forwarded[0] {
+				t.Errorf("forwarded Authorization = %q, want %q", forwarded, tt.forwarded)
+			}
+		})
+	}
+}
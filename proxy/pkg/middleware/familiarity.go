@@ -0,0 +1,223 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/geoip"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var unfamiliarAccess = metrics.NewCounterVec("aegis_unfamiliar_access_total",
+	"Requests from a certificate, user agent family or ASN new to their subject, by signal.", "signal")
+
+const familiarityPrefix = "aegis:seen:"
+
+// Familiarity is what about a request its subject hasn't been seen with
+// before. A subject's first request is new in every way and flags none.
+type Familiarity struct {
+	FirstSeen       bool   `json:"first_seen,omitempty"`
+	NewCertificate  bool   `json:"new_certificate,omitempty"`
+	NewUserAgent    bool   `json:"new_user_agent,omitempty"`
+	NewASN          bool   `json:"new_asn,omitempty"`
+	NewCombination  bool   `json:"new_combination,omitempty"`
+	UserAgentFamily string `json:"user_agent_family"`
+	ASN             uint32 `json:"asn,omitempty"`
+}
+
+// Unfamiliar reports whether anything about the request was new.
+func (f *Familiarity) Unfamiliar() bool {
+	return f != nil && (f.NewDevice() || f.NewASN || f.NewCombination)
+}
+
+// NewDevice reports whether the certificate or user agent family is new.
+func (f *Familiarity) NewDevice() bool {
+	return f.NewCertificate || f.NewUserAgent
+}
+
+// FamiliarityOptions configures unfamiliar-access detection.
+type FamiliarityOptions struct {
+	GeoIP   *geoip.DB     // With ASN blocks; nil leaves networks out
+	History time.Duration // Kept after a subject's last request
+	// Action is carried out on unfamiliar access: a new device or network
+	// with StepUpOnAny, else a new device on a new network. ActionLogOnly
+	// only flags it.
+	Action      Action
+	StepUpOnAny bool
+	Responder   *Responder
+	KillSwitch  *KillSwitch // Suspends Action while engaged, if set
+}
+
+// FamiliarityMiddleware keeps each subject's client certificates, user
+// agent families and ASNs in Redis and flags requests that bring a new one,
+// the zero-trust "unfamiliar access" signal: a token replayed from another
+// machine or network looks like its owner in every other way.
+type FamiliarityMiddleware struct {
+	client  *redis.Client
+	opts    FamiliarityOptions
+	auditor *Auditor
+}
+
+// NewFamiliarityMiddleware creates the familiarity stage.
+func NewFamiliarityMiddleware(client *redis.Client, opts FamiliarityOptions, auditor *Auditor) *FamiliarityMiddleware {
+	return &FamiliarityMiddleware{client: client, opts: opts, auditor: auditor}
+}
+
+// Handler returns the middleware handler
+func (m *FamiliarityMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject := subjectFromContext(r.Context())
+		if subject == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		f, err := m.observe(r)
+		if err != nil {
+			logging.For(r.Context()).Warnf("[Familiarity] Failed to check %s: %v", subject, err)
+			next.ServeHTTP(w, r)
+			return
+		}
+		setFamiliarity(r.Context(), f)
+
+		var signals []string
+		if f.NewCertificate {
+			signals = append(signals, "certificate")
+		}
+		if f.NewUserAgent {
+			signals = append(signals, "user_agent")
+		}
+		if f.NewASN {
+			signals = append(signals, "asn")
+		}
+		for _, signal := range signals {
+			unfamiliarAccess.Inc(signal)
+		}
+		unfamiliar := f.NewDevice() && f.NewASN || m.opts.StepUpOnAny && len(signals) > 0
+		if !unfamiliar {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		reason := "unfamiliar " + strings.Join(signals, ", ")
+		enforce := m.opts.Action != ActionLogOnly
+		if enforce && !m.opts.KillSwitch.enforcing() {
+			// Audited as it would have been carried out
+			reason += "; would " + string(m.opts.Action)
+			enforce = false
+		}
+		logging.For(r.Context()).Infof("[Familiarity] %s from %s: %s (%s)", subject, clientIP(r), reason, f.UserAgentFamily)
+		noteDecision(r.Context(), "familiarity", "", reason)
+		m.auditor.Record(AuditEvent{
+			ClientIP:  clientIP(r),
+			Subject:   subject,
+			Tenant:    tenantName(r.Context()),
+			RequestID: logging.RequestID(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Stage:     "familiarity",
+			Reason:    reason,
+		})
+		if enforce && m.opts.Responder.Execute(w, r, clientIP(r), m.opts.Action) {
+			noteDecision(r.Context(), "familiarity", OutcomeDeny, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// observe adds the request's certificate, user agent family and ASN to its
+// subject's history and reports which were new.
+func (m *FamiliarityMiddleware) observe(r *http.Request) (*Familiarity, error) {
+	f := &Familiarity{UserAgentFamily: userAgentFamily(r.UserAgent())}
+	var fingerprint string
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		fingerprint = hex.EncodeToString(sum[:])
+	}
+	if addr, err := netip.ParseAddr(clientIP(r)); err == nil && m.opts.GeoIP != nil {
+		if rec, ok := m.opts.GeoIP.Lookup(addr); ok {
+			f.ASN = rec.ASN
+		}
+	}
+	asn := ""
+	if f.ASN != 0 {
+		asn = strconv.FormatUint(uint64(f.ASN), 10)
+	}
+
+	key := familiarityPrefix + identityKey(r, true)
+	var known *redis.IntCmd
+	var added [4]*redis.IntCmd
+	_, err := m.client.Pipelined(r.Context(), func(pipe redis.Pipeliner) error {
+		known = pipe.Exists(r.Context(), key+":combo")
+		for i, set := range [...]struct{ name, member string }{
+			{"cert", fingerprint}, {"ua", f.UserAgentFamily}, {"asn", asn},
+			{"combo", fingerprint + "|" + f.UserAgentFamily + "|" + asn},
+		} {
+			if set.member == "" {
+				continue
+			}
+			added[i] = pipe.SAdd(r.Context(), key+":"+set.name, set.member)
+			pipe.Expire(r.Context(), key+":"+set.name, m.opts.History)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if known.Val() == 0 {
+		f.FirstSeen = true
+		return f, nil
+	}
+	f.NewCertificate = isNew(added[0])
+	f.NewUserAgent = isNew(added[1])
+	f.NewASN = isNew(added[2])
+	f.NewCombination = isNew(added[3])
+	return f, nil
+}
+
+// isNew reports whether an SADD added its member.
+func isNew(cmd *redis.IntCmd) bool {
+	return cmd != nil && cmd.Val() > 0
+}
+
+// userAgentFamily reduces a User-Agent to its browser or client and
+// platform, leaving out versions so upgrades aren't new devices.
+func userAgentFamily(ua string) string {
+	if ua == "" {
+		return "none"
+	}
+	client := ""
+	for _, browser := range [...]struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	} {
+		if strings.Contains(ua, browser.token) {
+			client = browser.name
+			break
+		}
+	}
+	if client == "" {
+		// Non-browser clients lead with their product, e.g. curl/8.4.0
+		product, _, _ := strings.Cut(ua, "/")
+		product, _, _ = strings.Cut(product, " ")
+		return product
+	}
+
+	for _, platform := range [...]struct{ token, name string }{
+		{"iPhone", "iOS"}, {"iPad", "iOS"}, {"Android", "Android"},
+		{"Windows", "Windows"}, {"Macintosh", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, platform.token) {
+			return client + " on " + platform.name
+		}
+	}
+	return client
+}
@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var (
+	guardrailTrips = metrics.NewCounterVec("aegis_guardrail_trips_total",
+		"Guardrails on automated enforcement that tripped on this replica, by guardrail.", "guardrail")
+	guardrailTripped = metrics.NewGaugeVec("aegis_guardrail_tripped",
+		"1 while a guardrail is tripped on this replica, by guardrail.", "guardrail")
+)
+
+// guardrailAlertPrefix keys the Redis lock that lets one replica alert for
+// the fleet.
+const guardrailAlertPrefix = "aegis:guardrail:alert:"
+
+// GuardrailEvent reports a guardrail on automated enforcement tripping,
+// e.g. the AI engine blocking far more clients than usual.
+type GuardrailEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Guardrail string    `json:"guardrail"`
+	Summary   string    `json:"summary"`
+	Observed  float64   `json:"observed"`
+	Limit     float64   `json:"limit"`
+	Window    string    `json:"window,omitempty"`
+	Node      string    `json:"node,omitempty"`     // Replica that noticed
+	Reverted  bool      `json:"reverted,omitempty"` // The kill switch was engaged
+}
+
+// GuardrailAlerts logs guardrail trips and passes them to subscribers, such
+// as webhooks. Every replica watches the same shared state, so a Redis lock
+// lets only the first to notice a trip alert for it.
+type GuardrailAlerts struct {
+	client    *redis.Client
+	node      string
+	listeners []func(GuardrailEvent)
+
+	// Guardrails whose trips engage the kill switch
+	killSwitch *KillSwitch
+	revert     map[string]bool
+
+	mu      sync.Mutex
+	tripped map[string]bool
+}
+
+// NewGuardrailAlerts creates the alerter of the replica named node.
+func NewGuardrailAlerts(client *redis.Client, node string) *GuardrailAlerts {
+	return &GuardrailAlerts{client: client, node: node, tripped: make(map[string]bool)}
+}
+
+// Subscribe registers a function called with every alert. It must be
+// called before the guardrails start and must not block.
+func (g *GuardrailAlerts) Subscribe(fn func(GuardrailEvent)) {
+	g.listeners = append(g.listeners, fn)
+}
+
+// RevertWith makes trips of the named guardrails engage the kill switch,
+// putting the fleet in monitor mode until an operator releases it: scoring
+// stops enforcing, and the blocklist and verdicts let the clients they hold
+// through, so blocks a runaway model wrote stop refusing traffic. It must
+// be called before the guardrails start. blocked_clients is never reverted:
+// clients drive its counts, so tripping it would let them turn enforcement
+// off for everyone; it holds new blocks instead.
+func (g *GuardrailAlerts) RevertWith(k *KillSwitch, guardrails ...string) {
+	g.killSwitch = k
+	g.revert = make(map[string]bool)
+	for _, name := range guardrails {
+		if name != GuardrailBlockedClients {
+			g.revert[name] = true
+		}
+	}
+}
+
+// Check records whether a guardrail is tripped, alerting when it trips and
+// logging when it recovers. quiet is passed on to Trip.
+func (g *GuardrailAlerts) Check(ctx context.Context, guardrail string, tripped bool, ev GuardrailEvent, quiet time.Duration) {
+	g.mu.Lock()
+	was := g.tripped[guardrail]
+	g.tripped[guardrail] = tripped
+	g.mu.Unlock()
+
+	if !tripped {
+		guardrailTripped.Set(0, guardrail)
+		if was {
+			log.Printf("[Guardrail] %s: back to normal", guardrail)
+		}
+		return
+	}
+	guardrailTripped.Set(1, guardrail)
+	if !was {
+		g.Trip(ctx, ev, quiet)
+	}
+}
+
+// Trip reports a guardrail that tripped. Subscribers hear about it unless
+// another replica alerted for the same guardrail within quiet; if Redis
+// can't be reached, they hear about it anyway.
+func (g *GuardrailAlerts) Trip(ctx context.Context, ev GuardrailEvent, quiet time.Duration) {
+	if ev.Timestamp.IsZero() {
+		ev.Timestamp = time.Now().UTC()
+	}
+	ev.Node = g.node
+	guardrailTrips.Inc(ev.Guardrail)
+	log.Printf("[Guardrail] %s: %s", ev.Guardrail, ev.Summary)
+
+	first, err := g.client.SetNX(ctx, guardrailAlertPrefix+ev.Guardrail, g.node, quiet).Result()
+	if err != nil {
+		log.Printf("[Guardrail] Failed to coordinate alert for %s, alerting anyway: %v", ev.Guardrail, err)
+	} else if !first {
+		return
+	}
+	if g.revert[ev.Guardrail] && !g.killSwitch.Engaged() {
+		if _, err := g.killSwitch.Set(ctx, true, "guardrail", g.node, ev.Guardrail+": "+ev.Summary); err != nil {
+			log.Printf("[Guardrail] Failed to engage the kill switch for %s: %v", ev.Guardrail, err)
+		} else {
+			ev.Reverted = true
+			log.Printf("[Guardrail] Kill switch engaged for %s, enforcement is in monitor mode until it is released", ev.Guardrail)
+		}
+	}
+	for _, fn := range g.listeners {
+		fn(ev)
+	}
+}
@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestGuardrailRevertLiftsBlocks(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	// The model mass-writing blocks
+	mr.Set(blocklistPrefix+"203.0.113.7", "model")
+
+	killSwitch := NewKillSwitch(client, "aegis:killswitch", nil)
+	alerts := NewGuardrailAlerts(client, "proxy-1")
+	alerts.RevertWith(killSwitch, GuardrailGrowth)
+	blocklist := NewBlocklistMiddleware(client, nil, nil, false)
+	blocklist.SetKillSwitch(killSwitch)
+
+	handler := blocklist.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func() int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "203.0.113.7:4000"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	if code := serve(); code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403 before the trip", code)
+	}
+
+	var reverted bool
+	alerts.Subscribe(func(ev GuardrailEvent) { reverted = ev.Reverted })
+	alerts.Check(context.Background(), GuardrailGrowth, true, GuardrailEvent{
+		Guardrail: GuardrailGrowth,
+		Summary:   "blocklist grew 10x",
+	}, time.Minute)
+	if !reverted || !killSwitch.Engaged() {
+		t.Fatalf("reverted = %t, engaged = %t, want the kill switch engaged", reverted, killSwitch.Engaged())
+	}
+	if code := serve(); code != http.StatusOK {
+		t.Errorf("status = %d, want 200 after the revert", code)
+	}
+	if !mr.Exists(blocklistPrefix + "203.0.113.7") {
+		t.Error("revert removed the blocklist entry")
+	}
+}
@@ -0,0 +1,89 @@
+package middleware
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// SecurityHeaders are response header values; empty ones are not sent.
+type SecurityHeaders struct {
+	HSTS           string // Sent over TLS only, where browsers honor it
+	FrameOptions   string
+	ReferrerPolicy string
+	CSP            string
+}
+
+// SecurityHeadersMiddleware gives every response a hardened baseline of
+// security headers. Headers the upstream sets itself are kept, so services
+// with stricter or more specific values, such as CSP nonces, stay in control.
+type SecurityHeadersMiddleware struct {
+	defaults atomic.Pointer[SecurityHeaders]
+	routes   *RoutePolicies // Per-route overrides; nil without the routes stage
+}
+
+// NewSecurityHeadersMiddleware creates the headers stage.
+func NewSecurityHeadersMiddleware(defaults SecurityHeaders, routes *RoutePolicies) *SecurityHeadersMiddleware {
+	m := &SecurityHeadersMiddleware{routes: routes}
+	m.defaults.Store(&defaults)
+	return m
+}
+
+// SetDefault replaces the headers of routes without their own.
+func (m *SecurityHeadersMiddleware) SetDefault(h SecurityHeaders) {
+	m.defaults.Store(&h)
+}
+
+// Handler returns the middleware handler
+func (m *SecurityHeadersMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := m.defaults.Load()
+		if m.routes != nil {
+			if route := m.routes.Match(r.URL.Path); route != nil && route.SecurityHeaders != nil {
+				headers = route.SecurityHeaders
+			}
+		}
+		next.ServeHTTP(&headersWriter{ResponseWriter: w, headers: headers, tls: r.TLS != nil}, r)
+	})
+}
+
+// headersWriter adds the security headers the response lacks when it is
+// written.
+type headersWriter struct {
+	http.ResponseWriter
+	headers     *SecurityHeaders
+	tls         bool
+	wroteHeader bool
+}
+
+func (w *headersWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= 200 {
+		w.wroteHeader = true
+		h := w.Header()
+		setMissing(h, "X-Content-Type-Options", "nosniff")
+		setMissing(h, "X-Frame-Options", w.headers.FrameOptions)
+		setMissing(h, "Referrer-Policy", w.headers.ReferrerPolicy)
+		setMissing(h, "Content-Security-Policy", w.headers.CSP)
+		if w.tls {
+			setMissing(h, "Strict-Transport-Security", w.headers.HSTS)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headersWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *headersWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func setMissing(h http.Header, name, value string) {
+	if value != "" && h.Get(name) == "" {
+		h.Set(name, value)
+	}
+}
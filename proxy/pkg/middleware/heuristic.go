@@ -0,0 +1,181 @@
+package middleware
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HeuristicConfig holds the thresholds of the built-in rule-based scorer.
+type HeuristicConfig struct {
+	Window         time.Duration
+	MinRequests    int     // Rate, error and entropy rules need this much history
+	MaxRequestRate float64 // Requests per second
+	MaxErrorRate   float64 // Fraction of 4xx/5xx responses
+	MaxPathEntropy float64 // Bits across the distinct paths requested
+	MaxPayloadSize int64   // Bytes
+}
+
+// Rule weights; a client tripping every rule scores 1.
+const (
+	weightRequestRate = 0.5
+	weightErrorRate   = 0.2
+	weightPathEntropy = 0.2
+	weightPayloadSize = 0.1
+)
+
+// maxTrackedPaths bounds the per-client path histogram.
+const maxTrackedPaths = 256
+
+// HeuristicScorer produces a degraded-mode risk score from simple rules so
+// basic protection survives AI engine and pipeline outages. It runs as the
+// heuristic stage, before scoring, so every request and response status
+// reaches its rules; scoring falls back to its score when no scorer has one.
+type HeuristicScorer struct {
+	mu        sync.Mutex
+	cfg       HeuristicConfig
+	clients   map[string]*heuristicState
+	lastSweep time.Time
+}
+
+type heuristicState struct {
+	windowStart time.Time
+	requests    int
+	errors      int
+	responses   int
+	paths       map[string]int
+}
+
+// NewHeuristicScorer creates the rule-based fallback scorer.
+func NewHeuristicScorer(cfg HeuristicConfig) *HeuristicScorer {
+	return &HeuristicScorer{
+		cfg:       cfg,
+		clients:   make(map[string]*heuristicState),
+		lastSweep: time.Now(),
+	}
+}
+
+// Score records the request and evaluates the rules against the client's window.
+func (h *HeuristicScorer) Score(ctx context.Context, req *ScoreRequest) (*RiskScore, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	h.sweep(now)
+
+	st := h.state(req.ClientIP, now)
+	st.requests++
+	if _, ok := st.paths[req.Path]; ok || len(st.paths) < maxTrackedPaths {
+		st.paths[req.Path]++
+	}
+
+	attributions := make(map[string]float64)
+
+	if st.requests >= h.cfg.MinRequests {
+		elapsed := math.Max(now.Sub(st.windowStart).Seconds(), 1)
+		if float64(st.requests)/elapsed > h.cfg.MaxRequestRate {
+			attributions["request_rate"] = weightRequestRate
+		}
+		if st.responses > 0 && float64(st.errors)/float64(st.responses) > h.cfg.MaxErrorRate {
+			attributions["error_rate"] = weightErrorRate
+		}
+		if pathEntropy(st.paths) > h.cfg.MaxPathEntropy {
+			attributions["path_entropy"] = weightPathEntropy
+		}
+	}
+	if req.ContentLength > h.cfg.MaxPayloadSize {
+		attributions["payload_size"] = weightPayloadSize
+	}
+
+	var score float64
+	for _, w := range attributions {
+		score += w
+	}
+
+	return &RiskScore{
+		Value:        math.Min(score, 1),
+		Model:        "heuristic",
+		Source:       "heuristic",
+		Attributions: attributions,
+	}, nil
+}
+
+// Handler scores each request for scoring to fall back on, and feeds the
+// response status into the error-rate rule.
+func (h *HeuristicScorer) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := clientIP(r)
+		score, _ := h.Score(r.Context(), &ScoreRequest{
+			ClientIP:      clientIP,
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			ContentLength: r.ContentLength,
+		})
+		r, rc := attachRequestContext(r)
+		rc.Heuristic = score
+
+		ww := &responseWriterWrapper{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(ww, r)
+		h.ObserveResponse(clientIP, ww.statusCode)
+	})
+}
+
+// ObserveResponse feeds response statuses into the error-rate rule.
+func (h *HeuristicScorer) ObserveResponse(clientIP string, status int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := h.clients[clientIP]
+	if !ok {
+		return
+	}
+	st.responses++
+	if status >= 400 {
+		st.errors++
+	}
+}
+
+// state returns the client's current window, starting a new one when it has elapsed.
+func (h *HeuristicScorer) state(clientIP string, now time.Time) *heuristicState {
+	st, ok := h.clients[clientIP]
+	if !ok || now.Sub(st.windowStart) > h.cfg.Window {
+		st = &heuristicState{windowStart: now, paths: make(map[string]int)}
+		h.clients[clientIP] = st
+	}
+	return st
+}
+
+// sweep drops clients whose window has expired. Callers must hold the lock.
+func (h *HeuristicScorer) sweep(now time.Time) {
+	if now.Sub(h.lastSweep) < h.cfg.Window {
+		return
+	}
+	h.lastSweep = now
+
+	for ip, st := range h.clients {
+		if now.Sub(st.windowStart) > h.cfg.Window {
+			delete(h.clients, ip)
+		}
+	}
+}
+
+// pathEntropy is the Shannon entropy (bits) of the path distribution.
+// Enumeration and scraping touch many distinct paths and score high.
+func pathEntropy(paths map[string]int) float64 {
+	var total int
+	for _, n := range paths {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	var entropy float64
+	for _, n := range paths {
+		p := float64(n) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeuristicStage(t *testing.T) {
+	h := NewHeuristicScorer(HeuristicConfig{
+		Window:         time.Minute,
+		MinRequests:    3,
+		MaxRequestRate: 1000,
+		MaxErrorRate:   0.5,
+		MaxPathEntropy: 100,
+		MaxPayloadSize: 1 << 20,
+	})
+	scoring := &ScoringMiddleware{}
+
+	var fallback *RiskScore
+	handler := RequestContextHandler(h.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fallback = scoring.score(r.Context(), &ScoreRequest{ClientIP: "203.0.113.7"})
+		w.WriteHeader(http.StatusNotFound)
+	})))
+	for i := range 4 {
+		r := httptest.NewRequest(http.MethodGet, "/missing", nil)
+		r.RemoteAddr = "203.0.113.7:4000"
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if fallback == nil {
+			t.Fatalf("request %d: scoring didn't fall back on the heuristic score", i)
+		}
+	}
+	// The first three 404s were observed before the fourth request was scored
+	if fallback.Attributions["error_rate"] != weightErrorRate {
+		t.Errorf("attributions = %v, want the error rate rule", fallback.Attributions)
+	}
+
+	// A scorer's score wins over the heuristic one
+	scoring.scorers = []Scorer{fixedScorer{value: 0.9}}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if fallback == nil || fallback.Value != 0.9 {
+		t.Errorf("score = %v, want the scorer's", fallback)
+	}
+}
+
+type fixedScorer struct{ value float64 }
+
+func (s fixedScorer) Score(context.Context, *ScoreRequest) (*RiskScore, error) {
+	return &RiskScore{Value: s.value}, nil
+}
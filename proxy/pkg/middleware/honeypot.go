@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+)
+
+// LabelHoneypot marks training labels emitted for decoy path hits.
+const LabelHoneypot = "honeypot"
+
+// honeypotPrefix keys trapped clients, so every replica scores them.
+const honeypotPrefix = "aegis:honeypot:trapped:"
+
+// HoneypotOptions configures the decoy routes.
+type HoneypotOptions struct {
+	Paths []string // Decoy path prefixes, e.g. /wp-login.php or /.env
+
+	// Score is reported for trapped clients until ScoreTTL elapses.
+	Score    float64
+	ScoreTTL time.Duration
+
+	// AutoBlock adds trapped clients to the Redis blocklist for BlockTTL.
+	AutoBlock  bool
+	BlockTTL   time.Duration
+	Recent     *RecentBlocks     // Learns the blocks made, if set
+	Escalation *BlockEscalation  // Lengthens repeat offenders' blocks, if set
+	Guard      *EnforcementGuard // Holds blocks over the blocked clients cap, if set
+	KillSwitch *KillSwitch       // Suspends the blocks while engaged, if set
+
+	// LabelTopic receives a training label for every hit (empty disables).
+	LabelTopic string
+}
+
+// HoneypotLabel is published for every decoy hit. Legitimate clients have no
+// reason to request these paths, so hits are high-signal malicious examples.
+type HoneypotLabel struct {
+	Timestamp time.Time `json:"timestamp"`
+	ClientIP  string    `json:"client_ip"`
+	Label     string    `json:"label"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// HoneypotMiddleware answers decoy paths itself and never proxies them upstream.
+// It is also a Scorer, reporting a high score for clients that hit a decoy.
+type HoneypotMiddleware struct {
+	client  *redis.Client
+	sink    EventSink
+	auditor *Auditor
+	opts    HoneypotOptions
+
+	mu    sync.RWMutex
+	paths []string
+}
+
+// NewHoneypotMiddleware creates the decoy route handler.
+func NewHoneypotMiddleware(client *redis.Client, sink EventSink, auditor *Auditor, opts HoneypotOptions) *HoneypotMiddleware {
+	return &HoneypotMiddleware{
+		client:  client,
+		sink:    sink,
+		auditor: auditor,
+		opts:    opts,
+		paths:   opts.Paths,
+	}
+}
+
+// SetPaths replaces the decoy paths.
+func (h *HoneypotMiddleware) SetPaths(paths []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.paths = paths
+}
+
+// Handler returns the middleware handler
+func (h *HoneypotMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.isDecoy(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The address ClientIPMiddleware resolved: the peer, or the client
+		// a trusted proxy forwarded for, never one the client claims itself
+		clientIP := clientIP(r)
+		logging.For(r.Context()).Infof("[Honeypot] %s hit decoy %s %s", clientIP, r.Method, r.URL.Path)
+
+		h.trap(r.Context(), clientIP)
+		reason := "decoy path requested"
+		if h.opts.AutoBlock && !h.opts.KillSwitch.enforcing() {
+			// The decoy is still answered; only the block is suspended
+			logging.For(r.Context()).Infof("[KillSwitch] Would block %s in honeypot: %s", clientIP, reason)
+			reason += "; would block"
+		} else if h.opts.AutoBlock && !h.opts.Guard.holds(r.Context(), clientIP, "honeypot") {
+			if err := h.opts.Escalation.block(r.Context(), h.client, h.opts.Recent, clientIP, ActionTypeHoneypot, "honeypot", h.opts.BlockTTL); err != nil {
+				log.Printf("[Honeypot] Failed to blocklist %s: %v", clientIP, err)
+			}
+		}
+		h.publishLabel(r, clientIP)
+
+		noteDecision(r.Context(), "honeypot", OutcomeDeny, reason)
+		h.auditor.Record(AuditEvent{
+			ClientIP:  clientIP,
+			Tenant:    tenantName(r.Context()),
+			RequestID: logging.RequestID(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    http.StatusNotFound,
+			Stage:     "honeypot",
+			Reason:    reason,
+		})
+
+		// Look like an ordinary missing page so scanners learn nothing
+		http.NotFound(w, r)
+	})
+}
+
+// Score implements Scorer for clients that recently hit a decoy.
+func (h *HoneypotMiddleware) Score(ctx context.Context, req *ScoreRequest) (*RiskScore, error) {
+	n, err := h.client.Exists(ctx, honeypotPrefix+req.ClientIP).Result()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	return &RiskScore{
+		Value:        h.opts.Score,
+		Model:        "honeypot",
+		Source:       "honeypot",
+		Attributions: map[string]float64{"honeypot_hit": h.opts.Score},
+	}, nil
+}
+
+func (h *HoneypotMiddleware) isDecoy(path string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, decoy := range h.paths {
+		if matchPrefix(path, decoy) {
+			return true
+		}
+	}
+	return false
+}
+
+// trap marks the client in Redis until ScoreTTL elapses.
+func (h *HoneypotMiddleware) trap(ctx context.Context, clientIP string) {
+	if err := h.client.Set(ctx, honeypotPrefix+clientIP, 1, h.opts.ScoreTTL).Err(); err != nil {
+		log.Printf("[Honeypot] Failed to record the hit of %s: %v", clientIP, err)
+	}
+}
+
+// publishLabel emits the training label without blocking the response.
+func (h *HoneypotMiddleware) publishLabel(r *http.Request, clientIP string) {
+	if h.opts.LabelTopic == "" {
+		return
+	}
+
+	label := HoneypotLabel{
+		Timestamp: time.Now().UTC(),
+		ClientIP:  clientIP,
+		Label:     LabelHoneypot,
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		UserAgent: r.UserAgent(),
+	}
+	data, err := json.Marshal(label)
+	if err != nil {
+		log.Printf("[Honeypot] Error marshalling label: %v", err)
+		return
+	}
+
+	go func() {
+		if err := h.sink.Publish(h.opts.LabelTopic, clientIP, data); err != nil {
+			log.Printf("[Honeypot] Failed to publish label: %v", err)
+		}
+	}()
+}
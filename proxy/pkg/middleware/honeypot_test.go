@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestHoneypot(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	opts := HoneypotOptions{
+		Paths:     []string{"/.env"},
+		Score:     1,
+		ScoreTTL:  time.Hour,
+		AutoBlock: true,
+		BlockTTL:  time.Hour,
+	}
+	// Two replicas sharing Redis
+	hit := NewHoneypotMiddleware(client, nil, nil, opts)
+	other := NewHoneypotMiddleware(client, nil, nil, opts)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("decoy request proxied")
+	})
+	handler := NewClientIPMiddleware([]string{"10.0.0.0/8"}).Handler(hit.Handler(upstream))
+
+	// An untrusted peer can't pick the address it is blocked by
+	r := httptest.NewRequest(http.MethodGet, "/.env", nil)
+	r.RemoteAddr = "203.0.113.7:4000"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, r)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("status = %d, want 404", rec.Code)
+	}
+	if !mr.Exists(blocklistPrefix+"203.0.113.7") || mr.Exists(blocklistPrefix+"198.51.100.1") {
+		t.Errorf("blocklist = %v, want only the peer", mr.Keys())
+	}
+
+	// A trusted proxy's client is blocked, not the proxy
+	r = httptest.NewRequest(http.MethodGet, "/.env", nil)
+	r.RemoteAddr = "10.0.0.2:4000"
+	r.Header.Set("X-Forwarded-For", "192.0.2.9")
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if !mr.Exists(blocklistPrefix+"192.0.2.9") || mr.Exists(blocklistPrefix+"10.0.0.2") {
+		t.Errorf("blocklist = %v, want the forwarded client", mr.Keys())
+	}
+
+	ctx := context.Background()
+	score, err := other.Score(ctx, &ScoreRequest{ClientIP: "203.0.113.7"})
+	if err != nil || score == nil || score.Value != 1 {
+		t.Fatalf("other replica's score = %v, %v, want the honeypot score", score, err)
+	}
+	if score, err := other.Score(ctx, &ScoreRequest{ClientIP: "198.51.100.1"}); err != nil || score != nil {
+		t.Errorf("score = %v, %v, want none for a forged address", score, err)
+	}
+
+	mr.FastForward(time.Hour + time.Second)
+	if score, err := other.Score(ctx, &ScoreRequest{ClientIP: "203.0.113.7"}); err != nil || score != nil {
+		t.Errorf("score = %v, %v, want none after ScoreTTL", score, err)
+	}
+}
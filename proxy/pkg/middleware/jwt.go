@@ -0,0 +1,222 @@
+package middleware
+
+import (
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var jwtClockRejections = metrics.NewCounterVec("aegis_jwt_clock_rejections_total",
+	"Tokens rejected by a time claim, by claim (exp, nbf or iat). A surge of nbf or iat rejections points at clock skew.", "claim")
+
+// HeaderTokenExpiresIn tells clients how many seconds their token has left
+// once it is about to expire, so they can refresh it before it is refused.
+const HeaderTokenExpiresIn = "X-Aegis-Token-Expires-In"
+
+// Bearer token error codes of WWW-Authenticate challenges (RFC 6750).
+const (
+	bearerInvalidRequest = "invalid_request"
+	bearerInvalidToken   = "invalid_token"
+)
+
+// JWTMiddleware validates JWT tokens using RS256
+type JWTMiddleware struct {
+	publicKey     atomic.Pointer[rsa.PublicKey]
+	subjects      *BlocklistMiddleware
+	routes        *RoutePolicies
+	leeway        time.Duration
+	expiryWarning time.Duration
+}
+
+// NewJWTMiddleware creates a new JWT validator with the given RSA public key
+func NewJWTMiddleware(publicKey *rsa.PublicKey) *JWTMiddleware {
+	j := &JWTMiddleware{}
+	j.publicKey.Store(publicKey)
+	return j
+}
+
+// SetPublicKey replaces the verification key, e.g. after rotation.
+func (j *JWTMiddleware) SetPublicKey(publicKey *rsa.PublicKey) {
+	j.publicKey.Store(publicKey)
+}
+
+// PublicKey returns the key tokens are verified with.
+func (j *JWTMiddleware) PublicKey() *rsa.PublicKey {
+	return j.publicKey.Load()
+}
+
+// SetSubjectBlocklist refuses authenticated subjects found in the blocklist.
+// It must be called before the proxy starts serving.
+func (j *JWTMiddleware) SetSubjectBlocklist(blocklist *BlocklistMiddleware) {
+	j.subjects = blocklist
+}
+
+// SetLeeway tolerates clock skew of up to d between the proxy and the token
+// issuer when checking exp, nbf and iat.
+// It must be called before the proxy starts serving.
+func (j *JWTMiddleware) SetLeeway(d time.Duration) {
+	j.leeway = d
+}
+
+// SetExpiryWarning sets the X-Aegis-Token-Expires-In response header on
+// requests whose token expires within d. Zero disables it.
+// It must be called before the proxy starts serving.
+func (j *JWTMiddleware) SetExpiryWarning(d time.Duration) {
+	j.expiryWarning = d
+}
+
+// SetRoutes applies the route guards before parsing tokens and lets requests
+// to routes with auth none through without one.
+// It must be called before the proxy starts serving.
+func (j *JWTMiddleware) SetRoutes(routes *RoutePolicies) {
+	j.routes = routes
+}
+
+// Handler returns the middleware handler
+func (j *JWTMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Skip health check endpoint
+		if r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if j.routes != nil {
+			if !j.routes.Guard(w, r) {
+				return
+			}
+			if j.routes.SkipsAuth(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		// Extract token from Authorization header
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			logging.For(r.Context()).Infof("[JWT] Missing Authorization header from %s", r.RemoteAddr)
+			noteDecision(r.Context(), "jwt", OutcomeDeny, "missing token")
+			bearerChallenge(w, "", "")
+			pages.WriteError(w, r, pages.ErrTokenMissing)
+			return
+		}
+
+		// Expect "Bearer <token>"
+		parts := strings.SplitN(authHeader, " ", 2)
+		if len(parts) != 2 || strings.ToLower(parts[0]) != "bearer" {
+			logging.For(r.Context()).Infof("[JWT] Invalid Authorization header format from %s", r.RemoteAddr)
+			noteDecision(r.Context(), "jwt", OutcomeDeny, "invalid token format")
+			bearerChallenge(w, bearerInvalidRequest, "The Authorization header is not a bearer token")
+			pages.WriteError(w, r, pages.ErrTokenMalformed)
+			return
+		}
+
+		tokenString := parts[1]
+
+		// Parse and validate the token
+		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+			// Validate the signing method is RS256
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, jwt.ErrSignatureInvalid
+			}
+			return j.publicKey.Load(), nil
+		}, jwt.WithLeeway(j.leeway), jwt.WithIssuedAt())
+
+		if err != nil {
+			switch {
+			case errors.Is(err, jwt.ErrTokenExpired):
+				jwtClockRejections.Inc("exp")
+			case errors.Is(err, jwt.ErrTokenNotValidYet):
+				jwtClockRejections.Inc("nbf")
+			case errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+				jwtClockRejections.Inc("iat")
+			}
+			logging.For(r.Context()).Infof("[JWT] Token validation failed from %s: %v", r.RemoteAddr, err)
+			// The signature is checked before the claims, so an expired
+			// token failing no other check is one the client can refresh
+			if errors.Is(err, jwt.ErrTokenExpired) && !errors.Is(err, jwt.ErrTokenNotValidYet) && !errors.Is(err, jwt.ErrTokenUsedBeforeIssued) {
+				noteDecision(r.Context(), "jwt", OutcomeDeny, "expired token")
+				bearerChallenge(w, bearerInvalidToken, "The access token expired")
+				pages.WriteError(w, r, pages.ErrTokenExpired.Wrap(err))
+				return
+			}
+			noteDecision(r.Context(), "jwt", OutcomeDeny, "invalid token")
+			bearerChallenge(w, bearerInvalidToken, "The access token is invalid")
+			pages.WriteError(w, r, pages.ErrTokenInvalid.Wrap(err))
+			return
+		}
+
+		if !token.Valid {
+			logging.For(r.Context()).Infof("[JWT] Invalid token from %s", r.RemoteAddr)
+			noteDecision(r.Context(), "jwt", OutcomeDeny, "invalid token")
+			bearerChallenge(w, bearerInvalidToken, "The access token is invalid")
+			pages.WriteError(w, r, pages.ErrTokenInvalid)
+			return
+		}
+
+		// Extract claims for logging/context
+		if claims, ok := token.Claims.(jwt.MapClaims); ok {
+			j.warnExpiry(w, claims)
+			r = r.WithContext(withClaims(r.Context(), claims))
+			if sub, exists := claims["sub"]; exists {
+				logging.For(r.Context()).Debugf("[JWT] Authenticated user: %v", sub)
+				r = r.WithContext(withSubject(r.Context(), fmt.Sprint(sub)))
+			}
+		}
+
+		if subject := subjectFromContext(r.Context()); subject != "" && j.subjects != nil {
+			blocked, err := j.subjects.SubjectBlocked(r.Context(), subject)
+			if err != nil {
+				logging.For(r.Context()).Warnf("[JWT] Redis error checking subject %s: %v", subject, err)
+				if !j.subjects.FailOpen() {
+					pages.WriteError(w, r, pages.ErrUnavailable)
+					return
+				}
+			}
+			if blocked && !j.subjects.guard.spares(r.Context(), clientIP(r), "jwt") {
+				logging.For(r.Context()).Infof("[JWT] BLOCKED subject: %s", subject)
+				j.subjects.auditSubject(r, subject)
+				pages.WriteError(w, r, pages.ErrSubjectBlocked)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// warnExpiry sets X-Aegis-Token-Expires-In when the token's exp is within
+// the expiry warning.
+func (j *JWTMiddleware) warnExpiry(w http.ResponseWriter, claims jwt.MapClaims) {
+	if j.expiryWarning <= 0 {
+		return
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return
+	}
+	if left := time.Until(exp.Time); left <= j.expiryWarning {
+		w.Header().Set(HeaderTokenExpiresIn, strconv.Itoa(max(int(left.Seconds()), 0)))
+	}
+}
+
+// bearerChallenge sets the WWW-Authenticate header of a 401 (RFC 6750), so
+// clients can tell a token to refresh from one to give up on. Requests
+// without a token get a challenge without an error code.
+func bearerChallenge(w http.ResponseWriter, code, description string) {
+	if code == "" {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		return
+	}
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf("Bearer error=%q, error_description=%q", code, description))
+}
@@ -0,0 +1,231 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var killSwitchGauge = metrics.NewGaugeVec("aegis_kill_switch_engaged",
+	"1 while the kill switch holds the proxy in monitor mode.")
+
+// KillSwitchState is the kill switch as stored in Redis, with the last change.
+type KillSwitchState struct {
+	Engaged bool      `json:"engaged"`
+	By      string    `json:"by,omitempty"`
+	Source  string    `json:"source,omitempty"` // Address the change came from
+	Reason  string    `json:"reason,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// KillSwitch forces every proxy sharing a Redis into monitor mode, for
+// emergencies when the model blocks legitimate traffic. The state is kept in
+// a Redis key; changes are published on a channel of the same name so
+// replicas follow within moments, with polling as a fallback.
+type KillSwitch struct {
+	client    *redis.Client
+	key       string
+	auditor   *Auditor
+	listeners []func(KillSwitchState)
+
+	mu    sync.Mutex
+	state KillSwitchState
+}
+
+// NewKillSwitch creates a kill switch stored under key.
+func NewKillSwitch(client *redis.Client, key string, auditor *Auditor) *KillSwitch {
+	return &KillSwitch{client: client, key: key, auditor: auditor}
+}
+
+// Subscribe registers a function called whenever the switch is engaged or
+// released. It must be called before Run and before the proxy starts serving.
+func (k *KillSwitch) Subscribe(fn func(KillSwitchState)) {
+	k.listeners = append(k.listeners, fn)
+}
+
+// Engaged reports whether the kill switch was engaged when last read.
+func (k *KillSwitch) Engaged() bool {
+	if k == nil {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.state.Engaged
+}
+
+// enforcing reports whether the stages that block clients carry their
+// blocks out. While the switch is engaged they let the client through and
+// only record what they would have done; a nil switch always enforces.
+func (k *KillSwitch) enforcing() bool {
+	return !k.Engaged()
+}
+
+// wouldBlock logs and audits a refusal by stage that the engaged kill switch
+// suspended, so the blocks held back stay visible.
+func wouldBlock(r *http.Request, auditor *Auditor, stage, reason string) {
+	clientIP := clientIP(r)
+	logging.For(r.Context()).Infof("[KillSwitch] Would block %s in %s: %s", clientIP, stage, reason)
+	noteDecision(r.Context(), stage, "", "would block: "+reason)
+	auditor.Record(AuditEvent{
+		ClientIP:  clientIP,
+		Subject:   subjectFromContext(r.Context()),
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    http.StatusOK,
+		Stage:     stage,
+		Reason:    "would block: " + reason,
+	})
+}
+
+// State reads the current state from Redis.
+func (k *KillSwitch) State(ctx context.Context) (KillSwitchState, error) {
+	value, err := k.client.Get(ctx, k.key).Result()
+	if err == redis.Nil {
+		return KillSwitchState{}, nil
+	}
+	if err != nil {
+		return KillSwitchState{}, err
+	}
+	var state KillSwitchState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		// Set by hand, e.g. redis-cli SET aegis:killswitch "bad model"
+		return KillSwitchState{Engaged: true, Reason: value}, nil
+	}
+	return state, nil
+}
+
+// Set engages or releases the kill switch for the whole fleet and records
+// who did it.
+func (k *KillSwitch) Set(ctx context.Context, engaged bool, by, source, reason string) (KillSwitchState, error) {
+	state := KillSwitchState{Engaged: engaged, By: by, Source: source, Reason: reason, At: time.Now().UTC()}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return state, err
+	}
+	if err := k.client.Set(ctx, k.key, data, 0).Err(); err != nil {
+		return state, err
+	}
+	if err := k.client.Publish(ctx, k.key, data).Err(); err != nil {
+		log.Printf("[KillSwitch] Failed to notify replicas, they will pick it up on the next poll: %v", err)
+	}
+
+	verb := "released"
+	if engaged {
+		verb = "engaged"
+	}
+	k.auditor.Record(AuditEvent{
+		ClientIP: source,
+		Subject:  by,
+		Method:   http.MethodPost,
+		Path:     "/admin/killswitch",
+		Status:   http.StatusOK,
+		Stage:    "killswitch",
+		Reason:   verb + ": " + reason,
+	})
+	k.update(state)
+	return state, nil
+}
+
+// Load reads the state once, so a proxy started during an incident starts
+// in monitor mode. It returns the error but keeps the switch released.
+func (k *KillSwitch) Load(ctx context.Context) error {
+	state, err := k.State(ctx)
+	if err != nil {
+		return err
+	}
+	k.update(state)
+	return nil
+}
+
+// Run follows the state until ctx is done. Redis errors keep the last known state.
+func (k *KillSwitch) Run(ctx context.Context, poll time.Duration) {
+	changed := make(chan struct{}, 1)
+	go func() {
+		for ctx.Err() == nil {
+			if err := k.watch(ctx, changed); err != nil {
+				log.Printf("[KillSwitch] Watch failed, polling only: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-changed:
+		}
+
+		state, err := k.State(ctx)
+		if err != nil {
+			log.Printf("[KillSwitch] Failed to read state, keeping current: %v", err)
+			continue
+		}
+		k.update(state)
+	}
+}
+
+// watch signals on changed for every change published by a replica.
+func (k *KillSwitch) watch(ctx context.Context, changed chan<- struct{}) error {
+	sub := k.client.Subscribe(ctx, k.key)
+	defer sub.Close()
+
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-messages:
+			if !ok {
+				return nil
+			}
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// update records state and notifies listeners if Engaged changed.
+func (k *KillSwitch) update(state KillSwitchState) {
+	k.mu.Lock()
+	flipped := state.Engaged != k.state.Engaged
+	k.state = state
+	k.mu.Unlock()
+
+	if state.Engaged {
+		killSwitchGauge.Set(1)
+	} else {
+		killSwitchGauge.Set(0)
+	}
+	if flipped {
+		if state.Engaged {
+			log.Printf("[KillSwitch] ENGAGED by %q from %s at %s: %s; enforcement suspended", state.By, state.Source, state.At.Format(time.RFC3339), state.Reason)
+		} else {
+			log.Printf("[KillSwitch] Released by %q from %s at %s", state.By, state.Source, state.At.Format(time.RFC3339))
+		}
+		for _, fn := range k.listeners {
+			fn(state)
+		}
+	}
+}
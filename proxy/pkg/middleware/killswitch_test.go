@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestKillSwitchSuspendsBlocks(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	mr.Set(blocklistPrefix+"203.0.113.7", "model")
+
+	killSwitch := NewKillSwitch(client, "aegis:killswitch", nil)
+	blocklist := NewBlocklistMiddleware(client, nil, nil, false)
+	blocklist.SetKillSwitch(killSwitch)
+	store := NewVerdictStore(time.Minute)
+	store.Apply(Verdict{ClientIP: "198.51.100.1", Action: ActionBlock, Score: 0.99})
+	verdicts := NewVerdictMiddleware(store, NewRateLimiter(1, 1), nil)
+	verdicts.SetKillSwitch(killSwitch)
+
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := blocklist.Handler(verdicts.Handler(upstream))
+	serve := func(clientIP string) int {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = clientIP + ":4000"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, r)
+		return rec.Code
+	}
+
+	for _, ip := range []string{"203.0.113.7", "198.51.100.1"} {
+		if code := serve(ip); code != http.StatusForbidden {
+			t.Errorf("%s: status = %d, want 403 while enforcing", ip, code)
+		}
+	}
+
+	ctx := context.Background()
+	if _, err := killSwitch.Set(ctx, true, "oncall", "127.0.0.1", "bad model"); err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"203.0.113.7", "198.51.100.1"} {
+		if code := serve(ip); code != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200 with the kill switch engaged", ip, code)
+		}
+	}
+	if refused, err := blocklist.RefusesConn(ctx, "203.0.113.7"); err != nil || refused {
+		t.Errorf("RefusesConn = %t, %v, want false with the kill switch engaged", refused, err)
+	}
+
+	if _, err := killSwitch.Set(ctx, false, "oncall", "127.0.0.1", "fixed"); err != nil {
+		t.Fatal(err)
+	}
+	if code := serve("203.0.113.7"); code != http.StatusForbidden {
+		t.Errorf("status = %d, want 403 once released", code)
+	}
+}
@@ -0,0 +1,363 @@
+package middleware
+
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+)
+
+// RequestLog represents the structured log entry sent to the AI Engine.
+// It matches the schema expected by the Python consumer.
+type RequestLog struct {
+	Timestamp     time.Time        `json:"timestamp"`
+	ClientIP      string           `json:"client_ip"`
+	Tenant        string           `json:"tenant,omitempty"`
+	RequestID     string           `json:"request_id,omitempty"`
+	Method        string           `json:"method"`
+	URL           string           `json:"url"`
+	UserAgent     string           `json:"user_agent"`
+	Status        int              `json:"status"`
+	Duration      int64            `json:"duration_ms"`
+	RequestSize   int64            `json:"request_size"`
+	ResponseSize  int64            `json:"response_size"`
+	Protocol      string           `json:"protocol"`
+	ModelID       string           `json:"model_id,omitempty"`
+	Features      *TrafficFeatures `json:"features,omitempty"`
+	RiskScore     *float64         `json:"risk_score,omitempty"`
+	SmoothedScore *float64         `json:"smoothed_score,omitempty"`
+	Decision      Action           `json:"decision,omitempty"`
+	Model         string           `json:"model,omitempty"`
+	WAF           *WAFResult       `json:"waf,omitempty"` // Set when the waf stage ran
+	// SchemaViolations are how the request broke its route's OpenAPI spec
+	SchemaViolations []string `json:"schema_violations,omitempty"`
+	// ProtocolAnomalies are HTTP-level oddities such as duplicate headers
+	ProtocolAnomalies []string `json:"protocol_anomalies,omitempty"`
+	// OffSchedule names the flagging schedules the request is outside of
+	OffSchedule []string `json:"off_schedule,omitempty"`
+	// Travel is the subject's move since its last request
+	Travel *Travel `json:"travel,omitempty"`
+	// Familiarity is what the subject hasn't been seen with before
+	Familiarity *Familiarity `json:"familiarity,omitempty"`
+	// Pod is the Kubernetes pod the proxy runs in, in sidecar mode
+	Pod *PodInfo `json:"pod,omitempty"`
+	// Cloud is where the proxy runs, from the cloud's metadata service
+	Cloud *CloudInfo `json:"cloud,omitempty"`
+
+	// Challenger model results, logged for comparison only
+	ShadowScore    *float64 `json:"shadow_score,omitempty"`
+	ShadowDecision Action   `json:"shadow_decision,omitempty"`
+	ShadowModel    string   `json:"shadow_model,omitempty"`
+}
+
+// PodInfo identifies the Kubernetes pod of a sidecar, from the Downward API.
+type PodInfo struct {
+	Name      string `json:"name,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Node      string `json:"node,omitempty"`
+	IP        string `json:"ip,omitempty"`
+}
+
+// CloudInfo locates the proxy's instance in its cloud, so anomalies can be
+// sliced by deployment location.
+type CloudInfo struct {
+	Provider     string `json:"provider"`          // "aws" or "gcp"
+	Account      string `json:"account,omitempty"` // AWS account or GCP project
+	Region       string `json:"region,omitempty"`
+	Zone         string `json:"zone,omitempty"`
+	InstanceID   string `json:"instance_id,omitempty"`
+	InstanceType string `json:"instance_type,omitempty"`
+	Cluster      string `json:"cluster,omitempty"` // EKS or GKE
+}
+
+// FeatureVector is the compact per-request record published for model
+// training and inference, separate from the richer access log.
+type FeatureVector struct {
+	Timestamp time.Time        `json:"timestamp"`
+	ClientIP  string           `json:"client_ip"`
+	Tenant    string           `json:"tenant,omitempty"`
+	ModelID   string           `json:"model_id,omitempty"`
+	Features  *TrafficFeatures `json:"features"`
+	WAF       *WAFResult       `json:"waf,omitempty"`
+
+	SchemaViolations  []string     `json:"schema_violations,omitempty"`
+	ProtocolAnomalies []string     `json:"protocol_anomalies,omitempty"`
+	OffSchedule       []string     `json:"off_schedule,omitempty"`
+	Travel            *Travel      `json:"travel,omitempty"`
+	Familiarity       *Familiarity `json:"familiarity,omitempty"`
+}
+
+// LoggerOptions selects the topics the logger publishes to.
+type LoggerOptions struct {
+	AccessLogTopic string // Rich access logs for audit
+	FeatureTopic   string // Compact feature vectors; empty disables
+	// AccessLogFeatures embeds features in access logs for consumers
+	// that predate the feature topic.
+	AccessLogFeatures bool
+	// Profiles tag each record with the model_id of its route.
+	Profiles *RouteProfiles
+	// SampleRate is the fraction of allowed, successful requests logged;
+	// errors, requests with a risk decision, WAF matches, schema violations,
+	// protocol anomalies, off-schedule requests, impossible travel and
+	// unfamiliar devices or networks are always logged. A route profile
+	// with its own sample rate overrides it.
+	SampleRate float64
+	// Logs are shipped by ShipWorkers goroutines from a queue of up to
+	// ShipQueueSize; ShipOverflow decides what happens when it is full.
+	ShipWorkers   int
+	ShipQueueSize int
+	ShipOverflow  string
+	// Pod and Cloud, if set, are added to every access log
+	Pod   *PodInfo
+	Cloud *CloudInfo
+}
+
+// LoggerMiddleware handles request logging and feature extraction for the pipeline.
+type LoggerMiddleware struct {
+	sink        EventSink
+	opts        LoggerOptions
+	flowTracker *FlowTracker
+	queue       *shipQueue
+	late        sync.WaitGroup // Logs waiting for their shadow score
+}
+
+// NewLoggerMiddleware creates the logger stage publishing to the given sink.
+func NewLoggerMiddleware(sink EventSink, opts LoggerOptions) *LoggerMiddleware {
+	lm := &LoggerMiddleware{
+		sink:        sink,
+		opts:        opts,
+		flowTracker: NewFlowTracker(),
+	}
+	lm.queue = newShipQueue(opts.ShipWorkers, opts.ShipQueueSize, opts.ShipOverflow, lm.shipLog)
+	return lm
+}
+
+// Close ships the logs still queued, and those waiting for a shadow score;
+// requests logged afterwards are dropped.
+func (lm *LoggerMiddleware) Close() {
+	lm.queue.close()
+	lm.late.Wait()
+}
+
+// Flows returns the per-client flow state behind the traffic features.
+func (lm *LoggerMiddleware) Flows() *FlowTracker {
+	return lm.flowTracker
+}
+
+// Handler acts as the middleware function to intercept HTTP traffic.
+func (lm *LoggerMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		// 1. Feature Extraction (Pre-Request)
+		r, rc := attachRequestContext(r)
+		clientIP := rc.ClientIP
+		tenant := tenantFromContext(r.Context())
+		flowKey := FlowKey(tenantName(r.Context()), clientIP)
+
+		// Estimate request size (Header + Body) including overhead
+		reqSize := r.ContentLength
+		if reqSize < 0 {
+			reqSize = 0
+		}
+		// Add standard overhead for HTTP headers estimate
+		reqSize += 500
+
+		// Update flow state and calculate initial feature set
+		features := lm.flowTracker.TrackRequest(flowKey, reqSize)
+
+		// Share features with downstream stages, which leave their findings
+		rc.Features = features
+
+		// 2. Request Processing
+		// Wrap ResponseWriter to capture status code and content size
+		ww := &responseWriterWrapper{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(ww, r)
+
+		// 3. Post-Request Statistics
+		duration := time.Since(start).Milliseconds()
+
+		// Update stats with actual response size (Bwd Packet Length) and status
+		lm.flowTracker.TrackResponse(flowKey, ww.responseSize, ww.statusCode, features)
+
+		// 4. Async Log Shipping
+		// Construct the log entry for the AI Engine in a pooled job
+		job := newShipJob()
+		logEntry := &job.entry
+		profile := lm.opts.Profiles.Match(r.URL.Path)
+		*logEntry = RequestLog{
+			Timestamp:    start.UTC(),
+			ClientIP:     clientIP,
+			Tenant:       tenantName(r.Context()),
+			RequestID:    logging.RequestID(r.Context()),
+			Method:       r.Method,
+			URL:          r.URL.String(),
+			UserAgent:    r.UserAgent(),
+			Status:       ww.statusCode,
+			Duration:     duration,
+			RequestSize:  reqSize,
+			ResponseSize: ww.responseSize,
+			Protocol:     r.Proto,
+			ModelID:      profile.ModelID,
+			Pod:          lm.opts.Pod,
+			Cloud:        lm.opts.Cloud,
+		}
+		if lm.opts.AccessLogFeatures {
+			logEntry.Features = features
+		}
+		if rc.Score != nil {
+			logEntry.RiskScore = &rc.Score.Value
+			logEntry.SmoothedScore = rc.Score.Smoothed
+			logEntry.Decision = rc.Score.Decision
+			logEntry.Model = rc.Score.Model
+		}
+		logEntry.WAF = rc.WAF
+		logEntry.SchemaViolations = rc.SchemaViolations
+		logEntry.ProtocolAnomalies = rc.ProtocolAnomalies
+		logEntry.OffSchedule = rc.OffSchedule
+		logEntry.Travel = rc.Travel
+		logEntry.Familiarity = rc.Familiarity
+
+		if !lm.sampled(logEntry, profile) {
+			job.release()
+			return
+		}
+
+		// A shipping worker handles the serialization and kafka produce
+		job.features, job.shadow, job.tenant = features, rc.shadow, tenant
+		lm.queue.enqueue(job)
+	})
+}
+
+// sampled reports whether an entry is shipped under the sample rate of its
+// route profile.
+func (lm *LoggerMiddleware) sampled(entry *RequestLog, profile *RouteProfile) bool {
+	rate := lm.opts.SampleRate
+	if profile.SampleRate != nil {
+		rate = *profile.SampleRate
+	}
+	if rate >= 1 || entry.Status >= 400 {
+		return true
+	}
+	if entry.Decision != "" && entry.Decision != ActionAllow {
+		return true
+	}
+	if entry.WAF != nil && entry.WAF.Score > 0 || len(entry.SchemaViolations) > 0 || len(entry.ProtocolAnomalies) > 0 || len(entry.OffSchedule) > 0 || entry.Travel != nil && entry.Travel.Impossible || entry.Familiarity.Unfamiliar() {
+		return true
+	}
+	return rand.Float64() < rate
+}
+
+// shadowWait bounds how long log shipping waits for a challenger score.
+const shadowWait = time.Second
+
+// shipLog sends the log entry and feature vector to Kafka from a shipping
+// worker, using the tenant's topics where it has its own. A log whose
+// shadow score isn't ready yet is handed to shipLate, so workers never wait
+// on the challenger.
+func (lm *LoggerMiddleware) shipLog(job *shipJob) {
+	if job.shadow != nil {
+		select {
+		case score := <-job.shadow:
+			job.setShadow(score)
+		default:
+			// The worker releases job once this returns
+			late := newShipJob()
+			*late = *job
+			lm.late.Add(1)
+			go lm.shipLate(late)
+			return
+		}
+	}
+	lm.publishJob(job)
+}
+
+// shipLate waits up to shadowWait for the log's shadow score, then ships
+// it with the score or without it.
+func (lm *LoggerMiddleware) shipLate(job *shipJob) {
+	defer lm.late.Done()
+	defer job.release()
+	select {
+	case score := <-job.shadow:
+		job.setShadow(score)
+	case <-time.After(shadowWait):
+		log.Printf("[Scoring] Shadow score for %s not ready, logging without it", job.entry.ClientIP)
+	}
+	lm.publishJob(job)
+}
+
+// setShadow adds the challenger's score, nil if it failed, to the log.
+func (job *shipJob) setShadow(score *RiskScore) {
+	if score != nil {
+		job.entry.ShadowScore = &score.Value
+		job.entry.ShadowDecision = score.Decision
+		job.entry.ShadowModel = score.Model
+	}
+}
+
+// publishJob publishes the log entry and feature vector of job.
+func (lm *LoggerMiddleware) publishJob(job *shipJob) {
+	entry, tenant := &job.entry, job.tenant
+
+	accessLogTopic, featureTopic := lm.opts.AccessLogTopic, lm.opts.FeatureTopic
+	if tenant != nil && tenant.AccessLogTopic != "" {
+		accessLogTopic = tenant.AccessLogTopic
+	}
+	if tenant != nil && tenant.FeatureTopic != "" {
+		featureTopic = tenant.FeatureTopic
+	}
+
+	lm.publish(accessLogTopic, entry.ClientIP, entry)
+
+	if featureTopic != "" {
+		job.vector = FeatureVector{
+			Timestamp: entry.Timestamp,
+			ClientIP:  entry.ClientIP,
+			Tenant:    entry.Tenant,
+			ModelID:   entry.ModelID,
+			Features:  job.features,
+			WAF:       entry.WAF,
+
+			SchemaViolations:  entry.SchemaViolations,
+			ProtocolAnomalies: entry.ProtocolAnomalies,
+			OffSchedule:       entry.OffSchedule,
+			Travel:            entry.Travel,
+			Familiarity:       entry.Familiarity,
+		}
+		lm.publish(featureTopic, entry.ClientIP, &job.vector)
+	}
+}
+
+// publish serializes v and sends it keyed by client IP for partition locality.
+func (lm *LoggerMiddleware) publish(topic, clientIP string, v interface{}) {
+	if err := publishJSON(lm.sink, topic, clientIP, v); err != nil {
+		log.Printf("Failed to send event to %s: %v", topic, err)
+	}
+}
+
+// responseWriterWrapper captures HTTP status code and response size.
+type responseWriterWrapper struct {
+	http.ResponseWriter
+	statusCode   int
+	responseSize int64
+}
+
+func (w *responseWriterWrapper) WriteHeader(code int) {
+	w.statusCode = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriterWrapper) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.responseSize += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// streamed responses are flushed and transfer deadlines can be moved.
+func (w *responseWriterWrapper) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// recordingSink passes published events to a channel.
+type recordingSink struct {
+	events chan RequestLog
+}
+
+func (s recordingSink) Publish(topic, key string, value []byte) error {
+	var entry RequestLog
+	if err := json.Unmarshal(value, &entry); err != nil {
+		return err
+	}
+	s.events <- entry
+	return nil
+}
+
+func (recordingSink) Close() error { return nil }
+
+func TestShipLogDoesNotWaitForShadow(t *testing.T) {
+	sink := recordingSink{events: make(chan RequestLog, 4)}
+	lm := NewLoggerMiddleware(sink, LoggerOptions{AccessLogTopic: "logs", ShipWorkers: 1, ShipQueueSize: 4})
+
+	shadow := make(chan *RiskScore, 1)
+	slow := newShipJob()
+	slow.entry = RequestLog{ClientIP: "198.51.100.1"}
+	slow.shadow = shadow
+	lm.queue.enqueue(slow)
+	ready := make(chan *RiskScore, 1)
+	ready <- &RiskScore{Value: 0.25, Model: "challenger"}
+	fast := newShipJob()
+	fast.entry = RequestLog{ClientIP: "198.51.100.2"}
+	fast.shadow = ready
+	lm.queue.enqueue(fast)
+
+	// The only worker ships the second log while the first waits
+	select {
+	case entry := <-sink.events:
+		if entry.ClientIP != "198.51.100.2" {
+			t.Fatalf("shipped %s first, want the log whose shadow score is ready", entry.ClientIP)
+		}
+		if entry.ShadowScore == nil || *entry.ShadowScore != 0.25 || entry.ShadowModel != "challenger" {
+			t.Errorf("ready shadow score not attached: %+v", entry)
+		}
+	case <-time.After(shadowWait / 2):
+		t.Fatal("worker waited for a pending shadow score")
+	}
+
+	shadow <- &RiskScore{Value: 0.75, Decision: ActionChallenge}
+	select {
+	case entry := <-sink.events:
+		if entry.ClientIP != "198.51.100.1" || entry.ShadowScore == nil || *entry.ShadowScore != 0.75 || entry.ShadowDecision != ActionChallenge {
+			t.Errorf("late log %+v, want it with its shadow score", entry)
+		}
+	case <-time.After(shadowWait):
+		t.Fatal("late log not shipped")
+	}
+
+	// Close waits for a log whose score never comes, which ships without it
+	never := newShipJob()
+	never.entry = RequestLog{ClientIP: "198.51.100.3"}
+	never.shadow = make(chan *RiskScore)
+	lm.queue.enqueue(never)
+	lm.Close()
+	select {
+	case entry := <-sink.events:
+		if entry.ClientIP != "198.51.100.3" || entry.ShadowScore != nil {
+			t.Errorf("log %+v, want the last one without a shadow score", entry)
+		}
+	default:
+		t.Fatal("log waiting for its shadow score dropped on close")
+	}
+}
@@ -0,0 +1,50 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+// MaintenanceMiddleware answers every request with the maintenance page
+// while enabled, without reaching the upstream. Health checks, metrics and
+// the admin API are served outside it and stay available.
+type MaintenanceMiddleware struct {
+	enabled    atomic.Bool
+	retryAfter atomic.Int64 // Seconds
+}
+
+// NewMaintenanceMiddleware creates the middleware, initially enabled or not.
+func NewMaintenanceMiddleware(enabled bool, retryAfter time.Duration) *MaintenanceMiddleware {
+	m := &MaintenanceMiddleware{}
+	m.Set(enabled, retryAfter)
+	return m
+}
+
+// Set turns maintenance mode on or off and sets the Retry-After sent with it.
+func (m *MaintenanceMiddleware) Set(enabled bool, retryAfter time.Duration) {
+	m.retryAfter.Store(int64(retryAfter / time.Second))
+	m.enabled.Store(enabled)
+}
+
+// Enabled reports whether maintenance mode is on.
+func (m *MaintenanceMiddleware) Enabled() bool {
+	return m.enabled.Load()
+}
+
+// Handler wraps the proxy chain.
+func (m *MaintenanceMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.enabled.Load() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if seconds := m.retryAfter.Load(); seconds > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+		}
+		pages.WriteError(w, r, pages.ErrMaintenance)
+	})
+}
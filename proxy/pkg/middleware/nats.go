@@ -0,0 +1,467 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// NATSOptions configures a NATSSink.
+type NATSOptions struct {
+	URLs          []string // nats://host:4222 or tls://host:4222, tried in order
+	SubjectPrefix string   // Prepended to topics to form subjects, e.g. "aegis."
+	Token         string
+	User          string
+	Password      string
+	// AckTimeout bounds the wait for JetStream to store a message
+	AckTimeout time.Duration
+}
+
+// natsRetries is how many times a publish is attempted, reconnecting in
+// between, like the Kafka producer's retries.
+const natsRetries = 3
+
+var (
+	// errNATSClosed fails requests in flight when the connection is lost
+	errNATSClosed = errors.New("nats: connection closed")
+	// errNATSTimeout leaves the connection open: the server may be busy
+	errNATSTimeout = errors.New("nats: no reply")
+)
+
+// NATSSink publishes events to NATS JetStream, for sites too small to run
+// Kafka. A topic becomes the subject SubjectPrefix+topic, which a stream
+// must capture. Every publish waits for the stream's acknowledgement, and
+// carries a Nats-Msg-Id so a retry after a lost acknowledgement is stored
+// once. The key is sent in the Aegis-Key header; a stream is ordered, so
+// events of a key keep their order as in a Kafka partition.
+type NATSSink struct {
+	opts   NATSOptions
+	prefix string // Of message IDs, unique per process
+	seq    atomic.Uint64
+
+	mu   sync.Mutex
+	conn *natsConn
+}
+
+// natsConn is one connection to a server. Replies to requests arrive on a
+// subscription to inbox.*, matched to their request by the last token.
+type natsConn struct {
+	netConn net.Conn
+	inbox   string
+	next    atomic.Uint64 // Of reply tokens
+
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu      sync.Mutex
+	pending map[string]chan natsReply
+	closed  bool
+}
+
+type natsReply struct {
+	data   []byte
+	status string // From the headers, e.g. "503" when nothing answered
+	err    error
+}
+
+// NewNATSSink connects to the first server that answers.
+func NewNATSSink(opts NATSOptions) (*NATSSink, error) {
+	if len(opts.URLs) == 0 {
+		return nil, fmt.Errorf("no NATS servers")
+	}
+	if opts.AckTimeout <= 0 {
+		opts.AckTimeout = 5 * time.Second
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	s := &NATSSink{opts: opts, prefix: hex.EncodeToString(id)}
+	if _, err := s.connection(); err != nil {
+		return nil, err
+	}
+	log.Printf("[NATS] Connected publisher to %v", opts.URLs)
+	return s, nil
+}
+
+// natsHeaderValue strips the line breaks out of a header value.
+var natsHeaderValue = strings.NewReplacer("\r", "", "\n", "")
+
+// Publish sends a single message to JetStream and waits for it to be
+// stored.
+func (s *NATSSink) Publish(topic, key string, value []byte) error {
+	headers := "NATS/1.0\r\nNats-Msg-Id: " + s.prefix + "-" + strconv.FormatUint(s.seq.Add(1), 36) + "\r\n"
+	// A line break in the key would end the header early
+	if key = natsHeaderValue.Replace(key); key != "" {
+		headers += "Aegis-Key: " + key + "\r\n"
+	}
+	headers += "\r\n"
+
+	var err error
+	for attempt := 0; attempt < natsRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		var c *natsConn
+		if c, err = s.connection(); err != nil {
+			continue
+		}
+		var reply natsReply
+		reply, err = c.request(s.opts.SubjectPrefix+topic, headers, value, s.opts.AckTimeout)
+		if err != nil {
+			if !errors.Is(err, errNATSTimeout) {
+				s.drop(c)
+			}
+			continue
+		}
+		return publishAck(s.opts.SubjectPrefix+topic, reply)
+	}
+	return err
+}
+
+// publishAck reads JetStream's answer to a publish to subject.
+func publishAck(subject string, reply natsReply) error {
+	if reply.status == "503" {
+		return fmt.Errorf("nats: no stream captures %s", subject)
+	}
+	var ack struct {
+		Stream string `json:"stream"`
+		Error  *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(reply.data, &ack); err != nil {
+		return fmt.Errorf("nats: invalid publish acknowledgement: %w", err)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("nats: %s (%d)", ack.Error.Description, ack.Error.Code)
+	}
+	return nil
+}
+
+// Check verifies that a server can be reached and that a JetStream stream
+// captures the subject of topic.
+func (s *NATSSink) Check(topic string) error {
+	c, err := s.connection()
+	if err != nil {
+		return err
+	}
+	subject := s.opts.SubjectPrefix + topic
+	body, _ := json.Marshal(map[string]string{"subject": subject})
+	reply, err := c.request("$JS.API.STREAM.NAMES", "", body, s.opts.AckTimeout)
+	if err != nil {
+		if !errors.Is(err, errNATSTimeout) {
+			s.drop(c)
+		}
+		return err
+	}
+	if reply.status == "503" {
+		return fmt.Errorf("nats: JetStream is not enabled")
+	}
+	var names struct {
+		Streams []string `json:"streams"`
+	}
+	if err := json.Unmarshal(reply.data, &names); err != nil {
+		return fmt.Errorf("nats: invalid stream list: %w", err)
+	}
+	if len(names.Streams) == 0 {
+		return fmt.Errorf("nats: no stream captures %s", subject)
+	}
+	return nil
+}
+
+// Close closes the connection.
+func (s *NATSSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.netConn.Close()
+	s.conn = nil
+	return err
+}
+
+// connection returns the current connection, connecting to the servers in
+// turn if there is none.
+func (s *NATSSink) connection() (*natsConn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil && !s.conn.isClosed() {
+		return s.conn, nil
+	}
+	var errs []error
+	for _, server := range s.opts.URLs {
+		c, err := s.dial(server)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", server, err))
+			continue
+		}
+		s.conn = c
+		return c, nil
+	}
+	return nil, errors.Join(errs...)
+}
+
+// drop closes a connection that failed, so the next publish reconnects.
+func (s *NATSSink) drop(c *natsConn) {
+	c.netConn.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == c {
+		s.conn = nil
+	}
+}
+
+// dial connects to a server: it reads the server's INFO, upgrades to TLS
+// if asked to, authenticates with CONNECT, waits for the PONG confirming
+// it, and subscribes to the inbox.
+func (s *NATSSink) dial(server string) (*natsConn, error) {
+	u, err := url.Parse(server)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid NATS URL")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	netConn, err := net.DialTimeout("tcp", host, s.opts.AckTimeout)
+	if err != nil {
+		return nil, err
+	}
+	netConn.SetDeadline(time.Now().Add(s.opts.AckTimeout))
+	r := bufio.NewReader(netConn)
+
+	line, err := readNATSLine(r)
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+		Headers     bool `json:"headers"`
+		JetStream   bool `json:"jetstream"`
+	}
+	if payload, ok := strings.CutPrefix(line, "INFO "); !ok || json.Unmarshal([]byte(payload), &info) != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("unexpected greeting %q", line)
+	}
+	if !info.Headers {
+		netConn.Close()
+		return nil, fmt.Errorf("server doesn't support headers (NATS 2.2+ is required)")
+	}
+	if u.Scheme == "tls" || info.TLSRequired {
+		tlsConn := tls.Client(netConn, &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12})
+		if err := tlsConn.Handshake(); err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		netConn = tlsConn
+		r = bufio.NewReader(netConn)
+	}
+
+	connect := map[string]interface{}{
+		"verbose": false, "pedantic": false, "headers": true, "no_responders": true,
+		"name": "aegis-zero-proxy", "lang": "go", "version": "1.0", "protocol": 1,
+	}
+	user, password := s.opts.User, s.opts.Password
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if user != "" {
+		connect["user"], connect["pass"] = user, password
+	}
+	if s.opts.Token != "" {
+		connect["auth_token"] = s.opts.Token
+	}
+	payload, _ := json.Marshal(connect)
+	inbox := "_INBOX." + s.prefix + strconv.FormatUint(s.seq.Add(1), 36)
+	fmt.Fprintf(netConn, "CONNECT %s\r\nPING\r\nSUB %s.* 1\r\n", payload, inbox)
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			netConn.Close()
+			return nil, fmt.Errorf("server refused connection: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+	if !info.JetStream {
+		log.Printf("[NATS] %s doesn't report JetStream; publishes will fail", server)
+	}
+	netConn.SetDeadline(time.Time{})
+
+	c := &natsConn{
+		netConn: netConn,
+		inbox:   inbox,
+		w:       bufio.NewWriter(netConn),
+		pending: make(map[string]chan natsReply),
+	}
+	go c.read(r)
+	return c, nil
+}
+
+// request publishes payload with the given headers, if any, and waits for
+// the reply.
+func (c *natsConn) request(subject, headers string, payload []byte, timeout time.Duration) (natsReply, error) {
+	ch := make(chan natsReply, 1)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return natsReply{}, errNATSClosed
+	}
+	token := strconv.FormatUint(c.next.Add(1), 36)
+	c.pending[token] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, token)
+		c.mu.Unlock()
+	}()
+
+	reply := c.inbox + "." + token
+	c.wmu.Lock()
+	var err error
+	if headers == "" {
+		_, err = fmt.Fprintf(c.w, "PUB %s %s %d\r\n", subject, reply, len(payload))
+	} else {
+		_, err = fmt.Fprintf(c.w, "HPUB %s %s %d %d\r\n%s", subject, reply, len(headers), len(headers)+len(payload), headers)
+	}
+	if err == nil {
+		c.w.Write(payload)
+		c.w.WriteString("\r\n")
+		err = c.w.Flush()
+	}
+	c.wmu.Unlock()
+	if err != nil {
+		return natsReply{}, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r, r.err
+	case <-timer.C:
+		return natsReply{}, fmt.Errorf("%w within %s", errNATSTimeout, timeout)
+	}
+}
+
+// read handles what the server sends until the connection fails: replies,
+// and PINGs to answer.
+func (c *natsConn) read(r *bufio.Reader) {
+	err := c.readLoop(r)
+	c.mu.Lock()
+	c.closed = true
+	for _, ch := range c.pending {
+		ch <- natsReply{err: errNATSClosed}
+	}
+	c.mu.Unlock()
+	c.netConn.Close()
+	if !errors.Is(err, net.ErrClosed) {
+		log.Printf("[NATS] Connection lost: %v", err)
+	}
+}
+
+func (c *natsConn) readLoop(r *bufio.Reader) error {
+	for {
+		line, err := readNATSLine(r)
+		if err != nil {
+			return err
+		}
+		op, args, _ := strings.Cut(line, " ")
+		op = strings.ToUpper(op)
+		switch op {
+		case "PING":
+			c.wmu.Lock()
+			c.w.WriteString("PONG\r\n")
+			err = c.w.Flush()
+			c.wmu.Unlock()
+			if err != nil {
+				return err
+			}
+		case "-ERR":
+			log.Printf("[NATS] Server error: %s", args)
+		case "MSG", "HMSG":
+			// MSG <subject> <sid> [reply] <size>
+			// HMSG <subject> <sid> [reply] <header size> <total size>
+			fields := strings.Fields(args)
+			if len(fields) < 3 {
+				return fmt.Errorf("malformed %s", op)
+			}
+			total, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil || total < 0 {
+				return fmt.Errorf("malformed %s", op)
+			}
+			data := make([]byte, total+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return err
+			}
+			reply := natsReply{data: data[:total]}
+			if op == "HMSG" {
+				headerSize, err := strconv.Atoi(fields[len(fields)-2])
+				if err != nil || headerSize < 0 || headerSize > total {
+					return fmt.Errorf("malformed %s", op)
+				}
+				reply.status = natsStatus(data[:headerSize])
+				reply.data = data[headerSize:total]
+			}
+			c.deliver(fields[0], reply)
+		}
+	}
+}
+
+// deliver passes a reply to the request waiting for it.
+func (c *natsConn) deliver(subject string, reply natsReply) {
+	token := strings.TrimPrefix(subject, c.inbox+".")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ch, ok := c.pending[token]; ok {
+		ch <- reply
+		delete(c.pending, token)
+	}
+}
+
+func (c *natsConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// natsStatus returns the status code of a header block, as "NATS/1.0 503".
+func natsStatus(headers []byte) string {
+	line, _, _ := bytes.Cut(headers, []byte("\r\n"))
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 {
+		return ""
+	}
+	return fields[1]
+}
+
+// readNATSLine reads a protocol line without its CRLF.
+func readNATSLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNATSReadLoopHeaders(t *testing.T) {
+	c := &natsConn{inbox: "_INBOX.test", pending: make(map[string]chan natsReply)}
+	replies := make(map[string]chan natsReply)
+	for _, token := range []string{"1", "2"} {
+		replies[token] = make(chan natsReply, 1)
+		c.pending[token] = replies[token]
+	}
+
+	// Servers may send operations in any case
+	headers := "NATS/1.0 503\r\n\r\n"
+	sizes := strconv.Itoa(len(headers)) + " " + strconv.Itoa(len(headers)+2)
+	stream := "HMSG _INBOX.test.1 1 " + sizes + "\r\n" + headers + "ok\r\n" +
+		"hmsg _INBOX.test.2 1 " + sizes + "\r\n" + headers + "ok\r\n"
+	if err := c.readLoop(bufio.NewReader(strings.NewReader(stream))); err != io.EOF {
+		t.Fatalf("readLoop = %v, want EOF", err)
+	}
+	for token, ch := range replies {
+		reply := <-ch
+		if reply.status != "503" || string(reply.data) != "ok" {
+			t.Errorf("reply %s = status %q, data %q, want 503 and the payload without headers", token, reply.status, reply.data)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var pathAnomalies = metrics.NewCounterVec("aegis_path_anomalies_total",
+	"Requests with abnormally encoded or non-canonical paths, by anomaly.", "anomaly")
+
+// unresolvable are anomalies refused even when normalizing: the path means
+// something else to an upstream decoding more, or decoding encoded
+// separators, than route matching does.
+var unresolvable = []string{"path_double_encoded_dot_segment", "path_encoded_traversal"}
+
+// Path normalization modes.
+const (
+	PathNormalize = "normalize" // Rewrite to the canonical path and flag
+	PathStrict    = "strict"    // Refuse non-canonical paths
+	PathOff       = "off"
+)
+
+// PathMiddleware rewrites request paths to their canonical form before any
+// stage sees them, so routes, policies and the upstream agree on what was
+// asked for: /admin/%2e%2e/users matched against an /admin prefix is
+// /users to the upstream. Dot segments are resolved, empty segments
+// dropped and encodings left as sent otherwise, so encoded slashes in a
+// segment stay encoded. What was abnormal goes to the protocol anomalies.
+type PathMiddleware struct {
+	mode    string
+	auditor *Auditor
+}
+
+// NewPathMiddleware creates the path normalization handler for a mode.
+func NewPathMiddleware(mode string, auditor *Auditor) *PathMiddleware {
+	return &PathMiddleware{mode: mode, auditor: auditor}
+}
+
+// Handler returns the middleware handler
+func (m *PathMiddleware) Handler(next http.Handler) http.Handler {
+	if m.mode == PathOff {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || !strings.HasPrefix(r.URL.Path, "/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		raw, anomalies := normalizePath(r.URL.EscapedPath())
+		if len(anomalies) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, anomaly := range anomalies {
+			pathAnomalies.Inc(anomaly)
+		}
+		addProtocolAnomalies(r.Context(), anomalies...)
+		// Double-encoded dot segments and dot segments behind encoded
+		// separators can't be resolved without guessing how the upstream
+		// decodes; no client sends them by accident
+		refused := slices.ContainsFunc(anomalies, func(a string) bool { return slices.Contains(unresolvable, a) })
+		if m.mode == PathNormalize && !refused {
+			if raw != r.URL.EscapedPath() {
+				logging.For(r.Context()).Infof("[Path] Normalized %s to %s from %s: %v", r.URL.EscapedPath(), raw, clientIP(r), anomalies)
+				setPath(r.URL, raw)
+			} else {
+				logging.For(r.Context()).Infof("[Path] Anomalies in %s from %s: %v", raw, clientIP(r), anomalies)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		logging.For(r.Context()).Infof("[Path] REJECTED %s %s from %s: %v", r.Method, r.URL.EscapedPath(), clientIP(r), anomalies)
+		m.auditor.Record(AuditEvent{
+			ClientIP:  clientIP(r),
+			Tenant:    tenantName(r.Context()),
+			RequestID: logging.RequestID(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    http.StatusBadRequest,
+			Stage:     "path",
+			Reason:    strings.Join(anomalies, ","),
+		})
+		pages.WriteError(w, r, pages.ErrProtocolAnomaly)
+	})
+}
+
+// normalizePath resolves the dot segments of an escaped path and drops its
+// empty ones, returning the canonical escaped path and what was abnormal.
+// Segments are kept as sent, so "a%2Fb" stays one segment.
+func normalizePath(escaped string) (string, []string) {
+	found := make(map[string]bool)
+	segments := strings.Split(escaped[1:], "/")
+	kept := make([]string, 0, len(segments))
+	trailing := false
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		decoded, err := url.PathUnescape(segment)
+		if err != nil {
+			decoded = segment
+		}
+		trailing = false
+		switch decoded {
+		case "":
+			if !last {
+				found["path_empty_segment"] = true
+			}
+			trailing = last && len(kept) > 0
+			continue
+		case ".", "..":
+			if segment != decoded {
+				found["path_encoded_dot_segment"] = true
+			} else {
+				found["path_dot_segment"] = true
+			}
+			if decoded == ".." {
+				if len(kept) == 0 {
+					found["path_traversal_above_root"] = true
+				} else {
+					kept = kept[:len(kept)-1]
+				}
+			}
+			trailing = last
+			continue
+		}
+		if strings.ContainsAny(decoded, "/\\") {
+			found["path_encoded_slash"] = true
+			// /public/..%2fadmin is one segment to route matching but
+			// /admin to an upstream decoding %2F
+			if hasDotSegment(decoded) {
+				found["path_encoded_traversal"] = true
+			}
+		}
+		if twice, err := url.PathUnescape(decoded); err == nil && twice != decoded {
+			found["path_double_encoding"] = true
+			if twice == "." || twice == ".." || strings.Contains(twice, "../") || strings.Contains(twice, "..\\") {
+				found["path_double_encoded_dot_segment"] = true
+			}
+		}
+		if !utf8.ValidString(decoded) {
+			found["path_invalid_utf8"] = true
+		}
+		kept = append(kept, segment)
+	}
+	if len(found) == 0 {
+		return escaped, nil
+	}
+
+	anomalies := make([]string, 0, len(found))
+	for anomaly := range found {
+		anomalies = append(anomalies, anomaly)
+	}
+	sort.Strings(anomalies)
+	raw := "/" + strings.Join(kept, "/")
+	if trailing && len(kept) > 0 {
+		raw += "/"
+	}
+	return raw, anomalies
+}
+
+// hasDotSegment reports whether a decoded segment has a "." or ".." part
+// between its slashes or backslashes.
+func hasDotSegment(decoded string) bool {
+	for _, part := range strings.FieldsFunc(decoded, func(c rune) bool { return c == '/' || c == '\\' }) {
+		if part == "." || part == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// setPath replaces the path of u with an escaped one, keeping its escaping.
+func setPath(u *url.URL, escaped string) {
+	path, err := url.PathUnescape(escaped)
+	if err != nil {
+		return
+	}
+	u.Path, u.RawPath = path, escaped
+	if u.EscapedPath() != escaped {
+		u.RawPath = ""
+	}
+}
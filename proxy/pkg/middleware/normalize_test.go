@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct {
+		path      string
+		want      string
+		anomalies []string
+	}{
+		{"/orders/7", "/orders/7", nil},
+		{"/admin/../users", "/users", []string{"path_dot_segment"}},
+		{"/admin/%2e%2e/users", "/users", []string{"path_encoded_dot_segment"}},
+		{"/a/./b/", "/a/b/", []string{"path_dot_segment"}},
+		{"/../etc", "/etc", []string{"path_dot_segment", "path_traversal_above_root"}},
+		{"/a//b", "/a/b", []string{"path_empty_segment"}},
+		{"/files/a%2Fb", "/files/a%2Fb", []string{"path_encoded_slash"}},
+		{"/public/..%2fadmin", "/public/..%2fadmin", []string{"path_encoded_slash", "path_encoded_traversal"}},
+		{"/public/..%5cadmin", "/public/..%5cadmin", []string{"path_encoded_slash", "path_encoded_traversal"}},
+		{"/public/x%2f..%2f..%2fadmin", "/public/x%2f..%2f..%2fadmin", []string{"path_encoded_slash", "path_encoded_traversal"}},
+		{"/public/.%2fadmin", "/public/.%2fadmin", []string{"path_encoded_slash", "path_encoded_traversal"}},
+		{"/files/v1..v2%2fdiff", "/files/v1..v2%2fdiff", []string{"path_encoded_slash"}},
+		{"/a/%252e%252e/b", "/a/%252e%252e/b", []string{"path_double_encoded_dot_segment", "path_double_encoding"}},
+		{"/a/%c0%ae", "/a/%c0%ae", []string{"path_invalid_utf8"}},
+	}
+	for _, tt := range tests {
+		got, anomalies := normalizePath(tt.path)
+		if got != tt.want || !slices.Equal(anomalies, tt.anomalies) {
+			t.Errorf("normalizePath(%q) = %q, %v, want %q, %v", tt.path, got, anomalies, tt.want, tt.anomalies)
+		}
+	}
+}
+
+// TestPathEncodedTraversal checks that a dot segment behind an encoded
+// slash can't put a request under one route for the routes stage and
+// under another for the upstream.
+func TestPathEncodedTraversal(t *testing.T) {
+	routes := NewRoutePolicies(nil, func() bool { return true })
+	routes.Update([]RoutePolicy{{Prefix: "/public", AuthNone: true}, {Prefix: "/admin"}}, nil)
+
+	tests := []struct {
+		path string
+		mode string
+		want int
+	}{
+		{"/public/..%2fadmin", PathNormalize, http.StatusBadRequest},
+		{"/public/..%2Fadmin/users", PathNormalize, http.StatusBadRequest},
+		{"/public/..%5cadmin", PathNormalize, http.StatusBadRequest},
+		{"/public/..%2fadmin", PathStrict, http.StatusBadRequest},
+		{"/public/../admin", PathNormalize, http.StatusOK}, // Resolved to /admin before matching
+		{"/public/a%2fb", PathNormalize, http.StatusOK},
+	}
+	for _, tt := range tests {
+		var matched string
+		h := NewPathMiddleware(tt.mode, nil).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if p := routes.Match(r.URL.Path); p != nil {
+				matched = p.Prefix
+			}
+		}))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if rec.Code != tt.want {
+			t.Errorf("%s %s: status = %d, want %d", tt.mode, tt.path, rec.Code, tt.want)
+		}
+		if tt.path == "/public/../admin" && matched != "/admin" {
+			t.Errorf("%s: matched route %q, want /admin", tt.path, matched)
+		}
+	}
+}
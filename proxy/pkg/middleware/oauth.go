@@ -0,0 +1,57 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errTokenRejected marks token requests the IdP refused, e.g. with
+// invalid_grant, as opposed to requests that failed.
+var errTokenRejected = errors.New("token request rejected")
+
+// tokenResponse is an OAuth 2.0 token endpoint's answer.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// requestToken posts a token request to endpoint, authenticating as
+// clientID with HTTP basic auth.
+func requestToken(ctx context.Context, client *http.Client, endpoint, clientID, clientSecret string, form url.Values) (*tokenResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(clientSecret))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result tokenResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("invalid token endpoint response: %w", err)
+	}
+	switch {
+	case resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusForbidden:
+		return nil, fmt.Errorf("%w: %s", errTokenRejected, strings.TrimSpace(result.Error+" "+result.ErrorDescription))
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("token endpoint returned %d %s", resp.StatusCode, result.Error)
+	case result.AccessToken == "":
+		return nil, fmt.Errorf("token endpoint returned no access_token")
+	}
+	return &result, nil
+}
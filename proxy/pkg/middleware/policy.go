@@ -0,0 +1,200 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var policyDecisions = metrics.NewCounterVec("aegis_policy_decisions_total",
+	"Authorization decisions of the OPA policy by result: allow, deny or error.", "result")
+
+// PolicyInput is the input document of the authorization policy, available
+// to Rego as input.
+type PolicyInput struct {
+	Method     string                 `json:"method"`
+	Path       string                 `json:"path"`
+	Query      map[string][]string    `json:"query,omitempty"`
+	Host       string                 `json:"host"`
+	Headers    map[string]string      `json:"headers,omitempty"` // Lower-case names, without credentials
+	ClientIP   string                 `json:"client_ip"`
+	Tenant     string                 `json:"tenant,omitempty"`
+	Subject    string                 `json:"subject,omitempty"`
+	Claims     map[string]interface{} `json:"claims,omitempty"` // Verified by the jwt stage
+	ClientCert *PolicyCert            `json:"client_cert,omitempty"`
+	Risk       *RiskScore             `json:"risk,omitempty"` // Set when the scoring stage ran first
+}
+
+// PolicyCert is the identity of the client certificate.
+type PolicyCert struct {
+	CommonName   string   `json:"common_name"`
+	Organization []string `json:"organization,omitempty"`
+	DNSNames     []string `json:"dns_names,omitempty"`
+	URIs         []string `json:"uris,omitempty"` // e.g. SPIFFE IDs
+	Issuer       string   `json:"issuer"`
+	Serial       string   `json:"serial"`
+}
+
+// policyResult is the policy's decision: a boolean, or an object that may
+// also set the status and reason of a denial.
+type policyResult struct {
+	Allow  bool   `json:"allow"`
+	Status int    `json:"status"`
+	Reason string `json:"reason"`
+}
+
+func (p *policyResult) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.Allow); err == nil {
+		return nil
+	}
+	type plain policyResult
+	return json.Unmarshal(data, (*plain)(p))
+}
+
+// PolicyOptions configures the policy stage.
+type PolicyOptions struct {
+	// URL is the OPA Data API document deciding requests, e.g.
+	// http://localhost:8181/v1/data/aegis/authz
+	URL      string
+	Timeout  time.Duration
+	FailOpen bool // Allow requests when OPA can't be reached
+	Auditor  *Auditor
+}
+
+// PolicyMiddleware asks an OPA sidecar whether to allow each request, so
+// authorization rules live in one Rego policy instead of being spread across
+// stages.
+type PolicyMiddleware struct {
+	opts   PolicyOptions
+	client *http.Client
+}
+
+// NewPolicyMiddleware creates the policy stage.
+func NewPolicyMiddleware(opts PolicyOptions) *PolicyMiddleware {
+	return &PolicyMiddleware{opts: opts, client: &http.Client{Timeout: opts.Timeout}}
+}
+
+// Handler returns the middleware handler
+func (p *PolicyMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		input := policyInput(r)
+		result, err := p.evaluate(r.Context(), input)
+		if err != nil {
+			policyDecisions.Inc("error")
+			logging.For(r.Context()).Warnf("[Policy] Evaluation failed for %s %s: %v", r.Method, r.URL.Path, err)
+			if p.opts.FailOpen {
+				next.ServeHTTP(w, r)
+				return
+			}
+			pages.WriteError(w, r, pages.ErrUnavailable)
+			return
+		}
+		if result.Allow {
+			policyDecisions.Inc("allow")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		policyDecisions.Inc("deny")
+		status := result.Status
+		if status < 400 || status > 599 {
+			status = http.StatusForbidden
+		}
+		logging.For(r.Context()).Infof("[Policy] DENIED %s %s for %s: %s", r.Method, r.URL.Path, input.ClientIP, result.Reason)
+		noteDecision(r.Context(), "opa", OutcomeDeny, result.Reason)
+		p.opts.Auditor.Record(AuditEvent{
+			ClientIP:  input.ClientIP,
+			Subject:   input.Subject,
+			Tenant:    input.Tenant,
+			RequestID: logging.RequestID(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    status,
+			Stage:     "opa",
+			Reason:    result.Reason,
+		})
+		pages.Write(w, r, status, pages.CodePolicyDenied, http.StatusText(status)+" - Denied by Policy")
+	})
+}
+
+// evaluate queries the policy document with the input.
+func (p *PolicyMiddleware) evaluate(ctx context.Context, input *PolicyInput) (*policyResult, error) {
+	body, err := json.Marshal(map[string]interface{}{"input": input})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.opts.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OPA returned %s", resp.Status)
+	}
+
+	var decoded struct {
+		Result *policyResult `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("invalid OPA response: %w", err)
+	}
+	if decoded.Result == nil {
+		// The document is undefined, e.g. the policy isn't loaded
+		return nil, fmt.Errorf("policy document is undefined")
+	}
+	return decoded.Result, nil
+}
+
+// policyInput collects what the policy can decide on.
+func policyInput(r *http.Request) *PolicyInput {
+	input := &PolicyInput{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Host:     r.Host,
+		ClientIP: clientIP(r),
+		Tenant:   tenantName(r.Context()),
+		Subject:  subjectFromContext(r.Context()),
+		Claims:   claimsFromContext(r.Context()),
+		Risk:     scoreFromContext(r.Context()),
+		Headers:  make(map[string]string, len(r.Header)),
+	}
+	if len(r.URL.RawQuery) > 0 {
+		input.Query = r.URL.Query()
+	}
+	for name, values := range r.Header {
+		switch name {
+		case "Authorization", "Cookie", "Proxy-Authorization":
+			continue
+		}
+		input.Headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		input.ClientCert = &PolicyCert{
+			CommonName:   cert.Subject.CommonName,
+			Organization: cert.Subject.Organization,
+			DNSNames:     cert.DNSNames,
+			Issuer:       cert.Issuer.CommonName,
+			Serial:       cert.SerialNumber.String(),
+		}
+		for _, uri := range cert.URIs {
+			input.ClientCert.URIs = append(input.ClientCert.URIs, uri.String())
+		}
+	}
+	return input
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// maxPooledBuffer keeps unusually large encodings from being held by the pool.
+const maxPooledBuffer = 64 << 10
+
+// jsonBuffer is an encoding buffer with an encoder writing to it.
+type jsonBuffer struct {
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+var jsonBuffers = sync.Pool{New: func() interface{} {
+	b := new(jsonBuffer)
+	b.enc = json.NewEncoder(&b.buf)
+	return b
+}}
+
+// publishJSON encodes v into a pooled buffer and publishes it. Sinks don't
+// keep values once Publish returns, so the buffer is reused right away.
+func publishJSON(sink EventSink, topic, key string, v interface{}) error {
+	b := jsonBuffers.Get().(*jsonBuffer)
+	defer func() {
+		if b.buf.Cap() <= maxPooledBuffer {
+			jsonBuffers.Put(b)
+		}
+	}()
+
+	b.buf.Reset()
+	if err := b.enc.Encode(v); err != nil {
+		return fmt.Errorf("marshalling event: %w", err)
+	}
+	// Encode terminates values with a newline that Marshal doesn't add
+	return sink.Publish(topic, key, bytes.TrimSuffix(b.buf.Bytes(), []byte("\n")))
+}
@@ -0,0 +1,78 @@
+package middleware
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RouteProfile selects the model and response policy for requests under a path prefix.
+type RouteProfile struct {
+	Prefix  string
+	ModelID string
+	Policy  *ResponsePolicy // nil inherits the default policy
+	// SampleRate is the fraction of the route's allowed requests logged;
+	// nil inherits the default rate
+	SampleRate *float64
+}
+
+// RouteProfiles matches request paths to scoring profiles.
+type RouteProfiles struct {
+	mu       sync.RWMutex
+	profiles []RouteProfile // Longest prefix first
+	fallback *RouteProfile
+}
+
+// NewRouteProfiles creates a matcher. The fallback applies to unmatched paths
+// and supplies the policy for profiles that don't set their own.
+func NewRouteProfiles(fallback RouteProfile, profiles []RouteProfile) *RouteProfiles {
+	rp := &RouteProfiles{}
+	rp.Update(fallback, profiles)
+	return rp
+}
+
+// Update replaces the profiles. Requests already holding a matched profile
+// keep using it.
+func (rp *RouteProfiles) Update(fallback RouteProfile, profiles []RouteProfile) {
+	sorted := make([]RouteProfile, 0, len(profiles))
+	for _, p := range profiles {
+		if p.Policy == nil {
+			p.Policy = fallback.Policy
+		}
+		if p.ModelID == "" {
+			p.ModelID = fallback.ModelID
+		}
+		if p.SampleRate == nil {
+			p.SampleRate = fallback.SampleRate
+		}
+		sorted = append(sorted, p)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i].Prefix) > len(sorted[j].Prefix) })
+
+	rp.mu.Lock()
+	rp.profiles = sorted
+	rp.fallback = &fallback
+	rp.mu.Unlock()
+}
+
+// Match returns the profile with the longest prefix matching the path.
+func (rp *RouteProfiles) Match(path string) *RouteProfile {
+	rp.mu.RLock()
+	profiles, fallback := rp.profiles, rp.fallback
+	rp.mu.RUnlock()
+
+	for i := range profiles {
+		if matchPrefix(path, profiles[i].Prefix) {
+			return &profiles[i]
+		}
+	}
+	return fallback
+}
+
+// matchPrefix matches whole path segments, so /login doesn't match /loginx.
+func matchPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
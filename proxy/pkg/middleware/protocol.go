@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var protocolAnomalies = metrics.NewCounterVec("aegis_protocol_anomalies_total",
+	"Requests with HTTP protocol anomalies, by anomaly.", "anomaly")
+
+// singletonHeaders may appear once: duplicates are read differently by
+// different servers, which is what request smuggling and auth confusion
+// exploit.
+var singletonHeaders = map[string]string{
+	"Authorization":     "duplicate_authorization",
+	"Content-Type":      "duplicate_content_type",
+	"Origin":            "duplicate_origin",
+	"X-Forwarded-Host":  "duplicate_forwarded_host",
+	"X-Forwarded-Proto": "duplicate_forwarded_proto",
+}
+
+// maxHeaderValue bounds the size of headers whose legitimate values are short.
+var maxHeaderValue = map[string]int{
+	"Host":              255,
+	"Content-Type":      256,
+	"X-Forwarded-Host":  255,
+	"X-Forwarded-Proto": 16,
+	"Origin":            2048,
+}
+
+// ProtocolMiddleware refuses requests that are ambiguous at the HTTP level.
+// Go's parser already handles the framing conflicts behind request smuggling:
+// it rejects differing Content-Length headers and any Transfer-Encoding but a
+// single "chunked", drops Content-Length when a body is chunked and ignores
+// Transfer-Encoding on HTTP/1.0, and the reverse proxy re-frames every body
+// it forwards. This stage catches the ambiguities that remain visible to
+// handlers.
+type ProtocolMiddleware struct {
+	block   bool // Refuse anomalous requests; otherwise only report them
+	auditor *Auditor
+}
+
+// NewProtocolMiddleware creates the protocol stage.
+func NewProtocolMiddleware(block bool, auditor *Auditor) *ProtocolMiddleware {
+	return &ProtocolMiddleware{block: block, auditor: auditor}
+}
+
+// Handler returns the middleware handler
+func (m *ProtocolMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		anomalies := protocolChecks(r)
+		if len(anomalies) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		for _, anomaly := range anomalies {
+			protocolAnomalies.Inc(anomaly)
+		}
+		addProtocolAnomalies(r.Context(), anomalies...)
+		clientIP := clientIP(r)
+		if !m.block {
+			logging.For(r.Context()).Infof("[Protocol] Anomalies in %s %s from %s: %v", r.Method, r.URL.EscapedPath(), clientIP, anomalies)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		logging.For(r.Context()).Infof("[Protocol] REJECTED %s %s from %s: %v", r.Method, r.URL.EscapedPath(), clientIP, anomalies)
+		noteDecision(r.Context(), "protocol", OutcomeDeny, "", anomalies...)
+		m.auditor.Record(AuditEvent{
+			ClientIP:  clientIP,
+			Tenant:    tenantName(r.Context()),
+			RequestID: logging.RequestID(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    http.StatusBadRequest,
+			Stage:     "protocol",
+			Reason:    strings.Join(anomalies, ","),
+		})
+		// The connection may be desynchronized; don't reuse it
+		w.Header().Set("Connection", "close")
+		pages.WriteError(w, r, pages.ErrProtocolAnomaly)
+	})
+}
+
+// protocolChecks returns the names of the request's protocol anomalies.
+func protocolChecks(r *http.Request) []string {
+	var anomalies []string
+
+	// Absolute-form targets are for forward proxies; servers disagree on
+	// whether the target's host or the Host header wins
+	if r.Method != http.MethodConnect && r.RequestURI != "*" && r.RequestURI != "" && !strings.HasPrefix(r.RequestURI, "/") {
+		anomalies = append(anomalies, "absolute_form")
+	}
+
+	for name, anomaly := range singletonHeaders {
+		if len(r.Header[name]) > 1 {
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+	for name, limit := range maxHeaderValue {
+		value := r.Header.Get(name)
+		if name == "Host" {
+			value = r.Host
+		}
+		if len(value) > limit {
+			anomalies = append(anomalies, "oversized_"+strings.ToLower(strings.ReplaceAll(name, "-", "_")))
+		}
+	}
+
+	// Underscores are folded into dashes by some servers, smuggling headers
+	// such as X_Forwarded_For past filters checking the dashed name
+	for name := range r.Header {
+		if strings.ContainsRune(name, '_') {
+			anomalies = append(anomalies, "underscore_header")
+			break
+		}
+	}
+
+	if invalidTarget(r.RequestURI) {
+		anomalies = append(anomalies, "invalid_target")
+	}
+	sort.Strings(anomalies)
+	return anomalies
+}
+
+// invalidTarget reports raw bytes outside printable ASCII, backslashes and
+// encoded NUL, CR or LF in the request target.
+func invalidTarget(target string) bool {
+	for i := 0; i < len(target); i++ {
+		c := target[i]
+		if c < 0x21 || c > 0x7e || c == '\\' {
+			return true
+		}
+		if c == '%' && i+2 < len(target) {
+			switch strings.ToLower(target[i+1 : i+3]) {
+			case "00", "0a", "0d":
+				return true
+			}
+		}
+	}
+	return false
+}
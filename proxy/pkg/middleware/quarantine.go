@@ -0,0 +1,95 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+// quarantinePrefix is the Redis key prefix of quarantined client IPs.
+const quarantinePrefix = "quarantine:ip:"
+
+// SetQuarantinePaths sets the path prefixes quarantined clients may still
+// reach, such as logout and support pages. It is safe to call while serving.
+func (b *BlocklistMiddleware) SetQuarantinePaths(prefixes []string) {
+	b.quarantinePaths.Store(&prefixes)
+}
+
+// quarantineAllows reports whether path is open to quarantined clients.
+func (b *BlocklistMiddleware) quarantineAllows(path string) bool {
+	if prefixes := b.quarantinePaths.Load(); prefixes != nil {
+		for _, prefix := range *prefixes {
+			if matchPrefix(path, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// quarantineKeys returns the keys holding a client's global and tenant
+// quarantine entries.
+func quarantineKeys(ctx context.Context, clientIP string) []string {
+	keys := []string{quarantinePrefix + clientIP}
+	if prefix := tenantKeyPrefix(ctx); prefix != "" {
+		keys = append(keys, prefix+quarantinePrefix+clientIP)
+	}
+	return keys
+}
+
+// refuseQuarantined refuses a request from a quarantined client outside the
+// allowed paths.
+func (b *BlocklistMiddleware) refuseQuarantined(w http.ResponseWriter, r *http.Request, clientIP string) {
+	logging.For(r.Context()).Infof("[Blocklist] QUARANTINED IP: %s %s", clientIP, r.URL.Path)
+	noteDecision(r.Context(), "blocklist", OutcomeDeny, "IP in quarantine")
+	b.auditor.Record(AuditEvent{
+		ClientIP:  clientIP,
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    http.StatusForbidden,
+		Stage:     "blocklist",
+		Reason:    "IP in quarantine",
+	})
+	pages.WriteError(w, r, pages.ErrQuarantined)
+}
+
+// ListQuarantine returns the quarantined clients, scanning up to limit entries.
+func (b *BlocklistMiddleware) ListQuarantine(ctx context.Context, limit int) ([]BlockEntry, error) {
+	var entries []BlockEntry
+	prefix := tenantKeyPrefix(ctx) + quarantinePrefix
+	iter := b.client.Scan(ctx, 0, prefix+"*", 100).Iterator()
+	for iter.Next(ctx) && len(entries) < limit {
+		entry, err := b.GetQuarantine(ctx, strings.TrimPrefix(iter.Val(), prefix))
+		if err != nil {
+			return nil, err
+		}
+		if entry != nil {
+			entries = append(entries, *entry)
+		}
+	}
+	return entries, iter.Err()
+}
+
+// GetQuarantine returns the quarantine entry of a client, or nil if it isn't
+// quarantined.
+func (b *BlocklistMiddleware) GetQuarantine(ctx context.Context, clientIP string) (*BlockEntry, error) {
+	return b.entry(ctx, tenantKeyPrefix(ctx)+quarantinePrefix+clientIP, BlockEntry{ClientIP: clientIP})
+}
+
+// Quarantine confines a client to the quarantine paths; a zero ttl
+// quarantines it until released.
+func (b *BlocklistMiddleware) Quarantine(ctx context.Context, clientIP, reason string, ttl time.Duration) error {
+	return b.client.Set(ctx, tenantKeyPrefix(ctx)+quarantinePrefix+clientIP, blockValue(reason), ttl).Err()
+}
+
+// Release lifts a client's quarantine, reporting whether it was quarantined.
+func (b *BlocklistMiddleware) Release(ctx context.Context, clientIP string) (bool, error) {
+	n, err := b.client.Del(ctx, tenantKeyPrefix(ctx)+quarantinePrefix+clientIP).Result()
+	return n > 0, err
+}
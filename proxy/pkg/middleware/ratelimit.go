@@ -0,0 +1,169 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+// RateLimiter is a keyed token-bucket limiter.
+type RateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	consumed  map[string]float64 // Since the last TakeConsumed; nil until its first call
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a limiter allowing rate requests per second per key,
+// with bursts of up to burst requests.
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow reports whether a request for key may proceed, consuming a token if so.
+func (l *RateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+
+	// Refill based on elapsed time
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	if l.consumed != nil {
+		l.consumed[key]++
+	}
+	return true
+}
+
+// TakeConsumed returns the tokens taken per key since the previous call and
+// starts counting again. Counting starts with the first call, so limiters
+// that aren't shared don't pay for it.
+func (l *RateLimiter) TakeConsumed() map[string]float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	consumed := l.consumed
+	l.consumed = make(map[string]float64)
+	return consumed
+}
+
+// Consume takes tokens used elsewhere, e.g. by other replicas, from the
+// bucket of key. A bucket is never taken below empty.
+func (l *RateLimiter) Consume(key string, tokens float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds()*l.rate - tokens
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	if b.tokens < 0 {
+		b.tokens = 0
+	}
+	b.last = now
+}
+
+// SetLimits changes the rate and burst; existing buckets keep their tokens.
+func (l *RateLimiter) SetLimits(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate = rate
+	l.burst = float64(burst)
+}
+
+// sweep drops buckets that have refilled completely, bounding memory use.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimitMiddleware applies a per-client request rate limit to all traffic,
+// independent of risk scores.
+type RateLimitMiddleware struct {
+	limiter *RateLimiter
+	auditor *Auditor
+}
+
+// NewRateLimitMiddleware creates the rate-limit stage.
+func NewRateLimitMiddleware(limiter *RateLimiter, auditor *Auditor) *RateLimitMiddleware {
+	return &RateLimitMiddleware{limiter: limiter, auditor: auditor}
+}
+
+// Handler returns the middleware handler
+func (m *RateLimitMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := clientIP(r)
+
+		// Tenants with their own limit get their own limiter; buckets are
+		// per tenant either way
+		limiter := m.limiter
+		if tenant := tenantFromContext(r.Context()); tenant != nil && tenant.Limiter != nil {
+			limiter = tenant.Limiter
+		}
+
+		if !limiter.Allow(FlowKey(tenantName(r.Context()), clientIP)) {
+			logging.For(r.Context()).Infof("[RateLimit] RATE LIMITED IP: %s", clientIP)
+			noteDecision(r.Context(), "ratelimit", OutcomeDeny, "rate limit exceeded")
+			m.auditor.Record(AuditEvent{
+				ClientIP:  clientIP,
+				Tenant:    tenantName(r.Context()),
+				RequestID: logging.RequestID(r.Context()),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Status:    http.StatusTooManyRequests,
+				Stage:     "ratelimit",
+			})
+			w.Header().Set("Retry-After", "1")
+			pages.WriteError(w, r, pages.ErrRateLimited)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
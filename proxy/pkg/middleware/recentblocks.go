@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+)
+
+// recentBlockMax bounds how long a block is remembered locally. Redis stays
+// the source of truth; this only covers the time a block takes to reach the
+// replicas, and Redis outages while failing open.
+const recentBlockMax = 10 * time.Minute
+
+// RecentBlocks remembers the clients blocked recently, by their blocklist
+// key, so they are refused without waiting for Redis. Blocks made by this
+// replica are passed to OnBlock, and those of other replicas are added
+// with Add when cluster coordination is enabled.
+type RecentBlocks struct {
+	mu      sync.RWMutex
+	expires map[string]time.Time
+
+	// OnBlock and OnUnblock are called for blocks made or lifted by this
+	// replica; nil without coordination. Set them before serving.
+	OnBlock   func(key string, ttl time.Duration)
+	OnUnblock func(key string)
+}
+
+// NewRecentBlocks creates an empty set.
+func NewRecentBlocks() *RecentBlocks {
+	return &RecentBlocks{expires: make(map[string]time.Time)}
+}
+
+// Add remembers a block; a zero ttl, for permanent blocks, is remembered
+// for the maximum.
+func (rb *RecentBlocks) Add(key string, ttl time.Duration) {
+	if ttl <= 0 || ttl > recentBlockMax {
+		ttl = recentBlockMax
+	}
+	now := time.Now()
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	for k, expiry := range rb.expires {
+		if now.After(expiry) {
+			delete(rb.expires, k)
+		}
+	}
+	rb.expires[key] = now.Add(ttl)
+}
+
+// Remove forgets a block that was lifted.
+func (rb *RecentBlocks) Remove(key string) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	delete(rb.expires, key)
+}
+
+// Blocked reports whether any of keys was blocked recently.
+func (rb *RecentBlocks) Blocked(keys ...string) bool {
+	now := time.Now()
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	for _, key := range keys {
+		if expiry, ok := rb.expires[key]; ok && now.Before(expiry) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of blocks remembered, expired ones included until
+// the next Add.
+func (rb *RecentBlocks) Len() int {
+	rb.mu.RLock()
+	defer rb.mu.RUnlock()
+	return len(rb.expires)
+}
+
+// blocked records a block made by this replica.
+func (rb *RecentBlocks) blocked(key string, ttl time.Duration) {
+	if rb == nil {
+		return
+	}
+	rb.Add(key, ttl)
+	if rb.OnBlock != nil {
+		rb.OnBlock(key, ttl)
+	}
+}
+
+// unblocked records a block lifted by this replica.
+func (rb *RecentBlocks) unblocked(key string) {
+	if rb == nil {
+		return
+	}
+	rb.Remove(key)
+	if rb.OnUnblock != nil {
+		rb.OnUnblock(key)
+	}
+}
@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/httpsig"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var replayRejected = metrics.NewCounterVec("aegis_replay_rejected_total",
+	"Requests refused by the replay stage, by reason: missing, invalid, stale, unsigned, bad_signature or replayed.", "reason")
+
+// replayPrefix is the Redis key prefix of seen nonces.
+const replayPrefix = "replay:nonce:"
+
+// nonceFormat bounds nonces to URL-safe tokens of a useful length.
+var nonceFormat = regexp.MustCompile(`^[A-Za-z0-9._~-]{16,128}$`)
+
+// ReplayOptions configures the replay stage.
+type ReplayOptions struct {
+	NonceHeader     string
+	TimestampHeader string        // Unix seconds
+	Window          time.Duration // Allowed clock difference either way
+	FailOpen        bool          // Let requests through when Redis fails
+	Auditor         *Auditor
+}
+
+// ReplayMiddleware stops exact replays of requests to machine APIs, which a
+// still-valid JWT would otherwise let through. Requests to routes with
+// replay_protection must carry a fresh timestamp and a nonce the client
+// hasn't used before; nonces are remembered in Redis for as long as their
+// timestamp is fresh, so every proxy sharing Redis rejects the replay.
+// Whoever replays a request could set new headers, so the client must sign
+// them together with the request (RFC 9421) with the key of its verified
+// client certificate.
+type ReplayMiddleware struct {
+	client *redis.Client
+	routes *RoutePolicies // Routes with replay protection set are checked
+	opts   ReplayOptions
+	signed []string // Components the client's signature must cover
+}
+
+// NewReplayMiddleware creates the replay stage.
+func NewReplayMiddleware(client *redis.Client, routes *RoutePolicies, opts ReplayOptions) *ReplayMiddleware {
+	return &ReplayMiddleware{client: client, routes: routes, opts: opts, signed: []string{
+		"@method", "@authority", "@path", "@query",
+		strings.ToLower(opts.NonceHeader), strings.ToLower(opts.TimestampHeader),
+	}}
+}
+
+// Handler returns the middleware handler
+func (m *ReplayMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := m.routes.Match(r.URL.Path); route == nil || !route.ReplayProtection {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		nonce := r.Header.Get(m.opts.NonceHeader)
+		stamp := r.Header.Get(m.opts.TimestampHeader)
+		if nonce == "" || stamp == "" {
+			m.reject(w, r, "missing", http.StatusBadRequest, m.opts.NonceHeader+" and "+m.opts.TimestampHeader+" are required")
+			return
+		}
+		unix, err := strconv.ParseInt(stamp, 10, 64)
+		if err != nil || !nonceFormat.MatchString(nonce) {
+			m.reject(w, r, "invalid", http.StatusBadRequest, "malformed nonce or timestamp")
+			return
+		}
+		if skew := time.Since(time.Unix(unix, 0)); skew > m.opts.Window || skew < -m.opts.Window {
+			m.reject(w, r, "stale", http.StatusBadRequest, "timestamp outside the "+m.opts.Window.String()+" window")
+			return
+		}
+		if reason, err := m.verifySignature(r); err != nil {
+			m.reject(w, r, reason, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		// Nonces are per client: the subject when authenticated, else the address
+		client := subjectFromContext(r.Context())
+		if client == "" {
+			client = clientIP(r)
+		}
+		ctx := r.Context()
+		key := tenantKeyPrefix(ctx) + replayPrefix + client + ":" + nonce
+		// A timestamp is accepted for up to a window either side of now, so
+		// its nonce must be remembered that long
+		fresh, err := m.client.SetNX(ctx, key, 1, 2*m.opts.Window).Result()
+		if err != nil {
+			logging.For(r.Context()).Warnf("[Replay] Redis error for %s: %v", client, err)
+			if !m.opts.FailOpen {
+				pages.WriteError(w, r, pages.ErrUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !fresh {
+			m.reject(w, r, "replayed", http.StatusConflict, "nonce already used")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// verifySignature checks the client's signature over the request, its
+// nonce and its timestamp, and returns the rejection reason if it fails.
+func (m *ReplayMiddleware) verifySignature(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "unsigned", errors.New("a verified client certificate is required")
+	}
+	sig, err := httpsig.Parse(r)
+	if err != nil {
+		return "unsigned", errors.New("the request must be signed")
+	}
+	for _, component := range m.signed {
+		if !sig.Covers(component) {
+			return "bad_signature", fmt.Errorf("the signature must cover %s", component)
+		}
+	}
+	key := r.TLS.PeerCertificates[0].PublicKey
+	if alg, err := httpsig.Algorithm(key); err != nil || sig.Alg != "" && sig.Alg != alg {
+		return "bad_signature", errors.New("unsupported signature algorithm")
+	}
+	base, err := httpsig.Base(r, sig.Components, sig.Params)
+	if err == nil {
+		err = httpsig.Verify(key, base, sig.Value)
+	}
+	if err != nil {
+		return "bad_signature", errors.New("invalid signature")
+	}
+	return "", nil
+}
+
+// reject logs, audits and refuses a request failing the replay check.
+func (m *ReplayMiddleware) reject(w http.ResponseWriter, r *http.Request, reason string, status int, detail string) {
+	replayRejected.Inc(reason)
+	clientIP := clientIP(r)
+	logging.For(r.Context()).Infof("[Replay] REJECTED %s %s from %s: %s", r.Method, r.URL.Path, clientIP, detail)
+	noteDecision(r.Context(), "replay", OutcomeDeny, reason)
+	m.opts.Auditor.Record(AuditEvent{
+		ClientIP:  clientIP,
+		Subject:   subjectFromContext(r.Context()),
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    status,
+		Stage:     "replay",
+		Reason:    reason,
+	})
+	pages.Write(w, r, status, pages.CodeReplayRejected, "Request Rejected - "+detail)
+}
@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/httpsig"
+)
+
+// signRequest signs r as a client would, covering components.
+func signRequest(t *testing.T, r *http.Request, key *ecdsa.PrivateKey, components []string) {
+	t.Helper()
+	params := httpsig.Params(components, fmt.Sprintf(";created=%d;alg=%q", time.Now().Unix(), "ecdsa-p256-sha256"))
+	base, err := httpsig.Base(r, components, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(base)
+	rs, ss, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := make([]byte, 64)
+	rs.FillBytes(signature[:32])
+	ss.FillBytes(signature[32:])
+	r.Header.Set("Signature-Input", "client="+params)
+	r.Header.Set("Signature", "client=:"+base64.StdEncoding.EncodeToString(signature)+":")
+}
+
+func TestReplayMiddleware(t *testing.T) {
+	mr := miniredis.RunT(t)
+	routes := NewRoutePolicies(nil, func() bool { return true })
+	routes.Update([]RoutePolicy{{Prefix: "/api/payments", ReplayProtection: true}}, nil)
+	replay := NewReplayMiddleware(redis.NewClient(&redis.Options{Addr: mr.Addr()}), routes, ReplayOptions{
+		NonceHeader:     "X-Request-Nonce",
+		TimestampHeader: "X-Request-Timestamp",
+		Window:          5 * time.Minute,
+	}).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	cert := &x509.Certificate{PublicKey: &clientKey.PublicKey}
+	all := []string{"@method", "@authority", "@path", "@query", "x-request-nonce", "x-request-timestamp"}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	tests := []struct {
+		name       string
+		path       string
+		nonce      string
+		stamp      string
+		unverified bool // No verified client certificate
+		key        *ecdsa.PrivateKey
+		covered    []string
+		tamper     func(r *http.Request)
+		want       int
+	}{
+		{"unprotected route", "/api/orders", "", "", true, nil, nil, nil, http.StatusOK},
+		{"no nonce", "/api/payments", "", now, false, clientKey, nil, nil, http.StatusBadRequest},
+		{"malformed nonce", "/api/payments", "short", now, false, clientKey, nil, nil, http.StatusBadRequest},
+		{"stale timestamp", "/api/payments", "9f0c6a1e-2b7d-4c55-a1", "1", false, clientKey, nil, nil, http.StatusBadRequest},
+		{"unsigned", "/api/payments", "9f0c6a1e-2b7d-4c55-a2", now, false, nil, nil, nil, http.StatusUnauthorized},
+		{"no client certificate", "/api/payments", "9f0c6a1e-2b7d-4c55-a3", now, true, clientKey, all, nil, http.StatusUnauthorized},
+		{"nonce not covered", "/api/payments", "9f0c6a1e-2b7d-4c55-a4", now, false, clientKey, []string{"@method", "@authority", "@path", "@query", "x-request-timestamp"}, nil, http.StatusUnauthorized},
+		{"signed with another key", "/api/payments", "9f0c6a1e-2b7d-4c55-a5", now, false, otherKey, all, nil, http.StatusUnauthorized},
+		{"nonce changed after signing", "/api/payments", "9f0c6a1e-2b7d-4c55-a6", now, false, clientKey, all,
+			func(r *http.Request) { r.Header.Set("X-Request-Nonce", "9f0c6a1e-2b7d-4c55-b6") }, http.StatusUnauthorized},
+		{"path changed after signing", "/api/payments", "9f0c6a1e-2b7d-4c55-a7", now, false, clientKey, all,
+			func(r *http.Request) { r.URL.Path = "/api/payments/refund" }, http.StatusUnauthorized},
+		{"signed", "/api/payments", "9f0c6a1e-2b7d-4c55-a8", now, false, clientKey, all, nil, http.StatusOK},
+		{"replayed", "/api/payments", "9f0c6a1e-2b7d-4c55-a8", now, false, clientKey, all, nil, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "https://api.example.com"+tt.path+"?id=7", nil)
+			if tt.nonce != "" {
+				req.Header.Set("X-Request-Nonce", tt.nonce)
+			}
+			req.Header.Set("X-Request-Timestamp", tt.stamp)
+			req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+			if !tt.unverified {
+				req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+			}
+			if tt.key != nil && tt.nonce != "" {
+				covered := tt.covered
+				if covered == nil {
+					covered = all
+				}
+				signRequest(t, req, tt.key, covered)
+			}
+			if tt.tamper != nil {
+				tt.tamper(req)
+			}
+			rec := httptest.NewRecorder()
+			replay.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+)
+
+// RequestIDHeader carries a request's ID to the upstream and back to the
+// client.
+const RequestIDHeader = "X-Request-Id"
+
+// RequestIDMiddleware gives every request an ID that ties its log lines,
+// access log, verdicts and upstream traces together. Trusted peers, such as
+// a load balancer or another proxy, may pass their own in X-Request-ID;
+// anyone else's is replaced so clients can't collide with other requests.
+type RequestIDMiddleware struct {
+	trusted []*net.IPNet
+}
+
+// NewRequestIDMiddleware creates the middleware, keeping the IDs of peers
+// in the trusted CIDRs.
+func NewRequestIDMiddleware(trusted []string) *RequestIDMiddleware {
+	m := &RequestIDMiddleware{}
+	for _, cidr := range trusted {
+		if _, network, err := net.ParseCIDR(cidr); err == nil {
+			m.trusted = append(m.trusted, network)
+		}
+	}
+	return m
+}
+
+// Handler sets the request's ID on the request, its context and the
+// response before calling next.
+func (m *RequestIDMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) || !m.trusts(r) {
+			id = NewRequestID()
+		}
+		r.Header.Set(RequestIDHeader, id)
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(logging.WithRequestID(r.Context(), id)))
+	})
+}
+
+// trusts reports whether the request's peer may set its ID. The peer is the
+// connection's address, after PROXY protocol, never X-Forwarded-For.
+func (m *RequestIDMiddleware) trusts(r *http.Request) bool {
+	return peerIn(r, m.trusted)
+}
+
+// validRequestID accepts up to 128 printable ASCII characters, so an ID
+// can't break log lines or headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// NewRequestID returns a UUIDv7: a millisecond timestamp followed by random
+// bits, so IDs sort by the time requests arrived.
+func NewRequestID() string {
+	var u [16]byte
+	rand.Read(u[6:])
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(time.Now().UnixMilli()))
+	copy(u[:6], ms[2:])
+	u[6] = u[6]&0x0f | 0x70 // Version 7
+	u[8] = u[8]&0x3f | 0x80 // RFC 9562 variant
+
+	var buf [36]byte
+	hex.Encode(buf[0:8], u[0:4])
+	buf[8] = '-'
+	hex.Encode(buf[9:13], u[4:6])
+	buf[13] = '-'
+	hex.Encode(buf[14:18], u[6:8])
+	buf[18] = '-'
+	hex.Encode(buf[19:23], u[8:10])
+	buf[23] = '-'
+	hex.Encode(buf[24:], u[10:])
+	return string(buf[:])
+}
@@ -0,0 +1,266 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+// Graduated actions, from least to most severe. ActionAllow, ActionChallenge,
+// ActionRateLimit and ActionBlock are declared with the scoring types.
+const (
+	ActionLogOnly    Action = "log_only"
+	ActionTarpit     Action = "tarpit"
+	ActionReauth     Action = "reauth"
+	ActionTempBlock  Action = "temp_block"
+	ActionPermaBlock Action = "perma_block"
+)
+
+// ResponseBand applies Action to scores at or above MinScore.
+type ResponseBand struct {
+	MinScore float64
+	Action   Action
+}
+
+// ResponsePolicy maps score ranges to actions.
+type ResponsePolicy struct {
+	bands []ResponseBand // Sorted by ascending MinScore
+}
+
+// NewResponsePolicy creates a policy from bands in any order.
+func NewResponsePolicy(bands []ResponseBand) *ResponsePolicy {
+	sorted := append([]ResponseBand(nil), bands...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].MinScore < sorted[j].MinScore })
+	return &ResponsePolicy{bands: sorted}
+}
+
+// Decide returns the action for a score. Bands at or below the client's
+// current action are lowered by hysteresis, so a client only leaves a band
+// once its score has clearly dropped below it.
+func (p *ResponsePolicy) Decide(score float64, current Action, hysteresis float64) Action {
+	currentRank := -1
+	for i, band := range p.bands {
+		if band.Action == current {
+			currentRank = i
+		}
+	}
+
+	for i := len(p.bands) - 1; i >= 0; i-- {
+		threshold := p.bands[i].MinScore
+		if i <= currentRank {
+			threshold -= hysteresis
+		}
+		if score >= threshold {
+			return p.bands[i].Action
+		}
+	}
+	return ActionAllow
+}
+
+// Challenger verifies clients that receive the challenge action.
+type Challenger interface {
+	// Verify reports whether the request carries proof of a passed challenge.
+	Verify(r *http.Request) bool
+	// Serve writes the challenge response.
+	Serve(w http.ResponseWriter, r *http.Request)
+}
+
+// denyChallenger is used when no interactive challenge is configured:
+// challenged clients are refused until their score drops.
+type denyChallenger struct{}
+
+func (denyChallenger) Verify(r *http.Request) bool { return false }
+
+func (denyChallenger) Serve(w http.ResponseWriter, r *http.Request) {
+	pages.WriteError(w, r, pages.ErrChallenge)
+}
+
+// ResponderOptions configures how each graduated action is carried out.
+type ResponderOptions struct {
+	TarpitDelay  time.Duration
+	TempBlockTTL time.Duration
+	Limiter      *RateLimiter
+	Challenger   Challenger        // Defaults to refusing challenged clients
+	Recent       *RecentBlocks     // Learns the blocks made, if set
+	Guard        *EnforcementGuard // Spares allowlisted clients from blocks, if set
+	Escalation   *BlockEscalation  // Lengthens repeat offenders' temporary blocks, if set
+
+	// ReauthClearance is how long a client that re-authenticated isn't
+	// asked again, even if its score still warrants reauth
+	ReauthClearance time.Duration
+}
+
+// Redis keys of the reauth action, followed by the client's address: when
+// the client was first asked to re-authenticate (Unix seconds), and the
+// clearance it was given after presenting a token issued since.
+const (
+	reauthAskedPrefix   = "aegis:reauth:asked:"
+	reauthClearedPrefix = "aegis:reauth:cleared:"
+)
+
+// reauthAskedTTL bounds how long an unanswered request to re-authenticate
+// is remembered.
+const reauthAskedTTL = 24 * time.Hour
+
+// Responder carries out graduated actions for a request.
+type Responder struct {
+	client *redis.Client
+	opts   ResponderOptions
+}
+
+// NewResponder creates a responder. Temporary and permanent blocks are written
+// to the Redis blocklist so they apply to subsequent requests too.
+func NewResponder(client *redis.Client, opts ResponderOptions) *Responder {
+	if opts.Challenger == nil {
+		opts.Challenger = denyChallenger{}
+	}
+	return &Responder{client: client, opts: opts}
+}
+
+// Execute carries out the action. It returns true if it wrote a response,
+// in which case the request must not be forwarded.
+func (rp *Responder) Execute(w http.ResponseWriter, r *http.Request, clientIP string, action Action) bool {
+	switch action {
+	case ActionBlock, ActionTempBlock, ActionPermaBlock:
+		if rp.opts.Guard.spares(r.Context(), clientIP, "response") || rp.opts.Guard.holds(r.Context(), clientIP, "response") {
+			return false
+		}
+	}
+
+	switch action {
+	case ActionLogOnly:
+		logging.For(r.Context()).Infof("[Response] Log-only decision for %s on %s", clientIP, r.URL.Path)
+		return false
+
+	case ActionTarpit:
+		select {
+		case <-time.After(rp.opts.TarpitDelay):
+		case <-r.Context().Done():
+		}
+		return false
+
+	case ActionChallenge:
+		if rp.opts.Challenger.Verify(r) {
+			return false
+		}
+		rp.opts.Challenger.Serve(w, r)
+		return true
+
+	case ActionReauth:
+		if rp.reauthenticated(r.Context(), clientIP) {
+			return false
+		}
+		// Step-up authentication challenge (RFC 9470)
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_user_authentication", error_description="re-authentication required"`)
+		pages.WriteError(w, r, pages.ErrReauth)
+		return true
+
+	case ActionRateLimit:
+		if rp.opts.Limiter.Allow(FlowKey(tenantName(r.Context()), clientIP)) {
+			return false
+		}
+		w.Header().Set("Retry-After", "1")
+		pages.WriteError(w, r, pages.ErrRateLimited)
+		return true
+
+	case ActionTempBlock:
+		rp.blocklist(r.Context(), clientIP, action, rp.opts.TempBlockTTL)
+		pages.WriteError(w, r, pages.ErrBlocked)
+		return true
+
+	case ActionPermaBlock:
+		rp.blocklist(r.Context(), clientIP, action, 0)
+		pages.WriteError(w, r, pages.ErrBlocked)
+		return true
+
+	case ActionBlock:
+		pages.WriteError(w, r, pages.ErrRiskTooHigh)
+		return true
+	}
+	return false
+}
+
+// reauthenticated reports whether the client has re-authenticated since it
+// was first asked to: it holds a clearance, or presents a verified token
+// issued after the request, which earns it one. A score that stays in the
+// reauth band, as hysteresis keeps it, would otherwise lock the client out
+// however often it signs in again. Once the clearance expires the client is
+// asked again if its score still warrants it.
+func (rp *Responder) reauthenticated(ctx context.Context, clientIP string) bool {
+	prefix := tenantKeyPrefix(ctx)
+	cleared := prefix + reauthClearedPrefix + clientIP
+	asked := prefix + reauthAskedPrefix + clientIP
+
+	n, err := rp.client.Exists(ctx, cleared).Result()
+	if err != nil {
+		logging.For(ctx).Warnf("[Response] Failed to check reauth clearance of %s: %v", clientIP, err)
+		return false
+	}
+	if n > 0 {
+		return true
+	}
+	askedAt, err := rp.client.Get(ctx, asked).Int64()
+	if err == redis.Nil {
+		if err := rp.client.SetNX(ctx, asked, time.Now().Unix(), reauthAskedTTL).Err(); err != nil {
+			logging.For(ctx).Warnf("[Response] Failed to record reauth of %s: %v", clientIP, err)
+		}
+		return false
+	}
+	if err != nil {
+		logging.For(ctx).Warnf("[Response] Failed to check reauth of %s: %v", clientIP, err)
+		return false
+	}
+	issued, ok := issuedAt(ctx)
+	if !ok || issued <= askedAt {
+		return false
+	}
+	pipe := rp.client.TxPipeline()
+	pipe.Set(ctx, cleared, issued, rp.opts.ReauthClearance)
+	pipe.Del(ctx, asked)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logging.For(ctx).Warnf("[Response] Failed to clear reauth of %s: %v", clientIP, err)
+	}
+	logging.For(ctx).Infof("[Response] %s re-authenticated; cleared for %s", clientIP, rp.opts.ReauthClearance)
+	return true
+}
+
+// issuedAt returns the "iat" claim of the request's verified token.
+func issuedAt(ctx context.Context) (int64, bool) {
+	switch iat := claimsFromContext(ctx)["iat"].(type) {
+	case float64:
+		return int64(iat), true
+	case json.Number:
+		n, err := iat.Int64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// blocklist adds the client to the Redis blocklist; a zero ttl never expires.
+func (rp *Responder) blocklist(ctx context.Context, clientIP string, action Action, ttl time.Duration) {
+	if err := rp.opts.Escalation.block(ctx, rp.client, rp.opts.Recent, clientIP, string(action), string(action), ttl); err != nil {
+		log.Printf("[Response] Failed to blocklist %s: %v", clientIP, err)
+	}
+}
+
+// addToBlocklist writes blocklist:ip:<IP> in the format the AI engine uses,
+// under the prefix of the tenant in ctx, if any, and notes it in recent.
+func addToBlocklist(ctx context.Context, client *redis.Client, recent *RecentBlocks, clientIP, reason string, ttl time.Duration) error {
+	key := tenantKeyPrefix(ctx) + blocklistPrefix + clientIP
+	recent.blocked(key, ttl)
+	return client.Set(ctx, key, blockValue(reason), ttl).Err()
+}
+
+// blockValue is the JSON stored with a blocklist key.
+func blockValue(reason string) string {
+	return fmt.Sprintf(`{"reason": %q, "blocked_at": %q}`, reason, time.Now().UTC().Format(time.RFC3339))
+}
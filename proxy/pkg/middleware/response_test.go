@@ -0,0 +1,114 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestResponsePolicyDecide(t *testing.T) {
+	policy := NewResponsePolicy([]ResponseBand{
+		{MinScore: 0.9, Action: ActionTempBlock},
+		{MinScore: 0.5, Action: ActionChallenge},
+		{MinScore: 0.7, Action: ActionReauth},
+	})
+	tests := []struct {
+		name       string
+		score      float64
+		current    Action
+		hysteresis float64
+		want       Action
+	}{
+		{"below every band", 0.2, ActionAllow, 0, ActionAllow},
+		{"at a band", 0.5, ActionAllow, 0, ActionChallenge},
+		{"unsorted bands", 0.75, ActionAllow, 0, ActionReauth},
+		{"highest band", 0.95, ActionAllow, 0, ActionTempBlock},
+		{"stays within hysteresis", 0.45, ActionChallenge, 0.1, ActionChallenge},
+		{"leaves below hysteresis", 0.39, ActionChallenge, 0.1, ActionAllow},
+		{"drops one band within hysteresis", 0.65, ActionReauth, 0.1, ActionReauth},
+		{"drops to the band below", 0.55, ActionReauth, 0.1, ActionChallenge},
+		{"no hysteresis upward", 0.85, ActionReauth, 0.1, ActionReauth},
+		{"escalates at the threshold", 0.9, ActionReauth, 0.1, ActionTempBlock},
+		{"unknown current action", 0.45, ActionRateLimit, 0.1, ActionAllow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Decide(tt.score, tt.current, tt.hysteresis); got != tt.want {
+				t.Errorf("Decide(%v, %s, %v) = %s, want %s", tt.score, tt.current, tt.hysteresis, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponderReauth(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	rp := NewResponder(client, ResponderOptions{ReauthClearance: time.Minute})
+
+	// reauth answers whether the responder refused a request with a token
+	// issued at iat, or without one if iat is zero.
+	reauth := func(iat time.Time) bool {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if !iat.IsZero() {
+			r = r.WithContext(withClaims(r.Context(), map[string]interface{}{"iat": float64(iat.Unix())}))
+		}
+		w := httptest.NewRecorder()
+		refused := rp.Execute(w, r, "198.51.100.1", ActionReauth)
+		if refused && w.Code != http.StatusUnauthorized {
+			t.Fatalf("status %d, want 401", w.Code)
+		}
+		return refused
+	}
+
+	before := time.Now().Add(-time.Hour)
+	if !reauth(before) {
+		t.Fatal("first request not asked to re-authenticate")
+	}
+	if !reauth(before) {
+		t.Error("token from before the request accepted")
+	}
+	if !reauth(time.Time{}) {
+		t.Error("request without a token accepted")
+	}
+	// Backdate the request, so a token issued now is newer
+	mr.Set(reauthAskedPrefix+"198.51.100.1", strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10))
+	if reauth(time.Now()) {
+		t.Fatal("token issued after the request refused")
+	}
+	// The clearance holds while the score stays in the band, without a token
+	if reauth(time.Time{}) {
+		t.Error("cleared client asked again")
+	}
+	if ttl := mr.TTL(reauthClearedPrefix + "198.51.100.1"); ttl != time.Minute {
+		t.Errorf("clearance TTL %s, want 1m", ttl)
+	}
+	// Once it expires, the client is asked again and the old token no
+	// longer does
+	mr.FastForward(time.Minute)
+	if !reauth(time.Now().Add(-time.Second)) {
+		t.Error("client not asked again after its clearance expired")
+	}
+	if !reauth(time.Now().Add(-time.Second)) {
+		t.Error("token from before the second request accepted")
+	}
+}
+
+func TestResponderReauthRedisDown(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	defer client.Close()
+	rp := NewResponder(client, ResponderOptions{ReauthClearance: time.Minute})
+	mr.Close()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r = r.WithContext(withClaims(r.Context(), map[string]interface{}{"iat": float64(time.Now().Unix())}))
+	if !rp.Execute(httptest.NewRecorder(), r, "198.51.100.1", ActionReauth) {
+		t.Error("reauth skipped without Redis")
+	}
+}
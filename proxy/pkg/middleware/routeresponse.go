@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var responseViolations = metrics.NewCounterVec("aegis_response_violations_total",
+	"Upstream responses violating their route's response rules, by route, rule and action.", "route", "rule", "action")
+
+// ResponseRules are what upstream responses of a route must satisfy, so a
+// compromised backend can't send whatever it likes out through the edge.
+type ResponseRules struct {
+	MaxSize int64 // Body bytes; 0 doesn't limit them
+	// ContentTypes are the accepted media types of bodies, exact or type/*
+	ContentTypes    []string
+	RequiredHeaders []string
+	// Truncate cuts bodies off at MaxSize instead of refusing them; other
+	// violations are always refused
+	Truncate bool
+}
+
+// errResponseTooLarge aborts a response found over its size limit after
+// its headers were sent.
+var errResponseTooLarge = errors.New("response over the route's max_size")
+
+// CheckResponse applies the response rules of the request's route to an
+// upstream response, for the proxy to call before the response is sent on.
+// Responses with the wrong content type or missing headers, and those too
+// large by their Content-Length, are refused with an error the proxy
+// answers 502; bodies without a length are limited as they are read.
+func (rp *RoutePolicies) CheckResponse(resp *http.Response) error {
+	rc := RequestContextFrom(resp.Request.Context())
+	if rc == nil || rc.Route == "" {
+		return nil
+	}
+	p := (*rp.table.Load())[strings.TrimSuffix(rc.Route, "/")]
+	if p == nil || p.Response == nil {
+		return nil
+	}
+	rules := p.Response
+
+	hasBody := resp.ContentLength != 0 && resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusNotModified && resp.Request.Method != http.MethodHead
+	if len(rules.ContentTypes) > 0 && hasBody {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if !acceptsMediaType(rules.ContentTypes, mediaType) {
+			return rp.refuseResponse(resp, p, "content_type", "content type "+strconv.Quote(mediaType))
+		}
+	}
+	for _, name := range rules.RequiredHeaders {
+		if resp.Header.Get(name) == "" {
+			return rp.refuseResponse(resp, p, "header", "missing header "+name)
+		}
+	}
+	if rules.MaxSize > 0 && hasBody {
+		if resp.ContentLength > rules.MaxSize {
+			if !rules.Truncate {
+				return rp.refuseResponse(resp, p, "size", "body of "+strconv.FormatInt(resp.ContentLength, 10)+" bytes")
+			}
+			resp.Header.Del("Content-Length")
+			resp.ContentLength = -1
+		}
+		resp.Body = &limitedResponse{
+			ReadCloser: resp.Body,
+			remaining:  rules.MaxSize,
+			truncate:   rules.Truncate,
+			exceeded:   func() { rp.oversized(resp, p) },
+		}
+	}
+	return nil
+}
+
+// refuseResponse logs and audits a refused response and returns the error
+// the proxy answers with.
+func (rp *RoutePolicies) refuseResponse(resp *http.Response, p *RoutePolicy, rule, reason string) error {
+	r := resp.Request
+	responseViolations.Inc(p.Prefix, rule, "blocked")
+	logging.For(r.Context()).Warnf("[Routes] Blocked response to %s %s from upstream (route %s): %s", r.Method, r.URL.Path, p.Prefix, reason)
+	noteDecision(r.Context(), "routes", OutcomeDeny, "response "+reason, p.Prefix)
+	rp.auditResponse(r, http.StatusBadGateway, "response "+reason)
+	return pages.ErrResponseBlocked.Wrap(errors.New(reason))
+}
+
+// oversized records a response body found over the route's limit as it
+// was read: cut off, or aborted when the route doesn't truncate.
+func (rp *RoutePolicies) oversized(resp *http.Response, p *RoutePolicy) {
+	r := resp.Request
+	action := "aborted"
+	if p.Response.Truncate {
+		action = "truncated"
+	}
+	responseViolations.Inc(p.Prefix, "size", action)
+	logging.For(r.Context()).Warnf("[Routes] Response to %s %s %s at %d bytes (route %s)", r.Method, r.URL.Path, action, p.Response.MaxSize, p.Prefix)
+	rp.auditResponse(r, resp.StatusCode, "response "+action+" at max_size")
+}
+
+func (rp *RoutePolicies) auditResponse(r *http.Request, status int, reason string) {
+	rp.auditor.Record(AuditEvent{
+		ClientIP:  clientIP(r),
+		Subject:   subjectFromContext(r.Context()),
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    status,
+		Stage:     "routes",
+		Reason:    reason,
+	})
+}
+
+// limitedResponse ends a response body at a limit: with io.EOF when
+// truncating, else with an error that aborts the response.
+type limitedResponse struct {
+	io.ReadCloser
+	remaining int64
+	truncate  bool
+	exceeded  func()
+	done      error
+}
+
+func (l *limitedResponse) Read(b []byte) (int, error) {
+	if l.done != nil {
+		return 0, l.done
+	}
+	// Read one byte past the limit to tell a body ending at it from a longer one
+	if int64(len(b)) > l.remaining+1 {
+		b = b[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(b)
+	if int64(n) <= l.remaining {
+		l.remaining -= int64(n)
+		return n, err
+	}
+	n, l.done = int(l.remaining), errResponseTooLarge
+	if l.truncate {
+		l.done = io.EOF
+	}
+	l.remaining = 0
+	l.exceeded()
+	return n, l.done
+}
@@ -0,0 +1,367 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/openapi"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var schemaViolations = metrics.NewCounterVec("aegis_schema_violations_total",
+	"Requests violating their route's OpenAPI spec, by route.", "route")
+
+// RoutePolicy is a compiled route requirement. Zero values impose nothing.
+type RoutePolicy struct {
+	Prefix  string
+	Methods map[string]bool // nil allows every method
+	// ContentTypes are the media types accepted for bodies, e.g.
+	// application/json or text/*; empty accepts any
+	ContentTypes   []string
+	MaxHeaders     int   // Header fields, counting repeated ones
+	MaxHeaderBytes int64 // Total size of header names and values
+	AuthNone       bool  // The jwt stage doesn't require a token
+	Scopes         []string
+	RequireMTLS    bool
+	Tier           string // Rate limit tier name, for logs
+	Limiter        *RateLimiter
+	MaxBody        int64
+	MaxRisk        float64
+	Schema         *openapi.Spec // Requests must conform to it
+	SchemaBlock    bool          // Refuse violations; otherwise only report them
+	CORS           *CORSPolicy   // Replaces the cors stage's default policy
+	CSRF           bool          // The csrf stage checks tokens
+	// The replay stage requires a nonce and timestamp
+	ReplayProtection bool
+	// SecurityHeaders replace the headers stage's defaults
+	SecurityHeaders *SecurityHeaders
+	// Timeout replaces the server's read and write timeouts, for routes
+	// serving large uploads or downloads
+	Timeout time.Duration
+	// CacheTTL is how long the cache stage keeps GET responses; 0 doesn't
+	// cache them
+	CacheTTL time.Duration
+	// Response rules are checked on upstream responses by the proxy
+	Response *ResponseRules
+	// Mirror is the upstream URL MirrorPercent of requests are copied to
+	Mirror        string
+	MirrorPercent float64
+	// TokenAudience replaces the exchange stage's audience
+	TokenAudience string
+
+	allow string // The Allow header of 405 responses
+}
+
+// RateTier is a rate limit shared by the routes naming it.
+type RateTier struct {
+	RPS   float64
+	Burst int
+}
+
+// RoutePolicies matches request paths to their policies and enforces them.
+// Policies are looked up by walking the path's segments through a map, so a
+// match costs one lookup per segment however many routes are configured.
+type RoutePolicies struct {
+	table     atomic.Pointer[map[string]*RoutePolicy] // Keyed by prefix without a trailing slash
+	mu        sync.Mutex
+	limiters  map[string]*RateLimiter // By tier, kept across updates
+	auditor   *Auditor
+	enforcing func() bool // Whether risk thresholds are enforced
+}
+
+// NewRoutePolicies creates the routes stage. enforcing reports whether the
+// scoring stage is in enforce mode; max_risk is only applied while it is.
+func NewRoutePolicies(auditor *Auditor, enforcing func() bool) *RoutePolicies {
+	rp := &RoutePolicies{
+		limiters:  make(map[string]*RateLimiter),
+		auditor:   auditor,
+		enforcing: enforcing,
+	}
+	rp.table.Store(&map[string]*RoutePolicy{})
+	return rp
+}
+
+// Update replaces the policies. Limiters of tiers that still exist keep their
+// buckets and take the new limits.
+func (rp *RoutePolicies) Update(policies []RoutePolicy, tiers map[string]RateTier) {
+	rp.mu.Lock()
+	limiters := make(map[string]*RateLimiter, len(tiers))
+	for name, tier := range tiers {
+		limiter, ok := rp.limiters[name]
+		if ok {
+			limiter.SetLimits(tier.RPS, tier.Burst)
+		} else {
+			limiter = NewRateLimiter(tier.RPS, tier.Burst)
+		}
+		limiters[name] = limiter
+	}
+	rp.limiters = limiters
+	rp.mu.Unlock()
+
+	table := make(map[string]*RoutePolicy, len(policies))
+	for _, p := range policies {
+		p := p
+		if p.Tier != "" {
+			p.Limiter = limiters[p.Tier]
+		}
+		if len(p.Methods) > 0 {
+			methods := make([]string, 0, len(p.Methods))
+			for method := range p.Methods {
+				methods = append(methods, method)
+			}
+			sort.Strings(methods)
+			p.allow = strings.Join(methods, ", ")
+		}
+		table[strings.TrimSuffix(p.Prefix, "/")] = &p
+	}
+	rp.table.Store(&table)
+}
+
+// Match returns the policy with the longest prefix matching whole segments
+// of the path, or nil.
+func (rp *RoutePolicies) Match(path string) *RoutePolicy {
+	table := *rp.table.Load()
+	if len(table) == 0 {
+		return nil
+	}
+	for {
+		if p, ok := table[path]; ok {
+			return p
+		}
+		i := strings.LastIndexByte(path, '/')
+		if i < 0 {
+			return nil
+		}
+		path = path[:i]
+	}
+}
+
+// Timeout returns the timeout of the route of path, or 0 if it has none.
+func (rp *RoutePolicies) Timeout(path string) time.Duration {
+	if p := rp.Match(path); p != nil {
+		return p.Timeout
+	}
+	return 0
+}
+
+// Mirror returns the mirror upstream of the route of path and the
+// percentage of requests copied to it, or an empty URL if it has none.
+func (rp *RoutePolicies) Mirror(path string) (string, float64) {
+	if p := rp.Match(path); p != nil {
+		return p.Mirror, p.MirrorPercent
+	}
+	return "", 0
+}
+
+// SkipsAuth reports whether the route of path needs no token.
+func (rp *RoutePolicies) SkipsAuth(path string) bool {
+	p := rp.Match(path)
+	return p != nil && p.AuthNone
+}
+
+// Handler returns the middleware handler
+func (rp *RoutePolicies) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := rp.Match(r.URL.Path)
+		if p == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		setRoute(r.Context(), p.Prefix)
+		if !rp.guard(w, r, p) {
+			return
+		}
+		if p.RequireMTLS && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			rp.refuse(w, r, p, http.StatusForbidden, pages.CodeForbidden,
+				"Forbidden - Client Certificate Required", "client certificate required")
+			return
+		}
+		if missing := missingScope(claimsFromContext(r.Context()), p.Scopes); missing != "" {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+strings.Join(p.Scopes, " ")+`"`)
+			rp.refuse(w, r, p, http.StatusForbidden, pages.CodeForbidden,
+				"Forbidden - Insufficient Scope", "missing scope "+missing)
+			return
+		}
+		if p.MaxBody > 0 {
+			if r.ContentLength > p.MaxBody {
+				rp.refuse(w, r, p, http.StatusRequestEntityTooLarge, pages.CodeBodyTooLarge,
+					"Request Entity Too Large", "body of "+strconv.FormatInt(r.ContentLength, 10)+" bytes")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, p.MaxBody)
+		}
+		if p.Schema != nil {
+			if violations := rp.validate(r, p); len(violations) > 0 && p.SchemaBlock {
+				rp.refuse(w, r, p, http.StatusBadRequest, pages.CodeSchemaViolation,
+					"Bad Request - Schema Violation", strings.Join(violations, "; "))
+				return
+			}
+		}
+		if p.Limiter != nil && !p.Limiter.Allow(FlowKey(tenantName(r.Context()), clientIP(r))) {
+			w.Header().Set("Retry-After", "1")
+			rp.refuse(w, r, p, http.StatusTooManyRequests, pages.CodeRateLimited,
+				"Too Many Requests", "rate limit tier "+p.Tier)
+			return
+		}
+		if score := scoreFromContext(r.Context()); p.MaxRisk > 0 && score != nil && rp.enforcing() {
+			level := score.Value
+			if score.Smoothed != nil {
+				level = *score.Smoothed
+			}
+			if level >= p.MaxRisk {
+				rp.refuse(w, r, p, http.StatusForbidden, pages.CodeRiskTooHigh,
+					"Forbidden - Risk Too High", "risk "+strconv.FormatFloat(level, 'f', 2, 64))
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Guard applies the checks of the route's policy that need no identity:
+// methods, content types and header limits. The jwt stage calls it before
+// parsing tokens, so malformed requests are refused before any crypto; the
+// routes stage applies it again for chains without jwt. It reports whether
+// the request may proceed.
+func (rp *RoutePolicies) Guard(w http.ResponseWriter, r *http.Request) bool {
+	p := rp.Match(r.URL.Path)
+	return p == nil || rp.guard(w, r, p)
+}
+
+func (rp *RoutePolicies) guard(w http.ResponseWriter, r *http.Request, p *RoutePolicy) bool {
+	if p.Methods != nil && !p.Methods[r.Method] {
+		w.Header().Set("Allow", p.allow)
+		rp.refuse(w, r, p, http.StatusMethodNotAllowed, pages.CodeMethodNotAllowed,
+			"Method Not Allowed", "method not allowed")
+		return false
+	}
+	if len(p.ContentTypes) > 0 && (r.ContentLength > 0 || len(r.TransferEncoding) > 0) {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if !acceptsMediaType(p.ContentTypes, mediaType) {
+			rp.refuse(w, r, p, http.StatusUnsupportedMediaType, pages.CodeUnsupportedMediaType,
+				"Unsupported Media Type", "content type "+strconv.Quote(mediaType))
+			return false
+		}
+	}
+	if p.MaxHeaders > 0 || p.MaxHeaderBytes > 0 {
+		var count int
+		var size int64
+		for name, values := range r.Header {
+			count += len(values)
+			for _, value := range values {
+				size += int64(len(name) + len(value))
+			}
+		}
+		if p.MaxHeaders > 0 && count > p.MaxHeaders || p.MaxHeaderBytes > 0 && size > p.MaxHeaderBytes {
+			rp.refuse(w, r, p, http.StatusRequestHeaderFieldsTooLarge, pages.CodeHeadersTooLarge,
+				"Request Header Fields Too Large", fmt.Sprintf("%d header fields, %d bytes", count, size))
+			return false
+		}
+	}
+	return true
+}
+
+// acceptsMediaType matches a media type against exact types and type/* wildcards.
+func acceptsMediaType(accepted []string, mediaType string) bool {
+	for _, a := range accepted {
+		if a == mediaType || strings.HasSuffix(a, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaBodyLimit bounds the body read for schema validation when the route
+// sets no max_body; longer bodies are validated up to the media type.
+const schemaBodyLimit = 1 << 20
+
+// validate checks the request against the route's OpenAPI spec and hands the
+// violations to the logger.
+func (rp *RoutePolicies) validate(r *http.Request, p *RoutePolicy) []string {
+	limit := int64(schemaBodyLimit)
+	if p.MaxBody > 0 {
+		limit = p.MaxBody
+	}
+	var body []byte
+	truncated := false
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, limit+1))
+		truncated = err != nil || int64(len(body)) > limit
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	}
+
+	violations := p.Schema.Validate(r, body, truncated)
+	if len(violations) > 0 {
+		schemaViolations.Inc(p.Prefix)
+		setSchemaViolations(r.Context(), violations)
+		if !p.SchemaBlock {
+			logging.For(r.Context()).Infof("[Routes] Schema violations in %s %s from %s: %s", r.Method, r.URL.Path, clientIP(r), strings.Join(violations, "; "))
+		}
+	}
+	return violations
+}
+
+// refuse logs, audits and answers a request failing its route's policy.
+func (rp *RoutePolicies) refuse(w http.ResponseWriter, r *http.Request, p *RoutePolicy, status int, code, message, reason string) {
+	clientIP := clientIP(r)
+	logging.For(r.Context()).Infof("[Routes] DENIED %s %s for %s (route %s): %s", r.Method, r.URL.Path, clientIP, p.Prefix, reason)
+	noteDecision(r.Context(), "routes", OutcomeDeny, reason, p.Prefix)
+	rp.auditor.Record(AuditEvent{
+		ClientIP:  clientIP,
+		Subject:   subjectFromContext(r.Context()),
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    status,
+		Stage:     "routes",
+		Reason:    reason,
+	})
+	pages.Write(w, r, status, code, message)
+}
+
+// missingScope returns the first required scope the claims don't grant. Scopes
+// are read from the space-separated "scope" claim or the "scp" array.
+func missingScope(claims map[string]interface{}, required []string) string {
+	if len(required) == 0 {
+		return ""
+	}
+	granted := make(map[string]bool)
+	if scope, ok := claims["scope"].(string); ok {
+		for _, s := range strings.Fields(scope) {
+			granted[s] = true
+		}
+	}
+	switch scp := claims["scp"].(type) {
+	case string:
+		for _, s := range strings.Fields(scp) {
+			granted[s] = true
+		}
+	case []interface{}:
+		for _, s := range scp {
+			if s, ok := s.(string); ok {
+				granted[s] = true
+			}
+		}
+	}
+	for _, s := range required {
+		if !granted[s] {
+			return s
+		}
+	}
+	return ""
+}
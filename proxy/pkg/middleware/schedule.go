@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var offSchedule = metrics.NewCounterVec("aegis_off_schedule_total",
+	"Requests outside the time window of a schedule, by schedule and action.", "schedule", "action")
+
+// Schedule restricts the requests under Prefix, optionally only those of
+// some identities, to a weekly time window.
+type Schedule struct {
+	Name     string
+	Prefix   string          // Empty matches every request
+	Subjects map[string]bool // Nil applies to every subject
+	Claims   map[string]string
+	Days     [7]bool // Days the window opens, by time.Weekday
+	// Start and End are times of day; an End before Start runs overnight
+	Start, End time.Duration
+	Location   *time.Location
+	Flag       bool // Mark requests for the model instead of refusing them
+}
+
+// applies reports whether the schedule covers the request.
+func (s *Schedule) applies(r *http.Request) bool {
+	if s.Prefix != "" && !matchPrefix(r.URL.Path, s.Prefix) {
+		return false
+	}
+	if s.Subjects != nil && !s.Subjects[subjectFromContext(r.Context())] {
+		return false
+	}
+	claims := claimsFromContext(r.Context())
+	for name, want := range s.Claims {
+		if value, ok := claims[name]; !ok || fmt.Sprint(value) != want {
+			return false
+		}
+	}
+	return true
+}
+
+// Open reports whether t falls in the schedule's window.
+func (s *Schedule) Open(t time.Time) bool {
+	t = t.In(s.Location)
+	// The wall clock, not the time since midnight: days with a DST change
+	// are an hour shorter or longer
+	clock := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if s.Start < s.End {
+		return s.Days[t.Weekday()] && clock >= s.Start && clock < s.End
+	}
+	// Overnight: the evening of an opening day or the morning after one
+	return s.Days[t.Weekday()] && clock >= s.Start || s.Days[(t.Weekday()+6)%7] && clock < s.End
+}
+
+// ScheduleMiddleware enforces schedules. Every schedule covering a request
+// applies: one that blocks refuses it outside its window with 403, and one
+// that flags records it on the request's context, where scoring passes it
+// to the model and the logger to the access log.
+type ScheduleMiddleware struct {
+	schedules []Schedule
+	auditor   *Auditor
+	now       func() time.Time
+}
+
+// NewScheduleMiddleware creates the schedule stage.
+func NewScheduleMiddleware(schedules []Schedule, auditor *Auditor) *ScheduleMiddleware {
+	return &ScheduleMiddleware{schedules: schedules, auditor: auditor, now: time.Now}
+}
+
+// Handler returns the middleware handler
+func (m *ScheduleMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := m.now()
+		var flagged []string
+		for i := range m.schedules {
+			s := &m.schedules[i]
+			if !s.applies(r) || s.Open(now) {
+				continue
+			}
+			if s.Flag {
+				offSchedule.Inc(s.Name, "flag")
+				flagged = append(flagged, s.Name)
+				continue
+			}
+			offSchedule.Inc(s.Name, "block")
+			logging.For(r.Context()).Infof("[Schedule] Refused %s %s from %s outside schedule %s", r.Method, r.URL.Path, clientIP(r), s.Name)
+			noteDecision(r.Context(), "schedule", OutcomeDeny, "outside schedule "+s.Name)
+			m.auditor.Record(AuditEvent{
+				ClientIP:  clientIP(r),
+				Subject:   subjectFromContext(r.Context()),
+				Tenant:    tenantName(r.Context()),
+				RequestID: logging.RequestID(r.Context()),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Status:    http.StatusForbidden,
+				Stage:     "schedule",
+				Reason:    "outside schedule " + s.Name,
+			})
+			pages.WriteError(w, r, pages.ErrOffSchedule)
+			return
+		}
+		if flagged != nil {
+			noteDecision(r.Context(), "schedule", "", "outside schedule", flagged...)
+			setOffSchedule(r.Context(), flagged)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,38 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleOpenAcrossDST(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	everyDay := [7]bool{true, true, true, true, true, true, true}
+	office := Schedule{Days: everyDay, Start: 9 * time.Hour, End: 17 * time.Hour, Location: newYork}
+	night := Schedule{Days: everyDay, Start: 22 * time.Hour, End: 6 * time.Hour, Location: newYork}
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		at       time.Time
+		want     bool
+	}{
+		// 2026-03-08 springs forward at 2:00, 2026-11-01 falls back at 2:00
+		{"opening on a short day", office, time.Date(2026, 3, 8, 9, 30, 0, 0, newYork), true},
+		{"before opening on a short day", office, time.Date(2026, 3, 8, 8, 30, 0, 0, newYork), false},
+		{"closing on a long day", office, time.Date(2026, 11, 1, 16, 30, 0, 0, newYork), true},
+		{"after closing on a long day", office, time.Date(2026, 11, 1, 17, 30, 0, 0, newYork), false},
+		{"after a short night", night, time.Date(2026, 3, 8, 6, 30, 0, 0, newYork), false},
+		{"end of a long night", night, time.Date(2026, 11, 1, 5, 30, 0, 0, newYork), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.schedule.Open(tt.at.UTC()); got != tt.want {
+				t.Errorf("Open(%s) = %t, want %t", tt.at, got, tt.want)
+			}
+		})
+	}
+}
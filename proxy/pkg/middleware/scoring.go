@@ -0,0 +1,432 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+)
+
+// Headers attached to the upstream request when a risk score is available.
+// Client-supplied values are always stripped so they cannot be spoofed.
+const (
+	HeaderRiskScore = "X-Aegis-Risk-Score"
+	HeaderDecision  = "X-Aegis-Decision"
+)
+
+// Action is the enforcement decision associated with a risk score.
+type Action string
+
+const (
+	ActionAllow     Action = "allow"
+	ActionChallenge Action = "challenge"
+	ActionRateLimit Action = "rate_limit"
+	ActionBlock     Action = "block"
+)
+
+// RiskScore is a client's risk assessment, normalized so that 0 is benign
+// and 1 is certainly malicious.
+type RiskScore struct {
+	Value    float64  `json:"score"`
+	Smoothed *float64 `json:"smoothed,omitempty"`
+	Decision Action   `json:"decision,omitempty"`
+	Model    string   `json:"model,omitempty"`
+	Source   string   `json:"source,omitempty"`
+
+	// Attributions are per-feature contributions (e.g. SHAP values) returned
+	// by the scorer, explaining the score.
+	Attributions map[string]float64 `json:"attributions,omitempty"`
+
+	// Final marks decisions made deliberately upstream (e.g. verdicts),
+	// which bypass local thresholds and smoothing.
+	Final bool `json:"-"`
+}
+
+// ScoreRequest is the input sent to a scorer for a single request.
+type ScoreRequest struct {
+	ClientIP      string           `json:"client_ip"`
+	Method        string           `json:"method"`
+	Path          string           `json:"path"`
+	ContentLength int64            `json:"content_length"`
+	ModelID       string           `json:"model_id,omitempty"`
+	Features      *TrafficFeatures `json:"features,omitempty"`
+	// OffSchedule names the flagging schedules the request is outside of
+	OffSchedule []string `json:"off_schedule,omitempty"`
+	Travel      *Travel  `json:"travel,omitempty"`
+	// Familiarity is what the subject hasn't been seen with before
+	Familiarity *Familiarity `json:"familiarity,omitempty"`
+}
+
+// Scorer produces a risk score for a request.
+// A nil score with a nil error means no score is available.
+type Scorer interface {
+	Score(ctx context.Context, req *ScoreRequest) (*RiskScore, error)
+}
+
+// ResponseObserver is implemented by scorers that learn from response statuses.
+type ResponseObserver interface {
+	ObserveResponse(clientIP string, status int)
+}
+
+// RedisScoreCache reads the latest score the AI engine wrote for a client.
+type RedisScoreCache struct {
+	client *redis.Client
+}
+
+// NewRedisScoreCache creates a scorer backed by the AI engine's score cache.
+func NewRedisScoreCache(client *redis.Client) *RedisScoreCache {
+	return &RedisScoreCache{client: client}
+}
+
+// Score looks up aegis:score:ip:<IP> in Redis.
+func (c *RedisScoreCache) Score(ctx context.Context, req *ScoreRequest) (*RiskScore, error) {
+	data, err := c.client.Get(ctx, "aegis:score:ip:"+req.ClientIP).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var score RiskScore
+	if err := json.Unmarshal(data, &score); err != nil {
+		return nil, fmt.Errorf("invalid cached score: %w", err)
+	}
+	score.Source = "cache"
+	return &score, nil
+}
+
+// HTTPScorer scores requests inline by calling a scoring service.
+type HTTPScorer struct {
+	url    string
+	model  string
+	client *http.Client
+}
+
+// NewHTTPScorer creates an inline scorer that POSTs to the given URL.
+// The model name labels scores when the service doesn't report one itself;
+// when empty, the request's model_id is used.
+func NewHTTPScorer(url, model string, timeout time.Duration) *HTTPScorer {
+	return &HTTPScorer{
+		url:    url,
+		model:  model,
+		client: &http.Client{Timeout: timeout},
+	}
+}
+
+// Score posts the request features to the scoring service.
+func (s *HTTPScorer) Score(ctx context.Context, req *ScoreRequest) (*RiskScore, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("scoring service returned %d", resp.StatusCode)
+	}
+
+	var score RiskScore
+	if err := json.NewDecoder(resp.Body).Decode(&score); err != nil {
+		return nil, fmt.Errorf("invalid scoring response: %w", err)
+	}
+	score.Source = "inline"
+	if score.Model == "" {
+		score.Model = s.model
+	}
+	if score.Model == "" {
+		score.Model = req.ModelID
+	}
+	return &score, nil
+}
+
+// ScoringOptions configures the scoring stage.
+type ScoringOptions struct {
+	// Profiles select the model and response policy for each route.
+	Profiles *RouteProfiles
+
+	// Enforce carries out decisions through the Responder; otherwise the
+	// decision is only annotated for the upstream (monitor mode). It can be
+	// changed at runtime with SetEnforce.
+	Enforce   bool
+	Responder *Responder
+	// Smoother, if set, derives decisions from smoothed rather than raw scores.
+	Smoother *ScoreSmoother
+	// Shadow is an optional challenger scorer. Its results are logged next
+	// to the champion's but never influence headers or enforcement.
+	Shadow Scorer
+
+	// Decisions stores the top contributing features of non-allow decisions
+	// so analysts can see why a client was acted upon.
+	Decisions   *DecisionStore
+	TopFeatures int
+	Auditor     *Auditor
+
+	// Aggregates, if set, receives every score for the risk heatmap.
+	Aggregates *RiskAggregator
+}
+
+// ScoringMiddleware attaches the client's risk score and decision to the
+// upstream request so backends can apply their own graduated responses.
+type ScoringMiddleware struct {
+	scorers   []Scorer
+	observers []ResponseObserver
+	listeners []func(ScoreEvent)
+	opts      ScoringOptions
+	enforce   atomic.Bool
+}
+
+// ScoreEvent describes a scored request, for listeners such as webhooks.
+type ScoreEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	ClientIP  string    `json:"client_ip"`
+	Subject   string    `json:"subject,omitempty"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Score     float64   `json:"score"`
+	Decision  Action    `json:"decision"`
+	Model     string    `json:"model,omitempty"`
+	Enforced  bool      `json:"enforced"`
+}
+
+// NewScoringMiddleware creates the scoring stage. Scorers are tried in order
+// (e.g. inline, then cached) and the first one to return a score wins.
+func NewScoringMiddleware(opts ScoringOptions, scorers ...Scorer) *ScoringMiddleware {
+	s := &ScoringMiddleware{
+		scorers: scorers,
+		opts:    opts,
+	}
+	for _, scorer := range scorers {
+		if observer, ok := scorer.(ResponseObserver); ok {
+			s.observers = append(s.observers, observer)
+		}
+	}
+	s.enforce.Store(opts.Enforce)
+	return s
+}
+
+// Subscribe registers a function called synchronously with every score.
+// It must be called before the proxy starts serving and must not block.
+func (s *ScoringMiddleware) Subscribe(fn func(ScoreEvent)) {
+	s.listeners = append(s.listeners, fn)
+}
+
+// SetEnforce switches between enforce and monitor mode for new requests.
+func (s *ScoringMiddleware) SetEnforce(enforce bool) {
+	s.enforce.Store(enforce)
+}
+
+// Enforcing reports whether decisions are carried out.
+func (s *ScoringMiddleware) Enforcing() bool {
+	return s.enforce.Load()
+}
+
+// StripScoreHeaders removes the scoring headers clients send, so upstreams
+// only ever see those the scoring stage sets. It wraps every chain, since
+// chains without the scoring stage would otherwise forward them as sent.
+func StripScoreHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(HeaderRiskScore)
+		r.Header.Del(HeaderDecision)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Handler returns the middleware handler
+func (s *ScoringMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never trust scoring headers from the client
+		r.Header.Del(HeaderRiskScore)
+		r.Header.Del(HeaderDecision)
+
+		profile := s.opts.Profiles.Match(r.URL.Path)
+		req := &ScoreRequest{
+			ClientIP:      clientIP(r),
+			Method:        r.Method,
+			Path:          r.URL.Path,
+			ContentLength: r.ContentLength,
+			ModelID:       profile.ModelID,
+			Features:      featuresFromContext(r.Context()),
+			OffSchedule:   offScheduleFromContext(r.Context()),
+			Travel:        travelFromContext(r.Context()),
+			Familiarity:   familiarityFromContext(r.Context()),
+		}
+
+		if s.opts.Shadow != nil {
+			setShadowScore(r.Context(), s.scoreShadow(r.Context(), req, profile.Policy))
+		}
+
+		score := s.score(r.Context(), req)
+		if score != nil {
+			s.applyDecision(req, profile.Policy, score)
+			r.Header.Set(HeaderRiskScore, strconv.FormatFloat(score.Value, 'f', 4, 64))
+			r.Header.Set(HeaderDecision, string(score.Decision))
+			r = r.WithContext(withScore(r.Context(), score))
+			if s.opts.Aggregates != nil {
+				s.opts.Aggregates.ObserveScore(tenantName(r.Context()), req.ClientIP, subjectFromContext(r.Context()), score)
+			}
+
+			var record *DecisionRecord
+			if score.Decision != ActionAllow && score.Decision != ActionLogOnly {
+				record = s.recordDecision(req.ClientIP, score)
+			}
+			s.notify(r, req, score)
+
+			if s.enforce.Load() {
+				rw := &responseWriterWrapper{ResponseWriter: w, statusCode: http.StatusOK}
+				if s.opts.Responder.Execute(rw, r, req.ClientIP, score.Decision) {
+					logging.For(r.Context()).Infof("[Scoring] %s for IP %s (score=%.4f)", score.Decision, req.ClientIP, score.Value)
+					noteDecision(r.Context(), "scoring", OutcomeDeny, string(score.Decision))
+					s.opts.Auditor.Record(AuditEvent{
+						ClientIP:  req.ClientIP,
+						Subject:   subjectFromContext(r.Context()),
+						Tenant:    tenantName(r.Context()),
+						RequestID: logging.RequestID(r.Context()),
+						Method:    r.Method,
+						Path:      r.URL.Path,
+						Status:    rw.statusCode,
+						Stage:     "scoring",
+						Reason:    string(score.Decision),
+						Decision:  record,
+					})
+					return
+				}
+			}
+		}
+
+		if len(s.observers) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ww := &responseWriterWrapper{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(ww, r)
+		for _, observer := range s.observers {
+			observer.ObserveResponse(req.ClientIP, ww.statusCode)
+		}
+	})
+}
+
+// notify passes the score to listeners.
+func (s *ScoringMiddleware) notify(r *http.Request, req *ScoreRequest, score *RiskScore) {
+	if len(s.listeners) == 0 {
+		return
+	}
+	ev := ScoreEvent{
+		Timestamp: time.Now().UTC(),
+		ClientIP:  req.ClientIP,
+		Subject:   subjectFromContext(r.Context()),
+		Tenant:    tenantName(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Score:     score.Value,
+		Decision:  score.Decision,
+		Model:     score.Model,
+		Enforced:  s.enforce.Load(),
+	}
+	for _, fn := range s.listeners {
+		fn(ev)
+	}
+}
+
+// score returns the first score produced by the configured scorers.
+// A failing scorer is logged and skipped so a later one can still answer.
+func (s *ScoringMiddleware) score(ctx context.Context, req *ScoreRequest) *RiskScore {
+	for _, scorer := range s.scorers {
+		score, err := scorer.Score(ctx, req)
+		if err != nil {
+			logging.For(ctx).Warnf("[Scoring] %T failed for %s: %v", scorer, req.ClientIP, err)
+			continue
+		}
+		if score != nil {
+			return score
+		}
+	}
+	// Without a model score, the heuristic stage's keeps basic protection
+	if score := heuristicScoreFromContext(ctx); score != nil {
+		fallback := *score
+		return &fallback
+	}
+	return nil
+}
+
+// scoreShadow runs the challenger in the background. The result is delivered
+// on the returned channel (nil if scoring failed) so the logger can pick it up
+// without the request waiting on it.
+func (s *ScoringMiddleware) scoreShadow(ctx context.Context, req *ScoreRequest, policy *ResponsePolicy) <-chan *RiskScore {
+	result := make(chan *RiskScore, 1)
+
+	// The request may finish before the challenger answers
+	ctx = context.WithoutCancel(ctx)
+
+	go func() {
+		score, err := s.opts.Shadow.Score(ctx, req)
+		if err != nil {
+			logging.For(ctx).Warnf("[Scoring] Shadow scoring failed for %s: %v", req.ClientIP, err)
+			score = nil
+		}
+		if score != nil && score.Decision == "" {
+			score.Decision = policy.Decide(score.Value, ActionAllow, 0)
+		}
+		result <- score
+	}()
+
+	return result
+}
+
+// recordDecision builds the explanation for a decision and persists it.
+func (s *ScoringMiddleware) recordDecision(clientIP string, score *RiskScore) *DecisionRecord {
+	record := &DecisionRecord{
+		ClientIP:    clientIP,
+		Score:       score.Value,
+		Decision:    score.Decision,
+		Model:       score.Model,
+		Source:      score.Source,
+		TopFeatures: topAttributions(score.Attributions, s.opts.TopFeatures),
+		DecidedAt:   time.Now().UTC(),
+	}
+
+	if s.opts.Decisions != nil {
+		s.opts.Decisions.Save(record)
+	}
+	return record
+}
+
+// applyDecision fills in the score's decision. Final decisions are kept;
+// otherwise the smoothed level is used when smoothing is enabled, and the
+// scorer's own suggestion or the route's policy when it is not. Smoothing
+// state is kept per client and model, since each model scores differently.
+func (s *ScoringMiddleware) applyDecision(req *ScoreRequest, policy *ResponsePolicy, score *RiskScore) {
+	if score.Final {
+		return
+	}
+	if s.opts.Smoother != nil {
+		level, action := s.opts.Smoother.Observe(req.ClientIP+"|"+req.ModelID, score.Value, policy)
+		score.Smoothed = &level
+		score.Decision = action
+		return
+	}
+	if score.Decision == "" {
+		score.Decision = policy.Decide(score.Value, ActionAllow, 0)
+	}
+}
@@ -0,0 +1,394 @@
+package middleware
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var sessionEvents = metrics.NewCounterVec("aegis_sessions_total",
+	"Browser session events of the session stage: login, logout, refreshed, expired or failed.", "event")
+
+const (
+	sessionPrefix = "aegis:session:"
+	// sessionLoginTTL bounds the time between the redirect to the IdP and
+	// the callback.
+	sessionLoginTTL = 10 * time.Minute
+	// sessionRefreshMargin is how long before expiry access tokens are
+	// refreshed, so they don't expire on their way upstream.
+	sessionRefreshMargin = 30 * time.Second
+	// sessionStateSuffix names the cookie binding a login to the browser
+	// that started it, after the session cookie's name.
+	sessionStateSuffix = "_state"
+)
+
+// SessionOptions configures the session stage.
+type SessionOptions struct {
+	// AuthorizeURL and TokenURL are the IdP's OIDC endpoints; the proxy is
+	// the client ClientID, with RedirectURL as its callback
+	AuthorizeURL string
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	CookieName   string
+	TTL          time.Duration // Lifetime of a session, refreshes included
+	// LogoutPath ends the session, then redirects to LogoutRedirect
+	LogoutPath     string
+	LogoutRedirect string
+	Timeout        time.Duration // Of token endpoint requests
+	Auditor        *Auditor
+}
+
+// SessionMiddleware lets browser apps use the same token-based stages as
+// API clients. It runs the OIDC authorization code flow (with PKCE) at the
+// edge, keeps the tokens in Redis and gives the browser only an HttpOnly
+// cookie naming the session. Requests with the cookie are forwarded with
+// the session's access token as a bearer token, refreshed as it expires,
+// and without the cookie. Requests carrying their own Authorization header
+// are left alone; browser navigations without a session are sent to log
+// in, and anything else passes on for the jwt stage to refuse.
+type SessionMiddleware struct {
+	client       *redis.Client
+	opts         SessionOptions
+	http         *http.Client
+	callbackPath string
+}
+
+// session is what Redis keeps of a session.
+type session struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Expires      int64  `json:"expires,omitempty"` // Of the access token, Unix seconds
+}
+
+// sessionLogin is a login in progress, kept under its state.
+type sessionLogin struct {
+	Verifier string `json:"verifier"` // PKCE code verifier
+	ReturnTo string `json:"return_to"`
+}
+
+// NewSessionMiddleware creates the session stage. Callbacks are served on
+// the path of RedirectURL.
+func NewSessionMiddleware(client *redis.Client, opts SessionOptions) (*SessionMiddleware, error) {
+	redirect, err := url.Parse(opts.RedirectURL)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionMiddleware{
+		client:       client,
+		opts:         opts,
+		http:         &http.Client{Timeout: opts.Timeout},
+		callbackPath: redirect.Path,
+	}, nil
+}
+
+// Handler returns the middleware handler
+func (m *SessionMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case m.callbackPath:
+			m.callback(w, r)
+			return
+		case m.opts.LogoutPath:
+			m.logout(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if cookie, err := r.Cookie(m.opts.CookieName); err == nil {
+			token, err := m.accessToken(r.Context(), cookie.Value)
+			if err != nil {
+				logging.For(r.Context()).Warnf("[Session] Failed to resume session from %s: %v", clientIP(r), err)
+			}
+			if token != "" {
+				removeCookie(r, m.opts.CookieName)
+				r.Header.Set("Authorization", "Bearer "+token)
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		if browserNavigation(r) {
+			m.login(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessToken returns the access token of a session, refreshing it when it
+// is about to expire, or "" if the session is gone or can't be refreshed.
+func (m *SessionMiddleware) accessToken(ctx context.Context, id string) (string, error) {
+	key := sessionPrefix + hashSessionID(id)
+	data, err := m.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	var s session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return "", err
+	}
+	if s.Expires == 0 || time.Now().Add(sessionRefreshMargin).Before(time.Unix(s.Expires, 0)) {
+		return s.AccessToken, nil
+	}
+
+	if s.RefreshToken == "" {
+		sessionEvents.Inc("expired")
+		m.client.Del(ctx, key)
+		return "", nil
+	}
+	tokens, err := requestToken(ctx, m.http, m.opts.TokenURL, m.opts.ClientID, m.opts.ClientSecret, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.RefreshToken},
+	})
+	if err != nil {
+		// A refused refresh ends the session; a failed one may be retried
+		if errors.Is(err, errTokenRejected) {
+			sessionEvents.Inc("expired")
+			m.client.Del(ctx, key)
+			return "", nil
+		}
+		sessionEvents.Inc("failed")
+		return "", err
+	}
+	sessionEvents.Inc("refreshed")
+	s = newSession(tokens, s.RefreshToken)
+	if data, err = json.Marshal(s); err != nil {
+		return "", err
+	}
+	// The session keeps its remaining lifetime
+	if err := m.client.SetArgs(ctx, key, data, redis.SetArgs{KeepTTL: true}).Err(); err != nil {
+		return "", err
+	}
+	return s.AccessToken, nil
+}
+
+// login sends the browser to the IdP, remembering where it was going. The
+// state is also set in a cookie, so only the browser that started a login
+// can complete it.
+func (m *SessionMiddleware) login(w http.ResponseWriter, r *http.Request) {
+	state, verifier := randomToken(), randomToken()
+	data, _ := json.Marshal(sessionLogin{Verifier: verifier, ReturnTo: r.URL.RequestURI()})
+	if err := m.client.Set(r.Context(), sessionPrefix+"login:"+state, data, sessionLoginTTL).Err(); err != nil {
+		logging.For(r.Context()).Warnf("[Session] Failed to start login for %s: %v", clientIP(r), err)
+		pages.WriteError(w, r, pages.ErrUnavailable)
+		return
+	}
+	m.setStateCookie(w, r, state, int(sessionLoginTTL.Seconds()))
+
+	challenge := sha256.Sum256([]byte(verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {m.opts.ClientID},
+		"redirect_uri":          {m.opts.RedirectURL},
+		"scope":                 {strings.Join(m.opts.Scopes, " ")},
+		"state":                 {state},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(m.opts.AuthorizeURL, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, m.opts.AuthorizeURL+separator+query.Encode(), http.StatusFound)
+}
+
+// callback completes a login: it trades the code for tokens, stores them
+// and sets the session cookie. The state must be the one set in the
+// browser's state cookie, or a victim opening an attacker's callback URL
+// would be logged in as the attacker.
+func (m *SessionMiddleware) callback(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	state := query.Get("state")
+	cookie, err := r.Cookie(m.opts.CookieName + sessionStateSuffix)
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		m.loginFailed(w, r, "state not started by this browser")
+		return
+	}
+	m.setStateCookie(w, r, "", -1)
+
+	data, err := m.client.GetDel(r.Context(), sessionPrefix+"login:"+state).Bytes()
+	var login sessionLogin
+	switch {
+	case errors.Is(err, redis.Nil):
+		m.loginFailed(w, r, "unknown or expired state")
+		return
+	case err != nil:
+		logging.For(r.Context()).Warnf("[Session] Failed to complete login for %s: %v", clientIP(r), err)
+		pages.WriteError(w, r, pages.ErrUnavailable)
+		return
+	case json.Unmarshal(data, &login) != nil:
+		m.loginFailed(w, r, "invalid login state")
+		return
+	case query.Get("error") != "":
+		m.loginFailed(w, r, "IdP returned "+query.Get("error"))
+		return
+	}
+
+	tokens, err := requestToken(r.Context(), m.http, m.opts.TokenURL, m.opts.ClientID, m.opts.ClientSecret, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {m.opts.RedirectURL},
+		"code_verifier": {login.Verifier},
+	})
+	if err != nil {
+		if errors.Is(err, errTokenRejected) {
+			m.loginFailed(w, r, err.Error())
+			return
+		}
+		sessionEvents.Inc("failed")
+		logging.For(r.Context()).Warnf("[Session] Token request for %s failed: %v", clientIP(r), err)
+		pages.WriteError(w, r, pages.ErrUnavailable)
+		return
+	}
+
+	id := randomToken()
+	data, _ = json.Marshal(newSession(tokens, ""))
+	if err := m.client.Set(r.Context(), sessionPrefix+hashSessionID(id), data, m.opts.TTL).Err(); err != nil {
+		logging.For(r.Context()).Warnf("[Session] Failed to store session for %s: %v", clientIP(r), err)
+		pages.WriteError(w, r, pages.ErrUnavailable)
+		return
+	}
+	sessionEvents.Inc("login")
+	logging.For(r.Context()).Infof("[Session] Session started for %s", clientIP(r))
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.opts.CookieName,
+		Value:    id,
+		Path:     "/",
+		MaxAge:   int(m.opts.TTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, localPath(login.ReturnTo), http.StatusFound)
+}
+
+// loginFailed logs, audits and refuses a callback that can't complete.
+func (m *SessionMiddleware) loginFailed(w http.ResponseWriter, r *http.Request, reason string) {
+	sessionEvents.Inc("failed")
+	logging.For(r.Context()).Infof("[Session] Login from %s failed: %s", clientIP(r), reason)
+	m.opts.Auditor.Record(AuditEvent{
+		ClientIP:  clientIP(r),
+		Tenant:    tenantName(r.Context()),
+		RequestID: logging.RequestID(r.Context()),
+		Method:    r.Method,
+		Path:      r.URL.Path,
+		Status:    http.StatusUnauthorized,
+		Stage:     "session",
+		Reason:    reason,
+	})
+	pages.Write(w, r, http.StatusUnauthorized, pages.CodeUnauthorized, "Unauthorized - Login Failed")
+}
+
+// logout ends the session and clears its cookie. It only takes POST, so
+// other sites can't log users out with a link or an image.
+func (m *SessionMiddleware) logout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		pages.Write(w, r, http.StatusMethodNotAllowed, pages.CodeMethodNotAllowed, "Method Not Allowed")
+		return
+	}
+	if cookie, err := r.Cookie(m.opts.CookieName); err == nil {
+		if err := m.client.Del(r.Context(), sessionPrefix+hashSessionID(cookie.Value)).Err(); err != nil {
+			logging.For(r.Context()).Warnf("[Session] Failed to end session for %s: %v", clientIP(r), err)
+		} else {
+			sessionEvents.Inc("logout")
+		}
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.opts.CookieName,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, m.opts.LogoutRedirect, http.StatusSeeOther)
+}
+
+// setStateCookie sets, or with a negative maxAge clears, the cookie
+// binding a login's state to the browser. It is only sent to the callback.
+func (m *SessionMiddleware) setStateCookie(w http.ResponseWriter, r *http.Request, state string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.opts.CookieName + sessionStateSuffix,
+		Value:    state,
+		Path:     m.callbackPath,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// newSession records the tokens of a token response, keeping refreshToken
+// if the IdP didn't rotate it.
+func newSession(tokens *tokenResponse, refreshToken string) session {
+	s := session{AccessToken: tokens.AccessToken, RefreshToken: tokens.RefreshToken}
+	if s.RefreshToken == "" {
+		s.RefreshToken = refreshToken
+	}
+	if tokens.ExpiresIn > 0 {
+		s.Expires = time.Now().Unix() + tokens.ExpiresIn
+	}
+	return s
+}
+
+// hashSessionID keys sessions by a hash of their ID, so reading Redis
+// doesn't yield usable cookies.
+func hashSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomToken returns 256 random bits, base64url-encoded.
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// browserNavigation reports whether a request is a browser loading a page,
+// which can be sent to log in.
+func browserNavigation(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if mode := r.Header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// removeCookie drops a cookie from the request, keeping the others.
+func removeCookie(r *http.Request, name string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if cookie.Name != name {
+			r.AddCookie(cookie)
+		}
+	}
+}
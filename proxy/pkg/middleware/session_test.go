@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newTestSession(t *testing.T) (*SessionMiddleware, http.Handler) {
+	t.Helper()
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(tokenResponse{AccessToken: "access-" + r.FormValue("code"), ExpiresIn: 300})
+	}))
+	t.Cleanup(idp.Close)
+	mr := miniredis.RunT(t)
+	m, err := NewSessionMiddleware(redis.NewClient(&redis.Options{Addr: mr.Addr()}), SessionOptions{
+		AuthorizeURL:   "https://idp.example.com/authorize",
+		TokenURL:       idp.URL,
+		ClientID:       "aegis",
+		RedirectURL:    "https://app.example.com/oauth2/callback",
+		CookieName:     "aegis_session",
+		TTL:            time.Hour,
+		LogoutPath:     "/oauth2/logout",
+		LogoutRedirect: "/",
+		Timeout:        5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+}
+
+// startLogin navigates to a page without a session and returns the state
+// sent to the IdP and the state cookie set with it.
+func startLogin(t *testing.T, h http.Handler) (string, *http.Cookie) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+	req.Header.Set("Sec-Fetch-Mode", "navigate")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("navigation without a session = %d, want 302", rec.Code)
+	}
+	location, err := url.Parse(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "aegis_session_state" {
+			if !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/oauth2/callback" {
+				t.Errorf("state cookie = %+v, want HttpOnly, SameSite=Lax, on the callback path", cookie)
+			}
+			return location.Query().Get("state"), cookie
+		}
+	}
+	t.Fatal("no state cookie set")
+	return "", nil
+}
+
+func TestSessionCallbackState(t *testing.T) {
+	tests := []struct {
+		name        string
+		cookie      func(victim, attacker *http.Cookie) *http.Cookie
+		wantSession bool
+	}{
+		{"state cookie of the same browser", func(victim, attacker *http.Cookie) *http.Cookie { return attacker }, true},
+		{"no state cookie", func(victim, attacker *http.Cookie) *http.Cookie { return nil }, false},
+		{"state cookie of another login", func(victim, attacker *http.Cookie) *http.Cookie { return victim }, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, h := newTestSession(t)
+			_, victim := startLogin(t, h)
+			state, attacker := startLogin(t, h)
+
+			// The attacker's callback URL, opened by whoever holds the cookie
+			req := httptest.NewRequest(http.MethodGet, "/oauth2/callback?code=attacker&state="+state, nil)
+			if cookie := tt.cookie(victim, attacker); cookie != nil {
+				req.AddCookie(cookie)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			var session *http.Cookie
+			for _, cookie := range rec.Result().Cookies() {
+				if cookie.Name == "aegis_session" {
+					session = cookie
+				}
+			}
+			if got := session != nil; got != tt.wantSession {
+				t.Fatalf("session started = %t (status %d), want %t", got, rec.Code, tt.wantSession)
+			}
+			if !tt.wantSession {
+				if rec.Code != http.StatusUnauthorized {
+					t.Errorf("status = %d, want 401", rec.Code)
+				}
+				return
+			}
+			if location := rec.Header().Get("Location"); location != "/orders" {
+				t.Errorf("Location = %q, want /orders", location)
+			}
+
+			req = httptest.NewRequest(http.MethodGet, "/orders", nil)
+			req.AddCookie(session)
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Body.String() != "Bearer access-attacker" {
+				t.Errorf("forwarded Authorization = %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestSessionLogout(t *testing.T) {
+	m, h := newTestSession(t)
+	state, stateCookie := startLogin(t, h)
+	req := httptest.NewRequest(http.MethodGet, "/oauth2/callback?code=user&state="+state, nil)
+	req.AddCookie(stateCookie)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var session *http.Cookie
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == "aegis_session" {
+			session = cookie
+		}
+	}
+	if session == nil {
+		t.Fatalf("login failed with %d", rec.Code)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req = httptest.NewRequest(method, "/oauth2/logout", nil)
+		req.AddCookie(session)
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+			t.Errorf("%s logout = %d, want 405 allowing POST", method, rec.Code)
+		}
+	}
+	if token, _ := m.accessToken(req.Context(), session.Value); token == "" {
+		t.Fatal("session ended by a GET")
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/oauth2/logout", nil)
+	req.AddCookie(session)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/" {
+		t.Errorf("POST logout = %d to %q, want 303 to /", rec.Code, rec.Header().Get("Location"))
+	}
+	if token, _ := m.accessToken(req.Context(), session.Value); token != "" {
+		t.Error("session still valid after logout")
+	}
+}
@@ -0,0 +1,201 @@
+package middleware
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+// Priorities of the load shedder, highest first.
+const (
+	PriorityTrusted   = "trusted"   // Authenticated and low risk
+	PriorityRisky     = "risky"     // Authenticated with a high score
+	PriorityAnonymous = "anonymous" // Low risk without a token
+	PriorityUntrusted = "untrusted" // High risk without a token
+)
+
+// shedShares are the shares of the concurrency limit each priority may use,
+// so lower priorities are shed first as the proxy nears saturation.
+var shedShares = map[string]float64{
+	PriorityTrusted:   1.0,
+	PriorityRisky:     0.9,
+	PriorityAnonymous: 0.75,
+	PriorityUntrusted: 0.5,
+}
+
+var shedRequests = metrics.NewCounterVec("aegis_shed_total",
+	"Requests refused by the load shedder, by priority.", "priority")
+
+const (
+	shedWindowSamples = 10                     // Latency samples per limit update, at least
+	shedWindowMin     = 100 * time.Millisecond // Time per limit update, at least
+	shedBaselineAlpha = 0.002                  // Weight of a slower window in the latency baseline
+	shedSmoothing     = 0.2                    // Weight of a new limit against the current one
+	shedBackoff       = 0.9                    // Limit kept after an overloaded upstream
+)
+
+// LoadShedOptions configures adaptive load shedding.
+type LoadShedOptions struct {
+	MinLimit, MaxLimit, InitialLimit int
+	// Tolerance is how far latency may rise above its baseline, as a
+	// ratio, before the limit shrinks
+	Tolerance  float64
+	RetryAfter time.Duration
+	// LowRisk is the score below which traffic counts as low risk
+	LowRisk float64
+}
+
+// LoadShedder limits the requests in flight to a concurrency limit that
+// adapts to observed latency: while latency stays near its long-term
+// baseline the limit grows, and as requests queue in the proxy or the
+// upstream and latency rises, it shrinks in proportion. An upstream that
+// answers 502, 503 or 504 shrinks it at once. Requests over the limit get
+// 503 with Retry-After, lower priorities first: anonymous and high-risk
+// traffic may only use part of the limit, so authenticated low-risk traffic
+// is still served while the rest is shed. It should run after jwt and
+// scoring, which decide priority.
+type LoadShedder struct {
+	opts LoadShedOptions
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	baseline float64 // Long-term latency, in seconds
+
+	// The current window
+	start    time.Time
+	sum      float64
+	samples  int
+	overload bool
+}
+
+// NewLoadShedder creates the shed stage.
+func NewLoadShedder(opts LoadShedOptions) *LoadShedder {
+	s := &LoadShedder{opts: opts, limit: float64(opts.InitialLimit), start: time.Now()}
+	metrics.NewGaugeFunc("aegis_concurrency_limit", "Requests the load shedder lets into the proxy at once.", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return math.Floor(s.limit)
+	})
+	metrics.NewGaugeFunc("aegis_inflight_requests", "Requests admitted by the load shedder and not yet answered.", func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(s.inflight)
+	})
+	return s
+}
+
+// Handler returns the middleware handler
+func (s *LoadShedder) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		priority := s.priority(r)
+		if !s.acquire(priority) {
+			shedRequests.Inc(priority)
+			logging.For(r.Context()).Debugf("[Shed] Refused %s %s from %s (%s)", r.Method, r.URL.Path, clientIP(r), priority)
+			noteDecision(r.Context(), "shed", OutcomeDeny, "overloaded, "+priority)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(s.opts.RetryAfter.Seconds()))))
+			pages.WriteError(w, r, pages.ErrOverloaded)
+			return
+		}
+
+		start := time.Now()
+		ww := &responseWriterWrapper{ResponseWriter: w, statusCode: http.StatusOK}
+		defer func() {
+			s.release(time.Since(start), ww.statusCode)
+		}()
+		next.ServeHTTP(ww, r)
+	})
+}
+
+// priority ranks a request by whether it is authenticated and its risk.
+func (s *LoadShedder) priority(r *http.Request) string {
+	risky := false
+	if score := scoreFromContext(r.Context()); score != nil {
+		risky = score.Value >= s.opts.LowRisk
+	}
+	switch authenticated := subjectFromContext(r.Context()) != ""; {
+	case authenticated && !risky:
+		return PriorityTrusted
+	case authenticated:
+		return PriorityRisky
+	case !risky:
+		return PriorityAnonymous
+	default:
+		return PriorityUntrusted
+	}
+}
+
+// acquire admits a request of priority if its share of the limit has room.
+func (s *LoadShedder) acquire(priority string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if float64(s.inflight) >= math.Max(1, s.limit*shedShares[priority]) {
+		return false
+	}
+	s.inflight++
+	return true
+}
+
+// release records an answered request's latency and status, updating the
+// limit once a window is complete.
+func (s *LoadShedder) release(latency time.Duration, status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inflight--
+	switch status {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		s.overload = true
+	default:
+		s.sum += latency.Seconds()
+		s.samples++
+	}
+
+	now := time.Now()
+	if now.Sub(s.start) < shedWindowMin || (s.samples < shedWindowSamples && !s.overload) {
+		return
+	}
+	s.update()
+	s.start, s.sum, s.samples, s.overload = now, 0, 0, false
+}
+
+// update computes the next limit from the window; s.mu must be held. The
+// gradient of baseline over current latency scales the limit down as
+// latency rises, and the square root of the limit is headroom for growth.
+func (s *LoadShedder) update() {
+	var next float64
+	switch {
+	case s.overload:
+		next = s.limit * shedBackoff
+	case s.samples == 0:
+		return
+	default:
+		latency := s.sum / float64(s.samples)
+		// The baseline follows drops in latency at once and rises slowly,
+		// so it approximates latency without queueing
+		if s.baseline == 0 || latency < s.baseline {
+			s.baseline = latency
+		} else {
+			s.baseline += (latency - s.baseline) * shedBaselineAlpha
+		}
+		gradient := math.Max(0.5, math.Min(1, s.opts.Tolerance*s.baseline/latency))
+		next = s.limit*gradient + math.Sqrt(s.limit)
+		// Only grow a limit that is used, or it grows without bound while idle
+		if next > s.limit && float64(s.inflight) < s.limit/2 {
+			next = s.limit
+		}
+		next = s.limit*(1-shedSmoothing) + next*shedSmoothing
+	}
+
+	previous := s.limit
+	s.limit = math.Max(float64(s.opts.MinLimit), math.Min(float64(s.opts.MaxLimit), next))
+	if math.Floor(s.limit) != math.Floor(previous) {
+		logging.Debugf("[Shed] Concurrency limit %.0f -> %.0f (baseline %v)", previous, s.limit,
+			time.Duration(s.baseline*float64(time.Second)).Round(time.Microsecond))
+	}
+}
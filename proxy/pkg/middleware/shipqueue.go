@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+// Overflow policies of the log shipping queue.
+const (
+	OverflowDropNewest = "drop-newest" // Discard the log that doesn't fit
+	OverflowDropOldest = "drop-oldest" // Discard the longest-waiting log to make room
+	OverflowBlock      = "block"       // Hold the request until there is room
+)
+
+var (
+	shipDropped = metrics.NewCounterVec("aegis_log_ship_dropped_total",
+		"Access logs dropped because the shipping queue was full, by overflow policy.", "policy")
+	shipBlocked = metrics.NewCounterVec("aegis_log_ship_blocked_total",
+		"Requests that waited for room in the full shipping queue.")
+
+	// shipDepth reports the depth of the latest queue, the logger's; it
+	// is registered once however many loggers tests create
+	latestShipQueue atomic.Pointer[shipQueue]
+	shipDepth       = sync.OnceFunc(func() {
+		metrics.NewGaugeFunc("aegis_log_ship_queue_depth", "Access logs waiting to be shipped.", func() float64 {
+			if q := latestShipQueue.Load(); q != nil {
+				return float64(len(q.jobs))
+			}
+			return 0
+		})
+	})
+)
+
+// shipJob is a request's log waiting to be shipped. Jobs are pooled, so
+// logging a request doesn't allocate its RequestLog and FeatureVector.
+type shipJob struct {
+	entry    RequestLog
+	vector   FeatureVector
+	features *TrafficFeatures
+	shadow   <-chan *RiskScore
+	tenant   *Tenant
+}
+
+var shipJobs = sync.Pool{New: func() interface{} { return new(shipJob) }}
+
+func newShipJob() *shipJob {
+	return shipJobs.Get().(*shipJob)
+}
+
+// release returns the job to the pool once it is shipped or dropped.
+func (job *shipJob) release() {
+	*job = shipJob{}
+	shipJobs.Put(job)
+}
+
+// shipQueue hands logs to a fixed pool of workers through a bounded
+// channel, so a Kafka slowdown fills the queue instead of piling up
+// goroutines.
+type shipQueue struct {
+	jobs     chan *shipJob
+	overflow string
+	workers  sync.WaitGroup
+
+	mu     sync.RWMutex // Held for reading while enqueueing, so close waits
+	closed bool
+}
+
+// newShipQueue starts workers calling ship for each queued job.
+func newShipQueue(workers, size int, overflow string, ship func(*shipJob)) *shipQueue {
+	q := &shipQueue{jobs: make(chan *shipJob, size), overflow: overflow}
+	latestShipQueue.Store(q)
+	shipDepth()
+	for i := 0; i < workers; i++ {
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			for job := range q.jobs {
+				ship(job)
+				job.release()
+			}
+		}()
+	}
+	return q
+}
+
+// enqueue queues a job, applying the overflow policy when the queue is full.
+func (q *shipQueue) enqueue(job *shipJob) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		shipDropped.Inc(q.overflow)
+		job.release()
+		return
+	}
+
+	select {
+	case q.jobs <- job:
+		return
+	default:
+	}
+	switch q.overflow {
+	case OverflowBlock:
+		shipBlocked.Inc()
+		q.jobs <- job
+	case OverflowDropOldest:
+		for {
+			select {
+			case oldest := <-q.jobs:
+				shipDropped.Inc(q.overflow)
+				oldest.release()
+			default:
+			}
+			select {
+			case q.jobs <- job:
+				return
+			default:
+			}
+		}
+	default:
+		shipDropped.Inc(q.overflow)
+		job.release()
+	}
+}
+
+// close stops accepting jobs and waits for the queued ones to be shipped.
+func (q *shipQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	close(q.jobs)
+	q.mu.Unlock()
+	q.workers.Wait()
+}
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"log"
+
+	"github.com/IBM/sarama"
+)
+
+// EventSink publishes keyed events to a named stream. Publish must not keep
+// value after it returns; callers reuse its buffer.
+type EventSink interface {
+	Publish(topic, key string, value []byte) error
+	Close() error
+}
+
+// KafkaSink publishes events to Kafka topics with a synchronous producer.
+type KafkaSink struct {
+	client   sarama.Client
+	producer sarama.SyncProducer
+}
+
+// NewKafkaSink connects a producer to the given brokers.
+func NewKafkaSink(brokers []string) (*KafkaSink, error) {
+	// Configure Kafka producer for reliability and speed
+	config := sarama.NewConfig()
+	config.Producer.Return.Successes = true
+	config.Producer.RequiredAcks = sarama.WaitForLocal // Local ack is sufficient for high throughput
+	config.Producer.Retry.Max = 3
+
+	client, err := sarama.NewClient(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	log.Printf("[Kafka] Connected producer to %v", brokers)
+	return &KafkaSink{client: client, producer: producer}, nil
+}
+
+// Publish sends a single message. The key determines partition locality.
+func (k *KafkaSink) Publish(topic, key string, value []byte) error {
+	msg := &sarama.ProducerMessage{
+		Topic: topic,
+		Key:   sarama.StringEncoder(key),
+		Value: sarama.ByteEncoder(value),
+	}
+	_, _, err := k.producer.SendMessage(msg)
+	return err
+}
+
+// Check fetches the metadata of topic from the brokers, verifying that
+// they can be reached.
+func (k *KafkaSink) Check(topic string) error {
+	return k.client.RefreshMetadata(topic)
+}
+
+// Close ensures the Kafka connection is terminated gracefully.
+func (k *KafkaSink) Close() error {
+	err := k.producer.Close()
+	if cerr := k.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package middleware
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Smoothing modes for ScoreSmoother.
+const (
+	SmoothingEWMA   = "ewma"
+	SmoothingWindow = "window"
+)
+
+// SmoothingConfig controls how raw scores are smoothed before enforcement.
+type SmoothingConfig struct {
+	Mode  string  // SmoothingEWMA or SmoothingWindow
+	Alpha float64 // EWMA weight of the newest score
+	K, N  int     // Window mode: act when K of the last N scores cross a threshold
+
+	// Hysteresis is how far the level must fall below a band before the
+	// client leaves it, so borderline clients don't flap.
+	Hysteresis float64
+}
+
+// ScoreSmoother tracks per-client score history and turns it into a stable action.
+type ScoreSmoother struct {
+	mu        sync.Mutex
+	cfg       SmoothingConfig
+	clients   map[string]*smoothState
+	lastSweep time.Time
+}
+
+type smoothState struct {
+	ewma     float64
+	window   []float64 // Ring buffer of the last N scores
+	next     int
+	action   Action
+	lastSeen time.Time
+}
+
+// smoothIdleTTL is how long a client's history is kept without new requests.
+const smoothIdleTTL = 10 * time.Minute
+
+// NewScoreSmoother creates a smoother with the given configuration.
+func NewScoreSmoother(cfg SmoothingConfig) *ScoreSmoother {
+	return &ScoreSmoother{
+		cfg:       cfg,
+		clients:   make(map[string]*smoothState),
+		lastSweep: time.Now(),
+	}
+}
+
+// SetConfig replaces the smoothing parameters; the mode stays as created.
+// Client windows are cleared when their size changes, since scores kept
+// for the old size no longer line up with it.
+func (s *ScoreSmoother) SetConfig(cfg SmoothingConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cfg.Mode = s.cfg.Mode
+	if cfg.N != s.cfg.N {
+		for _, st := range s.clients {
+			st.window, st.next = nil, 0
+		}
+	}
+	s.cfg = cfg
+}
+
+// Observe records a raw score for the client and returns the smoothed level
+// together with the action it currently warrants under the given policy.
+func (s *ScoreSmoother) Observe(clientIP string, score float64, policy *ResponsePolicy) (float64, Action) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+
+	st, ok := s.clients[clientIP]
+	if !ok {
+		st = &smoothState{ewma: score, action: ActionAllow}
+		s.clients[clientIP] = st
+	}
+	st.lastSeen = now
+
+	var level float64
+	switch s.cfg.Mode {
+	case SmoothingWindow:
+		if len(st.window) < s.cfg.N {
+			st.window = append(st.window, score)
+		} else {
+			st.window[st.next] = score
+		}
+		st.next = (st.next + 1) % s.cfg.N
+		level = kthLargest(st.window, s.cfg.K)
+	default:
+		if ok {
+			st.ewma = s.cfg.Alpha*score + (1-s.cfg.Alpha)*st.ewma
+		}
+		level = st.ewma
+	}
+
+	st.action = policy.Decide(level, st.action, s.cfg.Hysteresis)
+	return level, st.action
+}
+
+// kthLargest returns the k-th largest value, which crosses a threshold
+// exactly when at least k values do. It is 0 until k values are known.
+func kthLargest(values []float64, k int) float64 {
+	if len(values) < k {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Sort(sort.Reverse(sort.Float64Slice(sorted)))
+	return sorted[k-1]
+}
+
+// sweep drops idle clients. Callers must hold the lock.
+func (s *ScoreSmoother) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+
+	for ip, st := range s.clients {
+		if now.Sub(st.lastSeen) > smoothIdleTTL {
+			delete(s.clients, ip)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestScoreSmoother(t *testing.T) {
+	policy := NewResponsePolicy([]ResponseBand{
+		{MinScore: 0.5, Action: ActionRateLimit},
+		{MinScore: 0.75, Action: ActionBlock},
+	})
+	type step struct {
+		score  float64
+		level  float64
+		action Action
+	}
+	tests := []struct {
+		name  string
+		cfg   SmoothingConfig
+		steps []step
+	}{
+		{
+			"ewma", SmoothingConfig{Mode: SmoothingEWMA, Alpha: 0.5, Hysteresis: 0.1},
+			[]step{
+				{0.2, 0.2, ActionAllow}, // The first score starts the average
+				{1.0, 0.6, ActionRateLimit},
+				{1.0, 0.8, ActionBlock},
+				{0.6, 0.7, ActionBlock}, // Within hysteresis of the block band
+				{0.4, 0.55, ActionRateLimit},
+				{0.4, 0.475, ActionRateLimit},
+				{0.1, 0.2875, ActionAllow},
+			},
+		},
+		{
+			"window", SmoothingConfig{Mode: SmoothingWindow, K: 2, N: 3},
+			[]step{
+				{0.9, 0, ActionAllow}, // Fewer than K scores
+				{0.9, 0.9, ActionBlock},
+				{0.1, 0.9, ActionBlock},
+				{0.1, 0.1, ActionAllow}, // The first 0.9 is overwritten
+				{0.6, 0.1, ActionAllow},
+				{0.6, 0.6, ActionRateLimit},
+			},
+		},
+		{
+			"window with hysteresis", SmoothingConfig{Mode: SmoothingWindow, K: 1, N: 2, Hysteresis: 0.1},
+			[]step{
+				{0.8, 0.8, ActionBlock},
+				{0.7, 0.8, ActionBlock},
+				{0.7, 0.7, ActionBlock},
+				{0.6, 0.7, ActionBlock},
+				{0.6, 0.6, ActionRateLimit},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewScoreSmoother(tt.cfg)
+			for i, st := range tt.steps {
+				level, action := s.Observe("10.0.0.1", st.score, policy)
+				if math.Abs(level-st.level) > 1e-9 || action != st.action {
+					t.Fatalf("step %d: Observe(%v) = %v, %s, want %v, %s", i, st.score, level, action, st.level, st.action)
+				}
+			}
+			// Clients are smoothed separately
+			if level, action := s.Observe("10.0.0.2", 0.3, policy); action != ActionAllow || tt.cfg.Mode == SmoothingEWMA && level != 0.3 {
+				t.Errorf("new client: Observe(0.3) = %v, %s", level, action)
+			}
+		})
+	}
+}
+
+func TestScoreSmootherSetConfig(t *testing.T) {
+	policy := NewResponsePolicy([]ResponseBand{{MinScore: 0.75, Action: ActionBlock}})
+	s := NewScoreSmoother(SmoothingConfig{Mode: SmoothingWindow, K: 1, N: 2})
+	s.Observe("10.0.0.1", 0.9, policy)
+
+	// The same size keeps the window
+	s.SetConfig(SmoothingConfig{Mode: SmoothingEWMA, K: 1, N: 2, Alpha: 0.5})
+	if level, _ := s.Observe("10.0.0.1", 0.1, policy); level != 0.9 {
+		t.Errorf("level after SetConfig with the same N = %v, want 0.9", level)
+	}
+
+	// A new size clears it; the mode stays as created
+	s.SetConfig(SmoothingConfig{K: 1, N: 3})
+	if level, _ := s.Observe("10.0.0.1", 0.2, policy); level != 0.2 {
+		t.Errorf("level after SetConfig with a new N = %v, want 0.2", level)
+	}
+}
+
+func TestScoreSmootherSweep(t *testing.T) {
+	policy := NewResponsePolicy([]ResponseBand{{MinScore: 0.75, Action: ActionBlock}})
+	s := NewScoreSmoother(SmoothingConfig{Mode: SmoothingEWMA, Alpha: 0.5})
+	s.Observe("10.0.0.1", 0.9, policy)
+	s.Observe("10.0.0.2", 0.9, policy)
+
+	s.mu.Lock()
+	s.clients["10.0.0.1"].lastSeen = time.Now().Add(-smoothIdleTTL - time.Second)
+	s.lastSweep = time.Now().Add(-2 * time.Minute)
+	s.mu.Unlock()
+
+	// The idle client starts over; the other keeps its history
+	if level, action := s.Observe("10.0.0.1", 0.1, policy); level != 0.1 || action != ActionAllow {
+		t.Errorf("idle client: Observe(0.1) = %v, %s, want 0.1, allow", level, action)
+	}
+	if level, _ := s.Observe("10.0.0.2", 0.1, policy); level != 0.5 {
+		t.Errorf("active client: level = %v, want 0.5", level)
+	}
+}
@@ -0,0 +1,111 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Stage is a stage of the middleware chain. Built-in stages are adapted
+// with NewStage; stages compiled in from elsewhere implement it themselves
+// and are made available with RegisterStage.
+type Stage interface {
+	Name() string
+	// Priority places a registered stage that STAGES doesn't list: below
+	// zero it runs outside the configured stages and above zero inside
+	// them, lowest first. At zero, it runs only where STAGES lists it, as
+	// built-in stages do.
+	Priority() int
+	// Handler wraps the next stage
+	Handler(next http.Handler) http.Handler
+	// Close releases the stage's resources once the proxy has stopped
+	// serving
+	Close() error
+}
+
+// funcStage adapts a handler wrapper to Stage.
+type funcStage struct {
+	name    string
+	handler func(http.Handler) http.Handler
+}
+
+// NewStage adapts the handler wrapper of a built-in stage, which has
+// nothing to close.
+func NewStage(name string, handler func(http.Handler) http.Handler) Stage {
+	return funcStage{name: name, handler: handler}
+}
+
+func (s funcStage) Name() string                           { return s.name }
+func (s funcStage) Priority() int                          { return 0 }
+func (s funcStage) Handler(next http.Handler) http.Handler { return s.handler(next) }
+func (s funcStage) Close() error                           { return nil }
+
+// wrappedStage replaces the handler of a stage, keeping the rest.
+type wrappedStage struct {
+	Stage
+	handler func(http.Handler) http.Handler
+}
+
+func (s wrappedStage) Handler(next http.Handler) http.Handler { return s.handler(next) }
+
+// WithHandler returns s with handler in place of its own, which handler
+// usually calls, as the decision log does to observe every stage.
+func WithHandler(s Stage, handler func(http.Handler) http.Handler) Stage {
+	return wrappedStage{Stage: s, handler: handler}
+}
+
+// StageOptions is what a registered stage is created with.
+type StageOptions struct {
+	// Settings are the stage's entry under stage_settings in the config file
+	Settings map[string]string
+	Sink     EventSink
+	Auditor  *Auditor
+	Redis    *redis.Client
+}
+
+// StageFactory creates a registered stage at startup. It may return a nil
+// Stage to stay out of the chain, e.g. when it isn't configured.
+type StageFactory func(opts StageOptions) (Stage, error)
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]StageFactory)
+)
+
+// RegisterStage makes a stage compiled into the proxy available under
+// name, usually from the init function of the file or package adding it.
+// It panics if the name is registered twice.
+func RegisterStage(name string, factory StageFactory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic(fmt.Sprintf("middleware: stage %q registered twice", name))
+	}
+	registry[name] = factory
+}
+
+// RegisteredStages returns the names of registered stages, sorted.
+func RegisteredStages() []string {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewRegisteredStage creates the registered stage name with opts.
+func NewRegisteredStage(name string, opts StageOptions) (Stage, error) {
+	registryMu.Lock()
+	factory, ok := registry[name]
+	registryMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("stage %q is not registered", name)
+	}
+	return factory(opts)
+}
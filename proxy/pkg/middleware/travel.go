@@ -0,0 +1,161 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/geoip"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var impossibleTravel = metrics.NewCounterVec("aegis_impossible_travel_total",
+	"Requests from a subject farther from its last location than it could have traveled, by action.", "action")
+
+const (
+	travelPrefix = "aegis:travel:"
+	// travelHistory is how long a last location is kept. After a day even
+	// the antipodes are reachable, so older ones can't make travel impossible.
+	travelHistory = 24 * time.Hour
+)
+
+// Travel is how far a subject moved since its previous request, by the
+// GeoIP locations of their addresses.
+type Travel struct {
+	DistanceKm float64 `json:"distance_km"`
+	ElapsedSec float64 `json:"elapsed_s"`
+	SpeedKmh   float64 `json:"speed_kmh"` // 0 under the minimum distance
+	Impossible bool    `json:"impossible,omitempty"`
+}
+
+// TravelOptions configures impossible-travel detection.
+type TravelOptions struct {
+	GeoIP *geoip.DB
+	// MaxSpeed is the fastest plausible travel, in km/h
+	MaxSpeed float64
+	// MinDistance ignores moves shorter than GeoIP's accuracy, in km
+	MinDistance float64
+	// Action is carried out on impossible travel; ActionLogOnly only
+	// flags it
+	Action     Action
+	Responder  *Responder
+	KillSwitch *KillSwitch // Suspends Action while engaged, if set
+}
+
+// TravelMiddleware tracks each subject's last location in Redis and
+// computes the speed it would have needed to reach its current one. The
+// travel goes to the model with the request; travel faster than MaxSpeed,
+// such as the same account in Berlin and then Singapore ten minutes later,
+// is flagged and can be challenged.
+type TravelMiddleware struct {
+	client  *redis.Client
+	opts    TravelOptions
+	auditor *Auditor
+}
+
+// NewTravelMiddleware creates the travel stage.
+func NewTravelMiddleware(client *redis.Client, opts TravelOptions, auditor *Auditor) *TravelMiddleware {
+	return &TravelMiddleware{client: client, opts: opts, auditor: auditor}
+}
+
+// Handler returns the middleware handler
+func (m *TravelMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject := subjectFromContext(r.Context())
+		clientIP := clientIP(r)
+		addr, err := netip.ParseAddr(clientIP)
+		if subject == "" || err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		location, ok := m.opts.GeoIP.Lookup(addr)
+		if !ok || !location.HasLocation {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		travel, err := m.track(r, location, time.Now())
+		if err != nil {
+			logging.For(r.Context()).Warnf("[Travel] Failed to track %s: %v", subject, err)
+		}
+		if travel == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		setTravel(r.Context(), travel)
+
+		if travel.Impossible {
+			impossibleTravel.Inc(string(m.opts.Action))
+			reason := fmt.Sprintf("impossible travel: %.0f km in %.0fs", travel.DistanceKm, travel.ElapsedSec)
+			enforce := m.opts.Action != ActionLogOnly
+			if enforce && !m.opts.KillSwitch.enforcing() {
+				// Audited as it would have been carried out
+				reason += "; would " + string(m.opts.Action)
+				enforce = false
+			}
+			logging.For(r.Context()).Infof("[Travel] %s from %s: %s", subject, clientIP, reason)
+			noteDecision(r.Context(), "travel", "", reason)
+			m.auditor.Record(AuditEvent{
+				ClientIP:  clientIP,
+				Subject:   subject,
+				Tenant:    tenantName(r.Context()),
+				RequestID: logging.RequestID(r.Context()),
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Stage:     "travel",
+				Reason:    reason,
+			})
+			if enforce && m.opts.Responder.Execute(w, r, clientIP, m.opts.Action) {
+				noteDecision(r.Context(), "travel", OutcomeDeny, "")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// track stores the subject's location and returns its travel from the
+// previous one, or nil if it has none.
+func (m *TravelMiddleware) track(r *http.Request, location geoip.Record, now time.Time) (*Travel, error) {
+	key := travelPrefix + identityKey(r, true)
+	value := strconv.FormatFloat(location.Latitude, 'f', 4, 64) + "," +
+		strconv.FormatFloat(location.Longitude, 'f', 4, 64) + "," +
+		strconv.FormatInt(now.UnixMilli(), 10)
+	previous, err := m.client.SetArgs(r.Context(), key, value, redis.SetArgs{TTL: travelHistory, Get: true}).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(previous, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed last location %q", previous)
+	}
+	lat, err1 := strconv.ParseFloat(parts[0], 64)
+	lon, err2 := strconv.ParseFloat(parts[1], 64)
+	at, err3 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return nil, fmt.Errorf("malformed last location %q", previous)
+	}
+
+	elapsed := now.Sub(time.UnixMilli(at))
+	travel := &Travel{
+		DistanceKm: geoip.DistanceKm(lat, lon, location.Latitude, location.Longitude),
+		ElapsedSec: elapsed.Seconds(),
+	}
+	if travel.DistanceKm >= m.opts.MinDistance {
+		// Requests a moment apart still count as a second of travel
+		travel.SpeedKmh = travel.DistanceKm / max(elapsed, time.Second).Hours()
+		travel.Impossible = travel.SpeedKmh > m.opts.MaxSpeed
+	}
+	return travel, nil
+}
@@ -0,0 +1,297 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/IBM/sarama"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+// Verdict is an enforcement action published by the AI engine on the
+// verdicts topic. An "allow" verdict lifts any earlier action for the client.
+type Verdict struct {
+	ClientIP   string  `json:"client_ip"`
+	Action     Action  `json:"action"`
+	Score      float64 `json:"score"`
+	Reason     string  `json:"reason,omitempty"`
+	TTLSeconds int     `json:"ttl_seconds"`
+	// RequestID is the last request the verdict was based on
+	RequestID string `json:"request_id,omitempty"`
+
+	expiresAt time.Time
+}
+
+// verdictSweepEvery is how many verdicts are applied between sweeps of
+// the expired ones. Lookup ignores expired verdicts, so sweeping only bounds
+// memory; doing it on every verdict would hold the lock for the whole map
+// each time, just when the engine is busiest.
+const verdictSweepEvery = 1024
+
+// VerdictStore holds the active verdicts applied locally by this proxy.
+type VerdictStore struct {
+	mu         sync.RWMutex
+	verdicts   map[string]*Verdict
+	defaultTTL time.Duration
+	applied    int          // Since the last sweep
+	blocks     atomic.Int64 // Block verdicts applied
+}
+
+// NewVerdictStore creates an empty store. Verdicts without a TTL expire after defaultTTL.
+func NewVerdictStore(defaultTTL time.Duration) *VerdictStore {
+	return &VerdictStore{
+		verdicts:   make(map[string]*Verdict),
+		defaultTTL: defaultTTL,
+	}
+}
+
+// Apply records a verdict, replacing any earlier one for the same client.
+func (s *VerdictStore) Apply(v Verdict) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.applied++; s.applied >= verdictSweepEvery {
+		s.sweep(now)
+		s.applied = 0
+	}
+
+	if v.Action == ActionAllow {
+		delete(s.verdicts, v.ClientIP)
+		return
+	}
+
+	ttl := time.Duration(v.TTLSeconds) * time.Second
+	if ttl <= 0 {
+		ttl = s.defaultTTL
+	}
+	v.expiresAt = now.Add(ttl)
+	s.verdicts[v.ClientIP] = &v
+	if v.Action == ActionBlock {
+		s.blocks.Add(1)
+	}
+}
+
+// Blocks returns the number of block verdicts applied since startup.
+func (s *VerdictStore) Blocks() int64 {
+	return s.blocks.Load()
+}
+
+// Lookup returns the active verdict for a client, if any.
+func (s *VerdictStore) Lookup(clientIP string) (*Verdict, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v, ok := s.verdicts[clientIP]
+	if !ok || time.Now().After(v.expiresAt) {
+		return nil, false
+	}
+	return v, true
+}
+
+// Score implements Scorer so active verdicts also drive the decision header.
+func (s *VerdictStore) Score(ctx context.Context, req *ScoreRequest) (*RiskScore, error) {
+	v, ok := s.Lookup(req.ClientIP)
+	if !ok {
+		return nil, nil
+	}
+	return &RiskScore{Value: v.Score, Decision: v.Action, Source: "verdict", Final: true}, nil
+}
+
+// sweep drops expired verdicts. Callers must hold the write lock.
+func (s *VerdictStore) sweep(now time.Time) {
+	for ip, v := range s.verdicts {
+		if now.After(v.expiresAt) {
+			delete(s.verdicts, ip)
+		}
+	}
+}
+
+// VerdictConsumer subscribes to the verdicts topic and applies each verdict
+// to the local store. Every proxy replica reads all partitions from the
+// newest offset, so verdicts are broadcast rather than load-balanced.
+type VerdictConsumer struct {
+	consumer   sarama.Consumer
+	partitions []sarama.PartitionConsumer
+	store      *VerdictStore
+	wg         sync.WaitGroup
+}
+
+// NewVerdictConsumer connects to Kafka and starts consuming the verdicts topic.
+func NewVerdictConsumer(brokers []string, topic string, store *VerdictStore) (*VerdictConsumer, error) {
+	config := sarama.NewConfig()
+	config.Consumer.Offsets.Initial = sarama.OffsetNewest
+
+	consumer, err := sarama.NewConsumer(brokers, config)
+	if err != nil {
+		return nil, err
+	}
+
+	partitionIDs, err := consumer.Partitions(topic)
+	if err != nil {
+		consumer.Close()
+		return nil, err
+	}
+
+	vc := &VerdictConsumer{consumer: consumer, store: store}
+	for _, id := range partitionIDs {
+		pc, err := consumer.ConsumePartition(topic, id, sarama.OffsetNewest)
+		if err != nil {
+			vc.Close()
+			return nil, err
+		}
+		vc.partitions = append(vc.partitions, pc)
+
+		vc.wg.Add(1)
+		go vc.consume(pc)
+	}
+
+	log.Printf("[Verdicts] Consuming %d partitions of topic %s", len(partitionIDs), topic)
+	return vc, nil
+}
+
+// consume applies verdicts from a single partition until it is closed.
+func (vc *VerdictConsumer) consume(pc sarama.PartitionConsumer) {
+	defer vc.wg.Done()
+
+	for msg := range pc.Messages() {
+		var v Verdict
+		if err := json.Unmarshal(msg.Value, &v); err != nil {
+			log.Printf("[Verdicts] Ignoring malformed verdict: %v", err)
+			continue
+		}
+		if v.ClientIP == "" || v.Action == "" {
+			log.Printf("[Verdicts] Ignoring incomplete verdict: %s", msg.Value)
+			continue
+		}
+
+		vc.store.Apply(v)
+		log.Printf("[Verdicts] Applied %s for %s (score=%.4f, request_id=%s)", v.Action, v.ClientIP, v.Score, v.RequestID)
+	}
+}
+
+// Close stops consuming and waits for in-flight verdicts to be applied.
+func (vc *VerdictConsumer) Close() error {
+	for _, pc := range vc.partitions {
+		pc.AsyncClose()
+	}
+	vc.wg.Wait()
+	return vc.consumer.Close()
+}
+
+// VerdictMiddleware enforces locally held verdicts. Blocked clients are
+// rejected, rate-limited clients are throttled and challenged clients must
+// pass a challenge, whether or not the scoring stage runs or enforces, unless
+// the kill switch is engaged.
+type VerdictMiddleware struct {
+	store      *VerdictStore
+	limiter    *RateLimiter
+	auditor    *Auditor
+	guard      *EnforcementGuard
+	challenger Challenger
+	killSwitch *KillSwitch
+}
+
+// NewVerdictMiddleware creates the verdict enforcement stage. Challenged
+// clients are refused until SetChallenger gives them a challenge to pass.
+func NewVerdictMiddleware(store *VerdictStore, limiter *RateLimiter, auditor *Auditor) *VerdictMiddleware {
+	return &VerdictMiddleware{store: store, limiter: limiter, auditor: auditor, challenger: denyChallenger{}}
+}
+
+// SetChallenger serves challenge verdicts with challenger. Call it before
+// serving.
+func (m *VerdictMiddleware) SetChallenger(challenger Challenger) {
+	m.challenger = challenger
+}
+
+// SetGuard makes block verdicts spare allowlisted clients and counts the
+// clients they block. Call it before serving.
+func (m *VerdictMiddleware) SetGuard(guard *EnforcementGuard) {
+	m.guard = guard
+}
+
+// SetKillSwitch makes verdicts let clients through, auditing what they
+// would have refused, while the kill switch is engaged. Call it before
+// serving.
+func (m *VerdictMiddleware) SetKillSwitch(killSwitch *KillSwitch) {
+	m.killSwitch = killSwitch
+}
+
+// Handler returns the middleware handler
+func (m *VerdictMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := clientIP(r)
+
+		v, ok := m.store.Lookup(clientIP)
+		if ok {
+			switch v.Action {
+			case ActionBlock:
+				if !m.killSwitch.enforcing() {
+					wouldBlock(r, m.auditor, "verdicts", v.Reason)
+					break
+				}
+				if m.guard.spares(r.Context(), clientIP, "verdicts") {
+					break
+				}
+				logging.For(r.Context()).Infof("[Verdicts] BLOCKED IP: %s (%s)", clientIP, v.Reason)
+				noteDecision(r.Context(), "verdicts", OutcomeDeny, v.Reason)
+				m.auditor.Record(AuditEvent{
+					ClientIP:  clientIP,
+					Tenant:    tenantName(r.Context()),
+					RequestID: logging.RequestID(r.Context()),
+					Method:    r.Method,
+					Path:      r.URL.Path,
+					Status:    http.StatusForbidden,
+					Stage:     "verdicts",
+					Reason:    v.Reason,
+				})
+				pages.WriteError(w, r, pages.ErrBlocked)
+				return
+			case ActionChallenge:
+				if m.challenger.Verify(r) {
+					break
+				}
+				if !m.killSwitch.enforcing() {
+					wouldBlock(r, m.auditor, "verdicts", string(ActionChallenge))
+					break
+				}
+				logging.For(r.Context()).Infof("[Verdicts] CHALLENGED IP: %s (%s)", clientIP, v.Reason)
+				noteDecision(r.Context(), "verdicts", OutcomeDeny, "challenge")
+				rw := &responseWriterWrapper{ResponseWriter: w, statusCode: http.StatusOK}
+				m.challenger.Serve(rw, r)
+				m.auditor.Record(AuditEvent{
+					ClientIP:  clientIP,
+					Tenant:    tenantName(r.Context()),
+					RequestID: logging.RequestID(r.Context()),
+					Method:    r.Method,
+					Path:      r.URL.Path,
+					Status:    rw.statusCode,
+					Stage:     "verdicts",
+					Reason:    string(ActionChallenge),
+				})
+				return
+			case ActionRateLimit:
+				if m.limiter.Allow(FlowKey(tenantName(r.Context()), clientIP)) {
+					break
+				}
+				if !m.killSwitch.enforcing() {
+					wouldBlock(r, m.auditor, "verdicts", string(ActionRateLimit))
+					break
+				}
+				logging.For(r.Context()).Infof("[Verdicts] RATE LIMITED IP: %s", clientIP)
+				w.Header().Set("Retry-After", "1")
+				pages.WriteError(w, r, pages.ErrRateLimited)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
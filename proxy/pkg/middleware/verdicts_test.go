@@ -0,0 +1,83 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// cookieChallenger passes requests with a "cleared" cookie and answers
+// others with 429.
+type cookieChallenger struct{}
+
+func (cookieChallenger) Verify(r *http.Request) bool {
+	_, err := r.Cookie("cleared")
+	return err == nil
+}
+
+func (cookieChallenger) Serve(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+func TestVerdictChallenge(t *testing.T) {
+	store := NewVerdictStore(time.Minute)
+	store.Apply(Verdict{ClientIP: "203.0.113.7", Action: ActionChallenge, Score: 0.6})
+	store.Apply(Verdict{ClientIP: "198.51.100.1", Action: ActionBlock, Score: 0.99})
+
+	tests := []struct {
+		name       string
+		challenger Challenger
+		clientIP   string
+		cookie     bool
+		want       int
+	}{
+		{"no verdict", cookieChallenger{}, "192.0.2.9", false, http.StatusOK},
+		{"challenged", cookieChallenger{}, "203.0.113.7", false, http.StatusTooManyRequests},
+		{"passed the challenge", cookieChallenger{}, "203.0.113.7", true, http.StatusOK},
+		{"no challenger", nil, "203.0.113.7", true, http.StatusForbidden},
+		{"blocked", cookieChallenger{}, "198.51.100.1", true, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewVerdictMiddleware(store, NewRateLimiter(1, 1), nil)
+			if tt.challenger != nil {
+				m.SetChallenger(tt.challenger)
+			}
+			handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.clientIP + ":4000"
+			if tt.cookie {
+				r.AddCookie(&http.Cookie{Name: "cleared", Value: "1"})
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerdictStoreSweep(t *testing.T) {
+	store := NewVerdictStore(time.Minute)
+	store.Apply(Verdict{ClientIP: "203.0.113.7", Action: ActionBlock, TTLSeconds: 1})
+	store.mu.Lock()
+	store.verdicts["203.0.113.7"].expiresAt = time.Now().Add(-time.Second)
+	store.mu.Unlock()
+
+	// Expired verdicts are ignored until a sweep drops them
+	if _, ok := store.Lookup("203.0.113.7"); ok {
+		t.Error("expired verdict still active")
+	}
+	for i := 1; i < verdictSweepEvery; i++ {
+		store.Apply(Verdict{ClientIP: "198.51.100.1", Action: ActionRateLimit})
+	}
+	store.mu.RLock()
+	_, kept := store.verdicts["203.0.113.7"]
+	n := len(store.verdicts)
+	store.mu.RUnlock()
+	if kept || n != 1 {
+		t.Errorf("after %d verdicts: expired verdict kept = %t, %d verdicts held, want it swept", verdictSweepEvery, kept, n)
+	}
+}
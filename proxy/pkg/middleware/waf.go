@@ -0,0 +1,283 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+var (
+	wafMatches = metrics.NewCounterVec("aegis_waf_matches_total",
+		"WAF rule matches by category and rule ID.", "category", "rule")
+	wafRequests = metrics.NewCounterVec("aegis_waf_requests_total",
+		"Requests inspected by the WAF by result: clean, flagged or blocked.", "result")
+)
+
+// Anomaly points of a match, as in the OWASP Core Rule Set.
+const (
+	severityCritical = 5
+	severityError    = 4
+	severityWarning  = 3
+	severityNotice   = 2
+)
+
+// WAFRule is a request signature. Matches add its severity to the request's
+// anomaly score.
+type WAFRule struct {
+	ID       int
+	Category string // sqli, xss, traversal or cmdi
+	Name     string
+	Severity int
+	pattern  *regexp.Regexp
+	rawURI   bool // Matched against the undecoded request target only
+}
+
+// coreRules is a subset of the OWASP Core Rule Set, numbered after the CRS
+// rules they approximate.
+var coreRules = []WAFRule{
+	{ID: 942100, Category: "sqli", Name: "SQL tautology", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(?i)['"]\s*(or|and)\s+['"]?[\w-]+['"]?\s*(=|<|>|like\b)`)},
+	{ID: 942190, Category: "sqli", Name: "UNION SELECT", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(?i)\bunion\b[\s/*()]+(all[\s/*()]+)?select\b`)},
+	{ID: 942140, Category: "sqli", Name: "Database catalog access", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(?i)\b(information_schema|sysobjects|pg_catalog|sqlite_master|mysql\.user)\b`)},
+	{ID: 942160, Category: "sqli", Name: "Time-based blind SQL injection", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(?i)\b(sleep|benchmark|pg_sleep)\s*\(|\bwaitfor\s+delay\b`)},
+	{ID: 942350, Category: "sqli", Name: "Stacked SQL statement", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(?i);\s*(drop|delete|insert|update|create|alter|truncate|exec)\s`)},
+	{ID: 942440, Category: "sqli", Name: "SQL comment after quote", Severity: severityWarning,
+		pattern: regexp.MustCompile(`'\s*(--|#|/\*)`)},
+
+	{ID: 941110, Category: "xss", Name: "Script tag", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(?i)<script[\s>/]`)},
+	{ID: 941160, Category: "xss", Name: "Event handler attribute", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(?i)<[a-z][^>]*[\s/]on[a-z]+\s*=`)},
+	{ID: 941170, Category: "xss", Name: "Script URI", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(?i)\b(javascript|vbscript)\s*:|data:text/html`)},
+	{ID: 941180, Category: "xss", Name: "Embedding tag", Severity: severityNotice,
+		pattern: regexp.MustCompile(`(?i)<(iframe|object|embed|svg|math|base|meta)[\s/>]`)},
+	{ID: 941200, Category: "xss", Name: "DOM access", Severity: severityError,
+		pattern: regexp.MustCompile(`(?i)\b(document\.(cookie|write|domain)|window\.location|eval\s*\()`)},
+
+	{ID: 930100, Category: "traversal", Name: "Encoded path traversal", Severity: severityCritical, rawURI: true,
+		pattern: regexp.MustCompile(`(?i)(%2e|\.){2}(%2f|%5c|%252f|%255c)|%252e%252e|%c0%ae`)},
+	{ID: 930110, Category: "traversal", Name: "Path traversal", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(^|[\\/])\.\.([\\/]|$)`)},
+	{ID: 930120, Category: "traversal", Name: "OS file access", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(?i)/etc/(passwd|shadow|hosts)\b|/proc/self/|\b(boot|win)\.ini\b`)},
+
+	// Short command names only count in shell context: after a pipe or a
+	// command substitution, run by path, or given a flag or path argument.
+	// A cookie like "theme=dark; id=42" or the text "; cat videos" isn't one.
+	{ID: 932100, Category: "cmdi", Name: "Unix command injection", Severity: severityCritical,
+		pattern: regexp.MustCompile("(?i)(\\$\\(|`|\\|\\|?)\\s*" + unixCommands + "\\b" +
+			"|(;|&&)\\s*(/usr)?/s?bin/" + unixCommands + "\\b" +
+			"|(;|&&)\\s*" + unixCommands + "\\s+[-/~$]")},
+	{ID: 932150, Category: "cmdi", Name: "Shell invocation", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(?i)/bin/(ba|z|da)?sh\b|\bcmd(\.exe)?\s+/c\b|\bpowershell(\.exe)?\s+-`)},
+	{ID: 932160, Category: "cmdi", Name: "JNDI lookup", Severity: severityCritical,
+		pattern: regexp.MustCompile(`(?i)\$\{\s*jndi\s*:`)},
+}
+
+// unixCommands are the commands rule 932100 looks for.
+const unixCommands = `(cat|ls|id|whoami|uname|wget|curl|nc|bash|sh|python\d?|perl|rm|chmod)`
+
+// WAFResult is what the WAF found in a request. It is published with the
+// request's access log and feature vector.
+type WAFResult struct {
+	Score      int      `json:"score"` // Total anomaly points
+	Rules      []int    `json:"rules,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+}
+
+// ruleIDs returns the matched rule IDs as strings.
+func (r *WAFResult) ruleIDs() []string {
+	ids := make([]string, len(r.Rules))
+	for i, id := range r.Rules {
+		ids[i] = strconv.Itoa(id)
+	}
+	return ids
+}
+
+// WAFOptions configures the waf stage.
+type WAFOptions struct {
+	Block     bool  // Refuse requests at the threshold; otherwise only log them
+	Threshold int   // Anomaly score that blocks
+	MaxBody   int64 // Bytes of each body inspected; 0 skips bodies
+	Disabled  []string
+	Auditor   *Auditor
+}
+
+// WAFMiddleware inspects the URL, headers and the start of the body of each
+// request for attack signatures and blocks requests whose anomaly score
+// reaches the threshold.
+type WAFMiddleware struct {
+	opts  WAFOptions
+	rules []WAFRule
+}
+
+// NewWAFMiddleware creates the waf stage with the core rules that aren't disabled.
+func NewWAFMiddleware(opts WAFOptions) *WAFMiddleware {
+	disabled := make(map[string]bool, len(opts.Disabled))
+	for _, id := range opts.Disabled {
+		disabled[id] = true
+	}
+	m := &WAFMiddleware{opts: opts}
+	for _, rule := range coreRules {
+		if !disabled[strconv.Itoa(rule.ID)] {
+			m.rules = append(m.rules, rule)
+		}
+	}
+	return m
+}
+
+// Rules returns the active rules.
+func (m *WAFMiddleware) Rules() []WAFRule {
+	return m.rules
+}
+
+// Handler returns the middleware handler
+func (m *WAFMiddleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		result := m.inspect(r)
+		setWAFResult(r.Context(), result)
+		if result.Score == 0 {
+			wafRequests.Inc("clean")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		clientIP := clientIP(r)
+		reason := "anomaly score " + strconv.Itoa(result.Score) + ": " + strings.Join(result.Categories, ",")
+		if !m.opts.Block || result.Score < m.opts.Threshold {
+			wafRequests.Inc("flagged")
+			logging.For(r.Context()).Infof("[WAF] Flagged %s %s from %s, %s (rules %v)", r.Method, r.URL.Path, clientIP, reason, result.Rules)
+			noteDecision(r.Context(), "waf", "", reason, result.ruleIDs()...)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		wafRequests.Inc("blocked")
+		logging.For(r.Context()).Infof("[WAF] BLOCKED %s %s from %s, %s (rules %v)", r.Method, r.URL.Path, clientIP, reason, result.Rules)
+		noteDecision(r.Context(), "waf", OutcomeDeny, reason, result.ruleIDs()...)
+		m.opts.Auditor.Record(AuditEvent{
+			ClientIP:  clientIP,
+			Subject:   subjectFromContext(r.Context()),
+			Tenant:    tenantName(r.Context()),
+			RequestID: logging.RequestID(r.Context()),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Status:    http.StatusForbidden,
+			Stage:     "waf",
+			Reason:    reason,
+		})
+		pages.WriteError(w, r, pages.ErrWAFBlocked)
+	})
+}
+
+// inspect matches the rules against the request, counting each rule once.
+func (m *WAFMiddleware) inspect(r *http.Request) *WAFResult {
+	inputs := []string{r.URL.Path}
+	// Split by hand: url.ParseQuery drops pairs containing semicolons
+	for _, pair := range strings.FieldsFunc(r.URL.RawQuery, func(c rune) bool { return c == '&' }) {
+		inputs = append(inputs, decode(pair))
+	}
+	for name, values := range r.Header {
+		if name == "Authorization" || name == "Proxy-Authorization" || name == "Cookie" {
+			continue
+		}
+		inputs = append(inputs, values...)
+	}
+	// Cookie values are inspected one by one, not the "; "-joined header.
+	// Split by hand too: r.Cookies drops values it can't parse
+	for _, header := range r.Header.Values("Cookie") {
+		for _, pair := range strings.Split(header, ";") {
+			if _, value, ok := strings.Cut(pair, "="); ok {
+				pair = value
+			}
+			if value := strings.TrimSpace(pair); value != "" {
+				inputs = append(inputs, decode(value))
+			}
+		}
+	}
+	if body := m.readBody(r); body != "" {
+		inputs = append(inputs, body)
+	}
+	raw := r.URL.RequestURI()
+
+	result := &WAFResult{}
+	categories := make(map[string]bool)
+	for _, rule := range m.rules {
+		if !rule.matches(raw, inputs) {
+			continue
+		}
+		wafMatches.Inc(rule.Category, strconv.Itoa(rule.ID))
+		result.Score += rule.Severity
+		result.Rules = append(result.Rules, rule.ID)
+		if !categories[rule.Category] {
+			categories[rule.Category] = true
+			result.Categories = append(result.Categories, rule.Category)
+		}
+	}
+	sort.Strings(result.Categories)
+	return result
+}
+
+func (rule *WAFRule) matches(raw string, inputs []string) bool {
+	if rule.rawURI {
+		return rule.pattern.MatchString(raw)
+	}
+	for _, input := range inputs {
+		if rule.pattern.MatchString(input) {
+			return true
+		}
+	}
+	return false
+}
+
+// readBody returns up to MaxBody bytes of textual bodies, decoding forms, and
+// puts them back in front of the rest of the body for the upstream.
+func (m *WAFMiddleware) readBody(r *http.Request) string {
+	if m.opts.MaxBody <= 0 || r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 {
+		return ""
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	form := mediaType == "application/x-www-form-urlencoded"
+	if !form && !strings.HasPrefix(mediaType, "text/") && !strings.HasSuffix(mediaType, "json") && !strings.HasSuffix(mediaType, "xml") {
+		return ""
+	}
+
+	head, err := io.ReadAll(io.LimitReader(r.Body, m.opts.MaxBody))
+	r.Body = readCloser{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+	if err != nil {
+		return ""
+	}
+	if form {
+		return decode(string(head))
+	}
+	return string(head)
+}
+
+// readCloser reads from a replayed body while closing the original.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decode percent-decodes s, leaving it as is when it isn't valid.
+func decode(s string) string {
+	if decoded, err := url.QueryUnescape(s); err == nil {
+		return decoded
+	}
+	return s
+}
@@ -0,0 +1,44 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWAFCommandInjection(t *testing.T) {
+	m := NewWAFMiddleware(WAFOptions{Block: true, Threshold: 5})
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		target string
+		cookie string
+		want   int
+	}{
+		{"cookie with an id", "/", "theme=dark; id=42", http.StatusOK},
+		{"cookies named after commands", "/", "ls=1; cat=2; sh=3", http.StatusOK},
+		{"query text with separators", "/search?q=rock%20%26%20roll%20;%20cat%20videos", "", http.StatusOK},
+		{"query text with a pipe word", "/search?q=salt%20and%20pepper", "", http.StatusOK},
+		{"command after a separator", "/ping?host=127.0.0.1;%20cat%20/etc/hostname", "", http.StatusForbidden},
+		{"command with a flag", "/ping?host=127.0.0.1%26%26ls%20-la", "", http.StatusForbidden},
+		{"command by path", "/ping?host=127.0.0.1;/usr/bin/id", "", http.StatusForbidden},
+		{"piped command", "/ping?host=127.0.0.1%7Cid", "", http.StatusForbidden},
+		{"command substitution", "/ping?host=$(whoami)", "", http.StatusForbidden},
+		{"command in a cookie", "/", "theme=dark; host=x%3B%20rm%20-rf%20~", http.StatusForbidden},
+		{"command in a cookie r.Cookies drops", "/", `theme=dark; host="x;"$(id)`, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.cookie != "" {
+				req.Header.Set("Cookie", tt.cookie)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d (rules %v)", rec.Code, tt.want, m.inspect(req).Rules)
+			}
+		})
+	}
+}
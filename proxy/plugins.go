@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"plugin"
+	"slices"
+	"strings"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/wasmfilter"
+)
+
+// loadPlugins loads the plugins the configuration lists, so stages can be
+// deployed without rebuilding the proxy. A .wasm plugin is a proxy-wasm
+// filter, registered as a stage named after the file. Anything else is a Go
+// plugin, which adds stages by calling middleware.RegisterStage from an
+// init function, run as it is opened. Go plugins must be built with the
+// proxy's Go version and module versions, and need a proxy built with cgo,
+// which the published image isn't.
+func loadPlugins() error {
+	paths, err := config.PluginPaths()
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		if strings.HasSuffix(path, ".wasm") {
+			if err := loadWasmFilter(path); err != nil {
+				return fmt.Errorf("loading plugin %s: %w", path, err)
+			}
+			continue
+		}
+		before := middleware.RegisteredStages()
+		if _, err := plugin.Open(path); err != nil {
+			return fmt.Errorf("loading plugin %s: %w", path, err)
+		}
+		var added []string
+		for _, name := range middleware.RegisteredStages() {
+			if !slices.Contains(before, name) {
+				added = append(added, name)
+			}
+		}
+		if len(added) == 0 {
+			log.Printf("Warning: plugin %s registered no stages", path)
+			continue
+		}
+		log.Printf("Loaded plugin %s: stages %v", path, added)
+	}
+	return nil
+}
+
+// loadWasmFilter compiles the filter at path and registers it as a stage.
+// Its plugin configuration is its stage_settings entry as a JSON object.
+// Like built-in stages it runs only where STAGES lists it.
+func loadWasmFilter(path string) error {
+	name := strings.TrimSuffix(filepath.Base(path), ".wasm")
+	if slices.Contains(middleware.RegisteredStages(), name) {
+		return fmt.Errorf("stage %q is already registered", name)
+	}
+	module, err := wasmfilter.Compile(context.Background(), path)
+	if err != nil {
+		return err
+	}
+	middleware.RegisterStage(name, func(opts middleware.StageOptions) (middleware.Stage, error) {
+		settings := opts.Settings
+		if settings == nil {
+			settings = map[string]string{}
+		}
+		config, err := json.Marshal(settings)
+		if err != nil {
+			return nil, err
+		}
+		return module.NewFilter(name, config)
+	})
+	log.Printf("Loaded WASM filter %s: stage %s", path, name)
+	return nil
+}
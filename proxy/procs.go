@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// tuneGOMAXPROCS lowers GOMAXPROCS to the CPU limit of the container, if it
+// has one. Go sizes it by the host's CPUs, so a proxy limited to 2 CPUs on a
+// 64-core node would run 64 threads that the kernel throttles. An explicit
+// GOMAXPROCS environment variable is left alone.
+func tuneGOMAXPROCS() {
+	if os.Getenv("GOMAXPROCS") != "" {
+		return
+	}
+	limit := cgroupCPULimit()
+	if limit <= 0 {
+		return
+	}
+	procs := int(limit)
+	if procs < 1 {
+		procs = 1
+	}
+	if current := runtime.GOMAXPROCS(0); procs < current {
+		runtime.GOMAXPROCS(procs)
+		log.Printf("GOMAXPROCS: %d, for a CPU limit of %g (was %d)", procs, limit, current)
+	}
+}
+
+// cgroupCPULimit returns the CPU quota of the process's cgroup in CPUs, or 0
+// without one. It reads cgroup v2's cpu.max, else v1's CFS quota and period.
+func cgroupCPULimit() float64 {
+	if data, err := os.ReadFile("/sys/fs/cgroup/cpu.max"); err == nil {
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0
+		}
+		return quota(fields[0], fields[1])
+	}
+	q, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_quota_us")
+	if err != nil {
+		return 0
+	}
+	p, err := os.ReadFile("/sys/fs/cgroup/cpu/cpu.cfs_period_us")
+	if err != nil {
+		return 0
+	}
+	return quota(strings.TrimSpace(string(q)), strings.TrimSpace(string(p)))
+}
+
+// quota divides a CFS quota by its period; a negative quota means unlimited.
+func quota(q, p string) float64 {
+	quota, err := strconv.ParseFloat(q, 64)
+	if err != nil || quota <= 0 {
+		return 0
+	}
+	period, err := strconv.ParseFloat(p, 64)
+	if err != nil || period <= 0 {
+		return 0
+	}
+	return quota / period
+}
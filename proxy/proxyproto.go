@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+)
+
+var proxyProtocolErrors = metrics.NewCounterVec("aegis_proxy_protocol_errors_total",
+	"Connections from trusted load balancers closed for a missing or malformed PROXY protocol header.")
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener recovers the client address from the PROXY protocol
+// (v1 or v2) header that load balancers in TCP mode, such as AWS NLB or
+// HAProxy, send ahead of a connection's data. Headers are only read from
+// trusted sources, which must send one; connections from elsewhere are
+// served with their own address. Headers are read off the accept loop, so a
+// slow peer doesn't hold up other connections.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	timeout time.Duration
+
+	conns chan net.Conn
+	done  chan struct{}
+	err   error // Why the accept loop stopped; set before done is closed
+	once  sync.Once
+}
+
+func newProxyProtoListener(ln net.Listener, trusted []*net.IPNet, timeout time.Duration) *proxyProtoListener {
+	l := &proxyProtoListener{
+		Listener: ln,
+		trusted:  trusted,
+		timeout:  timeout,
+		conns:    make(chan net.Conn),
+		done:     make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *proxyProtoListener) acceptLoop() {
+	var delay time.Duration
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			// Back off on temporary errors such as running out of file
+			// descriptors, as http.Server does
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				time.Sleep(delay)
+				continue
+			}
+			l.err = err
+			l.once.Do(func() { close(l.done) })
+			return
+		}
+		delay = 0
+		go l.handshake(conn)
+	}
+}
+
+// handshake reads the header of a trusted peer and hands the connection to
+// Accept.
+func (l *proxyProtoListener) handshake(conn net.Conn) {
+	if l.isTrusted(conn.RemoteAddr()) {
+		conn.SetReadDeadline(time.Now().Add(l.timeout))
+		pc, err := readProxyHeader(conn)
+		if err != nil {
+			proxyProtocolErrors.Inc()
+			logging.Warnf("[ProxyProtocol] Closing connection from %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		conn = pc
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		if l.err != nil {
+			return nil, l.err
+		}
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *proxyProtoListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { close(l.done) })
+	return err
+}
+
+func (l *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range l.trusted {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyConn reports the client address from the PROXY header and reads
+// any bytes buffered after it before the connection's own.
+type proxyConn struct {
+	net.Conn
+	r          *bufio.Reader
+	remoteAddr net.Addr // nil keeps the connection's own, for LOCAL and UNKNOWN
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader reads a v1 or v2 header from conn.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	pc := &proxyConn{Conn: conn, r: bufio.NewReaderSize(conn, 256)}
+	start, err := pc.r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		pc.remoteAddr, err = readProxyV2(pc.r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		pc.remoteAddr, err = readProxyV1(pc.r)
+	default:
+		err = errors.New("no PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readProxyV1 parses "PROXY TCP4|TCP6 src dst sport dport\r\n", or
+// "PROXY UNKNOWN ...\r\n".
+func readProxyV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 { // The longest header the spec allows
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("reading v1 header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("v1 header too long or not terminated by CRLF")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("malformed v1 source %s:%s", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 parses the binary header: the signature, version and command,
+// address family, length, addresses and TLVs, which are skipped.
+func readProxyV2(r *bufio.Reader) (net.Addr, error) {
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("reading v2 header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported v2 version %d", header[12]>>4)
+	}
+	command, family := header[12]&0x0f, header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading v2 addresses: %w", err)
+	}
+
+	switch command {
+	case 0x0: // LOCAL: the load balancer's own connection, e.g. a health check
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("unsupported v2 command %d", command)
+	}
+	switch family {
+	case 0x11: // TCP over IPv4
+		if len(payload) < 12 {
+			return nil, errors.New("short v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 0x21: // TCP over IPv6
+		if len(payload) < 36 {
+			return nil, errors.New("short v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default: // UNSPEC, UDP and unix sockets carry no usable client address
+		return nil, nil
+	}
+}
+
+// parseCIDRs parses the trusted load balancer networks.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
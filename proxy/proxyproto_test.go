@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// proxyV2 builds a v2 header of the version and command byte, family and
+// address payload.
+func proxyV2(verCmd, family byte, payload []byte) string {
+	h := append([]byte{}, proxyV2Signature...)
+	h = append(h, verCmd, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(payload)))
+	return string(append(h, payload...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{198, 51, 100, 1, 10, 0, 0, 1, 0x30, 0x39, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6, net.ParseIP("2001:db8::1"))
+	copy(v6[16:], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v6[32:], 12345)
+	tlvs := append(append([]byte{}, v4...), 0x04, 0x00, 0x01, 0x00) // A NOOP TLV
+
+	tests := []struct {
+		name    string
+		header  string
+		want    string // Client address; "" keeps the connection's own
+		wantErr bool
+	}{
+		{name: "v1 TCP4", header: "PROXY TCP4 198.51.100.1 10.0.0.1 12345 443\r\n", want: "198.51.100.1:12345"},
+		{name: "v1 TCP6", header: "PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n", want: "[2001:db8::1]:12345"},
+		{name: "v1 UNKNOWN", header: "PROXY UNKNOWN\r\n"},
+		{name: "v1 family mismatch", header: "PROXY TCP4 2001:db8::1 10.0.0.1 12345 443\r\n", wantErr: true},
+		{name: "v1 bad port", header: "PROXY TCP4 198.51.100.1 10.0.0.1 99999 443\r\n", wantErr: true},
+		{name: "v1 bad address", header: "PROXY TCP4 junk 10.0.0.1 12345 443\r\n", wantErr: true},
+		{name: "v1 missing fields", header: "PROXY TCP4 198.51.100.1\r\n", wantErr: true},
+		{name: "v1 without CRLF", header: "PROXY TCP4 198.51.100.1 10.0.0.1 12345 443\n", wantErr: true},
+		{name: "v1 too long", header: "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", wantErr: true},
+		{name: "v2 TCP4", header: proxyV2(0x21, 0x11, v4), want: "198.51.100.1:12345"},
+		{name: "v2 TCP6", header: proxyV2(0x21, 0x21, v6), want: "[2001:db8::1]:12345"},
+		{name: "v2 TLVs skipped", header: proxyV2(0x21, 0x11, tlvs), want: "198.51.100.1:12345"},
+		{name: "v2 LOCAL", header: proxyV2(0x20, 0x00, nil)},
+		{name: "v2 UDP", header: proxyV2(0x21, 0x12, v4)},
+		{name: "v2 short IPv4", header: proxyV2(0x21, 0x11, v4[:8]), wantErr: true},
+		{name: "v2 short IPv6", header: proxyV2(0x21, 0x21, v6[:20]), wantErr: true},
+		{name: "v2 bad version", header: proxyV2(0x11, 0x11, v4), wantErr: true},
+		{name: "v2 bad command", header: proxyV2(0x22, 0x11, v4), wantErr: true},
+		{name: "v2 truncated", header: proxyV2(0x21, 0x11, v4)[:20], wantErr: true},
+		{name: "no header", header: "GET / HTTP/1.1\r\n\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				io.WriteString(client, tt.header+"data")
+				client.Close()
+			}()
+			pc, err := readProxyHeader(server)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", pc.RemoteAddr())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if pc.remoteAddr != nil {
+				got = pc.remoteAddr.String()
+			}
+			if got != tt.want {
+				t.Errorf("client %q, want %q", got, tt.want)
+			}
+			// The data after the header is still read
+			if data, err := io.ReadAll(pc); err != nil || string(data) != "data" {
+				t.Errorf("read %q, %v after the header, want \"data\"", data, err)
+			}
+		})
+	}
+}
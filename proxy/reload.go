@@ -0,0 +1,306 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/central"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/handler"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// centralVersion is the version of the applied central config snapshot.
+var centralVersion = metrics.NewGaugeVec("aegis_central_config_version",
+	"Version of the dynamic policy applied from the central config store.")
+
+// configReloader applies configuration changes that don't need a restart:
+// route profiles and policies, response policies, the default CORS policy and
+// security headers, rate limits, access log sampling, score smoothing
+// parameters, honeypot and quarantine paths, the enforcement mode,
+// maintenance mode, log level and the upstreams. A config
+// that fails to load or validate is rejected and the last-known-good one
+// stays active.
+type configReloader struct {
+	mu      sync.Mutex
+	current *config.Config
+	central *central.Snapshot // Overlay from the central store; nil without one
+
+	profiles        *middleware.RouteProfiles
+	proxy           *handler.ProxyHandler
+	responseLimiter *middleware.RateLimiter
+	verdictLimiter  *middleware.RateLimiter               // nil without a verdicts topic
+	stageLimiter    *middleware.RateLimiter               // nil without the ratelimit stage
+	routePolicies   *middleware.RoutePolicies             // nil without the routes stage
+	cors            *middleware.CORSMiddleware            // nil without the cors stage
+	headers         *middleware.SecurityHeadersMiddleware // nil without the headers stage
+	decisions       *middleware.DecisionLogMiddleware     // nil without the decisions stage
+	honeypot        *middleware.HoneypotMiddleware        // nil without honeypot paths
+	blocklist       *middleware.BlocklistMiddleware
+	scoring         *middleware.ScoringMiddleware
+	smoother        *middleware.ScoreSmoother // nil without score smoothing
+	killSwitch      *middleware.KillSwitch    // Holds monitor mode while engaged
+	maintenance     *middleware.MaintenanceMiddleware
+}
+
+// run reloads on SIGHUP and, with a non-zero interval, when the config file's
+// modification time changes.
+func (rl *configReloader) run(path string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	var lastMod time.Time
+	if path != "" && interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+		lastMod = modTime(path)
+	}
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("[Config] SIGHUP received, reloading")
+			rl.reload()
+		case <-tick:
+			if mod := modTime(path); !mod.Equal(lastMod) {
+				lastMod = mod
+				log.Printf("[Config] %s changed, reloading", path)
+				rl.reload()
+			}
+		}
+	}
+}
+
+// EnforcementMode returns "enforce" or "monitor".
+func (rl *configReloader) EnforcementMode() string {
+	if rl.scoring.Enforcing() {
+		return "enforce"
+	}
+	return "monitor"
+}
+
+// SetEnforcementMode switches the mode until the next reload or restart.
+func (rl *configReloader) SetEnforcementMode(mode string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.scoring.SetEnforce(mode == "enforce" && !rl.killSwitch.Engaged())
+	current := *rl.current
+	current.EnforcementMode = mode
+	rl.current = &current
+	rl.stampPolicyVersion()
+}
+
+// Maintenance reports whether maintenance mode is on.
+func (rl *configReloader) Maintenance() bool {
+	return rl.maintenance.Enabled()
+}
+
+// SetMaintenance turns maintenance mode on or off until the next reload or
+// restart.
+func (rl *configReloader) SetMaintenance(enabled bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.maintenance.Set(enabled, rl.current.MaintenanceRetryAfter.Std())
+	current := *rl.current
+	current.MaintenanceMode = enabled
+	rl.current = &current
+}
+
+// applyKillSwitch suspends scoring enforcement while the kill switch is
+// engaged and restores the configured mode when it is released. The other
+// stages that block consult the switch themselves.
+func (rl *configReloader) applyKillSwitch(state middleware.KillSwitchState) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.scoring.SetEnforce(rl.current.EnforcementMode == "enforce" && !state.Engaged)
+}
+
+// effective returns the configuration currently in effect.
+func (rl *configReloader) effective() *config.Config {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.current
+}
+
+// reload loads and validates the configuration, then applies it.
+func (rl *configReloader) reload() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.apply(rl.central)
+}
+
+// applyCentral applies a new snapshot from the central store. A snapshot
+// that fails validation is rejected and the previous one stays in effect.
+func (rl *configReloader) applyCentral(snapshot *central.Snapshot) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if rl.apply(snapshot) {
+		rl.central = snapshot
+		centralVersion.Set(float64(snapshot.Version))
+		log.Printf("[Config] Central config version %d applied", snapshot.Version)
+	}
+}
+
+// apply loads the configuration with the central overlay and applies it,
+// reporting whether it was accepted.
+func (rl *configReloader) apply(snapshot *central.Snapshot) bool {
+	next, err := config.Load()
+	if err == nil && snapshot != nil {
+		err = config.ApplyCentral(next, snapshot.Values)
+	}
+	if err != nil {
+		log.Printf("[Config] Reload rejected, keeping current configuration: %v", err)
+		return false
+	}
+
+	// Specs are loaded before anything is applied, so a broken one rejects
+	// the whole reload
+	var routePolicies []middleware.RoutePolicy
+	var routeTiers map[string]middleware.RateTier
+	if rl.routePolicies != nil {
+		if routePolicies, routeTiers, err = newRoutePolicies(next); err != nil {
+			log.Printf("[Config] Reload rejected, keeping current configuration: %v", err)
+			return false
+		}
+	}
+
+	// Discovered upstreams replace the configured ones
+	if !next.Discovered() && !reflect.DeepEqual(next.Upstreams(), rl.current.Upstreams()) {
+		if err := rl.proxy.SetUpstreams(next.Upstreams()); err != nil {
+			log.Printf("[Config] Reload rejected, keeping current configuration: invalid upstream: %v", err)
+			return false
+		}
+	}
+	rl.proxy.SetDraining(next.UpstreamDraining)
+
+	rl.scoring.SetEnforce(next.EnforcementMode == "enforce" && !rl.killSwitch.Engaged())
+	rl.maintenance.Set(next.MaintenanceMode, next.MaintenanceRetryAfter.Std())
+	level, _ := logging.ParseLevel(next.LogLevel)
+	logging.SetLevel(level)
+	rl.profiles.Update(newRouteProfiles(next))
+	if rl.smoother != nil {
+		rl.smoother.SetConfig(newSmoothingConfig(next))
+	}
+	rl.responseLimiter.SetLimits(next.ResponseRateLimitRPS, next.ResponseRateLimitBurst)
+	if rl.verdictLimiter != nil {
+		rl.verdictLimiter.SetLimits(next.VerdictRateLimitRPS, next.VerdictRateLimitBurst)
+	}
+	if rl.stageLimiter != nil {
+		rl.stageLimiter.SetLimits(next.RateLimitRPS, next.RateLimitBurst)
+	}
+	if rl.routePolicies != nil {
+		rl.routePolicies.Update(routePolicies, routeTiers)
+	}
+	if rl.cors != nil {
+		rl.cors.SetDefault(newCORSPolicy(next.CORS))
+	}
+	if rl.headers != nil {
+		rl.headers.SetDefault(newSecurityHeaders(next.SecurityHeaders))
+	}
+	if rl.honeypot != nil {
+		rl.honeypot.SetPaths(next.HoneypotPaths)
+	}
+	rl.blocklist.SetQuarantinePaths(next.QuarantinePaths)
+
+	// Settings that were not applied keep their running values, so they are
+	// reported again after the next reload if they still differ
+	applied := *rl.current
+	rl.copyReloadable(&applied, next)
+	for _, field := range changedFields(&applied, next) {
+		log.Printf("[Config] %s changed; restart to apply it", field)
+	}
+	rl.current = &applied
+	rl.stampPolicyVersion()
+
+	log.Printf("[Config] Reloaded: %d route profiles, upstreams %v", len(next.RouteProfiles), next.Upstreams())
+	return true
+}
+
+// stampPolicyVersion labels decision logs with the configuration in effect.
+func (rl *configReloader) stampPolicyVersion() {
+	if rl.decisions != nil {
+		rl.decisions.SetPolicyVersion(policyVersion(rl.current))
+	}
+}
+
+// copyReloadable copies the settings that reload applies from src to dst.
+func (rl *configReloader) copyReloadable(dst, src *config.Config) {
+	dst.UpstreamURL = src.UpstreamURL
+	dst.UpstreamURLs = src.UpstreamURLs
+	dst.UpstreamDraining = src.UpstreamDraining
+	dst.LogLevel = src.LogLevel
+	dst.EnforcementMode = src.EnforcementMode
+	dst.MaintenanceMode = src.MaintenanceMode
+	dst.MaintenanceRetryAfter = src.MaintenanceRetryAfter
+	dst.RouteProfiles = src.RouteProfiles
+	dst.ResponsePolicy = src.ResponsePolicy
+	dst.ScoringModel = src.ScoringModel
+	dst.RiskChallengeThreshold = src.RiskChallengeThreshold
+	dst.RiskBlockThreshold = src.RiskBlockThreshold
+	dst.ResponseRateLimitRPS = src.ResponseRateLimitRPS
+	dst.ResponseRateLimitBurst = src.ResponseRateLimitBurst
+	dst.VerdictRateLimitRPS = src.VerdictRateLimitRPS
+	dst.VerdictRateLimitBurst = src.VerdictRateLimitBurst
+	dst.AccessLogSampleRate = src.AccessLogSampleRate
+	if rl.smoother != nil {
+		dst.ScoreEWMAAlpha = src.ScoreEWMAAlpha
+		dst.ScoreWindowSize = src.ScoreWindowSize
+		dst.ScoreWindowHits = src.ScoreWindowHits
+		dst.ScoreHysteresis = src.ScoreHysteresis
+	}
+	if rl.stageLimiter != nil {
+		dst.RateLimitRPS = src.RateLimitRPS
+		dst.RateLimitBurst = src.RateLimitBurst
+	}
+	if rl.routePolicies != nil {
+		dst.RoutePolicies = src.RoutePolicies
+		dst.RateLimitTiers = src.RateLimitTiers
+	}
+	if rl.cors != nil {
+		dst.CORS = src.CORS
+	}
+	if rl.headers != nil {
+		dst.SecurityHeaders = src.SecurityHeaders
+	}
+	if rl.honeypot != nil {
+		dst.HoneypotPaths = src.HoneypotPaths
+	}
+	dst.QuarantinePaths = src.QuarantinePaths
+	// Derived at load time rather than configured
+	dst.JWTPublicKey = src.JWTPublicKey
+	dst.AssertionSigningKey = src.AssertionSigningKey
+	dst.Secrets = src.Secrets
+}
+
+// changedFields lists the names of fields that differ between two configs.
+func changedFields(a, b *config.Config) []string {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+
+	var fields []string
+	for i := 0; i < va.NumField(); i++ {
+		if !reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			fields = append(fields, va.Type().Field(i).Name)
+		}
+	}
+	return fields
+}
+
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
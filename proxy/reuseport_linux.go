@@ -0,0 +1,20 @@
+package main
+
+import "syscall"
+
+// soReusePort is SO_REUSEPORT, which the syscall package doesn't define. Its
+// value is the same on the architectures the image is built for.
+const soReusePort = 0xf
+
+// reusePort sets SO_REUSEPORT on a listening socket before it is bound, so
+// several sockets can accept on the same address.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePort is only supported on Linux, where the kernel balances
+// connections across the sockets sharing a port.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("ACCEPT_LOOPS above 1 requires SO_REUSEPORT, which is only supported on Linux")
+}
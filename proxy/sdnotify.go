@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state change to systemd when the proxy runs as a
+// Type=notify service, e.g. "READY=1". Outside systemd NOTIFY_SOCKET is
+// unset and it does nothing.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// A leading @ is an abstract socket, which Go addresses the same way
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		log.Printf("[Systemd] Failed to notify %q: %v", state, err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("[Systemd] Failed to notify %q: %v", state, err)
+	}
+}
+
+// sdWatchdog pings systemd's watchdog at half the interval WatchdogSec
+// sets, until stop is closed. ping reports whether the proxy is healthy
+// enough to ping; systemd restarts it when the pings stop.
+func sdWatchdog(stop <-chan struct{}, ping func() bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 || os.Getenv("NOTIFY_SOCKET") == "" {
+		return
+	}
+	// The watchdog may be meant for another process of the service
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	log.Printf("[Systemd] Watchdog enabled (%s)", time.Duration(usec)*time.Microsecond)
+	ticker := time.NewTicker(time.Duration(usec) * time.Microsecond / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if ping() {
+				sdNotify("WATCHDOG=1")
+			}
+		}
+	}
+}
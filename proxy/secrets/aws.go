@@ -0,0 +1,147 @@
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// awsProvider reads AWS Secrets Manager secrets with credentials from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, in
+// AWS_REGION. References look like "aws:aegis/tls" or "aws:aegis/tls#key"
+// to select a field of a JSON secret.
+type awsProvider struct {
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+func newAWSProvider() *awsProvider {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	return &awsProvider{
+		region:       region,
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (a *awsProvider) Fetch(ctx context.Context, location string) ([]byte, error) {
+	if a.region == "" || a.accessKey == "" || a.secretKey == "" {
+		return nil, fmt.Errorf("AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	secretID, field := splitField(location)
+
+	body, err := json.Marshal(map[string]string{"SecretId": secretID})
+	if err != nil {
+		return nil, err
+	}
+
+	host := "secretsmanager." + a.region + ".amazonaws.com"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://"+host+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	a.sign(req, host, body, time.Now().UTC())
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("secrets manager returned %d", resp.StatusCode)
+	}
+
+	var out struct {
+		SecretString string `json:"SecretString"`
+		SecretBinary string `json:"SecretBinary"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("invalid secrets manager response: %w", err)
+	}
+
+	value := []byte(out.SecretString)
+	if out.SecretString == "" && out.SecretBinary != "" {
+		if value, err = base64.StdEncoding.DecodeString(out.SecretBinary); err != nil {
+			return nil, fmt.Errorf("invalid SecretBinary: %w", err)
+		}
+	}
+
+	if field != "" {
+		return jsonField(value, field)
+	}
+	return value, nil
+}
+
+// sign adds AWS Signature Version 4 headers to the request.
+func (a *awsProvider) sign(req *http.Request, host string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if a.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", a.sessionToken)
+	}
+
+	// Headers in the canonical (sorted) order
+	headers := [][2]string{
+		{"content-type", req.Header.Get("Content-Type")},
+		{"host", host},
+		{"x-amz-date", amzDate},
+	}
+	if a.sessionToken != "" {
+		headers = append(headers, [2]string{"x-amz-security-token", a.sessionToken})
+	}
+	headers = append(headers, [2]string{"x-amz-target", req.Header.Get("X-Amz-Target")})
+
+	var canonicalHeaders, signedHeaders string
+	for i, h := range headers {
+		canonicalHeaders += h[0] + ":" + h[1] + "\n"
+		if i > 0 {
+			signedHeaders += ";"
+		}
+		signedHeaders += h[0]
+	}
+
+	canonicalRequest := "POST\n/\n\n" + canonicalHeaders + "\n" + signedHeaders + "\n" + payloadHash
+	scope := date + "/" + a.region + "/secretsmanager/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+a.secretKey), date)
+	key = hmacSHA256(key, a.region)
+	key = hmacSHA256(key, "secretsmanager")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,73 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// The example credentials of the AWS Signature Version 4 documentation.
+const (
+	exampleAccessKey = "AKIDEXAMPLE"
+	exampleSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+func TestSigningKey(t *testing.T) {
+	// "Deriving the signing key" example of the SigV4 documentation
+	key := hmacSHA256([]byte("AWS4"+exampleSecretKey), "20120215")
+	key = hmacSHA256(key, "us-east-1")
+	key = hmacSHA256(key, "iam")
+	key = hmacSHA256(key, "aws4_request")
+	if got, want := hex.EncodeToString(key), "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; got != want {
+		t.Errorf("signing key = %s, want %s", got, want)
+	}
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"SecretId":"aegis/tls"}`)
+	host := "secretsmanager.us-east-1.amazonaws.com"
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		sessionToken  string
+		authorization string
+	}{
+		{
+			"long-term credentials", "",
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240102/us-east-1/secretsmanager/aws4_request, " +
+				"SignedHeaders=content-type;host;x-amz-date;x-amz-target, " +
+				"Signature=2d0d5967fe3bc709f45881f333407ae40a118e0173c3ff615725168c87a7ff97",
+		},
+		{
+			"session token", "SESSIONTOKEN",
+			"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20240102/us-east-1/secretsmanager/aws4_request, " +
+				"SignedHeaders=content-type;host;x-amz-date;x-amz-security-token;x-amz-target, " +
+				"Signature=b39c8982eeb4bf29d975c4dddb3fb039942d5297a79b845f6c15c73215519c3a",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &awsProvider{region: "us-east-1", accessKey: exampleAccessKey, secretKey: exampleSecretKey, sessionToken: tt.sessionToken}
+			req, err := http.NewRequest(http.MethodPost, "https://"+host+"/", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+			req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+			a.sign(req, host, body, now)
+
+			if got := req.Header.Get("Authorization"); got != tt.authorization {
+				t.Errorf("Authorization = %s\nwant %s", got, tt.authorization)
+			}
+			if got := req.Header.Get("X-Amz-Date"); got != "20240102T030405Z" {
+				t.Errorf("X-Amz-Date = %s", got)
+			}
+			if got := req.Header.Get("X-Amz-Security-Token"); got != tt.sessionToken {
+				t.Errorf("X-Amz-Security-Token = %q, want %q", got, tt.sessionToken)
+			}
+		})
+	}
+}
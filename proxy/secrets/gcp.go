@@ -0,0 +1,105 @@
+package secrets
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// gcpMetadataTokenURL serves access tokens for the instance's service account.
+const gcpMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// gcpProvider reads GCP Secret Manager versions. It authenticates with
+// GCP_ACCESS_TOKEN when set, otherwise with the metadata server's service
+// account token. References look like
+// "gcp:projects/my-project/secrets/jwt-public-key/versions/latest".
+type gcpProvider struct {
+	token  string
+	client *http.Client
+}
+
+func newGCPProvider() *gcpProvider {
+	return &gcpProvider{
+		token:  os.Getenv("GCP_ACCESS_TOKEN"),
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (g *gcpProvider) Fetch(ctx context.Context, location string) ([]byte, error) {
+	name, field := splitField(location)
+	if !strings.Contains(name, "/versions/") {
+		name += "/versions/latest"
+	}
+
+	token, err := g.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://secretmanager.googleapis.com/v1/"+name+":access", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("secret manager returned %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid secret manager response: %w", err)
+	}
+	value, err := base64.StdEncoding.DecodeString(body.Payload.Data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret payload: %w", err)
+	}
+
+	if field != "" {
+		return jsonField(value, field)
+	}
+	return value, nil
+}
+
+func (g *gcpProvider) accessToken(ctx context.Context) (string, error) {
+	if g.token != "" {
+		return g.token, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gcpMetadataTokenURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("no GCP_ACCESS_TOKEN and metadata server unavailable: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %d", resp.StatusCode)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid metadata token response: %w", err)
+	}
+	return body.AccessToken, nil
+}
@@ -0,0 +1,168 @@
+// Package secrets resolves secret references such as "file:/certs/tls.key",
+// "env:ADMIN_TOKEN", "vault:secret/data/aegis#jwt_public_key",
+// "aws:aegis/tls#key" or "gcp:projects/p/secrets/s/versions/latest".
+// A reference without a scheme is a file path.
+package secrets
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider fetches secret values for one reference scheme.
+type Provider interface {
+	Fetch(ctx context.Context, location string) ([]byte, error)
+}
+
+// Store resolves references through the registered providers and caches the
+// values for a TTL, so rotated secrets are picked up on the next refresh.
+type Store struct {
+	providers map[string]Provider
+	ttl       time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedSecret
+}
+
+type cachedSecret struct {
+	value     []byte
+	fetchedAt time.Time
+}
+
+// NewStore creates a store with the env, file, vault, aws and gcp providers.
+// Cloud providers are configured from their usual environment variables.
+func NewStore(ttl time.Duration) *Store {
+	return &Store{
+		providers: map[string]Provider{
+			"env":   envProvider{},
+			"file":  fileProvider{},
+			"vault": newVaultProvider(),
+			"aws":   newAWSProvider(),
+			"gcp":   newGCPProvider(),
+		},
+		ttl:   ttl,
+		cache: make(map[string]cachedSecret),
+	}
+}
+
+// Parse splits a reference into its scheme and location.
+func Parse(ref string) (scheme, location string) {
+	if scheme, location, ok := strings.Cut(ref, ":"); ok {
+		switch scheme {
+		case "env", "file", "vault", "aws", "gcp":
+			return scheme, location
+		}
+	}
+	return "file", ref
+}
+
+// Get returns the secret's value, from the cache while it is fresh.
+func (s *Store) Get(ctx context.Context, ref string) ([]byte, error) {
+	s.mu.Lock()
+	cached, ok := s.cache[ref]
+	s.mu.Unlock()
+	if ok && time.Since(cached.fetchedAt) < s.ttl {
+		return cached.value, nil
+	}
+
+	value, err := s.fetch(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.cache[ref] = cachedSecret{value: value, fetchedAt: time.Now()}
+	s.mu.Unlock()
+	return value, nil
+}
+
+// Watch re-reads the secret every interval until ctx is done and calls onChange
+// with the new value whenever it differs from the previous one. Fetch errors
+// are logged and the current value stays in use.
+func (s *Store) Watch(ctx context.Context, ref string, interval time.Duration, onChange func([]byte)) {
+	last, _ := s.Get(ctx, ref)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		value, err := s.fetch(ctx, ref)
+		if err != nil {
+			log.Printf("[Secrets] Failed to refresh %s: %v", Redact(ref), err)
+			continue
+		}
+
+		s.mu.Lock()
+		s.cache[ref] = cachedSecret{value: value, fetchedAt: time.Now()}
+		s.mu.Unlock()
+
+		if !bytes.Equal(value, last) {
+			log.Printf("[Secrets] %s rotated", Redact(ref))
+			last = value
+			onChange(value)
+		}
+	}
+}
+
+func (s *Store) fetch(ctx context.Context, ref string) ([]byte, error) {
+	scheme, location := Parse(ref)
+	value, err := s.providers[scheme].Fetch(ctx, location)
+	if err != nil {
+		return nil, fmt.Errorf("secret %s: %w", Redact(ref), err)
+	}
+	return value, nil
+}
+
+// Redact returns the reference without its field selector, for logging.
+func Redact(ref string) string {
+	location, _, _ := strings.Cut(ref, "#")
+	return location
+}
+
+// splitField separates "location#field"; field is empty when absent.
+func splitField(location string) (string, string) {
+	location, field, _ := strings.Cut(location, "#")
+	return location, field
+}
+
+// jsonField extracts a string field from a JSON object secret.
+func jsonField(data []byte, field string) ([]byte, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, fmt.Errorf("secret is not a JSON object: %w", err)
+	}
+	value, ok := fields[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("field %q not found", field)
+	}
+	return []byte(value), nil
+}
+
+type envProvider struct{}
+
+func (envProvider) Fetch(ctx context.Context, name string) ([]byte, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
+	}
+	return []byte(value), nil
+}
+
+type fileProvider struct{}
+
+func (fileProvider) Fetch(ctx context.Context, path string) ([]byte, error) {
+	return os.ReadFile(path)
+}
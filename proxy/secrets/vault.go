@@ -0,0 +1,83 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultProvider reads HashiCorp Vault KV secrets, v1 or v2, using the token
+// in VAULT_TOKEN (or the file named by VAULT_TOKEN_FILE) against VAULT_ADDR.
+// References look like "vault:secret/data/aegis#jwt_public_key".
+type vaultProvider struct {
+	addr      string
+	token     string
+	tokenFile string
+	client    *http.Client
+}
+
+func newVaultProvider() *vaultProvider {
+	return &vaultProvider{
+		addr:      strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+		token:     os.Getenv("VAULT_TOKEN"),
+		tokenFile: os.Getenv("VAULT_TOKEN_FILE"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (v *vaultProvider) Fetch(ctx context.Context, location string) ([]byte, error) {
+	if v.addr == "" {
+		return nil, fmt.Errorf("VAULT_ADDR is not set")
+	}
+	path, field := splitField(location)
+	if field == "" {
+		return nil, fmt.Errorf("vault references need a #field")
+	}
+
+	token := v.token
+	if v.tokenFile != "" {
+		// Re-read each time so agent-renewed tokens are used
+		data, err := os.ReadFile(v.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read VAULT_TOKEN_FILE: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid vault response: %w", err)
+	}
+
+	// KV v2 nests the secret under data.data
+	data := body.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return nil, fmt.Errorf("field %q not found", field)
+	}
+	return []byte(value), nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// sidecar is the state of Kubernetes sidecar mode: the pod the proxy runs
+// in and the drain before shutdown. When a pod terminates, the proxy and
+// its app get SIGTERM together while endpoints still route traffic to the
+// pod for a few seconds; the proxy must keep serving until they are
+// updated, or those requests fail. The drain fails health checks, stops
+// keep-alives and keeps serving for the delay. It runs once, from the
+// preStop hook or SIGTERM, whichever comes first.
+type sidecar struct {
+	pod    *middleware.PodInfo
+	hostIP net.IP // The node's, from which the kubelet calls the preStop hook
+	delay  time.Duration
+	drain  func() // Set once the servers exist
+	once   sync.Once
+}
+
+// newSidecar reads the pod's metadata from the environment variables the
+// Downward API sets in the pod spec.
+func newSidecar(delay time.Duration) *sidecar {
+	return &sidecar{
+		pod: &middleware.PodInfo{
+			Name:      os.Getenv("POD_NAME"),
+			Namespace: os.Getenv("POD_NAMESPACE"),
+			Node:      os.Getenv("NODE_NAME"),
+			IP:        os.Getenv("POD_IP"),
+		},
+		hostIP: net.ParseIP(os.Getenv("HOST_IP")),
+		delay:  delay,
+	}
+}
+
+// drainAndWait takes the proxy out of rotation and returns once the delay
+// has passed. Later calls wait for the first to finish.
+func (s *sidecar) drainAndWait(trigger string) {
+	s.once.Do(func() {
+		log.Printf("[Sidecar] %s: draining for %s", trigger, s.delay)
+		s.drain()
+		time.Sleep(s.delay)
+	})
+}
+
+// handlePreStop serves GET /prestop for the pod's preStop httpGet hook,
+// answering once the drain is over. Only the kubelet, calling from the
+// node's address, and processes in the pod may drain the proxy.
+func (s *sidecar) handlePreStop(w http.ResponseWriter, r *http.Request) {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() && !ip.Equal(s.hostIP) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	s.drainAndWait("preStop hook")
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status": "drained", "service": "aegis-zero-proxy"}`))
+}
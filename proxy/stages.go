@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// allowRegisteredStages lets STAGES and stage_settings name the stages
+// compiled in with middleware.RegisterStage. Registration happens in init
+// functions, which have all run by the time main does.
+func allowRegisteredStages() {
+	for _, name := range middleware.RegisteredStages() {
+		if config.Stages[name] {
+			log.Fatalf("Registered stage %q has the name of a built-in stage", name)
+		}
+		config.Stages[name] = true
+	}
+}
+
+// addRegisteredStages creates every registered stage and adds those that
+// want to run to stages.
+func addRegisteredStages(cfg *config.Config, stages map[string]middleware.Stage, opts middleware.StageOptions) error {
+	for _, name := range middleware.RegisteredStages() {
+		opts.Settings = cfg.StageSettings[name]
+		stage, err := middleware.NewRegisteredStage(name, opts)
+		if err != nil {
+			return fmt.Errorf("stage %s: %w", name, err)
+		}
+		if stage == nil {
+			continue
+		}
+		stages[name] = stage
+		log.Printf("Registered stage: %s (priority %d)", name, stage.Priority())
+	}
+	return nil
+}
+
+// stageOrder is the chain order: the configured stages, with stages that
+// STAGES doesn't list placed around or inside them by priority. Those of
+// priority zero, which includes every built-in stage, only run if listed.
+func stageOrder(configured []string, stages map[string]middleware.Stage) []string {
+	listed := make(map[string]bool, len(configured))
+	for _, name := range configured {
+		listed[name] = true
+	}
+	var outer, inner []middleware.Stage
+	for name, stage := range stages {
+		if listed[name] {
+			continue
+		}
+		if stage.Priority() < 0 {
+			outer = append(outer, stage)
+		} else if stage.Priority() > 0 {
+			inner = append(inner, stage)
+		}
+	}
+	byPriority := func(s []middleware.Stage) []string {
+		sort.Slice(s, func(i, j int) bool {
+			if s[i].Priority() != s[j].Priority() {
+				return s[i].Priority() < s[j].Priority()
+			}
+			return s[i].Name() < s[j].Name()
+		})
+		names := make([]string, len(s))
+		for i, stage := range s {
+			names[i] = stage.Name()
+		}
+		return names
+	}
+	order := byPriority(outer)
+	order = append(order, configured...)
+	return append(order, byPriority(inner)...)
+}
+
+// closeStages closes every stage once the servers have stopped.
+func closeStages(stages map[string]middleware.Stage) {
+	for name, stage := range stages {
+		if err := stage.Close(); err != nil {
+			log.Printf("Closing stage %s: %v", name, err)
+		}
+	}
+}
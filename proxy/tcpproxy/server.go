@@ -0,0 +1,284 @@
+// Package tcpproxy relays TCP connections, such as database and SSH
+// sessions, to a fixed upstream. Without HTTP to parse, each connection is
+// checked against the blocklist when it is accepted and described by a flow
+// record when it closes, with the byte and inter-arrival features the
+// request logs carry.
+package tcpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/flow"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+var connections = metrics.NewCounterVec("aegis_tcp_connections_total",
+	"Connections accepted by TCP listeners, by listener and result (relayed, blocked, rejected or failed).", "listener", "result")
+
+// ErrServerClosed is returned by Serve after Shutdown.
+var ErrServerClosed = errors.New("tcpproxy: server closed")
+
+// Blocklist decides whether a client's connections are refused.
+type Blocklist interface {
+	RefusesConn(ctx context.Context, clientIP string) (bool, error)
+	FailOpen() bool
+}
+
+// Options configures a TCP listener.
+type Options struct {
+	Name     string // Listener name, in logs, metrics and flow records
+	Upstream string // host:port connections are relayed to
+	// TLS, if set, terminates TLS (and verifies client certificates, with
+	// mTLS) before relaying the plaintext
+	TLS              *tls.Config
+	HandshakeTimeout time.Duration // 0 waits indefinitely
+	DialTimeout      time.Duration
+	Blocklist        Blocklist // nil checks nothing
+	Sink             middleware.EventSink
+	Topic            string // Flow records; empty ships none
+	Pod              *middleware.PodInfo
+	Cloud            *middleware.CloudInfo
+}
+
+// Server relays the connections of one TCP listener.
+type Server struct {
+	opts   Options
+	dialer *net.Dialer
+
+	mu        sync.Mutex
+	listeners map[net.Listener]bool
+	conns     map[net.Conn]bool
+	closed    bool
+	active    sync.WaitGroup
+}
+
+// NewServer creates a server relaying to opts.Upstream.
+func NewServer(opts Options) *Server {
+	return &Server{
+		opts:      opts,
+		dialer:    &net.Dialer{Timeout: opts.DialTimeout, KeepAlive: 30 * time.Second},
+		listeners: make(map[net.Listener]bool),
+		conns:     make(map[net.Conn]bool),
+	}
+}
+
+// Serve accepts connections on ln until it fails or the server is shut down.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[ln] = true
+	s.mu.Unlock()
+
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				// Back off on temporary errors such as running out of files
+				delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go s.handle(conn)
+	}
+}
+
+// Shutdown stops accepting connections and waits for open ones to close
+// until ctx expires, then closes them.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closed = true
+	for ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	s.active.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.active.Done()
+}
+
+// handle checks a connection and relays it to the upstream.
+func (s *Server) handle(conn net.Conn) {
+	defer s.untrack(conn)
+	defer conn.Close()
+
+	meter := flow.NewConnMeter()
+	record := &middleware.FlowRecord{
+		ClientIP: clientIP(conn.RemoteAddr()),
+		Listener: s.opts.Name,
+		Upstream: s.opts.Upstream,
+		Protocol: "tcp",
+		Pod:      s.opts.Pod,
+		Cloud:    s.opts.Cloud,
+	}
+
+	if s.refused(record.ClientIP) {
+		connections.Inc(s.opts.Name, "blocked")
+		log.Printf("[TCP] %s: BLOCKED connection from %s", s.opts.Name, record.ClientIP)
+		record.Blocked = true
+		s.ship(meter, record)
+		return
+	}
+
+	if s.opts.TLS != nil {
+		tlsConn := tls.Server(conn, s.opts.TLS)
+		if s.opts.HandshakeTimeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.opts.HandshakeTimeout))
+		}
+		err := tlsConn.Handshake()
+		conn.SetDeadline(time.Time{})
+		if err != nil {
+			connections.Inc(s.opts.Name, "rejected")
+			log.Printf("[TCP] %s: TLS handshake with %s failed: %v", s.opts.Name, record.ClientIP, err)
+			return
+		}
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			record.Identity = certs[0].Subject.CommonName
+		}
+		record.Protocol = "tls"
+		conn = tlsConn
+	}
+
+	upstream, err := s.dialer.Dial("tcp", s.opts.Upstream)
+	if err != nil {
+		connections.Inc(s.opts.Name, "failed")
+		log.Printf("[TCP] %s: connecting to %s failed: %v", s.opts.Name, s.opts.Upstream, err)
+		record.Error = err.Error()
+		s.ship(meter, record)
+		return
+	}
+	defer upstream.Close()
+	connections.Inc(s.opts.Name, "relayed")
+
+	done := make(chan struct{})
+	go func() {
+		relay(conn, upstream, meter.Backward)
+		close(done)
+	}()
+	relay(upstream, conn, meter.Forward)
+	<-done
+	s.ship(meter, record)
+}
+
+// refused checks the client against the blocklist, refusing it when the
+// blocklist can't be read unless the blocklist fails open.
+func (s *Server) refused(ip string) bool {
+	if s.opts.Blocklist == nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	refused, err := s.opts.Blocklist.RefusesConn(ctx, ip)
+	if err != nil {
+		log.Printf("[TCP] %s: blocklist unavailable for %s: %v", s.opts.Name, ip, err)
+		return !s.opts.Blocklist.FailOpen()
+	}
+	return refused
+}
+
+// ship publishes the connection's flow record.
+func (s *Server) ship(meter *flow.ConnMeter, record *middleware.FlowRecord) {
+	if s.opts.Topic == "" || s.opts.Sink == nil {
+		return
+	}
+	record.Measured(meter.Measure())
+	data, err := json.Marshal(record)
+	if err == nil {
+		err = s.opts.Sink.Publish(s.opts.Topic, record.ClientIP, data)
+	}
+	if err != nil {
+		log.Printf("Failed to send event to %s: %v", s.opts.Topic, err)
+	}
+}
+
+// relay copies src to dst, counting each read, then closes dst for writing
+// so the other side sees the end of the stream.
+func relay(dst, src net.Conn, count func(n int)) {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			count(n)
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+func clientIP(addr net.Addr) string {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/secrets"
+)
+
+// tlsMaterial holds the server certificate and client CA pools loaded from
+// secret references, and swaps them in when the secrets rotate.
+type tlsMaterial struct {
+	store                  *secrets.Store
+	certRef, keyRef, caRef string
+	adminCARef             string // Client CA of admin listeners; empty uses caRef
+	policy                 string
+	cert                   atomic.Pointer[tls.Certificate]
+	clientCAs              atomic.Pointer[x509.CertPool]
+	adminCAs               atomic.Pointer[x509.CertPool]
+
+	// Certificates of virtual hosts, chosen by the ClientHello's server name
+	vhosts []*vhostCert
+}
+
+// vhostCert is the certificate of a virtual host.
+type vhostCert struct {
+	name            string
+	hosts           []string
+	certRef, keyRef string
+	cert            atomic.Pointer[tls.Certificate]
+}
+
+// loadTLSMaterial reads the certificate, key and CA bundle.
+func loadTLSMaterial(ctx context.Context, cfg *config.Config) (*tlsMaterial, error) {
+	m := &tlsMaterial{
+		store:      cfg.Secrets,
+		certRef:    cfg.TLSCertPath,
+		keyRef:     cfg.TLSKeyPath,
+		caRef:      cfg.CACertPath,
+		adminCARef: cfg.AdminCACertPath,
+		policy:     cfg.TLSPolicy,
+	}
+	if err := m.loadCertificate(ctx, m.certRef, m.keyRef, &m.cert); err != nil {
+		return nil, err
+	}
+	for _, v := range cfg.VirtualHosts {
+		vc := &vhostCert{name: v.Name, hosts: v.Hosts, certRef: v.CertPath, keyRef: v.KeyPath}
+		if err := m.loadCertificate(ctx, vc.certRef, vc.keyRef, &vc.cert); err != nil {
+			return nil, fmt.Errorf("virtual host %s: %w", v.Name, err)
+		}
+		m.vhosts = append(m.vhosts, vc)
+	}
+	if err := m.loadCAs(ctx, m.caRef, &m.clientCAs); err != nil {
+		return nil, err
+	}
+	if m.adminCARef != "" {
+		if err := m.loadCAs(ctx, m.adminCARef, &m.adminCAs); err != nil {
+			return nil, fmt.Errorf("admin CA: %w", err)
+		}
+	}
+	return m, nil
+}
+
+func (m *tlsMaterial) loadCertificate(ctx context.Context, certRef, keyRef string, dst *atomic.Pointer[tls.Certificate]) error {
+	certPEM, err := m.store.Get(ctx, certRef)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := m.store.Get(ctx, keyRef)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid TLS certificate or key: %w", err)
+	}
+	dst.Store(&cert)
+	return nil
+}
+
+// certificate returns the certificate for a server name: the virtual host
+// naming it exactly, else the one with the longest matching wildcard, else
+// the default certificate.
+func (m *tlsMaterial) certificate(serverName string) *tls.Certificate {
+	if v := m.virtualHost(serverName); v != nil {
+		return v.cert.Load()
+	}
+	return m.cert.Load()
+}
+
+// virtualHost returns the virtual host serving a name, or nil.
+func (m *tlsMaterial) virtualHost(name string) *vhostCert {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return nil
+	}
+	var best *vhostCert
+	bestLen := 0
+	for _, v := range m.vhosts {
+		for _, host := range v.hosts {
+			host = strings.ToLower(host)
+			if host == name {
+				return v
+			}
+			if suffix, ok := strings.CutPrefix(host, "*"); ok && strings.HasSuffix(name, suffix) && len(suffix) > bestLen {
+				best, bestLen = v, len(suffix)
+			}
+		}
+	}
+	return best
+}
+
+func (m *tlsMaterial) loadCAs(ctx context.Context, ref string, dst *atomic.Pointer[x509.CertPool]) error {
+	caCert, err := m.store.Get(ctx, ref)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caCert) {
+		return fmt.Errorf("failed to parse CA certificate")
+	}
+	dst.Store(pool)
+	return nil
+}
+
+// clientCAPool returns the current client CA pool, which is nil until one
+// is loaded.
+func (m *tlsMaterial) clientCAPool() *x509.CertPool {
+	return m.clientCAs.Load()
+}
+
+// serverConfig returns a TLS config for a listener that always uses the
+// current certificate and CA pool for new handshakes. Admin listeners use
+// the admin CA pool when one is configured.
+func (m *tlsMaterial) serverConfig(clientAuth tls.ClientAuthType, admin bool) *tls.Config {
+	clientCAs := &m.clientCAs
+	if admin && m.adminCARef != "" {
+		clientCAs = &m.adminCAs
+	}
+
+	base := &tls.Config{
+		ClientAuth: clientAuth,
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return m.certificate(hello.ServerName), nil
+		},
+	}
+	switch m.policy {
+	case "modern":
+		base.MinVersion = tls.VersionTLS13
+	case "fips":
+		// Go's TLS 1.3 suites can't be restricted, so stay on TLS 1.2 with
+		// AES-GCM and the NIST curves
+		base.MaxVersion = tls.VersionTLS12
+		base.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+	}
+
+	cfg := base.Clone()
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.ClientCAs = clientCAs.Load()
+		return c, nil
+	}
+	return cfg
+}
+
+// watch reloads the material when any of the secrets rotates. A certificate
+// and key rotated separately may briefly mismatch; the previous pair stays
+// in use until both have been updated.
+func (m *tlsMaterial) watch(ctx context.Context, interval time.Duration) {
+	reloadCertificate := func([]byte) {
+		if err := m.loadCertificate(ctx, m.certRef, m.keyRef, &m.cert); err != nil {
+			log.Printf("[TLS] Keeping current certificate: %v", err)
+			return
+		}
+		log.Printf("[TLS] Server certificate reloaded")
+	}
+	go m.store.Watch(ctx, m.certRef, interval, reloadCertificate)
+	go m.store.Watch(ctx, m.keyRef, interval, reloadCertificate)
+	for _, v := range m.vhosts {
+		reloadVHost := func([]byte) {
+			if err := m.loadCertificate(ctx, v.certRef, v.keyRef, &v.cert); err != nil {
+				log.Printf("[TLS] Keeping current certificate of virtual host %s: %v", v.name, err)
+				return
+			}
+			log.Printf("[TLS] Certificate of virtual host %s reloaded", v.name)
+		}
+		go m.store.Watch(ctx, v.certRef, interval, reloadVHost)
+		go m.store.Watch(ctx, v.keyRef, interval, reloadVHost)
+	}
+
+	go m.store.Watch(ctx, m.caRef, interval, func([]byte) {
+		if err := m.loadCAs(ctx, m.caRef, &m.clientCAs); err != nil {
+			log.Printf("[TLS] Keeping current CA bundle: %v", err)
+			return
+		}
+		log.Printf("[TLS] Client CA bundle reloaded")
+	})
+	if m.adminCARef != "" {
+		go m.store.Watch(ctx, m.adminCARef, interval, func([]byte) {
+			if err := m.loadCAs(ctx, m.adminCARef, &m.adminCAs); err != nil {
+				log.Printf("[TLS] Keeping current admin CA bundle: %v", err)
+				return
+			}
+			log.Printf("[TLS] Admin client CA bundle reloaded")
+		})
+	}
+}
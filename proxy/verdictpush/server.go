@@ -0,0 +1,147 @@
+// Package verdictpush receives verdicts the AI engine pushes to each proxy
+// over a gRPC stream (aegis.verdicts.v1.VerdictPush, see verdicts.proto), so
+// a detection is enforced within milliseconds instead of waiting for the
+// next Redis lookup or Kafka poll.
+package verdictpush
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/grpcwire"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// pushPath is the gRPC method the AI engine calls.
+const pushPath = "/aegis.verdicts.v1.VerdictPush/Push"
+
+var pushed = metrics.NewCounterVec("aegis_verdicts_pushed_total",
+	"Verdicts pushed over gRPC, by result (applied or rejected).", "result")
+
+// Server applies the verdicts of Push streams to the store the verdicts
+// stage enforces, as the verdicts topic consumer does. A stream may stay
+// open indefinitely; it is answered with a summary when the client closes
+// it.
+type Server struct {
+	store       *middleware.VerdictStore
+	token       string
+	clientNames []string
+}
+
+// NewServer creates a server for store. With a token, calls must carry it
+// as a bearer token in their authorization metadata. With clientNames, they
+// must also come over mTLS with a verified client certificate whose common
+// name or a DNS name is listed. Calls are refused if neither is given.
+func NewServer(store *middleware.VerdictStore, token string, clientNames []string) *Server {
+	return &Server{store: store, token: token, clientNames: clientNames}
+}
+
+// ServeHTTP handles gRPC calls, which arrive as HTTP/2 POST requests.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != pushPath {
+		grpcwire.WriteStatus(w, grpcwire.CodeUnimplemented, "unknown method "+r.URL.Path)
+		return
+	}
+	if !grpcwire.IsRequest(r) {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	if !s.authenticated(r) {
+		log.Printf("[VerdictPush] Unauthenticated stream from %s", r.RemoteAddr)
+		grpcwire.WriteStatus(w, grpcwire.CodeUnauthenticated, "invalid token")
+		return
+	}
+
+	var applied, rejected uint64
+	for {
+		msg, code, err := grpcwire.ReadMessage(r.Body)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			log.Printf("[VerdictPush] Stream from %s ended after %d verdicts: %v", r.RemoteAddr, applied, err)
+			grpcwire.WriteStatus(w, code, err.Error())
+			return
+		}
+		v, err := decodeVerdict(msg)
+		if err != nil {
+			rejected++
+			pushed.Inc("rejected")
+			log.Printf("[VerdictPush] Ignoring verdict: %v", err)
+			continue
+		}
+		s.store.Apply(v)
+		applied++
+		pushed.Inc("applied")
+		log.Printf("[VerdictPush] Applied %s for %s (score=%.4f, request_id=%s)", v.Action, v.ClientIP, v.Score, v.RequestID)
+	}
+
+	summary := grpcwire.AppendVarintField(nil, 1, applied)
+	summary = grpcwire.AppendVarintField(summary, 2, rejected)
+	grpcwire.WriteMessage(w, summary)
+}
+
+// decodeVerdict reads an aegis.verdicts.v1.Verdict.
+func decodeVerdict(msg []byte) (middleware.Verdict, error) {
+	var v middleware.Verdict
+	err := grpcwire.ReadFields(msg, func(f grpcwire.Field) error {
+		switch {
+		case f.Num == 1 && f.Wire == grpcwire.WireBytes:
+			v.ClientIP = string(f.Bytes)
+		case f.Num == 2 && f.Wire == grpcwire.WireBytes:
+			v.Action = middleware.Action(f.Bytes)
+		case f.Num == 3 && f.Wire == grpcwire.WireFixed64:
+			v.Score = f.Double()
+		case f.Num == 4 && f.Wire == grpcwire.WireBytes:
+			v.Reason = string(f.Bytes)
+		case f.Num == 5 && f.Wire == grpcwire.WireVarint:
+			v.TTLSeconds = int(int32(f.Varint))
+		case f.Num == 6 && f.Wire == grpcwire.WireBytes:
+			v.RequestID = string(f.Bytes)
+		}
+		return nil
+	})
+	if err != nil {
+		return v, err
+	}
+	if v.ClientIP == "" || v.Action == "" {
+		return v, fmt.Errorf("incomplete verdict for %q: action %q", v.ClientIP, v.Action)
+	}
+	return v, nil
+}
+
+// authenticated checks a stream's bearer token and client certificate.
+// Verdicts can block any client, and listeners other than admin ones trust
+// the general client CA, so a stream is never accepted on the listener's
+// word alone, nor on any certificate it verified.
+func (s *Server) authenticated(r *http.Request) bool {
+	if s.token == "" && len(s.clientNames) == 0 {
+		return false
+	}
+	if s.token != "" {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			return false
+		}
+	}
+	if len(s.clientNames) == 0 {
+		return true
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	for _, name := range s.clientNames {
+		if cert.Subject.CommonName == name || slices.Contains(cert.DNSNames, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/config"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/handler"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+// virtualHostRoutes routes the hosts of virtual hosts with upstreams of
+// their own; the others use the default upstreams.
+func virtualHostRoutes(cfg *config.Config) []handler.Route {
+	var routes []handler.Route
+	for _, v := range cfg.VirtualHosts {
+		if len(v.Upstreams) == 0 {
+			continue
+		}
+		for _, host := range v.Hosts {
+			routes = append(routes, handler.Route{
+				Host:      strings.ToLower(host),
+				Path:      "/",
+				Upstreams: v.Upstreams,
+				Source:    "virtual host " + v.Name,
+			})
+		}
+	}
+	return routes
+}
+
+// withRoutes adds fixed routes to each route table set, so virtual hosts
+// keep their routes alongside those of the ingress controller.
+func withRoutes(set func([]handler.Route), fixed []handler.Route) func([]handler.Route) {
+	return func(routes []handler.Route) {
+		set(append(append([]handler.Route(nil), fixed...), routes...))
+	}
+}
+
+// misdirected answers 421 to requests whose Host belongs to a different
+// virtual host than the server name of their TLS connection, so a
+// connection established with one domain's certificate can't be used to
+// reach another's upstreams. Clients retry such requests on a new
+// connection.
+func misdirected(material *tlsMaterial, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && r.TLS.ServerName != "" {
+			host := r.Host
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			if material.virtualHost(host) != material.virtualHost(r.TLS.ServerName) {
+				log.Printf("[TLS] Misdirected request for %s on a connection for %s from %s", host, r.TLS.ServerName, r.RemoteAddr)
+				pages.WriteError(w, r, pages.ErrMisdirected)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
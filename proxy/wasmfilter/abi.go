@@ -0,0 +1,489 @@
+package wasmfilter
+
+import (
+	"context"
+	"encoding/binary"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pkg/middleware"
+)
+
+// Status codes host functions return to the filter.
+const (
+	statusOk            = 0
+	statusNotFound      = 1
+	statusBadArgument   = 2
+	statusUnimplemented = 12
+)
+
+// Header maps and buffers the filter can reach.
+const (
+	mapRequestHeaders  = 0
+	mapResponseHeaders = 2
+
+	bufferVMConfiguration     = 6
+	bufferPluginConfiguration = 7
+)
+
+// Actions the header callbacks return.
+const actionContinue = 0
+
+// call is what host functions see of the filter callback calling them: the
+// filter, and the request it runs for, nil for root context callbacks.
+type call struct {
+	filter *Filter
+	stream *stream
+}
+
+type callKey struct{}
+
+func withCall(ctx context.Context, c *call) context.Context {
+	return context.WithValue(ctx, callKey{}, c)
+}
+
+func callFrom(ctx context.Context) *call {
+	c, _ := ctx.Value(callKey{}).(*call)
+	return c
+}
+
+// stream is the state of one request passing through a filter.
+type stream struct {
+	r        *http.Request
+	response http.Header // Nil before the response headers phase
+	status   int
+	local    *localResponse
+}
+
+// localResponse is what proxy_send_local_response asked to send instead
+// of the upstream's response.
+type localResponse struct {
+	status  int
+	body    []byte
+	headers [][2]string
+}
+
+// hostFunc implements an import of the "env" module; its parameters and
+// result are all i32.
+type hostFunc struct {
+	params int
+	fn     func(ctx context.Context, c *call, m api.Module, args []uint64) uint32
+}
+
+// hostFuncs is the subset of the proxy-wasm ABI the proxy implements.
+// Other proxy_* imports return statusUnimplemented.
+var hostFuncs = map[string]hostFunc{
+	"proxy_log":                          {3, proxyLog},
+	"proxy_get_log_level":                {1, proxyGetLogLevel},
+	"proxy_get_current_time_nanoseconds": {1, proxyGetCurrentTime},
+	"proxy_get_header_map_pairs":         {3, proxyGetHeaderMapPairs},
+	"proxy_get_header_map_value":         {5, proxyGetHeaderMapValue},
+	"proxy_add_header_map_value":         {5, proxyAddHeaderMapValue},
+	"proxy_replace_header_map_value":     {5, proxyReplaceHeaderMapValue},
+	"proxy_remove_header_map_value":      {3, proxyRemoveHeaderMapValue},
+	"proxy_set_header_map_pairs":         {3, proxySetHeaderMapPairs},
+	"proxy_get_buffer_bytes":             {5, proxyGetBufferBytes},
+	"proxy_get_property":                 {4, proxyGetProperty},
+	"proxy_send_local_response":          {8, proxySendLocalResponse},
+	"proxy_set_effective_context":        {1, proxyOk},
+	"proxy_continue_stream":              {1, proxyOk},
+	"proxy_continue_request":             {0, proxyOk},
+	"proxy_continue_response":            {0, proxyOk},
+	"proxy_done":                         {0, proxyOk},
+}
+
+// instantiateHost instantiates the "env" module the filter imports from,
+// stubbing the proxy_* functions outside the implemented subset.
+func instantiateHost(ctx context.Context, rt wazero.Runtime, compiled wazero.CompiledModule) error {
+	b := rt.NewHostModuleBuilder("env")
+	for name, h := range hostFuncs {
+		params := make([]api.ValueType, h.params)
+		for i := range params {
+			params[i] = api.ValueTypeI32
+		}
+		fn := h.fn
+		b.NewFunctionBuilder().
+			WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, m api.Module, stack []uint64) {
+				stack[0] = uint64(fn(ctx, callFrom(ctx), m, stack))
+			}), params, []api.ValueType{api.ValueTypeI32}).
+			Export(name)
+	}
+	for _, def := range compiled.ImportedFunctions() {
+		module, name, _ := def.Import()
+		if _, ok := hostFuncs[name]; ok || module != "env" || !strings.HasPrefix(name, "proxy_") {
+			continue
+		}
+		results := def.ResultTypes()
+		b.NewFunctionBuilder().
+			WithGoModuleFunction(api.GoModuleFunc(func(ctx context.Context, m api.Module, stack []uint64) {
+				if len(results) > 0 {
+					stack[0] = statusUnimplemented
+				}
+			}), def.ParamTypes(), results).
+			Export(name)
+	}
+	_, err := b.Instantiate(ctx)
+	return err
+}
+
+func proxyOk(context.Context, *call, api.Module, []uint64) uint32 {
+	return statusOk
+}
+
+func proxyLog(ctx context.Context, c *call, m api.Module, args []uint64) uint32 {
+	msg, ok := m.Memory().Read(uint32(args[1]), uint32(args[2]))
+	if !ok {
+		return statusBadArgument
+	}
+	log := logging.For(ctx)
+	switch level := args[0]; {
+	case level <= 1: // Trace, debug
+		log.Debugf("[Wasm] %s: %s", c.filter.name, msg)
+	case level == 2:
+		log.Infof("[Wasm] %s: %s", c.filter.name, msg)
+	default:
+		log.Warnf("[Wasm] %s: %s", c.filter.name, msg)
+	}
+	return statusOk
+}
+
+func proxyGetLogLevel(_ context.Context, _ *call, m api.Module, args []uint64) uint32 {
+	level := uint32(3) // Warn
+	switch {
+	case logging.Enabled(logging.Debug):
+		level = 1
+	case logging.Enabled(logging.Info):
+		level = 2
+	}
+	if !m.Memory().WriteUint32Le(uint32(args[0]), level) {
+		return statusBadArgument
+	}
+	return statusOk
+}
+
+func proxyGetCurrentTime(_ context.Context, _ *call, m api.Module, args []uint64) uint32 {
+	if !m.Memory().WriteUint64Le(uint32(args[0]), uint64(time.Now().UnixNano())) {
+		return statusBadArgument
+	}
+	return statusOk
+}
+
+// headerPairs returns the header map of mapType, pseudo-headers first, or
+// nil if the request has no such map yet.
+func (s *stream) headerPairs(mapType uint64) [][2]string {
+	var pairs [][2]string
+	var h http.Header
+	switch {
+	case s == nil:
+		return nil
+	case mapType == mapRequestHeaders:
+		scheme := "http"
+		if s.r.TLS != nil {
+			scheme = "https"
+		}
+		pairs = [][2]string{{":method", s.r.Method}, {":path", s.r.URL.RequestURI()}, {":authority", s.r.Host}, {":scheme", scheme}}
+		h = s.r.Header
+	case mapType == mapResponseHeaders && s.response != nil:
+		pairs = [][2]string{{":status", strconv.Itoa(s.status)}}
+		h = s.response
+	default:
+		return nil
+	}
+	for name, values := range h {
+		for _, v := range values {
+			pairs = append(pairs, [2]string{strings.ToLower(name), v})
+		}
+	}
+	return pairs
+}
+
+// headers returns the header map of mapType the filter may change.
+func (s *stream) headers(mapType uint64) http.Header {
+	switch {
+	case s == nil:
+		return nil
+	case mapType == mapRequestHeaders:
+		return s.r.Header
+	case mapType == mapResponseHeaders:
+		return s.response
+	}
+	return nil
+}
+
+func proxyGetHeaderMapPairs(ctx context.Context, c *call, m api.Module, args []uint64) uint32 {
+	pairs := c.stream.headerPairs(args[0])
+	if pairs == nil {
+		return statusNotFound
+	}
+	return returnBytes(ctx, m, encodePairs(pairs), args[1], args[2])
+}
+
+func proxyGetHeaderMapValue(ctx context.Context, c *call, m api.Module, args []uint64) uint32 {
+	key, ok := m.Memory().Read(uint32(args[1]), uint32(args[2]))
+	if !ok {
+		return statusBadArgument
+	}
+	var values []string
+	for _, p := range c.stream.headerPairs(args[0]) {
+		if strings.EqualFold(p[0], string(key)) {
+			values = append(values, p[1])
+		}
+	}
+	if values == nil {
+		return statusNotFound
+	}
+	return returnBytes(ctx, m, []byte(strings.Join(values, ", ")), args[3], args[4])
+}
+
+// headerArgs reads the key and value of a header change, refusing
+// pseudo-headers, which the proxy doesn't let filters rewrite.
+func headerArgs(c *call, m api.Module, args []uint64, withValue bool) (http.Header, string, string, uint32) {
+	h := c.stream.headers(args[0])
+	if h == nil {
+		return nil, "", "", statusNotFound
+	}
+	key, ok := m.Memory().Read(uint32(args[1]), uint32(args[2]))
+	if !ok || len(key) == 0 || key[0] == ':' {
+		return nil, "", "", statusBadArgument
+	}
+	var value []byte
+	if withValue {
+		if value, ok = m.Memory().Read(uint32(args[3]), uint32(args[4])); !ok {
+			return nil, "", "", statusBadArgument
+		}
+	}
+	return h, string(key), string(value), statusOk
+}
+
+func proxyAddHeaderMapValue(_ context.Context, c *call, m api.Module, args []uint64) uint32 {
+	h, key, value, status := headerArgs(c, m, args, true)
+	if status == statusOk {
+		h.Add(key, value)
+	}
+	return status
+}
+
+func proxyReplaceHeaderMapValue(_ context.Context, c *call, m api.Module, args []uint64) uint32 {
+	h, key, value, status := headerArgs(c, m, args, true)
+	if status == statusOk {
+		h.Set(key, value)
+	}
+	return status
+}
+
+func proxyRemoveHeaderMapValue(_ context.Context, c *call, m api.Module, args []uint64) uint32 {
+	h, key, _, status := headerArgs(c, m, args, false)
+	if status == statusOk {
+		h.Del(key)
+	}
+	return status
+}
+
+func proxySetHeaderMapPairs(_ context.Context, c *call, m api.Module, args []uint64) uint32 {
+	h := c.stream.headers(args[0])
+	if h == nil {
+		return statusNotFound
+	}
+	data, ok := m.Memory().Read(uint32(args[1]), uint32(args[2]))
+	if !ok {
+		return statusBadArgument
+	}
+	pairs, ok := decodePairs(data)
+	if !ok {
+		return statusBadArgument
+	}
+	for name := range h {
+		delete(h, name)
+	}
+	for _, p := range pairs {
+		if !strings.HasPrefix(p[0], ":") {
+			h.Add(p[0], p[1])
+		}
+	}
+	return statusOk
+}
+
+func proxyGetBufferBytes(ctx context.Context, c *call, m api.Module, args []uint64) uint32 {
+	var buf []byte
+	switch args[0] {
+	case bufferVMConfiguration:
+	case bufferPluginConfiguration:
+		buf = c.filter.config
+	default:
+		return statusNotFound
+	}
+	start, size := args[1], args[2]
+	if start > uint64(len(buf)) {
+		return statusBadArgument
+	}
+	buf = buf[start:]
+	if size < uint64(len(buf)) {
+		buf = buf[:size]
+	}
+	return returnBytes(ctx, m, buf, args[3], args[4])
+}
+
+func proxyGetProperty(ctx context.Context, c *call, m api.Module, args []uint64) uint32 {
+	path, ok := m.Memory().Read(uint32(args[0]), uint32(args[1]))
+	if !ok {
+		return statusBadArgument
+	}
+	value, ok := c.property(ctx, strings.TrimSuffix(string(path), "\x00"))
+	if !ok {
+		return statusNotFound
+	}
+	return returnBytes(ctx, m, []byte(value), args[2], args[3])
+}
+
+// property returns the property at path, whose segments are separated by
+// NUL bytes. Values are strings, including aegis.score.
+func (c *call) property(ctx context.Context, path string) (string, bool) {
+	if path == "plugin_name" {
+		return c.filter.name, true
+	}
+	if c.stream == nil {
+		return "", false
+	}
+	r := c.stream.r
+	rc := middleware.RequestContextFrom(r.Context())
+	if rc == nil {
+		rc = &middleware.RequestContext{}
+	}
+	switch strings.ReplaceAll(path, "\x00", ".") {
+	case "source.address":
+		return r.RemoteAddr, true
+	case "request.path":
+		return r.URL.RequestURI(), true
+	case "request.url_path":
+		return r.URL.Path, true
+	case "request.method":
+		return r.Method, true
+	case "request.host":
+		return r.Host, true
+	case "request.scheme":
+		if r.TLS != nil {
+			return "https", true
+		}
+		return "http", true
+	case "request.id":
+		id := logging.RequestID(ctx)
+		return id, id != ""
+	case "aegis.client_ip":
+		return rc.ClientIP, rc.ClientIP != ""
+	case "aegis.subject":
+		return rc.Subject, rc.Subject != ""
+	case "aegis.tenant":
+		if rc.Tenant == nil {
+			return "", false
+		}
+		return rc.Tenant.Name, true
+	case "aegis.score":
+		if rc.Score == nil {
+			return "", false
+		}
+		return strconv.FormatFloat(rc.Score.Value, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+func proxySendLocalResponse(_ context.Context, c *call, m api.Module, args []uint64) uint32 {
+	if c.stream == nil {
+		return statusNotFound
+	}
+	status := int(uint32(args[0]))
+	if status < 200 || status > 599 {
+		return statusBadArgument
+	}
+	body, ok := m.Memory().Read(uint32(args[3]), uint32(args[4]))
+	if !ok {
+		return statusBadArgument
+	}
+	data, ok := m.Memory().Read(uint32(args[5]), uint32(args[6]))
+	if !ok {
+		return statusBadArgument
+	}
+	headers, ok := decodePairs(data)
+	if !ok {
+		return statusBadArgument
+	}
+	c.stream.local = &localResponse{status: status, body: append([]byte(nil), body...), headers: headers}
+	return statusOk
+}
+
+// returnBytes copies b into memory the filter allocates, and writes its
+// address and size to ptrPtr and sizePtr.
+func returnBytes(ctx context.Context, m api.Module, b []byte, ptrPtr, sizePtr uint64) uint32 {
+	var ptr uint32
+	if len(b) > 0 {
+		var err error
+		if ptr, err = allocate(ctx, m, uint32(len(b))); err != nil || !m.Memory().Write(ptr, b) {
+			return statusBadArgument
+		}
+	}
+	if !m.Memory().WriteUint32Le(uint32(ptrPtr), ptr) || !m.Memory().WriteUint32Le(uint32(sizePtr), uint32(len(b))) {
+		return statusBadArgument
+	}
+	return statusOk
+}
+
+// allocate allocates size bytes in the filter's memory.
+func allocate(ctx context.Context, m api.Module, size uint32) (uint32, error) {
+	fn := m.ExportedFunction("proxy_on_memory_allocate")
+	if fn == nil {
+		fn = m.ExportedFunction("malloc")
+	}
+	res, err := fn.Call(ctx, uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	return uint32(res[0]), nil
+}
+
+// encodePairs serializes a header map as the ABI does: the number of
+// pairs, the size of each name and value, then each NUL-terminated name
+// and value.
+func encodePairs(pairs [][2]string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(pairs)))
+	for _, p := range pairs {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(p[0])))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(p[1])))
+	}
+	for _, p := range pairs {
+		b = append(append(b, p[0]...), 0)
+		b = append(append(b, p[1]...), 0)
+	}
+	return b
+}
+
+// decodePairs parses a header map serialized by encodePairs.
+func decodePairs(b []byte) ([][2]string, bool) {
+	if len(b) == 0 {
+		return nil, true
+	}
+	if len(b) < 4 {
+		return nil, false
+	}
+	n := int(binary.LittleEndian.Uint32(b))
+	if n > (len(b)-4)/8 {
+		return nil, false
+	}
+	sizes, data := b[4:4+8*n], b[4+8*n:]
+	pairs := make([][2]string, n)
+	for i := range pairs {
+		for j := range 2 {
+			size := int(binary.LittleEndian.Uint32(sizes[8*i+4*j:]))
+			if size+1 > len(data) || data[size] != 0 {
+				return nil, false
+			}
+			pairs[i][j] = string(data[:size])
+			data = data[size+1:]
+		}
+	}
+	return pairs, true
+}
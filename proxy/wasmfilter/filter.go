@@ -0,0 +1,386 @@
+// Package wasmfilter runs WebAssembly filters as stages of the middleware
+// chain. Filters use a subset of the proxy-wasm ABI, so filters built with
+// the proxy-wasm SDKs for Envoy run unchanged as long as they stick to
+// request and response headers, properties, logging and local responses.
+// Modules run in the wazero interpreter or compiler, which needs no cgo,
+// sandboxed with WASI and no filesystem or network access.
+package wasmfilter
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/logging"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/metrics"
+	"github.com/rajeev-chaurasia/aegis-zero/proxy/pages"
+)
+
+const (
+	// startTimeout bounds starting and configuring an instance
+	startTimeout = 10 * time.Second
+	// callTimeout bounds each callback of a request, so a looping filter
+	// can't hold requests forever
+	callTimeout = 100 * time.Millisecond
+
+	rootContextID = 1
+)
+
+var filterErrors = metrics.NewCounterVec("aegis_wasm_filter_errors_total",
+	"Requests refused because a WASM filter trapped, timed out or failed to start", "filter")
+
+// Module is a compiled filter module, from which filters are created.
+type Module struct {
+	path     string
+	runtime  wazero.Runtime
+	compiled wazero.CompiledModule
+	start    []string // _initialize for reactors
+	abi010   bool     // proxy_on_request_headers without end_of_stream
+}
+
+// Compile compiles the filter module at path, checking it implements the
+// proxy-wasm ABI.
+func Compile(ctx context.Context, path string) (*Module, error) {
+	wasm, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rt := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+	m := &Module{path: path, runtime: rt}
+	if err := m.compile(ctx, wasm); err != nil {
+		rt.Close(ctx)
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Module) compile(ctx context.Context, wasm []byte) error {
+	compiled, err := m.runtime.CompileModule(ctx, wasm)
+	if err != nil {
+		return err
+	}
+	m.compiled = compiled
+	exports := compiled.ExportedFunctions()
+	abi := false
+	for _, version := range []string{"proxy_abi_version_0_2_1", "proxy_abi_version_0_2_0", "proxy_abi_version_0_1_0"} {
+		if _, ok := exports[version]; ok {
+			abi = true
+		}
+	}
+	if !abi {
+		return errors.New("not a proxy-wasm module: it exports no proxy_abi_version function")
+	}
+	if _, ok := exports["proxy_on_memory_allocate"]; !ok {
+		if _, ok := exports["malloc"]; !ok {
+			return errors.New("exports neither proxy_on_memory_allocate nor malloc")
+		}
+	}
+	if def, ok := exports["proxy_on_request_headers"]; ok {
+		m.abi010 = len(def.ParamTypes()) == 2
+	}
+	if _, ok := exports["_initialize"]; ok {
+		m.start = []string{"_initialize"}
+	} else if _, ok := exports["_start"]; ok {
+		m.start = []string{"_start"}
+	}
+	if _, err := wasi_snapshot_preview1.Instantiate(ctx, m.runtime); err != nil {
+		return err
+	}
+	return instantiateHost(ctx, m.runtime, compiled)
+}
+
+// Close releases the module and every filter created from it.
+func (m *Module) Close(ctx context.Context) error {
+	return m.runtime.Close(ctx)
+}
+
+// Filter is a stage running a filter module with a plugin configuration.
+// Each request holds an instance of the module for its duration; idle
+// instances are kept for the next requests.
+type Filter struct {
+	module *Module
+	name   string
+	config []byte
+
+	mu   sync.Mutex
+	idle []*instance
+}
+
+// NewFilter creates the stage name running m with config, which the filter
+// reads as its plugin configuration. It starts an instance to check that
+// the filter accepts the configuration.
+func (m *Module) NewFilter(name string, config []byte) (*Filter, error) {
+	f := &Filter{module: m, name: name, config: config}
+	inst, err := f.newInstance()
+	if err != nil {
+		return nil, err
+	}
+	f.put(inst)
+	return f, nil
+}
+
+func (f *Filter) Name() string  { return f.name }
+func (f *Filter) Priority() int { return 0 }
+
+// Close closes the idle instances.
+func (f *Filter) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, inst := range f.idle {
+		inst.close()
+	}
+	f.idle = nil
+	return nil
+}
+
+// instance is an instance of the module, with its root context configured.
+type instance struct {
+	mod  api.Module
+	next uint32 // ID of the next request's context
+}
+
+func (f *Filter) newInstance() (*instance, error) {
+	ctx, cancel := context.WithTimeout(withCall(context.Background(), &call{filter: f}), startTimeout)
+	defer cancel()
+	cfg := wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions(f.module.start...).
+		WithSysWalltime().
+		WithSysNanotime().
+		WithRandSource(rand.Reader)
+	mod, err := f.module.runtime.InstantiateModule(ctx, f.module.compiled, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("starting %s: %w", f.module.path, err)
+	}
+	inst := &instance{mod: mod, next: rootContextID + 1}
+	if _, err := inst.call(ctx, "proxy_on_context_create", rootContextID, 0); err != nil {
+		inst.close()
+		return nil, err
+	}
+	for _, step := range []struct {
+		fn   string
+		size int
+	}{{"proxy_on_vm_start", 0}, {"proxy_on_configure", len(f.config)}} {
+		ok, err := inst.call(ctx, step.fn, rootContextID, uint64(step.size))
+		if err == nil && ok == 0 {
+			err = fmt.Errorf("%s of %s failed", step.fn, f.module.path)
+		}
+		if err != nil {
+			inst.close()
+			return nil, err
+		}
+	}
+	return inst, nil
+}
+
+// call calls the exported function fn and returns its result. Functions
+// the module doesn't export return 1, so optional callbacks returning a
+// bool succeed.
+func (inst *instance) call(ctx context.Context, fn string, args ...uint64) (uint64, error) {
+	f := inst.mod.ExportedFunction(fn)
+	if f == nil {
+		return 1, nil
+	}
+	res, err := f.Call(ctx, args...)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", fn, err)
+	}
+	if len(res) == 0 {
+		return 1, nil
+	}
+	return res[0], nil
+}
+
+func (inst *instance) close() {
+	inst.mod.Close(context.Background())
+}
+
+func (f *Filter) get() (*instance, error) {
+	f.mu.Lock()
+	if n := len(f.idle); n > 0 {
+		inst := f.idle[n-1]
+		f.idle = f.idle[:n-1]
+		f.mu.Unlock()
+		return inst, nil
+	}
+	f.mu.Unlock()
+	return f.newInstance()
+}
+
+func (f *Filter) put(inst *instance) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.idle) >= 4*runtime.GOMAXPROCS(0) {
+		inst.close()
+		return
+	}
+	f.idle = append(f.idle, inst)
+}
+
+// request is a request's use of an instance.
+type request struct {
+	filter *Filter
+	inst   *instance
+	id     uint64
+	stream *stream
+	failed bool
+}
+
+// callback calls a callback of the request's context, bounded by
+// callTimeout. Once one fails the instance is discarded, since a trap or
+// timeout leaves it unusable.
+func (q *request) callback(fn string, args ...uint64) (uint64, error) {
+	ctx := withCall(context.WithoutCancel(q.stream.r.Context()), &call{filter: q.filter, stream: q.stream})
+	ctx, cancel := context.WithTimeout(ctx, callTimeout)
+	defer cancel()
+	res, err := q.inst.call(ctx, fn, append([]uint64{q.id}, args...)...)
+	if err != nil {
+		q.failed = true
+		filterErrors.Inc(q.filter.name)
+		logging.For(ctx).Warnf("[Wasm] %s: %v", q.filter.name, err)
+	}
+	return res, err
+}
+
+// headers runs a header callback, returning whether it succeeded.
+func (q *request) headers(fn string, count int) bool {
+	args := []uint64{uint64(count), 0}
+	if q.filter.module.abi010 {
+		args = args[:1]
+	}
+	if q.inst.mod.ExportedFunction(fn) == nil {
+		return true
+	}
+	action, err := q.callback(fn, args...)
+	if err != nil {
+		return false
+	}
+	if action != actionContinue && q.stream.local == nil {
+		logging.For(q.stream.r.Context()).Warnf("[Wasm] %s: %s paused the stream, which isn't supported; continuing", q.filter.name, fn)
+	}
+	return true
+}
+
+// done deletes the request's context and returns the instance, unless a
+// callback failed.
+func (q *request) done() {
+	for _, fn := range []string{"proxy_on_done", "proxy_on_delete"} {
+		if !q.failed {
+			q.callback(fn)
+		}
+	}
+	if q.failed {
+		q.inst.close()
+		return
+	}
+	q.filter.put(q.inst)
+}
+
+// Handler runs the filter on the request headers before next, and on the
+// response headers next writes. A local response the filter sends replaces
+// the rest of the chain or the upstream's response. A filter that traps or
+// times out fails the request closed.
+func (f *Filter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inst, err := f.get()
+		if err != nil {
+			filterErrors.Inc(f.name)
+			logging.For(r.Context()).Warnf("[Wasm] %s: %v", f.name, err)
+			pages.WriteError(w, r, pages.ErrInternal)
+			return
+		}
+		q := &request{filter: f, inst: inst, id: uint64(inst.next), stream: &stream{r: r}}
+		inst.next++
+		defer q.done()
+
+		if _, err := q.callback("proxy_on_context_create", rootContextID); err != nil {
+			pages.WriteError(w, r, pages.ErrInternal)
+			return
+		}
+		if !q.headers("proxy_on_request_headers", len(q.stream.headerPairs(mapRequestHeaders))) {
+			pages.WriteError(w, r, pages.ErrInternal)
+			return
+		}
+		if q.stream.local != nil {
+			writeLocal(w, q.stream.local)
+			return
+		}
+		fw := &filterWriter{ResponseWriter: w, r: r, q: q}
+		next.ServeHTTP(fw, r)
+		if !fw.wroteHeader {
+			fw.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// filterWriter runs the response headers callback as the response is
+// written.
+type filterWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	q           *request
+	wroteHeader bool
+	replaced    bool // The upstream's response was replaced; drop its body
+}
+
+func (w *filterWriter) WriteHeader(code int) {
+	if w.wroteHeader || code < 200 {
+		if !w.wroteHeader {
+			w.ResponseWriter.WriteHeader(code)
+		}
+		return
+	}
+	w.wroteHeader = true
+	s := w.q.stream
+	s.response, s.status = w.Header(), code
+	if !w.q.headers("proxy_on_response_headers", len(s.headerPairs(mapResponseHeaders))) {
+		w.replaced = true
+		clear(w.Header())
+		pages.WriteError(w.ResponseWriter, w.r, pages.ErrInternal)
+		return
+	}
+	if s.local != nil {
+		w.replaced = true
+		clear(w.Header())
+		writeLocal(w.ResponseWriter, s.local)
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *filterWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *filterWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func writeLocal(w http.ResponseWriter, local *localResponse) {
+	h := w.Header()
+	for _, p := range local.headers {
+		if p[0] != "" && p[0][0] != ':' {
+			h.Add(p[0], p[1])
+		}
+	}
+	h.Set("Content-Length", strconv.Itoa(len(local.body)))
+	w.WriteHeader(local.status)
+	w.Write(local.body)
+}
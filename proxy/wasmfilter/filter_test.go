@@ -0,0 +1,184 @@
+package wasmfilter
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var (
+	buildOnce sync.Once
+	wasmPath  string
+	buildErr  error
+)
+
+// testModule compiles testdata/filter for wasip1, skipping the test if the
+// toolchain can't.
+func testModule(t *testing.T) *Module {
+	t.Helper()
+	buildOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "wasmfilter")
+		if err != nil {
+			buildErr = err
+			return
+		}
+		wasmPath = filepath.Join(dir, "filter.wasm")
+		cmd := exec.Command("go", "build", "-buildmode=c-shared", "-o", wasmPath, "./testdata/filter")
+		cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			buildErr = err
+			t.Logf("%s", out)
+		}
+	})
+	if buildErr != nil {
+		t.Skipf("building the test filter: %v", buildErr)
+	}
+	m, err := Compile(context.Background(), wasmPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { m.Close(context.Background()) })
+	return m
+}
+
+func TestFilter(t *testing.T) {
+	f, err := testModule(t).NewFilter("test", []byte(`{"greeting":"hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var upstream *http.Request
+	h := f.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+		w.Header().Set("X-Upstream", r.Header.Get("X-Upstream"))
+		io.WriteString(w, "upstream")
+	}))
+
+	tests := []struct {
+		name        string
+		header      [2]string
+		status      int
+		body        string
+		reachesNext bool
+		check       func(t *testing.T, w *httptest.ResponseRecorder)
+	}{
+		{name: "continue", status: 200, body: "upstream", reachesNext: true, check: func(t *testing.T, w *httptest.ResponseRecorder) {
+			if got := upstream.Header.Get("X-Filtered-Path"); got != "/path?q=1" {
+				t.Errorf("X-Filtered-Path %q, want the request path", got)
+			}
+			if got := upstream.Header.Get("X-Client-Ip"); got != "" {
+				t.Errorf("X-Client-IP %q without a request context, want none", got)
+			}
+			if got := w.Header().Get("X-Upstream"); got != "seen" {
+				t.Errorf("response X-Upstream %q, want seen", got)
+			}
+			if got := w.Header().Get("X-Config"); got != `{"greeting":"hello"}` {
+				t.Errorf("response X-Config %q, want the plugin configuration", got)
+			}
+		}},
+		{name: "local response", header: [2]string{"X-Deny", "test"}, status: 403, body: "denied", check: func(t *testing.T, w *httptest.ResponseRecorder) {
+			if got := w.Header().Get("X-Filter"); got != "deny" {
+				t.Errorf("X-Filter %q, want deny", got)
+			}
+		}},
+		{name: "response replaced", header: [2]string{"X-Upstream", "replace"}, status: 502, body: "replaced", reachesNext: true},
+		{name: "trap", header: [2]string{"X-Trap", "1"}, status: 500},
+		{name: "timeout", header: [2]string{"X-Loop", "1"}, status: 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream = nil
+			r := httptest.NewRequest(http.MethodGet, "/path?q=1", nil)
+			if tt.header[0] != "" {
+				r.Header.Set(tt.header[0], tt.header[1])
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.body != "" && w.Body.String() != tt.body {
+				t.Errorf("body %q, want %q", w.Body.String(), tt.body)
+			}
+			if got := upstream != nil; got != tt.reachesNext {
+				t.Errorf("reached next %t, want %t", got, tt.reachesNext)
+			}
+			if tt.check != nil {
+				tt.check(t, w)
+			}
+		})
+	}
+	// Failed instances are replaced
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != 200 {
+		t.Errorf("status %d after failures, want 200", w.Code)
+	}
+}
+
+func TestFilterConcurrent(t *testing.T) {
+	f, err := testModule(t).NewFilter("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	h := f.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Filtered-Path"))
+	}))
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := "/" + strings.Repeat("a", i)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			if w.Body.String() != path {
+				t.Errorf("body %q, want %q", w.Body.String(), path)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestFilterRejectsConfiguration(t *testing.T) {
+	if _, err := testModule(t).NewFilter("test", []byte(`{"mode":"reject"}`)); err == nil {
+		t.Error("filter accepted a configuration its proxy_on_configure rejected")
+	}
+}
+
+func TestCompileRejectsOtherModules(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "empty.wasm")
+	// An empty module: the magic number and version
+	if err := os.WriteFile(path, []byte("\x00asm\x01\x00\x00\x00"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compile(context.Background(), path); err == nil || !strings.Contains(err.Error(), "proxy-wasm") {
+		t.Errorf("Compile = %v, want a proxy-wasm error", err)
+	}
+}
+
+func TestPairs(t *testing.T) {
+	pairs := [][2]string{{":method", "GET"}, {"x-a", ""}, {"x-b", "two words"}}
+	got, ok := decodePairs(encodePairs(pairs))
+	if !ok || len(got) != len(pairs) {
+		t.Fatalf("decodePairs(encodePairs) = %v, %t", got, ok)
+	}
+	for i := range pairs {
+		if got[i] != pairs[i] {
+			t.Errorf("pair %d = %q, want %q", i, got[i], pairs[i])
+		}
+	}
+	for _, bad := range [][]byte{{1, 0}, {1, 0, 0, 0}, {1, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0, 'a', 0}} {
+		if _, ok := decodePairs(bad); ok {
+			t.Errorf("decodePairs(%v) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+// Command filter is a proxy-wasm filter for the tests, built with
+// GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared.
+//
+// It refuses requests with an X-Deny header, traps on X-Trap, loops on
+// X-Loop, and otherwise adds X-Filtered-Path and X-Client-IP to the request,
+// and X-Config and X-Upstream: seen to the response. A plugin configuration
+// containing "reject" fails to configure.
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"unsafe"
+)
+
+const (
+	requestHeaders  = 0
+	responseHeaders = 2
+	pluginConfig    = 7
+)
+
+//go:wasmimport env proxy_get_header_map_value
+func getHeaderMapValue(mapType, keyPtr, keySize, retPtr, retSize uint32) uint32
+
+//go:wasmimport env proxy_replace_header_map_value
+func replaceHeaderMapValue(mapType, keyPtr, keySize, valuePtr, valueSize uint32) uint32
+
+//go:wasmimport env proxy_get_property
+func getProperty(pathPtr, pathSize, retPtr, retSize uint32) uint32
+
+//go:wasmimport env proxy_get_buffer_bytes
+func getBufferBytes(bufferType, start, maxSize, retPtr, retSize uint32) uint32
+
+//go:wasmimport env proxy_send_local_response
+func sendLocalResponse(status, detailsPtr, detailsSize, bodyPtr, bodySize, headersPtr, headersSize, grpcStatus uint32) uint32
+
+//go:wasmimport env proxy_log
+func proxyLog(level, msgPtr, msgSize uint32) uint32
+
+//go:wasmimport env proxy_set_tick_period_milliseconds
+func setTickPeriod(period uint32) uint32
+
+// allocated keeps the buffers the host writes into alive.
+var allocated = map[uint32][]byte{}
+
+var config string
+
+func ptr(b []byte) uint32 {
+	if len(b) == 0 {
+		return 0
+	}
+	return uint32(uintptr(unsafe.Pointer(&b[0])))
+}
+
+func str(s string) (uint32, uint32) {
+	b := []byte(s)
+	allocated[ptr(b)] = b
+	return ptr(b), uint32(len(b))
+}
+
+// returned reads what the host returned through retPtr and retSize.
+func returned(call func(retPtr, retSize uint32) uint32) (string, bool) {
+	var p, size uint32
+	if call(uint32(uintptr(unsafe.Pointer(&p))), uint32(uintptr(unsafe.Pointer(&size)))) != 0 {
+		return "", false
+	}
+	b := allocated[p]
+	delete(allocated, p)
+	return string(b[:size]), true
+}
+
+func header(mapType uint32, name string) (string, bool) {
+	kp, ks := str(name)
+	return returned(func(rp, rs uint32) uint32 { return getHeaderMapValue(mapType, kp, ks, rp, rs) })
+}
+
+func setHeader(mapType uint32, name, value string) {
+	kp, ks := str(name)
+	vp, vs := str(value)
+	replaceHeaderMapValue(mapType, kp, ks, vp, vs)
+}
+
+func property(path ...string) string {
+	pp, ps := str(strings.Join(path, "\x00"))
+	v, _ := returned(func(rp, rs uint32) uint32 { return getProperty(pp, ps, rp, rs) })
+	return v
+}
+
+//go:wasmexport proxy_abi_version_0_2_1
+func abiVersion() {}
+
+//go:wasmexport proxy_on_memory_allocate
+func onMemoryAllocate(size uint32) uint32 {
+	b := make([]byte, size)
+	allocated[ptr(b)] = b
+	return ptr(b)
+}
+
+//go:wasmexport proxy_on_context_create
+func onContextCreate(contextID, rootContextID uint32) {}
+
+//go:wasmexport proxy_on_vm_start
+func onVMStart(contextID, size uint32) uint32 {
+	// Ticks aren't implemented; the stub says so
+	if setTickPeriod(1000) != 12 {
+		return 0
+	}
+	return 1
+}
+
+//go:wasmexport proxy_on_configure
+func onConfigure(contextID, size uint32) uint32 {
+	config, _ = returned(func(rp, rs uint32) uint32 { return getBufferBytes(pluginConfig, 0, size, rp, rs) })
+	return boolean(!strings.Contains(config, "reject"))
+}
+
+//go:wasmexport proxy_on_request_headers
+func onRequestHeaders(contextID, headers, endOfStream uint32) uint32 {
+	if _, ok := header(requestHeaders, "x-trap"); ok {
+		panic("trap")
+	}
+	if _, ok := header(requestHeaders, "x-loop"); ok {
+		for {
+		}
+	}
+	if reason, ok := header(requestHeaders, "x-deny"); ok {
+		mp, ms := str("denied: " + reason)
+		bp, bs := str("denied")
+		hp, hs := str(string(pairs([2]string{"x-filter", "deny"})))
+		sendLocalResponse(403, 0, 0, bp, bs, hp, hs, 0)
+		proxyLog(2, mp, ms)
+		return 1
+	}
+	setHeader(requestHeaders, "x-filtered-path", property("request", "path"))
+	setHeader(requestHeaders, "x-client-ip", property("aegis", "client_ip"))
+	return 0
+}
+
+//go:wasmexport proxy_on_response_headers
+func onResponseHeaders(contextID, headers, endOfStream uint32) uint32 {
+	if v, ok := header(responseHeaders, "x-upstream"); ok && v == "replace" {
+		bp, bs := str("replaced")
+		sendLocalResponse(502, 0, 0, bp, bs, 0, 0, 0)
+		return 1
+	}
+	setHeader(responseHeaders, "x-upstream", "seen")
+	setHeader(responseHeaders, "x-config", config)
+	return 0
+}
+
+func pairs(ps ...[2]string) []byte {
+	b := binary.LittleEndian.AppendUint32(nil, uint32(len(ps)))
+	for _, p := range ps {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(p[0])))
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(p[1])))
+	}
+	for _, p := range ps {
+		b = append(append(b, p[0]...), 0)
+		b = append(append(b, p[1]...), 0)
+	}
+	return b
+}
+
+func boolean(b bool) uint32 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func main() {}